@@ -0,0 +1,1054 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// 用户状态标记
+const (
+	USER_FLAG_ENABLED     = 1 << 0 // on 关闭的用户不能认证
+	USER_FLAG_NOPASS      = 1 << 1 // 任意密码都可以认证
+	USER_FLAG_ALLKEYS     = 1 << 2 // 可以访问所有 key
+	USER_FLAG_ALLCHANNELS = 1 << 3 // 可以访问所有频道
+)
+
+// 权限检查的结果 也是 ACL LOG 中记录的原因
+const (
+	ACL_OK = iota
+	ACL_DENIED_CMD
+	ACL_DENIED_KEY
+	ACL_DENIED_AUTH
+	ACL_DENIED_CHANNEL
+)
+
+// 被拒绝的命令是在哪里执行的
+const (
+	ACL_LOG_CTX_TOPLEVEL = iota
+	ACL_LOG_CTX_LUA
+	ACL_LOG_CTX_MULTI
+)
+
+const (
+	ACL_LOG_GROUPING_MAX_TIME_DELTA = 60000 // 毫秒 这段时间内相同的拒绝合并成一条
+	ACL_DEFAULT_GENPASS_BITS        = 256
+)
+
+var aclCommandCategories = []struct {
+	name string
+	flag int
+}{
+	{"keyspace", CMD_CATEGORY_KEYSPACE},
+	{"read", CMD_CATEGORY_READ},
+	{"write", CMD_CATEGORY_WRITE},
+	{"set", CMD_CATEGORY_SET},
+	{"sortedset", CMD_CATEGORY_SORTEDSET},
+	{"list", CMD_CATEGORY_LIST},
+	{"hash", CMD_CATEGORY_HASH},
+	{"string", CMD_CATEGORY_STRING},
+	{"pubsub", CMD_CATEGORY_PUBSUB},
+	{"admin", CMD_CATEGORY_ADMIN},
+	{"fast", CMD_CATEGORY_FAST},
+	{"slow", CMD_CATEGORY_SLOW},
+	{"blocking", CMD_CATEGORY_BLOCKING},
+	{"dangerous", CMD_CATEGORY_DANGEROUS},
+	{"connection", CMD_CATEGORY_CONNECTION},
+	{"transaction", CMD_CATEGORY_TRANSACTION},
+	{"scripting", CMD_CATEGORY_SCRIPTING},
+}
+
+type aclUser struct {
+	name      string
+	flags     int
+	passwords []string // 密码的 SHA256 十六进制
+	// 可以执行的命令 只允许部分子命令的命令记录在 allowedSubcommands 中
+	allowedCommands    map[string]bool
+	allowedSubcommands map[string][]string
+	cmdRules           []string // 按顺序生效的命令规则 用于 ACL LIST 和 ACL SAVE
+	patterns           []string // key 的模式
+	channels           []string // 频道的模式
+}
+
+type aclLogEntry struct {
+	count    int64
+	reason   int
+	context  int
+	object   string // 被拒绝的命令 key 或者频道
+	username string
+	ctime    int64  // 最后一次发生的时间（毫秒）
+	cinfo    string // 最后一次发生时客户端的信息
+}
+
+var (
+	errAclSyntax          = errors.New("Syntax error")
+	errAclUnknownCommand  = errors.New("Unknown command or category name in ACL")
+	errAclBadHash         = errors.New("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+	errAclNoSuchPassword  = errors.New("The password you are trying to remove from the user does not exist")
+	errAclKeyAfterAll     = errors.New("Adding a pattern after the * pattern (or the 'allkeys' flag) is not valid and does not have any effect. Try 'resetkeys' to start with an empty list of patterns")
+	errAclChannelAfterAll = errors.New("Adding a pattern after the * pattern (or the 'allchannels' flag) is not valid and does not have any effect. Try 'resetchannels' to start with an empty list of channels")
+)
+
+func aclGetCommandCategoryFlagByName(name string) int {
+	for _, cat := range aclCommandCategories {
+		if cat.name == name {
+			return cat.flag
+		}
+	}
+	return 0
+}
+
+// 由命令标记推导出的类别
+func setImplicitACLCategories(cmd *GodisCommand) {
+	if cmd.flags&CMD_WRITE != 0 {
+		cmd.flags |= CMD_CATEGORY_WRITE
+	}
+	if cmd.flags&CMD_READONLY != 0 {
+		cmd.flags |= CMD_CATEGORY_READ
+	}
+	if cmd.flags&CMD_ADMIN != 0 {
+		cmd.flags |= CMD_CATEGORY_ADMIN | CMD_CATEGORY_DANGEROUS
+	}
+	if cmd.flags&CMD_PUBSUB != 0 {
+		cmd.flags |= CMD_CATEGORY_PUBSUB
+	}
+	if cmd.flags&CMD_FAST != 0 {
+		cmd.flags |= CMD_CATEGORY_FAST
+	}
+	if cmd.flags&CMD_CATEGORY_FAST == 0 {
+		cmd.flags |= CMD_CATEGORY_SLOW
+	}
+}
+
+/*
+启动时创建 default 用户 可以执行所有命令 不需要密码
+requirepass 和 ACL 文件会在之后修改它
+*/
+func aclInit() {
+	server.aclUsers = make(map[string]*aclUser)
+	server.defaultUser = aclCreateDefaultUser()
+	server.aclUsers["default"] = server.defaultUser
+	server.aclLog = nil
+}
+
+func aclCreateUser(name string) *aclUser {
+	return &aclUser{
+		name:               name,
+		allowedCommands:    make(map[string]bool),
+		allowedSubcommands: make(map[string][]string),
+	}
+}
+
+func aclCreateDefaultUser() *aclUser {
+	u := aclCreateUser("default")
+	for _, op := range []string{"+@all", "~*", "&*", "on", "nopass"} {
+		aclSetUser(u, op)
+	}
+	return u
+}
+
+func aclGetUserByName(name string) *aclUser {
+	return server.aclUsers[name]
+}
+
+func (u *aclUser) dup() *aclUser {
+	nu := *u
+	nu.passwords = append([]string(nil), u.passwords...)
+	nu.allowedCommands = make(map[string]bool, len(u.allowedCommands))
+	for name, ok := range u.allowedCommands {
+		nu.allowedCommands[name] = ok
+	}
+	nu.allowedSubcommands = make(map[string][]string, len(u.allowedSubcommands))
+	for name, subs := range u.allowedSubcommands {
+		nu.allowedSubcommands[name] = append([]string(nil), subs...)
+	}
+	nu.cmdRules = append([]string(nil), u.cmdRules...)
+	nu.patterns = append([]string(nil), u.patterns...)
+	nu.channels = append([]string(nil), u.channels...)
+	return &nu
+}
+
+func aclHashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+func aclValidPasswordHash(hash string) bool {
+	if len(hash) != 64 {
+		return false
+	}
+	for i := 0; i < len(hash); i++ {
+		if !(hash[i] >= '0' && hash[i] <= '9' || hash[i] >= 'a' && hash[i] <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func removeString(list []string, s string) ([]string, bool) {
+	i := indexOfString(list, s)
+	if i < 0 {
+		return list, false
+	}
+	return append(list[:i], list[i+1:]...), true
+}
+
+/*
+对用户执行一条规则 和 ACL SETUSER 的参数一致
+on off nopass resetpass >password <password #hash !hash
+~pattern allkeys resetkeys &pattern allchannels resetchannels
++command -command +@category -@category +command|subcommand allcommands nocommands reset
+*/
+func aclSetUser(u *aclUser, op string) error {
+	if op == "" {
+		return errAclSyntax
+	}
+	switch strings.ToLower(op) {
+	case "on":
+		u.flags |= USER_FLAG_ENABLED
+	case "off":
+		u.flags &^= USER_FLAG_ENABLED
+	case "nopass":
+		u.flags |= USER_FLAG_NOPASS
+		u.passwords = nil
+	case "resetpass":
+		u.flags &^= USER_FLAG_NOPASS
+		u.passwords = nil
+	case "allkeys", "~*":
+		u.flags |= USER_FLAG_ALLKEYS
+		u.patterns = nil
+	case "resetkeys":
+		u.flags &^= USER_FLAG_ALLKEYS
+		u.patterns = nil
+	case "allchannels", "&*":
+		u.flags |= USER_FLAG_ALLCHANNELS
+		u.channels = nil
+	case "resetchannels":
+		u.flags &^= USER_FLAG_ALLCHANNELS
+		u.channels = nil
+	case "allcommands":
+		return aclSetUserCommandRule(u, "+@all")
+	case "nocommands":
+		return aclSetUserCommandRule(u, "-@all")
+	case "reset":
+		for _, op := range []string{"resetpass", "resetkeys", "resetchannels", "off", "-@all"} {
+			aclSetUser(u, op)
+		}
+	default:
+		switch op[0] {
+		case '>', '#':
+			hash := op[1:]
+			if op[0] == '>' {
+				hash = aclHashPassword(op[1:])
+			} else if !aclValidPasswordHash(hash) {
+				return errAclBadHash
+			}
+			if indexOfString(u.passwords, hash) < 0 {
+				u.passwords = append(u.passwords, hash)
+			}
+			u.flags &^= USER_FLAG_NOPASS
+		case '<', '!':
+			hash := op[1:]
+			if op[0] == '<' {
+				hash = aclHashPassword(op[1:])
+			} else if !aclValidPasswordHash(hash) {
+				return errAclBadHash
+			}
+			var ok bool
+			if u.passwords, ok = removeString(u.passwords, hash); !ok {
+				return errAclNoSuchPassword
+			}
+		case '~':
+			if u.flags&USER_FLAG_ALLKEYS != 0 {
+				return errAclKeyAfterAll
+			}
+			if indexOfString(u.patterns, op[1:]) < 0 {
+				u.patterns = append(u.patterns, op[1:])
+			}
+		case '&':
+			if u.flags&USER_FLAG_ALLCHANNELS != 0 {
+				return errAclChannelAfterAll
+			}
+			if indexOfString(u.channels, op[1:]) < 0 {
+				u.channels = append(u.channels, op[1:])
+			}
+		case '+', '-':
+			return aclSetUserCommandRule(u, op)
+		default:
+			return errAclSyntax
+		}
+	}
+	return nil
+}
+
+// +command -command +@category -@category +command|subcommand
+func aclSetUserCommandRule(u *aclUser, op string) error {
+	allow := op[0] == '+'
+	name := strings.ToLower(op[1:])
+	if name == "@all" {
+		for cmdName := range server.commands {
+			aclSetUserCommand(u, cmdName, allow)
+		}
+	} else if strings.HasPrefix(name, "@") {
+		flag := aclGetCommandCategoryFlagByName(name[1:])
+		if flag == 0 {
+			return errAclUnknownCommand
+		}
+		for cmdName, cmd := range server.commands {
+			if cmd.flags&flag != 0 {
+				aclSetUserCommand(u, cmdName, allow)
+			}
+		}
+	} else if i := strings.IndexByte(name, '|'); i >= 0 {
+		// 只能单独允许子命令 不能单独禁止
+		cmdName, sub := name[:i], name[i+1:]
+		if !allow || lookupCommand(cmdName) == nil || sub == "" || strings.IndexByte(sub, '|') >= 0 {
+			return errAclUnknownCommand
+		}
+		if !u.allowedCommands[cmdName] && indexOfString(u.allowedSubcommands[cmdName], sub) < 0 {
+			u.allowedSubcommands[cmdName] = append(u.allowedSubcommands[cmdName], sub)
+		}
+	} else {
+		if lookupCommand(name) == nil {
+			return errAclUnknownCommand
+		}
+		aclSetUserCommand(u, name, allow)
+	}
+	aclUpdateCommandRules(u, op[:1]+name)
+	return nil
+}
+
+func aclSetUserCommand(u *aclUser, name string, allow bool) {
+	if allow {
+		u.allowedCommands[name] = true
+	} else {
+		delete(u.allowedCommands, name)
+	}
+	delete(u.allowedSubcommands, name)
+}
+
+/*
+记录命令规则 后面的规则完全覆盖前面针对同一个命令或类别的规则 前面的可以去掉
++@all -@all 覆盖之前所有的规则 规则列表为空表示 -@all
+*/
+func aclUpdateCommandRules(u *aclUser, rule string) {
+	if rule == "+@all" || rule == "-@all" {
+		u.cmdRules = nil
+		if rule == "+@all" {
+			u.cmdRules = []string{rule}
+		}
+		return
+	}
+	target := rule[1:]
+	rules := u.cmdRules[:0]
+	for _, r := range u.cmdRules {
+		if r[1:] == target || !strings.HasPrefix(target, "@") && strings.HasPrefix(r[1:], target+"|") {
+			continue
+		}
+		rules = append(rules, r)
+	}
+	u.cmdRules = append(rules, rule)
+}
+
+func aclDescribeUserCommandRules(u *aclUser) string {
+	if len(u.cmdRules) > 0 && u.cmdRules[0] == "+@all" {
+		return strings.Join(u.cmdRules, " ")
+	}
+	return strings.Join(append([]string{"-@all"}, u.cmdRules...), " ")
+}
+
+func aclDescribeUserKeys(u *aclUser) string {
+	if u.flags&USER_FLAG_ALLKEYS != 0 {
+		return "~*"
+	}
+	pats := make([]string, len(u.patterns))
+	for i, p := range u.patterns {
+		pats[i] = "~" + p
+	}
+	return strings.Join(pats, " ")
+}
+
+func aclDescribeUserChannels(u *aclUser) string {
+	if u.flags&USER_FLAG_ALLCHANNELS != 0 {
+		return "&*"
+	}
+	pats := make([]string, len(u.channels))
+	for i, p := range u.channels {
+		pats[i] = "&" + p
+	}
+	return strings.Join(pats, " ")
+}
+
+func aclDescribeUserFlags(u *aclUser) []string {
+	flags := []string{"off"}
+	if u.flags&USER_FLAG_ENABLED != 0 {
+		flags[0] = "on"
+	}
+	if u.flags&USER_FLAG_NOPASS != 0 {
+		flags = append(flags, "nopass")
+	}
+	return flags
+}
+
+// ACL LIST 和 ACL 文件中的一行 可以用 ACL SETUSER 还原出同样的用户
+func aclDescribeUser(u *aclUser) string {
+	parts := []string{"user", u.name}
+	parts = append(parts, aclDescribeUserFlags(u)...)
+	for _, p := range u.passwords {
+		parts = append(parts, "#"+p)
+	}
+	if keys := aclDescribeUserKeys(u); keys != "" {
+		parts = append(parts, keys)
+	}
+	if u.flags&USER_FLAG_ALLCHANNELS != 0 {
+		parts = append(parts, "&*")
+	} else {
+		parts = append(parts, "resetchannels")
+		if channels := aclDescribeUserChannels(u); channels != "" {
+			parts = append(parts, channels)
+		}
+	}
+	parts = append(parts, aclDescribeUserCommandRules(u))
+	return strings.Join(parts, " ")
+}
+
+/* ----------------------------- 权限检查 ----------------------------- */
+
+func aclUserCanRunCommand(u *aclUser, cmd *GodisCommand, args []*Gobj) bool {
+	if u.allowedCommands[cmd.name] {
+		return true
+	}
+	return len(args) > 1 && indexOfString(u.allowedSubcommands[cmd.name], strings.ToLower(args[1].StrVal())) >= 0
+}
+
+func aclMatchKeyPatterns(u *aclUser, key string) bool {
+	for _, p := range u.patterns {
+		if stringmatch(p, key, false) {
+			return true
+		}
+	}
+	return false
+}
+
+// 订阅模式时要求和允许的模式完全一样 否则用户可以用更宽的模式收到不允许的消息
+func aclCheckChannelPerm(u *aclUser, channel string, literal bool) bool {
+	if u.flags&USER_FLAG_ALLCHANNELS != 0 {
+		return true
+	}
+	for _, p := range u.channels {
+		if literal && p == channel || !literal && stringmatch(p, channel, false) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+检查用户能否执行命令 返回拒绝的原因和对应参数的位置
+u 为 nil 的客户端（AOF 主节点的连接）不受限制 AUTH 这类命令总是可以执行
+*/
+func aclCheckAllUserCommandPerm(u *aclUser, cmd *GodisCommand, args []*Gobj) (int, int) {
+	if u == nil || cmd.flags&CMD_NO_AUTH != 0 {
+		return ACL_OK, 0
+	}
+	if !aclUserCanRunCommand(u, cmd, args) {
+		return ACL_DENIED_CMD, 0
+	}
+	if u.flags&USER_FLAG_ALLKEYS == 0 {
+		for _, pos := range getKeysFromCommand(cmd, args) {
+			if !aclMatchKeyPatterns(u, args[pos].StrVal()) {
+				return ACL_DENIED_KEY, pos
+			}
+		}
+	}
+	switch cmd.name {
+	case "publish":
+		if !aclCheckChannelPerm(u, args[1].StrVal(), false) {
+			return ACL_DENIED_CHANNEL, 1
+		}
+	case "subscribe", "psubscribe":
+		for j := 1; j < len(args); j++ {
+			if !aclCheckChannelPerm(u, args[j].StrVal(), cmd.name == "psubscribe") {
+				return ACL_DENIED_CHANNEL, j
+			}
+		}
+	}
+	return ACL_OK, 0
+}
+
+func aclCheckAllPerm(c *GodisClient, cmd *GodisCommand, args []*Gobj) (int, int) {
+	return aclCheckAllUserCommandPerm(c.user, cmd, args)
+}
+
+// 日志中记录的被拒绝的对象
+func aclDeniedObject(reason int, cmd *GodisCommand, args []*Gobj, pos int) string {
+	if reason == ACL_DENIED_CMD {
+		return cmd.name
+	}
+	return args[pos].StrVal()
+}
+
+func getAclErrorMessage(reason int, cmd *GodisCommand) string {
+	switch reason {
+	case ACL_DENIED_CMD:
+		return fmt.Sprintf("this user has no permissions to run the '%s' command", cmd.name)
+	case ACL_DENIED_KEY:
+		return "this user has no permissions to access one of the keys used as arguments"
+	case ACL_DENIED_CHANNEL:
+		return "this user has no permissions to access one of the channels used as arguments"
+	}
+	return "no permissions"
+}
+
+// 检查权限 拒绝时记录日志并回复错误 返回 false
+func aclCheckAllPermOrReply(c *GodisClient, cmd *GodisCommand, context int) bool {
+	reason, pos := aclCheckAllPerm(c, cmd, c.args)
+	if reason == ACL_OK {
+		return true
+	}
+	addACLLogEntry(c, reason, context, aclDeniedObject(reason, cmd, c.args, pos), "")
+	c.AddReplyError("-NOPERM " + getAclErrorMessage(reason, cmd))
+	return false
+}
+
+/* ----------------------------- 认证 ----------------------------- */
+
+// 设置了密码（或者关闭了 default 用户）之后 新连接需要先认证
+func authRequired(c *GodisClient) bool {
+	u := server.defaultUser
+	return (u.flags&USER_FLAG_NOPASS == 0 || u.flags&USER_FLAG_ENABLED == 0) && !c.authenticated
+}
+
+func aclCheckUserCredentials(username, password string) bool {
+	u := aclGetUserByName(username)
+	if u == nil || u.flags&USER_FLAG_ENABLED == 0 {
+		return false
+	}
+	if u.flags&USER_FLAG_NOPASS != 0 {
+		return true
+	}
+	hash := aclHashPassword(password)
+	for _, p := range u.passwords {
+		if subtle.ConstantTimeCompare([]byte(p), []byte(hash)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// 认证成功之后客户端切换到这个用户 失败时记录到 ACL LOG
+func aclAuthenticateUser(c *GodisClient, username, password string) bool {
+	if aclCheckUserCredentials(username, password) {
+		c.user = aclGetUserByName(username)
+		c.authenticated = true
+		return true
+	}
+	context := ACL_LOG_CTX_TOPLEVEL
+	if c.flags&CLIENT_MULTI != 0 {
+		context = ACL_LOG_CTX_MULTI
+	}
+	addACLLogEntry(c, ACL_DENIED_AUTH, context, "AUTH", username)
+	return false
+}
+
+// AUTH [username] password
+func authCommand(c *GodisClient) {
+	if len(c.args) > 3 {
+		c.AddReply(shared.syntaxerr)
+		return
+	}
+	username, password := "default", c.args[1].StrVal()
+	if len(c.args) == 3 {
+		username, password = c.args[1].StrVal(), c.args[2].StrVal()
+	} else if server.defaultUser.flags&USER_FLAG_NOPASS != 0 {
+		c.AddReplyError("AUTH <password> called without any password configured for the default user. " +
+			"Are you sure your configuration is correct?")
+		return
+	}
+	if !aclAuthenticateUser(c, username, password) {
+		c.AddReplyError("-WRONGPASS invalid username-password pair or user is disabled.")
+		return
+	}
+	c.AddReply(shared.ok)
+}
+
+/* ----------------------------- ACL LOG ----------------------------- */
+
+/*
+记录一次被拒绝的命令或认证 username 为空时使用客户端当前的用户
+一分钟内原因 上下文 对象和用户都相同的记录合并 只增加计数
+*/
+func addACLLogEntry(c *GodisClient, reason, context int, object, username string) {
+	if username == "" {
+		username = clientUserName(c)
+	}
+	now := GetMsTime()
+	cinfo := catClientInfoString(c)
+	for i, le := range server.aclLog {
+		if le.reason == reason && le.context == context && le.object == object && le.username == username &&
+			now-le.ctime < ACL_LOG_GROUPING_MAX_TIME_DELTA {
+			le.count++
+			le.ctime = now
+			le.cinfo = cinfo
+			// 移到最前面
+			copy(server.aclLog[1:i+1], server.aclLog[:i])
+			server.aclLog[0] = le
+			return
+		}
+	}
+	le := &aclLogEntry{count: 1, reason: reason, context: context, object: object,
+		username: username, ctime: now, cinfo: cinfo}
+	server.aclLog = append([]*aclLogEntry{le}, server.aclLog...)
+	if len(server.aclLog) > server.acllogMaxLen {
+		server.aclLog = server.aclLog[:server.acllogMaxLen]
+	}
+}
+
+func aclLogReasonString(reason int) string {
+	switch reason {
+	case ACL_DENIED_CMD:
+		return "command"
+	case ACL_DENIED_KEY:
+		return "key"
+	case ACL_DENIED_CHANNEL:
+		return "channel"
+	case ACL_DENIED_AUTH:
+		return "auth"
+	}
+	return "unknown"
+}
+
+func aclLogContextString(context int) string {
+	switch context {
+	case ACL_LOG_CTX_LUA:
+		return "lua"
+	case ACL_LOG_CTX_MULTI:
+		return "multi"
+	}
+	return "toplevel"
+}
+
+/* ----------------------------- 用户管理 ----------------------------- */
+
+// 用户名中不能有空白 否则 ACL 文件无法解析
+func aclValidUsername(name string) bool {
+	return name != "" && !strings.ContainsAny(name, " \t\r\n\x00")
+}
+
+// 先在副本上执行所有规则 全部成功之后才替换 出错时用户保持不变
+func aclSetUserFromRules(name string, ops []string) error {
+	u := aclGetUserByName(name)
+	if u == nil {
+		u = aclCreateUser(name)
+	} else {
+		u = u.dup()
+	}
+	for _, op := range ops {
+		if err := aclSetUser(u, op); err != nil {
+			return fmt.Errorf("Error in ACL SETUSER modifier '%s': %s", op, err)
+		}
+	}
+	aclReplaceUser(u)
+	return nil
+}
+
+// 替换同名的用户 已经认证的客户端改用新的用户
+func aclReplaceUser(u *aclUser) {
+	old := server.aclUsers[u.name]
+	server.aclUsers[u.name] = u
+	if u.name == "default" {
+		server.defaultUser = u
+	}
+	if old == nil {
+		return
+	}
+	for _, c := range server.clients {
+		if c.user == old {
+			c.user = u
+		}
+	}
+	aclKillPubsubClientsIfNeeded(u)
+}
+
+// 关闭订阅了用户不再允许的频道的客户端
+func aclKillPubsubClientsIfNeeded(u *aclUser) {
+	if u.flags&USER_FLAG_ALLCHANNELS != 0 {
+		return
+	}
+	for _, c := range server.clients {
+		if c.user != u {
+			continue
+		}
+		kill := false
+		for _, ch := range c.pubsubChannels {
+			kill = kill || !aclCheckChannelPerm(u, ch, false)
+		}
+		for _, pat := range c.pubsubPatterns {
+			kill = kill || !aclCheckChannelPerm(u, pat, true)
+		}
+		if kill {
+			aclKillClient(c)
+		}
+	}
+}
+
+// 正在执行命令的客户端先把回复发送出去再关闭
+func aclKillClient(c *GodisClient) {
+	if c == server.currentClient {
+		c.flags |= CLIENT_CLOSE_AFTER_REPLY
+	} else {
+		freeClient(c)
+	}
+}
+
+func aclDeleteUser(name string) {
+	u := server.aclUsers[name]
+	delete(server.aclUsers, name)
+	for _, c := range server.clients {
+		if c.user == u {
+			aclKillClient(c)
+		}
+	}
+}
+
+func aclSortedUsers() []*aclUser {
+	users := make([]*aclUser, 0, len(server.aclUsers))
+	for _, u := range server.aclUsers {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].name < users[j].name })
+	return users
+}
+
+/* ----------------------------- ACL 文件 ----------------------------- */
+
+/*
+启动时加载配置文件中的 user 指令或者 ACL 文件 两者不能同时使用
+requirepass 只修改 default 用户的密码 可以被它们覆盖
+*/
+func aclLoadUsersAtStartup(config *Config) error {
+	if config.RequirePass != "" {
+		aclUpdateDefaultUserPassword(config.RequirePass)
+	}
+	if len(config.Users) > 0 && config.AclFile != "" {
+		return errors.New("Configuring Redis with users defined in redis.conf and at the same setting an ACL file path is invalid. " +
+			"This setup is very likely to lead to configuration errors and security holes, please define either an ACL file " +
+			"or declare users directly in your redis.conf, but not both.")
+	}
+	for _, argv := range config.Users {
+		if !aclValidUsername(argv[0]) {
+			return fmt.Errorf("Error in user declaration '%s': Usernames can't contain spaces or null characters", argv[0])
+		}
+		if err := aclSetUserFromRules(argv[0], argv[1:]); err != nil {
+			return fmt.Errorf("Error in user declaration '%s': %v", argv[0], err)
+		}
+	}
+	server.aclFilename = config.AclFile
+	if server.aclFilename != "" {
+		if err := aclLoadFromFile(server.aclFilename); err != nil {
+			return fmt.Errorf("Aborting Redis startup because of ACL errors: %v", err)
+		}
+	}
+	return nil
+}
+
+// requirepass 为空表示不需要密码
+func aclUpdateDefaultUserPassword(password string) {
+	aclSetUser(server.defaultUser, "resetpass")
+	if password == "" {
+		aclSetUser(server.defaultUser, "nopass")
+	} else {
+		aclSetUser(server.defaultUser, ">"+password)
+	}
+}
+
+/*
+每行的格式是 user <username> rule1 rule2 ... 和 ACL LIST 的输出一致
+所有行都检查通过之后才替换现有的用户 没有定义 default 时使用默认的 default 用户
+*/
+func aclLoadFromFile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("Error loading ACLs, opening file '%s': %v", filename, err)
+	}
+	defer f.Close()
+
+	users := make(map[string]*aclUser)
+	var errs []string
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		argv, err := splitArgs(line)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s:%d: unbalanced quotes in acl line.", filename, lineno))
+			continue
+		}
+		if len(argv) < 2 || argv[0] != "user" {
+			errs = append(errs, fmt.Sprintf("%s:%d should start with user keyword.", filename, lineno))
+			continue
+		}
+		name := argv[1]
+		if !aclValidUsername(name) {
+			errs = append(errs, fmt.Sprintf("%s:%d: username '%s' contains invalid characters.", filename, lineno, name))
+			continue
+		}
+		if users[name] != nil {
+			errs = append(errs, fmt.Sprintf("%s:%d: duplicate user '%s' found.", filename, lineno, name))
+			continue
+		}
+		u := aclCreateUser(name)
+		for _, op := range argv[2:] {
+			if err := aclSetUser(u, op); err != nil {
+				errs = append(errs, fmt.Sprintf("%s:%d: %v.", filename, lineno, err))
+				u = nil
+				break
+			}
+		}
+		if u != nil {
+			users[name] = u
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, " "))
+	}
+	if users["default"] == nil {
+		users["default"] = aclCreateDefaultUser()
+	}
+	// 文件中没有的用户被删除 已经认证的客户端断开
+	for name := range server.aclUsers {
+		if users[name] == nil {
+			aclDeleteUser(name)
+		}
+	}
+	for _, u := range users {
+		aclReplaceUser(u)
+	}
+	return nil
+}
+
+// 先写临时文件再 rename 保证文件总是完整的
+func aclSaveToFile(filename string) error {
+	var b strings.Builder
+	for _, u := range aclSortedUsers() {
+		b.WriteString(aclDescribeUser(u))
+		b.WriteString("\n")
+	}
+	tmpfile := fmt.Sprintf("%s.tmp-%d", filename, os.Getpid())
+	if err := os.WriteFile(tmpfile, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpfile, filename); err != nil {
+		os.Remove(tmpfile)
+		return err
+	}
+	return nil
+}
+
+/* ----------------------------- ACL 命令 ----------------------------- */
+
+func aclCommand(c *GodisClient) {
+	sub := strings.ToLower(c.args[1].StrVal())
+	switch {
+	case sub == "setuser" && len(c.args) >= 3:
+		name := c.args[2].StrVal()
+		if !aclValidUsername(name) {
+			c.AddReplyError("Usernames can't contain spaces or null characters")
+			return
+		}
+		ops := make([]string, len(c.args)-3)
+		for i, arg := range c.args[3:] {
+			ops[i] = arg.StrVal()
+		}
+		if err := aclSetUserFromRules(name, ops); err != nil {
+			c.AddReplyError(err.Error())
+			return
+		}
+		c.AddReply(shared.ok)
+	case sub == "deluser" && len(c.args) >= 3:
+		deleted := 0
+		for _, arg := range c.args[2:] {
+			name := arg.StrVal()
+			if name == "default" {
+				c.AddReplyError("The 'default' user cannot be removed")
+				return
+			}
+		}
+		for _, arg := range c.args[2:] {
+			if aclGetUserByName(arg.StrVal()) != nil {
+				aclDeleteUser(arg.StrVal())
+				deleted++
+			}
+		}
+		c.AddReplyInt(int64(deleted))
+	case sub == "getuser" && len(c.args) == 3:
+		u := aclGetUserByName(c.args[2].StrVal())
+		if u == nil {
+			c.AddReplyNull()
+			return
+		}
+		c.AddReplyMapLen(6)
+		c.AddReplyBulkStr("flags")
+		flags := aclDescribeUserFlags(u)
+		c.AddReplyArrayLen(len(flags))
+		for _, f := range flags {
+			c.AddReplyBulkStr(f)
+		}
+		c.AddReplyBulkStr("passwords")
+		c.AddReplyArrayLen(len(u.passwords))
+		for _, p := range u.passwords {
+			c.AddReplyBulkStr(p)
+		}
+		c.AddReplyBulkStr("commands")
+		c.AddReplyBulkStr(aclDescribeUserCommandRules(u))
+		c.AddReplyBulkStr("keys")
+		c.AddReplyBulkStr(aclDescribeUserKeys(u))
+		c.AddReplyBulkStr("channels")
+		c.AddReplyBulkStr(aclDescribeUserChannels(u))
+		c.AddReplyBulkStr("selectors")
+		c.AddReplyArrayLen(0)
+	case (sub == "list" || sub == "users") && len(c.args) == 2:
+		users := aclSortedUsers()
+		c.AddReplyArrayLen(len(users))
+		for _, u := range users {
+			if sub == "list" {
+				c.AddReplyBulkStr(aclDescribeUser(u))
+			} else {
+				c.AddReplyBulkStr(u.name)
+			}
+		}
+	case sub == "whoami" && len(c.args) == 2:
+		c.AddReplyBulkStr(clientUserName(c))
+	case sub == "cat" && (len(c.args) == 2 || len(c.args) == 3):
+		if len(c.args) == 2 {
+			c.AddReplyArrayLen(len(aclCommandCategories))
+			for _, cat := range aclCommandCategories {
+				c.AddReplyBulkStr(cat.name)
+			}
+			return
+		}
+		flag := aclGetCommandCategoryFlagByName(strings.ToLower(c.args[2].StrVal()))
+		if flag == 0 {
+			c.AddReplyErrorFormat("Unknown category '%s'", c.args[2].StrVal())
+			return
+		}
+		var names []string
+		for name, cmd := range server.commands {
+			if cmd.flags&flag != 0 {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		c.AddReplyArrayLen(len(names))
+		for _, name := range names {
+			c.AddReplyBulkStr(name)
+		}
+	case sub == "log" && (len(c.args) == 2 || len(c.args) == 3):
+		aclLogCommand(c)
+	case (sub == "load" || sub == "save") && len(c.args) == 2:
+		if server.aclFilename == "" {
+			c.AddReplyError("This Redis instance is not configured to use an ACL file. You may want to specify users " +
+				"via the ACL SETUSER command and then issue a CONFIG REWRITE (assuming you have a Redis configuration " +
+				"file set) in order to store users in the Redis configuration.")
+			return
+		}
+		if sub == "load" {
+			if err := aclLoadFromFile(server.aclFilename); err != nil {
+				c.AddReplyError(err.Error())
+				return
+			}
+		} else if err := aclSaveToFile(server.aclFilename); err != nil {
+			serverLog(LL_WARNING, "Error saving ACLs to '%s': %v", server.aclFilename, err)
+			c.AddReplyError("There was an error trying to save the ACLs. Please check the server logs for more information")
+			return
+		}
+		c.AddReply(shared.ok)
+	case sub == "genpass" && (len(c.args) == 2 || len(c.args) == 3):
+		bits := int64(ACL_DEFAULT_GENPASS_BITS)
+		if len(c.args) == 3 {
+			var err error
+			bits, err = c.args[2].ParseInt()
+			if err != nil || bits <= 0 || bits > 4096 {
+				c.AddReplyError("ACL GENPASS argument must be the number of bits for the output password, " +
+					"a positive number up to 4096")
+				return
+			}
+		}
+		c.AddReplyBulkStr(getRandomHexChars(int((bits + 3) / 4)))
+	case sub == "dryrun" && len(c.args) >= 4:
+		// ACL DRYRUN username command [arg ...]
+		u := aclGetUserByName(c.args[2].StrVal())
+		if u == nil {
+			c.AddReplyErrorFormat("User '%s' not found", c.args[2].StrVal())
+			return
+		}
+		cmd := lookupCommand(strings.ToLower(c.args[3].StrVal()))
+		if cmd == nil {
+			c.AddReplyErrorFormat("Command '%s' not found", c.args[3].StrVal())
+			return
+		}
+		args := c.args[3:]
+		if (cmd.arity > 0 && cmd.arity != len(args)) || len(args) < -cmd.arity {
+			c.AddReplyErrorFormat("wrong number of arguments for '%s' command", cmd.name)
+			return
+		}
+		if reason, _ := aclCheckAllUserCommandPerm(u, cmd, args); reason != ACL_OK {
+			c.AddReplyBulkStr(fmt.Sprintf("This user has no permissions to run the '%s' command", cmd.name))
+			return
+		}
+		c.AddReply(shared.ok)
+	default:
+		c.AddReplyErrorFormat("unknown subcommand or wrong number of arguments for '%s'. Try ACL HELP.", c.args[1].StrVal())
+	}
+}
+
+// ACL LOG [count | RESET]
+func aclLogCommand(c *GodisClient) {
+	count := int64(10)
+	if len(c.args) == 3 {
+		if strings.EqualFold(c.args[2].StrVal(), "reset") {
+			server.aclLog = nil
+			c.AddReply(shared.ok)
+			return
+		}
+		var ok bool
+		if count, ok = getPositiveLongFromObjectOrReply(c, c.args[2], ""); !ok {
+			return
+		}
+	}
+	if count > int64(len(server.aclLog)) {
+		count = int64(len(server.aclLog))
+	}
+	now := GetMsTime()
+	c.AddReplyArrayLen(int(count))
+	for _, le := range server.aclLog[:count] {
+		c.AddReplyMapLen(7)
+		c.AddReplyBulkStr("count")
+		c.AddReplyInt(le.count)
+		c.AddReplyBulkStr("reason")
+		c.AddReplyBulkStr(aclLogReasonString(le.reason))
+		c.AddReplyBulkStr("context")
+		c.AddReplyBulkStr(aclLogContextString(le.context))
+		c.AddReplyBulkStr("object")
+		c.AddReplyBulkStr(le.object)
+		c.AddReplyBulkStr("username")
+		c.AddReplyBulkStr(le.username)
+		c.AddReplyBulkStr("age-seconds")
+		c.AddReplyDouble(float64(now-le.ctime) / 1000)
+		c.AddReplyBulkStr("client-info")
+		c.AddReplyBulkStr(le.cinfo)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAuth(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	expectReply(t, c, "-ERR AUTH <password> called without any password configured for the default user. "+
+		"Are you sure your configuration is correct?\r\n", "auth", "foo")
+	expectReply(t, c, "+OK\r\n", "auth", "default", "anything")
+
+	aclUpdateDefaultUserPassword("foo")
+	// 已经认证的连接不受影响
+	expectReply(t, c, "$-1\r\n", "get", "k")
+	c = newTestClient(t)
+	expectReply(t, c, "-NOAUTH Authentication required.\r\n", "get", "k")
+	expectReply(t, c, "-WRONGPASS invalid username-password pair or user is disabled.\r\n", "auth", "bar")
+	if got := c.run("hello", "3"); !strings.HasPrefix(got, "-NOAUTH HELLO must be called") {
+		t.Errorf("unexpected hello reply %q", got)
+	}
+	expectReply(t, c, "-NOAUTH Authentication required.\r\n", "multi")
+	expectReply(t, c, "+OK\r\n", "auth", "foo")
+	expectReply(t, c, "$-1\r\n", "get", "k")
+
+	c = newTestClient(t)
+	if got := c.run("hello", "2", "auth", "default", "foo"); !strings.HasPrefix(got, "*14\r\n") {
+		t.Errorf("unexpected hello reply %q", got)
+	}
+	expectReply(t, c, "$7\r\ndefault\r\n", "acl", "whoami")
+
+	log := c.run("acl", "log")
+	if !strings.HasPrefix(log, "*1\r\n") || !strings.Contains(log, "$6\r\nreason\r\n$4\r\nauth\r\n") ||
+		!strings.Contains(log, "$6\r\nobject\r\n$4\r\nAUTH\r\n") || !strings.Contains(log, "$5\r\ncount\r\n:1\r\n") {
+		t.Errorf("unexpected acl log %q", log)
+	}
+}
+
+// 没有认证的客户端不能发送很大的命令
+func TestAuthProtocolLimits(t *testing.T) {
+	initTestServer(t)
+	aclUpdateDefaultUserPassword("foo")
+	feed := func(c *GodisClient, input string) error {
+		c.queryBuf = append(c.queryBuf[:c.queryLen], input...)
+		c.queryLen += len(input)
+		return ProcessQueryBuf(c)
+	}
+	for _, input := range []string{"*11\r\n", "*1\r\n$536870912\r\n"} {
+		if err := feed(newTestClient(t), input); err == nil {
+			t.Errorf("%q: expect error", input)
+		}
+	}
+	c := newTestClient(t)
+	if err := feed(c, "*2\r\n$4\r\nauth\r\n$3\r\nfoo\r\n*1\r\n$536870912\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.takeReply(); got != "+OK\r\n" || c.bulkLen != 536870912 {
+		t.Errorf("unexpected reply %q bulkLen %d", got, c.bulkLen)
+	}
+}
+
+func TestAclSetUser(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	expectReply(t, c, "+OK\r\n", "acl", "setuser", "alice", "on", ">p1", "~cached:*", "+get", "+set", "-set", "+acl|whoami")
+	expectReply(t, c, "-ERR Error in ACL SETUSER modifier 'foo': Syntax error\r\n", "acl", "setuser", "alice", "-get", "foo")
+	expectReply(t, c, "-ERR Error in ACL SETUSER modifier '+nosuch': Unknown command or category name in ACL\r\n",
+		"acl", "setuser", "alice", "+nosuch")
+	expectReply(t, c, "-ERR Error in ACL SETUSER modifier '#abc': The password hash must be exactly 64 characters "+
+		"and contain only lowercase hexadecimal characters\r\n", "acl", "setuser", "alice", "#abc")
+	expectReply(t, c, "-ERR Error in ACL SETUSER modifier '<p2': The password you are trying to remove from the user "+
+		"does not exist\r\n", "acl", "setuser", "alice", "<p2")
+	expectReply(t, c, "-ERR Usernames can't contain spaces or null characters\r\n", "acl", "setuser", "a b")
+
+	// 出错的 SETUSER 不修改用户
+	hash := aclHashPassword("p1")
+	expect := "user alice on #" + hash + " ~cached:* resetchannels -@all +get -set +acl|whoami"
+	list := c.run("acl", "list")
+	if !strings.Contains(list, expect) || !strings.Contains(list, "user default on nopass ~* &* +@all") {
+		t.Errorf("unexpected acl list %q", list)
+	}
+	expectReply(t, c, "*2\r\n$5\r\nalice\r\n$7\r\ndefault\r\n", "acl", "users")
+	expectReply(t, c, "*12\r\n$5\r\nflags\r\n*1\r\n$2\r\non\r\n$9\r\npasswords\r\n*1\r\n$64\r\n"+hash+"\r\n"+
+		"$8\r\ncommands\r\n$27\r\n-@all +get -set +acl|whoami\r\n$4\r\nkeys\r\n$9\r\n~cached:*\r\n$8\r\nchannels\r\n$0\r\n\r\n"+
+		"$9\r\nselectors\r\n*0\r\n", "acl", "getuser", "alice")
+	expectReply(t, c, "$-1\r\n", "acl", "getuser", "nosuch")
+
+	expectReply(t, c, "+OK\r\n", "acl", "dryrun", "alice", "get", "cached:1")
+	expectReply(t, c, "$53\r\nThis user has no permissions to run the 'set' command\r\n",
+		"acl", "dryrun", "alice", "set", "cached:1", "v")
+
+	expectReply(t, c, "+OK\r\n", "auth", "alice", "p1")
+	expectReply(t, c, "$5\r\nalice\r\n", "acl", "whoami")
+	expectReply(t, c, "$-1\r\n", "get", "cached:1")
+	expectReply(t, c, "-NOPERM this user has no permissions to access one of the keys used as arguments\r\n", "get", "k")
+	expectReply(t, c, "-NOPERM this user has no permissions to run the 'set' command\r\n", "set", "cached:1", "v")
+	expectReply(t, c, "-NOPERM this user has no permissions to run the 'acl' command\r\n", "acl", "users")
+	if got := clientUserName(c); got != "alice" {
+		t.Errorf("expect alice, got %s", got)
+	}
+
+	// 重复的拒绝合并成一条 并移到最前面
+	c.run("set", "cached:1", "v")
+	if len(server.aclLog) != 3 || server.aclLog[0].object != "set" || server.aclLog[0].count != 2 ||
+		server.aclLog[1].object != "acl" || server.aclLog[2].reason != ACL_DENIED_KEY || server.aclLog[2].object != "k" ||
+		server.aclLog[2].username != "alice" {
+		t.Errorf("unexpected acl log %+v", server.aclLog)
+	}
+
+	// 关闭的用户不能认证 删除用户时断开已经认证的连接
+	other, _ := newTestConnClient(t)
+	other.run("acl", "setuser", "alice", "off")
+	expectReply(t, other, "-WRONGPASS invalid username-password pair or user is disabled.\r\n", "auth", "alice", "p1")
+	expectReply(t, other, "-ERR The 'default' user cannot be removed\r\n", "acl", "deluser", "alice", "default")
+	expectReply(t, other, ":1\r\n", "acl", "deluser", "alice", "nosuch")
+	if server.clients[c.fd] == c {
+		t.Errorf("client of deleted user not killed")
+	}
+}
+
+func TestAclCommandRules(t *testing.T) {
+	initTestServer(t)
+	u := aclCreateUser("u")
+	for _, op := range []string{"+@all", "-@dangerous", "+keys", "-keys", "+client|id", "+client|setname", "-client"} {
+		if err := aclSetUser(u, op); err != nil {
+			t.Fatalf("%s: %v", op, err)
+		}
+	}
+	if got := aclDescribeUserCommandRules(u); got != "+@all -@dangerous -keys -client" {
+		t.Errorf("unexpected rules %q", got)
+	}
+	if !u.allowedCommands["get"] || u.allowedCommands["keys"] || u.allowedCommands["flushall"] || u.allowedCommands["client"] {
+		t.Errorf("unexpected allowed commands")
+	}
+
+	// 按照描述重新创建出来的用户权限相同
+	u2 := aclCreateUser("u")
+	for _, op := range strings.Fields(aclDescribeUserCommandRules(u)) {
+		aclSetUser(u2, op)
+	}
+	for name := range server.commands {
+		if u.allowedCommands[name] != u2.allowedCommands[name] {
+			t.Errorf("%s: permission mismatch after replay", name)
+		}
+	}
+
+	c := newTestClient(t)
+	c.run("acl", "setuser", "bob", "on", "nopass", "allkeys", "+@read", "-@string", "+client|id")
+	c.run("auth", "bob", "x")
+	expectReply(t, c, "$-1\r\n", "hget", "h", "f")
+	expectReply(t, c, "-NOPERM this user has no permissions to run the 'get' command\r\n", "get", "k")
+	expectReply(t, c, ":"+strconv.FormatInt(c.id, 10)+"\r\n", "client", "id")
+	expectReply(t, c, "-NOPERM this user has no permissions to run the 'client' command\r\n", "client", "list")
+
+	c = newTestClient(t)
+	expectReply(t, c, "-ERR Unknown category 'foo'\r\n", "acl", "cat", "foo")
+	if got := c.run("acl", "cat"); !strings.HasPrefix(got, "*"+strconv.Itoa(len(aclCommandCategories))+"\r\n") ||
+		!strings.Contains(got, "$9\r\nsortedset\r\n") {
+		t.Errorf("unexpected acl cat %q", got)
+	}
+	blocking := c.run("acl", "cat", "blocking")
+	if !strings.Contains(blocking, "$5\r\nblpop\r\n") || strings.Contains(blocking, "$4\r\nlpop\r\n") {
+		t.Errorf("unexpected acl cat blocking %q", blocking)
+	}
+	if cmd := lookupCommand("lastsave"); cmd.flags&CMD_CATEGORY_ADMIN == 0 || cmd.flags&CMD_CATEGORY_FAST == 0 {
+		t.Errorf("unexpected lastsave categories")
+	}
+	if cmd := lookupCommand("save"); cmd.flags&CMD_CATEGORY_DANGEROUS == 0 || cmd.flags&CMD_CATEGORY_SLOW == 0 {
+		t.Errorf("unexpected save categories")
+	}
+}
+
+func TestAclChannels(t *testing.T) {
+	initTestServer(t)
+	admin := newTestClient(t)
+	admin.run("acl", "setuser", "sub", "on", "nopass", "+@all", "&news.*")
+	c, _ := newTestConnClient(t)
+	c.run("auth", "sub", "x")
+	expectReply(t, c, ":0\r\n", "publish", "news.1", "hi")
+	expectReply(t, c, "-NOPERM this user has no permissions to access one of the channels used as arguments\r\n",
+		"publish", "sports", "hi")
+	expectReply(t, c, "-NOPERM this user has no permissions to access one of the channels used as arguments\r\n",
+		"psubscribe", "news*")
+	expectReply(t, c, "*3\r\n$10\r\npsubscribe\r\n$6\r\nnews.*\r\n:1\r\n", "psubscribe", "news.*")
+
+	// 不再允许订阅的频道时关闭连接
+	admin.run("acl", "setuser", "sub", "resetchannels", "&news.1")
+	if server.clients[c.fd] == c {
+		t.Errorf("subscribed client not killed")
+	}
+	if got := admin.run("acl", "getuser", "sub"); !strings.Contains(got, "$8\r\nchannels\r\n$7\r\n&news.1\r\n") {
+		t.Errorf("unexpected getuser %q", got)
+	}
+}
+
+func TestAclMultiAndScripts(t *testing.T) {
+	initTestServer(t)
+	admin := newTestClient(t)
+	admin.run("acl", "setuser", "w", "on", "nopass", "allkeys", "+multi", "+exec", "+set", "+get", "+eval")
+	c := newTestClient(t)
+	c.run("auth", "w", "x")
+	c.run("multi")
+	expectReply(t, c, "-NOPERM this user has no permissions to run the 'del' command\r\n", "del", "k")
+	expectReply(t, c, "-EXECABORT Transaction discarded because of previous errors.\r\n", "exec")
+
+	// 排队之后权限被修改
+	c.run("multi")
+	c.run("set", "k", "v")
+	c.run("get", "k")
+	admin.run("acl", "setuser", "w", "-set")
+	expectReply(t, c, "*2\r\n-NOPERM ACLs rules changed between the moment the transaction was accumulated and the "+
+		"EXEC call. This command is no longer allowed for the following reason: this user has no permissions to run "+
+		"the 'set' command\r\n$-1\r\n", "exec")
+	if le := server.aclLog[0]; le.context != ACL_LOG_CTX_MULTI || le.object != "set" {
+		t.Errorf("unexpected acl log %+v", le)
+	}
+
+	if got := c.run("eval", "return redis.call('set', KEYS[1], 'v')", "1", "k"); !strings.HasPrefix(got,
+		"-NOPERM this user has no permissions to run the 'set' command script:") {
+		t.Errorf("unexpected eval reply %q", got)
+	}
+	if le := server.aclLog[0]; le.context != ACL_LOG_CTX_LUA || le.object != "set" || le.username != "w" {
+		t.Errorf("unexpected acl log %+v", le)
+	}
+	expectReply(t, c, "$-1\r\n", "eval", "return redis.call('get', KEYS[1])", "1", "k")
+	expectReply(t, admin, "+OK\r\n", "acl", "log", "reset")
+	if len(server.aclLog) != 0 {
+		t.Errorf("acl log not reset")
+	}
+}
+
+func TestAclFile(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	if got := c.run("acl", "save"); !strings.HasPrefix(got, "-ERR This Redis instance is not configured to use an ACL file.") {
+		t.Errorf("unexpected reply %q", got)
+	}
+	server.aclFilename = filepath.Join(t.TempDir(), "users.acl")
+	os.WriteFile(server.aclFilename, []byte("# users\nuser alice on >p1 ~* +@read\n\nuser default on >secret ~* &* +@all\n"), 0644)
+	bob, _ := newTestConnClient(t)
+	bob.run("acl", "setuser", "bob", "on", "nopass", "+@all")
+	bob.run("auth", "bob", "x")
+	expectReply(t, c, "+OK\r\n", "acl", "load")
+	// 文件中没有的用户被删除 default 用户的客户端继续使用新的 default 用户
+	if aclGetUserByName("bob") != nil || server.clients[bob.fd] == bob {
+		t.Errorf("bob not deleted")
+	}
+	if c.user != server.defaultUser || !aclCheckUserCredentials("default", "secret") || !aclCheckUserCredentials("alice", "p1") {
+		t.Errorf("users not loaded")
+	}
+
+	// 文件有错误时保留当前的用户
+	os.WriteFile(server.aclFilename, []byte("user carol on\nuser dave +nosuch\nfoo\n"), 0644)
+	got := c.run("acl", "load")
+	if !strings.Contains(got, "users.acl:2: Unknown command or category name in ACL.") ||
+		!strings.Contains(got, "users.acl:3 should start with user keyword.") || aclGetUserByName("alice") == nil {
+		t.Errorf("unexpected reply %q", got)
+	}
+
+	expectReply(t, c, "+OK\r\n", "acl", "setuser", "alice", "&ch", "-get")
+	expectReply(t, c, "+OK\r\n", "acl", "save")
+	data, _ := os.ReadFile(server.aclFilename)
+	expect := "user alice on #" + aclHashPassword("p1") + " ~* resetchannels &ch -@all +@read -get\n" +
+		"user default on #" + aclHashPassword("secret") + " ~* &* +@all\n"
+	if string(data) != expect {
+		t.Errorf("expect %q, got %q", expect, data)
+	}
+	expectReply(t, c, "+OK\r\n", "acl", "load")
+	if u := aclGetUserByName("alice"); u.allowedCommands["get"] || !u.allowedCommands["hget"] || u.channels[0] != "ch" {
+		t.Errorf("unexpected user after reload")
+	}
+}
+
+func TestAclStartup(t *testing.T) {
+	initTestServer(t)
+	config := DefaultConfig()
+	config.RequirePass = "foo"
+	config.Users = [][]string{{"alice", "on", ">p1", "+get"}}
+	if err := aclLoadUsersAtStartup(config); err != nil {
+		t.Fatal(err)
+	}
+	if !aclCheckUserCredentials("default", "foo") || !aclCheckUserCredentials("alice", "p1") {
+		t.Errorf("users not loaded")
+	}
+	config.AclFile = "users.acl"
+	if err := aclLoadUsersAtStartup(config); err == nil || !strings.Contains(err.Error(), "but not both") {
+		t.Errorf("unexpected error %v", err)
+	}
+	config.Users = [][]string{{"bob", "+nosuch"}}
+	config.AclFile = ""
+	if err := aclLoadUsersAtStartup(config); err == nil || !strings.Contains(err.Error(), "Error in user declaration 'bob'") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+// 主节点设置了密码时副本用 masterauth 认证
+func TestAclMasterauthProcesses(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip starting goredis processes in short mode")
+	}
+	tmp := t.TempDir()
+	bin := filepath.Join(tmp, "goredis")
+	if out, err := exec.Command("go", "build", "-o", bin, ".").CombinedOutput(); err != nil {
+		t.Fatalf("build: %v\n%s", err, out)
+	}
+	for _, d := range []string{"master", "replica"} {
+		os.Mkdir(filepath.Join(tmp, d), 0755)
+	}
+	mport := startTestServer(t, bin, filepath.Join(tmp, "master"),
+		"requirepass secret", "user repl on >replpass +psync +replconf +ping")
+	rport := startTestServer(t, bin, filepath.Join(tmp, "replica"),
+		"masteruser repl", "masterauth replpass", "replicaof 127.0.0.1 "+strconv.Itoa(mport))
+	m, r := dialTestServer(t, mport), dialTestServer(t, rport)
+	if got := m.do("set", "k", "v"); got != "-NOAUTH Authentication required." {
+		t.Fatalf("unexpected reply %s", got)
+	}
+	m.do("auth", "secret")
+	m.do("set", "k", "v")
+	waitFor(t, "replica synced", func() bool { return r.do("get", "k") == "v" })
+	if got := infoField(r.do("info", "replication"), "master_link_status"); got != "up" {
+		t.Errorf("expect link up, got %s", got)
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"log"
 	"time"
 
 	"golang.org/x/sys/unix"
@@ -46,6 +45,7 @@ type AeTimeEvent struct {
 	interval int64 // 重复触发的时间间隔
 	proc     TimeProc
 	extra    interface{}
+	deleted  bool // 同一轮中已被前面的事件删除
 	next     *AeTimeEvent
 }
 
@@ -55,6 +55,7 @@ type AeLoop struct {
 	fileEventFd     int
 	timeEventNextId int
 	stop            bool
+	BeforeSleep     func(loop *AeLoop) // 每次进入 epoll_wait 之前调用
 }
 
 // fe到epoll的映射关系
@@ -73,7 +74,8 @@ func (loop *AeLoop) getEpollMask(fd int) uint32 {
 	var ev uint32
 	if loop.FileEvents[getFeKey(fd, AE_READABLE)] != nil {
 		ev |= unix.EPOLLIN
-	} else if loop.FileEvents[getFeKey(fd, AE_WRITABLE)] != nil {
+	}
+	if loop.FileEvents[getFeKey(fd, AE_WRITABLE)] != nil {
 		ev |= unix.EPOLLOUT
 	}
 	return ev
@@ -94,7 +96,7 @@ func (loop *AeLoop) AddFileEvent(fd int, mask FeType, proc FileProc, extra inter
 	ev |= fe2ep[mask] // 获取事件类型
 	err := unix.EpollCtl(loop.fileEventFd, op, fd, &unix.EpollEvent{Events: ev, Fd: int32(fd)})
 	if err != nil {
-		log.Println("epoll_ctl error:", err)
+		serverLog(LL_WARNING, "epoll_ctl error: %v", err)
 		return
 	}
 
@@ -105,11 +107,15 @@ func (loop *AeLoop) AddFileEvent(fd int, mask FeType, proc FileProc, extra inter
 	fe.proc = proc
 	fe.extra = extra
 	loop.FileEvents[getFeKey(fd, mask)] = &fe
-	log.Printf("ae add file event fd:%v, mask:%v\n", fd, mask)
+	serverLog(LL_DEBUG, "ae add file event fd:%v, mask:%v", fd, mask)
 
 }
 
 func (loop *AeLoop) RemoveFileEvent(fd int, mask FeType) {
+	// 没有注册过该事件
+	if loop.FileEvents[getFeKey(fd, mask)] == nil {
+		return
+	}
 	// epoll_ctl 删除事件
 	op := unix.EPOLL_CTL_DEL
 	ev := loop.getEpollMask(fd)
@@ -120,18 +126,23 @@ func (loop *AeLoop) RemoveFileEvent(fd int, mask FeType) {
 	}
 	err := unix.EpollCtl(loop.fileEventFd, op, fd, &unix.EpollEvent{Events: ev, Fd: int32(fd)})
 	if err != nil {
-		log.Println("epoll_ctl error:", err)
+		serverLog(LL_WARNING, "epoll_ctl error: %v", err)
 		return
 	}
 	// 删除用户态的对应事件，如果关心多个事件则分多次注册和删除
-	loop.FileEvents[getFeKey(fd, mask)] = nil // 一次只会删除一个关心的事件
-	log.Printf("ae remove file event fd:%v, mask:%v\n", fd, mask)
+	delete(loop.FileEvents, getFeKey(fd, mask)) // 一次只会删除一个关心的事件
+	serverLog(LL_DEBUG, "ae remove file event fd:%v, mask:%v", fd, mask)
 }
 
 func GetMsTime() int64 {
 	return time.Now().UnixNano() / 1e6
 }
 
+// 微秒级时间 用于统计耗时
+func GetUsTime() int64 {
+	return time.Now().UnixNano() / 1e3
+}
+
 // *TimeEvents 是用户态队列 (*AeTimeEvent)
 func (loop *AeLoop) AddTimeEvent(mask TeType, interval int64, proc TimeProc, extra interface{}) int {
 	id := loop.timeEventNextId
@@ -154,6 +165,7 @@ func (loop *AeLoop) RemoveTimeEvent(id int) {
 	var pre *AeTimeEvent
 	for p != nil {
 		if p.id == id {
+			p.deleted = true
 			if pre == nil {
 				loop.TimeEvents = p.next
 			} else {
@@ -204,13 +216,28 @@ func (loop *AeLoop) AeWait() (tes []*AeTimeEvent, fes []*AeFileEvent) {
 		timeout = 10
 	}
 	// file
+	fes = loop.pollFileEvents(int(timeout))
+	// time
+	now := GetMsTime()
+	p := loop.TimeEvents
+	for p != nil {
+		if p.when <= now {
+			tes = append(tes, p)
+		}
+		p = p.next
+	}
+	return
+}
+
+// 等待 timeout 毫秒 返回就绪的文件事件
+func (loop *AeLoop) pollFileEvents(timeout int) (fes []*AeFileEvent) {
 	var events [128]unix.EpollEvent
-	n, err := unix.EpollWait(loop.fileEventFd, events[:], int(timeout))
+	n, err := unix.EpollWait(loop.fileEventFd, events[:], timeout)
 	if err != nil {
-		log.Println("epoll_wait error:", err)
+		serverLog(LL_WARNING, "epoll_wait error: %v", err)
 	}
 	if n > 0 {
-		log.Println("ae get ", n, " events")
+		serverLog(LL_DEBUG, "ae get %v events", n)
 	}
 	for i := 0; i < n; i++ {
 		if events[i].Events&unix.EPOLLIN != 0 {
@@ -226,21 +253,15 @@ func (loop *AeLoop) AeWait() (tes []*AeTimeEvent, fes []*AeFileEvent) {
 			}
 		}
 	}
-	// time
-	now := GetMsTime()
-	p := loop.TimeEvents
-	for p != nil {
-		if p.when <= now {
-			tes = append(tes, p)
-		}
-		p = p.next
-	}
-	return
+	return fes
 }
 
 func (loop *AeLoop) AeProcess(tes []*AeTimeEvent, fes []*AeFileEvent) {
 	// index + value(*AeTimeEvent/ *AeFileEvent)
 	for _, te := range tes {
+		if te.deleted {
+			continue
+		}
 		te.proc(loop, te.id, te.extra)
 		// 如果是一次性事件，删除该事件(只针对timeevent)
 		if te.mask == AE_ONCE {
@@ -250,8 +271,12 @@ func (loop *AeLoop) AeProcess(tes []*AeTimeEvent, fes []*AeFileEvent) {
 		}
 	}
 	if len(fes) > 0 {
-		log.Println("ae is processing file events")
+		serverLog(LL_DEBUG, "ae is processing file events")
 		for _, fe := range fes {
+			// 前面的事件可能已经关闭了这个 fd（比如 freeClient）
+			if loop.FileEvents[getFeKey(fe.fd, fe.mask)] != fe {
+				continue
+			}
 			fe.proc(loop, fe.fd, fe.extra)
 		}
 	}
@@ -259,6 +284,9 @@ func (loop *AeLoop) AeProcess(tes []*AeTimeEvent, fes []*AeFileEvent) {
 
 func (loop *AeLoop) AeMain() {
 	for loop.stop != true {
+		if loop.BeforeSleep != nil {
+			loop.BeforeSleep(loop)
+		}
 		tes, fes := loop.AeWait()
 		loop.AeProcess(tes, fes)
 	}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+AOF 持久化
+执行成功并且修改了数据的命令以 RESP 格式追加到 aofBuf 中
+在 beforeSleep 中写入文件 所以客户端收到回复之前命令已经写入了 AOF
+*/
+const (
+	AOF_OFF = 0
+	AOF_ON  = 1
+)
+
+// 重写时每条命令最多包含的元素个数
+const AOF_REWRITE_ITEMS_PER_CMD = 64
+
+// 重写时缓冲区超过这个大小就写出一次
+const AOF_REWRITE_FLUSH_SIZE = 64 * 1024
+
+func catAppendOnlyGenericCommand(buf []byte, args ...string) []byte {
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, "\r\n"...)
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, "\r\n"...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+	return buf
+}
+
+// 命令所在的数据库和上一条不同时先写入 SELECT
+func feedAppendOnlyFile(dictid int, args []string) {
+	var buf []byte
+	if dictid != server.aofSelectedDb {
+		buf = catAppendOnlyGenericCommand(buf, "SELECT", strconv.Itoa(dictid))
+		server.aofSelectedDb = dictid
+	}
+	buf = catAppendOnlyGenericCommand(buf, args...)
+	server.aofBuf = append(server.aofBuf, buf...)
+	// 重写期间的命令还要追加到新文件的末尾
+	if server.aofChildRunning {
+		server.aofRewriteBuf = append(server.aofRewriteBuf, buf...)
+	}
+}
+
+/*
+把 aofBuf 写入文件 并按 appendfsync 策略执行 fsync
+always 在主线程中 fsync everysec 每秒在后台 fsync 一次 no 交给操作系统
+*/
+func flushAppendOnlyFile() {
+	if server.aofFile == nil {
+		return
+	}
+	if len(server.aofBuf) == 0 {
+		// everysec 下已经写入的数据可能还没有 fsync
+		if server.aofFsync == AOF_FSYNC_EVERYSEC && server.aofFsyncPending &&
+			GetMsTime()-server.aofLastFsync >= 1000 && !server.aofFsyncInProgress.Load() {
+			aofBackgroundFsync()
+		}
+		return
+	}
+	n, err := server.aofFile.Write(server.aofBuf)
+	server.aofCurrentSize += int64(n)
+	if err != nil {
+		serverLog(LL_WARNING, "Error writing to the AOF file: %v", err)
+		if server.aofFsync == AOF_FSYNC_ALWAYS {
+			// 无法保证回复之前已经落盘 只能退出
+			serverLog(LL_WARNING, "Can't recover from AOF write error when the AOF fsync policy is 'always'. Exiting...")
+			os.Exit(1)
+		}
+		// 没有写入的部分下次重试
+		server.aofBuf = server.aofBuf[n:]
+		server.aofLastWriteStatus = false
+		return
+	}
+	if !server.aofLastWriteStatus {
+		serverLog(LL_WARNING, "AOF write error looks solved, Redis can write again.")
+		server.aofLastWriteStatus = true
+	}
+	server.aofBuf = server.aofBuf[:0]
+	server.aofFsyncPending = true
+
+	switch server.aofFsync {
+	case AOF_FSYNC_ALWAYS:
+		if err := server.aofFile.Sync(); err != nil {
+			serverLog(LL_WARNING, "Can't persist AOF for fsync error when the AOF fsync policy is 'always': %v. Exiting...", err)
+			os.Exit(1)
+		}
+		server.aofLastFsync = GetMsTime()
+		server.aofFsyncPending = false
+	case AOF_FSYNC_EVERYSEC:
+		if GetMsTime()-server.aofLastFsync >= 1000 && !server.aofFsyncInProgress.Load() {
+			aofBackgroundFsync()
+		}
+	}
+}
+
+// 和 Redis 的 bio 线程一样 fsync 可能很慢 不能阻塞事件循环
+func aofBackgroundFsync() {
+	server.aofFsyncInProgress.Store(true)
+	server.aofLastFsync = GetMsTime()
+	server.aofFsyncPending = false
+	f := server.aofFile
+	go func() {
+		if err := f.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+			serverLog(LL_WARNING, "Error fsyncing the AOF file: %v", err)
+		}
+		server.aofFsyncInProgress.Store(false)
+	}()
+}
+
+// 打开 AOF 文件用于追加
+func openAppendOnlyFile() error {
+	f, err := os.OpenFile(server.aofFilename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("can't open the append-only file %s: %v", server.aofFilename, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	server.aofFile = f
+	server.aofCurrentSize = info.Size()
+	server.aofSelectedDb = -1
+	server.aofLastFsync = GetMsTime()
+	return nil
+}
+
+/*
+读取一条 RESP 格式的命令 返回读取的字节数
+文件在命令中间结束时返回 io.ErrUnexpectedEOF
+*/
+func readAofCommand(r *bufio.Reader) ([]string, int64, error) {
+	var n int64
+	readLine := func() (string, error) {
+		line, err := r.ReadString('\n')
+		n += int64(len(line))
+		if err != nil {
+			if err == io.EOF && n > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		if len(line) < 2 || line[len(line)-2] != '\r' {
+			return "", errors.New("invalid line ending")
+		}
+		return line[:len(line)-2], nil
+	}
+	line, err := readLine()
+	if err != nil {
+		return nil, n, err
+	}
+	if len(line) < 2 || line[0] != '*' {
+		return nil, n, errors.New("expected multibulk")
+	}
+	argc, err := strconv.Atoi(line[1:])
+	if err != nil || argc < 1 {
+		return nil, n, errors.New("invalid multibulk length")
+	}
+	args := make([]string, argc)
+	for i := range args {
+		line, err := readLine()
+		if err != nil {
+			return nil, n, err
+		}
+		if len(line) < 2 || line[0] != '$' {
+			return nil, n, errors.New("expected bulk")
+		}
+		l, err := strconv.Atoi(line[1:])
+		if err != nil || l < 0 {
+			return nil, n, errors.New("invalid bulk length")
+		}
+		buf := make([]byte, l+2)
+		m, err := io.ReadFull(r, buf)
+		n += int64(m)
+		if err != nil {
+			return nil, n, io.ErrUnexpectedEOF
+		}
+		if buf[l] != '\r' || buf[l+1] != '\n' {
+			return nil, n, errors.New("invalid bulk ending")
+		}
+		args[i] = string(buf[:l])
+	}
+	return args, n, nil
+}
+
+/*
+启动时通过伪客户端重新执行 AOF 中的命令
+末尾的命令不完整时 开启 aof-load-truncated 则截断文件并继续启动
+*/
+func loadAppendOnlyFile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	server.loading = true
+	defer func() { server.loading = false }()
+
+	fakeClient := CreateClient(-1)
+	r := bufio.NewReaderSize(f, 64*1024)
+	var valid int64            // 最后一条完整命令结束的位置
+	var validBeforeMulti int64 // 最后一个 MULTI 开始的位置
+	for {
+		args, n, err := readAofCommand(r)
+		if err == io.EOF && fakeClient.flags&CLIENT_MULTI == 0 {
+			break
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			if !server.aofLoadTruncated {
+				return fmt.Errorf("unexpected end of file reading the append only file %s. "+
+					"You can set the 'aof-load-truncated' configuration option to yes and restart the server", filename)
+			}
+			// 不完整的事务整个丢弃
+			if fakeClient.flags&CLIENT_MULTI != 0 {
+				serverLog(LL_WARNING, "Revert incomplete MULTI/EXEC transaction in AOF file %s", filename)
+				valid = validBeforeMulti
+				discardTransaction(fakeClient)
+			}
+			serverLog(LL_WARNING, "!!! Warning: short read while loading the AOF file %s!!!", filename)
+			serverLog(LL_WARNING, "AOF %s loaded anyway because aof-load-truncated is enabled", filename)
+			if err := os.Truncate(filename, valid); err != nil {
+				return fmt.Errorf("error truncating the AOF file %s: %v", filename, err)
+			}
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("bad file format reading the append only file %s: %v", filename, err)
+		}
+		if lookupCommand(strings.ToLower(args[0])) == nil {
+			return fmt.Errorf("unknown command '%s' reading the append only file %s", args[0], filename)
+		}
+		if strings.EqualFold(args[0], "multi") {
+			validBeforeMulti = valid
+		}
+		fakeClient.args = make([]*Gobj, len(args))
+		for i, arg := range args {
+			fakeClient.args[i] = CreateObject(GSTR, arg)
+		}
+		ProcessCommand(fakeClient)
+		freeReplyList(fakeClient)
+		valid += n
+	}
+	server.dirty = 0
+	return nil
+}
+
+// 每条命令最多包含 AOF_REWRITE_ITEMS_PER_CMD 个元素 每个元素由 width 个参数组成
+func catAppendOnlyBatchedCommand(buf []byte, cmd, key string, items []string, width int) []byte {
+	batch := AOF_REWRITE_ITEMS_PER_CMD * width
+	for len(items) > 0 {
+		n := min(batch, len(items))
+		args := append([]string{cmd, key}, items[:n]...)
+		buf = catAppendOnlyGenericCommand(buf, args...)
+		items = items[n:]
+	}
+	return buf
+}
+
+func rewriteObject(buf []byte, key string, o *Gobj) []byte {
+	var items []string
+	switch o.Type_ {
+	case GSTR:
+		return catAppendOnlyGenericCommand(buf, "SET", key, o.StrVal())
+	case GLIST:
+		for n := o.Val_.(*List).First(); n != nil; n = n.Next() {
+			items = append(items, n.Val.StrVal())
+		}
+		return catAppendOnlyBatchedCommand(buf, "RPUSH", key, items, 1)
+	case GSET:
+		it := o.Val_.(*Dict).GetIterator()
+		for e := it.Next(); e != nil; e = it.Next() {
+			items = append(items, e.Key.StrVal())
+		}
+		it.Release()
+		return catAppendOnlyBatchedCommand(buf, "SADD", key, items, 1)
+	case GZSET:
+		for x := o.Val_.(*zset).zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+			items = append(items, formatDouble(x.score), x.member.StrVal())
+		}
+		return catAppendOnlyBatchedCommand(buf, "ZADD", key, items, 2)
+	case GDICT:
+		it := o.Val_.(*Dict).GetIterator()
+		for e := it.Next(); e != nil; e = it.Next() {
+			items = append(items, e.Key.StrVal(), e.Val.StrVal())
+		}
+		it.Release()
+		return catAppendOnlyBatchedCommand(buf, "HSET", key, items, 2)
+	}
+	return buf
+}
+
+func aofRewriteTempFile() string {
+	return filepath.Join(filepath.Dir(server.aofFilename), fmt.Sprintf("temp-rewriteaof-bg-%d.aof", os.Getpid()))
+}
+
+/*
+BGREWRITEAOF
+和 BGSAVE 一样由 ServerCron 分批生成开始时刻数据的最短命令序列 由后台 goroutine 写入临时文件
+已经过期的 key 不写入
+重写期间的新命令保存在 aofRewriteBuf 中 完成后追加到临时文件末尾再替换旧文件
+*/
+func rewriteAppendOnlyFileBackground() error {
+	if server.aofChildRunning {
+		return errors.New("background append only file rewriting already in progress")
+	}
+	s := createSnapshot()
+	now := GetMsTime()
+	curdb := -1
+	s.saveKey = func(dbid int, key, val *Gobj, expire int64) {
+		if expire != -1 && expire < now {
+			return
+		}
+		var buf []byte
+		if dbid != curdb {
+			buf = catAppendOnlyGenericCommand(buf, "SELECT", strconv.Itoa(dbid))
+			curdb = dbid
+		}
+		buf = rewriteObject(buf, key.StrVal(), val)
+		if expire != -1 {
+			buf = catAppendOnlyGenericCommand(buf, "PEXPIREAT", key.StrVal(), strconv.FormatInt(expire, 10))
+		}
+		s.buf.Write(buf)
+	}
+	s.saveEnd = func() {}
+	server.aofSnapshot = s
+	server.aofChildRunning = true
+	server.aofRewriteBuf = nil
+	server.aofRewriteTimeStart = GetMsTime()
+	// 保证之后的命令在两个文件中都以 SELECT 开头
+	server.aofSelectedDb = -1
+	done := make(chan error, 1)
+	server.aofChildDone = done
+	tmpfile := aofRewriteTempFile()
+	go func() {
+		done <- writeFileSync(tmpfile, s.writeTo)
+	}()
+	serverLog(LL_NOTICE, "Background append only file rewriting started")
+	return nil
+}
+
+func writeFileSync(filename string, write func(w io.Writer) error) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriterSize(f, AOF_REWRITE_FLUSH_SIZE)
+	err = write(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func backgroundRewriteDoneHandler(err error) {
+	server.aofChildRunning = false
+	server.aofChildDone = nil
+	server.aofSnapshot = nil
+	tmpfile := aofRewriteTempFile()
+	rewriteBuf := server.aofRewriteBuf
+	server.aofRewriteBuf = nil
+	if err == nil {
+		err = appendFileSync(tmpfile, rewriteBuf)
+	}
+	if err == nil {
+		err = os.Rename(tmpfile, server.aofFilename)
+	}
+	if err != nil {
+		serverLog(LL_WARNING, "Background AOF rewrite failed: %v", err)
+		os.Remove(tmpfile)
+		server.aofLastBgrewriteStatus = false
+		return
+	}
+	if server.aofState == AOF_ON {
+		old := server.aofFile
+		if err := openAppendOnlyFile(); err != nil {
+			// 旧的文件描述符仍然有效 但是指向已经被替换的文件
+			serverLog(LL_WARNING, "Background AOF rewrite failed: %v", err)
+			server.aofLastBgrewriteStatus = false
+			return
+		}
+		old.Close()
+		// aofBuf 中的内容已经通过 aofRewriteBuf 写入了新文件
+		server.aofBuf = server.aofBuf[:0]
+		server.aofFsyncPending = false
+	}
+	serverLog(LL_NOTICE, "Background AOF rewrite finished successfully")
+	server.aofLastBgrewriteStatus = true
+}
+
+func appendFileSync(filename string, data []byte) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// 等待正在进行的 AOF 重写结束 测试中使用
+func waitForAofRewrite() {
+	if server.aofChildRunning {
+		server.aofSnapshot.run(0, true)
+		backgroundRewriteDoneHandler(<-server.aofChildDone)
+	}
+}
+
+// 数据被整个替换时放弃正在进行的重写 不需要等它完成
+func killAppendOnlyChild() {
+	if !server.aofChildRunning {
+		return
+	}
+	serverLog(LL_NOTICE, "Killing running AOF rewrite child")
+	server.aofSnapshot.abort()
+	<-server.aofChildDone
+	os.Remove(aofRewriteTempFile())
+	server.aofChildRunning = false
+	server.aofChildDone = nil
+	server.aofSnapshot = nil
+	server.aofRewriteBuf = nil
+}
+
+func bgrewriteaofCommand(c *GodisClient) {
+	if server.aofChildRunning {
+		c.AddReplyError("Background append only file rewriting already in progress")
+		return
+	}
+	if err := rewriteAppendOnlyFileBackground(); err != nil {
+		serverLog(LL_WARNING, "Can't rewrite append only file in background: %v", err)
+		c.AddReply(shared.err)
+		return
+	}
+	c.AddReplyStatus("Background append only file rewriting started")
+}
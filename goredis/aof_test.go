@@ -0,0 +1,241 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// 打开 AOF 测试结束时关闭文件
+func enableTestAof(t *testing.T) {
+	server.aofState = AOF_ON
+	if err := openAppendOnlyFile(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if server.aofFile != nil {
+			server.aofFile.Close()
+			server.aofFile = nil
+		}
+	})
+}
+
+func readAof(t *testing.T) string {
+	data, err := os.ReadFile(server.aofFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// 清空数据库后从 AOF 重新加载
+func reloadAof(t *testing.T, c *GodisClient) {
+	emptyData(-1)
+	if err := loadAppendOnlyFile(server.aofFilename); err != nil {
+		t.Fatal(err)
+	}
+	c.db = server.dbs[0]
+}
+
+func TestCatAppendOnlyGenericCommand(t *testing.T) {
+	got := string(catAppendOnlyGenericCommand(nil, "SET", "k", ""))
+	if got != "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$0\r\n\r\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestAofPropagate(t *testing.T) {
+	initTestServer(t)
+	enableTestAof(t)
+	c := newTestClient(t)
+	c.run("set", "k", "v")
+	c.run("get", "k")
+	c.run("set", "k2", "v", "ex", "100")
+	c.run("expire", "k", "100")
+	c.run("setnx", "k", "v2")
+	c.run("sadd", "s", "a", "b", "c")
+	c.run("spop", "s")
+	c.run("rpush", "l", "1", "2")
+	c.run("blpop", "l", "0")
+	ttl := c.run("pexpiretime", "k")
+	c.run("select", "1")
+	c.run("incr", "counter")
+	c.run("incr", "counter")
+	flushAppendOnlyFile()
+
+	aof := readAof(t)
+	// 只读命令 没有修改数据的命令 以及需要改写的命令都不应该出现
+	for _, arg := range []string{"get", "setnx", "expire", "ex", "spop", "blpop"} {
+		if strings.Contains(aof, "$"+strconv.Itoa(len(arg))+"\r\n"+arg+"\r\n") {
+			t.Errorf("%s should not be in the AOF: %q", arg, aof)
+		}
+	}
+	for _, cmd := range []string{"PEXPIREAT", "PXAT", "SREM", "LPOP", "SELECT"} {
+		if !strings.Contains(aof, cmd) {
+			t.Errorf("%s is missing in the AOF: %q", cmd, aof)
+		}
+	}
+
+	reloadAof(t, c)
+	expectReply(t, c, "$1\r\nv\r\n", "get", "k")
+	expectReply(t, c, ttl, "pexpiretime", "k")
+	expectReply(t, c, ":2\r\n", "scard", "s")
+	expectReply(t, c, "*1\r\n$1\r\n2\r\n", "lrange", "l", "0", "-1")
+	c.run("select", "1")
+	expectReply(t, c, "$1\r\n2\r\n", "get", "counter")
+	if server.dirty != 0 {
+		t.Errorf("dirty = %d after loading", server.dirty)
+	}
+}
+
+func TestAofPropagateBlockedPop(t *testing.T) {
+	initTestServer(t)
+	enableTestAof(t)
+	c1 := newTestClient(t)
+	c2 := newTestClient(t)
+	c1.run("brpop", "l", "0")
+	c2.run("rpush", "l", "a", "b")
+	c1.run("blmove", "l", "dst", "left", "right", "0")
+	flushAppendOnlyFile()
+	aof := readAof(t)
+	rpush := strings.Index(aof, "rpush")
+	rpop := strings.Index(aof, "RPOP")
+	if rpush < 0 || rpop < rpush || !strings.Contains(aof, "LMOVE") {
+		t.Errorf("unexpected AOF: %q", aof)
+	}
+	reloadAof(t, c1)
+	expectReply(t, c1, ":0\r\n", "exists", "l")
+	expectReply(t, c1, "*1\r\n$1\r\na\r\n", "lrange", "dst", "0", "-1")
+}
+
+func TestAofPropagateExpiredKey(t *testing.T) {
+	initTestServer(t)
+	enableTestAof(t)
+	c := newTestClient(t)
+	c.run("set", "k", "v")
+	c.db.setExpire(CreateObject(GSTR, "k"), GetMsTime()-1)
+	expectReply(t, c, "$-1\r\n", "get", "k")
+	flushAppendOnlyFile()
+	if aof := readAof(t); !strings.HasSuffix(aof, "*2\r\n$3\r\nDEL\r\n$1\r\nk\r\n") {
+		t.Errorf("unexpected AOF: %q", aof)
+	}
+}
+
+func TestAofLoadTruncated(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	valid := string(catAppendOnlyGenericCommand(nil, "SET", "k", "v"))
+	content := valid + "*3\r\n$3\r\nSET\r\n$2\r\nk2\r\n$5\r\nva"
+	if err := os.WriteFile(server.aofFilename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server.aofLoadTruncated = false
+	if err := loadAppendOnlyFile(server.aofFilename); err == nil {
+		t.Fatal("truncated AOF loaded with aof-load-truncated no")
+	}
+	server.aofLoadTruncated = true
+	reloadAof(t, c)
+	expectReply(t, c, "$1\r\nv\r\n", "get", "k")
+	expectReply(t, c, ":0\r\n", "exists", "k2")
+	if aof := readAof(t); aof != valid {
+		t.Errorf("AOF is not truncated: %q", aof)
+	}
+
+	// 格式错误不是截断 不能忽略
+	if err := os.WriteFile(server.aofFilename, []byte(valid+"+OK\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadAppendOnlyFile(server.aofFilename); err == nil {
+		t.Error("bad AOF loaded without error")
+	}
+}
+
+func TestBgrewriteaof(t *testing.T) {
+	initTestServer(t)
+	enableTestAof(t)
+	c := newTestClient(t)
+	for i := 0; i < 10; i++ {
+		c.run("incr", "counter")
+	}
+	for i := 0; i < 100; i++ {
+		c.run("rpush", "list", strconv.Itoa(i))
+	}
+	c.run("zadd", "zset", "1.5", "a", "-inf", "b")
+	c.run("hset", "hash", "f", "v")
+	c.run("sadd", "set", "m")
+	c.run("set", "tmp", "v", "px", "100000")
+	expire := c.db.getExpire(CreateObject(GSTR, "tmp"))
+	c.run("select", "2")
+	c.run("set", "db2", "v")
+	flushAppendOnlyFile()
+
+	expectReply(t, c, "+Background append only file rewriting started\r\n", "bgrewriteaof")
+	expectReply(t, c, "-ERR Background append only file rewriting already in progress\r\n", "bgrewriteaof")
+	// 重写期间的修改追加到新文件中
+	c.run("set", "during", "rewrite")
+	flushAppendOnlyFile()
+	waitForAofRewrite()
+	if !server.aofLastBgrewriteStatus {
+		t.Fatal("rewrite failed")
+	}
+	c.run("set", "after", "rewrite")
+	flushAppendOnlyFile()
+
+	aof := readAof(t)
+	if strings.Contains(aof, "INCR") || strings.Count(aof, "RPUSH") != 2 {
+		t.Errorf("AOF is not compacted: %q", aof)
+	}
+	reloadAof(t, c)
+	expectReply(t, c, "$2\r\n10\r\n", "get", "counter")
+	expectReply(t, c, ":100\r\n", "llen", "list")
+	expectReply(t, c, "$2\r\n99\r\n", "lindex", "list", "-1")
+	expectReply(t, c, "*4\r\n$1\r\nb\r\n$4\r\n-inf\r\n$1\r\na\r\n$3\r\n1.5\r\n", "zrange", "zset", "0", "-1", "withscores")
+	expectReply(t, c, "$1\r\nv\r\n", "hget", "hash", "f")
+	expectReply(t, c, ":1\r\n", "sismember", "set", "m")
+	expectReply(t, c, ":"+strconv.FormatInt(expire, 10)+"\r\n", "pexpiretime", "tmp")
+	c.run("select", "2")
+	expectReply(t, c, "$1\r\nv\r\n", "get", "db2")
+	expectReply(t, c, "$7\r\nrewrite\r\n", "get", "during")
+	expectReply(t, c, "$7\r\nrewrite\r\n", "get", "after")
+}
+
+func TestBgrewriteaofDuringWrites(t *testing.T) {
+	initTestServer(t)
+	enableTestAof(t)
+	c := newTestClient(t)
+	for i := 0; i < 100; i++ {
+		c.run("set", "k"+strconv.Itoa(i), "v")
+	}
+	c.run("rpush", "l", "a")
+	c.run("bgrewriteaof")
+	// 还没有遍历到的 key 被修改 重写内容中是原来的值 修改本身在 aofRewriteBuf 中
+	server.aofSnapshot.scanStep()
+	c.run("rpush", "l", "b")
+	c.run("del", "k1")
+	c.run("set", "added", "v")
+	flushAppendOnlyFile()
+	for server.aofChildRunning {
+		snapshotCron()
+		checkChildrenDone()
+	}
+	if !server.aofLastBgrewriteStatus {
+		t.Fatal("rewrite failed")
+	}
+	reloadAof(t, c)
+	expectReply(t, c, ":101\r\n", "dbsize")
+	expectReply(t, c, "*2\r\n$1\r\na\r\n$1\r\nb\r\n", "lrange", "l", "0", "-1")
+	expectReply(t, c, ":0\r\n", "exists", "k1")
+
+	// 放弃重写时删除临时文件
+	c.run("bgrewriteaof")
+	killAppendOnlyChild()
+	if server.aofChildRunning || server.aofSnapshot != nil {
+		t.Errorf("rewrite still running after kill")
+	}
+	if _, err := os.Stat(aofRewriteTempFile()); !os.IsNotExist(err) {
+		t.Errorf("temp file not removed: %v", err)
+	}
+	expectReply(t, c, "+Background append only file rewriting started\r\n", "bgrewriteaof")
+	waitForAofRewrite()
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"math"
+	"strconv"
+)
+
+// 阻塞命令的状态 保存在 GodisClient 中
+type blockingState struct {
+	btype     Gtype   // 等待的类型 GLIST / GZSET
+	keys      []*Gobj // 等待的 key 任意一个可用即可
+	timeoutId int     // 超时的 time event id 0 表示永久阻塞
+	target    *Gobj   // BLMOVE 的目标 key
+	wherefrom int     // BLPOP / BRPOP / BLMOVE 的弹出方向
+	whereto   int     // BLMOVE 的插入方向
+	max       bool    // BZPOPMAX
+	postponed bool    // CLIENT PAUSE 推迟执行 命令参数保留在 args 中
+}
+
+// 有数据写入的 key 在命令执行结束后统一处理
+type readyKey struct {
+	db  *GodisDB
+	key *Gobj
+}
+
+/*
+解析以秒为单位的超时时间 返回毫秒 0 表示永久阻塞
+*/
+func getTimeoutFromObjectOrReply(c *GodisClient, o *Gobj) (int64, bool) {
+	tval, err := strconv.ParseFloat(o.StrVal(), 64)
+	if err != nil || math.IsNaN(tval) || math.IsInf(tval, 0) {
+		c.AddReplyError("timeout is not a float or out of range")
+		return 0, false
+	}
+	if tval < 0 {
+		c.AddReplyError("timeout is negative")
+		return 0, false
+	}
+	ms := int64(tval * 1000)
+	// 不足 1ms 的超时按 1ms 处理 避免变成永久阻塞
+	if ms == 0 && tval > 0 {
+		ms = 1
+	}
+	return ms, true
+}
+
+// 客户端挂到每个 key 的等待队列末尾 之后不再处理它的输入直到被唤醒
+func blockForKeys(c *GodisClient, btype Gtype, keys []*Gobj, timeout int64) {
+	c.flags |= CLIENT_BLOCKED
+	c.bstate.btype = btype
+	for _, key := range keys {
+		name := key.StrVal()
+		clients := c.db.blockingKeys[name]
+		// 同一个 key 可能重复出现
+		dup := false
+		for _, bc := range clients {
+			if bc == c {
+				dup = true
+			}
+		}
+		if dup {
+			continue
+		}
+		c.db.blockingKeys[name] = append(clients, c)
+		c.bstate.keys = append(c.bstate.keys, key)
+		key.IncrRefCount()
+	}
+	if timeout > 0 {
+		c.bstate.timeoutId = server.aeLoop.AddTimeEvent(AE_ONCE, timeout, blockTimeoutProc, c)
+	}
+	server.blockedClients++
+}
+
+// 从所有等待队列中移除 不发送任何回复
+func unblockClient(c *GodisClient) {
+	if c.flags&CLIENT_BLOCKED == 0 {
+		return
+	}
+	for _, key := range c.bstate.keys {
+		name := key.StrVal()
+		clients := c.db.blockingKeys[name]
+		for i, bc := range clients {
+			if bc == c {
+				clients = append(clients[:i], clients[i+1:]...)
+				break
+			}
+		}
+		if len(clients) == 0 {
+			delete(c.db.blockingKeys, name)
+		} else {
+			c.db.blockingKeys[name] = clients
+		}
+		key.DecrRefCount()
+	}
+	if c.bstate.timeoutId != 0 {
+		server.aeLoop.RemoveTimeEvent(c.bstate.timeoutId)
+	}
+	if c.bstate.target != nil {
+		c.bstate.target.DecrRefCount()
+	}
+	if c.bstate.postponed {
+		for i, pc := range server.postponedClients {
+			if pc == c {
+				server.postponedClients = append(server.postponedClients[:i], server.postponedClients[i+1:]...)
+				break
+			}
+		}
+	}
+	c.bstate = blockingState{}
+	c.flags &^= CLIENT_BLOCKED
+	server.blockedClients--
+	// 阻塞期间收到的命令在 beforeSleep 中继续处理
+	server.unblockedClients = append(server.unblockedClients, c)
+}
+
+func blockTimeoutProc(loop *AeLoop, id int, extra interface{}) {
+	c := extra.(*GodisClient)
+	// 超时事件已经被执行 不需要再删除
+	c.bstate.timeoutId = 0
+	if c.bstate.btype == GLIST && c.bstate.target != nil {
+		c.AddReplyNull()
+	} else {
+		c.AddReplyNullArray()
+	}
+	unblockClient(c)
+}
+
+// 有客户端阻塞在 key 上时记录下来
+func signalKeyAsReady(db *GodisDB, key *Gobj) {
+	if _, ok := db.blockingKeys[key.StrVal()]; !ok {
+		return
+	}
+	for _, rk := range server.readyKeys {
+		if rk.db == db && GStrEqual(rk.key, key) {
+			return
+		}
+	}
+	key.IncrRefCount()
+	server.readyKeys = append(server.readyKeys, readyKey{db, key})
+}
+
+/*
+每条命令执行完之后调用 按阻塞的先后顺序唤醒客户端
+BLMOVE 写入目标 key 时可能产生新的 ready key 所以循环处理
+*/
+func handleClientsBlockedOnKeys() {
+	for len(server.readyKeys) > 0 {
+		keys := server.readyKeys
+		server.readyKeys = nil
+		for _, rk := range keys {
+			for {
+				o := rk.db.lookupKeyWrite(rk.key)
+				if o == nil {
+					break
+				}
+				// 跳过等待其他类型的客户端
+				var target *GodisClient
+				for _, bc := range rk.db.blockingKeys[rk.key.StrVal()] {
+					if bc.bstate.btype == o.Type_ {
+						target = bc
+						break
+					}
+				}
+				if target == nil {
+					break
+				}
+				serveClientBlockedOnKey(target, rk.key, o)
+			}
+			rk.key.DecrRefCount()
+		}
+	}
+}
+
+func serveClientBlockedOnKey(c *GodisClient, key *Gobj, o *Gobj) {
+	dirty := server.dirty
+	if o.Type_ == GLIST {
+		serveClientBlockedOnList(c, key, o)
+	} else {
+		serveClientBlockedOnZset(c, key, o)
+	}
+	if server.dirty != dirty {
+		signalModifiedKey(c, c.db, key)
+		if c.bstate.target != nil {
+			signalModifiedKey(c, c.db, c.bstate.target)
+		}
+		propagate(c.db.id, blockedPopCommandArgs(c, key)...)
+	}
+	unblockClient(c)
+}
+
+// 阻塞命令以对应的非阻塞命令传播
+func blockedPopCommandArgs(c *GodisClient, key *Gobj) []string {
+	if c.bstate.btype == GZSET {
+		if c.bstate.max {
+			return []string{"ZPOPMAX", key.StrVal()}
+		}
+		return []string{"ZPOPMIN", key.StrVal()}
+	}
+	if c.bstate.target != nil {
+		return []string{"LMOVE", key.StrVal(), c.bstate.target.StrVal(),
+			listPositionName(c.bstate.wherefrom), listPositionName(c.bstate.whereto)}
+	}
+	if c.bstate.wherefrom == LIST_HEAD {
+		return []string{"LPOP", key.StrVal()}
+	}
+	return []string{"RPOP", key.StrVal()}
+}
+
+func serveClientBlockedOnList(c *GodisClient, key *Gobj, o *Gobj) {
+	db := c.db
+	if c.bstate.target == nil {
+		val := listTypePop(o, c.bstate.wherefrom)
+		c.AddReplyArrayLen(2)
+		c.AddReplyBulk(key)
+		c.AddReplyBulk(val)
+		val.DecrRefCount()
+	} else {
+		// BLMOVE 在弹出之前检查目标 key 的类型
+		dobj := db.lookupKeyWrite(c.bstate.target)
+		if dobj != nil && checkType(c, dobj, GLIST) {
+			return
+		}
+		val := listTypePop(o, c.bstate.wherefrom)
+		if dobj == nil {
+			dobj = CreateListObject()
+			db.dbAdd(c.bstate.target, dobj)
+			dobj.DecrRefCount()
+		}
+		listTypePush(dobj, val, c.bstate.whereto)
+		c.AddReplyBulk(val)
+		val.DecrRefCount()
+	}
+	notifyKeyspaceEvent(NOTIFY_LIST, listEventName("pop", c.bstate.wherefrom), key, db.id)
+	if c.bstate.target != nil {
+		notifyKeyspaceEvent(NOTIFY_LIST, listEventName("push", c.bstate.whereto), c.bstate.target, db.id)
+	}
+	if listTypeLength(o) == 0 {
+		db.dbDelete(key)
+		notifyKeyspaceEvent(NOTIFY_GENERIC, "del", key, db.id)
+	}
+	server.dirty++
+}
+
+func serveClientBlockedOnZset(c *GodisClient, key *Gobj, o *Gobj) {
+	zs := o.Val_.(*zset)
+	var x *zskiplistNode
+	if c.bstate.max {
+		x = zs.zsl.tail
+	} else {
+		x = zs.zsl.header.level[0].forward
+	}
+	member := x.member
+	c.AddReplyArrayLen(3)
+	c.AddReplyBulk(key)
+	c.AddReplyBulk(member)
+	c.AddReplyDouble(x.score)
+	member.IncrRefCount()
+	zsetDel(o, member)
+	member.DecrRefCount()
+	if c.bstate.max {
+		notifyKeyspaceEvent(NOTIFY_ZSET, "zpopmax", key, c.db.id)
+	} else {
+		notifyKeyspaceEvent(NOTIFY_ZSET, "zpopmin", key, c.db.id)
+	}
+	if zsetLength(o) == 0 {
+		c.db.dbDelete(key)
+		notifyKeyspaceEvent(NOTIFY_GENERIC, "del", key, c.db.id)
+	}
+	server.dirty++
+}
+
+// 被唤醒的客户端可能已经在缓冲区中积累了后续的命令
+func processUnblockedClients() {
+	for len(server.unblockedClients) > 0 {
+		c := server.unblockedClients[0]
+		server.unblockedClients = server.unblockedClients[1:]
+		// 已经断开连接或者再次被阻塞
+		if server.clients[c.fd] != c || c.flags&CLIENT_BLOCKED != 0 {
+			continue
+		}
+		// 被推迟的命令还没有执行
+		if c.args != nil {
+			ProcessCommand(c)
+			if c.flags&CLIENT_BLOCKED != 0 {
+				continue
+			}
+		}
+		if c.queryLen > 0 {
+			if err := ProcessQueryBuf(c); err != nil {
+				serverLog(LL_VERBOSE, "process query buf err: %v", err)
+				freeClient(c)
+			}
+		}
+	}
+}
+
+// BLPOP / BRPOP key [key ...] timeout
+func blockingPopGenericCommand(c *GodisClient, where int) {
+	timeout, ok := getTimeoutFromObjectOrReply(c, c.args[len(c.args)-1])
+	if !ok {
+		return
+	}
+	keys := c.args[1 : len(c.args)-1]
+	for _, key := range keys {
+		o := c.db.lookupKeyWrite(key)
+		if o == nil {
+			continue
+		}
+		if checkType(c, o, GLIST) {
+			return
+		}
+		// 有数据时和 LPOP 一样直接返回
+		val := listTypePop(o, where)
+		c.AddReplyArrayLen(2)
+		c.AddReplyBulk(key)
+		c.AddReplyBulk(val)
+		val.DecrRefCount()
+		notifyKeyspaceEvent(NOTIFY_LIST, listEventName("pop", where), key, c.db.id)
+		if listTypeLength(o) == 0 {
+			c.db.dbDelete(key)
+			notifyKeyspaceEvent(NOTIFY_GENERIC, "del", key, c.db.id)
+		}
+		signalModifiedKey(c, c.db, key)
+		server.dirty++
+		if where == LIST_HEAD {
+			rewriteClientCommandVector(c, "LPOP", key.StrVal())
+		} else {
+			rewriteClientCommandVector(c, "RPOP", key.StrVal())
+		}
+		return
+	}
+	// 事务中不能阻塞 和超时一样返回
+	if c.flags&CLIENT_DENY_BLOCKING != 0 {
+		c.AddReplyNullArray()
+		return
+	}
+	c.bstate.wherefrom = where
+	blockForKeys(c, GLIST, keys, timeout)
+}
+
+func blpopCommand(c *GodisClient) {
+	blockingPopGenericCommand(c, LIST_HEAD)
+}
+
+func brpopCommand(c *GodisClient) {
+	blockingPopGenericCommand(c, LIST_TAIL)
+}
+
+func blmoveGenericCommand(c *GodisClient, wherefrom, whereto int, timeoutArg *Gobj) {
+	timeout, ok := getTimeoutFromObjectOrReply(c, timeoutArg)
+	if !ok {
+		return
+	}
+	o := c.db.lookupKeyWrite(c.args[1])
+	if o != nil {
+		if checkType(c, o, GLIST) {
+			return
+		}
+		src, dst := c.args[1].StrVal(), c.args[2].StrVal()
+		lmoveGenericCommand(c, wherefrom, whereto)
+		rewriteClientCommandVector(c, "LMOVE", src, dst, listPositionName(wherefrom), listPositionName(whereto))
+		return
+	}
+	if c.flags&CLIENT_DENY_BLOCKING != 0 {
+		c.AddReplyNull()
+		return
+	}
+	c.bstate.wherefrom = wherefrom
+	c.bstate.whereto = whereto
+	c.bstate.target = c.args[2]
+	c.bstate.target.IncrRefCount()
+	blockForKeys(c, GLIST, c.args[1:2], timeout)
+}
+
+// BLMOVE source destination LEFT|RIGHT LEFT|RIGHT timeout
+func blmoveCommand(c *GodisClient) {
+	wherefrom, ok1 := getListPosition(c.args[3])
+	whereto, ok2 := getListPosition(c.args[4])
+	if !ok1 || !ok2 {
+		c.AddReply(shared.syntaxerr)
+		return
+	}
+	blmoveGenericCommand(c, wherefrom, whereto, c.args[5])
+}
+
+func brpoplpushCommand(c *GodisClient) {
+	blmoveGenericCommand(c, LIST_TAIL, LIST_HEAD, c.args[3])
+}
+
+// BZPOPMIN / BZPOPMAX key [key ...] timeout
+func blockingZpopGenericCommand(c *GodisClient, max bool) {
+	timeout, ok := getTimeoutFromObjectOrReply(c, c.args[len(c.args)-1])
+	if !ok {
+		return
+	}
+	keys := c.args[1 : len(c.args)-1]
+	for _, key := range keys {
+		o := c.db.lookupKeyWrite(key)
+		if o == nil {
+			continue
+		}
+		if checkType(c, o, GZSET) {
+			return
+		}
+		c.bstate.btype = GZSET
+		c.bstate.max = max
+		serveClientBlockedOnZset(c, key, o)
+		signalModifiedKey(c, c.db, key)
+		rewriteClientCommandVector(c, blockedPopCommandArgs(c, key)...)
+		c.bstate = blockingState{}
+		return
+	}
+	if c.flags&CLIENT_DENY_BLOCKING != 0 {
+		c.AddReplyNullArray()
+		return
+	}
+	c.bstate.max = max
+	blockForKeys(c, GZSET, keys, timeout)
+}
+
+func bzpopminCommand(c *GodisClient) {
+	blockingZpopGenericCommand(c, false)
+}
+
+func bzpopmaxCommand(c *GodisClient) {
+	blockingZpopGenericCommand(c, true)
+}
@@ -0,0 +1,87 @@
+package main
+
+import "testing"
+
+func TestBlockingListPop(t *testing.T) {
+	initTestServer(t)
+	c1 := newTestClient(t)
+	c2 := newTestClient(t)
+	c3 := newTestClient(t)
+	expectReply(t, c1, ":1\r\n", "rpush", "l", "a")
+	expectReply(t, c1, "*2\r\n$1\r\nl\r\n$1\r\na\r\n", "blpop", "nosuch", "l", "0")
+	expectReply(t, c1, "-ERR timeout is negative\r\n", "blpop", "l", "-1")
+	expectReply(t, c1, "-ERR timeout is not a float or out of range\r\n", "blpop", "l", "abc")
+
+	// 按阻塞的先后顺序唤醒
+	expectReply(t, c1, "", "blpop", "l", "0")
+	expectReply(t, c2, "", "brpop", "l", "l2", "0")
+	if c1.flags&CLIENT_BLOCKED == 0 || c2.flags&CLIENT_BLOCKED == 0 {
+		t.Fatal("clients should be blocked")
+	}
+	expectReply(t, c3, ":1\r\n", "rpush", "l", "x")
+	if got := c1.takeReply(); got != "*2\r\n$1\r\nl\r\n$1\r\nx\r\n" {
+		t.Errorf("c1 got %q", got)
+	}
+	if got := c2.takeReply(); got != "" {
+		t.Errorf("c2 got %q", got)
+	}
+	expectReply(t, c3, ":2\r\n", "rpush", "l2", "y", "z")
+	if got := c2.takeReply(); got != "*2\r\n$2\r\nl2\r\n$1\r\nz\r\n" {
+		t.Errorf("c2 got %q", got)
+	}
+	expectReply(t, c3, "*1\r\n$1\r\ny\r\n", "lrange", "l2", "0", "-1")
+	if len(c1.db.blockingKeys) != 0 || server.blockedClients != 0 {
+		t.Errorf("blocking keys left: %v", c1.db.blockingKeys)
+	}
+}
+
+func TestBlockingMove(t *testing.T) {
+	initTestServer(t)
+	c1 := newTestClient(t)
+	c2 := newTestClient(t)
+	c3 := newTestClient(t)
+	expectReply(t, c1, "", "blmove", "src", "dst", "left", "right", "0")
+	expectReply(t, c2, "", "brpoplpush", "dst", "dst2", "0")
+	// c1 写入 dst 之后 c2 也随之被唤醒
+	expectReply(t, c3, ":1\r\n", "lpush", "src", "v")
+	if got := c1.takeReply(); got != "$1\r\nv\r\n" {
+		t.Errorf("c1 got %q", got)
+	}
+	if got := c2.takeReply(); got != "$1\r\nv\r\n" {
+		t.Errorf("c2 got %q", got)
+	}
+	expectReply(t, c1, "*1\r\n$1\r\nv\r\n", "lrange", "dst2", "0", "-1")
+	expectReply(t, c1, ":0\r\n", "llen", "dst")
+}
+
+func TestBlockingZpop(t *testing.T) {
+	initTestServer(t)
+	c1 := newTestClient(t)
+	c2 := newTestClient(t)
+	expectReply(t, c1, ":2\r\n", "zadd", "z", "1", "a", "2", "b")
+	expectReply(t, c1, "*3\r\n$1\r\nz\r\n$1\r\nb\r\n$1\r\n2\r\n", "bzpopmax", "z", "0")
+	expectReply(t, c1, "", "bzpopmin", "z2", "0")
+	expectReply(t, c2, ":1\r\n", "zadd", "z2", "5", "m")
+	if got := c1.takeReply(); got != "*3\r\n$2\r\nz2\r\n$1\r\nm\r\n$1\r\n5\r\n" {
+		t.Errorf("c1 got %q", got)
+	}
+}
+
+func TestBlockingTimeout(t *testing.T) {
+	initTestServer(t)
+	c1 := newTestClient(t)
+	c2 := newTestClient(t)
+	expectReply(t, c1, "", "blpop", "l", "0.01")
+	expectReply(t, c2, "", "blmove", "l", "d", "left", "left", "0.01")
+	tes, _ := server.aeLoop.AeWait()
+	server.aeLoop.AeProcess(tes, nil)
+	if got := c1.takeReply(); got != "*-1\r\n" {
+		t.Errorf("c1 got %q", got)
+	}
+	if got := c2.takeReply(); got != "$-1\r\n" {
+		t.Errorf("c2 got %q", got)
+	}
+	if c1.flags&CLIENT_BLOCKED != 0 || server.aeLoop.TimeEvents != nil {
+		t.Error("client should be unblocked")
+	}
+}
@@ -0,0 +1,2165 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+集群模式 和 Redis Cluster 一样把 key 按 CRC16 分到 16384 个槽位
+每个节点负责一部分槽位 节点之间通过集群总线（端口号 +10000）交换 PING/PONG
+PING/PONG 中带有发送者负责的槽位以及它知道的其他节点 槽位归属冲突时 configEpoch 大的获胜
+只支持主节点 没有副本和故障转移
+*/
+
+const (
+	CLUSTER_SLOTS     = 16384
+	CLUSTER_NAMELEN   = 40
+	CLUSTER_PORT_INCR = 10000 // 集群总线端口默认为 port + 10000
+
+	CLUSTER_OK   = 0
+	CLUSTER_FAIL = 1
+
+	CLUSTER_FAIL_REPORT_VALIDITY_MULT = 2 // 失败报告的有效期为 nodeTimeout 的倍数
+	CLUSTER_FAIL_UNDO_TIME_MULT       = 2 // 有槽位的节点 FAIL 之后多久可以清除
+)
+
+// 节点标记
+const (
+	CLUSTER_NODE_MASTER    = 1 << 0
+	CLUSTER_NODE_SLAVE     = 1 << 1
+	CLUSTER_NODE_PFAIL     = 1 << 2 // 本节点认为它可能下线了
+	CLUSTER_NODE_FAIL      = 1 << 3 // 多数主节点认为它下线了
+	CLUSTER_NODE_MYSELF    = 1 << 4
+	CLUSTER_NODE_HANDSHAKE = 1 << 5 // 还没有收到第一个 PONG 名字是随机的
+	CLUSTER_NODE_NOADDR    = 1 << 6 // 不知道它的地址
+	CLUSTER_NODE_MEET      = 1 << 7 // 连接之后发送 MEET 而不是 PING
+)
+
+// beforeSleep 中要做的事情
+const (
+	CLUSTER_TODO_UPDATE_STATE = 1 << 0
+	CLUSTER_TODO_SAVE_CONFIG  = 1 << 1
+)
+
+// getNodeByQuery 返回的重定向类型
+const (
+	CLUSTER_REDIR_NONE = iota
+	CLUSTER_REDIR_CROSS_SLOT
+	CLUSTER_REDIR_UNSTABLE
+	CLUSTER_REDIR_ASK
+	CLUSTER_REDIR_MOVED
+	CLUSTER_REDIR_DOWN_STATE
+	CLUSTER_REDIR_DOWN_UNBOUND
+)
+
+type clusterNode struct {
+	name         string
+	flags        int
+	ctime        int64 // 创建时间（毫秒）
+	configEpoch  uint64
+	slots        [CLUSTER_SLOTS / 8]byte
+	numslots     int
+	pingSent     int64 // 发出还没有收到 PONG 的 PING 的时间 0 表示没有
+	pongReceived int64
+	failTime     int64 // 被标记为 FAIL 的时间
+	ip           string
+	port         int
+	cport        int
+	link         *clusterLink           // 到这个节点的连接 用来发送 PING
+	failReports  map[*clusterNode]int64 // 认为这个节点下线的主节点 -> 报告时间
+}
+
+// 集群总线上的连接 本节点主动发起的连接 node 不为空
+type clusterLink struct {
+	fd     int
+	ctime  int64
+	sndbuf []byte
+	rcvbuf []byte
+	node   *clusterNode
+}
+
+type clusterState struct {
+	myself               *clusterNode
+	currentEpoch         uint64
+	state                int
+	size                 int // 负责至少一个槽位的主节点数量
+	nodes                map[string]*clusterNode
+	migratingSlotsTo     [CLUSTER_SLOTS]*clusterNode
+	importingSlotsFrom   [CLUSTER_SLOTS]*clusterNode
+	slots                [CLUSTER_SLOTS]*clusterNode
+	slotsKeys            [CLUSTER_SLOTS]map[string]struct{} // 0 号数据库中每个槽位的 key
+	todoBeforeSleep      int
+	fd                   int // 集群总线的监听 fd
+	statMessagesSent     int64
+	statMessagesReceived int64
+}
+
+/* ----------------------------- 槽位 ----------------------------- */
+
+/*
+只对第一个 { 和之后第一个 } 之间的内容计算槽位 内容为空时使用整个 key
+这样 {user1000}.following 和 {user1000}.followers 一定在同一个槽位
+*/
+func keyHashSlot(key string) int {
+	if s := strings.IndexByte(key, '{'); s >= 0 {
+		if e := strings.IndexByte(key[s+1:], '}'); e > 0 {
+			key = key[s+1 : s+1+e]
+		}
+	}
+	return int(crc16([]byte(key)) & (CLUSTER_SLOTS - 1))
+}
+
+func bitmapTestBit(bitmap []byte, pos int) bool {
+	return bitmap[pos/8]&(1<<(pos&7)) != 0
+}
+
+func bitmapSetBit(bitmap []byte, pos int) {
+	bitmap[pos/8] |= 1 << (pos & 7)
+}
+
+func bitmapClearBit(bitmap []byte, pos int) {
+	bitmap[pos/8] &^= 1 << (pos & 7)
+}
+
+// 槽位已经有节点负责时返回 false
+func clusterAddSlot(n *clusterNode, slot int) bool {
+	if server.cluster.slots[slot] != nil {
+		return false
+	}
+	bitmapSetBit(n.slots[:], slot)
+	n.numslots++
+	server.cluster.slots[slot] = n
+	return true
+}
+
+func clusterDelSlot(slot int) bool {
+	n := server.cluster.slots[slot]
+	if n == nil {
+		return false
+	}
+	bitmapClearBit(n.slots[:], slot)
+	n.numslots--
+	server.cluster.slots[slot] = nil
+	return true
+}
+
+/* ----------------------------- 槽位中的 key ----------------------------- */
+
+// 集群模式只使用 0 号数据库
+func slotToKeyAdd(db *GodisDB, key *Gobj) {
+	if !server.clusterEnabled || db.id != 0 {
+		return
+	}
+	slot := keyHashSlot(key.StrVal())
+	if server.cluster.slotsKeys[slot] == nil {
+		server.cluster.slotsKeys[slot] = make(map[string]struct{})
+	}
+	server.cluster.slotsKeys[slot][key.StrVal()] = struct{}{}
+}
+
+func slotToKeyDel(db *GodisDB, key *Gobj) {
+	if !server.clusterEnabled || db.id != 0 {
+		return
+	}
+	delete(server.cluster.slotsKeys[keyHashSlot(key.StrVal())], key.StrVal())
+}
+
+func slotToKeyFlush(db *GodisDB) {
+	if !server.clusterEnabled || db.id != 0 {
+		return
+	}
+	server.cluster.slotsKeys = [CLUSTER_SLOTS]map[string]struct{}{}
+}
+
+func countKeysInSlot(slot int) int {
+	return len(server.cluster.slotsKeys[slot])
+}
+
+// 按字典序返回最多 count 个 key
+func getKeysInSlot(slot int, count int) []string {
+	keys := make([]string, 0, countKeysInSlot(slot))
+	for key := range server.cluster.slotsKeys[slot] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys[:min(count, len(keys))]
+}
+
+// 删除槽位中的全部 key 并传播 DEL 返回删除的数量
+func delKeysInSlot(slot int) int {
+	db := server.dbs[0]
+	keys := getKeysInSlot(slot, countKeysInSlot(slot))
+	for _, name := range keys {
+		key := CreateObject(GSTR, name)
+		propagate(db.id, "DEL", name)
+		db.dbDelete(key)
+		signalModifiedKey(nil, db, key)
+		notifyKeyspaceEvent(NOTIFY_GENERIC, "del", key, db.id)
+		key.DecrRefCount()
+	}
+	return len(keys)
+}
+
+/* ----------------------------- 节点 ----------------------------- */
+
+// name 为空时随机生成
+func createClusterNode(name string, flags int) *clusterNode {
+	if name == "" {
+		name = getRandomHexChars(CLUSTER_NAMELEN)
+	}
+	return &clusterNode{
+		name:        name,
+		flags:       flags,
+		ctime:       GetMsTime(),
+		failReports: make(map[*clusterNode]int64),
+	}
+}
+
+func clusterLookupNode(name string) *clusterNode {
+	return server.cluster.nodes[name]
+}
+
+func clusterAddNode(n *clusterNode) {
+	server.cluster.nodes[n.name] = n
+}
+
+// 删除节点 清除它负责的槽位和它发出的失败报告
+func clusterDelNode(delnode *clusterNode) {
+	for j := 0; j < CLUSTER_SLOTS; j++ {
+		if server.cluster.importingSlotsFrom[j] == delnode {
+			server.cluster.importingSlotsFrom[j] = nil
+		}
+		if server.cluster.migratingSlotsTo[j] == delnode {
+			server.cluster.migratingSlotsTo[j] = nil
+		}
+		if server.cluster.slots[j] == delnode {
+			clusterDelSlot(j)
+		}
+	}
+	for _, n := range server.cluster.nodes {
+		delete(n.failReports, delnode)
+	}
+	if delnode.link != nil {
+		freeClusterLink(delnode.link)
+	}
+	delete(server.cluster.nodes, delnode.name)
+}
+
+// 握手完成之后换成节点真正的名字
+func clusterRenameNode(n *clusterNode, newname string) {
+	serverLog(LL_VERBOSE, "Renaming node %.40s into %.40s", n.name, newname)
+	delete(server.cluster.nodes, n.name)
+	n.name = newname
+	clusterAddNode(n)
+}
+
+func verifyClusterNodeId(name string) bool {
+	if len(name) != CLUSTER_NAMELEN {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !(name[i] >= 'a' && name[i] <= 'z' || name[i] >= '0' && name[i] <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func clusterHandshakeInProgress(ip string, port, cport int) bool {
+	for _, n := range server.cluster.nodes {
+		if n.flags&CLUSTER_NODE_HANDSHAKE != 0 && n.ip == ip && n.port == port && n.cport == cport {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+创建一个处于握手状态的节点 下一次 clusterCron 连接它并发送 MEET
+收到 PONG 之后才知道它的名字 地址不合法时返回 false
+*/
+func clusterStartHandshake(ip string, port, cport int) bool {
+	addr := net.ParseIP(ip).To4()
+	if addr == nil || port <= 0 || port > 65535 || cport <= 0 || cport > 65535 {
+		return false
+	}
+	ip = addr.String()
+	if clusterHandshakeInProgress(ip, port, cport) {
+		return true
+	}
+	n := createClusterNode("", CLUSTER_NODE_HANDSHAKE|CLUSTER_NODE_MEET)
+	n.ip = ip
+	n.port = port
+	n.cport = cport
+	clusterAddNode(n)
+	return true
+}
+
+/* ----------------------------- 失败检测 ----------------------------- */
+
+func clusterNodeAddFailureReport(failing, sender *clusterNode) {
+	failing.failReports[sender] = GetMsTime()
+}
+
+func clusterNodeDelFailureReport(failing, sender *clusterNode) {
+	delete(failing.failReports, sender)
+}
+
+// 过期的报告不算数
+func clusterNodeFailureReportsCount(n *clusterNode) int {
+	maxtime := server.clusterNodeTimeout * CLUSTER_FAIL_REPORT_VALIDITY_MULT
+	now := GetMsTime()
+	for sender, t := range n.failReports {
+		if now-t > maxtime {
+			delete(n.failReports, sender)
+		}
+	}
+	return len(n.failReports)
+}
+
+func clusterNeededQuorum() int {
+	return server.cluster.size/2 + 1
+}
+
+/*
+本节点认为 node 可能下线 并且负责槽位的主节点中多数也这么认为时标记为 FAIL
+然后广播给其他节点 让它们不需要再等待自己达到多数
+*/
+func markNodeAsFailingIfNeeded(n *clusterNode) {
+	if n.flags&CLUSTER_NODE_PFAIL == 0 || n.flags&CLUSTER_NODE_FAIL != 0 {
+		return
+	}
+	failures := clusterNodeFailureReportsCount(n)
+	if server.cluster.myself.numslots > 0 {
+		failures++
+	}
+	if failures < clusterNeededQuorum() {
+		return
+	}
+	serverLog(LL_NOTICE, "Marking node %.40s as failing (quorum reached).", n.name)
+	n.flags &^= CLUSTER_NODE_PFAIL
+	n.flags |= CLUSTER_NODE_FAIL
+	n.failTime = GetMsTime()
+	clusterSendFail(n.name)
+	clusterDoBeforeSleep(CLUSTER_TODO_UPDATE_STATE | CLUSTER_TODO_SAVE_CONFIG)
+}
+
+/*
+FAIL 的节点又能连上了
+没有槽位的节点直接清除 有槽位的节点等待一段时间 避免状态来回切换
+*/
+func clearNodeFailureIfNeeded(n *clusterNode) {
+	now := GetMsTime()
+	if n.numslots == 0 {
+		serverLog(LL_NOTICE, "Clear FAIL state for node %.40s: is reachable again.", n.name)
+	} else if now-n.failTime > server.clusterNodeTimeout*CLUSTER_FAIL_UNDO_TIME_MULT {
+		serverLog(LL_NOTICE, "Clear FAIL state for node %.40s: is reachable again and nobody is serving its slots after some time.", n.name)
+	} else {
+		return
+	}
+	n.flags &^= CLUSTER_NODE_FAIL
+	clusterDoBeforeSleep(CLUSTER_TODO_UPDATE_STATE | CLUSTER_TODO_SAVE_CONFIG)
+}
+
+/* ----------------------------- 纪元 ----------------------------- */
+
+func clusterGetMaxEpoch() uint64 {
+	max := server.cluster.currentEpoch
+	for _, n := range server.cluster.nodes {
+		if n.configEpoch > max {
+			max = n.configEpoch
+		}
+	}
+	return max
+}
+
+/*
+导入槽位完成时不经过投票直接递增自己的 configEpoch
+这样其他节点收到 PING 时新的归属会覆盖原来的节点
+*/
+func clusterBumpConfigEpochWithoutConsensus() bool {
+	myself := server.cluster.myself
+	maxEpoch := clusterGetMaxEpoch()
+	if myself.configEpoch == 0 || myself.configEpoch != maxEpoch {
+		server.cluster.currentEpoch++
+		myself.configEpoch = server.cluster.currentEpoch
+		clusterDoBeforeSleep(CLUSTER_TODO_SAVE_CONFIG)
+		serverLog(LL_NOTICE, "New configEpoch set to %d", myself.configEpoch)
+		return true
+	}
+	return false
+}
+
+/*
+两个主节点的 configEpoch 相同时 名字较小的节点递增自己的纪元
+最终所有主节点的 configEpoch 都不相同
+*/
+func clusterHandleConfigEpochCollision(sender *clusterNode) {
+	myself := server.cluster.myself
+	if sender.configEpoch != myself.configEpoch || sender.flags&CLUSTER_NODE_MASTER == 0 ||
+		myself.flags&CLUSTER_NODE_MASTER == 0 {
+		return
+	}
+	if sender.name <= myself.name {
+		return
+	}
+	server.cluster.currentEpoch++
+	myself.configEpoch = server.cluster.currentEpoch
+	clusterSaveConfigOrDie()
+	serverLog(LL_VERBOSE, "WARNING: configEpoch collision with node %.40s. configEpoch set to %d", sender.name, myself.configEpoch)
+}
+
+/*
+sender 声明负责 slots 中的槽位
+槽位没有节点负责或者当前负责的节点 configEpoch 更小时改为 sender
+本节点失去的槽位中的 key 已经不能访问 直接删除
+*/
+func clusterUpdateSlotsConfigWith(sender *clusterNode, senderConfigEpoch uint64, slots []byte) {
+	if sender == server.cluster.myself {
+		return
+	}
+	var dirtySlots []int
+	for j := 0; j < CLUSTER_SLOTS; j++ {
+		if !bitmapTestBit(slots, j) {
+			continue
+		}
+		cur := server.cluster.slots[j]
+		if cur == sender || server.cluster.importingSlotsFrom[j] != nil {
+			continue
+		}
+		if cur == nil || cur.configEpoch < senderConfigEpoch {
+			if cur == server.cluster.myself && countKeysInSlot(j) > 0 {
+				dirtySlots = append(dirtySlots, j)
+			}
+			if server.cluster.migratingSlotsTo[j] == sender {
+				server.cluster.migratingSlotsTo[j] = nil
+			}
+			clusterDelSlot(j)
+			clusterAddSlot(sender, j)
+			clusterDoBeforeSleep(CLUSTER_TODO_UPDATE_STATE | CLUSTER_TODO_SAVE_CONFIG)
+		}
+	}
+	for _, j := range dirtySlots {
+		serverLog(LL_NOTICE, "Deleting keys in dirty slot %d", j)
+		delKeysInSlot(j)
+	}
+}
+
+/* ----------------------------- 总线消息 ----------------------------- */
+
+const (
+	CLUSTERMSG_TYPE_PING = 0
+	CLUSTERMSG_TYPE_PONG = 1
+	CLUSTERMSG_TYPE_MEET = 2
+	CLUSTERMSG_TYPE_FAIL = 3
+)
+
+const (
+	CLUSTER_PROTO_VER = 1
+	NET_IP_STR_LEN    = 46
+	// sig totlen ver port type count currentEpoch configEpoch sender myslots cport flags state
+	CLUSTERMSG_HDR_SIZE = 4 + 4 + 2 + 2 + 2 + 2 + 8 + 8 + CLUSTER_NAMELEN + CLUSTER_SLOTS/8 + 2 + 2 + 1
+	// nodename pingSent pongReceived ip port cport flags
+	CLUSTERMSG_GOSSIP_SIZE = CLUSTER_NAMELEN + 4 + 4 + NET_IP_STR_LEN + 2 + 2 + 2
+	CLUSTERMSG_MAX_LEN     = 1024 * 1024
+)
+
+// 其他节点的状态 时间精确到秒
+type clusterMsgDataGossip struct {
+	nodename     string
+	pingSent     uint32
+	pongReceived uint32
+	ip           string
+	port         uint16
+	cport        uint16
+	flags        uint16
+}
+
+/*
+总线上的消息 整数都是大端序 字符串是定长的 不足的部分补 0
+PING PONG MEET 的消息体是 count 个 gossip FAIL 的消息体是下线节点的名字
+*/
+type clusterMsg struct {
+	typ          uint16
+	port         uint16
+	cport        uint16
+	currentEpoch uint64
+	configEpoch  uint64
+	sender       string
+	myslots      [CLUSTER_SLOTS / 8]byte
+	flags        uint16
+	state        byte
+	gossip       []clusterMsgDataGossip
+	failing      string
+}
+
+func appendFixedString(buf []byte, s string, n int) []byte {
+	field := make([]byte, n)
+	copy(field, s)
+	return append(buf, field...)
+}
+
+func readFixedString(buf []byte) string {
+	if i := bytes.IndexByte(buf, 0); i >= 0 {
+		buf = buf[:i]
+	}
+	return string(buf)
+}
+
+func (msg *clusterMsg) encode() []byte {
+	buf := make([]byte, 0, CLUSTERMSG_HDR_SIZE+len(msg.gossip)*CLUSTERMSG_GOSSIP_SIZE)
+	buf = append(buf, "RCmb"...)
+	buf = binary.BigEndian.AppendUint32(buf, 0)
+	buf = binary.BigEndian.AppendUint16(buf, CLUSTER_PROTO_VER)
+	buf = binary.BigEndian.AppendUint16(buf, msg.port)
+	buf = binary.BigEndian.AppendUint16(buf, msg.typ)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(msg.gossip)))
+	buf = binary.BigEndian.AppendUint64(buf, msg.currentEpoch)
+	buf = binary.BigEndian.AppendUint64(buf, msg.configEpoch)
+	buf = appendFixedString(buf, msg.sender, CLUSTER_NAMELEN)
+	buf = append(buf, msg.myslots[:]...)
+	buf = binary.BigEndian.AppendUint16(buf, msg.cport)
+	buf = binary.BigEndian.AppendUint16(buf, msg.flags)
+	buf = append(buf, msg.state)
+	if msg.typ == CLUSTERMSG_TYPE_FAIL {
+		buf = appendFixedString(buf, msg.failing, CLUSTER_NAMELEN)
+	} else {
+		for _, g := range msg.gossip {
+			buf = appendFixedString(buf, g.nodename, CLUSTER_NAMELEN)
+			buf = binary.BigEndian.AppendUint32(buf, g.pingSent)
+			buf = binary.BigEndian.AppendUint32(buf, g.pongReceived)
+			buf = appendFixedString(buf, g.ip, NET_IP_STR_LEN)
+			buf = binary.BigEndian.AppendUint16(buf, g.port)
+			buf = binary.BigEndian.AppendUint16(buf, g.cport)
+			buf = binary.BigEndian.AppendUint16(buf, g.flags)
+		}
+	}
+	binary.BigEndian.PutUint32(buf[4:], uint32(len(buf)))
+	return buf
+}
+
+// buf 是一条完整的消息 长度和类型不匹配时返回错误
+func decodeClusterMsg(buf []byte) (*clusterMsg, error) {
+	if len(buf) < CLUSTERMSG_HDR_SIZE {
+		return nil, errors.New("message too short")
+	}
+	if ver := binary.BigEndian.Uint16(buf[8:]); ver != CLUSTER_PROTO_VER {
+		return nil, fmt.Errorf("unsupported protocol version %d", ver)
+	}
+	msg := &clusterMsg{
+		port:         binary.BigEndian.Uint16(buf[10:]),
+		typ:          binary.BigEndian.Uint16(buf[12:]),
+		currentEpoch: binary.BigEndian.Uint64(buf[16:]),
+		configEpoch:  binary.BigEndian.Uint64(buf[24:]),
+		sender:       readFixedString(buf[32 : 32+CLUSTER_NAMELEN]),
+	}
+	count := int(binary.BigEndian.Uint16(buf[14:]))
+	p := 32 + CLUSTER_NAMELEN
+	copy(msg.myslots[:], buf[p:])
+	p += CLUSTER_SLOTS / 8
+	msg.cport = binary.BigEndian.Uint16(buf[p:])
+	msg.flags = binary.BigEndian.Uint16(buf[p+2:])
+	msg.state = buf[p+4]
+	body := buf[CLUSTERMSG_HDR_SIZE:]
+	switch msg.typ {
+	case CLUSTERMSG_TYPE_PING, CLUSTERMSG_TYPE_PONG, CLUSTERMSG_TYPE_MEET:
+		if len(body) != count*CLUSTERMSG_GOSSIP_SIZE {
+			return nil, errors.New("wrong gossip section length")
+		}
+		msg.gossip = make([]clusterMsgDataGossip, count)
+		for i := range msg.gossip {
+			g := body[i*CLUSTERMSG_GOSSIP_SIZE:]
+			msg.gossip[i] = clusterMsgDataGossip{
+				nodename:     readFixedString(g[:CLUSTER_NAMELEN]),
+				pingSent:     binary.BigEndian.Uint32(g[CLUSTER_NAMELEN:]),
+				pongReceived: binary.BigEndian.Uint32(g[CLUSTER_NAMELEN+4:]),
+				ip:           readFixedString(g[CLUSTER_NAMELEN+8 : CLUSTER_NAMELEN+8+NET_IP_STR_LEN]),
+				port:         binary.BigEndian.Uint16(g[CLUSTER_NAMELEN+8+NET_IP_STR_LEN:]),
+				cport:        binary.BigEndian.Uint16(g[CLUSTER_NAMELEN+10+NET_IP_STR_LEN:]),
+				flags:        binary.BigEndian.Uint16(g[CLUSTER_NAMELEN+12+NET_IP_STR_LEN:]),
+			}
+		}
+	case CLUSTERMSG_TYPE_FAIL:
+		if len(body) != CLUSTER_NAMELEN {
+			return nil, errors.New("wrong FAIL message length")
+		}
+		msg.failing = readFixedString(body)
+	default:
+		return nil, fmt.Errorf("unknown message type %d", msg.typ)
+	}
+	return msg, nil
+}
+
+// 消息头描述本节点的状态
+func clusterBuildMessageHdr(typ uint16) *clusterMsg {
+	myself := server.cluster.myself
+	return &clusterMsg{
+		typ:          typ,
+		port:         uint16(myself.port),
+		cport:        uint16(myself.cport),
+		currentEpoch: server.cluster.currentEpoch,
+		configEpoch:  myself.configEpoch,
+		sender:       myself.name,
+		myslots:      myself.slots,
+		flags:        uint16(myself.flags),
+		state:        byte(server.cluster.state),
+	}
+}
+
+func clusterSetGossipEntry(msg *clusterMsg, n *clusterNode) {
+	msg.gossip = append(msg.gossip, clusterMsgDataGossip{
+		nodename:     n.name,
+		pingSent:     uint32(n.pingSent / 1000),
+		pongReceived: uint32(n.pongReceived / 1000),
+		ip:           n.ip,
+		port:         uint16(n.port),
+		cport:        uint16(n.cport),
+		flags:        uint16(n.flags),
+	})
+}
+
+/*
+PING PONG MEET 中附带随机的十分之一（至少 3 个）节点的状态
+可能下线的节点全部附带 这样失败报告能尽快达到多数
+*/
+func clusterSendPing(link *clusterLink, typ uint16) {
+	if link.node != nil && typ == CLUSTERMSG_TYPE_PING && link.node.pingSent == 0 {
+		link.node.pingSent = GetMsTime()
+	}
+	msg := clusterBuildMessageHdr(typ)
+	wanted := max(3, len(server.cluster.nodes)/10)
+	nodes := make([]*clusterNode, 0, len(server.cluster.nodes))
+	for _, n := range server.cluster.nodes {
+		nodes = append(nodes, n)
+	}
+	rand.Shuffle(len(nodes), func(i, j int) { nodes[i], nodes[j] = nodes[j], nodes[i] })
+	for _, n := range nodes {
+		if n.flags&CLUSTER_NODE_PFAIL != 0 {
+			clusterSetGossipEntry(msg, n)
+			continue
+		}
+		if len(msg.gossip) >= wanted || n == server.cluster.myself ||
+			n.flags&(CLUSTER_NODE_HANDSHAKE|CLUSTER_NODE_NOADDR) != 0 || (n.link == nil && n.numslots == 0) {
+			continue
+		}
+		clusterSetGossipEntry(msg, n)
+	}
+	clusterSendMessage(link, msg.encode())
+}
+
+// 通知所有已连接的节点 比如槽位的归属发生了变化
+func clusterBroadcastPong() {
+	for _, n := range server.cluster.nodes {
+		if n.link == nil || n == server.cluster.myself || n.flags&CLUSTER_NODE_HANDSHAKE != 0 {
+			continue
+		}
+		clusterSendPing(n.link, CLUSTERMSG_TYPE_PONG)
+	}
+}
+
+func clusterSendFail(nodename string) {
+	msg := clusterBuildMessageHdr(CLUSTERMSG_TYPE_FAIL)
+	msg.failing = nodename
+	buf := msg.encode()
+	for _, n := range server.cluster.nodes {
+		if n.link == nil || n == server.cluster.myself || n.flags&CLUSTER_NODE_HANDSHAKE != 0 {
+			continue
+		}
+		clusterSendMessage(n.link, buf)
+	}
+}
+
+/*
+处理 gossip 中其他节点的状态
+主节点报告的 PFAIL/FAIL 计入失败报告 不认识的节点开始握手
+*/
+func clusterProcessGossipSection(msg *clusterMsg, sender *clusterNode) {
+	for _, g := range msg.gossip {
+		n := clusterLookupNode(g.nodename)
+		if n != nil {
+			if sender.flags&CLUSTER_NODE_MASTER != 0 && n != server.cluster.myself {
+				if g.flags&(CLUSTER_NODE_FAIL|CLUSTER_NODE_PFAIL) != 0 {
+					clusterNodeAddFailureReport(n, sender)
+					markNodeAsFailingIfNeeded(n)
+				} else {
+					clusterNodeDelFailureReport(n, sender)
+				}
+			}
+			continue
+		}
+		if g.flags&CLUSTER_NODE_NOADDR == 0 && verifyClusterNodeId(g.nodename) {
+			clusterStartHandshake(g.ip, int(g.port), int(g.cport))
+		}
+	}
+}
+
+func sockaddrIP(sa unix.Sockaddr) string {
+	if sa4, ok := sa.(*unix.SockaddrInet4); ok {
+		return net.IP(sa4.Addr[:]).String()
+	}
+	return ""
+}
+
+// 通过入站连接收到 PING 时 发现节点的地址变了就更新并重新连接
+func nodeUpdateAddressIfNeeded(n *clusterNode, link *clusterLink, msg *clusterMsg) {
+	sa, err := unix.Getpeername(link.fd)
+	if err != nil {
+		return
+	}
+	ip := sockaddrIP(sa)
+	if ip == "" || n.ip == ip && n.port == int(msg.port) && n.cport == int(msg.cport) {
+		return
+	}
+	n.ip = ip
+	n.port = int(msg.port)
+	n.cport = int(msg.cport)
+	n.flags &^= CLUSTER_NODE_NOADDR
+	if n.link != nil {
+		freeClusterLink(n.link)
+	}
+	serverLog(LL_NOTICE, "Address updated for node %.40s, now %s:%d", n.name, n.ip, n.port)
+	clusterDoBeforeSleep(CLUSTER_TODO_SAVE_CONFIG)
+}
+
+// 返回 false 表示连接已经被释放
+func clusterProcessPacket(link *clusterLink, buf []byte) bool {
+	msg, err := decodeClusterMsg(buf)
+	if err != nil {
+		serverLog(LL_WARNING, "Dropping cluster bus link: %v", err)
+		freeClusterLink(link)
+		return false
+	}
+	server.cluster.statMessagesReceived++
+	myself := server.cluster.myself
+	sender := clusterLookupNode(msg.sender)
+	if sender != nil && sender != myself {
+		if msg.currentEpoch > server.cluster.currentEpoch {
+			server.cluster.currentEpoch = msg.currentEpoch
+			clusterDoBeforeSleep(CLUSTER_TODO_SAVE_CONFIG)
+		}
+		if msg.configEpoch > sender.configEpoch {
+			sender.configEpoch = msg.configEpoch
+			clusterDoBeforeSleep(CLUSTER_TODO_SAVE_CONFIG | CLUSTER_TODO_UPDATE_STATE)
+		}
+	}
+
+	if msg.typ == CLUSTERMSG_TYPE_PING || msg.typ == CLUSTERMSG_TYPE_MEET {
+		// 第一次被 MEET 时从连接的本地地址得知自己的 IP
+		if msg.typ == CLUSTERMSG_TYPE_MEET || myself.ip == "" {
+			if sa, err := unix.Getsockname(link.fd); err == nil {
+				if ip := sockaddrIP(sa); ip != "" && ip != myself.ip {
+					myself.ip = ip
+					serverLog(LL_NOTICE, "IP address for this node updated to %s", ip)
+					clusterDoBeforeSleep(CLUSTER_TODO_SAVE_CONFIG)
+				}
+			}
+		}
+		// 被不认识的节点 MEET 把它加入集群 地址使用连接的对端地址
+		if sender == nil && msg.typ == CLUSTERMSG_TYPE_MEET && verifyClusterNodeId(msg.sender) {
+			if sa, err := unix.Getpeername(link.fd); err == nil {
+				n := createClusterNode(msg.sender, CLUSTER_NODE_MASTER)
+				n.ip = sockaddrIP(sa)
+				n.port = int(msg.port)
+				n.cport = int(msg.cport)
+				n.configEpoch = msg.configEpoch
+				clusterAddNode(n)
+				clusterProcessGossipSection(msg, n)
+				clusterDoBeforeSleep(CLUSTER_TODO_SAVE_CONFIG)
+			}
+		}
+		clusterSendPing(link, CLUSTERMSG_TYPE_PONG)
+	}
+
+	switch msg.typ {
+	case CLUSTERMSG_TYPE_PING, CLUSTERMSG_TYPE_PONG, CLUSTERMSG_TYPE_MEET:
+		if link.node != nil {
+			if link.node.flags&CLUSTER_NODE_HANDSHAKE != 0 {
+				// 已经认识这个节点 握手节点是多余的
+				if sender != nil {
+					serverLog(LL_VERBOSE, "Handshake: we already know node %.40s, removing the handshake node.", sender.name)
+					clusterDelNode(link.node)
+					return false
+				}
+				clusterRenameNode(link.node, msg.sender)
+				link.node.flags &^= CLUSTER_NODE_HANDSHAKE
+				link.node.flags |= CLUSTER_NODE_MASTER
+				link.node.configEpoch = msg.configEpoch
+				sender = link.node
+				clusterDoBeforeSleep(CLUSTER_TODO_SAVE_CONFIG)
+			} else if link.node.name != msg.sender {
+				// 这个地址上已经是另一个节点了
+				serverLog(LL_VERBOSE, "PONG contains mismatching sender ID. About node %.40s added %d ms ago, having flags %d",
+					link.node.name, GetMsTime()-link.node.ctime, link.node.flags)
+				link.node.flags |= CLUSTER_NODE_NOADDR
+				link.node.ip = ""
+				link.node.port = 0
+				link.node.cport = 0
+				freeClusterLink(link)
+				clusterDoBeforeSleep(CLUSTER_TODO_SAVE_CONFIG)
+				return false
+			}
+		}
+		if sender != nil && sender != myself && msg.typ == CLUSTERMSG_TYPE_PING && link.node == nil {
+			nodeUpdateAddressIfNeeded(sender, link, msg)
+		}
+		if link.node != nil && msg.typ == CLUSTERMSG_TYPE_PONG {
+			link.node.pongReceived = GetMsTime()
+			link.node.pingSent = 0
+			if link.node.flags&CLUSTER_NODE_PFAIL != 0 {
+				link.node.flags &^= CLUSTER_NODE_PFAIL
+				clusterDoBeforeSleep(CLUSTER_TODO_UPDATE_STATE)
+			} else if link.node.flags&CLUSTER_NODE_FAIL != 0 {
+				clearNodeFailureIfNeeded(link.node)
+			}
+		}
+		if sender == nil || sender == myself {
+			return true
+		}
+		if sender.flags&CLUSTER_NODE_MASTER != 0 && !bytes.Equal(sender.slots[:], msg.myslots[:]) {
+			clusterUpdateSlotsConfigWith(sender, msg.configEpoch, msg.myslots[:])
+		}
+		if sender.flags&CLUSTER_NODE_MASTER != 0 && msg.configEpoch == myself.configEpoch {
+			clusterHandleConfigEpochCollision(sender)
+		}
+		clusterProcessGossipSection(msg, sender)
+	case CLUSTERMSG_TYPE_FAIL:
+		if sender == nil {
+			return true
+		}
+		failing := clusterLookupNode(msg.failing)
+		if failing != nil && failing.flags&(CLUSTER_NODE_FAIL|CLUSTER_NODE_MYSELF) == 0 {
+			serverLog(LL_NOTICE, "FAIL message received from %.40s about %.40s", msg.sender, msg.failing)
+			failing.flags |= CLUSTER_NODE_FAIL
+			failing.failTime = GetMsTime()
+			failing.flags &^= CLUSTER_NODE_PFAIL
+			clusterDoBeforeSleep(CLUSTER_TODO_UPDATE_STATE | CLUSTER_TODO_SAVE_CONFIG)
+		}
+	}
+	return true
+}
+
+/* ----------------------------- 总线连接 ----------------------------- */
+
+func createClusterLink(fd int, node *clusterNode) *clusterLink {
+	link := &clusterLink{fd: fd, ctime: GetMsTime(), node: node}
+	server.aeLoop.AddFileEvent(fd, AE_READABLE, clusterReadHandler, link)
+	return link
+}
+
+func freeClusterLink(link *clusterLink) {
+	server.aeLoop.RemoveFileEvent(link.fd, AE_READABLE)
+	server.aeLoop.RemoveFileEvent(link.fd, AE_WRITABLE)
+	unix.Close(link.fd)
+	if link.node != nil && link.node.link == link {
+		link.node.link = nil
+	}
+}
+
+func clusterAcceptHandler(loop *AeLoop, fd int, extra interface{}) {
+	cfd, _, err := unix.Accept(fd)
+	if err != nil {
+		serverLog(LL_VERBOSE, "Error accepting cluster node: %v", err)
+		return
+	}
+	unix.SetNonblock(cfd, true)
+	createClusterLink(cfd, nil)
+	serverLog(LL_VERBOSE, "Accepting cluster node connection, fd: %d", cfd)
+}
+
+// 非阻塞地连接节点的总线端口 连接的结果在第一次写入时得知
+func clusterConnectNode(n *clusterNode) (int, error) {
+	ip := net.ParseIP(n.ip).To4()
+	if ip == nil {
+		return -1, fmt.Errorf("invalid address '%s'", n.ip)
+	}
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM|unix.SOCK_NONBLOCK, 0)
+	if err != nil {
+		return -1, err
+	}
+	sa := &unix.SockaddrInet4{Port: n.cport}
+	copy(sa.Addr[:], ip)
+	if err := unix.Connect(fd, sa); err != nil && err != unix.EINPROGRESS {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+func clusterSendMessage(link *clusterLink, msg []byte) {
+	if len(link.sndbuf) == 0 {
+		server.aeLoop.AddFileEvent(link.fd, AE_WRITABLE, clusterWriteHandler, link)
+	}
+	link.sndbuf = append(link.sndbuf, msg...)
+	server.cluster.statMessagesSent++
+}
+
+func clusterWriteHandler(loop *AeLoop, fd int, extra interface{}) {
+	link := extra.(*clusterLink)
+	n, err := unix.Write(fd, link.sndbuf)
+	if err == unix.EAGAIN {
+		return
+	}
+	if err != nil {
+		serverLog(LL_DEBUG, "I/O error writing to node link: %v", err)
+		freeClusterLink(link)
+		return
+	}
+	link.sndbuf = link.sndbuf[n:]
+	if len(link.sndbuf) == 0 {
+		link.sndbuf = nil
+		loop.RemoveFileEvent(fd, AE_WRITABLE)
+	}
+}
+
+func clusterReadHandler(loop *AeLoop, fd int, extra interface{}) {
+	link := extra.(*clusterLink)
+	var buf [GODIS_IO_BUF]byte
+	n, err := unix.Read(fd, buf[:])
+	if err == unix.EAGAIN {
+		return
+	}
+	if err != nil || n == 0 {
+		serverLog(LL_DEBUG, "I/O error reading from node link: %v", err)
+		freeClusterLink(link)
+		return
+	}
+	link.rcvbuf = append(link.rcvbuf, buf[:n]...)
+	for len(link.rcvbuf) >= 8 {
+		totlen := int(binary.BigEndian.Uint32(link.rcvbuf[4:]))
+		if string(link.rcvbuf[:4]) != "RCmb" || totlen < CLUSTERMSG_HDR_SIZE || totlen > CLUSTERMSG_MAX_LEN {
+			serverLog(LL_WARNING, "Bad message length or signature received from Cluster bus.")
+			freeClusterLink(link)
+			return
+		}
+		if len(link.rcvbuf) < totlen {
+			break
+		}
+		msg := link.rcvbuf[:totlen]
+		link.rcvbuf = link.rcvbuf[totlen:]
+		if !clusterProcessPacket(link, msg) {
+			return
+		}
+	}
+	if len(link.rcvbuf) == 0 {
+		link.rcvbuf = nil
+	}
+}
+
+/* ----------------------------- 集群状态 ----------------------------- */
+
+func clusterDoBeforeSleep(flags int) {
+	server.cluster.todoBeforeSleep |= flags
+}
+
+func clusterBeforeSleep() {
+	flags := server.cluster.todoBeforeSleep
+	server.cluster.todoBeforeSleep = 0
+	if flags&CLUSTER_TODO_UPDATE_STATE != 0 {
+		clusterUpdateState()
+	}
+	if flags&CLUSTER_TODO_SAVE_CONFIG != 0 {
+		clusterSaveConfigOrDie()
+	}
+}
+
+/*
+所有槽位都有正常的节点负责（cluster-require-full-coverage no 时不检查）
+并且本节点能联系上多数主节点时集群才可用
+*/
+func clusterUpdateState() {
+	newState := CLUSTER_OK
+	if server.clusterRequireFullCoverage {
+		for j := 0; j < CLUSTER_SLOTS; j++ {
+			n := server.cluster.slots[j]
+			if n == nil || n.flags&CLUSTER_NODE_FAIL != 0 {
+				newState = CLUSTER_FAIL
+				break
+			}
+		}
+	}
+	size, reachable := 0, 0
+	for _, n := range server.cluster.nodes {
+		if n.flags&CLUSTER_NODE_MASTER != 0 && n.numslots > 0 {
+			size++
+			if n.flags&(CLUSTER_NODE_FAIL|CLUSTER_NODE_PFAIL) == 0 {
+				reachable++
+			}
+		}
+	}
+	server.cluster.size = size
+	if reachable < clusterNeededQuorum() {
+		newState = CLUSTER_FAIL
+	}
+	if newState != server.cluster.state {
+		serverLog(LL_NOTICE, "Cluster state changed: %s", clusterStateName(newState))
+		server.cluster.state = newState
+	}
+}
+
+func clusterStateName(state int) string {
+	if state == CLUSTER_OK {
+		return "ok"
+	}
+	return "fail"
+}
+
+var clusterCronIteration int64
+
+/*
+每 100 毫秒执行一次
+连接还没有连接的节点 每秒随机挑选 PONG 最旧的节点发送 PING
+超过 nodeTimeout 没有收到 PONG 的节点标记为 PFAIL
+*/
+func clusterCron() {
+	now := GetMsTime()
+	clusterCronIteration++
+	handshakeTimeout := max(server.clusterNodeTimeout, 1000)
+	for _, n := range server.cluster.nodes {
+		if n.flags&(CLUSTER_NODE_MYSELF|CLUSTER_NODE_NOADDR) != 0 {
+			continue
+		}
+		if n.flags&CLUSTER_NODE_HANDSHAKE != 0 && now-n.ctime > handshakeTimeout {
+			clusterDelNode(n)
+			continue
+		}
+		if n.link != nil {
+			continue
+		}
+		fd, err := clusterConnectNode(n)
+		if err != nil {
+			// 连不上也算作没有回复 PING
+			if n.pingSent == 0 {
+				n.pingSent = now
+			}
+			serverLog(LL_DEBUG, "Unable to connect to Cluster Node [%s]:%d -> %v", n.ip, n.cport, err)
+			continue
+		}
+		n.link = createClusterLink(fd, n)
+		if n.flags&CLUSTER_NODE_MEET != 0 {
+			clusterSendPing(n.link, CLUSTERMSG_TYPE_MEET)
+		} else {
+			clusterSendPing(n.link, CLUSTERMSG_TYPE_PING)
+		}
+		n.flags &^= CLUSTER_NODE_MEET
+		serverLog(LL_DEBUG, "Connecting with Node %.40s at %s:%d", n.name, n.ip, n.cport)
+	}
+
+	if clusterCronIteration%10 == 0 {
+		var minNode *clusterNode
+		for j := 0; j < 5 && len(server.cluster.nodes) > 0; j++ {
+			n := clusterRandomNode()
+			if n.link == nil || n.pingSent != 0 || n.flags&(CLUSTER_NODE_MYSELF|CLUSTER_NODE_HANDSHAKE) != 0 {
+				continue
+			}
+			if minNode == nil || n.pongReceived < minNode.pongReceived {
+				minNode = n
+			}
+		}
+		if minNode != nil {
+			clusterSendPing(minNode.link, CLUSTERMSG_TYPE_PING)
+		}
+	}
+
+	update := false
+	for _, n := range server.cluster.nodes {
+		if n.flags&(CLUSTER_NODE_MYSELF|CLUSTER_NODE_NOADDR|CLUSTER_NODE_HANDSHAKE) != 0 {
+			continue
+		}
+		// 等待 PONG 的时间过长 连接可能有问题 重新连接
+		if n.link != nil && now-n.link.ctime > server.clusterNodeTimeout && n.pingSent != 0 &&
+			now-n.pingSent > server.clusterNodeTimeout/2 {
+			freeClusterLink(n.link)
+		}
+		if n.link != nil && n.pingSent == 0 && now-n.pongReceived > server.clusterNodeTimeout/2 {
+			clusterSendPing(n.link, CLUSTERMSG_TYPE_PING)
+			continue
+		}
+		if n.pingSent == 0 {
+			continue
+		}
+		if now-n.pingSent > server.clusterNodeTimeout && n.flags&(CLUSTER_NODE_PFAIL|CLUSTER_NODE_FAIL) == 0 {
+			serverLog(LL_DEBUG, "*** NODE %.40s possibly failing", n.name)
+			n.flags |= CLUSTER_NODE_PFAIL
+			update = true
+		}
+	}
+	if update || server.cluster.todoBeforeSleep&CLUSTER_TODO_UPDATE_STATE != 0 {
+		clusterUpdateState()
+	}
+}
+
+func clusterRandomNode() *clusterNode {
+	i := rand.Intn(len(server.cluster.nodes))
+	for _, n := range server.cluster.nodes {
+		if i == 0 {
+			return n
+		}
+		i--
+	}
+	return nil
+}
+
+/* ----------------------------- 配置文件 ----------------------------- */
+
+func representClusterNodeFlags(flags int) string {
+	var names []string
+	for _, f := range []struct {
+		flag int
+		name string
+	}{
+		{CLUSTER_NODE_MYSELF, "myself"},
+		{CLUSTER_NODE_MASTER, "master"},
+		{CLUSTER_NODE_SLAVE, "slave"},
+		{CLUSTER_NODE_PFAIL, "fail?"},
+		{CLUSTER_NODE_FAIL, "fail"},
+		{CLUSTER_NODE_HANDSHAKE, "handshake"},
+		{CLUSTER_NODE_NOADDR, "noaddr"},
+	} {
+		if flags&f.flag != 0 {
+			names = append(names, f.name)
+		}
+	}
+	if len(names) == 0 {
+		return "noflags"
+	}
+	return strings.Join(names, ",")
+}
+
+/*
+和 CLUSTER NODES 的格式相同 每个节点一行
+<id> <ip:port@cport> <flags> <master> <ping-sent> <pong-recv> <config-epoch> <link-state> <slot> ...
+本节点正在迁移和导入的槽位写成 [slot->-id] 和 [slot-<-id]
+*/
+func clusterGenNodeDescription(n *clusterNode) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s:%d@%d %s - %d %d %d ", n.name, n.ip, n.port, n.cport,
+		representClusterNodeFlags(n.flags), n.pingSent, n.pongReceived, n.configEpoch)
+	if n.link != nil || n.flags&CLUSTER_NODE_MYSELF != 0 {
+		b.WriteString("connected")
+	} else {
+		b.WriteString("disconnected")
+	}
+	for _, r := range clusterNodeSlotRanges(n) {
+		if r[0] == r[1] {
+			fmt.Fprintf(&b, " %d", r[0])
+		} else {
+			fmt.Fprintf(&b, " %d-%d", r[0], r[1])
+		}
+	}
+	if n.flags&CLUSTER_NODE_MYSELF != 0 {
+		for j := 0; j < CLUSTER_SLOTS; j++ {
+			if to := server.cluster.migratingSlotsTo[j]; to != nil {
+				fmt.Fprintf(&b, " [%d->-%s]", j, to.name)
+			} else if from := server.cluster.importingSlotsFrom[j]; from != nil {
+				fmt.Fprintf(&b, " [%d-<-%s]", j, from.name)
+			}
+		}
+	}
+	return b.String()
+}
+
+// 节点负责的连续槽位区间
+func clusterNodeSlotRanges(n *clusterNode) [][2]int {
+	var ranges [][2]int
+	start := -1
+	for j := 0; j <= CLUSTER_SLOTS; j++ {
+		if j < CLUSTER_SLOTS && bitmapTestBit(n.slots[:], j) {
+			if start == -1 {
+				start = j
+			}
+		} else if start != -1 {
+			ranges = append(ranges, [2]int{start, j - 1})
+			start = -1
+		}
+	}
+	return ranges
+}
+
+// 按名字排序 filter 中的节点不输出
+func clusterGenNodesDescription(filter int) string {
+	var b strings.Builder
+	for _, n := range clusterSortedNodes() {
+		if n.flags&filter != 0 {
+			continue
+		}
+		b.WriteString(clusterGenNodeDescription(n))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func clusterSortedNodes() []*clusterNode {
+	nodes := make([]*clusterNode, 0, len(server.cluster.nodes))
+	for _, n := range server.cluster.nodes {
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].name < nodes[j].name })
+	return nodes
+}
+
+// 先写入临时文件 fsync 之后再 rename
+func clusterSaveConfig() error {
+	content := clusterGenNodesDescription(CLUSTER_NODE_HANDSHAKE) +
+		fmt.Sprintf("vars currentEpoch %d lastVoteEpoch 0\n", server.cluster.currentEpoch)
+	tmpfile := fmt.Sprintf("%s.tmp-%d", server.clusterConfigfile, os.Getpid())
+	f, err := os.Create(tmpfile)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(content)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpfile, server.clusterConfigfile)
+	}
+	if err != nil {
+		os.Remove(tmpfile)
+	}
+	return err
+}
+
+func clusterSaveConfigOrDie() {
+	if err := clusterSaveConfig(); err != nil {
+		serverLog(LL_WARNING, "Fatal: can't update cluster config file: %v", err)
+		os.Exit(1)
+	}
+}
+
+// 解析 ip:port@cport
+func parseClusterNodeAddress(addr string) (string, int, int, error) {
+	at := strings.LastIndexByte(addr, '@')
+	colon := strings.LastIndexByte(addr, ':')
+	if at < 0 || colon < 0 || colon > at {
+		return "", 0, 0, fmt.Errorf("invalid address '%s'", addr)
+	}
+	port, err1 := strconv.Atoi(addr[colon+1 : at])
+	cport, err2 := strconv.Atoi(addr[at+1:])
+	if err1 != nil || err2 != nil {
+		return "", 0, 0, fmt.Errorf("invalid address '%s'", addr)
+	}
+	return addr[:colon], port, cport, nil
+}
+
+// 文件不存在时返回 os.IsNotExist 的错误
+func clusterLoadConfig(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		argv := strings.Fields(line)
+		if len(argv) == 0 {
+			continue
+		}
+		if err := clusterLoadConfigLine(argv); err != nil {
+			return fmt.Errorf("unrecoverable error in cluster config file %s at line %d: %v", filename, i+1, err)
+		}
+	}
+	if server.cluster.myself == nil {
+		return fmt.Errorf("myself node not found in cluster config file %s", filename)
+	}
+	if maxEpoch := clusterGetMaxEpoch(); maxEpoch > server.cluster.currentEpoch {
+		server.cluster.currentEpoch = maxEpoch
+	}
+	serverLog(LL_NOTICE, "Node configuration loaded, I'm %.40s", server.cluster.myself.name)
+	return nil
+}
+
+func clusterLoadConfigLine(argv []string) error {
+	if argv[0] == "vars" {
+		for j := 1; j+1 < len(argv); j += 2 {
+			if argv[j] == "currentEpoch" {
+				epoch, err := strconv.ParseUint(argv[j+1], 10, 64)
+				if err != nil {
+					return err
+				}
+				server.cluster.currentEpoch = epoch
+			}
+		}
+		return nil
+	}
+	if len(argv) < 8 {
+		return errors.New("wrong number of fields")
+	}
+	n := clusterLookupNode(argv[0])
+	if n == nil {
+		n = createClusterNode(argv[0], 0)
+		clusterAddNode(n)
+	}
+	var err error
+	if n.ip, n.port, n.cport, err = parseClusterNodeAddress(argv[1]); err != nil {
+		return err
+	}
+	for _, f := range strings.Split(argv[2], ",") {
+		switch f {
+		case "myself":
+			server.cluster.myself = n
+			n.flags |= CLUSTER_NODE_MYSELF
+		case "master":
+			n.flags |= CLUSTER_NODE_MASTER
+		case "slave":
+			n.flags |= CLUSTER_NODE_SLAVE
+		case "fail?":
+			n.flags |= CLUSTER_NODE_PFAIL
+		case "fail":
+			n.flags |= CLUSTER_NODE_FAIL
+			n.failTime = GetMsTime()
+		case "handshake":
+			n.flags |= CLUSTER_NODE_HANDSHAKE
+		case "noaddr":
+			n.flags |= CLUSTER_NODE_NOADDR
+		case "noflags":
+		default:
+			return fmt.Errorf("unknown flag '%s'", f)
+		}
+	}
+	if argv[4] != "0" {
+		n.pingSent = GetMsTime()
+	}
+	if argv[5] != "0" {
+		n.pongReceived = GetMsTime()
+	}
+	if n.configEpoch, err = strconv.ParseUint(argv[6], 10, 64); err != nil {
+		return err
+	}
+	for _, arg := range argv[8:] {
+		if arg[0] == '[' {
+			// [slot->-id] 或 [slot-<-id]
+			p := strings.IndexByte(arg, '-')
+			if p < 0 || len(arg) < p+3 {
+				return fmt.Errorf("invalid slot '%s'", arg)
+			}
+			slot, err := strconv.Atoi(arg[1:p])
+			if err != nil || slot < 0 || slot >= CLUSTER_SLOTS {
+				return fmt.Errorf("invalid slot '%s'", arg)
+			}
+			direction := arg[p+1]
+			name := strings.TrimSuffix(arg[p+3:], "]")
+			cn := clusterLookupNode(name)
+			if cn == nil {
+				cn = createClusterNode(name, 0)
+				clusterAddNode(cn)
+			}
+			if direction == '>' {
+				server.cluster.migratingSlotsTo[slot] = cn
+			} else {
+				server.cluster.importingSlotsFrom[slot] = cn
+			}
+			continue
+		}
+		start, stop := arg, arg
+		if p := strings.IndexByte(arg, '-'); p >= 0 {
+			start, stop = arg[:p], arg[p+1:]
+		}
+		s, err1 := strconv.Atoi(start)
+		e, err2 := strconv.Atoi(stop)
+		if err1 != nil || err2 != nil || s < 0 || e >= CLUSTER_SLOTS || s > e {
+			return fmt.Errorf("invalid slot range '%s'", arg)
+		}
+		for j := s; j <= e; j++ {
+			clusterDelSlot(j)
+			clusterAddSlot(n, j)
+		}
+	}
+	return nil
+}
+
+/*
+加载配置 没有配置文件时以新节点的身份启动 然后监听集群总线端口
+在加载数据之前调用 加载的 key 会记录到所在的槽位
+*/
+func clusterInit(backlog int) error {
+	server.cluster = &clusterState{
+		state: CLUSTER_FAIL,
+		nodes: make(map[string]*clusterNode),
+		fd:    -1,
+	}
+	if err := clusterLoadConfig(server.clusterConfigfile); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		myself := createClusterNode("", CLUSTER_NODE_MYSELF|CLUSTER_NODE_MASTER)
+		server.cluster.myself = myself
+		clusterAddNode(myself)
+		serverLog(LL_NOTICE, "No cluster configuration found, I'm %.40s", myself.name)
+		if err := clusterSaveConfig(); err != nil {
+			return err
+		}
+	}
+	cport := server.clusterPort
+	if cport == 0 {
+		cport = server.port + CLUSTER_PORT_INCR
+	}
+	if cport > 65535 {
+		return errors.New("Redis port number too high. Cluster communication port is 10,000 port numbers higher than your Redis port. Your Redis port number must be 55535 or less.")
+	}
+	fd, err := TcpServer(server.bind, cport, backlog)
+	if err != nil {
+		return err
+	}
+	server.cluster.fd = fd
+	server.cluster.myself.port = server.port
+	server.cluster.myself.cport = cport
+	clusterUpdateState()
+	return nil
+}
+
+/*
+加载数据之后检查 key 所在的槽位
+没有节点负责的槽位由本节点负责 其他节点负责的槽位设置为导入状态 由管理员处理
+*/
+func verifyClusterConfigWithData() error {
+	for _, db := range server.dbs[1:] {
+		if db.data.Len() > 0 {
+			return errors.New("You have keys in a different DB other than DB 0. Cluster mode only supports DB 0.")
+		}
+	}
+	updateConfig := false
+	for j := 0; j < CLUSTER_SLOTS; j++ {
+		if countKeysInSlot(j) == 0 {
+			continue
+		}
+		owner := server.cluster.slots[j]
+		if owner == server.cluster.myself || server.cluster.importingSlotsFrom[j] != nil {
+			continue
+		}
+		updateConfig = true
+		if owner == nil {
+			serverLog(LL_WARNING, "I have keys for unassigned slot %d. Taking responsibility for it.", j)
+			clusterAddSlot(server.cluster.myself, j)
+		} else {
+			serverLog(LL_WARNING, "I have keys for slot %d, but the slot is assigned to another node. Setting it to importing state.", j)
+			server.cluster.importingSlotsFrom[j] = owner
+		}
+	}
+	if updateConfig {
+		return clusterSaveConfig()
+	}
+	return nil
+}
+
+/* ----------------------------- 重定向 ----------------------------- */
+
+/*
+返回能够执行这个命令的节点 本节点可以执行时返回 myself
+所有 key 必须在同一个槽位 EXEC 检查事务中的全部命令
+槽位正在迁出并且有 key 不存在时返回 ASK（多个 key 时返回 TRYAGAIN）
+槽位正在导入时只接受 ASKING 之后的命令
+*/
+func getNodeByQuery(c *GodisClient, cmd *GodisCommand, args []*Gobj) (*clusterNode, int, int) {
+	myself := server.cluster.myself
+	cmds := []multiCmd{{args: args, cmd: cmd}}
+	if cmd.name == "exec" {
+		if c.flags&CLIENT_MULTI == 0 {
+			return myself, 0, CLUSTER_REDIR_NONE
+		}
+		cmds = c.mstate.commands
+	}
+	var n *clusterNode
+	var firstkey *Gobj
+	slot := 0
+	migrating, importing, multipleKeys := false, false, false
+	missingKeys := 0
+	for _, mc := range cmds {
+		for _, idx := range getKeysFromCommand(mc.cmd, mc.args) {
+			key := mc.args[idx]
+			thisslot := keyHashSlot(key.StrVal())
+			if firstkey == nil {
+				firstkey = key
+				slot = thisslot
+				n = server.cluster.slots[slot]
+				if n == nil {
+					return nil, slot, CLUSTER_REDIR_DOWN_UNBOUND
+				}
+				if n == myself && server.cluster.migratingSlotsTo[slot] != nil {
+					migrating = true
+				} else if server.cluster.importingSlotsFrom[slot] != nil {
+					importing = true
+				}
+			} else if !GStrEqual(firstkey, key) {
+				if thisslot != slot {
+					return nil, 0, CLUSTER_REDIR_CROSS_SLOT
+				}
+				multipleKeys = true
+			}
+			if (migrating || importing) && c.db.data.Get(key) == nil {
+				missingKeys++
+			}
+		}
+	}
+	if n == nil {
+		return myself, 0, CLUSTER_REDIR_NONE
+	}
+	if server.cluster.state != CLUSTER_OK {
+		return nil, 0, CLUSTER_REDIR_DOWN_STATE
+	}
+	if migrating && missingKeys > 0 {
+		if multipleKeys {
+			return nil, 0, CLUSTER_REDIR_UNSTABLE
+		}
+		return server.cluster.migratingSlotsTo[slot], slot, CLUSTER_REDIR_ASK
+	}
+	if importing && (c.flags&CLIENT_ASKING != 0 || cmd.flags&CMD_ASKING != 0) {
+		if multipleKeys && missingKeys > 0 {
+			return nil, 0, CLUSTER_REDIR_UNSTABLE
+		}
+		return myself, slot, CLUSTER_REDIR_NONE
+	}
+	if n != myself {
+		return n, slot, CLUSTER_REDIR_MOVED
+	}
+	return n, slot, CLUSTER_REDIR_NONE
+}
+
+func clusterRedirectClient(c *GodisClient, n *clusterNode, slot int, code int) {
+	switch code {
+	case CLUSTER_REDIR_CROSS_SLOT:
+		c.AddReplyError("-CROSSSLOT Keys in request don't hash to the same slot")
+	case CLUSTER_REDIR_UNSTABLE:
+		c.AddReplyError("-TRYAGAIN Multiple keys request during rehashing of slot")
+	case CLUSTER_REDIR_DOWN_STATE:
+		c.AddReplyError("-CLUSTERDOWN The cluster is down")
+	case CLUSTER_REDIR_DOWN_UNBOUND:
+		c.AddReplyError("-CLUSTERDOWN Hash slot not served")
+	case CLUSTER_REDIR_MOVED:
+		c.AddReplyErrorFormat("-MOVED %d %s:%d", slot, n.ip, n.port)
+	case CLUSTER_REDIR_ASK:
+		c.AddReplyErrorFormat("-ASK %d %s:%d", slot, n.ip, n.port)
+	}
+}
+
+/* ----------------------------- CLUSTER 命令 ----------------------------- */
+
+func getSlotOrReply(c *GodisClient, o *Gobj) (int, bool) {
+	slot, err := o.ParseInt()
+	if err != nil || slot < 0 || slot >= CLUSTER_SLOTS {
+		c.AddReplyError("Invalid or out of range slot")
+		return 0, false
+	}
+	return int(slot), true
+}
+
+func clusterCommand(c *GodisClient) {
+	if !server.clusterEnabled {
+		c.AddReplyError("This instance has cluster support disabled")
+		return
+	}
+	myself := server.cluster.myself
+	sub := strings.ToLower(c.args[1].StrVal())
+	switch {
+	case sub == "meet" && (len(c.args) == 4 || len(c.args) == 5):
+		// CLUSTER MEET <ip> <port> [cport]
+		port, err := strconv.Atoi(c.args[3].StrVal())
+		if err != nil {
+			c.AddReplyErrorFormat("Invalid base port specified: %s", c.args[3].StrVal())
+			return
+		}
+		cport := port + CLUSTER_PORT_INCR
+		if len(c.args) == 5 {
+			if cport, err = strconv.Atoi(c.args[4].StrVal()); err != nil {
+				c.AddReplyErrorFormat("Invalid bus port specified: %s", c.args[4].StrVal())
+				return
+			}
+		}
+		if !clusterStartHandshake(c.args[2].StrVal(), port, cport) {
+			c.AddReplyErrorFormat("Invalid node address specified: %s:%s", c.args[2].StrVal(), c.args[3].StrVal())
+			return
+		}
+		c.AddReply(shared.ok)
+	case sub == "nodes" && len(c.args) == 2:
+		c.AddReplyVerbatim(clusterGenNodesDescription(0), "txt")
+	case sub == "myid" && len(c.args) == 2:
+		c.AddReplyBulkStr(myself.name)
+	case sub == "slots" && len(c.args) == 2:
+		clusterReplySlots(c)
+	case sub == "shards" && len(c.args) == 2:
+		clusterReplyShards(c)
+	case sub == "info" && len(c.args) == 2:
+		c.AddReplyVerbatim(clusterGenInfoString(), "txt")
+	case sub == "keyslot" && len(c.args) == 3:
+		c.AddReplyInt(int64(keyHashSlot(c.args[2].StrVal())))
+	case sub == "countkeysinslot" && len(c.args) == 3:
+		slot, err := c.args[2].ParseInt()
+		if err != nil || slot < 0 || slot >= CLUSTER_SLOTS {
+			c.AddReplyError("Invalid slot")
+			return
+		}
+		c.AddReplyInt(int64(countKeysInSlot(int(slot))))
+	case sub == "getkeysinslot" && len(c.args) == 4:
+		maxkeys, err := c.args[3].ParseInt()
+		if err != nil || maxkeys < 0 {
+			c.AddReplyError("Invalid slot or number of keys")
+			return
+		}
+		slot, err := c.args[2].ParseInt()
+		if err != nil || slot < 0 || slot >= CLUSTER_SLOTS {
+			c.AddReplyError("Invalid slot or number of keys")
+			return
+		}
+		keys := getKeysInSlot(int(slot), int(maxkeys))
+		c.AddReplyArrayLen(len(keys))
+		for _, key := range keys {
+			c.AddReplyBulkStr(key)
+		}
+	case (sub == "addslots" || sub == "delslots") && len(c.args) >= 3:
+		// CLUSTER ADDSLOTS <slot> [slot] ...
+		slots := make([]int, 0, len(c.args)-2)
+		for _, arg := range c.args[2:] {
+			slot, ok := getSlotOrReply(c, arg)
+			if !ok {
+				return
+			}
+			slots = append(slots, slot)
+		}
+		clusterUpdateSlots(c, slots, sub == "addslots")
+	case (sub == "addslotsrange" || sub == "delslotsrange") && len(c.args) >= 4 && len(c.args)%2 == 0:
+		// CLUSTER ADDSLOTSRANGE <start> <end> [<start> <end>] ...
+		var slots []int
+		for j := 2; j < len(c.args); j += 2 {
+			start, ok := getSlotOrReply(c, c.args[j])
+			if !ok {
+				return
+			}
+			end, ok := getSlotOrReply(c, c.args[j+1])
+			if !ok {
+				return
+			}
+			if start > end {
+				c.AddReplyErrorFormat("start slot number %d is greater than end slot number %d", start, end)
+				return
+			}
+			for s := start; s <= end; s++ {
+				slots = append(slots, s)
+			}
+		}
+		clusterUpdateSlots(c, slots, sub == "addslotsrange")
+	case sub == "setslot" && len(c.args) >= 4:
+		clusterSetSlotCommand(c)
+	default:
+		c.AddReplyErrorFormat("unknown subcommand or wrong number of arguments for '%s'. Try CLUSTER HELP.", c.args[1].StrVal())
+	}
+}
+
+// 先检查全部槽位 有一个不满足条件时都不修改
+func clusterUpdateSlots(c *GodisClient, slots []int, add bool) {
+	seen := make(map[int]bool, len(slots))
+	for _, slot := range slots {
+		if add && server.cluster.slots[slot] != nil {
+			c.AddReplyErrorFormat("Slot %d is already busy", slot)
+			return
+		}
+		if !add && server.cluster.slots[slot] == nil {
+			c.AddReplyErrorFormat("Slot %d is already unassigned", slot)
+			return
+		}
+		if seen[slot] {
+			c.AddReplyErrorFormat("Slot %d specified multiple times", slot)
+			return
+		}
+		seen[slot] = true
+	}
+	for _, slot := range slots {
+		if add {
+			// 成为真正的负责节点 不再需要导入状态
+			server.cluster.importingSlotsFrom[slot] = nil
+			clusterAddSlot(server.cluster.myself, slot)
+		} else {
+			clusterDelSlot(slot)
+		}
+	}
+	clusterDoBeforeSleep(CLUSTER_TODO_UPDATE_STATE | CLUSTER_TODO_SAVE_CONFIG)
+	c.AddReply(shared.ok)
+}
+
+/*
+CLUSTER SETSLOT <slot> IMPORTING <node> | MIGRATING <node> | STABLE | NODE <node>
+迁移一个槽位的步骤:
+ 1. 目标节点 SETSLOT IMPORTING 源节点
+ 2. 源节点 SETSLOT MIGRATING 目标节点
+ 3. 源节点 GETKEYSINSLOT 然后 MIGRATE 每个 key
+ 4. 两个节点都 SETSLOT NODE 目标节点
+*/
+func clusterSetSlotCommand(c *GodisClient) {
+	myself := server.cluster.myself
+	slot, ok := getSlotOrReply(c, c.args[2])
+	if !ok {
+		return
+	}
+	action := strings.ToLower(c.args[3].StrVal())
+	switch {
+	case action == "migrating" && len(c.args) == 5:
+		if server.cluster.slots[slot] != myself {
+			c.AddReplyErrorFormat("I'm not the owner of hash slot %d", slot)
+			return
+		}
+		n := clusterLookupNode(c.args[4].StrVal())
+		if n == nil {
+			c.AddReplyErrorFormat("I don't know about node %s", c.args[4].StrVal())
+			return
+		}
+		server.cluster.migratingSlotsTo[slot] = n
+	case action == "importing" && len(c.args) == 5:
+		if server.cluster.slots[slot] == myself {
+			c.AddReplyErrorFormat("I'm already the owner of hash slot %d", slot)
+			return
+		}
+		n := clusterLookupNode(c.args[4].StrVal())
+		if n == nil {
+			c.AddReplyErrorFormat("I don't know about node %s", c.args[4].StrVal())
+			return
+		}
+		server.cluster.importingSlotsFrom[slot] = n
+	case action == "stable" && len(c.args) == 4:
+		server.cluster.importingSlotsFrom[slot] = nil
+		server.cluster.migratingSlotsTo[slot] = nil
+	case action == "node" && len(c.args) == 5:
+		n := clusterLookupNode(c.args[4].StrVal())
+		if n == nil {
+			c.AddReplyErrorFormat("Unknown node %s", c.args[4].StrVal())
+			return
+		}
+		if server.cluster.slots[slot] == myself && n != myself && countKeysInSlot(slot) != 0 {
+			c.AddReplyErrorFormat("Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot)
+			return
+		}
+		// 迁出完成
+		if countKeysInSlot(slot) == 0 && server.cluster.migratingSlotsTo[slot] != nil {
+			server.cluster.migratingSlotsTo[slot] = nil
+		}
+		clusterDelSlot(slot)
+		clusterAddSlot(n, slot)
+		// 导入完成 递增纪元让其他节点接受新的归属 然后马上通知它们
+		if n == myself && server.cluster.importingSlotsFrom[slot] != nil {
+			if clusterBumpConfigEpochWithoutConsensus() {
+				serverLog(LL_NOTICE, "configEpoch updated after importing slot %d", slot)
+			}
+			server.cluster.importingSlotsFrom[slot] = nil
+			clusterBroadcastPong()
+		}
+	default:
+		c.AddReplyError("Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP")
+		return
+	}
+	clusterDoBeforeSleep(CLUSTER_TODO_SAVE_CONFIG | CLUSTER_TODO_UPDATE_STATE)
+	c.AddReply(shared.ok)
+}
+
+func addNodeReplyForClusterSlots(c *GodisClient, n *clusterNode) {
+	c.AddReplyArrayLen(4)
+	c.AddReplyBulkStr(n.ip)
+	c.AddReplyInt(int64(n.port))
+	c.AddReplyBulkStr(n.name)
+	c.AddReplyMapLen(0)
+}
+
+// 按槽位顺序输出每个连续区间 [start, end, [ip, port, id, {}]]
+func clusterReplySlots(c *GodisClient) {
+	node := c.AddReplyDeferredLen()
+	count := 0
+	start := 0
+	for j := 1; j <= CLUSTER_SLOTS; j++ {
+		n := server.cluster.slots[start]
+		if j < CLUSTER_SLOTS && server.cluster.slots[j] == n {
+			continue
+		}
+		if n != nil {
+			c.AddReplyArrayLen(3)
+			c.AddReplyInt(int64(start))
+			c.AddReplyInt(int64(j - 1))
+			addNodeReplyForClusterSlots(c, n)
+			count++
+		}
+		start = j
+	}
+	c.SetDeferredArrayLen(node, count)
+}
+
+// 每个主节点是一个分片 [{slots: [start, end ...], nodes: [{id, port, ip, ...}]}]
+func clusterReplyShards(c *GodisClient) {
+	var masters []*clusterNode
+	for _, n := range clusterSortedNodes() {
+		if n.flags&CLUSTER_NODE_MASTER != 0 && n.flags&CLUSTER_NODE_HANDSHAKE == 0 {
+			masters = append(masters, n)
+		}
+	}
+	c.AddReplyArrayLen(len(masters))
+	for _, n := range masters {
+		c.AddReplyMapLen(2)
+		c.AddReplyBulkStr("slots")
+		ranges := clusterNodeSlotRanges(n)
+		c.AddReplyArrayLen(len(ranges) * 2)
+		for _, r := range ranges {
+			c.AddReplyInt(int64(r[0]))
+			c.AddReplyInt(int64(r[1]))
+		}
+		c.AddReplyBulkStr("nodes")
+		c.AddReplyArrayLen(1)
+		c.AddReplyMapLen(7)
+		c.AddReplyBulkStr("id")
+		c.AddReplyBulkStr(n.name)
+		c.AddReplyBulkStr("port")
+		c.AddReplyInt(int64(n.port))
+		c.AddReplyBulkStr("ip")
+		c.AddReplyBulkStr(n.ip)
+		c.AddReplyBulkStr("endpoint")
+		c.AddReplyBulkStr(n.ip)
+		c.AddReplyBulkStr("role")
+		c.AddReplyBulkStr("master")
+		c.AddReplyBulkStr("replication-offset")
+		if n == server.cluster.myself {
+			c.AddReplyInt(server.masterReplOffset)
+		} else {
+			c.AddReplyInt(0)
+		}
+		c.AddReplyBulkStr("health")
+		if n.flags&CLUSTER_NODE_FAIL != 0 {
+			c.AddReplyBulkStr("fail")
+		} else {
+			c.AddReplyBulkStr("online")
+		}
+	}
+}
+
+func clusterGenInfoString() string {
+	assigned, pfail, fail := 0, 0, 0
+	for j := 0; j < CLUSTER_SLOTS; j++ {
+		n := server.cluster.slots[j]
+		if n == nil {
+			continue
+		}
+		assigned++
+		if n.flags&CLUSTER_NODE_FAIL != 0 {
+			fail++
+		} else if n.flags&CLUSTER_NODE_PFAIL != 0 {
+			pfail++
+		}
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "cluster_state:%s\r\n", clusterStateName(server.cluster.state))
+	fmt.Fprintf(&b, "cluster_slots_assigned:%d\r\n", assigned)
+	fmt.Fprintf(&b, "cluster_slots_ok:%d\r\n", assigned-pfail-fail)
+	fmt.Fprintf(&b, "cluster_slots_pfail:%d\r\n", pfail)
+	fmt.Fprintf(&b, "cluster_slots_fail:%d\r\n", fail)
+	fmt.Fprintf(&b, "cluster_known_nodes:%d\r\n", len(server.cluster.nodes))
+	fmt.Fprintf(&b, "cluster_size:%d\r\n", server.cluster.size)
+	fmt.Fprintf(&b, "cluster_current_epoch:%d\r\n", server.cluster.currentEpoch)
+	fmt.Fprintf(&b, "cluster_my_epoch:%d\r\n", server.cluster.myself.configEpoch)
+	fmt.Fprintf(&b, "cluster_stats_messages_sent:%d\r\n", server.cluster.statMessagesSent)
+	fmt.Fprintf(&b, "cluster_stats_messages_received:%d\r\n", server.cluster.statMessagesReceived)
+	return b.String()
+}
+
+// 下一条命令可以访问正在导入的槽位
+func askingCommand(c *GodisClient) {
+	if !server.clusterEnabled {
+		c.AddReplyError("This instance has cluster support disabled")
+		return
+	}
+	c.flags |= CLIENT_ASKING
+	c.AddReply(shared.ok)
+}
+
+/* ----------------------------- DUMP / RESTORE / MIGRATE ----------------------------- */
+
+/*
+DUMP 的格式: RDB 类型 + RDB 编码的值 + 2 字节 RDB 版本 + 8 字节 CRC64
+版本和校验和都是小端序 校验和覆盖前面的全部内容
+*/
+func createDumpPayload(o *Gobj) string {
+	var buf bytes.Buffer
+	rdb := &rdbWriter{w: &buf}
+	rdb.saveType(rdbObjectType(o))
+	rdb.saveObject(o)
+	rdb.write([]byte{RDB_VERSION & 0xff, RDB_VERSION >> 8 & 0xff})
+	crc := make([]byte, 8)
+	binary.LittleEndian.PutUint64(crc, rdb.crc)
+	buf.Write(crc)
+	return buf.String()
+}
+
+func verifyDumpPayload(p string) bool {
+	if len(p) < 10 {
+		return false
+	}
+	footer := p[len(p)-10:]
+	if ver := int(footer[0]) | int(footer[1])<<8; ver > RDB_VERSION {
+		return false
+	}
+	return crc64(0, []byte(p[:len(p)-8])) == binary.LittleEndian.Uint64([]byte(footer[2:]))
+}
+
+func decodeDumpPayload(p string) (*Gobj, error) {
+	rdb := &rdbReader{r: bufio.NewReader(strings.NewReader(p[:len(p)-10])), left: int64(len(p) - 10)}
+	typ, err := rdb.loadType()
+	if err != nil {
+		return nil, err
+	}
+	return rdb.loadObject(typ)
+}
+
+func dumpCommand(c *GodisClient) {
+	o := c.db.lookupKeyRead(c.args[1])
+	if o == nil {
+		c.AddReplyNull()
+		return
+	}
+	c.AddReplyBulkStr(createDumpPayload(o))
+}
+
+// RESTORE key ttl serialized-value [REPLACE] [ABSTTL] [IDLETIME seconds] [FREQ frequency]
+func restoreCommand(c *GodisClient) {
+	key := c.args[1]
+	replace, absttl := false, false
+	lfuFreq, lruIdle := int64(-1), int64(-1)
+	for j := 4; j < len(c.args); j++ {
+		more := len(c.args) - j - 1
+		switch opt := strings.ToLower(c.args[j].StrVal()); {
+		case opt == "replace":
+			replace = true
+		case opt == "absttl":
+			absttl = true
+		case opt == "idletime" && more >= 1 && lfuFreq == -1:
+			v, ok := getLongLongFromObjectOrReply(c, c.args[j+1], "")
+			if !ok {
+				return
+			}
+			if v < 0 {
+				c.AddReplyError("Invalid IDLETIME value, must be >= 0")
+				return
+			}
+			lruIdle = v
+			j++
+		case opt == "freq" && more >= 1 && lruIdle == -1:
+			v, ok := getLongLongFromObjectOrReply(c, c.args[j+1], "")
+			if !ok {
+				return
+			}
+			if v < 0 || v > 255 {
+				c.AddReplyError("Invalid FREQ value, must be >= 0 and <= 255")
+				return
+			}
+			lfuFreq = v
+			j++
+		default:
+			c.AddReply(shared.syntaxerr)
+			return
+		}
+	}
+	if !replace && c.db.lookupKeyWrite(key) != nil {
+		c.AddReplyError("-BUSYKEY Target key name already exists.")
+		return
+	}
+	ttl, ok := getLongLongFromObjectOrReply(c, c.args[2], "")
+	if !ok {
+		return
+	}
+	if ttl < 0 {
+		c.AddReplyError("Invalid TTL value, must be >= 0")
+		return
+	}
+	payload := c.args[3].StrVal()
+	if !verifyDumpPayload(payload) {
+		c.AddReplyError("DUMP payload version or checksum are wrong")
+		return
+	}
+	obj, err := decodeDumpPayload(payload)
+	if err != nil {
+		c.AddReplyError("Bad data format")
+		return
+	}
+	deleted := replace && c.db.dbDelete(key)
+	if ttl != 0 && !absttl {
+		ttl += GetMsTime()
+	}
+	// 已经过期的 key 不用写入 原来的 key 被删除时传播 DEL
+	if ttl != 0 && ttl <= GetMsTime() {
+		obj.DecrRefCount()
+		if deleted {
+			rewriteClientCommandVector(c, "DEL", key.StrVal())
+			key = c.args[1]
+			signalModifiedKey(c, c.db, key)
+			notifyKeyspaceEvent(NOTIFY_GENERIC, "del", key, c.db.id)
+			server.dirty++
+		}
+		c.AddReply(shared.ok)
+		return
+	}
+	c.db.dbAdd(key, obj)
+	obj.DecrRefCount()
+	if ttl != 0 {
+		c.db.setExpire(key, ttl)
+	}
+	objectSetLRUOrLFU(obj, lfuFreq, lruIdle)
+	signalModifiedKey(c, c.db, key)
+	notifyKeyspaceEvent(NOTIFY_GENERIC, "restore", key, c.db.id)
+	server.dirty++
+	c.AddReply(shared.ok)
+}
+
+/*
+MIGRATE host port key|"" destination-db timeout [COPY] [REPLACE] [AUTH password] [AUTH2 username password] [KEYS key [key ...]]
+和 Redis 一样同步地连接目标节点 用 RESTORE-ASKING 写入每个 key
+成功之后删除本地的 key（COPY 时保留）传播的是 DEL
+*/
+func migrateCommand(c *GodisClient) {
+	copyKeys, replace := false, false
+	var username, password string
+	first, num := 3, 1
+	for j := 6; j < len(c.args); j++ {
+		more := len(c.args) - j - 1
+		switch opt := strings.ToLower(c.args[j].StrVal()); {
+		case opt == "copy":
+			copyKeys = true
+		case opt == "replace":
+			replace = true
+		case opt == "auth" && more >= 1:
+			password = c.args[j+1].StrVal()
+			j++
+		case opt == "auth2" && more >= 2:
+			username, password = c.args[j+1].StrVal(), c.args[j+2].StrVal()
+			j += 2
+		case opt == "keys":
+			if c.args[3].StrVal() != "" {
+				c.AddReplyError("When using MIGRATE KEYS option, the key argument must be set to the empty string")
+				return
+			}
+			first = j + 1
+			num = len(c.args) - j - 1
+			j = len(c.args)
+		default:
+			c.AddReply(shared.syntaxerr)
+			return
+		}
+	}
+	port, ok := getLongLongFromObjectOrReply(c, c.args[2], "")
+	if !ok {
+		return
+	}
+	dbid, ok := getLongLongFromObjectOrReply(c, c.args[4], "")
+	if !ok {
+		return
+	}
+	timeout, ok := getLongLongFromObjectOrReply(c, c.args[5], "")
+	if !ok {
+		return
+	}
+	if timeout <= 0 {
+		timeout = 1000
+	}
+
+	// 只迁移存在的 key
+	var keys []string
+	var vals []*Gobj
+	var expires []int64
+	for _, key := range c.args[first : first+num] {
+		if o := c.db.lookupKeyRead(key); o != nil {
+			keys = append(keys, key.StrVal())
+			vals = append(vals, o)
+			expires = append(expires, c.db.getExpire(key))
+		}
+	}
+	if len(keys) == 0 {
+		c.AddReplyStatus("NOKEY")
+		return
+	}
+
+	addr := net.JoinHostPort(c.args[1].StrVal(), strconv.FormatInt(port, 10))
+	conn, err := net.DialTimeout("tcp", addr, time.Duration(timeout)*time.Millisecond)
+	if err != nil {
+		c.AddReplyError("-IOERR error or timeout connecting to the client")
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Millisecond))
+
+	restoreCmd := "RESTORE"
+	if server.clusterEnabled {
+		restoreCmd = "RESTORE-ASKING"
+	}
+	var buf []byte
+	replies := 0
+	if password != "" {
+		if username != "" {
+			buf = catAppendOnlyGenericCommand(buf, "AUTH", username, password)
+		} else {
+			buf = catAppendOnlyGenericCommand(buf, "AUTH", password)
+		}
+		replies++
+	}
+	buf = catAppendOnlyGenericCommand(buf, "SELECT", strconv.FormatInt(dbid, 10))
+	replies++
+	for i, key := range keys {
+		ttl := int64(0)
+		if expires[i] != -1 {
+			ttl = max(expires[i]-GetMsTime(), 1)
+		}
+		args := []string{restoreCmd, key, strconv.FormatInt(ttl, 10), createDumpPayload(vals[i])}
+		if replace {
+			args = append(args, "REPLACE")
+		}
+		buf = catAppendOnlyGenericCommand(buf, args...)
+	}
+	if _, err := conn.Write(buf); err != nil {
+		c.AddReplyError("-IOERR error or timeout writing to target instance")
+		return
+	}
+
+	// AUTH 和 SELECT 出错时不删除任何 key 之后每个 RESTORE 成功的 key 都算迁移成功
+	r := bufio.NewReader(conn)
+	var errMsg string
+	var migrated []string
+	for i := 0; i < replies+len(keys); i++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			c.AddReplyError("-IOERR error or timeout reading to target instance")
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if strings.HasPrefix(line, "-") {
+			if errMsg == "" {
+				errMsg = line[1:]
+			}
+			if i < replies {
+				break
+			}
+			continue
+		}
+		if i >= replies {
+			migrated = append(migrated, keys[i-replies])
+		}
+	}
+	if !copyKeys && len(migrated) > 0 {
+		for _, name := range migrated {
+			key := CreateObject(GSTR, name)
+			c.db.dbDelete(key)
+			signalModifiedKey(c, c.db, key)
+			notifyKeyspaceEvent(NOTIFY_GENERIC, "del", key, c.db.id)
+			key.DecrRefCount()
+			server.dirty++
+		}
+		rewriteClientCommandVector(c, append([]string{"DEL"}, migrated...)...)
+	}
+	if errMsg != "" {
+		c.AddReplyErrorFormat("Target instance replied with error: %s", errMsg)
+		return
+	}
+	c.AddReply(shared.ok)
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestKeyHashSlot(t *testing.T) {
+	for _, tc := range []struct {
+		key  string
+		slot int
+	}{
+		{"123456789", 12739}, // CRC16("123456789") = 0x31C3
+		{"foo", 12182},
+		{"{foo}bar", 12182},
+		{"x{foo}y{bar}", 12182},
+		{"{}foo", int(crc16([]byte("{}foo"))) % CLUSTER_SLOTS},
+		{"foo{}{bar}", int(crc16([]byte("foo{}{bar}"))) % CLUSTER_SLOTS},
+		{"foo{{bar}}zap", int(crc16([]byte("{bar"))) % CLUSTER_SLOTS},
+	} {
+		if got := keyHashSlot(tc.key); got != tc.slot {
+			t.Errorf("%q: expect slot %d, got %d", tc.key, tc.slot, got)
+		}
+	}
+	if keyHashSlot("{user1000}.following") != keyHashSlot("{user1000}.followers") {
+		t.Errorf("keys with the same hash tag in different slots")
+	}
+}
+
+// 本节点负责 0-8191 另一个节点 127.0.0.1:7002 负责 8192-16383
+func initTestCluster(t *testing.T) (*clusterNode, *clusterNode) {
+	server.clusterEnabled = true
+	server.clusterConfigfile = filepath.Join(t.TempDir(), CONFIG_DEFAULT_CLUSTER_CONFIG)
+	server.clusterNodeTimeout = CONFIG_DEFAULT_NODE_TIMEOUT
+	server.clusterRequireFullCoverage = true
+	server.cluster = &clusterState{state: CLUSTER_FAIL, nodes: make(map[string]*clusterNode), fd: -1}
+	myself := createClusterNode("", CLUSTER_NODE_MYSELF|CLUSTER_NODE_MASTER)
+	myself.ip, myself.port, myself.cport = "127.0.0.1", 7001, 17001
+	server.cluster.myself = myself
+	clusterAddNode(myself)
+	other := createClusterNode("", CLUSTER_NODE_MASTER)
+	other.ip, other.port, other.cport = "127.0.0.1", 7002, 17002
+	other.configEpoch = 1
+	clusterAddNode(other)
+	server.cluster.currentEpoch = 1
+	for j := 0; j < CLUSTER_SLOTS; j++ {
+		if j < CLUSTER_SLOTS/2 {
+			clusterAddSlot(myself, j)
+		} else {
+			clusterAddSlot(other, j)
+		}
+	}
+	clusterUpdateState()
+	return myself, other
+}
+
+func TestClusterRedirect(t *testing.T) {
+	initTestServer(t)
+	myself, other := initTestCluster(t)
+	c := newTestClient(t)
+	// b: 3300 c: 7365 foo: 12182
+	expectReply(t, c, "+PONG\r\n", "ping")
+	expectReply(t, c, "+OK\r\n", "set", "b", "1")
+	expectReply(t, c, "-MOVED 12182 127.0.0.1:7002\r\n", "get", "foo")
+	expectReply(t, c, "-CROSSSLOT Keys in request don't hash to the same slot\r\n", "mget", "b", "c")
+	expectReply(t, c, "*2\r\n$1\r\n1\r\n$-1\r\n", "mget", "b", "{b}x")
+	expectReply(t, c, "-ERR SELECT is not allowed in cluster mode\r\n", "select", "1")
+
+	// 事务中的命令在排队时检查 EXEC 再检查一次全部命令
+	expectReply(t, c, "+OK\r\n", "multi")
+	expectReply(t, c, "-MOVED 12182 127.0.0.1:7002\r\n", "set", "foo", "1")
+	expectReply(t, c, "-EXECABORT Transaction discarded because of previous errors.\r\n", "exec")
+
+	// 迁出中的槽位 不存在的 key 返回 ASK
+	server.cluster.migratingSlotsTo[3300] = other
+	expectReply(t, c, "$1\r\n1\r\n", "get", "b")
+	expectReply(t, c, "-ASK 3300 127.0.0.1:7002\r\n", "get", "{b}x")
+	expectReply(t, c, "-TRYAGAIN Multiple keys request during rehashing of slot\r\n", "mget", "b", "{b}x")
+
+	// 导入中的槽位 只接受 ASKING 之后的一条命令
+	server.cluster.importingSlotsFrom[12182] = other
+	expectReply(t, c, "+OK\r\n", "asking")
+	expectReply(t, c, "+OK\r\n", "restore-asking", "foo", "0", createDumpPayload(CreateObject(GSTR, "bar")))
+	expectReply(t, c, "-MOVED 12182 127.0.0.1:7002\r\n", "get", "foo")
+	expectReply(t, c, "+OK\r\n", "asking")
+	expectReply(t, c, "$3\r\nbar\r\n", "get", "foo")
+	expectReply(t, c, "-MOVED 12182 127.0.0.1:7002\r\n", "get", "foo")
+
+	// 导入完成后本节点负责这个槽位 纪元增加
+	expectReply(t, c, "+OK\r\n", "cluster", "setslot", "12182", "node", myself.name)
+	if server.cluster.slots[12182] != myself || server.cluster.importingSlotsFrom[12182] != nil || myself.configEpoch != 2 {
+		t.Errorf("slot not imported: owner %v epoch %d", server.cluster.slots[12182].name, myself.configEpoch)
+	}
+	expectReply(t, c, "$3\r\nbar\r\n", "get", "foo")
+
+	// 有槽位没有节点负责时集群不可用
+	expectReply(t, c, "+OK\r\n", "cluster", "delslots", "16000")
+	clusterUpdateState()
+	expectReply(t, c, "-CLUSTERDOWN The cluster is down\r\n", "get", "b")
+	server.clusterRequireFullCoverage = false
+	clusterUpdateState()
+	expectReply(t, c, "-CLUSTERDOWN Hash slot not served\r\n", "get", keyForSlot(16000))
+	expectReply(t, c, "$1\r\n1\r\n", "get", "b")
+}
+
+// 找一个在 slot 中的 key
+func keyForSlot(slot int) string {
+	for i := 0; ; i++ {
+		if key := "key:" + strconv.Itoa(i); keyHashSlot(key) == slot {
+			return key
+		}
+	}
+}
+
+func TestClusterCommand(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	expectReply(t, c, "-ERR This instance has cluster support disabled\r\n", "cluster", "info")
+	myself, other := initTestCluster(t)
+
+	expectReply(t, c, ":12182\r\n", "cluster", "keyslot", "foo")
+	expectReply(t, c, "$40\r\n"+myself.name+"\r\n", "cluster", "myid")
+	expectReply(t, c, "-ERR Slot 100 is already busy\r\n", "cluster", "addslots", "100")
+	expectReply(t, c, "+OK\r\n", "cluster", "delslotsrange", "100", "101")
+	expectReply(t, c, "-ERR Slot 100 is already unassigned\r\n", "cluster", "delslots", "100")
+	expectReply(t, c, "-ERR Slot 100 specified multiple times\r\n", "cluster", "addslots", "100", "100")
+	expectReply(t, c, "-ERR Invalid or out of range slot\r\n", "cluster", "addslots", "16384")
+	expectReply(t, c, "+OK\r\n", "cluster", "addslotsrange", "100", "101")
+	expectReply(t, c, "-ERR I'm not the owner of hash slot 9000\r\n", "cluster", "setslot", "9000", "migrating", other.name)
+	expectReply(t, c, "-ERR I'm already the owner of hash slot 100\r\n", "cluster", "setslot", "100", "importing", other.name)
+	expectReply(t, c, "-ERR I don't know about node nosuch\r\n", "cluster", "setslot", "100", "migrating", "nosuch")
+	expectReply(t, c, "-ERR unknown subcommand or wrong number of arguments for 'foo'. Try CLUSTER HELP.\r\n", "cluster", "foo")
+
+	// 槽位中的 key
+	c.run("set", "b", "1")
+	c.run("set", "{b}2", "2")
+	c.run("set", "c", "3")
+	expectReply(t, c, ":2\r\n", "cluster", "countkeysinslot", "3300")
+	expectReply(t, c, "*1\r\n$1\r\nb\r\n", "cluster", "getkeysinslot", "3300", "1")
+	c.run("del", "b")
+	expectReply(t, c, "*1\r\n$4\r\n{b}2\r\n", "cluster", "getkeysinslot", "3300", "10")
+	expectReply(t, c, "-ERR Invalid slot or number of keys\r\n", "cluster", "getkeysinslot", "3300", "-1")
+	expectReply(t, c, "-ERR Can't assign hashslot 3300 to a different node while I still hold keys for this hash slot.\r\n",
+		"cluster", "setslot", "3300", "node", other.name)
+	c.run("flushall")
+	expectReply(t, c, ":0\r\n", "cluster", "countkeysinslot", "7365")
+
+	info := c.run("cluster", "info")
+	if !strings.Contains(info, "cluster_state:ok\r\n") || !strings.Contains(info, "cluster_known_nodes:2\r\n") ||
+		!strings.Contains(info, "cluster_size:2\r\n") {
+		t.Errorf("unexpected cluster info %q", info)
+	}
+	expect := fmt.Sprintf("*2\r\n*3\r\n:0\r\n:8191\r\n*4\r\n$9\r\n127.0.0.1\r\n:7001\r\n$40\r\n%s\r\n*0\r\n"+
+		"*3\r\n:8192\r\n:16383\r\n*4\r\n$9\r\n127.0.0.1\r\n:7002\r\n$40\r\n%s\r\n*0\r\n", myself.name, other.name)
+	expectReply(t, c, expect, "cluster", "slots")
+	nodes := c.run("cluster", "nodes")
+	if !strings.Contains(nodes, myself.name+" 127.0.0.1:7001@17001 myself,master - 0 0 0 connected 0-8191\n") ||
+		!strings.Contains(nodes, other.name+" 127.0.0.1:7002@17002 master - 0 0 1 disconnected 8192-16383\n") {
+		t.Errorf("unexpected cluster nodes %q", nodes)
+	}
+}
+
+// nodes.conf 保存之后再加载得到相同的状态
+func TestClusterConfigFile(t *testing.T) {
+	initTestServer(t)
+	myself, other := initTestCluster(t)
+	clusterDelSlot(10)
+	server.cluster.migratingSlotsTo[20] = other
+	server.cluster.importingSlotsFrom[9000] = other
+	server.cluster.currentEpoch = 5
+	expect := clusterGenNodesDescription(0)
+	if err := clusterSaveConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	server.cluster = &clusterState{state: CLUSTER_FAIL, nodes: make(map[string]*clusterNode), fd: -1}
+	if err := clusterLoadConfig(server.clusterConfigfile); err != nil {
+		t.Fatal(err)
+	}
+	if server.cluster.myself.name != myself.name || server.cluster.currentEpoch != 5 {
+		t.Fatalf("unexpected myself %s epoch %d", server.cluster.myself.name, server.cluster.currentEpoch)
+	}
+	if got := clusterGenNodesDescription(0); got != expect {
+		t.Errorf("expect %q, got %q", expect, got)
+	}
+
+	os.WriteFile(server.clusterConfigfile, []byte(myself.name+" 127.0.0.1:7001@17001 myself,bad - 0 0 0 connected\n"), 0644)
+	server.cluster = &clusterState{state: CLUSTER_FAIL, nodes: make(map[string]*clusterNode), fd: -1}
+	if err := clusterLoadConfig(server.clusterConfigfile); err == nil || !strings.Contains(err.Error(), "unknown flag 'bad'") {
+		t.Errorf("expect unknown flag error, got %v", err)
+	}
+}
+
+func TestClusterMsgEncoding(t *testing.T) {
+	initTestServer(t)
+	myself, other := initTestCluster(t)
+	other.flags |= CLUSTER_NODE_PFAIL
+	msg := clusterBuildMessageHdr(CLUSTERMSG_TYPE_PING)
+	clusterSetGossipEntry(msg, other)
+	buf := msg.encode()
+	if len(buf) != CLUSTERMSG_HDR_SIZE+CLUSTERMSG_GOSSIP_SIZE {
+		t.Fatalf("unexpected message length %d", len(buf))
+	}
+	got, err := decodeClusterMsg(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.sender != myself.name || got.port != 7001 || got.cport != 17001 || got.myslots != myself.slots ||
+		len(got.gossip) != 1 || got.gossip[0].nodename != other.name || got.gossip[0].ip != "127.0.0.1" ||
+		got.gossip[0].flags&CLUSTER_NODE_PFAIL == 0 {
+		t.Errorf("unexpected decoded message %+v", got)
+	}
+
+	msg = clusterBuildMessageHdr(CLUSTERMSG_TYPE_FAIL)
+	msg.failing = other.name
+	if got, err := decodeClusterMsg(msg.encode()); err != nil || got.failing != other.name {
+		t.Errorf("unexpected FAIL message %+v %v", got, err)
+	}
+	if _, err := decodeClusterMsg(buf[:len(buf)-1]); err == nil {
+		t.Errorf("expect error decoding truncated message")
+	}
+}
+
+func TestDumpRestore(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	bulk := func(reply string) string {
+		t.Helper()
+		p := strings.Index(reply, "\r\n")
+		if p < 0 || reply[0] != '$' {
+			t.Fatalf("expect bulk reply, got %q", reply)
+		}
+		return reply[p+2 : len(reply)-2]
+	}
+	c.run("rpush", "l", "a", "b", "c")
+	payload := bulk(c.run("dump", "l"))
+	expectReply(t, c, "$-1\r\n", "dump", "nokey")
+	expectReply(t, c, "-BUSYKEY Target key name already exists.\r\n", "restore", "l", "0", payload)
+	expectReply(t, c, "+OK\r\n", "restore", "l2", "0", payload)
+	expectReply(t, c, "*3\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n", "lrange", "l2", "0", "-1")
+	expectReply(t, c, "+OK\r\n", "restore", "l2", "10000", payload, "replace")
+	if pttl, _ := strconv.Atoi(strings.TrimSpace(c.run("pttl", "l2")[1:])); pttl < 9000 || pttl > 10000 {
+		t.Errorf("unexpected pttl %d", pttl)
+	}
+	// 已经过期的时间直接删除
+	expectReply(t, c, "+OK\r\n", "restore", "l2", "1", payload, "replace", "absttl")
+	expectReply(t, c, ":0\r\n", "exists", "l2")
+
+	c.run("set", "s", "hello")
+	payload = bulk(c.run("dump", "s"))
+	bad := []byte(payload)
+	bad[1] ^= 0xff
+	expectReply(t, c, "-ERR DUMP payload version or checksum are wrong\r\n", "restore", "s2", "0", string(bad))
+	expectReply(t, c, "-ERR Invalid TTL value, must be >= 0\r\n", "restore", "s2", "-1", payload)
+	expectReply(t, c, "-ERR syntax error\r\n", "restore", "s2", "0", payload, "foo")
+	expectReply(t, c, "+OK\r\n", "restore", "s2", "0", payload, "freq", "100")
+	expectReply(t, c, "$5\r\nhello\r\n", "get", "s2")
+
+	// 校验和正确但长度字段不可信的数据
+	forge := func(body ...byte) string {
+		body = append(body, RDB_VERSION&0xff, RDB_VERSION>>8&0xff)
+		crc := make([]byte, 8)
+		binary.LittleEndian.PutUint64(crc, crc64(0, body))
+		return string(append(body, crc...))
+	}
+	huge := []byte{RDB_64BITLEN, 0x40, 0, 0, 0, 0, 0, 0, 0}
+	for _, p := range []string{
+		forge(append([]byte{RDB_TYPE_STRING}, huge...)...),
+		forge(RDB_TYPE_STRING, 5, 'a', 'b'),
+		forge(append([]byte{RDB_TYPE_LIST}, huge...)...),
+		forge(append([]byte{RDB_TYPE_STRING, RDB_ENCVAL<<6 | RDB_ENC_LZF, 1}, append(huge, 0)...)...),
+	} {
+		expectReply(t, c, "-ERR Bad data format\r\n", "restore", "s3", "0", p)
+	}
+	expectReply(t, c, ":0\r\n", "exists", "s3")
+}
+
+// 三个 goredis 进程组成集群 把一个槽位从一个节点迁移到另一个节点
+func TestClusterProcesses(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip starting goredis processes in short mode")
+	}
+	tmp := t.TempDir()
+	bin := filepath.Join(tmp, "goredis")
+	if out, err := exec.Command("go", "build", "-o", bin, ".").CombinedOutput(); err != nil {
+		t.Fatalf("build: %v\n%s", err, out)
+	}
+	var ports, cports []int
+	var conns []*testConn
+	for i := 0; i < 3; i++ {
+		dir := filepath.Join(tmp, strconv.Itoa(i))
+		os.Mkdir(dir, 0755)
+		cport := freeTestPort(t)
+		port := startTestServer(t, bin, dir, "cluster-enabled yes", "cluster-node-timeout 2000",
+			"cluster-port "+strconv.Itoa(cport))
+		ports = append(ports, port)
+		cports = append(cports, cport)
+		conns = append(conns, dialTestServer(t, port))
+	}
+	for i := 1; i < 3; i++ {
+		if got := conns[0].do("cluster", "meet", "127.0.0.1", strconv.Itoa(ports[i]), strconv.Itoa(cports[i])); got != "+OK" {
+			t.Fatalf("cluster meet: %s", got)
+		}
+	}
+	ranges := [][2]int{{0, 5460}, {5461, 10922}, {10923, 16383}}
+	for i, r := range ranges {
+		if got := conns[i].do("cluster", "addslotsrange", strconv.Itoa(r[0]), strconv.Itoa(r[1])); got != "+OK" {
+			t.Fatalf("cluster addslotsrange: %s", got)
+		}
+	}
+	for i := range conns {
+		waitFor(t, "cluster state ok", func() bool {
+			info := conns[i].do("cluster", "info")
+			return infoField(info, "cluster_state") == "ok" && infoField(info, "cluster_known_nodes") == "3"
+		})
+	}
+	// 等待纪元冲突解决 每个节点的 configEpoch 都不相同 新的槽位归属才能覆盖原来的节点
+	waitFor(t, "config epochs settled", func() bool {
+		current := make(map[string]bool)
+		mine := make(map[string]bool)
+		for _, c := range conns {
+			info := c.do("cluster", "info")
+			current[infoField(info, "cluster_current_epoch")] = true
+			mine[infoField(info, "cluster_my_epoch")] = true
+		}
+		return len(current) == 1 && len(mine) == 3
+	})
+	ids := make([]string, 3)
+	for i := range conns {
+		ids[i] = conns[i].do("cluster", "myid")
+	}
+
+	// foo 在 12182 号槽位 由第三个节点负责
+	moved := fmt.Sprintf("-MOVED 12182 127.0.0.1:%d", ports[2])
+	if got := conns[0].do("set", "foo", "bar"); got != moved {
+		t.Fatalf("expect %s, got %s", moved, got)
+	}
+	conns[2].do("set", "foo", "bar")
+	conns[2].do("set", "{foo}2", "baz")
+	conns[2].do("set", "{foo}dup", "y")
+	items := []string{"rpush", "{foo}list"}
+	for i := 0; i < 600; i++ {
+		items = append(items, fmt.Sprintf("element-%03d", i))
+	}
+	conns[2].do(items...)
+
+	// 迁移 12182 号槽位到第一个节点
+	src, dst := conns[2], conns[0]
+	if got := dst.do("cluster", "setslot", "12182", "importing", ids[2]); got != "+OK" {
+		t.Fatalf("setslot importing: %s", got)
+	}
+	if got := src.do("cluster", "setslot", "12182", "migrating", ids[0]); got != "+OK" {
+		t.Fatalf("setslot migrating: %s", got)
+	}
+	if got := src.do("migrate", "127.0.0.1", strconv.Itoa(ports[0]), "foo", "0", "1000"); got != "+OK" {
+		t.Fatalf("migrate: %s", got)
+	}
+	ask := fmt.Sprintf("-ASK 12182 127.0.0.1:%d", ports[0])
+	if got := src.do("get", "foo"); got != ask {
+		t.Errorf("expect %s, got %s", ask, got)
+	}
+	// 超过 4KB 的 key 也可以迁移 前面的 key 出错时 之后迁移成功的 key 仍然从源节点删除
+	dst.do("asking")
+	dst.do("set", "{foo}dup", "x")
+	got := src.do("migrate", "127.0.0.1", strconv.Itoa(ports[0]), "", "0", "1000", "keys", "{foo}dup", "{foo}list")
+	if !strings.HasPrefix(got, "-ERR Target instance replied with error: BUSYKEY") {
+		t.Errorf("unexpected migrate reply %s", got)
+	}
+	if got := src.do("cluster", "countkeysinslot", "12182"); got != ":2" {
+		t.Errorf("expect {foo}2 and {foo}dup left on source, got %s", got)
+	}
+	dst.do("asking")
+	if got := dst.do("llen", "{foo}list"); got != ":600" {
+		t.Errorf("expect :600, got %s", got)
+	}
+	if got := src.do("migrate", "127.0.0.1", strconv.Itoa(ports[0]), "", "0", "1000", "replace", "keys", "{foo}2", "{foo}dup"); got != "+OK" {
+		t.Fatalf("migrate keys: %s", got)
+	}
+	for _, c := range []*testConn{src, dst} {
+		if got := c.do("cluster", "setslot", "12182", "node", ids[0]); got != "+OK" {
+			t.Fatalf("setslot node: %s", got)
+		}
+	}
+	moved = fmt.Sprintf("-MOVED 12182 127.0.0.1:%d", ports[0])
+	waitFor(t, "slot owner propagated", func() bool { return conns[1].do("get", "foo") == moved })
+
+	if got := dst.do("get", "foo"); got != "bar" {
+		t.Errorf("expect bar, got %s", got)
+	}
+	if got := dst.do("get", "{foo}2"); got != "baz" {
+		t.Errorf("expect baz, got %s", got)
+	}
+	if got := dst.do("get", "{foo}dup"); got != "y" {
+		t.Errorf("expect y, got %s", got)
+	}
+	if got := src.do("cluster", "countkeysinslot", "12182"); got != ":0" {
+		t.Errorf("expect no keys left on source, got %s", got)
+	}
+}
@@ -0,0 +1,597 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// 日志级别 与 redis.conf 中的 loglevel 对应
+const (
+	LL_DEBUG   = 0
+	LL_VERBOSE = 1
+	LL_NOTICE  = 2
+	LL_WARNING = 3
+)
+
+const (
+	CONFIG_DEFAULT_PORT              = 6379
+	CONFIG_DEFAULT_BIND              = "0.0.0.0"
+	CONFIG_DEFAULT_BACKLOG           = 511
+	CONFIG_DEFAULT_MAXCLIENTS        = 10000
+	CONFIG_DEFAULT_PROTO_MAX_BULK    = 512 * 1024 * 1024
+	CONFIG_MIN_PROTO_MAX_BULK        = 1024 * 1024
+	CONFIG_DEFAULT_HZ                = 10
+	CONFIG_MIN_HZ                    = 1
+	CONFIG_MAX_HZ                    = 500
+	CONFIG_DEFAULT_DBNUM             = 16
+	CONFIG_MAX_INCLUDE_DEPTH         = 16 // 防止 include 循环引用
+	CONFIG_DEFAULT_EFFORT            = 1
+	CONFIG_DEFAULT_DBFILENAME        = "dump.rdb"
+	CONFIG_DEFAULT_AOFFILENAME       = "appendonly.aof"
+	CONFIG_DEFAULT_LUA_TIME          = 5000
+	CONFIG_DEFAULT_MAXMEMORY_SAMPLES = 5
+	CONFIG_DEFAULT_LFU_LOG_FACTOR    = 10
+	CONFIG_DEFAULT_LFU_DECAY_TIME    = 1
+	CONFIG_DEFAULT_REPL_BACKLOG_SIZE = 1024 * 1024
+	CONFIG_DEFAULT_REPL_TIMEOUT      = 60
+	CONFIG_DEFAULT_REPL_PING_PERIOD  = 10
+	CONFIG_DEFAULT_CLUSTER_CONFIG    = "nodes.conf"
+	CONFIG_DEFAULT_NODE_TIMEOUT      = 15000
+	CONFIG_DEFAULT_ACLLOG_MAX_LEN    = 128
+)
+
+// appendfsync 策略
+const (
+	AOF_FSYNC_NO       = 0
+	AOF_FSYNC_ALWAYS   = 1
+	AOF_FSYNC_EVERYSEC = 2
+)
+
+var appendfsyncNames = map[string]int{
+	"no":       AOF_FSYNC_NO,
+	"always":   AOF_FSYNC_ALWAYS,
+	"everysec": AOF_FSYNC_EVERYSEC,
+}
+
+var loglevelNames = map[string]int{
+	"debug":   LL_DEBUG,
+	"verbose": LL_VERBOSE,
+	"notice":  LL_NOTICE,
+	"warning": LL_WARNING,
+}
+
+// Config 对应 redis.conf 中的配置项
+type Config struct {
+	Port       int
+	Bind       string
+	TcpBacklog int
+	MaxClients int
+	Hz         int
+	Timeout    int // 客户端空闲多少秒后断开 0 表示不断开
+	// 命令中单个参数以及字符串值的最大长度
+	ProtoMaxBulkLen int64
+	Databases       int
+	Dir             string
+	LogFile         string // 为空表示输出到标准输出
+	LogLevel        int
+	// 主动过期的力度 1 ~ 10 越大每轮检查的 key 越多 占用的 CPU 也越多
+	ActiveExpireEffort int
+	DbFilename         string
+	SaveParams         []SaveParam
+	saveParamsSet      bool // 配置文件中第一次出现 save 时清除默认值
+	AppendOnly         bool
+	AppendFilename     string
+	AppendFsync        int
+	AofLoadTruncated   bool // 加载时容忍文件末尾不完整的命令
+	// notify-keyspace-events 解析后的标记 0 表示关闭
+	NotifyKeyspaceEvents int
+	// 脚本执行超过这么多毫秒之后开始回复其他客户端 BUSY
+	LuaTimeLimit int
+	// 数据集的内存上限（字节） 0 表示不限制
+	Maxmemory        int64
+	MaxmemoryPolicy  int
+	MaxmemorySamples int
+	LfuLogFactor     int
+	LfuDecayTime     int
+	// 启动时作为这个主节点的副本 MasterHost 为空表示主节点
+	MasterHost          string
+	MasterPort          int
+	ReplSlaveRo         bool  // 副本只读
+	ReplBacklogSize     int64 // 积压缓冲区大小 副本断线期间的写命令超出时只能全量同步
+	ReplTimeout         int   // 秒
+	ReplPingSlavePeriod int   // 主节点每隔多少秒向副本发送 PING
+	MasterAuth          string
+	MasterUser          string
+	// 集群
+	ClusterEnabled             bool
+	ClusterConfigFile          string // 节点自动维护的集群配置
+	ClusterNodeTimeout         int    // 毫秒
+	ClusterPort                int    // 集群总线端口 0 表示 port + 10000
+	ClusterRequireFullCoverage bool   // 有槽位没有被覆盖时整个集群停止服务
+	// ACL
+	RequirePass  string     // default 用户的密码 为空表示不需要密码
+	AclFile      string     // 和 user 指令不能同时使用
+	AcllogMaxLen int        // ACL LOG 最多保留的记录数
+	Users        [][]string // user 指令 用户名和规则
+}
+
+// seconds 秒内至少有 changes 次修改时触发 BGSAVE
+type SaveParam struct {
+	Seconds int64
+	Changes int64
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Port:            CONFIG_DEFAULT_PORT,
+		Bind:            CONFIG_DEFAULT_BIND,
+		TcpBacklog:      CONFIG_DEFAULT_BACKLOG,
+		MaxClients:      CONFIG_DEFAULT_MAXCLIENTS,
+		ProtoMaxBulkLen: CONFIG_DEFAULT_PROTO_MAX_BULK,
+		Hz:              CONFIG_DEFAULT_HZ,
+		Timeout:         0,
+		Databases:       CONFIG_DEFAULT_DBNUM,
+		Dir:             ".",
+		LogFile:         "",
+		LogLevel:        LL_NOTICE,
+
+		ActiveExpireEffort:  CONFIG_DEFAULT_EFFORT,
+		DbFilename:          CONFIG_DEFAULT_DBFILENAME,
+		SaveParams:          []SaveParam{{3600, 1}, {300, 100}, {60, 10000}},
+		AppendOnly:          false,
+		AppendFilename:      CONFIG_DEFAULT_AOFFILENAME,
+		AppendFsync:         AOF_FSYNC_EVERYSEC,
+		AofLoadTruncated:    true,
+		LuaTimeLimit:        CONFIG_DEFAULT_LUA_TIME,
+		MaxmemoryPolicy:     MAXMEMORY_NO_EVICTION,
+		MaxmemorySamples:    CONFIG_DEFAULT_MAXMEMORY_SAMPLES,
+		LfuLogFactor:        CONFIG_DEFAULT_LFU_LOG_FACTOR,
+		LfuDecayTime:        CONFIG_DEFAULT_LFU_DECAY_TIME,
+		ReplSlaveRo:         true,
+		ReplBacklogSize:     CONFIG_DEFAULT_REPL_BACKLOG_SIZE,
+		ReplTimeout:         CONFIG_DEFAULT_REPL_TIMEOUT,
+		ReplPingSlavePeriod: CONFIG_DEFAULT_REPL_PING_PERIOD,
+
+		ClusterConfigFile:          CONFIG_DEFAULT_CLUSTER_CONFIG,
+		ClusterNodeTimeout:         CONFIG_DEFAULT_NODE_TIMEOUT,
+		ClusterRequireFullCoverage: true,
+
+		AcllogMaxLen: CONFIG_DEFAULT_ACLLOG_MAX_LEN,
+	}
+}
+
+// 带行号的配置错误
+type ConfigError struct {
+	File string
+	Line int
+	Text string
+	Msg  string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%s:%d: %s (>>> '%s')", e.File, e.Line, e.Msg, e.Text)
+}
+
+// 读取 redis.conf 格式的配置文件
+func LoadConfig(path string) (*Config, error) {
+	config := DefaultConfig()
+	if err := config.loadFile(path, 0); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (config *Config) loadFile(path string, depth int) error {
+	if depth > CONFIG_MAX_INCLUDE_DEPTH {
+		return fmt.Errorf("%s: include nested too deeply", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		// 跳过空行和注释
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		argv, err := splitArgs(line)
+		if err != nil {
+			return &ConfigError{path, lineno, line, err.Error()}
+		}
+		if len(argv) == 0 {
+			continue
+		}
+		name := strings.ToLower(argv[0])
+		// include 的相对路径相对于当前配置文件
+		if name == "include" {
+			if len(argv) != 2 {
+				return &ConfigError{path, lineno, line, "wrong number of arguments"}
+			}
+			inc := argv[1]
+			if !filepath.IsAbs(inc) {
+				inc = filepath.Join(filepath.Dir(path), inc)
+			}
+			if err := config.loadFile(inc, depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := config.applyDirective(name, argv[1:]); err != nil {
+			return &ConfigError{path, lineno, line, err.Error()}
+		}
+	}
+	return scanner.Err()
+}
+
+func (config *Config) applyDirective(name string, args []string) error {
+	var err error
+	switch name {
+	case "port":
+		config.Port, err = parseIntArg(args, 0, 65535)
+	case "bind":
+		if len(args) == 0 {
+			return errors.New("wrong number of arguments")
+		}
+		// 只支持监听一个 IPv4 地址 * 表示全部地址
+		if len(args) > 1 {
+			return errors.New("only one bind address is supported")
+		}
+		config.Bind = args[0]
+		if config.Bind == "*" {
+			config.Bind = "0.0.0.0"
+		}
+	case "tcp-backlog":
+		config.TcpBacklog, err = parseIntArg(args, 0, 1<<16)
+	case "maxclients":
+		config.MaxClients, err = parseIntArg(args, 1, 1<<20)
+	case "hz":
+		config.Hz, err = parseIntArg(args, CONFIG_MIN_HZ, CONFIG_MAX_HZ)
+	case "timeout":
+		config.Timeout, err = parseIntArg(args, 0, 1<<31-1)
+	case "proto-max-bulk-len":
+		if len(args) != 1 {
+			return errors.New("wrong number of arguments")
+		}
+		config.ProtoMaxBulkLen, err = memtoll(args[0])
+		if err == nil && config.ProtoMaxBulkLen < CONFIG_MIN_PROTO_MAX_BULK {
+			err = errors.New("proto-max-bulk-len must be 1mb or greater")
+		}
+	case "databases":
+		config.Databases, err = parseIntArg(args, 1, 1<<20)
+	case "dir":
+		if len(args) != 1 {
+			return errors.New("wrong number of arguments")
+		}
+		info, statErr := os.Stat(args[0])
+		if statErr != nil || !info.IsDir() {
+			return fmt.Errorf("can't chdir to '%s'", args[0])
+		}
+		config.Dir = args[0]
+	case "logfile":
+		if len(args) != 1 {
+			return errors.New("wrong number of arguments")
+		}
+		config.LogFile = args[0]
+	case "active-expire-effort":
+		config.ActiveExpireEffort, err = parseIntArg(args, 1, 10)
+	case "dbfilename":
+		if len(args) != 1 {
+			return errors.New("wrong number of arguments")
+		}
+		if args[0] == "" || strings.ContainsRune(args[0], '/') {
+			return errors.New("dbfilename can't be a path, just a filename")
+		}
+		config.DbFilename = args[0]
+	case "save":
+		if !config.saveParamsSet {
+			config.SaveParams = nil
+			config.saveParamsSet = true
+		}
+		// save "" 关闭自动保存
+		if len(args) == 1 && args[0] == "" {
+			config.SaveParams = nil
+			return nil
+		}
+		if len(args) == 0 || len(args)%2 != 0 {
+			return errors.New("wrong number of arguments")
+		}
+		for i := 0; i < len(args); i += 2 {
+			seconds, err1 := strconv.ParseInt(args[i], 10, 64)
+			changes, err2 := strconv.ParseInt(args[i+1], 10, 64)
+			if err1 != nil || err2 != nil || seconds < 1 || changes < 0 {
+				return errors.New("invalid save parameters")
+			}
+			config.SaveParams = append(config.SaveParams, SaveParam{seconds, changes})
+		}
+	case "appendonly":
+		config.AppendOnly, err = parseBoolArg(args)
+	case "appendfilename":
+		if len(args) != 1 {
+			return errors.New("wrong number of arguments")
+		}
+		if args[0] == "" || strings.ContainsRune(args[0], '/') {
+			return errors.New("appendfilename can't be a path, just a filename")
+		}
+		config.AppendFilename = args[0]
+	case "appendfsync":
+		if len(args) != 1 {
+			return errors.New("wrong number of arguments")
+		}
+		policy, ok := appendfsyncNames[strings.ToLower(args[0])]
+		if !ok {
+			return errors.New("argument must be 'no', 'always' or 'everysec'")
+		}
+		config.AppendFsync = policy
+	case "aof-load-truncated":
+		config.AofLoadTruncated, err = parseBoolArg(args)
+	case "notify-keyspace-events":
+		if len(args) != 1 {
+			return errors.New("wrong number of arguments")
+		}
+		flags, ok := keyspaceEventsStringToFlags(args[0])
+		if !ok {
+			return errors.New("invalid event class character. Use 'Ag$lshzxeKEnm'")
+		}
+		config.NotifyKeyspaceEvents = flags
+	case "lua-time-limit", "busy-reply-threshold":
+		config.LuaTimeLimit, err = parseIntArg(args, 0, 1<<31-1)
+	case "maxmemory":
+		if len(args) != 1 {
+			return errors.New("wrong number of arguments")
+		}
+		config.Maxmemory, err = memtoll(args[0])
+	case "maxmemory-policy":
+		if len(args) != 1 {
+			return errors.New("wrong number of arguments")
+		}
+		policy, ok := maxmemoryPolicyNames[strings.ToLower(args[0])]
+		if !ok {
+			return errors.New("invalid maxmemory policy")
+		}
+		config.MaxmemoryPolicy = policy
+	case "maxmemory-samples":
+		config.MaxmemorySamples, err = parseIntArg(args, 1, 64)
+	case "lfu-log-factor":
+		config.LfuLogFactor, err = parseIntArg(args, 0, 1<<31-1)
+	case "lfu-decay-time":
+		config.LfuDecayTime, err = parseIntArg(args, 0, 1<<31-1)
+	case "replicaof", "slaveof":
+		if len(args) != 2 {
+			return errors.New("wrong number of arguments")
+		}
+		config.MasterPort, err = parseIntArg(args[1:], 0, 65535)
+		config.MasterHost = args[0]
+	case "replica-read-only", "slave-read-only":
+		config.ReplSlaveRo, err = parseBoolArg(args)
+	case "repl-backlog-size":
+		if len(args) != 1 {
+			return errors.New("wrong number of arguments")
+		}
+		config.ReplBacklogSize, err = memtoll(args[0])
+		if err == nil && config.ReplBacklogSize < 1 {
+			err = errors.New("repl-backlog-size must be 1 or greater")
+		}
+	case "repl-timeout":
+		config.ReplTimeout, err = parseIntArg(args, 1, 1<<31-1)
+	case "repl-ping-replica-period", "repl-ping-slave-period":
+		config.ReplPingSlavePeriod, err = parseIntArg(args, 1, 1<<31-1)
+	case "cluster-enabled":
+		config.ClusterEnabled, err = parseBoolArg(args)
+	case "cluster-config-file":
+		if len(args) != 1 || args[0] == "" {
+			return errors.New("wrong number of arguments")
+		}
+		config.ClusterConfigFile = args[0]
+	case "cluster-node-timeout":
+		config.ClusterNodeTimeout, err = parseIntArg(args, 1, 1<<31-1)
+	case "cluster-port":
+		config.ClusterPort, err = parseIntArg(args, 0, 65535)
+	case "cluster-require-full-coverage":
+		config.ClusterRequireFullCoverage, err = parseBoolArg(args)
+	case "masterauth":
+		if len(args) != 1 {
+			return errors.New("wrong number of arguments")
+		}
+		config.MasterAuth = args[0]
+	case "masteruser":
+		if len(args) != 1 {
+			return errors.New("wrong number of arguments")
+		}
+		config.MasterUser = args[0]
+	case "requirepass":
+		if len(args) != 1 {
+			return errors.New("wrong number of arguments")
+		}
+		config.RequirePass = args[0]
+	case "aclfile":
+		if len(args) != 1 {
+			return errors.New("wrong number of arguments")
+		}
+		config.AclFile = args[0]
+	case "acllog-max-len":
+		config.AcllogMaxLen, err = parseIntArg(args, 0, 1<<31-1)
+	case "user":
+		// 规则在启动时才检查 用户名不能重复
+		if len(args) == 0 {
+			return errors.New("wrong number of arguments")
+		}
+		for _, u := range config.Users {
+			if u[0] == args[0] {
+				return fmt.Errorf("duplicate user '%s'", args[0])
+			}
+		}
+		config.Users = append(config.Users, args)
+	case "loglevel":
+		if len(args) != 1 {
+			return errors.New("wrong number of arguments")
+		}
+		level, ok := loglevelNames[strings.ToLower(args[0])]
+		if !ok {
+			return errors.New("invalid log level. Must be one of debug, verbose, notice, warning")
+		}
+		config.LogLevel = level
+	default:
+		return errors.New("bad directive or wrong number of arguments")
+	}
+	return err
+}
+
+func parseIntArg(args []string, min, max int) (int, error) {
+	if len(args) != 1 {
+		return 0, errors.New("wrong number of arguments")
+	}
+	v, err := strconv.Atoi(args[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid integer '%s'", args[0])
+	}
+	if v < min || v > max {
+		return 0, fmt.Errorf("argument must be between %d and %d inclusive", min, max)
+	}
+	return v, nil
+}
+
+// 解析带单位的内存大小 1k = 1000 1kb = 1024 m mb g gb 以此类推 单位不区分大小写
+func memtoll(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		mul    int64
+	}{
+		{"kb", 1024}, {"mb", 1024 * 1024}, {"gb", 1024 * 1024 * 1024},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000}, {"b", 1},
+	}
+	num, mul := strings.ToLower(s), int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(num, u.suffix) {
+			num, mul = strings.TrimSuffix(num, u.suffix), u.mul
+			break
+		}
+	}
+	v, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || v < 0 || v > math.MaxInt64/mul {
+		return 0, fmt.Errorf("invalid memory size '%s'", s)
+	}
+	return v * mul, nil
+}
+
+func parseBoolArg(args []string) (bool, error) {
+	if len(args) != 1 {
+		return false, errors.New("wrong number of arguments")
+	}
+	switch strings.ToLower(args[0]) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	}
+	return false, errors.New("argument must be 'yes' or 'no'")
+}
+
+/*
+按 redis 的 sdssplitargs 规则切分一行：
+空白分隔，"..." 内支持 \n \r \t \" \\ \xHH 转义，'...' 内只支持 \'
+引号结束后必须跟空白或行尾
+*/
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	i := 0
+	n := len(line)
+	for {
+		for i < n && isSpace(line[i]) {
+			i++
+		}
+		if i >= n {
+			return args, nil
+		}
+		var cur strings.Builder
+		inDq, inSq, done := false, false, false
+		for !done {
+			if inDq {
+				if i >= n {
+					return nil, errors.New("unbalanced quotes in configuration line")
+				}
+				if line[i] == '\\' && i+3 < n && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]) {
+					b, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+					cur.WriteByte(byte(b))
+					i += 3
+				} else if line[i] == '\\' && i+1 < n {
+					i++
+					switch line[i] {
+					case 'n':
+						cur.WriteByte('\n')
+					case 'r':
+						cur.WriteByte('\r')
+					case 't':
+						cur.WriteByte('\t')
+					case 'b':
+						cur.WriteByte('\b')
+					case 'a':
+						cur.WriteByte('\a')
+					default:
+						cur.WriteByte(line[i])
+					}
+				} else if line[i] == '"' {
+					if i+1 < n && !isSpace(line[i+1]) {
+						return nil, errors.New("closing quote must be followed by a space")
+					}
+					done = true
+				} else {
+					cur.WriteByte(line[i])
+				}
+			} else if inSq {
+				if i >= n {
+					return nil, errors.New("unbalanced quotes in configuration line")
+				}
+				if line[i] == '\\' && i+1 < n && line[i+1] == '\'' {
+					i++
+					cur.WriteByte('\'')
+				} else if line[i] == '\'' {
+					if i+1 < n && !isSpace(line[i+1]) {
+						return nil, errors.New("closing quote must be followed by a space")
+					}
+					done = true
+				} else {
+					cur.WriteByte(line[i])
+				}
+			} else {
+				if i >= n {
+					done = true
+					break
+				}
+				switch line[i] {
+				case ' ', '\n', '\r', '\t', 0:
+					done = true
+				case '"':
+					inDq = true
+				case '\'':
+					inSq = true
+				default:
+					cur.WriteByte(line[i])
+				}
+			}
+			if i < n {
+				i++
+			}
+		}
+		args = append(args, cur.String())
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
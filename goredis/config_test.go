@@ -0,0 +1,135 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConf(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	writeConf(t, dir, "extra.conf", "maxclients 20\n")
+	path := writeConf(t, dir, "godis.conf", `
+# comment line
+port 7000
+bind 127.0.0.1
+hz 50
+timeout 300
+proto-max-bulk-len 64mb
+databases 4
+loglevel "warning"
+logfile 'godis log.txt'
+include extra.conf
+maxmemory 100MB
+maxmemory-policy allkeys-lfu
+slaveof 10.0.0.1 6380
+replica-read-only no
+repl-backlog-size 16mb
+cluster-enabled yes
+cluster-config-file nodes-7000.conf
+cluster-node-timeout 5000
+cluster-port 17001
+requirepass "secret pass"
+masterauth foo
+masteruser repl
+acllog-max-len 16
+user alice on >p1 ~cached:* +get
+user bob off
+`)
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Port != 7000 || config.Bind != "127.0.0.1" || config.Hz != 50 {
+		t.Errorf("unexpected config: %+v", config)
+	}
+	if config.Timeout != 300 || config.Databases != 4 || config.MaxClients != 20 || config.ProtoMaxBulkLen != 64*1024*1024 {
+		t.Errorf("unexpected config: %+v", config)
+	}
+	if config.LogLevel != LL_WARNING || config.LogFile != "godis log.txt" {
+		t.Errorf("unexpected config: %+v", config)
+	}
+	if config.Maxmemory != 100*1024*1024 || config.MaxmemoryPolicy != MAXMEMORY_ALLKEYS_LFU {
+		t.Errorf("unexpected config: %+v", config)
+	}
+	if config.MasterHost != "10.0.0.1" || config.MasterPort != 6380 || config.ReplSlaveRo ||
+		config.ReplBacklogSize != 16*1024*1024 {
+		t.Errorf("unexpected config: %+v", config)
+	}
+	if !config.ClusterEnabled || config.ClusterConfigFile != "nodes-7000.conf" || config.ClusterNodeTimeout != 5000 ||
+		config.ClusterPort != 17001 || !config.ClusterRequireFullCoverage {
+		t.Errorf("unexpected config: %+v", config)
+	}
+	if config.RequirePass != "secret pass" || config.MasterAuth != "foo" || config.MasterUser != "repl" ||
+		config.AcllogMaxLen != 16 || len(config.Users) != 2 || strings.Join(config.Users[0], " ") != "alice on >p1 ~cached:* +get" {
+		t.Errorf("unexpected config: %+v", config)
+	}
+	if config, err = LoadConfig(writeConf(t, dir, "any.conf", "bind *\n")); err != nil {
+		t.Fatal(err)
+	}
+	if config.Bind != "0.0.0.0" {
+		t.Errorf("unexpected bind %q", config.Bind)
+	}
+}
+
+func TestLoadConfigError(t *testing.T) {
+	dir := t.TempDir()
+	cases := map[string]string{
+		"port abc\n":                   "invalid integer",
+		"bind 127.0.0.1 10.0.0.1\n":    "only one bind address",
+		"\nhz 1000\n":                  "between",
+		"\n\nnosuch 1\n":               "bad directive",
+		"loglevel \"notice\n":          "unbalanced quotes",
+		"loglevel \"notice\"x\n":       "closing quote",
+		"dir /no/such/dir/godis\n":     "can't chdir",
+		"notify-keyspace-events KEw\n": "invalid event class",
+		"maxmemory 10xb\n":             "invalid memory size",
+		"maxmemory-policy lru\n":       "invalid maxmemory policy",
+		"proto-max-bulk-len 1kb\n":     "1mb or greater",
+		"replicaof 127.0.0.1\n":        "wrong number of arguments",
+		"cluster-port 70000\n":         "between",
+		"user a on\nuser a off\n":      "duplicate user",
+	}
+	for content, msg := range cases {
+		path := writeConf(t, dir, "bad.conf", content)
+		_, err := LoadConfig(path)
+		if err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("%q: expect error containing %q, got %v", content, msg, err)
+			continue
+		}
+		cerr, ok := err.(*ConfigError)
+		if !ok {
+			t.Errorf("%q: expect *ConfigError, got %T", content, err)
+			continue
+		}
+		line := strings.Count(content, "\n")
+		if cerr.Line != line {
+			t.Errorf("%q: expect line %d, got %d", content, line, cerr.Line)
+		}
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	args, err := splitArgs(`set "a\x41\n" 'it\'s' plain`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{"set", "aA\n", "it's", "plain"}
+	if len(args) != len(expect) {
+		t.Fatalf("expect %v, got %v", expect, args)
+	}
+	for i := range expect {
+		if args[i] != expect[i] {
+			t.Errorf("arg %d: expect %q, got %q", i, expect[i], args[i])
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+// Redis 使用的 CRC-64/Jones 反射多项式 初始值为 0 并且不做最终异或
+const crc64JonesPoly = 0x95ac9329ac4bc9b5
+
+var crc64Table [256]uint64
+
+func init() {
+	for i := 0; i < 256; i++ {
+		crc := uint64(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 == 1 {
+				crc = crc>>1 ^ crc64JonesPoly
+			} else {
+				crc >>= 1
+			}
+		}
+		crc64Table[i] = crc
+	}
+}
+
+func crc64(crc uint64, p []byte) uint64 {
+	for _, b := range p {
+		crc = crc64Table[byte(crc)^b] ^ crc>>8
+	}
+	return crc
+}
@@ -0,0 +1,862 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+func createDB(id int) *GodisDB {
+	return &GodisDB{
+		id:           id,
+		data:         DictCreate(DictType{HashFunc: GStrHash, EqualFunc: GStrEqual}),
+		expire:       DictCreate(DictType{HashFunc: GStrHash, EqualFunc: GStrEqual}),
+		blockingKeys: make(map[string][]*GodisClient),
+		watchedKeys:  make(map[string][]*GodisClient),
+	}
+}
+
+/*
+每次修改 key 之后调用 让监视这个 key 的事务失败
+值被原地修改时重新估算它占用的内存
+*/
+func signalModifiedKey(c *GodisClient, db *GodisDB, key *Gobj) {
+	touchWatchedKey(db, key)
+	if o := db.data.Get(key); o != nil {
+		old := o.memUsage
+		o.memUsage = objectComputeSize(o, OBJ_COMPUTE_SIZE_DEF_SAMPLES)
+		db.usedMemory += o.memUsage - old
+	}
+}
+
+// 值占用的内存缓存在 memUsage 中 删除时减去同样的大小
+func (db *GodisDB) addKeyMemory(key, val *Gobj) {
+	val.memUsage = objectComputeSize(val, OBJ_COMPUTE_SIZE_DEF_SAMPLES)
+	db.usedMemory += stringObjectSize(key) + val.memUsage
+}
+
+func (db *GodisDB) removeKeyMemory(key, val *Gobj) {
+	db.usedMemory -= stringObjectSize(key) + val.memUsage
+}
+
+func selectDb(c *GodisClient, id int64) bool {
+	if id < 0 || id >= int64(len(server.dbs)) {
+		return false
+	}
+	c.db = server.dbs[id]
+	return true
+}
+
+func dbTotalKeys() int64 {
+	var total int64
+	for _, db := range server.dbs {
+		total += db.data.Len()
+	}
+	return total
+}
+
+/*
+清空数据库 dbnum 为 -1 时清空全部 返回删除的 key 数量
+直接替换成新的 dict 旧的数据由 GC 在后台回收 ASYNC 和 SYNC 的效果相同
+阻塞在 key 上的客户端保持阻塞
+*/
+func emptyData(dbnum int) int64 {
+	var removed int64
+	for _, db := range server.dbs {
+		if dbnum != -1 && db.id != dbnum {
+			continue
+		}
+		removed += db.data.Len()
+		touchAllWatchedKeysInDb(db, nil)
+		slotToKeyFlush(db)
+		db.data = DictCreate(DictType{HashFunc: GStrHash, EqualFunc: GStrEqual})
+		db.expire = DictCreate(DictType{HashFunc: GStrHash, EqualFunc: GStrEqual})
+		db.expiresCursor = 0
+		db.avgTTL = 0
+		db.usedMemory = 0
+	}
+	return removed
+}
+
+// 只检查不删除 遍历 dict 期间使用
+func (db *GodisDB) keyIsExpired(key *Gobj) bool {
+	when := db.getExpire(key)
+	return when != -1 && when <= GetMsTime()
+}
+
+/*
+删除已经过期的 key 返回 key 是否已过期
+副本不删除 等待主节点传播的 DEL 只是对普通客户端返回已过期
+执行主节点发来的命令时 key 总是存在
+*/
+func (db *GodisDB) expireIfNeeded(key *Gobj) bool {
+	if !db.keyIsExpired(key) {
+		return false
+	}
+	if server.masterhost != "" {
+		return server.currentClient == nil || server.currentClient != server.master
+	}
+	// 暂停期间不删除 只当作已经过期
+	if checkClientPauseTimeoutAndReturnIfPaused() {
+		return true
+	}
+	server.statExpiredKeys++
+	snapshotBeforeWrite(db, key)
+	// 删除之前传播 key 之后可能被释放
+	propagate(db.id, "DEL", key.StrVal())
+	signalModifiedKey(nil, db, key)
+	notifyKeyspaceEvent(NOTIFY_EXPIRED, "expired", key, db.id)
+	db.expire.Delete(key)
+	if val := db.data.Get(key); val != nil {
+		db.removeKeyMemory(key, val)
+		db.data.Delete(key)
+		slotToKeyDel(db, key)
+	}
+	return true
+}
+
+// 访问 key 时更新 LRU/LFU 信息
+func (db *GodisDB) lookupKey(key *Gobj) *Gobj {
+	o := db.data.Get(key)
+	if o != nil {
+		updateObjectAccess(o)
+	}
+	return o
+}
+
+func (db *GodisDB) lookupKeyRead(key *Gobj) *Gobj {
+	var o *Gobj
+	if !db.expireIfNeeded(key) {
+		o = db.lookupKey(key)
+	}
+	if o == nil {
+		notifyKeyspaceEvent(NOTIFY_KEY_MISS, "keymiss", key, db.id)
+	}
+	return o
+}
+
+// 返回的值可能被原地修改 所以先通知正在进行的快照
+func (db *GodisDB) lookupKeyWrite(key *Gobj) *Gobj {
+	if db.expireIfNeeded(key) {
+		return nil
+	}
+	snapshotBeforeWrite(db, key)
+	return db.lookupKey(key)
+}
+
+// key 不存在时回复 reply 并返回 nil
+func (db *GodisDB) lookupKeyReadOrReply(c *GodisClient, key *Gobj, reply *Gobj) *Gobj {
+	o := db.lookupKeyRead(key)
+	if o == nil {
+		c.AddReply(reply)
+	}
+	return o
+}
+
+func (db *GodisDB) lookupKeyWriteOrReply(c *GodisClient, key *Gobj, reply *Gobj) *Gobj {
+	o := db.lookupKeyWrite(key)
+	if o == nil {
+		c.AddReply(reply)
+	}
+	return o
+}
+
+// 调用方需要保证 key 不存在
+func (db *GodisDB) dbAdd(key, val *Gobj) {
+	db.data.Add(key, val)
+	snapshotKeyAdded(db, key)
+	db.addKeyMemory(key, val)
+	slotToKeyAdd(db, key)
+	notifyKeyspaceEvent(NOTIFY_NEW, "new", key, db.id)
+	if val.Type_ == GLIST || val.Type_ == GZSET {
+		signalKeyAsReady(db, key)
+	}
+}
+
+// 调用方需要保证 key 存在 过期时间保持不变
+func (db *GodisDB) dbOverwrite(key, val *Gobj) {
+	snapshotBeforeWrite(db, key)
+	if old := db.data.Get(key); old != nil {
+		db.removeKeyMemory(key, old)
+	}
+	db.data.Set(key, val)
+	db.addKeyMemory(key, val)
+}
+
+// 覆盖写入 key 之前设置的过期时间会被清除
+func (db *GodisDB) setKey(key, val *Gobj) {
+	db.genericSetKey(key, val, false)
+}
+
+// keepttl 为 true 时保留原来的过期时间（SET KEEPTTL）
+func (db *GodisDB) genericSetKey(key, val *Gobj, keepttl bool) {
+	if db.lookupKey(key) == nil {
+		db.dbAdd(key, val)
+	} else {
+		db.dbOverwrite(key, val)
+		if val.Type_ == GLIST || val.Type_ == GZSET {
+			signalKeyAsReady(db, key)
+		}
+	}
+	if !keepttl {
+		db.expire.Delete(key)
+	}
+}
+
+// when 为毫秒级的 unix 时间戳
+func (db *GodisDB) setExpire(key *Gobj, when int64) {
+	snapshotBeforeWrite(db, key)
+	expObj := CreateFromInt(when)
+	db.expire.Set(key, expObj)
+	expObj.DecrRefCount()
+}
+
+// 返回 -1 表示没有设置过期时间
+func (db *GodisDB) getExpire(key *Gobj) int64 {
+	entry := db.expire.Find(key)
+	if entry == nil {
+		return -1
+	}
+	return entry.Val.IntVal()
+}
+
+func (db *GodisDB) removeExpire(key *Gobj) bool {
+	snapshotBeforeWrite(db, key)
+	return db.expire.Delete(key) == nil
+}
+
+// 删除 key 以及它的过期时间 返回 key 是否存在
+func (db *GodisDB) dbDelete(key *Gobj) bool {
+	snapshotBeforeWrite(db, key)
+	db.expire.Delete(key)
+	val := db.data.Get(key)
+	if val == nil {
+		return false
+	}
+	db.removeKeyMemory(key, val)
+	slotToKeyDel(db, key)
+	return db.data.Delete(key) == nil
+}
+
+// 类型不匹配时回复 WRONGTYPE 并返回 true
+func checkType(c *GodisClient, o *Gobj, typ Gtype) bool {
+	if o.Type_ != typ {
+		c.AddReply(shared.wrongtypeerr)
+		return true
+	}
+	return false
+}
+
+func getObjectTypeName(o *Gobj) string {
+	if o == nil {
+		return "none"
+	}
+	switch o.Type_ {
+	case GSTR:
+		return "string"
+	case GLIST:
+		return "list"
+	case GSET:
+		return "set"
+	case GZSET:
+		return "zset"
+	case GDICT:
+		return "hash"
+	}
+	return "unknown"
+}
+
+// 字符串对象不会被原地修改 可以直接共享
+func dupObject(o *Gobj) *Gobj {
+	switch o.Type_ {
+	case GLIST:
+		return listTypeDup(o)
+	case GSET:
+		return setTypeDup(o)
+	case GZSET:
+		return zsetDup(o)
+	case GDICT:
+		return hashTypeDup(o)
+	}
+	o.IncrRefCount()
+	return o
+}
+
+// DEL 和 UNLINK 都是同步删除
+func delCommand(c *GodisClient) {
+	var deleted int64
+	for _, key := range c.args[1:] {
+		c.db.expireIfNeeded(key)
+		if c.db.dbDelete(key) {
+			signalModifiedKey(c, c.db, key)
+			notifyKeyspaceEvent(NOTIFY_GENERIC, "del", key, c.db.id)
+			deleted++
+		}
+	}
+	server.dirty += deleted
+	c.AddReplyInt(deleted)
+}
+
+// 重复的 key 会被重复计数
+func existsCommand(c *GodisClient) {
+	var count int64
+	for _, key := range c.args[1:] {
+		if c.db.lookupKeyRead(key) != nil {
+			count++
+		}
+	}
+	c.AddReplyInt(count)
+}
+
+func touchCommand(c *GodisClient) {
+	existsCommand(c)
+}
+
+func typeCommand(c *GodisClient) {
+	c.AddReplyStatus(getObjectTypeName(c.db.lookupKeyRead(c.args[1])))
+}
+
+// RENAME / RENAMENX 过期时间随 key 一起转移
+func renameGenericCommand(c *GodisClient, nx bool) {
+	src, dst := c.args[1], c.args[2]
+	o := c.db.lookupKeyWriteOrReply(c, src, shared.nokeyerr)
+	if o == nil {
+		return
+	}
+	samekey := GStrEqual(src, dst)
+	if samekey {
+		if nx {
+			c.AddReply(shared.czero)
+		} else {
+			c.AddReply(shared.ok)
+		}
+		return
+	}
+	expire := c.db.getExpire(src)
+	if c.db.lookupKeyWrite(dst) != nil {
+		if nx {
+			c.AddReply(shared.czero)
+			return
+		}
+		c.db.dbDelete(dst)
+	}
+	o.IncrRefCount()
+	c.db.dbDelete(src)
+	c.db.dbAdd(dst, o)
+	o.DecrRefCount()
+	if expire != -1 {
+		c.db.setExpire(dst, expire)
+	}
+	signalModifiedKey(c, c.db, src)
+	signalModifiedKey(c, c.db, dst)
+	notifyKeyspaceEvent(NOTIFY_GENERIC, "rename_from", src, c.db.id)
+	notifyKeyspaceEvent(NOTIFY_GENERIC, "rename_to", dst, c.db.id)
+	server.dirty++
+	if nx {
+		c.AddReply(shared.cone)
+	} else {
+		c.AddReply(shared.ok)
+	}
+}
+
+func renameCommand(c *GodisClient) {
+	renameGenericCommand(c, false)
+}
+
+func renamenxCommand(c *GodisClient) {
+	renameGenericCommand(c, true)
+}
+
+func keysCommand(c *GodisClient) {
+	pattern := c.args[1].StrVal()
+	allkeys := pattern == "*"
+	node := c.AddReplyDeferredLen()
+	var n int
+	// safe 迭代器允许在遍历过程中删除过期的 key
+	it := c.db.data.GetSafeIterator()
+	for e := it.Next(); e != nil; e = it.Next() {
+		key := e.Key
+		if allkeys || stringmatch(pattern, key.StrVal(), false) {
+			key.IncrRefCount()
+			if !c.db.expireIfNeeded(key) {
+				c.AddReplyBulk(key)
+				n++
+			}
+			key.DecrRefCount()
+		}
+	}
+	it.Release()
+	c.SetDeferredArrayLen(node, n)
+}
+
+func randomkeyCommand(c *GodisClient) {
+	// 副本不删除过期的 key 全部 key 都过期时重试若干次后直接返回
+	maxtries := 100
+	allvolatile := c.db.data.Len() == c.db.expire.Len()
+	for {
+		e := c.db.data.RandomGet()
+		if e == nil {
+			c.AddReplyNull()
+			return
+		}
+		key := e.Key
+		key.IncrRefCount()
+		if allvolatile && server.masterhost != "" {
+			if maxtries--; maxtries == 0 {
+				c.AddReplyBulk(key)
+				key.DecrRefCount()
+				return
+			}
+		}
+		// 取到过期的 key 时删除后重试
+		if c.db.expireIfNeeded(key) {
+			key.DecrRefCount()
+			continue
+		}
+		c.AddReplyBulk(key)
+		key.DecrRefCount()
+		return
+	}
+}
+
+func dbsizeCommand(c *GodisClient) {
+	c.AddReplyInt(c.db.data.Len())
+}
+
+// COPY source destination [DB destination-db] [REPLACE]
+func copyCommand(c *GodisClient) {
+	key, newkey := c.args[1], c.args[2]
+	src, dst := c.db, c.db
+	replace := false
+	for j := 3; j < len(c.args); j++ {
+		opt := strings.ToLower(c.args[j].StrVal())
+		if opt == "replace" {
+			replace = true
+		} else if opt == "db" && j+1 < len(c.args) {
+			dbid, ok := getLongLongFromObjectOrReply(c, c.args[j+1], "")
+			if !ok {
+				return
+			}
+			if dbid < 0 || dbid >= int64(len(server.dbs)) {
+				c.AddReplyError("DB index is out of range")
+				return
+			}
+			if server.clusterEnabled && dbid != 0 {
+				c.AddReplyError("Copying to another database is not allowed in cluster mode")
+				return
+			}
+			dst = server.dbs[dbid]
+			j++
+		} else {
+			c.AddReply(shared.syntaxerr)
+			return
+		}
+	}
+	if src == dst && GStrEqual(key, newkey) {
+		c.AddReplyError("source and destination objects are the same")
+		return
+	}
+	o := src.lookupKeyRead(key)
+	if o == nil {
+		c.AddReply(shared.czero)
+		return
+	}
+	expire := src.getExpire(key)
+	if dst.lookupKeyWrite(newkey) != nil {
+		if !replace {
+			c.AddReply(shared.czero)
+			return
+		}
+		dst.dbDelete(newkey)
+	}
+	newObj := dupObject(o)
+	dst.dbAdd(newkey, newObj)
+	newObj.DecrRefCount()
+	if expire != -1 {
+		dst.setExpire(newkey, expire)
+	}
+	signalModifiedKey(c, dst, newkey)
+	notifyKeyspaceEvent(NOTIFY_GENERIC, "copy_to", newkey, dst.id)
+	server.dirty++
+	c.AddReply(shared.cone)
+}
+
+// 解析数据库编号 不在范围内时回复错误
+func getDbIdOrReply(c *GodisClient, o *Gobj) (int64, bool) {
+	id, err := o.ParseInt()
+	if err != nil {
+		c.AddReplyError("invalid DB index")
+		return 0, false
+	}
+	if id < 0 || id >= int64(len(server.dbs)) {
+		c.AddReplyError("DB index is out of range")
+		return 0, false
+	}
+	return id, true
+}
+
+func selectCommand(c *GodisClient) {
+	id, ok := getDbIdOrReply(c, c.args[1])
+	if !ok {
+		return
+	}
+	// 集群模式只有 0 号数据库
+	if server.clusterEnabled && id != 0 {
+		c.AddReplyError("SELECT is not allowed in cluster mode")
+		return
+	}
+	selectDb(c, id)
+	c.AddReply(shared.ok)
+}
+
+// MOVE key db 过期时间随 key 一起移动
+func moveCommand(c *GodisClient) {
+	if server.clusterEnabled {
+		c.AddReplyError("MOVE is not allowed in cluster mode")
+		return
+	}
+	key := c.args[1]
+	id, ok := getDbIdOrReply(c, c.args[2])
+	if !ok {
+		return
+	}
+	src, dst := c.db, server.dbs[id]
+	if src == dst {
+		c.AddReplyError("source and destination objects are the same")
+		return
+	}
+	o := src.lookupKeyWrite(key)
+	if o == nil || dst.lookupKeyWrite(key) != nil {
+		c.AddReply(shared.czero)
+		return
+	}
+	expire := src.getExpire(key)
+	dst.dbAdd(key, o)
+	if expire != -1 {
+		dst.setExpire(key, expire)
+	}
+	src.dbDelete(key)
+	signalModifiedKey(c, src, key)
+	signalModifiedKey(c, dst, key)
+	notifyKeyspaceEvent(NOTIFY_GENERIC, "move_from", key, src.id)
+	notifyKeyspaceEvent(NOTIFY_GENERIC, "move_to", key, dst.id)
+	server.dirty++
+	c.AddReply(shared.cone)
+}
+
+/*
+交换两个数据库的数据 阻塞的客户端仍然留在原来的数据库编号上
+交换之后新出现的 key 需要唤醒阻塞在上面的客户端
+*/
+func swapdbCommand(c *GodisClient) {
+	if server.clusterEnabled {
+		c.AddReplyError("SWAPDB is not allowed in cluster mode")
+		return
+	}
+	id1, err := c.args[1].ParseInt()
+	if err != nil {
+		c.AddReplyError("invalid first DB index")
+		return
+	}
+	id2, err := c.args[2].ParseInt()
+	if err != nil {
+		c.AddReplyError("invalid second DB index")
+		return
+	}
+	if id1 < 0 || id1 >= int64(len(server.dbs)) || id2 < 0 || id2 >= int64(len(server.dbs)) {
+		c.AddReplyError("DB index is out of range")
+		return
+	}
+	db1, db2 := server.dbs[id1], server.dbs[id2]
+	if db1 != db2 {
+		// 监视 key 的客户端仍然监视原来编号的数据库
+		touchAllWatchedKeysInDb(db1, db2)
+		touchAllWatchedKeysInDb(db2, db1)
+		db1.data, db2.data = db2.data, db1.data
+		db1.expire, db2.expire = db2.expire, db1.expire
+		db1.expiresCursor, db2.expiresCursor = db2.expiresCursor, db1.expiresCursor
+		db1.avgTTL, db2.avgTTL = db2.avgTTL, db1.avgTTL
+		db1.usedMemory, db2.usedMemory = db2.usedMemory, db1.usedMemory
+		scanDatabaseForReadyKeys(db1)
+		scanDatabaseForReadyKeys(db2)
+		server.dirty++
+	}
+	c.AddReply(shared.ok)
+}
+
+func scanDatabaseForReadyKeys(db *GodisDB) {
+	for name := range db.blockingKeys {
+		key := CreateObject(GSTR, name)
+		if o := db.lookupKey(key); o != nil && (o.Type_ == GLIST || o.Type_ == GZSET) {
+			signalKeyAsReady(db, key)
+		}
+		key.DecrRefCount()
+	}
+}
+
+// FLUSHDB / FLUSHALL 的 [ASYNC|SYNC] 参数
+func getFlushCommandFlagsOrReply(c *GodisClient) bool {
+	if len(c.args) > 2 {
+		c.AddReply(shared.syntaxerr)
+		return false
+	}
+	if len(c.args) == 2 {
+		opt := strings.ToLower(c.args[1].StrVal())
+		if opt != "async" && opt != "sync" {
+			c.AddReply(shared.syntaxerr)
+			return false
+		}
+	}
+	return true
+}
+
+func flushdbCommand(c *GodisClient) {
+	if !getFlushCommandFlagsOrReply(c) {
+		return
+	}
+	server.dirty += emptyData(c.db.id)
+	c.AddReply(shared.ok)
+}
+
+func flushallCommand(c *GodisClient) {
+	if !getFlushCommandFlagsOrReply(c) {
+		return
+	}
+	server.dirty += emptyData(-1)
+	c.AddReply(shared.ok)
+}
+
+// 解析 SCAN 的游标 游标是无符号的 64 位整数
+func parseScanCursorOrReply(c *GodisClient, o *Gobj) (uint64, bool) {
+	cursor, err := strconv.ParseUint(o.StrVal(), 10, 64)
+	if err != nil {
+		c.AddReplyError("invalid cursor")
+		return 0, false
+	}
+	return cursor, true
+}
+
+/*
+SCAN / HSCAN / SSCAN / ZSCAN 的通用实现
+o 为 nil 时遍历整个数据库 否则遍历 o 对应的集合
+*/
+func scanGenericCommand(c *GodisClient, o *Gobj, cursor uint64) {
+	// SCAN 的选项从第 2 个参数开始 其他的从第 3 个参数开始
+	i := 2
+	if o != nil {
+		i = 3
+	}
+	count := int64(10)
+	var pattern, typename string
+	for ; i < len(c.args); i++ {
+		opt := strings.ToLower(c.args[i].StrVal())
+		if i+1 == len(c.args) {
+			c.AddReply(shared.syntaxerr)
+			return
+		}
+		switch {
+		case opt == "count":
+			v, ok := getLongLongFromObjectOrReply(c, c.args[i+1], "")
+			if !ok {
+				return
+			}
+			if v < 1 {
+				c.AddReply(shared.syntaxerr)
+				return
+			}
+			count = v
+		case opt == "match":
+			pattern = c.args[i+1].StrVal()
+			if pattern == "*" {
+				pattern = ""
+			}
+		case opt == "type" && o == nil:
+			typename = strings.ToLower(c.args[i+1].StrVal())
+		default:
+			c.AddReply(shared.syntaxerr)
+			return
+		}
+		i++
+	}
+
+	var d *Dict
+	var withVal bool
+	if o == nil {
+		d = c.db.data
+	} else {
+		switch o.Type_ {
+		case GSET:
+			d = o.Val_.(*Dict)
+		case GDICT:
+			d = o.Val_.(*Dict)
+			withVal = true
+		case GZSET:
+			d = o.Val_.(*zset).dict
+			withVal = true
+		}
+	}
+
+	// 先收集元素 过滤和删除过期 key 放在遍历结束之后
+	var keys, vals []*Gobj
+	maxiterations := count * 10
+	for {
+		cursor = d.Scan(cursor, func(e *Entry) {
+			e.Key.IncrRefCount()
+			keys = append(keys, e.Key)
+			if withVal {
+				e.Val.IncrRefCount()
+				vals = append(vals, e.Val)
+			}
+		})
+		maxiterations--
+		if cursor == 0 || maxiterations == 0 || int64(len(keys)) >= count {
+			break
+		}
+	}
+
+	c.AddReplyArrayLen(2)
+	c.AddReplyBulkStr(strconv.FormatUint(cursor, 10))
+	node := c.AddReplyDeferredLen()
+	var n int
+	for j, key := range keys {
+		filtered := pattern != "" && !stringmatch(pattern, key.StrVal(), false)
+		if !filtered && o == nil {
+			if c.db.expireIfNeeded(key) {
+				filtered = true
+			} else if typename != "" && getObjectTypeName(c.db.lookupKey(key)) != typename {
+				filtered = true
+			}
+		}
+		if !filtered {
+			c.AddReplyBulk(key)
+			n++
+			if withVal {
+				if o.Type_ == GZSET {
+					c.AddReplyBulkStr(strconv.FormatFloat(vals[j].Val_.(float64), 'g', -1, 64))
+				} else {
+					c.AddReplyBulk(vals[j])
+				}
+				n++
+			}
+		}
+		key.DecrRefCount()
+		if withVal {
+			vals[j].DecrRefCount()
+		}
+	}
+	c.SetDeferredArrayLen(node, n)
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+func scanCommand(c *GodisClient) {
+	cursor, ok := parseScanCursorOrReply(c, c.args[1])
+	if !ok {
+		return
+	}
+	scanGenericCommand(c, nil, cursor)
+}
+
+// HSCAN / SSCAN / ZSCAN key cursor [MATCH pattern] [COUNT count]
+func scanKeyGenericCommand(c *GodisClient, typ Gtype) {
+	cursor, ok := parseScanCursorOrReply(c, c.args[2])
+	if !ok {
+		return
+	}
+	o := c.db.lookupKeyReadOrReply(c, c.args[1], shared.emptyscan)
+	if o == nil || checkType(c, o, typ) {
+		return
+	}
+	scanGenericCommand(c, o, cursor)
+}
+
+func hscanCommand(c *GodisClient) {
+	scanKeyGenericCommand(c, GDICT)
+}
+
+func sscanCommand(c *GodisClient) {
+	scanKeyGenericCommand(c, GSET)
+}
+
+func zscanCommand(c *GodisClient) {
+	scanKeyGenericCommand(c, GZSET)
+}
+
+// 返回参数中 key 的下标
+func getKeysFromCommand(cmd *GodisCommand, args []*Gobj) []int {
+	if cmd.getkeysProc != nil {
+		return cmd.getkeysProc(args)
+	}
+	return getKeysUsingCommandTable(cmd, args)
+}
+
+func getKeysUsingCommandTable(cmd *GodisCommand, args []*Gobj) []int {
+	if cmd.firstkey == 0 {
+		return nil
+	}
+	last := cmd.lastkey
+	if last < 0 {
+		last += len(args)
+	}
+	var keys []int
+	for j := cmd.firstkey; j <= last && j < len(args); j += cmd.keystep {
+		keys = append(keys, j)
+	}
+	return keys
+}
+
+// 从 start 开始的 numkeys 个参数都是 key numkeys 不合法时返回 nil 由命令本身报错
+func getKeysWithNumkeys(args []*Gobj, numkeysPos int) []int {
+	numkeys, err := args[numkeysPos].ParseInt()
+	if err != nil || numkeys <= 0 || numkeys > int64(len(args)-numkeysPos-1) {
+		return nil
+	}
+	keys := make([]int, numkeys)
+	for i := range keys {
+		keys[i] = numkeysPos + 1 + i
+	}
+	return keys
+}
+
+// EVAL script numkeys key [key ...] arg [arg ...]
+func evalGetKeys(args []*Gobj) []int {
+	return getKeysWithNumkeys(args, 2)
+}
+
+// ZUNIONSTORE destination numkeys key [key ...] [WEIGHTS ...] [AGGREGATE ...]
+func zunionInterGetKeys(args []*Gobj) []int {
+	keys := getKeysWithNumkeys(args, 2)
+	if keys == nil {
+		return nil
+	}
+	return append([]int{1}, keys...)
+}
+
+// MEMORY USAGE key
+func memoryGetKeys(args []*Gobj) []int {
+	if len(args) >= 3 && strings.EqualFold(args[1].StrVal(), "usage") {
+		return []int{2}
+	}
+	return nil
+}
+
+// MIGRATE host port key|"" db timeout [...] [KEYS key [key ...]]
+func migrateGetKeys(args []*Gobj) []int {
+	if args[3].StrVal() != "" {
+		return []int{3}
+	}
+	for j := 6; j < len(args); j++ {
+		// 跳过密码 密码可能恰好是 "keys"
+		switch strings.ToLower(args[j].StrVal()) {
+		case "auth":
+			j++
+		case "auth2":
+			j += 2
+		case "keys":
+			keys := make([]int, 0, len(args)-j-1)
+			for k := j + 1; k < len(args); k++ {
+				keys = append(keys, k)
+			}
+			return keys
+		}
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestKeyspaceCommands(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	c.run("mset", "a", "1", "b", "2", "c", "3")
+	c.run("rpush", "l", "x", "y")
+	expectReply(t, c, ":4\r\n", "dbsize")
+	expectReply(t, c, ":3\r\n", "exists", "a", "a", "l", "nosuch")
+	expectReply(t, c, "+list\r\n", "type", "l")
+	expectReply(t, c, "+none\r\n", "type", "nosuch")
+	expectReply(t, c, ":2\r\n", "del", "a", "b", "nosuch")
+	expectReply(t, c, "-ERR no such key\r\n", "rename", "a", "z")
+	c.run("expire", "c", "100")
+	expectReply(t, c, "+OK\r\n", "rename", "c", "d")
+	if c.db.getExpire(CreateObject(GSTR, "d")) == -1 {
+		t.Error("RENAME should keep the expire")
+	}
+	expectReply(t, c, ":0\r\n", "renamenx", "d", "l")
+	expectReply(t, c, ":1\r\n", "copy", "l", "l2")
+	expectReply(t, c, ":0\r\n", "copy", "l", "l2")
+	c.run("rpush", "l2", "z")
+	expectReply(t, c, ":2\r\n", "llen", "l")
+	expectReply(t, c, ":1\r\n", "copy", "d", "l2", "replace")
+	expectReply(t, c, "+string\r\n", "type", "l2")
+	expectReply(t, c, "-ERR DB index is out of range\r\n", "copy", "d", "x", "db", "16")
+	expectReply(t, c, "*1\r\n$1\r\nl\r\n", "keys", "l")
+	if got := c.run("keys", "l*"); got[:4] != "*2\r\n" {
+		t.Errorf("keys l*: %q", got)
+	}
+}
+
+func TestMultipleDatabases(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	c.run("set", "k", "v0")
+	expectReply(t, c, "-ERR invalid DB index\r\n", "select", "x")
+	expectReply(t, c, "-ERR DB index is out of range\r\n", "select", "16")
+	expectReply(t, c, "+OK\r\n", "select", "1")
+	expectReply(t, c, "$-1\r\n", "get", "k")
+	c.run("set", "k", "v1", "ex", "100")
+	c.run("set", "only1", "x")
+	expectReply(t, c, ":2\r\n", "dbsize")
+
+	expectReply(t, c, ":0\r\n", "move", "k", "0")
+	expectReply(t, c, ":1\r\n", "move", "only1", "2")
+	expectReply(t, c, "-ERR source and destination objects are the same\r\n", "move", "k", "1")
+	expectReply(t, c, ":1\r\n", "copy", "k", "k", "db", "3")
+	expectReply(t, c, "+OK\r\n", "select", "3")
+	expectReply(t, c, "$2\r\nv1\r\n", "get", "k")
+	if c.db.getExpire(CreateObject(GSTR, "k")) == -1 {
+		t.Error("COPY should keep the expire")
+	}
+
+	// SWAPDB 之后选择了 db0 的客户端看到 db1 的数据
+	c2 := newTestClient(t)
+	expectReply(t, c, "+OK\r\n", "swapdb", "0", "1")
+	expectReply(t, c2, "$2\r\nv1\r\n", "get", "k")
+	expectReply(t, c, "-ERR invalid second DB index\r\n", "swapdb", "0", "x")
+
+	// 交换过来的 list 唤醒阻塞的客户端
+	expectReply(t, c2, "", "blpop", "l", "0")
+	c.run("select", "5")
+	c.run("rpush", "l", "a")
+	expectReply(t, c, "+OK\r\n", "swapdb", "5", "0")
+	if got := c2.takeReply(); got != "*2\r\n$1\r\nl\r\n$1\r\na\r\n" {
+		t.Errorf("blocked client got %q", got)
+	}
+
+	expectReply(t, c, "+OK\r\n", "flushdb", "async")
+	expectReply(t, c, ":0\r\n", "dbsize")
+	expectReply(t, c, "-ERR syntax error\r\n", "flushall", "now")
+	expectReply(t, c, "+OK\r\n", "flushall")
+	for _, db := range server.dbs {
+		if db.data.Len() != 0 {
+			t.Errorf("db%d has %d keys after FLUSHALL", db.id, db.data.Len())
+		}
+	}
+}
+
+func TestStringMatch(t *testing.T) {
+	cases := []struct {
+		pattern, str  string
+		nocase, match bool
+	}{
+		{"*", "", false, true},
+		{"h?llo", "hello", false, true},
+		{"h*llo", "heeeello", false, true},
+		{"h[ae]llo", "hallo", false, true},
+		{"h[^e]llo", "hello", false, false},
+		{"h[a-b]llo", "hbllo", false, true},
+		{"h\\*llo", "h*llo", false, true},
+		{"h\\*llo", "hello", false, false},
+		{"HELLO", "hello", true, true},
+		{"a*b", "acbd", false, false},
+	}
+	for _, tc := range cases {
+		if got := stringmatch(tc.pattern, tc.str, tc.nocase); got != tc.match {
+			t.Errorf("stringmatch(%q, %q) = %v", tc.pattern, tc.str, got)
+		}
+	}
+}
+
+// rehash 过程中扫描 开始时就存在的元素都要被返回
+func TestDictScanDuringRehash(t *testing.T) {
+	d := DictCreate(DictType{HashFunc: GStrHash, EqualFunc: GStrEqual})
+	for i := 0; i < 100; i++ {
+		d.Add(CreateObject(GSTR, strconv.Itoa(i)), nil)
+	}
+	seen := make(map[string]bool)
+	var cursor uint64
+	added := 100
+	rehashing := false
+	for {
+		rehashing = rehashing || d.isRehashing()
+		cursor = d.Scan(cursor, func(e *Entry) {
+			seen[e.Key.StrVal()] = true
+		})
+		// 每一步都写入新的元素 让 dict 扩容并推进 rehash
+		for j := 0; j < 20; j++ {
+			d.Add(CreateObject(GSTR, strconv.Itoa(added)), nil)
+			added++
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	if !rehashing {
+		t.Fatal("dict should be rehashing during the scan")
+	}
+	for i := 0; i < 100; i++ {
+		if !seen[strconv.Itoa(i)] {
+			t.Fatalf("key %d not returned by scan", i)
+		}
+	}
+}
+
+func TestScanCommands(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	for i := 0; i < 50; i++ {
+		c.run("set", "k"+strconv.Itoa(i), "v")
+	}
+	c.run("rpush", "list", "a")
+	expectReply(t, c, "-ERR invalid cursor\r\n", "scan", "abc")
+	expectReply(t, c, "-ERR syntax error\r\n", "scan", "0", "count", "0")
+	seen := make(map[string]bool)
+	cursor := "0"
+	for {
+		reply := c.run("scan", cursor, "count", "7", "match", "k*")
+		cursor, seen = parseScanReply(t, reply, seen)
+		if cursor == "0" {
+			break
+		}
+	}
+	if len(seen) != 50 || seen["list"] {
+		t.Errorf("scan returned %d keys", len(seen))
+	}
+	got := c.run("scan", "0", "count", "1000", "type", "list")
+	if _, keys := parseScanReply(t, got, map[string]bool{}); len(keys) != 1 || !keys["list"] {
+		t.Errorf("scan type: %q", got)
+	}
+
+	c.run("hset", "h", "f1", "v1")
+	expectReply(t, c, "*2\r\n$1\r\n0\r\n*2\r\n$2\r\nf1\r\n$2\r\nv1\r\n", "hscan", "h", "0")
+	c.run("zadd", "z", "1.5", "m")
+	expectReply(t, c, "*2\r\n$1\r\n0\r\n*2\r\n$1\r\nm\r\n$3\r\n1.5\r\n", "zscan", "z", "0")
+	c.run("sadd", "s", "a", "b")
+	expectReply(t, c, "*2\r\n$1\r\n0\r\n*1\r\n$1\r\na\r\n", "sscan", "s", "0", "match", "a")
+	expectReply(t, c, "*2\r\n$1\r\n0\r\n*0\r\n", "sscan", "nosuch", "0")
+	expectReply(t, c, "-ERR syntax error\r\n", "sscan", "s", "0", "type", "set")
+}
+
+// 解析 SCAN 的回复 只支持 bulk string 元素
+func parseScanReply(t *testing.T, reply string, seen map[string]bool) (string, map[string]bool) {
+	t.Helper()
+	lines := strings.Split(reply, "\r\n")
+	if len(lines) < 4 || lines[0] != "*2" {
+		t.Fatalf("bad scan reply %q", reply)
+	}
+	n, _ := strconv.Atoi(lines[3][1:])
+	for i := 0; i < n; i++ {
+		seen[lines[5+i*2]] = true
+	}
+	return lines[2], seen
+}
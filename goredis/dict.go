@@ -3,7 +3,9 @@ package main
 import (
 	"errors"
 	"math"
+	"math/bits"
 	"math/rand"
+	"unsafe"
 )
 
 const (
@@ -47,6 +49,7 @@ type Dict struct {
 	DictType
 	hts       [2]*htable
 	rehashidx int64
+	iterators int // 正在使用的 safe 迭代器数量 不为 0 时暂停 rehash
 }
 
 // 创建 Dict
@@ -62,9 +65,11 @@ func (dict *Dict) isRehashing() bool {
 }
 
 // 一次执行多少个 step
+// safe 迭代器打开期间不能移动 entry 否则会重复或者遗漏元素
 func (dict *Dict) rehashStep() {
-	//TODO: check iterators
-	dict.rehash(DEFAULT_STEP)
+	if dict.iterators == 0 {
+		dict.rehash(DEFAULT_STEP)
+	}
 }
 
 // rehash 过程
@@ -95,6 +100,23 @@ func (dict *Dict) rehash(step int) {
 	}
 }
 
+// 在 ms 毫秒内尽可能多地 rehash 由 ServerCron 调用 返回执行的步数
+func (dict *Dict) RehashMilliseconds(ms int64) int {
+	if dict.iterators > 0 {
+		return 0
+	}
+	start := GetMsTime()
+	rehashes := 0
+	for dict.isRehashing() {
+		dict.rehash(100)
+		rehashes += 100
+		if GetMsTime()-start > ms {
+			break
+		}
+	}
+	return rehashes
+}
+
 func nextPower(size int64) int64 {
 	for i := INIT_SIZE; i < math.MaxInt64; i *= 2 {
 		if i >= size {
@@ -194,7 +216,10 @@ func (dict *Dict) Add(key, val *Gobj) error {
 		return EX_ERR
 	}
 	entry.Val = val
-	val.IncrRefCount()
+	// set 类型的 val 为 nil
+	if val != nil {
+		val.IncrRefCount()
+	}
 	return nil
 }
 
@@ -205,15 +230,21 @@ func (dict *Dict) Set(key, val *Gobj) {
 		return
 	}
 	entry := dict.Find(key)
-	entry.Val.DecrRefCount()
+	if entry.Val != nil {
+		entry.Val.DecrRefCount()
+	}
 	entry.Val = val
-	val.IncrRefCount()
+	if val != nil {
+		val.IncrRefCount()
+	}
 }
 
 // 配合 delete 使用
 func freeEntry(e *Entry) {
 	e.Key.DecrRefCount()
-	e.Val.DecrRefCount()
+	if e.Val != nil {
+		e.Val.DecrRefCount()
+	}
 }
 
 func (dict *Dict) Find(key *Gobj) *Entry {
@@ -223,9 +254,10 @@ func (dict *Dict) Find(key *Gobj) *Entry {
 	if dict.isRehashing() {
 		dict.rehashStep()
 	}
+	h := dict.HashFunc(key)
 	for i := 0; i <= 1; i++ {
-		idx := dict.HashFunc(key)
-		entry := dict.hts[0].table[idx]
+		idx := h & dict.hts[i].mask
+		entry := dict.hts[i].table[idx]
 		for entry != nil {
 			if dict.EqualFunc(entry.Key, key) {
 				return entry
@@ -268,6 +300,7 @@ func (dict *Dict) Delete(key *Gobj) error {
 				} else {
 					prev.next = e.next
 				}
+				dict.hts[i].used -= 1
 				freeEntry(e)
 				return nil
 			}
@@ -282,40 +315,241 @@ func (dict *Dict) Delete(key *Gobj) error {
 	return NK_ERR
 }
 
+// 估算哈希表和 entry 占用的内存 不包括 key 和 val 对象本身
+func (dict *Dict) MemUsage() int64 {
+	size := int64(unsafe.Sizeof(*dict))
+	for _, ht := range dict.hts {
+		if ht != nil {
+			size += int64(unsafe.Sizeof(*ht)) + ht.size*int64(unsafe.Sizeof((*Entry)(nil))) +
+				ht.used*int64(unsafe.Sizeof(Entry{}))
+		}
+	}
+	return size
+}
+
+func (dict *Dict) Len() int64 {
+	var n int64
+	for i := 0; i <= 1; i++ {
+		if dict.hts[i] != nil {
+			n += dict.hts[i].used
+		}
+	}
+	return n
+}
+
+/*
+迭代器
+safe 迭代器打开期间暂停渐进式 rehash 可以在迭代过程中删除元素
+unsafe 迭代器只允许读 释放时通过 fingerprint 检查 dict 是否被修改过
+*/
+type DictIterator struct {
+	dict        *Dict
+	table       int
+	index       int64
+	safe        bool
+	entry       *Entry
+	nextEntry   *Entry // 当前 entry 可能被删除 提前记录下一个
+	fingerprint int64
+}
+
+func (dict *Dict) GetIterator() *DictIterator {
+	return &DictIterator{dict: dict, index: -1}
+}
+
+func (dict *Dict) GetSafeIterator() *DictIterator {
+	it := dict.GetIterator()
+	it.safe = true
+	return it
+}
+
+// 返回 nil 表示遍历结束
+func (it *DictIterator) Next() *Entry {
+	dict := it.dict
+	for {
+		if it.entry == nil {
+			// 第一次调用
+			if it.index == -1 && it.table == 0 {
+				if it.safe {
+					dict.iterators++
+				} else {
+					it.fingerprint = dict.fingerprint()
+				}
+			}
+			it.index++
+			ht := dict.hts[it.table]
+			if ht == nil {
+				return nil
+			}
+			if it.index >= ht.size {
+				if dict.isRehashing() && it.table == 0 {
+					it.table++
+					it.index = 0
+					ht = dict.hts[1]
+				} else {
+					return nil
+				}
+			}
+			it.entry = ht.table[it.index]
+		} else {
+			it.entry = it.nextEntry
+		}
+		if it.entry != nil {
+			it.nextEntry = it.entry.next
+			return it.entry
+		}
+	}
+}
+
+func (it *DictIterator) Release() {
+	if it.index == -1 && it.table == 0 {
+		return
+	}
+	if it.safe {
+		it.dict.iterators--
+	} else if it.fingerprint != it.dict.fingerprint() {
+		panic("dict: unsafe iterator used while the dict was modified")
+	}
+}
+
+/*
+两个 htable 的 size 和 used 组合出的指纹
+unsafe 迭代器在使用期间 dict 被修改时指纹会发生变化
+*/
+func (dict *Dict) fingerprint() int64 {
+	var integers [5]int64
+	for i := 0; i <= 1; i++ {
+		if ht := dict.hts[i]; ht != nil {
+			integers[i*2] = ht.size
+			integers[i*2+1] = ht.used
+		}
+	}
+	integers[4] = dict.rehashidx
+	// Thomas Wang 64 bit integer hash
+	var hash uint64
+	for _, v := range integers {
+		hash += uint64(v)
+		hash = ^hash + (hash << 21)
+		hash = hash ^ (hash >> 24)
+		hash = (hash + (hash << 3)) + (hash << 8)
+		hash = hash ^ (hash >> 14)
+		hash = (hash + (hash << 2)) + (hash << 4)
+		hash = hash ^ (hash >> 28)
+		hash = hash + (hash << 31)
+	}
+	return int64(hash)
+}
+
+/*
+SCAN 使用的游标迭代 返回下一次调用的游标 返回 0 表示遍历结束
+游标按高位递增（reverse binary） 两次调用之间 dict 扩容或者正在 rehash
+都不会遗漏从开始到结束一直存在的元素 但是可能会返回重复的元素
+*/
+func (dict *Dict) Scan(cursor uint64, fn func(e *Entry)) uint64 {
+	if dict.Len() == 0 {
+		return 0
+	}
+	emit := func(ht *htable, idx uint64) {
+		e := ht.table[idx]
+		for e != nil {
+			next := e.next
+			fn(e)
+			e = next
+		}
+	}
+	v := cursor
+	if !dict.isRehashing() {
+		t0 := dict.hts[0]
+		m0 := uint64(t0.mask)
+		emit(t0, v&m0)
+		// 把未被掩码覆盖的高位置 1 后做反向加一
+		v |= ^m0
+		v = bits.Reverse64(bits.Reverse64(v) + 1)
+		return v
+	}
+	// t0 为较小的表
+	t0, t1 := dict.hts[0], dict.hts[1]
+	if t0.size > t1.size {
+		t0, t1 = t1, t0
+	}
+	m0, m1 := uint64(t0.mask), uint64(t1.mask)
+	emit(t0, v&m0)
+	// 遍历大表中所有由小表中这个槽位扩展出来的槽位
+	for {
+		emit(t1, v&m1)
+		v |= ^m1
+		v = bits.Reverse64(bits.Reverse64(v) + 1)
+		if v&(m0^m1) == 0 {
+			break
+		}
+	}
+	return v
+}
+
 // random get
 func (dict *Dict) RandomGet() *Entry {
-	if dict.hts[0] == nil {
+	if dict.Len() == 0 {
 		return nil
 	}
-	t := 0
 	if dict.isRehashing() {
 		dict.rehashStep()
-		if dict.hts[1] != nil && dict.hts[1].used > dict.hts[0].used {
-			// simplify the logic, random get in the bigger table
-			t = 1
-		}
 	}
-	// random slot
-	idx := rand.Int63n(dict.hts[t].size)
-	cnt := 0
-	for dict.hts[t].table[idx] == nil && cnt < 1000 {
-		idx = rand.Int63n(dict.hts[t].size)
-		cnt += 1
-	}
-	if dict.hts[t].table[idx] == nil {
-		return nil
+	var p *Entry
+	if dict.isRehashing() {
+		// rehashidx 之前的槽位在 hts[0] 中一定为空 在剩余槽位中随机
+		size0 := dict.hts[0].size
+		for p == nil {
+			idx := dict.rehashidx + rand.Int63n(size0+dict.hts[1].size-dict.rehashidx)
+			if idx >= size0 {
+				p = dict.hts[1].table[idx-size0]
+			} else {
+				p = dict.hts[0].table[idx]
+			}
+		}
+	} else {
+		// random slot
+		for p == nil {
+			p = dict.hts[0].table[rand.Int63n(dict.hts[0].size)]
+		}
 	}
 	// random entry
 	var listLen int64
-	p := dict.hts[t].table[idx]
+	head := p
 	for p != nil {
 		listLen += 1
 		p = p.next
 	}
 	listIdx := rand.Int63n(listLen)
-	p = dict.hts[t].table[idx]
+	p = head
 	for i := int64(0); i < listIdx; i++ {
 		p = p.next
 	}
 	return p
 }
+
+// 超过这个比例时先取出全部 entry 再随机删除 比反复随机采样更快
+const RANDOM_SUB_STRATEGY_MUL = 3
+
+// 随机选出 count 个不重复的 entry count 不小于 Len 时返回全部
+func (dict *Dict) RandomEntries(count int64) []*Entry {
+	size := dict.Len()
+	picked := make(map[*Entry]bool)
+	if count >= size || count*RANDOM_SUB_STRATEGY_MUL > size {
+		it := dict.GetIterator()
+		for e := it.Next(); e != nil; e = it.Next() {
+			picked[e] = true
+		}
+		it.Release()
+		for int64(len(picked)) > count {
+			delete(picked, dict.RandomGet())
+		}
+	} else {
+		for int64(len(picked)) < count {
+			picked[dict.RandomGet()] = true
+		}
+	}
+	entries := make([]*Entry, 0, len(picked))
+	for e := range picked {
+		entries = append(entries, e)
+	}
+	return entries
+}
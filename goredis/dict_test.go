@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+// 构造一个正在 rehash 的 dict
+func newRehashingDict(t *testing.T, n int) *Dict {
+	d := DictCreate(DictType{HashFunc: GStrHash, EqualFunc: GStrEqual})
+	for i := 0; i < n; i++ {
+		d.Add(CreateObject(GSTR, strconv.Itoa(i)), nil)
+		if i > n/2 && d.isRehashing() {
+			return d
+		}
+	}
+	if !d.isRehashing() {
+		t.Fatal("dict should be rehashing")
+	}
+	return d
+}
+
+func TestDictSafeIterator(t *testing.T) {
+	d := newRehashingDict(t, 1000)
+	size := d.Len()
+	rehashidx := d.rehashidx
+	seen := make(map[string]bool)
+	it := d.GetSafeIterator()
+	for e := it.Next(); e != nil; e = it.Next() {
+		key := e.Key.StrVal()
+		if seen[key] {
+			t.Fatalf("key %s returned twice", key)
+		}
+		seen[key] = true
+		// 遍历过程中删除当前元素 rehash 需要暂停
+		e.Key.IncrRefCount()
+		if err := d.Delete(e.Key); err != nil {
+			t.Fatal(err)
+		}
+		if d.rehashidx != rehashidx {
+			t.Fatal("rehash should be paused while a safe iterator is open")
+		}
+	}
+	it.Release()
+	if int64(len(seen)) != size || d.Len() != 0 {
+		t.Errorf("seen %d of %d keys, %d left", len(seen), size, d.Len())
+	}
+	if d.iterators != 0 {
+		t.Errorf("iterators = %d", d.iterators)
+	}
+}
+
+func TestDictUnsafeIterator(t *testing.T) {
+	d := newRehashingDict(t, 1000)
+	var n int64
+	it := d.GetIterator()
+	for e := it.Next(); e != nil; e = it.Next() {
+		n++
+	}
+	it.Release()
+	if n != d.Len() {
+		t.Errorf("iterated %d of %d keys", n, d.Len())
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("modifying the dict during an unsafe iteration should panic")
+		}
+	}()
+	it = d.GetIterator()
+	it.Next()
+	d.Add(CreateObject(GSTR, "new"), nil)
+	it.Release()
+}
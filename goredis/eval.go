@@ -0,0 +1,532 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// 编译后的脚本 以 body 的 SHA1 为 key 缓存
+type luaScript struct {
+	body  string
+	proto []luaStat
+}
+
+// SCRIPT KILL 之后 hook 返回这个错误终止脚本 pcall 不能捕获
+var errLuaKilled = errors.New("Script killed by user with SCRIPT KILL...")
+
+/*
+创建 Lua 解释器和执行命令使用的伪客户端
+全局表在初始化完成之后设为只读 脚本不能定义全局变量
+*/
+func scriptingInit() {
+	L := newLuaState()
+	lib := newLuaTable()
+	luaSetFunctions(lib, map[string]func(*luaState, []luaValue) ([]luaValue, error){
+		"call":               luaRedisCallCommand,
+		"pcall":              luaRedisPcallCommand,
+		"error_reply":        luaRedisErrorReplyCommand,
+		"status_reply":       luaRedisStatusReplyCommand,
+		"sha1hex":            luaRedisSha1hexCommand,
+		"log":                luaLogCommand,
+		"replicate_commands": luaRedisReplicateCommandsCommand,
+	})
+	lib.Set("LOG_DEBUG", float64(LL_DEBUG))
+	lib.Set("LOG_VERBOSE", float64(LL_VERBOSE))
+	lib.Set("LOG_NOTICE", float64(LL_NOTICE))
+	lib.Set("LOG_WARNING", float64(LL_WARNING))
+	L.globals.Set("redis", lib)
+	for _, name := range []string{"redis", "string", "table", "math"} {
+		L.globals.GetStr(name).(*luaTable).readonly = true
+	}
+	L.globals.readonly = true
+	L.hook = luaMaskCountHook
+	server.lua = L
+	server.luaScripts = make(map[string]*luaScript)
+	server.luaClient = CreateClient(-1)
+	server.luaClient.flags |= CLIENT_DENY_BLOCKING
+	server.luaCaller = nil
+	server.luaTimedOut = false
+	server.luaKill = false
+}
+
+func sha1hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// 编译并缓存脚本 已经存在时直接返回
+func luaCreateFunction(body string) (string, error) {
+	sha := sha1hex(body)
+	if _, ok := server.luaScripts[sha]; ok {
+		return sha, nil
+	}
+	proto, err := luaParse(body)
+	if err != nil {
+		return "", err
+	}
+	server.luaScripts[sha] = &luaScript{body: body, proto: proto}
+	return sha, nil
+}
+
+// redis.call 和 redis.pcall 出错时的错误表
+func luaErrorTable(msg string) *luaTable {
+	t := newLuaTable()
+	t.Set("err", msg)
+	return t
+}
+
+/*
+在伪客户端上执行命令 再把 RESP2 的回复转换成 Lua 的值
+raise 为 true 时（redis.call）命令出错会抛出错误 否则返回错误表
+*/
+func luaRedisGenericCommand(L *luaState, args []luaValue, raise bool) ([]luaValue, error) {
+	fail := func(msg string) ([]luaValue, error) {
+		if raise {
+			return nil, &luaError{luaErrorTable(msg)}
+		}
+		return []luaValue{luaErrorTable(msg)}, nil
+	}
+	if len(args) == 0 {
+		return fail("ERR Please specify at least one argument for this redis lib call")
+	}
+	argv := make([]string, len(args))
+	for i, arg := range args {
+		switch a := arg.(type) {
+		case string:
+			argv[i] = a
+		case float64:
+			argv[i] = luaNumberToString(a)
+		default:
+			return fail("ERR Lua redis lib command arguments must be strings or integers")
+		}
+	}
+	cmd := lookupCommand(strings.ToLower(argv[0]))
+	if cmd == nil {
+		return fail("ERR Unknown Redis command called from script")
+	}
+	if (cmd.arity > 0 && cmd.arity != len(argv)) || len(argv) < -cmd.arity {
+		return fail("ERR Wrong number of args calling Redis command from script")
+	}
+	if cmd.flags&CMD_NOSCRIPT != 0 {
+		return fail("ERR This Redis command is not allowed from script")
+	}
+	if server.masterhost != "" && server.replSlaveRo && server.luaCaller.flags&CLIENT_MASTER == 0 &&
+		cmd.flags&CMD_WRITE != 0 {
+		return fail("READONLY You can't write against a read only replica.")
+	}
+	// 已经写过数据的脚本必须执行完 否则只有一部分写入生效
+	if server.maxmemory > 0 && !server.luaWriteDirty && cmd.flags&CMD_DENYOOM != 0 &&
+		performEvictions() == EVICT_FAIL {
+		return fail("OOM command not allowed when used memory > 'maxmemory'.")
+	}
+
+	lc := server.luaClient
+	lc.args = make([]*Gobj, len(argv))
+	for i, arg := range argv {
+		lc.args[i] = CreateObject(GSTR, arg)
+	}
+	// 脚本中的命令按执行脚本的用户检查权限
+	if reason, pos := aclCheckAllPerm(server.luaCaller, cmd, lc.args); reason != ACL_OK {
+		addACLLogEntry(server.luaCaller, reason, ACL_LOG_CTX_LUA, aclDeniedObject(reason, cmd, lc.args, pos), "")
+		freeArgs(lc)
+		lc.args = nil
+		return fail("NOPERM " + getAclErrorMessage(reason, cmd))
+	}
+	// 脚本只能访问本节点的 key 加载 AOF 和执行复制流时不检查
+	if server.clusterEnabled && !server.loading && server.luaCaller.flags&CLIENT_MASTER == 0 {
+		if n, _, _ := getNodeByQuery(lc, cmd, lc.args); n != server.cluster.myself {
+			freeArgs(lc)
+			lc.args = nil
+			return fail("ERR Lua script attempted to access a non local key in a cluster node")
+		}
+	}
+	dirty := server.dirty
+	call(lc, cmd)
+	if server.dirty != dirty {
+		server.luaWriteDirty = true
+	}
+	freeArgs(lc)
+	lc.args = nil
+	reply := luaClientTakeReply(lc)
+
+	v, _ := redisProtocolToLuaType(reply)
+	if t, ok := v.(*luaTable); ok && raise {
+		if _, ok := t.GetStr("err").(string); ok {
+			return nil, &luaError{t}
+		}
+	}
+	return []luaValue{v}, nil
+}
+
+// 取出伪客户端回复链表中的全部内容
+func luaClientTakeReply(c *GodisClient) string {
+	var b strings.Builder
+	for c.reply.Length() > 0 {
+		n := c.reply.First()
+		b.WriteString(n.Val.StrVal())
+		c.reply.DelNode(n)
+		n.Val.DecrRefCount()
+	}
+	return b.String()
+}
+
+/*
+把一个 RESP2 回复转换成 Lua 的值 返回值和消耗的长度
+整数 -> number  bulk -> string  nil -> false
+状态 -> {ok=...}  错误 -> {err=...}  数组 -> table
+*/
+func redisProtocolToLuaType(reply string) (luaValue, int) {
+	end := strings.Index(reply, "\r\n")
+	if end < 0 {
+		return false, len(reply)
+	}
+	line := reply[1:end]
+	pos := end + 2
+	switch reply[0] {
+	case ':':
+		n, _ := strconv.ParseInt(line, 10, 64)
+		return float64(n), pos
+	case '$':
+		l, _ := strconv.Atoi(line)
+		if l < 0 {
+			return false, pos
+		}
+		return reply[pos : pos+l], pos + l + 2
+	case '+':
+		t := newLuaTable()
+		t.Set("ok", line)
+		return t, pos
+	case '-':
+		return luaErrorTable(line), pos
+	case '*':
+		n, _ := strconv.Atoi(line)
+		if n < 0 {
+			return false, pos
+		}
+		t := newLuaTable()
+		for i := 1; i <= n; i++ {
+			v, l := redisProtocolToLuaType(reply[pos:])
+			t.Set(float64(i), v)
+			pos += l
+		}
+		return t, pos
+	}
+	return false, len(reply)
+}
+
+func luaRedisCallCommand(L *luaState, args []luaValue) ([]luaValue, error) {
+	return luaRedisGenericCommand(L, args, true)
+}
+
+func luaRedisPcallCommand(L *luaState, args []luaValue) ([]luaValue, error) {
+	return luaRedisGenericCommand(L, args, false)
+}
+
+// redis.error_reply(msg) 返回 {err=msg}
+func luaRedisErrorReplyCommand(L *luaState, args []luaValue) ([]luaValue, error) {
+	msg, ok := luaArg(args, 0).(string)
+	if len(args) != 1 || !ok {
+		return nil, L.errorf("wrong number or type of arguments")
+	}
+	return []luaValue{luaErrorTable(msg)}, nil
+}
+
+// redis.status_reply(msg) 返回 {ok=msg}
+func luaRedisStatusReplyCommand(L *luaState, args []luaValue) ([]luaValue, error) {
+	msg, ok := luaArg(args, 0).(string)
+	if len(args) != 1 || !ok {
+		return nil, L.errorf("wrong number or type of arguments")
+	}
+	t := newLuaTable()
+	t.Set("ok", msg)
+	return []luaValue{t}, nil
+}
+
+func luaRedisSha1hexCommand(L *luaState, args []luaValue) ([]luaValue, error) {
+	if len(args) != 1 {
+		return nil, L.errorf("wrong number of arguments")
+	}
+	s, err := L.checkString(args, 0, "sha1hex")
+	if err != nil {
+		return nil, err
+	}
+	return []luaValue{sha1hex(s)}, nil
+}
+
+// redis.log(level, message ...)
+func luaLogCommand(L *luaState, args []luaValue) ([]luaValue, error) {
+	if len(args) < 2 {
+		return nil, L.errorf("redis.log() requires two arguments or more.")
+	}
+	level, ok := args[0].(float64)
+	if !ok {
+		return nil, L.errorf("First argument must be a number (log level).")
+	}
+	if level < LL_DEBUG || level > LL_WARNING {
+		return nil, L.errorf("Invalid debug level.")
+	}
+	parts := make([]string, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		if s, ok := luaConcatString(arg); ok {
+			parts = append(parts, s)
+		}
+	}
+	serverLog(int(level), "%s", strings.Join(parts, " "))
+	return nil, nil
+}
+
+// 命令总是以效果的形式传播 保留这个函数只是为了兼容
+func luaRedisReplicateCommandsCommand(L *luaState, args []luaValue) ([]luaValue, error) {
+	return []luaValue{true}, nil
+}
+
+/*
+每执行 LUA_HOOK_STEPS 步调用一次
+超过 lua-time-limit 之后开始处理其他客户端的请求 回复 BUSY 并接受 SCRIPT KILL
+*/
+func luaMaskCountHook() error {
+	elapsed := GetMsTime() - server.luaTimeStart
+	if elapsed >= server.luaTimeLimit && !server.luaTimedOut {
+		serverLog(LL_WARNING, "Slow script detected: still in execution after %d milliseconds. "+
+			"You can try killing the script using the SCRIPT KILL command.", elapsed)
+		server.luaTimedOut = true
+		protectClient(server.luaCaller)
+	}
+	if server.luaTimedOut {
+		processEventsWhileBlocked()
+	}
+	if server.luaKill {
+		serverLog(LL_WARNING, "Lua script killed by user with SCRIPT KILL.")
+		return errLuaKilled
+	}
+	return nil
+}
+
+/*
+脚本超时期间不读取调用者的连接 它的下一条命令必须在脚本结束之后执行
+只有移除了可读事件时 脚本结束后才恢复
+*/
+func protectClient(c *GodisClient) {
+	if c.fd == -1 || server.aeLoop.FileEvents[getFeKey(c.fd, AE_READABLE)] == nil {
+		return
+	}
+	server.aeLoop.RemoveFileEvent(c.fd, AE_READABLE)
+	server.luaCallerProtected = true
+}
+
+func unprotectClient(c *GodisClient) {
+	if !server.luaCallerProtected {
+		return
+	}
+	server.luaCallerProtected = false
+	server.aeLoop.AddFileEvent(c.fd, AE_READABLE, ReadQueryFromClient, c)
+}
+
+// 只处理已经就绪的文件事件 不等待 也不执行定时任务
+func processEventsWhileBlocked() {
+	fes := server.aeLoop.pollFileEvents(0)
+	server.aeLoop.AeProcess(nil, fes)
+}
+
+// 脚本运行超时的时候 除了 SCRIPT KILL 其他命令都回复 BUSY
+func scriptIsTimedout() bool {
+	return server.luaCaller != nil && server.luaTimedOut
+}
+
+// Lua 的返回值转换成回复
+func luaReplyToRedisReply(c *GodisClient, v luaValue) {
+	switch x := v.(type) {
+	case string:
+		c.AddReplyBulkStr(x)
+	case bool:
+		if x {
+			c.AddReply(shared.cone)
+		} else {
+			c.AddReplyNull()
+		}
+	case float64:
+		c.AddReplyInt(int64(x))
+	case *luaTable:
+		if msg, ok := x.GetStr("err").(string); ok {
+			c.AddReplyError("-" + msg)
+			return
+		}
+		if msg, ok := x.GetStr("ok").(string); ok {
+			c.AddReplyStatus(msg)
+			return
+		}
+		// 数组在第一个 nil 处截断
+		n := 0
+		for x.Get(float64(n+1)) != nil {
+			n++
+		}
+		c.AddReplyArrayLen(n)
+		for i := 1; i <= n; i++ {
+			luaReplyToRedisReply(c, x.Get(float64(i)))
+		}
+	default:
+		c.AddReplyNull()
+	}
+}
+
+/*
+脚本执行出错时的回复 附带脚本的 SHA1 和出错的行号
+redis.call 抛出的错误表保留原来的错误码
+*/
+func luaReplyError(c *GodisClient, sha string, err error) {
+	msg := "ERR " + err.Error()
+	if lerr, ok := err.(*luaError); ok {
+		if t, ok := lerr.value.(*luaTable); ok {
+			if e, ok := t.GetStr("err").(string); ok {
+				msg = e
+			}
+		}
+	}
+	c.AddReplyErrorFormat("-%s script: %s, on @user_script:%d.", msg, sha, server.lua.line)
+}
+
+func luaCreateArray(args []*Gobj) *luaTable {
+	t := newLuaTable()
+	for i, arg := range args {
+		t.Set(float64(i+1), arg.StrVal())
+	}
+	return t
+}
+
+/*
+EVAL / EVALSHA 的公共部分
+脚本中的写命令各自传播 以 MULTI ... EXEC 包裹 EVAL 本身不传播
+*/
+func evalGenericCommand(c *GodisClient, evalsha bool) {
+	numkeys, ok := getLongLongFromObjectOrReply(c, c.args[2], "")
+	if !ok {
+		return
+	}
+	if numkeys > int64(len(c.args)-3) {
+		c.AddReplyError("Number of keys can't be greater than number of args")
+		return
+	}
+	if numkeys < 0 {
+		c.AddReplyError("Number of keys can't be negative")
+		return
+	}
+	var sha string
+	if evalsha {
+		sha = strings.ToLower(c.args[1].StrVal())
+		if _, ok := server.luaScripts[sha]; !ok {
+			c.AddReplyError("-NOSCRIPT No matching script. Please use EVAL.")
+			return
+		}
+	} else {
+		var err error
+		if sha, err = luaCreateFunction(c.args[1].StrVal()); err != nil {
+			c.AddReplyErrorFormat("Error compiling script (new function): %s", err.Error())
+			return
+		}
+	}
+	script := server.luaScripts[sha]
+	L := server.lua
+	L.globals.Set("KEYS", luaCreateArray(c.args[3:3+numkeys]))
+	L.globals.Set("ARGV", luaCreateArray(c.args[3+numkeys:]))
+
+	server.luaClient.db = c.db
+	server.luaCaller = c
+	server.luaTimeStart = GetMsTime()
+	server.luaTimedOut = false
+	server.luaKill = false
+	server.luaWriteDirty = false
+	wasInExec := server.inExec
+	server.inExec = true
+
+	rets, err := L.Exec(script.proto)
+
+	server.inExec = wasInExec
+	if server.luaTimedOut {
+		serverLog(LL_WARNING, "Slow script finished after %d milliseconds.", GetMsTime()-server.luaTimeStart)
+		unprotectClient(c)
+	}
+	server.luaCaller = nil
+	server.luaTimedOut = false
+	server.luaKill = false
+	L.globals.Set("KEYS", nil)
+	L.globals.Set("ARGV", nil)
+
+	if !wasInExec && server.execMultiPropagated {
+		server.execMultiPropagated = false
+		propagate(c.db.id, "EXEC")
+	}
+	c.flags |= CLIENT_PREVENT_PROP
+
+	if err != nil {
+		luaReplyError(c, sha, err)
+		return
+	}
+	var ret luaValue
+	if len(rets) > 0 {
+		ret = rets[0]
+	}
+	luaReplyToRedisReply(c, ret)
+}
+
+// EVAL script numkeys [key ...] [arg ...]
+func evalCommand(c *GodisClient) {
+	evalGenericCommand(c, false)
+}
+
+// EVALSHA sha1 numkeys [key ...] [arg ...]
+func evalshaCommand(c *GodisClient) {
+	evalGenericCommand(c, true)
+}
+
+// SCRIPT LOAD script | EXISTS sha1 [sha1 ...] | FLUSH [ASYNC|SYNC] | KILL
+func scriptCommand(c *GodisClient) {
+	sub := strings.ToLower(c.args[1].StrVal())
+	switch {
+	case sub == "load" && len(c.args) == 3:
+		sha, err := luaCreateFunction(c.args[2].StrVal())
+		if err != nil {
+			c.AddReplyErrorFormat("Error compiling script (new function): %s", err.Error())
+			return
+		}
+		c.AddReplyBulkStr(sha)
+	case sub == "exists" && len(c.args) >= 3:
+		c.AddReplyArrayLen(len(c.args) - 2)
+		for _, arg := range c.args[2:] {
+			if _, ok := server.luaScripts[strings.ToLower(arg.StrVal())]; ok {
+				c.AddReply(shared.cone)
+			} else {
+				c.AddReply(shared.czero)
+			}
+		}
+	case sub == "flush" && len(c.args) <= 3:
+		if len(c.args) == 3 {
+			mode := strings.ToLower(c.args[2].StrVal())
+			if mode != "async" && mode != "sync" {
+				c.AddReplyError("SCRIPT FLUSH only support SYNC|ASYNC option")
+				return
+			}
+		}
+		server.luaScripts = make(map[string]*luaScript)
+		c.AddReply(shared.ok)
+	case sub == "kill" && len(c.args) == 2:
+		if server.luaCaller == nil {
+			c.AddReplyError("-NOTBUSY No scripts in execution right now.")
+		} else if server.luaWriteDirty {
+			c.AddReplyError("-UNKILLABLE Sorry the script already executed write commands against the dataset. " +
+				"You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command.")
+		} else {
+			server.luaKill = true
+			c.AddReply(shared.ok)
+		}
+	default:
+		c.AddReplyErrorFormat("unknown subcommand or wrong number of arguments for '%s'. Try SCRIPT HELP.", c.args[1].StrVal())
+	}
+}
+
+// 是否为 SCRIPT KILL 脚本超时期间只接受这个命令
+func isScriptKill(c *GodisClient, cmd *GodisCommand) bool {
+	return cmd.name == "script" && len(c.args) == 2 && strings.EqualFold(c.args[1].StrVal(), "kill")
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// redislock 使用的脚本
+const (
+	testLockReleaseScript = `local key = KEYS[1]
+local targetToken = ARGV[1]
+local getToken = redis.call('get', key)
+if (not getToken or getToken ~= targetToken) then
+	return 0
+else
+	return redis.call('del', key)
+end`
+	testLockRefreshScript = `local key = KEYS[1]
+local targetToken = ARGV[1]
+local duration = ARGV[2]
+local getToken = redis.call('get', key)
+if (not getToken or getToken ~= targetToken) then
+	return 0
+else
+	return redis.call('pexpire', key, duration)
+end`
+)
+
+func TestEvalLock(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	c.run("set", "lock", "token1", "nx", "px", "10000")
+	expectReply(t, c, ":0\r\n", "eval", testLockRefreshScript, "1", "lock", "other", "20000")
+	expectReply(t, c, ":1\r\n", "eval", testLockRefreshScript, "1", "lock", "token1", "20000")
+	if ttl := c.run("pttl", "lock"); ttl <= ":10000\r\n" {
+		t.Errorf("lock not refreshed: %q", ttl)
+	}
+	expectReply(t, c, ":0\r\n", "eval", testLockReleaseScript, "1", "lock", "other")
+	expectReply(t, c, ":1\r\n", "eval", testLockReleaseScript, "1", "lock", "token1")
+	expectReply(t, c, ":0\r\n", "exists", "lock")
+	expectReply(t, c, ":0\r\n", "eval", testLockReleaseScript, "1", "lock", "token1")
+}
+
+func TestEvalReplies(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	expectReply(t, c, "*4\r\n$2\r\nk1\r\n$2\r\nk2\r\n$1\r\na\r\n$1\r\nb\r\n",
+		"eval", "return {KEYS[1], KEYS[2], ARGV[1], ARGV[2]}", "2", "k1", "k2", "a", "b")
+	expectReply(t, c, ":3\r\n", "eval", "return 3.99", "0")
+	expectReply(t, c, "$3\r\nabc\r\n", "eval", "return 'abc'", "0")
+	expectReply(t, c, ":1\r\n", "eval", "return true", "0")
+	expectReply(t, c, "$-1\r\n", "eval", "return false", "0")
+	expectReply(t, c, "$-1\r\n", "eval", "return nil", "0")
+	expectReply(t, c, "$-1\r\n", "eval", "local x = 1", "0")
+	expectReply(t, c, "*2\r\n:1\r\n:2\r\n", "eval", "return {1, 2, nil, 4}", "0")
+	expectReply(t, c, "+fine\r\n", "eval", "return redis.status_reply('fine')", "0")
+	expectReply(t, c, "-MY error\r\n", "eval", "return redis.error_reply('MY error')", "0")
+	expectReply(t, c, "$40\r\n"+sha1hex("x")+"\r\n", "eval", "return redis.sha1hex('x')", "0")
+
+	// 命令的回复转换成 Lua 的值
+	c.run("rpush", "list", "a", "b")
+	expectReply(t, c, "*2\r\n$1\r\na\r\n$1\r\nb\r\n", "eval", "return redis.call('lrange', KEYS[1], 0, -1)", "1", "list")
+	expectReply(t, c, "$4\r\nnone\r\n", "eval", "if redis.call('get', 'nokey') == false then return 'none' end", "0")
+	expectReply(t, c, "$2\r\nOK\r\n", "eval", "return redis.call('set', 'k', 'v').ok", "0")
+	expectReply(t, c, ":3\r\n", "eval", "return redis.call('incrby', 'n', 3)", "0")
+	expectReply(t, c, ":4\r\n", "eval", "return redis.call('incr', 'n')", "0")
+}
+
+func TestEvalErrors(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	expectReply(t, c, "-ERR Number of keys can't be greater than number of args\r\n", "eval", "return 1", "2", "a")
+	expectReply(t, c, "-ERR Number of keys can't be negative\r\n", "eval", "return 1", "-1")
+	expectReply(t, c, "-ERR value is not an integer or out of range\r\n", "eval", "return 1", "x")
+	expectReply(t, c, "-ERR Error compiling script (new function): user_script:1: unexpected symbol near '<eof>'\r\n",
+		"eval", "return 1 +", "0")
+
+	script := "return nosuch"
+	expectReply(t, c, "-ERR user_script:1: Script attempted to access nonexistent global variable 'nosuch' script: "+
+		sha1hex(script)+", on @user_script:1.\r\n", "eval", script, "0")
+	script = "x = 1"
+	if r := c.run("eval", script, "0"); !strings.Contains(r, "Attempt to modify a readonly table") {
+		t.Errorf("unexpected reply %q", r)
+	}
+
+	// redis.call 的错误保留错误码 redis.pcall 返回错误表
+	c.run("set", "str", "v")
+	script = "return redis.call('incr', 'str')"
+	expectReply(t, c, "-ERR value is not an integer or out of range script: "+sha1hex(script)+", on @user_script:1.\r\n",
+		"eval", script, "0")
+	script = "\nreturn redis.call('lpush', 'str', 'a')"
+	expectReply(t, c, "-WRONGTYPE Operation against a key holding the wrong kind of value script: "+sha1hex(script)+
+		", on @user_script:2.\r\n", "eval", script, "0")
+	expectReply(t, c, "$43\r\nERR value is not an integer or out of range\r\n",
+		"eval", "return redis.pcall('incr', 'str').err", "0")
+	expectReply(t, c, "-ERR value is not an integer or out of range\r\n",
+		"eval", "return redis.pcall('incr', 'str')", "0")
+	expectReply(t, c, "$43\r\nERR value is not an integer or out of range\r\n",
+		"eval", "local ok, e = pcall(redis.call, 'incr', 'str') return e.err", "0")
+
+	for _, tt := range []struct{ script, msg string }{
+		{"return redis.call('nosuch')", "Unknown Redis command called from script"},
+		{"return redis.call('get')", "Wrong number of args calling Redis command from script"},
+		{"return redis.call('eval', 'return 1', 0)", "This Redis command is not allowed from script"},
+		{"return redis.call('multi')", "This Redis command is not allowed from script"},
+		{"return redis.call('get', {})", "Lua redis lib command arguments must be strings or integers"},
+		{"return redis.call()", "Please specify at least one argument for this redis lib call"},
+	} {
+		if r := c.run("eval", tt.script, "0"); !strings.HasPrefix(r, "-ERR "+tt.msg) {
+			t.Errorf("%s: unexpected reply %q", tt.script, r)
+		}
+	}
+
+	// 脚本中的阻塞命令不会阻塞
+	expectReply(t, c, "$-1\r\n", "eval", "return redis.call('blpop', 'nolist', 0)", "0")
+}
+
+func TestEvalsha(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	script := "return ARGV[1]"
+	sha := sha1hex(script)
+	expectReply(t, c, "-NOSCRIPT No matching script. Please use EVAL.\r\n", "evalsha", sha, "0", "x")
+	expectReply(t, c, "$40\r\n"+sha+"\r\n", "script", "load", script)
+	expectReply(t, c, "$1\r\nx\r\n", "evalsha", sha, "0", "x")
+	expectReply(t, c, "$1\r\ny\r\n", "evalsha", strings.ToUpper(sha), "0", "y")
+	expectReply(t, c, "*2\r\n:1\r\n:0\r\n", "script", "exists", sha, "nosuch")
+	expectReply(t, c, "+OK\r\n", "script", "flush")
+	expectReply(t, c, "*1\r\n:0\r\n", "script", "exists", sha)
+
+	// EVAL 也会缓存脚本
+	c.run("eval", script, "0", "z")
+	expectReply(t, c, "$1\r\nz\r\n", "evalsha", sha, "0", "z")
+	expectReply(t, c, "-ERR SCRIPT FLUSH only support SYNC|ASYNC option\r\n", "script", "flush", "now")
+	expectReply(t, c, "+OK\r\n", "script", "flush", "async")
+	expectReply(t, c, "-NOTBUSY No scripts in execution right now.\r\n", "script", "kill")
+	expectReply(t, c, "-ERR unknown subcommand or wrong number of arguments for 'nosuch'. Try SCRIPT HELP.\r\n",
+		"script", "nosuch")
+}
+
+func TestEvalAof(t *testing.T) {
+	initTestServer(t)
+	enableTestAof(t)
+	c := newTestClient(t)
+	c.run("eval", "return redis.call('get', 'k')", "0")
+	flushAppendOnlyFile()
+	if aof := readAof(t); aof != "" {
+		t.Errorf("read only script propagated: %q", aof)
+	}
+
+	// 脚本中的写命令以 MULTI ... EXEC 包裹传播 EVAL 本身不传播
+	c.run("eval", "redis.call('set', KEYS[1], ARGV[1]) redis.call('incr', 'counter')", "1", "k", "v")
+	flushAppendOnlyFile()
+	aof := readAof(t)
+	multi, set, incr, exec := strings.Index(aof, "MULTI"), strings.Index(aof, "set"),
+		strings.Index(aof, "incr"), strings.Index(aof, "EXEC")
+	if strings.Contains(aof, "eval") || multi < 0 || !(multi < set && set < incr && incr < exec) {
+		t.Errorf("unexpected AOF: %q", aof)
+	}
+
+	// 在事务中执行时只有一对 MULTI ... EXEC
+	c.run("multi")
+	c.run("eval", "redis.call('incr', 'counter')", "0")
+	c.run("set", "k2", "v2")
+	c.run("exec")
+	flushAppendOnlyFile()
+	aof = readAof(t)
+	if strings.Count(aof, "MULTI") != 2 || strings.Count(aof, "EXEC")+strings.Count(aof, "exec") != 2 {
+		t.Errorf("unexpected AOF: %q", aof)
+	}
+	reloadAof(t, c)
+	expectReply(t, c, "$1\r\nv\r\n", "get", "k")
+	expectReply(t, c, "$1\r\n2\r\n", "get", "counter")
+	expectReply(t, c, "$2\r\nv2\r\n", "get", "k2")
+}
+
+// 注册了可读事件的客户端 返回对端的 fd 用来发送命令
+func newTestConnClient(t *testing.T) (*GodisClient, int) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unix.Close(fds[1]) })
+	c := CreateClient(fds[0])
+	server.clients[c.fd] = c
+	server.aeLoop.AddFileEvent(c.fd, AE_READABLE, ReadQueryFromClient, c)
+	t.Cleanup(func() {
+		if server.clients[c.fd] == c {
+			freeClient(c)
+		}
+	})
+	return c, fds[1]
+}
+
+func TestScriptKill(t *testing.T) {
+	initTestServer(t)
+	server.luaTimeLimit = 10
+	c := newTestClient(t)
+	other, otherPeer := newTestConnClient(t)
+	killer, killerPeer := newTestConnClient(t)
+	// 两条命令在脚本超时之后才会被处理
+	unix.Write(otherPeer, []byte("GET k\r\n"))
+	unix.Write(killerPeer, []byte("SCRIPT KILL\r\n"))
+
+	script := "local i = 0 while true do i = i + 1 end"
+	expectReply(t, c, "-ERR Script killed by user with SCRIPT KILL... script: "+sha1hex(script)+", on @user_script:1.\r\n",
+		"eval", script, "0")
+	if got := other.takeReply(); got != "-BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE.\r\n" {
+		t.Errorf("unexpected reply %q", got)
+	}
+	if got := killer.takeReply(); got != "+OK\r\n" {
+		t.Errorf("unexpected reply %q", got)
+	}
+	if server.luaCaller != nil || server.luaTimedOut {
+		t.Error("script state not reset")
+	}
+	expectReply(t, c, "+PONG\r\n", "ping")
+
+	// 执行过写命令的脚本不能被终止
+	server.luaCaller, server.luaWriteDirty = c, true
+	expectReply(t, killer, "-UNKILLABLE Sorry the script already executed write commands against the dataset. "+
+		"You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command.\r\n",
+		"script", "kill")
+	server.luaCaller, server.luaWriteDirty = nil, false
+}
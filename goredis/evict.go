@@ -0,0 +1,375 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+// maxmemory-policy 低 8 位是策略的属性 高位区分具体的策略
+const (
+	MAXMEMORY_FLAG_LRU     = 1 << 0
+	MAXMEMORY_FLAG_LFU     = 1 << 1
+	MAXMEMORY_FLAG_ALLKEYS = 1 << 2
+
+	MAXMEMORY_VOLATILE_LRU    = 0<<8 | MAXMEMORY_FLAG_LRU
+	MAXMEMORY_VOLATILE_LFU    = 1<<8 | MAXMEMORY_FLAG_LFU
+	MAXMEMORY_VOLATILE_TTL    = 2 << 8
+	MAXMEMORY_VOLATILE_RANDOM = 3 << 8
+	MAXMEMORY_ALLKEYS_LRU     = 4<<8 | MAXMEMORY_FLAG_LRU | MAXMEMORY_FLAG_ALLKEYS
+	MAXMEMORY_ALLKEYS_LFU     = 5<<8 | MAXMEMORY_FLAG_LFU | MAXMEMORY_FLAG_ALLKEYS
+	MAXMEMORY_ALLKEYS_RANDOM  = 6<<8 | MAXMEMORY_FLAG_ALLKEYS
+	MAXMEMORY_NO_EVICTION     = 7 << 8
+)
+
+var maxmemoryPolicyNames = map[string]int{
+	"volatile-lru":    MAXMEMORY_VOLATILE_LRU,
+	"volatile-lfu":    MAXMEMORY_VOLATILE_LFU,
+	"volatile-random": MAXMEMORY_VOLATILE_RANDOM,
+	"volatile-ttl":    MAXMEMORY_VOLATILE_TTL,
+	"allkeys-lru":     MAXMEMORY_ALLKEYS_LRU,
+	"allkeys-lfu":     MAXMEMORY_ALLKEYS_LFU,
+	"allkeys-random":  MAXMEMORY_ALLKEYS_RANDOM,
+	"noeviction":      MAXMEMORY_NO_EVICTION,
+}
+
+func maxmemoryPolicyName(policy int) string {
+	for name, p := range maxmemoryPolicyNames {
+		if p == policy {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+const (
+	EVICT_OK   = 0
+	EVICT_FAIL = 1 // 没有可以淘汰的 key 内存仍然超过 maxmemory
+)
+
+/* ---------------------------------- LRU ---------------------------------- */
+
+const (
+	LRU_CLOCK_MAX        = 1<<24 - 1 // lru 字段能表示的最大时钟
+	LRU_CLOCK_RESOLUTION = 1000      // 时钟精度（毫秒）
+)
+
+func getLRUClock() uint32 {
+	return uint32(GetMsTime()/LRU_CLOCK_RESOLUTION) & LRU_CLOCK_MAX
+}
+
+/*
+估算对象多久没有被访问过（毫秒）
+server.lruclock 由 ServerCron 更新 精度足够时不需要每次都读取系统时间
+*/
+func estimateObjectIdleTime(o *Gobj) uint64 {
+	lruclock := server.lruclock
+	if lruclock >= o.lru {
+		return uint64(lruclock-o.lru) * LRU_CLOCK_RESOLUTION
+	}
+	// 时钟已经回绕
+	return uint64(lruclock+(LRU_CLOCK_MAX-o.lru)) * LRU_CLOCK_RESOLUTION
+}
+
+/* ---------------------------------- LFU ---------------------------------- */
+
+/*
+LFU 的计数器只有 8 位 按对数增长：计数器越大 下一次访问让它加一的概率越小
+一段时间没有访问时每过 lfu-decay-time 分钟计数器减一 新对象从 LFU_INIT_VAL 开始
+避免刚写入的 key 马上被淘汰
+*/
+const LFU_INIT_VAL = 5
+
+func LFUGetTimeInMinutes() uint32 {
+	return uint32(GetMsTime()/1000/60) & 65535
+}
+
+// 距离上一次递减过去的分钟数 处理 16 位时间的回绕
+func LFUTimeElapsed(ldt uint32) uint32 {
+	now := LFUGetTimeInMinutes()
+	if now >= ldt {
+		return now - ldt
+	}
+	return 65535 - ldt + now
+}
+
+func LFULogIncr(counter uint32) uint32 {
+	if counter == 255 {
+		return 255
+	}
+	baseval := float64(counter) - LFU_INIT_VAL
+	if baseval < 0 {
+		baseval = 0
+	}
+	p := 1.0 / (baseval*float64(server.lfuLogFactor) + 1)
+	if rand.Float64() < p {
+		counter++
+	}
+	return counter
+}
+
+// 返回按经过的时间递减之后的计数器 不修改对象
+func LFUDecrAndReturn(o *Gobj) uint32 {
+	ldt := o.lru >> 8
+	counter := o.lru & 255
+	var periods uint32
+	if server.lfuDecayTime > 0 {
+		periods = LFUTimeElapsed(ldt) / uint32(server.lfuDecayTime)
+	}
+	if periods > counter {
+		return 0
+	}
+	return counter - periods
+}
+
+// 新对象的 lru 字段
+func objectInitLRU() uint32 {
+	if server.maxmemoryPolicy&MAXMEMORY_FLAG_LFU != 0 {
+		return LFUGetTimeInMinutes()<<8 | LFU_INIT_VAL
+	}
+	return server.lruclock
+}
+
+/*
+访问 key 时更新 LRU 时钟或者 LFU 计数器
+后台保存和重写正在遍历数据时不修改
+*/
+func updateObjectAccess(o *Gobj) {
+	if server.rdbChildRunning || server.aofChildRunning {
+		return
+	}
+	if server.maxmemoryPolicy&MAXMEMORY_FLAG_LFU != 0 {
+		counter := LFULogIncr(LFUDecrAndReturn(o))
+		o.lru = LFUGetTimeInMinutes()<<8 | counter
+	} else {
+		o.lru = server.lruclock
+	}
+}
+
+/*
+RESTORE 的 IDLETIME 和 FREQ 选项 只设置和当前策略对应的一个
+参数为 -1 表示没有指定 lruIdle 的单位为秒
+*/
+func objectSetLRUOrLFU(o *Gobj, lfuFreq, lruIdle int64) {
+	if server.maxmemoryPolicy&MAXMEMORY_FLAG_LFU != 0 {
+		if lfuFreq >= 0 {
+			o.lru = LFUGetTimeInMinutes()<<8 | uint32(lfuFreq)
+		}
+	} else if lruIdle >= 0 {
+		clock := int64(server.lruclock) - lruIdle*1000/LRU_CLOCK_RESOLUTION
+		if clock < 0 {
+			clock += LRU_CLOCK_MAX
+		}
+		o.lru = uint32(clock)
+	}
+}
+
+/* ----------------------------- 淘汰池 ----------------------------- */
+
+/*
+每次从各个数据库采样 maxmemory-samples 个 key 放入淘汰池 池中按 idle 从小到大排列
+idle 越大越应该被淘汰 LRU 是空闲时间 LFU 是 255 减去计数器 TTL 是过期时间的反序
+池在多次淘汰之间保留 积累下来的候选 key 让近似算法更接近真正的 LRU
+*/
+const EVPOOL_SIZE = 16
+
+type evictionPoolEntry struct {
+	idle uint64
+	key  string
+	dbid int
+}
+
+var evictionPool []evictionPoolEntry
+
+func evictionPoolAlloc() {
+	evictionPool = make([]evictionPoolEntry, 0, EVPOOL_SIZE)
+}
+
+// sampledict 是 data 或者 expire 取值总是从 data 中查找
+func evictionPoolPopulate(db *GodisDB, sampledict *Dict) {
+	for i := 0; i < server.maxmemorySamples; i++ {
+		e := sampledict.RandomGet()
+		if e == nil {
+			break
+		}
+		var idle uint64
+		switch {
+		case server.maxmemoryPolicy&MAXMEMORY_FLAG_LRU != 0:
+			idle = estimateObjectIdleTime(db.data.Get(e.Key))
+		case server.maxmemoryPolicy&MAXMEMORY_FLAG_LFU != 0:
+			idle = uint64(255 - LFUDecrAndReturn(db.data.Get(e.Key)))
+		case server.maxmemoryPolicy == MAXMEMORY_VOLATILE_TTL:
+			// 越早过期越先淘汰
+			idle = math.MaxUint64 - uint64(e.Val.IntVal())
+		}
+		evictionPoolInsert(evictionPoolEntry{idle, e.Key.StrVal(), db.id})
+	}
+}
+
+func evictionPoolInsert(entry evictionPoolEntry) {
+	pool := evictionPool
+	for i := range pool {
+		if pool[i].key == entry.key && pool[i].dbid == entry.dbid {
+			// 同一个 key 被重复采样 更新 idle 之后重新排序
+			pool = append(pool[:i], pool[i+1:]...)
+			break
+		}
+	}
+	k := sort.Search(len(pool), func(i int) bool { return pool[i].idle >= entry.idle })
+	if k == 0 && len(pool) == EVPOOL_SIZE {
+		// 比池中所有的 key 都更不应该被淘汰
+		evictionPool = pool
+		return
+	}
+	pool = append(pool, evictionPoolEntry{})
+	copy(pool[k+1:], pool[k:])
+	pool[k] = entry
+	if len(pool) > EVPOOL_SIZE {
+		// 丢弃 idle 最小的
+		pool = append(pool[:0], pool[1:]...)
+	}
+	evictionPool = pool
+}
+
+/* ----------------------------- 执行淘汰 ----------------------------- */
+
+var evictNextDb int // random 策略轮流从各个数据库中淘汰
+
+// 数据集占用的内存 包括 key val 以及数据库中 dict 本身的结构
+func usedMemory() int64 {
+	var size int64
+	for _, db := range server.dbs {
+		size += db.usedMemory + db.data.MemUsage() + db.expire.MemUsage()
+	}
+	return size
+}
+
+// 选出下一个要淘汰的 key 没有可以淘汰的 key 时返回 nil
+func evictionSelectKey() (*GodisDB, *Gobj) {
+	policy := server.maxmemoryPolicy
+	allkeys := policy&MAXMEMORY_FLAG_ALLKEYS != 0
+	keyDict := func(db *GodisDB) *Dict {
+		if allkeys {
+			return db.data
+		}
+		return db.expire
+	}
+	if policy&(MAXMEMORY_FLAG_LRU|MAXMEMORY_FLAG_LFU) != 0 || policy == MAXMEMORY_VOLATILE_TTL {
+		for {
+			var total int64
+			for _, db := range server.dbs {
+				if dict := keyDict(db); dict.Len() > 0 {
+					total += dict.Len()
+					evictionPoolPopulate(db, dict)
+				}
+			}
+			if total == 0 {
+				return nil, nil
+			}
+			// 从 idle 最大的开始 池中的 key 可能已经被删除或者去掉了过期时间
+			for i := len(evictionPool) - 1; i >= 0; i-- {
+				entry := evictionPool[i]
+				evictionPool = evictionPool[:i]
+				db := server.dbs[entry.dbid]
+				key := CreateObject(GSTR, entry.key)
+				if keyDict(db).Find(key) != nil {
+					return db, key
+				}
+				key.DecrRefCount()
+			}
+		}
+	}
+	for i := 0; i < len(server.dbs); i++ {
+		db := server.dbs[evictNextDb%len(server.dbs)]
+		evictNextDb++
+		if e := keyDict(db).RandomGet(); e != nil {
+			e.Key.IncrRefCount()
+			return db, e.Key
+		}
+	}
+	return nil, nil
+}
+
+func evictKey(db *GodisDB, key *Gobj) {
+	propagate(db.id, "DEL", key.StrVal())
+	db.dbDelete(key)
+	signalModifiedKey(nil, db, key)
+	notifyKeyspaceEvent(NOTIFY_EVICTED, "evicted", key, db.id)
+	server.statEvictedKeys++
+}
+
+/*
+内存超过 maxmemory 时按策略淘汰 key 直到回到限制以内
+noeviction 或者没有可以淘汰的 key 时返回 EVICT_FAIL
+*/
+func performEvictions() int {
+	// 副本的数据由主节点决定 和主节点各自淘汰会导致数据不一致
+	if server.masterhost != "" {
+		return EVICT_OK
+	}
+	// 暂停期间数据集保持不变
+	if checkClientPauseTimeoutAndReturnIfPaused() {
+		return EVICT_OK
+	}
+	if server.maxmemory == 0 || usedMemory() <= server.maxmemory {
+		return EVICT_OK
+	}
+	if server.maxmemoryPolicy == MAXMEMORY_NO_EVICTION {
+		return EVICT_FAIL
+	}
+	for usedMemory() > server.maxmemory {
+		db, key := evictionSelectKey()
+		if key == nil {
+			return EVICT_FAIL
+		}
+		evictKey(db, key)
+		key.DecrRefCount()
+	}
+	return EVICT_OK
+}
+
+/*
+命令可能增加内存时是否要因为 OOM 拒绝执行
+MULTI 中排队的命令都会被拒绝 EXEC 检查队列中是否有可能增加内存的命令
+*/
+func rejectCommandOnOOM(c *GodisClient, cmd *GodisCommand) bool {
+	if cmd.flags&CMD_DENYOOM != 0 {
+		return true
+	}
+	if cmd.name == "exec" {
+		return c.mstate.cmdFlags&CMD_DENYOOM != 0
+	}
+	return c.flags&CLIENT_MULTI != 0 && cmd.name != "discard"
+}
+
+// MEMORY USAGE key [SAMPLES count]
+func memoryCommand(c *GodisClient) {
+	sub := strings.ToLower(c.args[1].StrVal())
+	if sub != "usage" || len(c.args) < 3 {
+		c.AddReplyErrorFormat("unknown subcommand or wrong number of arguments for '%s'. Try MEMORY HELP.", c.args[1].StrVal())
+		return
+	}
+	samples := int64(OBJ_COMPUTE_SIZE_DEF_SAMPLES)
+	for i := 3; i < len(c.args); i++ {
+		if strings.EqualFold(c.args[i].StrVal(), "samples") && i+1 < len(c.args) {
+			v, ok := getPositiveLongFromObjectOrReply(c, c.args[i+1], "")
+			if !ok {
+				return
+			}
+			// 0 表示计算全部元素
+			samples = v
+			i++
+		} else {
+			c.AddReply(shared.syntaxerr)
+			return
+		}
+	}
+	key := c.args[2]
+	o := c.db.lookupKeyRead(key)
+	if o == nil {
+		c.AddReplyNull()
+		return
+	}
+	c.AddReplyInt(objectComputeSize(o, samples) + stringObjectSize(key))
+}
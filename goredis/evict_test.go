@@ -0,0 +1,180 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func testGetObject(c *GodisClient, key string) *Gobj {
+	k := CreateObject(GSTR, key)
+	defer k.DecrRefCount()
+	return c.db.data.Get(k)
+}
+
+func TestMemoryAccounting(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	db := c.db
+	if db.usedMemory != 0 {
+		t.Fatalf("expect 0, got %d", db.usedMemory)
+	}
+	c.run("set", "k", "value")
+	strSize := db.usedMemory
+	if strSize <= 0 {
+		t.Fatalf("string not accounted: %d", strSize)
+	}
+	c.run("set", "k", strings.Repeat("v", 1000))
+	if db.usedMemory < strSize+990 {
+		t.Errorf("overwrite not accounted: %d", db.usedMemory)
+	}
+
+	// 原地修改的集合类型重新估算大小
+	c.run("rpush", "list", "a")
+	before := db.usedMemory
+	c.run("rpush", "list", "b", "c", "d")
+	if db.usedMemory <= before {
+		t.Errorf("rpush not accounted: %d <= %d", db.usedMemory, before)
+	}
+	c.run("hset", "h", "f1", "v1", "f2", "v2")
+	c.run("sadd", "s", "m1", "m2")
+	c.run("zadd", "z", "1", "m1", "2", "m2")
+	for _, key := range []string{"list", "h", "s", "z"} {
+		if r := c.run("memory", "usage", key); !strings.HasPrefix(r, ":") || r == ":0\r\n" {
+			t.Errorf("memory usage %s: %q", key, r)
+		}
+	}
+	expectReply(t, c, "$-1\r\n", "memory", "usage", "nokey")
+	expectReply(t, c, "-ERR syntax error\r\n", "memory", "usage", "k", "samples")
+
+	c.run("del", "k", "list", "h", "s", "z")
+	if db.usedMemory != 0 {
+		t.Errorf("expect 0 after del, got %d", db.usedMemory)
+	}
+	c.run("set", "k", "v")
+	c.run("flushall")
+	if db.usedMemory != 0 {
+		t.Errorf("expect 0 after flushall, got %d", db.usedMemory)
+	}
+}
+
+func TestEvictNoeviction(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	c.run("set", "k", "v")
+	server.maxmemory = usedMemory() - 1
+	expectReply(t, c, "-OOM command not allowed when used memory > 'maxmemory'.\r\n", "set", "k2", "v")
+	expectReply(t, c, "$1\r\nv\r\n", "get", "k")
+
+	// 排队时被拒绝的事务整个不执行
+	c.run("multi")
+	expectReply(t, c, "-OOM command not allowed when used memory > 'maxmemory'.\r\n", "get", "k")
+	expectReply(t, c, "-EXECABORT Transaction discarded because of previous errors.\r\n", "exec")
+
+	script := "return redis.call('set', 'k2', 'v')"
+	expectReply(t, c, "-OOM command not allowed when used memory > 'maxmemory'. script: "+sha1hex(script)+
+		", on @user_script:1.\r\n", "eval", script, "0")
+	expectReply(t, c, ":1\r\n", "del", "k")
+	expectReply(t, c, "+OK\r\n", "set", "k2", "v")
+}
+
+func TestEvictAllkeysLRU(t *testing.T) {
+	initTestServer(t)
+	server.maxmemoryPolicy = MAXMEMORY_ALLKEYS_LRU
+	server.maxmemorySamples = 64
+	c := newTestClient(t)
+	server.lruclock = 1000
+	for _, key := range []string{"old", "mid", "new"} {
+		c.run("set", key, "v")
+	}
+	testGetObject(c, "old").lru = 900
+	testGetObject(c, "mid").lru = 950
+	server.maxmemory = usedMemory() - 1
+	c.run("ping")
+	expectReply(t, c, ":0\r\n", "exists", "old")
+	expectReply(t, c, ":2\r\n", "exists", "mid", "new")
+	if server.statEvictedKeys != 1 || !strings.Contains(genGodisInfoString([]string{"stats"}), "evicted_keys:1\r\n") {
+		t.Errorf("unexpected evicted keys %d", server.statEvictedKeys)
+	}
+
+	// 读取之后 mid 比 new 更新
+	server.lruclock = 1100
+	c.run("get", "mid")
+	server.maxmemory = usedMemory() - 1
+	c.run("ping")
+	expectReply(t, c, ":0\r\n", "exists", "new")
+	expectReply(t, c, ":1\r\n", "exists", "mid")
+}
+
+func TestEvictAllkeysLFU(t *testing.T) {
+	initTestServer(t)
+	server.maxmemoryPolicy = MAXMEMORY_ALLKEYS_LFU
+	server.maxmemorySamples = 64
+	c := newTestClient(t)
+	for _, key := range []string{"hot", "cold"} {
+		c.run("set", key, "v")
+	}
+	now := LFUGetTimeInMinutes()
+	testGetObject(c, "hot").lru = now<<8 | 100
+	testGetObject(c, "cold").lru = now<<8 | 2
+	server.maxmemory = usedMemory() - 1
+	c.run("ping")
+	expectReply(t, c, ":0\r\n", "exists", "cold")
+	expectReply(t, c, ":1\r\n", "exists", "hot")
+}
+
+func TestLFUCounter(t *testing.T) {
+	initTestServer(t)
+	server.maxmemoryPolicy = MAXMEMORY_ALLKEYS_LFU
+	o := CreateObject(GSTR, "v")
+	if LFUDecrAndReturn(o) != LFU_INIT_VAL {
+		t.Fatalf("expect initial counter %d, got %d", LFU_INIT_VAL, LFUDecrAndReturn(o))
+	}
+	for i := 0; i < 1000; i++ {
+		updateObjectAccess(o)
+	}
+	// 对数增长 1000 次访问远远达不到 255
+	if counter := LFUDecrAndReturn(o); counter <= LFU_INIT_VAL || counter >= 100 {
+		t.Errorf("unexpected counter %d", counter)
+	}
+	// 过了 10 分钟 计数器减 10
+	counter := LFUDecrAndReturn(o)
+	o.lru = (LFUGetTimeInMinutes()+65536-10)&65535<<8 | counter
+	if got := LFUDecrAndReturn(o); got != counter-10 {
+		t.Errorf("expect %d after decay, got %d", counter-10, got)
+	}
+}
+
+func TestEvictVolatile(t *testing.T) {
+	initTestServer(t)
+	server.maxmemoryPolicy = MAXMEMORY_VOLATILE_TTL
+	server.maxmemorySamples = 64
+	c := newTestClient(t)
+	c.run("set", "persist", "v")
+	c.run("set", "soon", "v", "ex", "100")
+	c.run("set", "later", "v", "ex", "1000")
+	server.maxmemory = usedMemory() - 1
+	c.run("ping")
+	expectReply(t, c, ":0\r\n", "exists", "soon")
+	expectReply(t, c, ":2\r\n", "exists", "persist", "later")
+
+	// 没有设置过期时间的 key 不会被淘汰
+	server.maxmemoryPolicy = MAXMEMORY_VOLATILE_RANDOM
+	server.maxmemory = 1
+	expectReply(t, c, "-OOM command not allowed when used memory > 'maxmemory'.\r\n", "set", "k", "v")
+	expectReply(t, c, ":0\r\n", "exists", "later")
+	expectReply(t, c, ":1\r\n", "exists", "persist")
+}
+
+func TestEvictAllkeysRandom(t *testing.T) {
+	initTestServer(t)
+	server.maxmemoryPolicy = MAXMEMORY_ALLKEYS_RANDOM
+	c := newTestClient(t)
+	for i := 0; i < 100; i++ {
+		c.run("set", "key:"+strings.Repeat("x", i), "v")
+	}
+	server.maxmemory = usedMemory() / 2
+	expectReply(t, c, "+OK\r\n", "set", "k", "v")
+	if usedMemory() > server.maxmemory+200 || c.db.data.Len() >= 100 {
+		t.Errorf("not evicted: used %d keys %d", usedMemory(), c.db.data.Len())
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// EXPIRE 系列命令的可选参数
+const (
+	EXPIRE_NX = 1 << 0
+	EXPIRE_XX = 1 << 1
+	EXPIRE_GT = 1 << 2
+	EXPIRE_LT = 1 << 3
+)
+
+func parseExtendedExpireArgumentsOrReply(c *GodisClient) (int, bool) {
+	var flags int
+	for _, arg := range c.args[3:] {
+		switch strings.ToLower(arg.StrVal()) {
+		case "nx":
+			flags |= EXPIRE_NX
+		case "xx":
+			flags |= EXPIRE_XX
+		case "gt":
+			flags |= EXPIRE_GT
+		case "lt":
+			flags |= EXPIRE_LT
+		default:
+			c.AddReplyErrorFormat("Unsupported option %s", arg.StrVal())
+			return 0, false
+		}
+	}
+	if flags&EXPIRE_NX != 0 && flags&(EXPIRE_XX|EXPIRE_GT|EXPIRE_LT) != 0 {
+		c.AddReplyError("NX and XX, GT or LT options at the same time are not compatible")
+		return 0, false
+	}
+	if flags&EXPIRE_GT != 0 && flags&EXPIRE_LT != 0 {
+		c.AddReplyError("GT and LT options at the same time are not compatible")
+		return 0, false
+	}
+	return flags, true
+}
+
+/*
+EXPIRE / PEXPIRE / EXPIREAT / PEXPIREAT 的通用实现
+basetime 为 0 时 args[2] 是绝对时间 过期时间统一以毫秒保存
+*/
+func expireGenericCommand(c *GodisClient, basetime int64, unit int) {
+	key := c.args[1]
+	when, ok := getLongLongFromObjectOrReply(c, c.args[2], "")
+	if !ok {
+		return
+	}
+	flags, ok := parseExtendedExpireArgumentsOrReply(c)
+	if !ok {
+		return
+	}
+	invalid := false
+	if unit == UNIT_SECONDS {
+		if when > math.MaxInt64/1000 || when < math.MinInt64/1000 {
+			invalid = true
+		}
+		when *= 1000
+	}
+	if !invalid && ((basetime > 0 && when > math.MaxInt64-basetime) || (basetime < 0 && when < math.MinInt64-basetime)) {
+		invalid = true
+	}
+	if invalid {
+		c.AddReplyErrorFormat("invalid expire time in '%s' command", strings.ToLower(c.args[0].StrVal()))
+		return
+	}
+	when += basetime
+
+	if c.db.lookupKeyWrite(key) == nil {
+		c.AddReply(shared.czero)
+		return
+	}
+	if flags != 0 {
+		current := c.db.getExpire(key)
+		// 没有过期时间的 key 视为 TTL 无限大
+		if (flags&EXPIRE_NX != 0 && current != -1) ||
+			(flags&EXPIRE_XX != 0 && current == -1) ||
+			(flags&EXPIRE_GT != 0 && (current == -1 || when <= current)) ||
+			(flags&EXPIRE_LT != 0 && current != -1 && when >= current) {
+			c.AddReply(shared.czero)
+			return
+		}
+	}
+	// 负数或者已经过去的时间直接删除 key 传播时统一改写成绝对时间
+	// 相对时间和 basetime 比较 避免执行期间时间变化导致 EXPIRE key 1 直接删除
+	now := basetime
+	if now == 0 {
+		now = GetMsTime()
+	}
+	signalModifiedKey(c, c.db, key)
+	if when <= now {
+		c.db.dbDelete(key)
+		notifyKeyspaceEvent(NOTIFY_GENERIC, "del", key, c.db.id)
+		rewriteClientCommandVector(c, "DEL", key.StrVal())
+	} else {
+		c.db.setExpire(key, when)
+		notifyKeyspaceEvent(NOTIFY_GENERIC, "expire", key, c.db.id)
+		rewriteClientCommandVector(c, "PEXPIREAT", key.StrVal(), strconv.FormatInt(when, 10))
+	}
+	server.dirty++
+	c.AddReply(shared.cone)
+}
+
+// EXPIRE key seconds [NX|XX|GT|LT]
+func expireCommand(c *GodisClient) {
+	expireGenericCommand(c, GetMsTime(), UNIT_SECONDS)
+}
+
+func pexpireCommand(c *GodisClient) {
+	expireGenericCommand(c, GetMsTime(), UNIT_MILLISECONDS)
+}
+
+func expireatCommand(c *GodisClient) {
+	expireGenericCommand(c, 0, UNIT_SECONDS)
+}
+
+func pexpireatCommand(c *GodisClient) {
+	expireGenericCommand(c, 0, UNIT_MILLISECONDS)
+}
+
+/*
+TTL / PTTL / EXPIRETIME / PEXPIRETIME
+key 不存在时返回 -2 没有过期时间时返回 -1
+*/
+func ttlGenericCommand(c *GodisClient, outputMs bool, absolute bool) {
+	key := c.args[1]
+	if c.db.lookupKeyRead(key) == nil {
+		c.AddReplyInt(-2)
+		return
+	}
+	expire := c.db.getExpire(key)
+	if expire == -1 {
+		c.AddReplyInt(-1)
+		return
+	}
+	ttl := expire
+	if !absolute {
+		ttl = max(expire-GetMsTime(), 0)
+	}
+	if outputMs {
+		c.AddReplyInt(ttl)
+	} else {
+		c.AddReplyInt((ttl + 500) / 1000)
+	}
+}
+
+func ttlCommand(c *GodisClient) {
+	ttlGenericCommand(c, false, false)
+}
+
+func pttlCommand(c *GodisClient) {
+	ttlGenericCommand(c, true, false)
+}
+
+func expiretimeCommand(c *GodisClient) {
+	ttlGenericCommand(c, false, true)
+}
+
+func pexpiretimeCommand(c *GodisClient) {
+	ttlGenericCommand(c, true, true)
+}
+
+func persistCommand(c *GodisClient) {
+	key := c.args[1]
+	if c.db.lookupKeyWrite(key) == nil || !c.db.removeExpire(key) {
+		c.AddReply(shared.czero)
+		return
+	}
+	signalModifiedKey(c, c.db, key)
+	notifyKeyspaceEvent(NOTIFY_GENERIC, "persist", key, c.db.id)
+	server.dirty++
+	c.AddReply(shared.cone)
+}
+
+/*
+主动过期 和 Redis 的 activeExpireCycle 一致
+每轮从 expire 中按槽位采样一批 key 删除其中已过期的
+过期比例超过 acceptable stale 时继续下一轮 直到超出时间预算
+SLOW 在 ServerCron 中执行 FAST 在每次 beforeSleep 中执行 耗时更短
+*/
+const (
+	ACTIVE_EXPIRE_CYCLE_SLOW = 0
+	ACTIVE_EXPIRE_CYCLE_FAST = 1
+
+	ACTIVE_EXPIRE_CYCLE_KEYS_PER_LOOP     = 20   // 每轮采样的 key 数量
+	ACTIVE_EXPIRE_CYCLE_FAST_DURATION     = 1000 // FAST 的时间预算（微秒）
+	ACTIVE_EXPIRE_CYCLE_SLOW_TIME_PERC    = 25   // SLOW 最多占用的 CPU 百分比
+	ACTIVE_EXPIRE_CYCLE_ACCEPTABLE_STALE  = 10   // 可以接受的过期 key 百分比
+	ACTIVE_EXPIRE_CYCLE_SAMPLE_TIME_CHECK = 16   // 每隔多少轮检查一次耗时
+)
+
+var (
+	timelimitExit   bool  // 上一次是否因为时间预算退出
+	lastFastCycle   int64 // 上一次 FAST 的开始时间（微秒）
+	activeExpireDbs int   // 下一次从哪个数据库开始
+)
+
+func activeExpireCycle(cycleType int) {
+	// effort 从 0 开始 默认的 1 对应上面的默认参数
+	effort := int64(server.activeExpireEffort - 1)
+	keysPerLoop := ACTIVE_EXPIRE_CYCLE_KEYS_PER_LOOP + ACTIVE_EXPIRE_CYCLE_KEYS_PER_LOOP/4*effort
+	fastDuration := ACTIVE_EXPIRE_CYCLE_FAST_DURATION + ACTIVE_EXPIRE_CYCLE_FAST_DURATION/4*effort
+	slowTimePerc := ACTIVE_EXPIRE_CYCLE_SLOW_TIME_PERC + 2*effort
+	acceptableStale := ACTIVE_EXPIRE_CYCLE_ACCEPTABLE_STALE - effort
+
+	start := GetUsTime()
+	if cycleType == ACTIVE_EXPIRE_CYCLE_FAST {
+		// 上一次没有超时并且过期比例不高时不需要 FAST
+		if !timelimitExit && server.statExpiredStalePerc < float64(acceptableStale) {
+			return
+		}
+		if start < lastFastCycle+fastDuration*2 {
+			return
+		}
+		lastFastCycle = start
+	}
+
+	// SLOW 每次最多占用 slowTimePerc% 的 CPU 时间
+	timelimit := slowTimePerc * 1000000 / int64(server.hz) / 100
+	if timelimit <= 0 {
+		timelimit = 1
+	}
+	if cycleType == ACTIVE_EXPIRE_CYCLE_FAST {
+		timelimit = fastDuration
+	}
+	// 每次最多处理 CRON_DBS_PER_CALL 个数据库 上次超时的话处理全部数据库
+	dbsPerCall := min(CRON_DBS_PER_CALL, len(server.dbs))
+	if timelimitExit {
+		dbsPerCall = len(server.dbs)
+	}
+	timelimitExit = false
+
+	var totalSampled, totalExpired int64
+	var iteration int64
+	for j := 0; j < dbsPerCall && !timelimitExit; j++ {
+		db := server.dbs[activeExpireDbs%len(server.dbs)]
+		activeExpireDbs++
+		for {
+			num := db.expire.Len()
+			if num == 0 {
+				db.avgTTL = 0
+				break
+			}
+			iteration++
+			if num > keysPerLoop {
+				num = keysPerLoop
+			}
+			sampled, expired, ttlSum, ttlSamples := activeExpireSample(db, num)
+			totalSampled += sampled
+			totalExpired += expired
+			// 平均 TTL 只做粗略的估计
+			if ttlSamples > 0 {
+				avg := ttlSum / ttlSamples
+				if db.avgTTL == 0 {
+					db.avgTTL = avg
+				} else {
+					db.avgTTL = (db.avgTTL/50)*49 + avg/50
+				}
+			}
+			if iteration%ACTIVE_EXPIRE_CYCLE_SAMPLE_TIME_CHECK == 0 && GetUsTime()-start > timelimit {
+				timelimitExit = true
+				server.statExpiredTimeCapReachedCount++
+				break
+			}
+			// 过期的比例足够低时处理下一个数据库
+			if sampled == 0 || expired*100/sampled <= acceptableStale {
+				break
+			}
+		}
+	}
+
+	server.statExpireCycleTimeUsed += GetUsTime() - start
+	var currentPerc float64
+	if totalSampled > 0 {
+		currentPerc = float64(totalExpired) / float64(totalSampled)
+	}
+	server.statExpiredStalePerc = currentPerc*0.05 + server.statExpiredStalePerc*0.95
+}
+
+/*
+从 db.expiresCursor 开始按槽位采样 num 个 key
+访问的空槽位也计入上限 防止 expire 很稀疏时耗时过长
+*/
+func activeExpireSample(db *GodisDB, num int64) (sampled, expired, ttlSum, ttlSamples int64) {
+	var keys []*Gobj
+	maxBuckets := num * 20
+	var checkedBuckets int64
+	now := GetMsTime()
+	for int64(len(keys)) < num && checkedBuckets < maxBuckets {
+		db.expiresCursor = db.expire.Scan(db.expiresCursor, func(e *Entry) {
+			e.Key.IncrRefCount()
+			keys = append(keys, e.Key)
+			ttl := e.Val.IntVal() - now
+			if ttl > 0 {
+				ttlSum += ttl
+				ttlSamples++
+			}
+		})
+		checkedBuckets++
+		if db.expiresCursor == 0 {
+			break
+		}
+	}
+	for _, key := range keys {
+		sampled++
+		if db.expireIfNeeded(key) {
+			expired++
+		}
+		key.DecrRefCount()
+	}
+	return sampled, expired, ttlSum, ttlSamples
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpireCommands(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	expectReply(t, c, ":0\r\n", "expire", "k", "100")
+	c.run("set", "k", "v")
+	expectReply(t, c, ":-1\r\n", "ttl", "k")
+	expectReply(t, c, ":-2\r\n", "ttl", "nosuch")
+	expectReply(t, c, ":0\r\n", "expire", "k", "100", "xx")
+	expectReply(t, c, ":0\r\n", "expire", "k", "100", "gt")
+	expectReply(t, c, ":1\r\n", "expire", "k", "100", "nx")
+	expectReply(t, c, ":0\r\n", "expire", "k", "200", "nx")
+	expectReply(t, c, ":100\r\n", "ttl", "k")
+	expectReply(t, c, ":0\r\n", "expire", "k", "50", "gt")
+	expectReply(t, c, ":1\r\n", "expire", "k", "50", "lt")
+	reply := c.run("pttl", "k")
+	if pttl, _ := strconv.Atoi(reply[1 : len(reply)-2]); pttl < 49000 || pttl > 50000 {
+		t.Errorf("pttl = %q", reply)
+	}
+	expectReply(t, c, "-ERR NX and XX, GT or LT options at the same time are not compatible\r\n", "expire", "k", "1", "nx", "xx")
+	expectReply(t, c, "-ERR GT and LT options at the same time are not compatible\r\n", "expire", "k", "1", "gt", "lt")
+	expectReply(t, c, "-ERR Unsupported option foo\r\n", "expire", "k", "1", "foo")
+	expectReply(t, c, "-ERR invalid expire time in 'expire' command\r\n", "expire", "k", "9223372036854775807")
+
+	at := GetMsTime() + 100000
+	expectReply(t, c, ":1\r\n", "pexpireat", "k", strconv.FormatInt(at, 10))
+	expectReply(t, c, ":"+strconv.FormatInt(at, 10)+"\r\n", "pexpiretime", "k")
+	expectReply(t, c, ":"+strconv.FormatInt((at+500)/1000, 10)+"\r\n", "expiretime", "k")
+	expectReply(t, c, ":1\r\n", "persist", "k")
+	expectReply(t, c, ":0\r\n", "persist", "k")
+	expectReply(t, c, ":-1\r\n", "pexpiretime", "k")
+
+	// 覆盖写入会清除过期时间
+	c.run("expire", "k", "100")
+	c.run("set", "k", "v2")
+	expectReply(t, c, ":-1\r\n", "ttl", "k")
+
+	// 过去的时间直接删除 key
+	expectReply(t, c, ":1\r\n", "expireat", "k", "1")
+	expectReply(t, c, ":0\r\n", "exists", "k")
+	c.run("set", "k", "v")
+	expectReply(t, c, ":1\r\n", "pexpire", "k", "-1")
+	expectReply(t, c, ":-2\r\n", "pttl", "k")
+	if c.db.expire.Len() != 0 {
+		t.Errorf("expire dict has %d entries", c.db.expire.Len())
+	}
+}
+
+func TestActiveExpireCycle(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	for i := 0; i < 1000; i++ {
+		key := "k" + strconv.Itoa(i)
+		c.run("set", key, "v")
+		c.run("pexpire", key, "1")
+	}
+	c.run("set", "persistent", "v")
+	c.run("set", "volatile", "v", "ex", "100")
+	time.Sleep(5 * time.Millisecond)
+
+	// 过期比例低并且上次没有超时 FAST 直接返回
+	timelimitExit = false
+	server.statExpiredStalePerc = 0
+	activeExpireCycle(ACTIVE_EXPIRE_CYCLE_FAST)
+	if n := c.db.expire.Len(); n != 1001 {
+		t.Fatalf("fast cycle should be skipped, %d expires left", n)
+	}
+
+	expired := server.statExpiredKeys
+	activeExpireCycle(ACTIVE_EXPIRE_CYCLE_SLOW)
+	if n := c.db.expire.Len(); n != 1 {
+		t.Errorf("%d expires left after slow cycle", n)
+	}
+	if server.statExpiredKeys-expired != 1000 {
+		t.Errorf("expired_keys = %d", server.statExpiredKeys-expired)
+	}
+	if server.statExpiredStalePerc <= 0 {
+		t.Error("expired_stale_perc should be updated")
+	}
+	expectReply(t, c, ":2\r\n", "dbsize")
+	if info := c.run("info", "stats"); !strings.Contains(info, "expired_keys:") {
+		t.Errorf("info stats: %q", info)
+	}
+}
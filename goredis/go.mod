@@ -1,5 +1,5 @@
 module goredis
 
-go 1.20
+go 1.23.0
 
 require golang.org/x/sys v0.33.0
@@ -5,10 +5,11 @@ import (
 	"fmt"
 	"hash/fnv"
 	"log"
+	"net"
 	"os"
 	"strconv"
 	"strings"
-	"time"
+	"sync/atomic"
 
 	"golang.org/x/sys/unix"
 )
@@ -23,28 +24,197 @@ const (
 	COMMAND_BULK    CmdType = 0x02 // 多条指令、结构化格式
 )
 
+const GODIS_VERSION = "7.0.0"
+
 const (
 	// 都是客户端发送来的一次完整命令的最大长度限制
-	GODIS_IO_BUF     = 1024 * 16 // I/O 缓冲区大小（16KB）
-	GODIS_MAX_BULK   = 1024 * 4  // 最大 Bulk（结构化）命令个数 最多支持 4K 个参数的结构化命令
-	GODIS_MAX_INLINE = 1024 * 4  // 最大 Inline 命令长度 单条 inline 文本命令最大长度为 4KB
+	GODIS_IO_BUF        = 1024 * 16   // I/O 缓冲区大小（16KB）
+	GODIS_MAX_INLINE    = 1024 * 4    // 最大 Inline 命令长度 单条 inline 文本命令最大长度为 4KB
+	PROTO_MBULK_BIG_ARG = 1024 * 32   // 超过这个长度的参数一次性预留读取的空间
+	PROTO_MAX_MULTIBULK = 1024 * 1024 // 一条命令最多的参数个数
+	// 还没有认证的客户端只能发送很小的命令 避免不知道密码也能占用大量内存
+	PROTO_UNAUTH_MULTIBULK = 10
+	PROTO_UNAUTH_BULK      = 1024 * 16
 )
 
 type GodisDB struct {
-	data   *Dict
-	expire *Dict
+	id            int
+	data          *Dict
+	expire        *Dict
+	blockingKeys  map[string][]*GodisClient // 阻塞在 key 上的客户端 按阻塞先后排列
+	watchedKeys   map[string][]*GodisClient // WATCH 这个 key 的客户端
+	expiresCursor uint64                    // 主动过期下一次从 expire 的哪个槽位开始
+	avgTTL        int64                     // 主动过期采样得到的平均 TTL（毫秒）
+	usedMemory    int64                     // key 和 val 对象估算占用的内存
 }
 
 type GodisServer struct {
-	fd      int
-	port    int
-	db      *GodisDB
-	clients map[int]*GodisClient // 维护的客户端列表
-	aeLoop  *AeLoop
+	fd              int
+	port            int
+	bind            string
+	hz              int // ServerCron 每秒执行的次数
+	maxclients      int
+	maxidletime     int   // 客户端空闲超时（秒）
+	protoMaxBulkLen int64 // 单个参数的最大长度
+	verbosity       int   // 日志级别
+	dbs             []*GodisDB
+	clients         map[int]*GodisClient // 维护的客户端列表
+	nextClientId    int64
+	dirty           int64 // 上次持久化之后的修改次数
+	commands        map[string]*GodisCommand
+	aeLoop          *AeLoop
+	// 阻塞命令
+	blockedClients   int
+	readyKeys        []readyKey     // 本轮命令中被写入的阻塞 key
+	unblockedClients []*GodisClient // 已唤醒 等待继续处理输入缓冲区
+	statStartTime    int64          // 启动时间（毫秒）
+	// 客户端管理
+	clientPauseType    int
+	clientPauseEndTime int64          // CLIENT PAUSE 结束的时间（毫秒）
+	postponedClients   []*GodisClient // 暂停期间被推迟的客户端
+	statRejectedConn   int64          // 超过 maxclients 被拒绝的连接数
+	// ACL
+	aclUsers     map[string]*aclUser // 用户名 -> 用户
+	defaultUser  *aclUser
+	aclFilename  string         // ACL LOAD / ACL SAVE 使用的文件 为空表示没有配置
+	aclLog       []*aclLogEntry // 最新的在前面
+	acllogMaxLen int
+	// 主动过期
+	activeExpireEffort             int
+	statExpiredKeys                int64
+	statExpiredStalePerc           float64 // 采样中已过期 key 的比例（平滑后）
+	statExpiredTimeCapReachedCount int64   // 因为超出时间预算提前退出的次数
+	statExpireCycleTimeUsed        int64   // 累计耗时（微秒）
+	// RDB 持久化
+	rdbFilename        string
+	saveparams         []SaveParam
+	lastsave           int64 // 上次成功保存的时间（秒）
+	lastbgsaveTry      int64 // 上次尝试 BGSAVE 的时间（秒）
+	lastbgsaveStatus   bool
+	rdbChildRunning    bool       // BGSAVE 是否正在进行
+	rdbChildDone       chan error // 后台写文件的结果
+	rdbSnapshot        *snapshot  // 正在生成的快照
+	rdbBgsaveScheduled bool       // BGSAVE SCHEDULE 等待当前的保存结束
+	rdbSaveTimeStart   int64      // BGSAVE 开始时间（毫秒）
+	dirtyBeforeBgsave  int64      // BGSAVE 开始时的 dirty
+	// AOF 持久化
+	loading                bool // 正在加载 AOF 此时不传播命令
+	aofState               int
+	aofFsync               int
+	aofFilename            string
+	aofLoadTruncated       bool
+	aofFile                *os.File
+	aofBuf                 []byte // 等待在 beforeSleep 中写入的命令
+	aofSelectedDb          int    // AOF 中最后一条 SELECT 的数据库
+	aofCurrentSize         int64
+	aofLastFsync           int64 // 毫秒
+	aofFsyncPending        bool  // 有写入的数据还没有 fsync
+	aofFsyncInProgress     atomic.Bool
+	aofLastWriteStatus     bool
+	aofChildRunning        bool // BGREWRITEAOF 是否正在进行
+	aofChildDone           chan error
+	aofSnapshot            *snapshot // 正在生成的重写内容
+	aofRewriteBuf          []byte    // 重写期间产生的命令
+	aofRewriteTimeStart    int64
+	aofLastBgrewriteStatus bool
+	// 事务
+	inExec              bool // 正在执行 EXEC
+	execMultiPropagated bool // 本次 EXEC 已经传播了 MULTI
+	// 发布订阅
+	pubsubChannels map[string][]*GodisClient // 频道 -> 订阅的客户端
+	pubsubPatterns map[string][]*GodisClient // 模式 -> 订阅的客户端
+	// 键空间通知
+	notifyKeyspaceEvents int
+	// Lua 脚本
+	lua                *luaState
+	luaScripts         map[string]*luaScript // SHA1 -> 脚本
+	luaClient          *GodisClient          // 执行脚本中命令的伪客户端
+	luaCaller          *GodisClient          // 正在执行脚本的客户端 没有脚本在执行时为 nil
+	luaTimeLimit       int64                 // 毫秒
+	luaTimeStart       int64
+	luaTimedOut        bool // 脚本执行超过了 luaTimeLimit
+	luaKill            bool // 收到了 SCRIPT KILL
+	luaWriteDirty      bool // 脚本已经执行过写命令 不能再被 SCRIPT KILL
+	luaCallerProtected bool
+	// 内存淘汰
+	lruclock         uint32 // LRU 时钟 由 ServerCron 更新
+	maxmemory        int64  // 0 表示不限制
+	maxmemoryPolicy  int
+	maxmemorySamples int
+	lfuLogFactor     int
+	lfuDecayTime     int // 分钟
+	statEvictedKeys  int64
+	// 主从复制 主节点和副本共用复制 ID 偏移和积压缓冲区
+	replid              string // 当前的复制 ID
+	replid2             string // 上一个主节点的复制 ID
+	masterReplOffset    int64  // 复制流的字节数
+	secondReplidOffset  int64  // replid2 可以接受的最大偏移
+	replBacklog         []byte // 积压缓冲区 环形
+	replBacklogSize     int64
+	replBacklogIdx      int64 // 下一个写入位置
+	replBacklogHistlen  int64 // 有效数据长度
+	replBacklogOff      int64 // 第一个有效字节的复制偏移
+	slaves              []*GodisClient
+	slaveseldb          int // 复制流中最后一条 SELECT 的数据库 -1 表示下一条命令前需要 SELECT
+	replTimeout         int64
+	replPingSlavePeriod int64
+	statSyncFull        int64
+	statSyncPartialOk   int64
+	statSyncPartialErr  int64
+	// 副本
+	masterhost          string // 为空表示主节点
+	masterport          int
+	master              *GodisClient // 同步完成之后到主节点的连接
+	replState           int
+	replSlaveRo         bool
+	masterauth          string // 主节点要求认证时使用的密码
+	masteruser          string // 为空时使用 default 用户
+	replTransferS       int    // 握手和接收快照期间到主节点的连接
+	replTransferBuf     []byte // 握手和快照阶段读到的数据
+	replTransferSize    int64  // 快照长度 -1 表示还没有读到
+	replTransferLastio  int64  // 秒
+	replDownSince       int64  // 秒
+	replStreamDb        int    // 断开时复制流选择的数据库 部分重同步后继续使用
+	masterInitialReplid string
+	masterInitialOffset int64
+	currentClient       *GodisClient // 正在执行命令的客户端
+	cronloops           int64
+	// 集群
+	clusterEnabled             bool
+	clusterConfigfile          string
+	clusterNodeTimeout         int64 // 毫秒
+	clusterPort                int   // 0 表示 port + 10000
+	clusterRequireFullCoverage bool
+	cluster                    *clusterState
 }
 
+// 客户端状态标记
+const (
+	CLIENT_CLOSE_AFTER_REPLY  = 1 << 0  // 回复发送完毕后关闭连接（QUIT）
+	CLIENT_BLOCKED            = 1 << 1  // 阻塞在 BLPOP 等命令上
+	CLIENT_MULTI              = 1 << 2  // 处于 MULTI 中 命令进入队列
+	CLIENT_DIRTY_CAS          = 1 << 3  // WATCH 的 key 被修改 EXEC 会失败
+	CLIENT_DIRTY_EXEC         = 1 << 4  // 排队时出错 EXEC 会失败
+	CLIENT_DENY_BLOCKING      = 1 << 5  // 不允许阻塞 阻塞命令直接按超时返回
+	CLIENT_PUBSUB             = 1 << 6  // 订阅模式 RESP2 下只能执行订阅相关命令
+	CLIENT_PREVENT_PROP       = 1 << 7  // 当前命令不传播（EVAL 中的命令已经各自传播）
+	CLIENT_SLAVE              = 1 << 8  // 连接到这里的副本
+	CLIENT_MASTER             = 1 << 9  // 副本到主节点的连接 执行复制流中的命令
+	CLIENT_MASTER_FORCE_REPLY = 1 << 10 // 主节点的连接默认不回复 发送 ACK 时临时设置
+	CLIENT_ASKING             = 1 << 11 // 下一条命令可以访问正在导入的槽位
+	CLIENT_NO_EVICT           = 1 << 12 // CLIENT NO-EVICT on
+	CLIENT_PRE_PSYNC          = 1 << 13 // 用 SYNC 发起复制的旧版本副本 不发送 +FULLRESYNC
+)
+
 type GodisClient struct {
+	id       int64
 	fd       int
+	flags    int
+	resp     int      // 协议版本 2 或 3 由 HELLO 协商
+	name     string   // CLIENT SETNAME / HELLO SETNAME
+	addr     string   // 对端地址 ip:port
+	laddr    string   // 本地地址 ip:port
+	ctime    int64    // 连接建立的时间（毫秒）
 	db       *GodisDB // 指向 GodisServer 中的数据库实例
 	args     []*Gobj  // 当前解析出的命令参数（比如 SET key value 拆成三项）
 	reply    *List    // 回复缓冲区，等待发送给客户端的数据列表
@@ -53,100 +223,440 @@ type GodisClient struct {
 	queryLen int      // 当前缓冲区有效数据长度
 	cmdTy    CmdType  // 当前客户端请求的命令类型（inline / bulk）
 	bulkNum  int      // bulk 模式下预期参数数量
-	bulkLen  int      // bulk 模式下当前读取的参数长度
+	bulkLen  int      // bulk 模式下当前读取的参数长度 -1 表示还没有读到 $ 行
+	bstate   blockingState
+	// 事务
+	mstate      multiState
+	watchedKeys []watchedKey
+	// 订阅的频道和模式 按订阅先后排列
+	pubsubChannels  []string
+	pubsubPatterns  []string
+	lastinteraction int64         // 最后一次读写的时间（秒）
+	lastcmd         *GodisCommand // 最近一次执行的命令
+	// ACL
+	user          *aclUser // nil 表示不受限制 比如 AOF 和主节点的伪客户端
+	authenticated bool
+	// 主从复制
+	slaveListeningPort int      // 副本上报的监听端口
+	replAckOff         int64    // 副本最后确认的复制偏移
+	replAckTime        int64    // 副本最后一次 ACK 的时间（秒）
+	slaveReplState     int      // 副本的同步状态 SLAVE_STATE_*
+	psyncInitialOffset int64    // 全量同步的快照对应的复制偏移
+	replDbFile         *os.File // 正在发送给副本的快照文件
+	replDbOff          int64    // 快照文件已经发送的字节数
+	replDbSize         int64    // 快照文件的大小
+	replPreamble       string   // 快照之前的 $<len>\r\n 还没有发送的部分
+	readReploff        int64    // 从主节点读到的复制流的偏移
+	reploff            int64    // 已经执行的复制流的偏移
+	pendingQuery       []byte   // 已经读到但还没有执行完的复制流 执行后写入积压缓冲区
 }
 
 // 定义命令和处理函数的映射关系
+// arity 为负数时表示参数个数至少为 -arity（包含命令名本身）
+// sflags 是命令标记的字符串形式 启动时解析到 flags 中
+//
+//	w: 写命令 r: 只读命令 m: 可能增加内存 超过 maxmemory 时拒绝
+//	a: 管理命令 p: 发布订阅相关 s: 脚本中不能调用 F: 时间复杂度 O(1) 或 O(log(N))
+//	k: 集群模式下即使没有 ASKING 也接受正在导入的槽位中的 key N: 不需要认证就可以执行
+//
+// categories 是命令所属的 ACL 类别 比如 "@string @blocking"
+// @read @write @admin @dangerous @pubsub @fast @slow 由 sflags 推导 不需要写出来
+// firstkey lastkey keystep 描述参数中 key 的位置 lastkey 为负数时从末尾倒数
+// key 的位置不固定的命令由 getkeysProc 返回
 type CommandProc func(c *GodisClient)
+type GetKeysProc func(args []*Gobj) []int
 type GodisCommand struct {
-	name  string
-	proc  CommandProc
-	arity int
+	name        string
+	proc        CommandProc
+	arity       int
+	sflags      string
+	categories  string
+	flags       int // 包括 sflags 和 categories 解析出的标记
+	getkeysProc GetKeysProc
+	firstkey    int
+	lastkey     int
+	keystep     int
 }
 
+const (
+	CMD_WRITE    = 1 << 0
+	CMD_READONLY = 1 << 1
+	CMD_DENYOOM  = 1 << 2
+	CMD_ADMIN    = 1 << 3
+	CMD_PUBSUB   = 1 << 4
+	CMD_NOSCRIPT = 1 << 5
+	CMD_FAST     = 1 << 6
+	CMD_ASKING   = 1 << 7
+	CMD_NO_AUTH  = 1 << 8
+	// ACL 类别
+	CMD_CATEGORY_KEYSPACE    = 1 << 9
+	CMD_CATEGORY_READ        = 1 << 10
+	CMD_CATEGORY_WRITE       = 1 << 11
+	CMD_CATEGORY_SET         = 1 << 12
+	CMD_CATEGORY_SORTEDSET   = 1 << 13
+	CMD_CATEGORY_LIST        = 1 << 14
+	CMD_CATEGORY_HASH        = 1 << 15
+	CMD_CATEGORY_STRING      = 1 << 16
+	CMD_CATEGORY_PUBSUB      = 1 << 17
+	CMD_CATEGORY_ADMIN       = 1 << 18
+	CMD_CATEGORY_FAST        = 1 << 19
+	CMD_CATEGORY_SLOW        = 1 << 20
+	CMD_CATEGORY_BLOCKING    = 1 << 21
+	CMD_CATEGORY_DANGEROUS   = 1 << 22
+	CMD_CATEGORY_CONNECTION  = 1 << 23
+	CMD_CATEGORY_TRANSACTION = 1 << 24
+	CMD_CATEGORY_SCRIPTING   = 1 << 25
+)
+
 var server GodisServer
 var cmdTable []GodisCommand = []GodisCommand{
-	{"get", getCommand, 2},
-	{"set", setCommand, 3},
-	{"expire", expireCommand, 3},
+	{"get", getCommand, 2, "rF", "@string", 0, nil, 1, 1, 1},
+	{"set", setCommand, -3, "wm", "@string", 0, nil, 1, 1, 1},
+	{"setnx", setnxCommand, 3, "wmF", "@string", 0, nil, 1, 1, 1},
+	{"setex", setexCommand, 4, "wm", "@string", 0, nil, 1, 1, 1},
+	{"psetex", psetexCommand, 4, "wm", "@string", 0, nil, 1, 1, 1},
+	{"getset", getsetCommand, 3, "wm", "@string", 0, nil, 1, 1, 1},
+	{"getdel", getdelCommand, 2, "wF", "@string", 0, nil, 1, 1, 1},
+	{"getex", getexCommand, -2, "wF", "@string", 0, nil, 1, 1, 1},
+	{"mget", mgetCommand, -2, "rF", "@string", 0, nil, 1, -1, 1},
+	{"mset", msetCommand, -3, "wm", "@string", 0, nil, 1, -1, 2},
+	{"msetnx", msetnxCommand, -3, "wm", "@string", 0, nil, 1, -1, 2},
+	{"append", appendCommand, 3, "wm", "@string", 0, nil, 1, 1, 1},
+	{"strlen", strlenCommand, 2, "rF", "@string", 0, nil, 1, 1, 1},
+	{"getrange", getrangeCommand, 4, "r", "@string", 0, nil, 1, 1, 1},
+	{"substr", getrangeCommand, 4, "r", "@string", 0, nil, 1, 1, 1},
+	{"setrange", setrangeCommand, 4, "wm", "@string", 0, nil, 1, 1, 1},
+	{"incr", incrCommand, 2, "wmF", "@string", 0, nil, 1, 1, 1},
+	{"decr", decrCommand, 2, "wmF", "@string", 0, nil, 1, 1, 1},
+	{"incrby", incrbyCommand, 3, "wmF", "@string", 0, nil, 1, 1, 1},
+	{"decrby", decrbyCommand, 3, "wmF", "@string", 0, nil, 1, 1, 1},
+	{"incrbyfloat", incrbyfloatCommand, 3, "wmF", "@string", 0, nil, 1, 1, 1},
+	{"lcs", lcsCommand, -3, "r", "@string", 0, nil, 1, 2, 1},
+	{"expire", expireCommand, -3, "wF", "@keyspace", 0, nil, 1, 1, 1},
+	{"pexpire", pexpireCommand, -3, "wF", "@keyspace", 0, nil, 1, 1, 1},
+	{"expireat", expireatCommand, -3, "wF", "@keyspace", 0, nil, 1, 1, 1},
+	{"pexpireat", pexpireatCommand, -3, "wF", "@keyspace", 0, nil, 1, 1, 1},
+	{"ttl", ttlCommand, 2, "rF", "@keyspace", 0, nil, 1, 1, 1},
+	{"pttl", pttlCommand, 2, "rF", "@keyspace", 0, nil, 1, 1, 1},
+	{"expiretime", expiretimeCommand, 2, "rF", "@keyspace", 0, nil, 1, 1, 1},
+	{"pexpiretime", pexpiretimeCommand, 2, "rF", "@keyspace", 0, nil, 1, 1, 1},
+	{"persist", persistCommand, 2, "wF", "@keyspace", 0, nil, 1, 1, 1},
+	{"del", delCommand, -2, "w", "@keyspace", 0, nil, 1, -1, 1},
+	{"unlink", delCommand, -2, "wF", "@keyspace", 0, nil, 1, -1, 1},
+	{"exists", existsCommand, -2, "rF", "@keyspace", 0, nil, 1, -1, 1},
+	{"touch", touchCommand, -2, "rF", "@keyspace", 0, nil, 1, -1, 1},
+	{"type", typeCommand, 2, "rF", "@keyspace", 0, nil, 1, 1, 1},
+	{"rename", renameCommand, 3, "w", "@keyspace", 0, nil, 1, 2, 1},
+	{"renamenx", renamenxCommand, 3, "wF", "@keyspace", 0, nil, 1, 2, 1},
+	{"keys", keysCommand, 2, "r", "@keyspace @dangerous", 0, nil, 0, 0, 0},
+	{"randomkey", randomkeyCommand, 1, "r", "@keyspace", 0, nil, 0, 0, 0},
+	{"dbsize", dbsizeCommand, 1, "rF", "@keyspace", 0, nil, 0, 0, 0},
+	{"select", selectCommand, 2, "F", "@connection", 0, nil, 0, 0, 0},
+	{"move", moveCommand, 3, "wF", "@keyspace", 0, nil, 1, 1, 1},
+	{"swapdb", swapdbCommand, 3, "wF", "@keyspace @dangerous", 0, nil, 0, 0, 0},
+	{"flushdb", flushdbCommand, -1, "w", "@keyspace @dangerous", 0, nil, 0, 0, 0},
+	{"flushall", flushallCommand, -1, "w", "@keyspace @dangerous", 0, nil, 0, 0, 0},
+	{"copy", copyCommand, -3, "wm", "@keyspace", 0, nil, 1, 2, 1},
+	{"scan", scanCommand, -2, "r", "@keyspace", 0, nil, 0, 0, 0},
+	{"hscan", hscanCommand, -3, "r", "@hash", 0, nil, 1, 1, 1},
+	{"sscan", sscanCommand, -3, "r", "@set", 0, nil, 1, 1, 1},
+	{"zscan", zscanCommand, -3, "r", "@sortedset", 0, nil, 1, 1, 1},
+	{"save", saveCommand, 1, "as", "", 0, nil, 0, 0, 0},
+	{"bgsave", bgsaveCommand, -1, "a", "", 0, nil, 0, 0, 0},
+	{"lastsave", lastsaveCommand, 1, "F", "@admin @dangerous", 0, nil, 0, 0, 0},
+	{"bgrewriteaof", bgrewriteaofCommand, 1, "a", "", 0, nil, 0, 0, 0},
+	{"multi", multiCommand, 1, "sF", "@transaction", 0, nil, 0, 0, 0},
+	{"exec", execCommand, 1, "s", "@transaction", 0, nil, 0, 0, 0},
+	{"discard", discardCommand, 1, "sF", "@transaction", 0, nil, 0, 0, 0},
+	{"watch", watchCommand, -2, "sF", "@transaction", 0, nil, 1, -1, 1},
+	{"unwatch", unwatchCommand, 1, "sF", "@transaction", 0, nil, 0, 0, 0},
+	{"subscribe", subscribeCommand, -2, "ps", "", 0, nil, 0, 0, 0},
+	{"unsubscribe", unsubscribeCommand, -1, "ps", "", 0, nil, 0, 0, 0},
+	{"psubscribe", psubscribeCommand, -2, "ps", "", 0, nil, 0, 0, 0},
+	{"punsubscribe", punsubscribeCommand, -1, "ps", "", 0, nil, 0, 0, 0},
+	{"publish", publishCommand, 3, "pF", "", 0, nil, 0, 0, 0},
+	{"pubsub", pubsubCommand, -2, "pr", "", 0, nil, 0, 0, 0},
+	{"eval", evalCommand, -3, "s", "@scripting", 0, evalGetKeys, 0, 0, 0},
+	{"evalsha", evalshaCommand, -3, "s", "@scripting", 0, evalGetKeys, 0, 0, 0},
+	{"script", scriptCommand, -2, "s", "@scripting", 0, nil, 0, 0, 0},
+	{"memory", memoryCommand, -2, "r", "", 0, memoryGetKeys, 0, 0, 0},
+	{"sync", syncCommand, 1, "as", "", 0, nil, 0, 0, 0},
+	{"psync", syncCommand, 3, "as", "", 0, nil, 0, 0, 0},
+	{"replconf", replconfCommand, -1, "as", "", 0, nil, 0, 0, 0},
+	{"replicaof", replicaofCommand, 3, "as", "", 0, nil, 0, 0, 0},
+	{"slaveof", replicaofCommand, 3, "as", "", 0, nil, 0, 0, 0},
+	{"cluster", clusterCommand, -2, "a", "", 0, nil, 0, 0, 0},
+	{"asking", askingCommand, 1, "F", "@connection", 0, nil, 0, 0, 0},
+	{"dump", dumpCommand, 2, "r", "@keyspace", 0, nil, 1, 1, 1},
+	{"restore", restoreCommand, -4, "wm", "@keyspace @dangerous", 0, nil, 1, 1, 1},
+	{"restore-asking", restoreCommand, -4, "wmk", "@keyspace @dangerous", 0, nil, 1, 1, 1},
+	{"migrate", migrateCommand, -6, "w", "@keyspace @dangerous", 0, migrateGetKeys, 0, 0, 0},
+	{"ping", pingCommand, -1, "F", "@connection", 0, nil, 0, 0, 0},
+	{"info", infoCommand, -1, "", "@dangerous", 0, nil, 0, 0, 0},
+	{"echo", echoCommand, 2, "F", "@connection", 0, nil, 0, 0, 0},
+	{"hello", helloCommand, -1, "sFN", "@connection", 0, nil, 0, 0, 0},
+	{"client", clientCommand, -2, "as", "@connection", 0, nil, 0, 0, 0},
+	{"auth", authCommand, -2, "sFN", "@connection", 0, nil, 0, 0, 0},
+	{"acl", aclCommand, -2, "as", "", 0, nil, 0, 0, 0},
+	// list
+	{"lpush", lpushCommand, -3, "wmF", "@list", 0, nil, 1, 1, 1},
+	{"rpush", rpushCommand, -3, "wmF", "@list", 0, nil, 1, 1, 1},
+	{"lpushx", lpushxCommand, -3, "wmF", "@list", 0, nil, 1, 1, 1},
+	{"rpushx", rpushxCommand, -3, "wmF", "@list", 0, nil, 1, 1, 1},
+	{"lpop", lpopCommand, -2, "wF", "@list", 0, nil, 1, 1, 1},
+	{"rpop", rpopCommand, -2, "wF", "@list", 0, nil, 1, 1, 1},
+	{"llen", llenCommand, 2, "rF", "@list", 0, nil, 1, 1, 1},
+	{"lindex", lindexCommand, 3, "r", "@list", 0, nil, 1, 1, 1},
+	{"lset", lsetCommand, 4, "wm", "@list", 0, nil, 1, 1, 1},
+	{"lrange", lrangeCommand, 4, "r", "@list", 0, nil, 1, 1, 1},
+	{"lrem", lremCommand, 4, "w", "@list", 0, nil, 1, 1, 1},
+	{"ltrim", ltrimCommand, 4, "w", "@list", 0, nil, 1, 1, 1},
+	{"linsert", linsertCommand, 5, "wm", "@list", 0, nil, 1, 1, 1},
+	{"lpos", lposCommand, -3, "r", "@list", 0, nil, 1, 1, 1},
+	{"lmove", lmoveCommand, 5, "wm", "@list", 0, nil, 1, 2, 1},
+	{"rpoplpush", rpoplpushCommand, 3, "wm", "@list", 0, nil, 1, 2, 1},
+	{"blpop", blpopCommand, -3, "w", "@list @blocking", 0, nil, 1, -2, 1},
+	{"brpop", brpopCommand, -3, "w", "@list @blocking", 0, nil, 1, -2, 1},
+	{"blmove", blmoveCommand, 6, "wm", "@list @blocking", 0, nil, 1, 2, 1},
+	{"brpoplpush", brpoplpushCommand, 4, "wm", "@list @blocking", 0, nil, 1, 2, 1},
+	// hash
+	{"hset", hsetCommand, -4, "wmF", "@hash", 0, nil, 1, 1, 1},
+	{"hmset", hsetCommand, -4, "wmF", "@hash", 0, nil, 1, 1, 1},
+	{"hsetnx", hsetnxCommand, 4, "wmF", "@hash", 0, nil, 1, 1, 1},
+	{"hget", hgetCommand, 3, "rF", "@hash", 0, nil, 1, 1, 1},
+	{"hmget", hmgetCommand, -3, "rF", "@hash", 0, nil, 1, 1, 1},
+	{"hdel", hdelCommand, -3, "wF", "@hash", 0, nil, 1, 1, 1},
+	{"hexists", hexistsCommand, 3, "rF", "@hash", 0, nil, 1, 1, 1},
+	{"hlen", hlenCommand, 2, "rF", "@hash", 0, nil, 1, 1, 1},
+	{"hstrlen", hstrlenCommand, 3, "rF", "@hash", 0, nil, 1, 1, 1},
+	{"hkeys", hkeysCommand, 2, "r", "@hash", 0, nil, 1, 1, 1},
+	{"hvals", hvalsCommand, 2, "r", "@hash", 0, nil, 1, 1, 1},
+	{"hgetall", hgetallCommand, 2, "r", "@hash", 0, nil, 1, 1, 1},
+	{"hincrby", hincrbyCommand, 4, "wmF", "@hash", 0, nil, 1, 1, 1},
+	{"hincrbyfloat", hincrbyfloatCommand, 4, "wmF", "@hash", 0, nil, 1, 1, 1},
+	{"hrandfield", hrandfieldCommand, -2, "r", "@hash", 0, nil, 1, 1, 1},
+	// set
+	{"sadd", saddCommand, -3, "wmF", "@set", 0, nil, 1, 1, 1},
+	{"srem", sremCommand, -3, "wF", "@set", 0, nil, 1, 1, 1},
+	{"sismember", sismemberCommand, 3, "rF", "@set", 0, nil, 1, 1, 1},
+	{"smismember", smismemberCommand, -3, "rF", "@set", 0, nil, 1, 1, 1},
+	{"scard", scardCommand, 2, "rF", "@set", 0, nil, 1, 1, 1},
+	{"smembers", smembersCommand, 2, "r", "@set", 0, nil, 1, 1, 1},
+	{"srandmember", srandmemberCommand, -2, "r", "@set", 0, nil, 1, 1, 1},
+	{"spop", spopCommand, -2, "wF", "@set", 0, nil, 1, 1, 1},
+	{"smove", smoveCommand, 4, "wF", "@set", 0, nil, 1, 2, 1},
+	{"sinter", sinterCommand, -2, "r", "@set", 0, nil, 1, -1, 1},
+	{"sinterstore", sinterstoreCommand, -3, "wm", "@set", 0, nil, 1, -1, 1},
+	{"sunion", sunionCommand, -2, "r", "@set", 0, nil, 1, -1, 1},
+	{"sunionstore", sunionstoreCommand, -3, "wm", "@set", 0, nil, 1, -1, 1},
+	{"sdiff", sdiffCommand, -2, "r", "@set", 0, nil, 1, -1, 1},
+	{"sdiffstore", sdiffstoreCommand, -3, "wm", "@set", 0, nil, 1, -1, 1},
+	// sorted set
+	{"zadd", zaddCommand, -4, "wmF", "@sortedset", 0, nil, 1, 1, 1},
+	{"zincrby", zincrbyCommand, 4, "wmF", "@sortedset", 0, nil, 1, 1, 1},
+	{"zrem", zremCommand, -3, "wF", "@sortedset", 0, nil, 1, 1, 1},
+	{"zscore", zscoreCommand, 3, "rF", "@sortedset", 0, nil, 1, 1, 1},
+	{"zmscore", zmscoreCommand, -3, "rF", "@sortedset", 0, nil, 1, 1, 1},
+	{"zcard", zcardCommand, 2, "rF", "@sortedset", 0, nil, 1, 1, 1},
+	{"zcount", zcountCommand, 4, "rF", "@sortedset", 0, nil, 1, 1, 1},
+	{"zrank", zrankCommand, -3, "rF", "@sortedset", 0, nil, 1, 1, 1},
+	{"zrevrank", zrevrankCommand, -3, "rF", "@sortedset", 0, nil, 1, 1, 1},
+	{"zrange", zrangeCommand, -4, "r", "@sortedset", 0, nil, 1, 1, 1},
+	{"zrevrange", zrevrangeCommand, -4, "r", "@sortedset", 0, nil, 1, 1, 1},
+	{"zrangebyscore", zrangebyscoreCommand, -4, "r", "@sortedset", 0, nil, 1, 1, 1},
+	{"zrevrangebyscore", zrevrangebyscoreCommand, -4, "r", "@sortedset", 0, nil, 1, 1, 1},
+	{"zrangebylex", zrangebylexCommand, -4, "r", "@sortedset", 0, nil, 1, 1, 1},
+	{"zrevrangebylex", zrevrangebylexCommand, -4, "r", "@sortedset", 0, nil, 1, 1, 1},
+	{"zremrangebyrank", zremrangebyrankCommand, 4, "w", "@sortedset", 0, nil, 1, 1, 1},
+	{"zremrangebyscore", zremrangebyscoreCommand, 4, "w", "@sortedset", 0, nil, 1, 1, 1},
+	{"zremrangebylex", zremrangebylexCommand, 4, "w", "@sortedset", 0, nil, 1, 1, 1},
+	{"zpopmin", zpopminCommand, -2, "wF", "@sortedset", 0, nil, 1, 1, 1},
+	{"zpopmax", zpopmaxCommand, -2, "wF", "@sortedset", 0, nil, 1, 1, 1},
+	{"bzpopmin", bzpopminCommand, -3, "wF", "@sortedset @blocking", 0, nil, 1, -2, 1},
+	{"bzpopmax", bzpopmaxCommand, -3, "wF", "@sortedset @blocking", 0, nil, 1, -2, 1},
+	{"zunionstore", zunionstoreCommand, -4, "wm", "@sortedset", 0, zunionInterGetKeys, 0, 0, 0},
+	{"zinterstore", zinterstoreCommand, -4, "wm", "@sortedset", 0, zunionInterGetKeys, 0, 0, 0},
 	//TODO
 }
 
-func expireIfNeeded(key *Gobj) {
-	entry := server.db.expire.Find(key)
-	if entry == nil {
+func pingCommand(c *GodisClient) {
+	if len(c.args) > 2 {
+		c.AddReplyErrorFormat("wrong number of arguments for '%s' command", c.args[0].StrVal())
 		return
 	}
-	when := entry.Val.IntVal()
-	if when > GetMsTime() {
-		return
+	// 订阅模式下 RESP2 的回复必须是数组 客户端才能和消息区分
+	if c.flags&CLIENT_PUBSUB != 0 && c.resp == 2 {
+		c.AddReplyArrayLen(2)
+		c.AddReplyBulkStr("pong")
+		if len(c.args) == 1 {
+			c.AddReply(shared.emptybulk)
+		} else {
+			c.AddReplyBulk(c.args[1])
+		}
+	} else if len(c.args) == 1 {
+		c.AddReply(shared.pong)
+	} else {
+		c.AddReplyBulk(c.args[1])
 	}
-	server.db.expire.Delete(key)
-	server.db.data.Delete(key)
 }
 
-func findKeyRead(key *Gobj) *Gobj {
-	expireIfNeeded(key)
-	return server.db.data.Get(key)
+func echoCommand(c *GodisClient) {
+	c.AddReplyBulk(c.args[1])
 }
 
-func getCommand(c *GodisClient) {
-	key := c.args[1]
-	val := findKeyRead(key)
-	if val == nil {
-		//TODO: extract shared.strings
-		c.AddReplyStr("$-1\r\n")
-	} else if val.Type_ != GSTR {
-		//TODO: extract shared.strings
-		c.AddReplyStr("-ERR: wrong type\r\n")
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+func helloCommand(c *GodisClient) {
+	ver := c.resp
+	if len(c.args) >= 2 {
+		v, err := strconv.ParseInt(c.args[1].StrVal(), 10, 64)
+		if err != nil {
+			c.AddReplyError("Protocol version is not an integer or out of range")
+			return
+		}
+		if v < 2 || v > 3 {
+			c.AddReplyError("-NOPROTO unsupported protocol version")
+			return
+		}
+		ver = int(v)
+	}
+	var name string
+	setname := false
+	for i := 2; i < len(c.args); i++ {
+		more := len(c.args) - i - 1
+		opt := strings.ToLower(c.args[i].StrVal())
+		if opt == "auth" && more >= 2 {
+			if !aclAuthenticateUser(c, c.args[i+1].StrVal(), c.args[i+2].StrVal()) {
+				c.AddReplyError("-WRONGPASS invalid username-password pair or user is disabled.")
+				return
+			}
+			i += 2
+		} else if opt == "setname" && more >= 1 {
+			name = c.args[i+1].StrVal()
+			if !validateClientName(name) {
+				c.AddReplyError("Client names cannot contain spaces, newlines or special characters.")
+				return
+			}
+			setname = true
+			i++
+		} else {
+			c.AddReplyErrorFormat("Syntax error in HELLO option '%s'", c.args[i].StrVal())
+			return
+		}
+	}
+	// 没有认证时只能通过 AUTH 选项同时完成认证
+	if !c.authenticated {
+		c.AddReplyError("-NOAUTH HELLO must be called with the client already authenticated, " +
+			"otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate " +
+			"the client and select the RESP protocol version at the same time")
+		return
+	}
+	if setname {
+		c.name = name
+	}
+	// 协商成功之后的回复就使用新的协议版本
+	c.resp = ver
+	c.AddReplyMapLen(7)
+	c.AddReplyBulkStr("server")
+	c.AddReplyBulkStr("redis")
+	c.AddReplyBulkStr("version")
+	c.AddReplyBulkStr(GODIS_VERSION)
+	c.AddReplyBulkStr("proto")
+	c.AddReplyInt(int64(c.resp))
+	c.AddReplyBulkStr("id")
+	c.AddReplyInt(c.id)
+	c.AddReplyBulkStr("mode")
+	if server.clusterEnabled {
+		c.AddReplyBulkStr("cluster")
+	} else {
+		c.AddReplyBulkStr("standalone")
+	}
+	c.AddReplyBulkStr("role")
+	if server.masterhost == "" {
+		c.AddReplyBulkStr("master")
 	} else {
-		str := val.StrVal()
-		c.AddReplyStr(fmt.Sprintf("$%d%v\r\n", len(str), str))
+		c.AddReplyBulkStr("replica")
 	}
+	c.AddReplyBulkStr("modules")
+	c.AddReplyArrayLen(0)
 }
 
-func setCommand(c *GodisClient) {
-	key := c.args[1]
-	val := c.args[2]
-	if val.Type_ != GSTR {
-		//TODO: extract shared.strings
-		c.AddReplyStr("-ERR: wrong type\r\n")
+// 名字中不能包含空格 换行等特殊字符
+func validateClientName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] < '!' || name[i] > '~' {
+			return false
+		}
 	}
-	server.db.data.Set(key, val)
-	server.db.expire.Delete(key)
-	c.AddReplyStr("+OK\r\n")
+	return true
 }
 
-func expireCommand(c *GodisClient) {
-	key := c.args[1]
-	val := c.args[2]
-	if val.Type_ != GSTR {
-		//TODO: extract shared.strings
-		c.AddReplyStr("-ERR: wrong type\r\n")
+// 命令表在启动时转换成 map 便于查找
+func populateCommandTable() {
+	server.commands = make(map[string]*GodisCommand, len(cmdTable))
+	for i := range cmdTable {
+		cmd := &cmdTable[i]
+		cmd.flags = 0
+		for _, f := range cmd.sflags {
+			switch f {
+			case 'w':
+				cmd.flags |= CMD_WRITE
+			case 'r':
+				cmd.flags |= CMD_READONLY
+			case 'm':
+				cmd.flags |= CMD_DENYOOM
+			case 'a':
+				cmd.flags |= CMD_ADMIN
+			case 'p':
+				cmd.flags |= CMD_PUBSUB
+			case 's':
+				cmd.flags |= CMD_NOSCRIPT
+			case 'F':
+				cmd.flags |= CMD_FAST
+			case 'k':
+				cmd.flags |= CMD_ASKING
+			case 'N':
+				cmd.flags |= CMD_NO_AUTH
+			default:
+				panic("unsupported command flag " + string(f))
+			}
+		}
+		for _, name := range strings.Fields(cmd.categories) {
+			flag := aclGetCommandCategoryFlagByName(strings.TrimPrefix(name, "@"))
+			if flag == 0 || name[0] != '@' {
+				panic("unsupported command category " + name)
+			}
+			cmd.flags |= flag
+		}
+		setImplicitACLCategories(cmd)
+		server.commands[cmd.name] = cmd
 	}
-	// 计算 expire 时间
-	expire := GetMsTime() + (val.IntVal() * 1000)
-	// 使用 expire 作为 val 创建对象
-	expObj := CreateFromInt(expire)
-	// 将过期的 key 放入到 expire 数据库当中
-	server.db.expire.Set(key, expObj)
-	expObj.DecrRefCount()
-	c.AddReplyStr("+OK\r\n")
 }
 
 func lookupCommand(cmdStr string) *GodisCommand {
-	for _, c := range cmdTable {
-		if c.name == cmdStr {
-			return &c
-		}
+	return server.commands[cmdStr]
+}
+
+/*
+返回 false 时不添加回复
+主节点发来的命令不回复 否则回复会混进 REPLCONF ACK 中
+*/
+func (c *GodisClient) prepareClientToWrite() bool {
+	if c.flags&CLIENT_MASTER != 0 && c.flags&CLIENT_MASTER_FORCE_REPLY == 0 {
+		return false
 	}
-	return nil
+	// 加载 AOF 使用的伪客户端没有连接 副本在快照发送完之前只积累数据
+	if c.fd != -1 && (c.flags&CLIENT_SLAVE == 0 || c.slaveReplState == SLAVE_STATE_ONLINE) {
+		server.aeLoop.AddFileEvent(c.fd, AE_WRITABLE, SendReplyToClient, c)
+	}
+	return true
 }
 
 func (c *GodisClient) AddReply(o *Gobj) {
+	if !c.prepareClientToWrite() {
+		return
+	}
 	c.reply.Append(o)
 	o.IncrRefCount()
-	server.aeLoop.AddFileEvent(c.fd, AE_WRITABLE, SendReplyToClient, c)
 }
 
 func (c *GodisClient) AddReplyStr(str string) {
@@ -156,31 +666,168 @@ func (c *GodisClient) AddReplyStr(str string) {
 }
 
 func ProcessCommand(c *GodisClient) {
-	cmdStr := c.args[0].StrVal()
-	log.Printf("process command: %v\n", cmdStr)
+	// 命令名大小写不敏感
+	cmdStr := strings.ToLower(c.args[0].StrVal())
+	serverLog(LL_DEBUG, "process command: %v", cmdStr)
 	if cmdStr == "quit" {
-		freeClient(c)
+		// 回复 OK 之后再关闭连接
+		c.AddReply(shared.ok)
+		c.flags |= CLIENT_CLOSE_AFTER_REPLY
+		resetClient(c)
 		return
 	}
 	cmd := lookupCommand(cmdStr)
+	c.lastcmd = cmd
 	if cmd == nil {
-		c.AddReplyStr("-ERR: unknow command")
+		flagTransaction(c)
+		c.AddReplyErrorFormat("unknown command '%s', with args beginning with: %s",
+			c.args[0].StrVal(), formatArgs(c.args[1:]))
 		resetClient(c)
 		return
-	} else if cmd.arity != len(c.args) {
-		c.AddReplyStr("-ERR: wrong number of args")
+	} else if (cmd.arity > 0 && cmd.arity != len(c.args)) || len(c.args) < -cmd.arity {
+		flagTransaction(c)
+		c.AddReplyErrorFormat("wrong number of arguments for '%s' command", cmd.name)
 		resetClient(c)
 		return
 	}
-	cmd.proc(c)
+	// 需要认证时 没有认证的客户端只能执行 AUTH HELLO
+	if authRequired(c) && cmd.flags&CMD_NO_AUTH == 0 {
+		flagTransaction(c)
+		c.AddReply(shared.noautherr)
+		resetClient(c)
+		return
+	}
+	// 检查用户能否执行这个命令 访问参数中的 key 和频道
+	aclContext := ACL_LOG_CTX_TOPLEVEL
+	if c.flags&CLIENT_MULTI != 0 {
+		aclContext = ACL_LOG_CTX_MULTI
+	}
+	if !aclCheckAllPermOrReply(c, cmd, aclContext) {
+		flagTransaction(c)
+		resetClient(c)
+		return
+	}
+	// 集群模式下 key 不在本节点的槽位时重定向 主节点的复制流和加载数据时不检查
+	if server.clusterEnabled && c.flags&CLIENT_MASTER == 0 && !server.loading &&
+		!(cmd.getkeysProc == nil && cmd.firstkey == 0 && cmd.name != "exec") {
+		n, slot, code := getNodeByQuery(c, cmd, c.args)
+		if code != CLUSTER_REDIR_NONE {
+			flagTransaction(c)
+			clusterRedirectClient(c, n, slot, code)
+			resetClient(c)
+			return
+		}
+	}
+	// 脚本超时期间由 hook 处理其他客户端的请求
+	if scriptIsTimedout() && !isScriptKill(c, cmd) {
+		flagTransaction(c)
+		c.AddReplyError("-BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE.")
+		resetClient(c)
+		return
+	}
+	// 只读副本只执行主节点发来的写命令
+	if server.masterhost != "" && server.replSlaveRo && c.flags&CLIENT_MASTER == 0 && cmd.flags&CMD_WRITE != 0 {
+		flagTransaction(c)
+		c.AddReplyError("-READONLY You can't write against a read only replica.")
+		resetClient(c)
+		return
+	}
+	// 超过 maxmemory 时先尝试淘汰 key 淘汰失败时拒绝可能增加内存的命令
+	if server.maxmemory > 0 && !server.loading && !scriptIsTimedout() {
+		if performEvictions() == EVICT_FAIL && rejectCommandOnOOM(c, cmd) {
+			flagTransaction(c)
+			c.AddReply(shared.oomerr)
+			resetClient(c)
+			return
+		}
+	}
+	// RESP3 可以在同一个连接上同时收消息和执行普通命令
+	if c.flags&CLIENT_PUBSUB != 0 && c.resp == 2 && cmd.name != "ping" && cmd.name != "subscribe" &&
+		cmd.name != "unsubscribe" && cmd.name != "psubscribe" && cmd.name != "punsubscribe" {
+		c.AddReplyErrorFormat("Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context", cmd.name)
+		resetClient(c)
+		return
+	}
+	// CLIENT PAUSE 期间推迟执行 保留参数等暂停结束后重新处理
+	if clientShouldBePaused(c, cmd) {
+		blockPostponeClient(c)
+		return
+	}
+	if c.flags&CLIENT_MULTI != 0 && cmd.name != "exec" && cmd.name != "discard" &&
+		cmd.name != "multi" && cmd.name != "watch" {
+		queueMultiCommand(c, cmd)
+		c.AddReply(shared.queued)
+		resetClient(c)
+		return
+	}
+	call(c, cmd)
+	handleClientsBlockedOnKeys()
 	resetClient(c)
 }
 
+// 执行命令 只传播修改了数据的命令 命令可以通过 rewriteClientCommandVector 改写传播的内容
+func call(c *GodisClient, cmd *GodisCommand) {
+	prev := server.currentClient
+	server.currentClient = c
+	defer func() { server.currentClient = prev }()
+	dirty := server.dirty
+	cmd.proc(c)
+	if server.dirty != dirty && c.flags&CLIENT_PREVENT_PROP == 0 {
+		args := make([]string, len(c.args))
+		for i, arg := range c.args {
+			args[i] = arg.StrVal()
+		}
+		propagate(c.db.id, args...)
+	}
+	c.flags &^= CLIENT_PREVENT_PROP
+}
+
+// 把写命令传播到 AOF 和副本
+func propagate(dbid int, args ...string) {
+	if server.loading {
+		return
+	}
+	// EXEC 中的第一个写命令之前先传播 MULTI
+	if server.inExec && !server.execMultiPropagated {
+		server.execMultiPropagated = true
+		propagate(dbid, "MULTI")
+	}
+	if server.aofState == AOF_ON {
+		feedAppendOnlyFile(dbid, args)
+	}
+	replicationFeedSlaves(dbid, args...)
+}
+
+/*
+替换当前命令的参数 用于把不确定的命令改写成确定的形式
+比如 EXPIRE 改写成 PEXPIREAT SPOP 改写成 SREM
+原来的参数会被释放 调用之后不能再使用
+*/
+func rewriteClientCommandVector(c *GodisClient, args ...string) {
+	freeArgs(c)
+	c.args = make([]*Gobj, len(args))
+	for i, arg := range args {
+		c.args[i] = CreateObject(GSTR, arg)
+	}
+}
+
+func formatArgs(args []*Gobj) string {
+	var b strings.Builder
+	for _, arg := range args {
+		fmt.Fprintf(&b, "'%s' ", arg.StrVal())
+	}
+	return b.String()
+}
+
 // 具体的 CommandProc 实现，引用清零
+// 解析出错时 bulk 参数可能只填充了一部分
 func freeArgs(client *GodisClient) {
 	for _, v := range client.args {
-		v.DecrRefCount()
+		if v != nil {
+			v.DecrRefCount()
+		}
 	}
+	client.args = nil
 }
 
 func freeReplyList(client *GodisClient) {
@@ -192,6 +839,16 @@ func freeReplyList(client *GodisClient) {
 }
 
 func freeClient(client *GodisClient) {
+	unblockClient(client)
+	discardTransaction(client)
+	pubsubUnsubscribeAllChannels(client, false)
+	pubsubUnsubscribeAllPatterns(client, false)
+	if client.flags&CLIENT_SLAVE != 0 {
+		replicationRemoveSlave(client)
+	}
+	if client.flags&CLIENT_MASTER != 0 {
+		replicationHandleMasterDisconnection(client)
+	}
 	freeArgs(client)
 	// deletes the element with the specified key (m[key]) from the map
 	delete(server.clients, client.fd)
@@ -202,9 +859,13 @@ func freeClient(client *GodisClient) {
 }
 
 func resetClient(client *GodisClient) {
+	// ASKING 只对下一条命令有效 MULTI 中对整个事务有效
+	if client.flags&CLIENT_MULTI == 0 && !(len(client.args) > 0 && strings.EqualFold(client.args[0].StrVal(), "asking")) {
+		client.flags &^= CLIENT_ASKING
+	}
 	freeArgs(client)
 	client.cmdTy = COMMAND_UNKNOWN
-	client.bulkLen = 0
+	client.bulkLen = -1
 	client.bulkNum = 0
 }
 
@@ -215,7 +876,11 @@ func (client *GodisClient) findLineInQuery() (int, error) {
 			return i, nil
 		}
 	}
-	return -1, errors.New("find line error")
+	// 还没有收到完整的一行 等待下一次读取
+	if client.queryLen > GODIS_MAX_INLINE {
+		return -1, errors.New("too big inline request")
+	}
+	return -1, nil
 }
 
 /*
@@ -265,8 +930,11 @@ func handleBulkBuf(client *GodisClient) (bool, error) {
 		}
 
 		bnum, err := client.getNumInQuery(1, index)
-		if err != nil {
-			return false, err
+		if err != nil || bnum < 0 || bnum > PROTO_MAX_MULTIBULK {
+			return false, errors.New("invalid multibulk length")
+		}
+		if bnum > PROTO_UNAUTH_MULTIBULK && authRequired(client) {
+			return false, errors.New("unauthenticated multibulk length")
 		}
 		// 代表空字符串 SET key ""
 		if bnum == 0 {
@@ -277,7 +945,7 @@ func handleBulkBuf(client *GodisClient) (bool, error) {
 	}
 	for client.bulkNum > 0 {
 		// 从 querybuf 读多长
-		if client.bulkLen == 0 {
+		if client.bulkLen < 0 {
 			index, err := client.findLineInQuery()
 			if index < 0 {
 				return false, err
@@ -287,14 +955,18 @@ func handleBulkBuf(client *GodisClient) (bool, error) {
 			}
 			// 头和尾都被处理过，1, index
 			blen, err := client.getNumInQuery(1, index)
-			// 长度为 0 代表空字符串
-			if err != nil || blen == 0 {
-				return false, err
+			// 长度为 0 代表空字符串 SET key ""
+			if err != nil || blen < 0 {
+				return false, errors.New("invalid bulk length")
 			}
-			// GODIS_MAX_BULK -> 限制的是 $ 后、\r 前的 bulk string
-			if blen > GODIS_MAX_BULK {
+			// proto-max-bulk-len 限制的是 $ 后、\r 前的 bulk string
+			// 主节点发来的命令已经在主节点上执行过 不受限制
+			if int64(blen) > server.protoMaxBulkLen && client.flags&CLIENT_MASTER == 0 {
 				return false, errors.New("bulk length too long")
 			}
+			if blen > PROTO_UNAUTH_BULK && authRequired(client) {
+				return false, errors.New("unauthenticated bulk length")
+			}
 			client.bulkLen = blen
 		}
 		// 开始读取数据并加入到 args 中
@@ -309,7 +981,7 @@ func handleBulkBuf(client *GodisClient) (bool, error) {
 		client.args[len(client.args)-client.bulkNum] = CreateObject(GSTR, string(client.queryBuf[:index]))
 		client.queryBuf = client.queryBuf[index+2:]
 		client.queryLen -= index + 2
-		client.bulkLen = 0
+		client.bulkLen = -1
 		client.bulkNum -= 1
 	}
 	return true, nil
@@ -318,6 +990,10 @@ func handleBulkBuf(client *GodisClient) (bool, error) {
 // 传递指针可以设置成员变量
 func ProcessQueryBuf(client *GodisClient) error {
 	for client.queryLen > 0 {
+		// 阻塞期间的输入留在缓冲区中 唤醒后再处理
+		if client.flags&CLIENT_BLOCKED != 0 {
+			break
+		}
 		// 初始时不知道cmd类型
 		if client.cmdTy == COMMAND_UNKNOWN {
 			if client.queryBuf[0] == '*' {
@@ -348,6 +1024,9 @@ func ProcessQueryBuf(client *GodisClient) error {
 			} else {
 				ProcessCommand(client)
 			}
+			if client.flags&CLIENT_MASTER != 0 {
+				replicationCommandProcessed(client)
+			}
 		} else {
 			break
 		}
@@ -358,90 +1037,154 @@ func ProcessQueryBuf(client *GodisClient) error {
 // 处理客户端的命令
 func ReadQueryFromClient(loop *AeLoop, fd int, extra interface{}) {
 	client := extra.(*GodisClient) // 接口的 assert
-	if len(client.queryBuf)-client.queryLen < GODIS_MAX_BULK {
+	readlen := GODIS_IO_BUF
+	// 正在读取很大的参数时 一次预留出剩下的部分 避免反复扩容 只对已经认证的客户端这样做
+	if client.cmdTy == COMMAND_BULK && client.bulkLen >= PROTO_MBULK_BIG_ARG && !authRequired(client) {
+		readlen = max(readlen, client.bulkLen+2-client.queryLen)
+	}
+	if len(client.queryBuf)-client.queryLen < readlen {
 		// func append(slice []T, elems ...T) []T 表示展开
-		client.queryBuf = append(client.queryBuf, make([]byte, GODIS_MAX_BULK)...)
+		client.queryBuf = append(client.queryBuf, make([]byte, readlen)...)
 	}
 	// 偏移 querylen 之后开始读数据
 	n, err := unix.Read(fd, client.queryBuf[client.queryLen:])
+	if err == unix.EAGAIN {
+		return
+	}
 	if err != nil {
-		log.Println("read error:", err)
+		serverLog(LL_VERBOSE, "read error: %v", err)
+		freeClient(client)
+		return
+	}
+	if n == 0 {
+		serverLog(LL_VERBOSE, "client closed connection, fd: %v", fd)
 		freeClient(client)
 		return
 	}
 
+	client.lastinteraction = GetMsTime() / 1000
+	if client.flags&CLIENT_MASTER != 0 {
+		client.readReploff += int64(n)
+		client.pendingQuery = append(client.pendingQuery, client.queryBuf[client.queryLen:client.queryLen+n]...)
+	}
 	client.queryLen += n
-	log.Printf("read %v bytes from client:%v\n", n, client.fd)
-	log.Printf("ReadQueryFromClient, queryBuf : %v\n", string(client.queryBuf))
+	serverLog(LL_DEBUG, "read %v bytes from client:%v", n, client.fd)
 
 	// 处理数据
 	err = ProcessQueryBuf(client)
 	if err != nil {
-		log.Printf("process query buf err: %v\n", err)
+		serverLog(LL_VERBOSE, "process query buf err: %v", err)
 		freeClient(client)
 		return
 	}
 }
 
+// 一次写事件最多合并发送的字节数
+const NET_MAX_WRITES_PER_EVENT = 1024 * 64
+
 func SendReplyToClient(loop *AeLoop, fd int, extra interface{}) {
 	client := extra.(*GodisClient)
-	log.Printf("SendReplyToClient, reply len:%v\n", client.reply.Length())
+	serverLog(LL_DEBUG, "SendReplyToClient, reply len:%v", client.reply.Length())
 	for client.reply.Length() > 0 {
-		rep := client.reply.First()
-		buf := []byte(rep.Val.StrVal())
-		bufLen := len(buf)
-		// sentlen < buflen 上一次没有发完
-		if client.sentLen < bufLen {
-			n, err := unix.Write(fd, buf[client.sentLen:])
-			if err != nil {
-				log.Printf("send reply err: %v\n", err)
-				freeClient(client)
-				return
-			}
-			client.sentLen += n
-			log.Printf("send %v bytes to client:%v\n", n, client.fd)
-			/*
-			 此时 head 已经发完了
-			 client.reply 中的每条消息都一次性成功写完 则不break
-			*/
-			if client.sentLen == bufLen {
-				client.reply.DelNode(rep)
-				rep.Val.DecrRefCount()
-				client.sentLen = 0
-			} else {
-				// 说明此时还是没有发完 缓冲区当中没有 bytes 了
+		/*
+		 把链表头部的若干条回复合并到一个 buf 中一次 write
+		 sentLen 记录的是合并 buf 中已经发出去的字节数
+		*/
+		var buf []byte
+		for node := client.reply.First(); node != nil && len(buf) < NET_MAX_WRITES_PER_EVENT; node = node.next {
+			buf = append(buf, node.Val.StrVal()...)
+		}
+		if client.sentLen >= len(buf) {
+			client.sentLen -= len(buf)
+			client.popReplies(len(buf))
+			continue
+		}
+		n, err := unix.Write(fd, buf[client.sentLen:])
+		if err != nil {
+			if err == unix.EAGAIN {
 				break
 			}
+			serverLog(LL_VERBOSE, "send reply err: %v", err)
+			freeClient(client)
+			return
+		}
+		serverLog(LL_DEBUG, "send %v bytes to client:%v", n, client.fd)
+		// 主节点的连接只看是否收到了数据
+		if client.flags&CLIENT_MASTER == 0 {
+			client.lastinteraction = GetMsTime() / 1000
+		}
+		client.sentLen += n
+		// 删除已经完整发送的节点 剩下的部分等待下一次写事件
+		client.sentLen = client.popReplies(client.sentLen)
+		if client.sentLen > 0 {
+			// 说明此时还是没有发完 缓冲区当中没有空间了
+			break
 		}
 	}
-	//
 	if client.reply.Length() == 0 {
 		client.sentLen = 0
 		loop.RemoveFileEvent(fd, AE_WRITABLE)
+		if client.flags&CLIENT_CLOSE_AFTER_REPLY != 0 {
+			freeClient(client)
+		}
 	}
 }
 
+// 从链表头部删除总长度不超过 n 的完整节点 返回头部节点已发送的字节数
+func (client *GodisClient) popReplies(n int) int {
+	for client.reply.Length() > 0 {
+		rep := client.reply.First()
+		l := len(rep.Val.StrVal())
+		if l > n {
+			break
+		}
+		client.reply.DelNode(rep)
+		rep.Val.DecrRefCount()
+		n -= l
+	}
+	return n
+}
+
 func AcceptHandler(loop *AeLoop, fd int, extra interface{}) {
 	cfd, _, err := unix.Accept(fd)
 	if err != nil {
-		log.Printf("accept err: %v\n", err)
+		serverLog(LL_WARNING, "accept err: %v", err)
+		return
+	}
+	// 连接数达到上限时回复错误后直接关闭
+	if len(server.clients) >= server.maxclients {
+		unix.Write(cfd, []byte("-ERR max number of clients reached\r\n"))
+		unix.Close(cfd)
+		server.statRejectedConn++
+		serverLog(LL_VERBOSE, "Error registering fd event for the new client: max number of clients reached")
 		return
 	}
 	client := CreateClient(cfd)
-	//TODO: check max clients limit
 	server.clients[cfd] = client
 	server.aeLoop.AddFileEvent(cfd, AE_READABLE, ReadQueryFromClient, client)
-	log.Printf("accept client, fd: %v\n", cfd)
+	serverLog(LL_VERBOSE, "accept client, fd: %v", cfd)
 }
 
-const EXPIRE_CHECK_COUNT int = 100
-
 func CreateClient(fd int) *GodisClient {
 	var client GodisClient
+	server.nextClientId++
+	client.id = server.nextClientId
 	client.fd = fd
-	client.db = server.db
+	client.resp = 2
+	client.db = server.dbs[0]
 	client.queryBuf = make([]byte, GODIS_IO_BUF)
+	client.bulkLen = -1
 	client.reply = ListCreate(ListType{EqualFunc: GStrEqual})
+	client.ctime = GetMsTime()
+	client.lastinteraction = client.ctime / 1000
+	// 伪客户端没有连接 不受 ACL 限制
+	if fd >= 0 {
+		setClientAddrs(&client)
+		client.user = server.defaultUser
+		client.authenticated = client.user.flags&USER_FLAG_NOPASS != 0 && client.user.flags&USER_FLAG_ENABLED != 0
+	} else {
+		client.authenticated = true
+	}
 	return &client
 }
 
@@ -463,83 +1206,297 @@ func GStrHash(key *Gobj) int64 {
 	return int64(hash.Sum64())
 }
 
-// 懒惰过期策略（lazy expiration）
-func ServerCron(loop *AeLoop, id int, extra interface{}) {
-	for i := 0; i < EXPIRE_CHECK_COUNT; i++ {
-		entry := server.db.expire.RandomGet()
-		if entry == nil {
+// 每次进入 epoll_wait 之前执行
+func beforeSleep(loop *AeLoop) {
+	// 先更新集群状态和配置文件 再处理其他事情
+	if server.clusterEnabled {
+		clusterBeforeSleep()
+	}
+	// 暂停时间到了之后被推迟的客户端马上继续执行
+	paused := checkClientPauseTimeoutAndReturnIfPaused()
+	// 副本上的 key 由主节点传播 DEL 删除 暂停期间数据集保持不变
+	if server.masterhost == "" && !paused {
+		activeExpireCycle(ACTIVE_EXPIRE_CYCLE_FAST)
+	}
+	processUnblockedClients()
+	// 在回复发送给客户端之前写入 AOF
+	flushAppendOnlyFile()
+}
+
+// 每次 cron 最多处理多少个数据库
+const CRON_DBS_PER_CALL = 16
+
+var rehashDb int // 下一次主动 rehash 的数据库
+
+// 主动过期以及渐进式 rehash
+func databasesCron() {
+	if server.masterhost == "" && !checkClientPauseTimeoutAndReturnIfPaused() {
+		activeExpireCycle(ACTIVE_EXPIRE_CYCLE_SLOW)
+	}
+	// 每次只对一个正在 rehash 的 dict 执行 1ms
+	dbsPerCall := min(CRON_DBS_PER_CALL, len(server.dbs))
+	for j := 0; j < dbsPerCall; j++ {
+		db := server.dbs[rehashDb%len(server.dbs)]
+		rehashDb++
+		if db.data.RehashMilliseconds(1) > 0 {
 			break
 		}
-		if entry.Val.IntVal() < time.Now().Unix() {
-			server.db.data.Delete(entry.Key)
-			server.db.expire.Delete(entry.Key)
+		if db.expire.RehashMilliseconds(1) > 0 {
+			break
 		}
 	}
 }
 
-// server
-const BACKLOG int = 64
+// 后台定时任务 每秒执行 hz 次
+func ServerCron(loop *AeLoop, id int, extra interface{}) {
+	server.lruclock = getLRUClock()
+	clientsCronHandleTimeout()
+	databasesCron()
+	snapshotCron()
+	checkChildrenDone()
+	rdbCronSave()
+	// 复制的定时任务每秒执行一次
+	if runWithPeriod(1000) {
+		replicationCron()
+	}
+	if server.clusterEnabled && runWithPeriod(100) {
+		clusterCron()
+	}
+	server.cronloops++
+}
+
+// 每 ms 毫秒执行一次 hz 较小时每次 cron 都执行
+func runWithPeriod(ms int) bool {
+	period := 1000 / server.hz
+	return ms <= period || server.cronloops%int64(ms/period) == 0
+}
 
-func TcpServer(port int) (int, error) {
+// 不阻塞地检查后台保存和 AOF 重写是否完成
+func checkChildrenDone() {
+	if server.rdbChildRunning {
+		select {
+		case err := <-server.rdbChildDone:
+			backgroundSaveDoneHandler(err)
+		default:
+		}
+	}
+	if server.aofChildRunning {
+		select {
+		case err := <-server.aofChildDone:
+			backgroundRewriteDoneHandler(err)
+		default:
+		}
+	}
+}
+
+func TcpServer(bind string, port int, backlog int) (int, error) {
+	var addr unix.SockaddrInet4
+	ip := net.ParseIP(bind).To4()
+	if ip == nil {
+		return -1, fmt.Errorf("invalid bind address '%s'", bind)
+	}
+	copy(addr.Addr[:], ip)
+	// golang.syscall will handle htons
+	addr.Port = port
 	s, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
 	if err != nil {
-		log.Printf("init socket err: %v\n", err)
-		return -1, nil
+		serverLog(LL_WARNING, "init socket err: %v", err)
+		return -1, err
 	}
-	err = unix.SetsockoptInt(s, unix.SOL_SOCKET, unix.SO_REUSEPORT, port)
+	err = unix.SetsockoptInt(s, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
 	if err != nil {
-		log.Printf("set SO_REUSEPORT err: %v\n", err)
+		serverLog(LL_WARNING, "set SO_REUSEPORT err: %v", err)
 		unix.Close(s)
-		return -1, nil
+		return -1, err
 	}
-	var addr unix.SockaddrInet4
-	// golang.syscall will handle htons
-	addr.Port = port
-	// golang will set addr.Addr = any(0)
 	err = unix.Bind(s, &addr)
 	if err != nil {
-		log.Printf("bind addr err: %v\n", err)
+		serverLog(LL_WARNING, "bind addr err: %v", err)
 		unix.Close(s)
-		return -1, nil
+		return -1, err
 	}
-	err = unix.Listen(s, BACKLOG)
+	err = unix.Listen(s, backlog)
 	if err != nil {
-		log.Printf("listen socket err: %v\n", err)
+		serverLog(LL_WARNING, "listen socket err: %v", err)
 		unix.Close(s)
-		return -1, nil
+		return -1, err
 	}
 	return s, nil
 }
 
+// 按 loglevel 过滤日志
+func serverLog(level int, format string, v ...interface{}) {
+	if level < server.verbosity {
+		return
+	}
+	log.Printf(format, v...)
+}
+
+func initLog(config *Config) error {
+	server.verbosity = config.LogLevel
+	if config.LogFile == "" {
+		return nil
+	}
+	f, err := os.OpenFile(config.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	log.SetOutput(f)
+	return nil
+}
+
 func initServer(config *Config) error {
+	// 相对路径的 logfile 相对于 dir
+	if err := os.Chdir(config.Dir); err != nil {
+		return err
+	}
+	if err := initLog(config); err != nil {
+		return err
+	}
 	server.port = config.Port
+	server.bind = config.Bind
+	server.hz = config.Hz
+	server.maxclients = config.MaxClients
+	server.maxidletime = config.Timeout
+	server.protoMaxBulkLen = config.ProtoMaxBulkLen
+	server.activeExpireEffort = config.ActiveExpireEffort
+	server.notifyKeyspaceEvents = config.NotifyKeyspaceEvents
+	server.luaTimeLimit = int64(config.LuaTimeLimit)
+	server.lruclock = getLRUClock()
+	server.maxmemory = config.Maxmemory
+	server.maxmemoryPolicy = config.MaxmemoryPolicy
+	server.maxmemorySamples = config.MaxmemorySamples
+	server.lfuLogFactor = config.LfuLogFactor
+	server.lfuDecayTime = config.LfuDecayTime
+	evictionPoolAlloc()
+	changeReplicationId()
+	clearReplicationId2()
+	server.slaveseldb = -1
+	server.replBacklogSize = config.ReplBacklogSize
+	server.replTimeout = int64(config.ReplTimeout)
+	server.replPingSlavePeriod = int64(config.ReplPingSlavePeriod)
+	server.replSlaveRo = config.ReplSlaveRo
+	server.masterauth = config.MasterAuth
+	server.masteruser = config.MasterUser
+	server.replTransferS = -1
+	if config.MasterHost != "" {
+		server.masterhost = config.MasterHost
+		server.masterport = config.MasterPort
+		server.replState = REPL_STATE_CONNECT
+	}
+	server.clusterEnabled = config.ClusterEnabled
+	server.clusterConfigfile = config.ClusterConfigFile
+	server.clusterNodeTimeout = int64(config.ClusterNodeTimeout)
+	server.clusterPort = config.ClusterPort
+	server.clusterRequireFullCoverage = config.ClusterRequireFullCoverage
+	server.statStartTime = GetMsTime()
 	server.clients = make(map[int]*GodisClient)
-	server.db = &GodisDB{
-		data:   DictCreate(DictType{HashFunc: GStrHash, EqualFunc: GStrEqual}),
-		expire: DictCreate(DictType{HashFunc: GStrHash, EqualFunc: GStrEqual}),
+	server.pubsubChannels = make(map[string][]*GodisClient)
+	server.pubsubPatterns = make(map[string][]*GodisClient)
+	createSharedObjects()
+	populateCommandTable()
+	server.acllogMaxLen = config.AcllogMaxLen
+	aclInit()
+	if err := aclLoadUsersAtStartup(config); err != nil {
+		return err
+	}
+	server.dbs = make([]*GodisDB, config.Databases)
+	for i := range server.dbs {
+		server.dbs[i] = createDB(i)
+	}
+	scriptingInit()
+	server.rdbFilename = config.DbFilename
+	server.saveparams = config.SaveParams
+	server.lastsave = GetMsTime() / 1000
+	server.lastbgsaveTry = server.lastsave
+	server.lastbgsaveStatus = true
+	server.aofFilename = config.AppendFilename
+	server.aofFsync = config.AppendFsync
+	server.aofLoadTruncated = config.AofLoadTruncated
+	server.aofLastWriteStatus = true
+	server.aofLastBgrewriteStatus = true
+	if config.AppendOnly {
+		server.aofState = AOF_ON
 	}
 	var err error
 	if server.aeLoop, err = AeLoopCreate(); err != nil {
 		return err
 	}
-	server.fd, err = TcpServer(server.port)
+	// 先加载集群配置 加载数据时才能记录 key 所在的槽位
+	if server.clusterEnabled {
+		if err := clusterInit(config.TcpBacklog); err != nil {
+			return err
+		}
+	}
+	_, aofStatErr := os.Stat(server.aofFilename)
+	if err := loadDataFromDisk(); err != nil {
+		return err
+	}
+	if server.clusterEnabled {
+		if err := verifyClusterConfigWithData(); err != nil {
+			return err
+		}
+	}
+	if server.aofState == AOF_ON {
+		if err := openAppendOnlyFile(); err != nil {
+			return err
+		}
+		if os.IsNotExist(aofStatErr) && dbTotalKeys() > 0 {
+			rewriteAppendOnlyFileBackground()
+		}
+	}
+	server.fd, err = TcpServer(server.bind, server.port, config.TcpBacklog)
 	return err
 }
 
-func main() {
-	path := os.Args[1]
-	config, err := LoadConfig(path)
+/*
+开启 AOF 时从 AOF 加载 否则从 RDB 加载
+AOF 还不存在时先加载 RDB 再重写一次 AOF 避免丢失 RDB 中的数据
+*/
+func loadDataFromDisk() error {
+	start := GetMsTime()
+	if server.aofState == AOF_ON {
+		err := loadAppendOnlyFile(server.aofFilename)
+		if err == nil {
+			serverLog(LL_NOTICE, "DB loaded from append only file: %.3f seconds", float64(GetMsTime()-start)/1000)
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	err := rdbLoad(server.rdbFilename)
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
-		log.Printf("config error: %v\n", err)
+		return err
 	}
-	err = initServer(config)
+	serverLog(LL_NOTICE, "DB loaded from disk: %.3f seconds", float64(GetMsTime()-start)/1000)
+	return nil
+}
+
+func main() {
+	config := DefaultConfig()
+	if len(os.Args) > 1 {
+		var err error
+		config, err = LoadConfig(os.Args[1])
+		if err != nil {
+			log.Fatalf("config error: %v\n", err)
+		}
+	}
+	err := initServer(config)
 	if err != nil {
-		log.Printf("init server error: %v\n", err)
+		log.Fatalf("init server error: %v\n", err)
 	}
 	// eventloop for files and time
 	server.aeLoop.AddFileEvent(server.fd, AE_READABLE, AcceptHandler, nil)
-	// 一开始加进来作为后台任务
-	server.aeLoop.AddTimeEvent(AE_NORMAL, 100, ServerCron, nil)
-	log.Println("godis server is up.")
+	if server.clusterEnabled {
+		server.aeLoop.AddFileEvent(server.cluster.fd, AE_READABLE, clusterAcceptHandler, nil)
+	}
+	server.aeLoop.BeforeSleep = beforeSleep
+	// 一开始加进来作为后台任务 每秒执行 hz 次
+	server.aeLoop.AddTimeEvent(AE_NORMAL, int64(1000/server.hz), ServerCron, nil)
+	serverLog(LL_NOTICE, "godis server is up, listening on %v:%v", server.bind, server.port)
 	server.aeLoop.AeMain()
 }
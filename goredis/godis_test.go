@@ -0,0 +1,203 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// 初始化一个不监听端口的 server 供命令测试使用
+func initTestServer(t *testing.T) {
+	config := DefaultConfig()
+	server.verbosity = LL_WARNING
+	server.hz = config.Hz
+	server.maxclients = config.MaxClients
+	server.maxidletime = config.Timeout
+	server.protoMaxBulkLen = config.ProtoMaxBulkLen
+	server.activeExpireEffort = config.ActiveExpireEffort
+	server.notifyKeyspaceEvents = config.NotifyKeyspaceEvents
+	server.luaTimeLimit = int64(config.LuaTimeLimit)
+	server.lruclock = getLRUClock()
+	server.maxmemory = config.Maxmemory
+	server.maxmemoryPolicy = config.MaxmemoryPolicy
+	server.maxmemorySamples = config.MaxmemorySamples
+	server.lfuLogFactor = config.LfuLogFactor
+	server.lfuDecayTime = config.LfuDecayTime
+	server.statEvictedKeys = 0
+	evictionPoolAlloc()
+	changeReplicationId()
+	clearReplicationId2()
+	server.masterReplOffset = 0
+	server.replBacklog = nil
+	server.replBacklogSize = config.ReplBacklogSize
+	server.replTimeout = int64(config.ReplTimeout)
+	server.replPingSlavePeriod = int64(config.ReplPingSlavePeriod)
+	server.replSlaveRo = config.ReplSlaveRo
+	server.slaves = nil
+	server.slaveseldb = -1
+	server.masterhost = ""
+	server.master = nil
+	server.replState = REPL_STATE_NONE
+	server.replTransferS = -1
+	server.currentClient = nil
+	server.clientPauseType = CLIENT_PAUSE_OFF
+	server.clientPauseEndTime = 0
+	server.postponedClients = nil
+	server.statRejectedConn = 0
+	server.clusterEnabled = false
+	server.cluster = nil
+	server.statSyncFull, server.statSyncPartialOk, server.statSyncPartialErr = 0, 0, 0
+	server.clients = make(map[int]*GodisClient)
+	server.pubsubChannels = make(map[string][]*GodisClient)
+	server.pubsubPatterns = make(map[string][]*GodisClient)
+	createSharedObjects()
+	populateCommandTable()
+	server.acllogMaxLen = config.AcllogMaxLen
+	server.aclFilename = ""
+	aclInit()
+	server.dbs = make([]*GodisDB, config.Databases)
+	for i := range server.dbs {
+		server.dbs[i] = createDB(i)
+	}
+	scriptingInit()
+	server.dirty = 0
+	server.rdbFilename = filepath.Join(t.TempDir(), config.DbFilename)
+	server.rdbChildRunning = false
+	server.rdbSnapshot = nil
+	server.rdbBgsaveScheduled = false
+	server.lastbgsaveStatus = true
+	server.loading = false
+	server.aofState = AOF_OFF
+	server.aofFile = nil
+	server.aofBuf = nil
+	server.aofFilename = filepath.Join(filepath.Dir(server.rdbFilename), config.AppendFilename)
+	server.aofFsync = config.AppendFsync
+	server.aofLoadTruncated = config.AofLoadTruncated
+	server.aofChildRunning = false
+	server.aofSnapshot = nil
+	server.aofLastWriteStatus = true
+	server.aofLastBgrewriteStatus = true
+	server.inExec = false
+	server.execMultiPropagated = false
+	var err error
+	if server.aeLoop, err = AeLoopCreate(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unix.Close(server.aeLoop.fileEventFd) })
+}
+
+// 用 socketpair 的一端作为客户端 fd
+func newTestClient(t *testing.T) *GodisClient {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		unix.Close(fds[0])
+		unix.Close(fds[1])
+	})
+	c := CreateClient(fds[0])
+	server.clients[c.fd] = c
+	return c
+}
+
+// 执行一条命令并取出回复链表中的全部内容
+func (c *GodisClient) run(args ...string) string {
+	c.args = make([]*Gobj, len(args))
+	for i, arg := range args {
+		c.args[i] = CreateObject(GSTR, arg)
+	}
+	ProcessCommand(c)
+	return c.takeReply()
+}
+
+func (c *GodisClient) takeReply() string {
+	var b strings.Builder
+	for c.reply.Length() > 0 {
+		n := c.reply.First()
+		b.WriteString(n.Val.StrVal())
+		c.reply.DelNode(n)
+		n.Val.DecrRefCount()
+	}
+	return b.String()
+}
+
+func expectReply(t *testing.T, c *GodisClient, expect string, args ...string) {
+	t.Helper()
+	if got := c.run(args...); got != expect {
+		t.Errorf("%v: expect %q, got %q", args, expect, got)
+	}
+}
+
+func TestProcessCommand(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	expectReply(t, c, "+PONG\r\n", "PING")
+	expectReply(t, c, "$5\r\nhello\r\n", "ping", "hello")
+	expectReply(t, c, "$-1\r\n", "get", "k")
+	expectReply(t, c, "+OK\r\n", "SET", "k", "v")
+	expectReply(t, c, "$1\r\nv\r\n", "Get", "k")
+	expectReply(t, c, "-ERR wrong number of arguments for 'get' command\r\n", "get")
+	expectReply(t, c, "-ERR unknown command 'nosuch', with args beginning with: 'a' \r\n", "nosuch", "a")
+}
+
+func TestHelloCommand(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	expectReply(t, c, "-NOPROTO unsupported protocol version\r\n", "hello", "4")
+	reply := c.run("hello", "3", "setname", "worker-1")
+	if !strings.HasPrefix(reply, "%7\r\n$6\r\nserver\r\n$5\r\nredis\r\n") || c.resp != 3 || c.name != "worker-1" {
+		t.Errorf("unexpected hello reply %q", reply)
+	}
+	expectReply(t, c, "_\r\n", "get", "nokey")
+	expectReply(t, c, "-ERR Syntax error in HELLO option 'foo'\r\n", "hello", "2", "foo")
+	reply = c.run("hello", "2")
+	if !strings.HasPrefix(reply, "*14\r\n") || c.resp != 2 {
+		t.Errorf("unexpected hello reply %q", reply)
+	}
+}
+
+// 命令可能分多次读到 在任意位置断开都要等待剩下的数据
+func TestProcessQueryBufPartial(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	input := "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$5\r\nhello\r\nPING\r\n"
+	for i := 0; i < len(input); i++ {
+		c.queryBuf = append(c.queryBuf[:c.queryLen], input[i])
+		c.queryLen++
+		if err := ProcessQueryBuf(c); err != nil {
+			t.Fatalf("byte %d: %v", i, err)
+		}
+	}
+	if got := c.takeReply(); got != "+OK\r\n+PONG\r\n" || c.args != nil {
+		t.Errorf("unexpected reply %q", got)
+	}
+	expectReply(t, c, "$5\r\nhello\r\n", "get", "k")
+
+	// 空字符串参数
+	input = "*3\r\n$3\r\nSET\r\n$0\r\n\r\n$1\r\nv\r\n"
+	c.queryBuf = append(c.queryBuf[:c.queryLen], input...)
+	c.queryLen += len(input)
+	if err := ProcessQueryBuf(c); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.takeReply(); got != "+OK\r\n" {
+		t.Errorf("unexpected reply %q", got)
+	}
+	expectReply(t, c, "$1\r\nv\r\n", "get", "")
+}
+
+// 参数个数不合法时直接返回错误 不分配 args
+func TestProcessQueryBufInvalid(t *testing.T) {
+	initTestServer(t)
+	for _, input := range []string{"*-1\r\n", "*2000000000\r\n", "*abc\r\n"} {
+		c := newTestClient(t)
+		c.queryBuf = append(c.queryBuf[:c.queryLen], input...)
+		c.queryLen += len(input)
+		if err := ProcessQueryBuf(c); err == nil {
+			t.Errorf("%q: expect error", input)
+		}
+	}
+}
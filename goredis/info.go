@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// INFO 中默认输出的 section
+var infoDefaultSections = []string{"server", "clients", "memory", "persistence", "stats", "replication", "cluster", "keyspace"}
+
+/*
+生成 INFO 的内容 每个 section 以 "# Name" 开头
+sections 为空时输出默认的全部 section
+*/
+func genGodisInfoString(sections []string) string {
+	if len(sections) == 0 {
+		sections = infoDefaultSections
+	}
+	want := make(map[string]bool)
+	for _, s := range sections {
+		s = strings.ToLower(s)
+		if s == "all" || s == "default" || s == "everything" {
+			for _, d := range infoDefaultSections {
+				want[d] = true
+			}
+			continue
+		}
+		want[s] = true
+	}
+
+	var b strings.Builder
+	section := func(name string) bool {
+		if !want[strings.ToLower(name)] {
+			return false
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "# %s\r\n", name)
+		return true
+	}
+	if section("Server") {
+		uptime := (GetMsTime() - server.statStartTime) / 1000
+		fmt.Fprintf(&b, "redis_version:%s\r\n", GODIS_VERSION)
+		fmt.Fprintf(&b, "process_id:%d\r\n", os.Getpid())
+		fmt.Fprintf(&b, "tcp_port:%d\r\n", server.port)
+		fmt.Fprintf(&b, "uptime_in_seconds:%d\r\n", uptime)
+		fmt.Fprintf(&b, "uptime_in_days:%d\r\n", uptime/86400)
+		fmt.Fprintf(&b, "hz:%d\r\n", server.hz)
+	}
+	if section("Clients") {
+		fmt.Fprintf(&b, "connected_clients:%d\r\n", len(server.clients))
+		fmt.Fprintf(&b, "maxclients:%d\r\n", server.maxclients)
+		fmt.Fprintf(&b, "blocked_clients:%d\r\n", server.blockedClients)
+	}
+	if section("Memory") {
+		used := usedMemory()
+		fmt.Fprintf(&b, "used_memory:%d\r\n", used)
+		fmt.Fprintf(&b, "used_memory_human:%s\r\n", bytesToHuman(used))
+		fmt.Fprintf(&b, "maxmemory:%d\r\n", server.maxmemory)
+		fmt.Fprintf(&b, "maxmemory_human:%s\r\n", bytesToHuman(server.maxmemory))
+		fmt.Fprintf(&b, "maxmemory_policy:%s\r\n", maxmemoryPolicyName(server.maxmemoryPolicy))
+	}
+	if section("Persistence") {
+		status := func(ok bool) string {
+			if ok {
+				return "ok"
+			}
+			return "err"
+		}
+		fmt.Fprintf(&b, "loading:0\r\n")
+		fmt.Fprintf(&b, "rdb_changes_since_last_save:%d\r\n", server.dirty)
+		fmt.Fprintf(&b, "rdb_bgsave_in_progress:%d\r\n", boolToInt(server.rdbChildRunning))
+		fmt.Fprintf(&b, "rdb_last_save_time:%d\r\n", server.lastsave)
+		fmt.Fprintf(&b, "rdb_last_bgsave_status:%s\r\n", status(server.lastbgsaveStatus))
+		current := int64(-1)
+		if server.rdbChildRunning {
+			current = (GetMsTime() - server.rdbSaveTimeStart) / 1000
+		}
+		fmt.Fprintf(&b, "rdb_current_bgsave_time_sec:%d\r\n", current)
+		fmt.Fprintf(&b, "aof_enabled:%d\r\n", boolToInt(server.aofState == AOF_ON))
+		fmt.Fprintf(&b, "aof_rewrite_in_progress:%d\r\n", boolToInt(server.aofChildRunning))
+		current = -1
+		if server.aofChildRunning {
+			current = (GetMsTime() - server.aofRewriteTimeStart) / 1000
+		}
+		fmt.Fprintf(&b, "aof_current_rewrite_time_sec:%d\r\n", current)
+		fmt.Fprintf(&b, "aof_last_bgrewrite_status:%s\r\n", status(server.aofLastBgrewriteStatus))
+		fmt.Fprintf(&b, "aof_last_write_status:%s\r\n", status(server.aofLastWriteStatus))
+		if server.aofState == AOF_ON {
+			fmt.Fprintf(&b, "aof_current_size:%d\r\n", server.aofCurrentSize)
+		}
+	}
+	if section("Stats") {
+		fmt.Fprintf(&b, "rejected_connections:%d\r\n", server.statRejectedConn)
+		fmt.Fprintf(&b, "expired_keys:%d\r\n", server.statExpiredKeys)
+		fmt.Fprintf(&b, "evicted_keys:%d\r\n", server.statEvictedKeys)
+		fmt.Fprintf(&b, "expired_stale_perc:%.2f\r\n", server.statExpiredStalePerc*100)
+		fmt.Fprintf(&b, "expired_time_cap_reached_count:%d\r\n", server.statExpiredTimeCapReachedCount)
+		fmt.Fprintf(&b, "expire_cycle_cpu_milliseconds:%d\r\n", server.statExpireCycleTimeUsed/1000)
+		fmt.Fprintf(&b, "pubsub_channels:%d\r\n", len(server.pubsubChannels))
+		fmt.Fprintf(&b, "pubsub_patterns:%d\r\n", len(server.pubsubPatterns))
+		fmt.Fprintf(&b, "sync_full:%d\r\n", server.statSyncFull)
+		fmt.Fprintf(&b, "sync_partial_ok:%d\r\n", server.statSyncPartialOk)
+		fmt.Fprintf(&b, "sync_partial_err:%d\r\n", server.statSyncPartialErr)
+	}
+	if section("Replication") {
+		now := GetMsTime() / 1000
+		if server.masterhost == "" {
+			b.WriteString("role:master\r\n")
+		} else {
+			b.WriteString("role:slave\r\n")
+			fmt.Fprintf(&b, "master_host:%s\r\n", server.masterhost)
+			fmt.Fprintf(&b, "master_port:%d\r\n", server.masterport)
+			linkStatus := "down"
+			if server.replState == REPL_STATE_CONNECTED {
+				linkStatus = "up"
+			}
+			fmt.Fprintf(&b, "master_link_status:%s\r\n", linkStatus)
+			lastIo, reploff := int64(-1), int64(0)
+			if server.master != nil {
+				lastIo, reploff = now-server.master.lastinteraction, server.master.reploff
+			}
+			fmt.Fprintf(&b, "master_last_io_seconds_ago:%d\r\n", lastIo)
+			fmt.Fprintf(&b, "master_sync_in_progress:%d\r\n", boolToInt(server.replState == REPL_STATE_TRANSFER))
+			fmt.Fprintf(&b, "slave_repl_offset:%d\r\n", reploff)
+			if server.replState == REPL_STATE_TRANSFER {
+				fmt.Fprintf(&b, "master_sync_total_bytes:%d\r\n", server.replTransferSize)
+				fmt.Fprintf(&b, "master_sync_read_bytes:%d\r\n", len(server.replTransferBuf))
+				fmt.Fprintf(&b, "master_sync_last_io_seconds_ago:%d\r\n", now-server.replTransferLastio)
+			}
+			if server.replState != REPL_STATE_CONNECTED {
+				fmt.Fprintf(&b, "master_link_down_since_seconds:%d\r\n", now-server.replDownSince)
+			}
+			fmt.Fprintf(&b, "slave_read_only:%d\r\n", boolToInt(server.replSlaveRo))
+		}
+		fmt.Fprintf(&b, "connected_slaves:%d\r\n", len(server.slaves))
+		for i, slave := range server.slaves {
+			name := replicationGetSlaveName(slave)
+			state := "online"
+			switch slave.slaveReplState {
+			case SLAVE_STATE_WAIT_BGSAVE_START, SLAVE_STATE_WAIT_BGSAVE_END:
+				state = "wait_bgsave"
+			case SLAVE_STATE_SEND_BULK:
+				state = "send_bulk"
+			}
+			fmt.Fprintf(&b, "slave%d:ip=%s,port=%d,state=%s,offset=%d,lag=%d\r\n",
+				i, name[:strings.LastIndexByte(name, ':')], slave.slaveListeningPort, state, slave.replAckOff, now-slave.replAckTime)
+		}
+		fmt.Fprintf(&b, "master_replid:%s\r\n", server.replid)
+		fmt.Fprintf(&b, "master_replid2:%s\r\n", server.replid2)
+		fmt.Fprintf(&b, "master_repl_offset:%d\r\n", server.masterReplOffset)
+		fmt.Fprintf(&b, "second_repl_offset:%d\r\n", server.secondReplidOffset)
+		fmt.Fprintf(&b, "repl_backlog_active:%d\r\n", boolToInt(server.replBacklog != nil))
+		fmt.Fprintf(&b, "repl_backlog_size:%d\r\n", server.replBacklogSize)
+		fmt.Fprintf(&b, "repl_backlog_first_byte_offset:%d\r\n", server.replBacklogOff)
+		fmt.Fprintf(&b, "repl_backlog_histlen:%d\r\n", server.replBacklogHistlen)
+	}
+	if section("Cluster") {
+		fmt.Fprintf(&b, "cluster_enabled:%d\r\n", boolToInt(server.clusterEnabled))
+	}
+	if section("Keyspace") {
+		for _, db := range server.dbs {
+			if keys := db.data.Len(); keys > 0 {
+				fmt.Fprintf(&b, "db%d:keys=%d,expires=%d,avg_ttl=%d\r\n", db.id, keys, db.expire.Len(), db.avgTTL)
+			}
+		}
+	}
+	return b.String()
+}
+
+// 和 redis 的 bytesToHuman 一样 保留两位小数
+func bytesToHuman(n int64) string {
+	d := float64(n)
+	switch {
+	case n < 1024:
+		return fmt.Sprintf("%dB", n)
+	case n < 1024*1024:
+		return fmt.Sprintf("%.2fK", d/1024)
+	case n < 1024*1024*1024:
+		return fmt.Sprintf("%.2fM", d/(1024*1024))
+	case n < 1024*1024*1024*1024:
+		return fmt.Sprintf("%.2fG", d/(1024*1024*1024))
+	}
+	return fmt.Sprintf("%.2fT", d/(1024*1024*1024*1024))
+}
+
+// INFO [section [section ...]]
+func infoCommand(c *GodisClient) {
+	sections := make([]string, 0, len(c.args)-1)
+	for _, arg := range c.args[1:] {
+		sections = append(sections, arg.StrVal())
+	}
+	c.AddReplyVerbatim(genGodisInfoString(sections), "txt")
+}
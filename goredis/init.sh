@@ -4,4 +4,4 @@ if [ $? -ne 0 ]; then
  echo "build fail"
  exit 1
 fi
-./goredis
+./goredis godis.conf
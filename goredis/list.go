@@ -78,29 +78,74 @@ func (list *List) DelNode(n *Node) {
 	if n == nil {
 		return
 	}
-	if list.head == n {
-		if n.next != nil {
-			n.next.prev = nil
-		}
+	if n.prev != nil {
+		n.prev.next = n.next
+	} else {
 		list.head = n.next
-		n.next = nil
-	} else if list.tail == n {
-		if n.prev != nil {
-			n.prev.next = nil
-		}
+	}
+	if n.next != nil {
+		n.next.prev = n.prev
+	} else {
 		list.tail = n.prev
-		n.prev = nil
+	}
+	n.prev = nil
+	n.next = nil
+	list.length -= 1
+}
+
+// 在 old 的前面或后面插入新节点
+func (list *List) InsertNode(old *Node, val *Gobj, after bool) *Node {
+	var n Node
+	n.Val = val
+	if after {
+		n.prev = old
+		n.next = old.next
+		if list.tail == old {
+			list.tail = &n
+		}
 	} else {
-		if n.prev != nil {
-			n.prev.next = n.next
+		n.next = old
+		n.prev = old.prev
+		if list.head == old {
+			list.head = &n
 		}
-		if n.next != nil {
-			n.next.prev = n.prev
+	}
+	if n.prev != nil {
+		n.prev.next = &n
+	}
+	if n.next != nil {
+		n.next.prev = &n
+	}
+	list.length += 1
+	return &n
+}
+
+// 下标从 0 开始 负数表示从尾部开始计数 -1 为最后一个
+func (list *List) Index(index int) *Node {
+	var n *Node
+	if index < 0 {
+		index = -index - 1
+		n = list.tail
+		for n != nil && index > 0 {
+			n = n.prev
+			index--
+		}
+	} else {
+		n = list.head
+		for n != nil && index > 0 {
+			n = n.next
+			index--
 		}
-		n.prev = nil
-		n.next = nil
 	}
-	list.length -= 1
+	return n
+}
+
+func (n *Node) Next() *Node {
+	return n.next
+}
+
+func (n *Node) Prev() *Node {
+	return n.prev
 }
 
 func (list *List) Delete(val *Gobj) {
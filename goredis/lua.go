@@ -0,0 +1,877 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+/*
+Lua 的值
+nil 对应 Go 的 nil 其余为 bool / float64 / string / *luaTable / *luaClosure / *luaGoFunction
+*/
+type luaValue interface{}
+
+type luaGoFunction struct {
+	name string
+	fn   func(L *luaState, args []luaValue) ([]luaValue, error)
+}
+
+type luaClosure struct {
+	proto *luaFunctionExpr
+	scope *luaScope
+}
+
+/*
+数组部分保存下标 1..len(arr) 的元素 最后一个元素不为 nil
+哈希部分按插入顺序记录 key 供 next 遍历使用 删除的 key 在下次插入新 key 时整理
+*/
+type luaTable struct {
+	arr    []luaValue
+	hash   map[luaValue]luaValue
+	keys   []luaValue
+	keyIdx map[luaValue]int
+	// 只读的表 比如 EVAL 的全局表和 redis 库
+	readonly bool
+}
+
+func newLuaTable() *luaTable {
+	return &luaTable{}
+}
+
+// 整数形式的数字返回对应的下标
+func luaArrayIndex(k luaValue) (int, bool) {
+	n, ok := k.(float64)
+	if !ok || n != math.Floor(n) || n < 1 || n > math.MaxInt32 {
+		return 0, false
+	}
+	return int(n), true
+}
+
+func (t *luaTable) Get(k luaValue) luaValue {
+	if i, ok := luaArrayIndex(k); ok && i <= len(t.arr) {
+		return t.arr[i-1]
+	}
+	if t.hash == nil {
+		return nil
+	}
+	return t.hash[k]
+}
+
+func (t *luaTable) GetStr(k string) luaValue {
+	return t.Get(k)
+}
+
+func (t *luaTable) Set(k, v luaValue) {
+	if i, ok := luaArrayIndex(k); ok {
+		if i <= len(t.arr) {
+			t.arr[i-1] = v
+			for len(t.arr) > 0 && t.arr[len(t.arr)-1] == nil {
+				t.arr = t.arr[:len(t.arr)-1]
+			}
+			return
+		}
+		if i == len(t.arr)+1 && v != nil {
+			t.arr = append(t.arr, v)
+			t.hashDelete(k)
+			// 哈希部分中紧接着的下标移动到数组部分
+			for t.hash != nil {
+				next := float64(len(t.arr) + 1)
+				nv, ok := t.hash[next]
+				if !ok {
+					break
+				}
+				t.arr = append(t.arr, nv)
+				t.hashDelete(next)
+			}
+			return
+		}
+	}
+	if v == nil {
+		t.hashDelete(k)
+		return
+	}
+	if t.hash == nil {
+		t.hash = make(map[luaValue]luaValue)
+		t.keyIdx = make(map[luaValue]int)
+	}
+	if _, ok := t.hash[k]; !ok {
+		if _, ok := t.keyIdx[k]; !ok {
+			if len(t.keys) > 2*len(t.hash)+8 {
+				t.compactKeys()
+			}
+			t.keyIdx[k] = len(t.keys)
+			t.keys = append(t.keys, k)
+		}
+	}
+	t.hash[k] = v
+}
+
+func (t *luaTable) hashDelete(k luaValue) {
+	if t.hash != nil {
+		delete(t.hash, k)
+	}
+}
+
+func (t *luaTable) compactKeys() {
+	keys := make([]luaValue, 0, len(t.hash))
+	t.keyIdx = make(map[luaValue]int, len(t.hash))
+	for _, k := range t.keys {
+		if _, ok := t.hash[k]; ok {
+			t.keyIdx[k] = len(keys)
+			keys = append(keys, k)
+		}
+	}
+	t.keys = keys
+}
+
+func (t *luaTable) Len() int {
+	return len(t.arr)
+}
+
+// 返回 k 之后的下一个 key 遍历结束时返回 nil
+func (t *luaTable) Next(k luaValue) (luaValue, luaValue, bool) {
+	start := 0
+	if k != nil {
+		if i, ok := luaArrayIndex(k); ok && i <= len(t.arr) {
+			start = i
+		} else {
+			idx, ok := t.keyIdx[k]
+			if !ok {
+				return nil, nil, false
+			}
+			return t.nextHash(idx + 1)
+		}
+	}
+	for i := start; i < len(t.arr); i++ {
+		if t.arr[i] != nil {
+			return float64(i + 1), t.arr[i], true
+		}
+	}
+	return t.nextHash(0)
+}
+
+func (t *luaTable) nextHash(from int) (luaValue, luaValue, bool) {
+	for i := from; i < len(t.keys); i++ {
+		if v, ok := t.hash[t.keys[i]]; ok {
+			return t.keys[i], v, true
+		}
+	}
+	return nil, nil, true
+}
+
+// 作用域链 每个块一个作用域 闭包持有定义时的作用域
+type luaScope struct {
+	parent *luaScope
+	vars   map[string]*luaValue
+}
+
+func newLuaScope(parent *luaScope) *luaScope {
+	return &luaScope{parent: parent}
+}
+
+func (s *luaScope) lookup(name string) *luaValue {
+	for ; s != nil; s = s.parent {
+		if cell, ok := s.vars[name]; ok {
+			return cell
+		}
+	}
+	return nil
+}
+
+func (s *luaScope) define(name string, v luaValue) {
+	if s.vars == nil {
+		s.vars = make(map[string]*luaValue)
+	}
+	s.vars[name] = &v
+}
+
+// Lua 的 error 抛出的值 可以被 pcall 捕获
+type luaError struct {
+	value luaValue
+}
+
+func (e *luaError) Error() string {
+	if s, ok := e.value.(string); ok {
+		return s
+	}
+	if t, ok := e.value.(*luaTable); ok {
+		if msg, ok := t.GetStr("err").(string); ok {
+			return msg
+		}
+	}
+	return luaToString(e.value)
+}
+
+// 函数调用的最大深度 避免无限递归耗尽栈
+const LUA_MAX_CALL_DEPTH = 200
+
+// 每执行这么多步调用一次 hook
+const LUA_HOOK_STEPS = 1000
+
+type luaState struct {
+	globals *luaTable
+	// 非 nil 时每隔 LUA_HOOK_STEPS 步调用 返回错误时终止脚本 pcall 不能捕获
+	hook  func() error
+	steps int
+	depth int
+	line  int // 当前执行的行号
+}
+
+func newLuaState() *luaState {
+	L := &luaState{globals: newLuaTable()}
+	luaOpenBaseLib(L)
+	return L
+}
+
+func (L *luaState) errorf(format string, v ...interface{}) error {
+	return &luaError{fmt.Sprintf("user_script:%d: ", L.line) + fmt.Sprintf(format, v...)}
+}
+
+func (L *luaState) step() error {
+	L.steps++
+	if L.hook != nil && L.steps%LUA_HOOK_STEPS == 0 {
+		return L.hook()
+	}
+	return nil
+}
+
+func (L *luaState) register(name string, fn func(L *luaState, args []luaValue) ([]luaValue, error)) {
+	L.globals.Set(name, &luaGoFunction{name, fn})
+}
+
+// 执行解析后的代码块 返回 return 的值
+func (L *luaState) Exec(body []luaStat) ([]luaValue, error) {
+	L.steps, L.depth, L.line = 0, 0, 0
+	ctrl, rets, err := L.execBlock(body, newLuaScope(nil))
+	if err != nil {
+		return nil, err
+	}
+	if ctrl == luaCtrlBreak {
+		return nil, L.errorf("no loop to break")
+	}
+	return rets, nil
+}
+
+const (
+	luaCtrlNone = iota
+	luaCtrlBreak
+	luaCtrlReturn
+)
+
+func (L *luaState) execBlock(body []luaStat, scope *luaScope) (int, []luaValue, error) {
+	for _, stat := range body {
+		ctrl, rets, err := L.execStat(stat, scope)
+		if err != nil || ctrl != luaCtrlNone {
+			return ctrl, rets, err
+		}
+	}
+	return luaCtrlNone, nil, nil
+}
+
+func (L *luaState) execStat(stat luaStat, scope *luaScope) (int, []luaValue, error) {
+	switch s := stat.(type) {
+	case *luaLineStat:
+		L.line = s.line
+		return luaCtrlNone, nil, L.step()
+	case *luaLocalStat:
+		values, err := L.evalExprList(s.exprs, scope, len(s.names))
+		if err != nil {
+			return 0, nil, err
+		}
+		for i, name := range s.names {
+			scope.define(name, values[i])
+		}
+	case *luaLocalFunctionStat:
+		// 先定义再创建闭包 函数内可以递归调用自己
+		scope.define(s.name, nil)
+		*scope.lookup(s.name) = &luaClosure{s.fn, scope}
+	case *luaAssignStat:
+		return luaCtrlNone, nil, L.execAssign(s, scope)
+	case *luaCallStat:
+		_, err := L.evalCall(s.call, scope)
+		return luaCtrlNone, nil, err
+	case *luaDoStat:
+		return L.execBlock(s.body, newLuaScope(scope))
+	case *luaWhileStat:
+		for {
+			if err := L.step(); err != nil {
+				return 0, nil, err
+			}
+			cond, err := L.eval(s.cond, scope)
+			if err != nil {
+				return 0, nil, err
+			}
+			if !luaToBoolean(cond) {
+				break
+			}
+			ctrl, rets, err := L.execBlock(s.body, newLuaScope(scope))
+			if err != nil || ctrl == luaCtrlReturn {
+				return ctrl, rets, err
+			}
+			if ctrl == luaCtrlBreak {
+				break
+			}
+		}
+	case *luaRepeatStat:
+		for {
+			if err := L.step(); err != nil {
+				return 0, nil, err
+			}
+			// until 的条件可以使用循环体中的局部变量
+			inner := newLuaScope(scope)
+			ctrl, rets, err := L.execBlock(s.body, inner)
+			if err != nil || ctrl == luaCtrlReturn {
+				return ctrl, rets, err
+			}
+			if ctrl == luaCtrlBreak {
+				break
+			}
+			cond, err := L.eval(s.cond, inner)
+			if err != nil {
+				return 0, nil, err
+			}
+			if luaToBoolean(cond) {
+				break
+			}
+		}
+	case *luaIfStat:
+		for i, c := range s.conds {
+			cond, err := L.eval(c, scope)
+			if err != nil {
+				return 0, nil, err
+			}
+			if luaToBoolean(cond) {
+				return L.execBlock(s.blocks[i], newLuaScope(scope))
+			}
+		}
+		if s.elseBlock != nil {
+			return L.execBlock(s.elseBlock, newLuaScope(scope))
+		}
+	case *luaNumericForStat:
+		return L.execNumericFor(s, scope)
+	case *luaGenericForStat:
+		return L.execGenericFor(s, scope)
+	case *luaReturnStat:
+		// return f() 返回 f 的全部返回值
+		rets, err := L.evalExprList(s.exprs, scope, -1)
+		return luaCtrlReturn, rets, err
+	case *luaBreakStat:
+		return luaCtrlBreak, nil, nil
+	}
+	return luaCtrlNone, nil, nil
+}
+
+func (L *luaState) execAssign(s *luaAssignStat, scope *luaScope) error {
+	// 先计算右边全部的值再赋值 a, b = b, a
+	type target struct {
+		table *luaTable
+		key   luaValue
+		name  string
+	}
+	targets := make([]target, len(s.targets))
+	for i, t := range s.targets {
+		switch e := t.(type) {
+		case *luaNameExpr:
+			targets[i].name = e.name
+		case *luaIndexExpr:
+			obj, err := L.eval(e.obj, scope)
+			if err != nil {
+				return err
+			}
+			key, err := L.eval(e.key, scope)
+			if err != nil {
+				return err
+			}
+			table, ok := obj.(*luaTable)
+			if !ok {
+				L.line = e.line
+				return L.errorf("attempt to index a %s value", luaTypeName(obj))
+			}
+			if key == nil {
+				return L.errorf("table index is nil")
+			}
+			if n, ok := key.(float64); ok && math.IsNaN(n) {
+				return L.errorf("table index is NaN")
+			}
+			targets[i].table, targets[i].key = table, key
+		}
+	}
+	values, err := L.evalExprList(s.exprs, scope, len(s.targets))
+	if err != nil {
+		return err
+	}
+	for i, t := range targets {
+		if t.table != nil {
+			if err := L.setTable(t.table, t.key, values[i]); err != nil {
+				return err
+			}
+		} else if cell := scope.lookup(t.name); cell != nil {
+			*cell = values[i]
+		} else if err := L.setGlobal(t.name, values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 全局表可以通过 readonly 设为只读
+func (L *luaState) setGlobal(name string, v luaValue) error {
+	return L.setTable(L.globals, name, v)
+}
+
+func (L *luaState) setTable(t *luaTable, k, v luaValue) error {
+	if t.readonly {
+		return L.errorf("Attempt to modify a readonly table")
+	}
+	t.Set(k, v)
+	return nil
+}
+
+func (L *luaState) execNumericFor(s *luaNumericForStat, scope *luaScope) (int, []luaValue, error) {
+	var nums [3]float64
+	exprs := []luaExpr{s.start, s.limit, s.step}
+	names := []string{"initial", "limit", "step"}
+	nums[2] = 1
+	for i, e := range exprs {
+		if e == nil {
+			continue
+		}
+		v, err := L.eval(e, scope)
+		if err != nil {
+			return 0, nil, err
+		}
+		n, ok := luaToNumber(v)
+		if !ok {
+			L.line = s.line
+			return 0, nil, L.errorf("'for' %s value must be a number", names[i])
+		}
+		nums[i] = n
+	}
+	start, limit, step := nums[0], nums[1], nums[2]
+	for i := start; (step > 0 && i <= limit) || (step <= 0 && i >= limit); i += step {
+		if err := L.step(); err != nil {
+			return 0, nil, err
+		}
+		inner := newLuaScope(scope)
+		inner.define(s.name, i)
+		ctrl, rets, err := L.execBlock(s.body, inner)
+		if err != nil || ctrl == luaCtrlReturn {
+			return ctrl, rets, err
+		}
+		if ctrl == luaCtrlBreak {
+			break
+		}
+	}
+	return luaCtrlNone, nil, nil
+}
+
+// for k, v in f, s, var do
+func (L *luaState) execGenericFor(s *luaGenericForStat, scope *luaScope) (int, []luaValue, error) {
+	init, err := L.evalExprList(s.exprs, scope, 3)
+	if err != nil {
+		return 0, nil, err
+	}
+	fn, state, control := init[0], init[1], init[2]
+	for {
+		if err := L.step(); err != nil {
+			return 0, nil, err
+		}
+		L.line = s.line
+		rets, err := L.call(fn, []luaValue{state, control})
+		if err != nil {
+			return 0, nil, err
+		}
+		if len(rets) == 0 || rets[0] == nil {
+			break
+		}
+		control = rets[0]
+		inner := newLuaScope(scope)
+		for i, name := range s.names {
+			var v luaValue
+			if i < len(rets) {
+				v = rets[i]
+			}
+			inner.define(name, v)
+		}
+		ctrl, rets, err := L.execBlock(s.body, inner)
+		if err != nil || ctrl == luaCtrlReturn {
+			return ctrl, rets, err
+		}
+		if ctrl == luaCtrlBreak {
+			break
+		}
+	}
+	return luaCtrlNone, nil, nil
+}
+
+/*
+计算表达式列表 最后一个表达式是函数调用时展开全部返回值
+want >= 0 时补齐或截断为 want 个值
+*/
+func (L *luaState) evalExprList(exprs []luaExpr, scope *luaScope, want int) ([]luaValue, error) {
+	var values []luaValue
+	for i, e := range exprs {
+		if call, ok := e.(*luaCallExpr); ok && i == len(exprs)-1 {
+			rets, err := L.evalCall(call, scope)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, rets...)
+			continue
+		}
+		v, err := L.eval(e, scope)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	if want >= 0 {
+		for len(values) < want {
+			values = append(values, nil)
+		}
+		values = values[:want]
+	}
+	return values, nil
+}
+
+func (L *luaState) eval(e luaExpr, scope *luaScope) (luaValue, error) {
+	switch x := e.(type) {
+	case *luaConstExpr:
+		return x.value, nil
+	case *luaNameExpr:
+		if cell := scope.lookup(x.name); cell != nil {
+			return *cell, nil
+		}
+		v := L.globals.Get(x.name)
+		if v == nil && L.globals.readonly {
+			L.line = x.line
+			return nil, L.errorf("Script attempted to access nonexistent global variable '%s'", x.name)
+		}
+		return v, nil
+	case *luaIndexExpr:
+		obj, err := L.eval(x.obj, scope)
+		if err != nil {
+			return nil, err
+		}
+		key, err := L.eval(x.key, scope)
+		if err != nil {
+			return nil, err
+		}
+		return L.index(obj, key, x.line)
+	case *luaCallExpr:
+		rets, err := L.evalCall(x, scope)
+		if err != nil || len(rets) == 0 {
+			return nil, err
+		}
+		return rets[0], nil
+	case *luaParenExpr:
+		return L.eval(x.expr, scope)
+	case *luaFunctionExpr:
+		return &luaClosure{x, scope}, nil
+	case *luaTableExpr:
+		return L.evalTable(x, scope)
+	case *luaUnOpExpr:
+		v, err := L.eval(x.expr, scope)
+		if err != nil {
+			return nil, err
+		}
+		L.line = x.line
+		return L.unaryOp(x.op, v)
+	case *luaBinOpExpr:
+		return L.evalBinOp(x, scope)
+	}
+	return nil, L.errorf("unknown expression")
+}
+
+func (L *luaState) index(obj, key luaValue, line int) (luaValue, error) {
+	switch o := obj.(type) {
+	case *luaTable:
+		return o.Get(key), nil
+	case string:
+		// 字符串可以直接使用 string 库中的函数 s:upper()
+		if lib, ok := L.globals.GetStr("string").(*luaTable); ok {
+			return lib.Get(key), nil
+		}
+	}
+	L.line = line
+	return nil, L.errorf("attempt to index a %s value", luaTypeName(obj))
+}
+
+func (L *luaState) evalTable(x *luaTableExpr, scope *luaScope) (luaValue, error) {
+	t := newLuaTable()
+	n := 0
+	for i, f := range x.fields {
+		if f.key != nil {
+			key, err := L.eval(f.key, scope)
+			if err != nil {
+				return nil, err
+			}
+			value, err := L.eval(f.value, scope)
+			if err != nil {
+				return nil, err
+			}
+			if key == nil {
+				L.line = x.line
+				return nil, L.errorf("table index is nil")
+			}
+			t.Set(key, value)
+			continue
+		}
+		// 最后一个元素是函数调用时展开全部返回值
+		if call, ok := f.value.(*luaCallExpr); ok && i == len(x.fields)-1 {
+			rets, err := L.evalCall(call, scope)
+			if err != nil {
+				return nil, err
+			}
+			for _, v := range rets {
+				n++
+				t.Set(float64(n), v)
+			}
+			continue
+		}
+		value, err := L.eval(f.value, scope)
+		if err != nil {
+			return nil, err
+		}
+		n++
+		t.Set(float64(n), value)
+	}
+	return t, nil
+}
+
+func (L *luaState) evalCall(x *luaCallExpr, scope *luaScope) ([]luaValue, error) {
+	fn, err := L.eval(x.fn, scope)
+	if err != nil {
+		return nil, err
+	}
+	var args []luaValue
+	if x.method != "" {
+		self := fn
+		if fn, err = L.index(self, x.method, x.line); err != nil {
+			return nil, err
+		}
+		args = append(args, self)
+	}
+	rest, err := L.evalExprList(x.args, scope, -1)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, rest...)
+	L.line = x.line
+	rets, err := L.call(fn, args)
+	L.line = x.line
+	return rets, err
+}
+
+func (L *luaState) call(fn luaValue, args []luaValue) ([]luaValue, error) {
+	L.depth++
+	defer func() { L.depth-- }()
+	if L.depth > LUA_MAX_CALL_DEPTH {
+		return nil, L.errorf("stack overflow")
+	}
+	switch f := fn.(type) {
+	case *luaGoFunction:
+		return f.fn(L, args)
+	case *luaClosure:
+		scope := newLuaScope(f.scope)
+		for i, name := range f.proto.params {
+			var v luaValue
+			if i < len(args) {
+				v = args[i]
+			}
+			scope.define(name, v)
+		}
+		line := L.line
+		_, rets, err := L.execBlock(f.proto.body, scope)
+		L.line = line
+		return rets, err
+	}
+	return nil, L.errorf("attempt to call a %s value", luaTypeName(fn))
+}
+
+func (L *luaState) unaryOp(op string, v luaValue) (luaValue, error) {
+	switch op {
+	case "not":
+		return !luaToBoolean(v), nil
+	case "-":
+		n, ok := luaToNumber(v)
+		if !ok {
+			return nil, L.errorf("attempt to perform arithmetic on a %s value", luaTypeName(v))
+		}
+		return -n, nil
+	case "#":
+		switch x := v.(type) {
+		case string:
+			return float64(len(x)), nil
+		case *luaTable:
+			return float64(x.Len()), nil
+		}
+		return nil, L.errorf("attempt to get length of a %s value", luaTypeName(v))
+	}
+	return nil, L.errorf("unknown operator '%s'", op)
+}
+
+func (L *luaState) evalBinOp(x *luaBinOpExpr, scope *luaScope) (luaValue, error) {
+	lhs, err := L.eval(x.lhs, scope)
+	if err != nil {
+		return nil, err
+	}
+	// and / or 短路求值 返回操作数本身
+	switch x.op {
+	case "and":
+		if !luaToBoolean(lhs) {
+			return lhs, nil
+		}
+		return L.eval(x.rhs, scope)
+	case "or":
+		if luaToBoolean(lhs) {
+			return lhs, nil
+		}
+		return L.eval(x.rhs, scope)
+	}
+	rhs, err := L.eval(x.rhs, scope)
+	if err != nil {
+		return nil, err
+	}
+	L.line = x.line
+	switch x.op {
+	case "==":
+		return lhs == rhs, nil
+	case "~=":
+		return lhs != rhs, nil
+	case "<", "<=", ">", ">=":
+		return L.compare(x.op, lhs, rhs)
+	case "..":
+		ls, ok1 := luaConcatString(lhs)
+		rs, ok2 := luaConcatString(rhs)
+		if !ok1 || !ok2 {
+			bad := lhs
+			if ok1 {
+				bad = rhs
+			}
+			return nil, L.errorf("attempt to concatenate a %s value", luaTypeName(bad))
+		}
+		return ls + rs, nil
+	}
+	a, ok1 := luaToNumber(lhs)
+	b, ok2 := luaToNumber(rhs)
+	if !ok1 || !ok2 {
+		bad := lhs
+		if ok1 {
+			bad = rhs
+		}
+		return nil, L.errorf("attempt to perform arithmetic on a %s value", luaTypeName(bad))
+	}
+	switch x.op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/":
+		return a / b, nil
+	case "%":
+		return a - math.Floor(a/b)*b, nil
+	case "^":
+		return math.Pow(a, b), nil
+	}
+	return nil, L.errorf("unknown operator '%s'", x.op)
+}
+
+func (L *luaState) compare(op string, lhs, rhs luaValue) (luaValue, error) {
+	// a > b 等价于 b < a
+	if op == ">" || op == ">=" {
+		lhs, rhs = rhs, lhs
+		op = map[string]string{">": "<", ">=": "<="}[op]
+	}
+	switch a := lhs.(type) {
+	case float64:
+		if b, ok := rhs.(float64); ok {
+			if op == "<" {
+				return a < b, nil
+			}
+			return a <= b, nil
+		}
+	case string:
+		if b, ok := rhs.(string); ok {
+			if op == "<" {
+				return a < b, nil
+			}
+			return a <= b, nil
+		}
+	}
+	t1, t2 := luaTypeName(lhs), luaTypeName(rhs)
+	if t1 == t2 {
+		return nil, L.errorf("attempt to compare two %s values", t1)
+	}
+	return nil, L.errorf("attempt to compare %s with %s", t1, t2)
+}
+
+func luaToBoolean(v luaValue) bool {
+	if v == nil {
+		return false
+	}
+	if b, ok := v.(bool); ok {
+		return b
+	}
+	return true
+}
+
+// 算术运算中字符串会被转换成数字
+func luaToNumber(v luaValue) (float64, bool) {
+	switch x := v.(type) {
+	case float64:
+		return x, true
+	case string:
+		return luaStringToNumber(x)
+	}
+	return 0, false
+}
+
+func luaConcatString(v luaValue) (string, bool) {
+	switch x := v.(type) {
+	case string:
+		return x, true
+	case float64:
+		return luaNumberToString(x), true
+	}
+	return "", false
+}
+
+func luaTypeName(v luaValue) string {
+	switch v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *luaTable:
+		return "table"
+	case *luaClosure, *luaGoFunction:
+		return "function"
+	}
+	return "userdata"
+}
+
+func luaToString(v luaValue) string {
+	switch x := v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		if x {
+			return "true"
+		}
+		return "false"
+	case float64:
+		return luaNumberToString(x)
+	case string:
+		return x
+	case *luaGoFunction:
+		return fmt.Sprintf("builtin: %p", x)
+	}
+	return fmt.Sprintf("%s: %p", luaTypeName(v), v)
+}
@@ -0,0 +1,671 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+/*
+脚本可以使用的标准库
+只提供 base / string / table / math 中常用的函数 没有 io / os / loadstring
+*/
+func luaOpenBaseLib(L *luaState) {
+	L.register("type", luaBaseType)
+	L.register("tostring", luaBaseTostring)
+	L.register("tonumber", luaBaseTonumber)
+	L.register("pcall", luaBasePcall)
+	L.register("error", luaBaseError)
+	L.register("assert", luaBaseAssert)
+	L.register("ipairs", luaBaseIpairs)
+	L.register("pairs", luaBasePairs)
+	L.register("next", luaBaseNext)
+	L.register("unpack", luaBaseUnpack)
+	L.register("select", luaBaseSelect)
+	L.register("rawget", luaBaseRawget)
+	L.register("rawset", luaBaseRawset)
+	L.register("rawequal", luaBaseRawequal)
+
+	str := newLuaTable()
+	luaSetFunctions(str, map[string]func(*luaState, []luaValue) ([]luaValue, error){
+		"len":     luaStringLen,
+		"sub":     luaStringSub,
+		"upper":   luaStringUpper,
+		"lower":   luaStringLower,
+		"rep":     luaStringRep,
+		"reverse": luaStringReverse,
+		"byte":    luaStringByte,
+		"char":    luaStringChar,
+		"format":  luaStringFormat,
+	})
+	L.globals.Set("string", str)
+
+	tbl := newLuaTable()
+	luaSetFunctions(tbl, map[string]func(*luaState, []luaValue) ([]luaValue, error){
+		"insert": luaTableInsert,
+		"remove": luaTableRemove,
+		"concat": luaTableConcat,
+		"getn":   luaTableGetn,
+	})
+	L.globals.Set("table", tbl)
+
+	m := newLuaTable()
+	luaSetFunctions(m, map[string]func(*luaState, []luaValue) ([]luaValue, error){
+		"floor": luaMathFunc(math.Floor),
+		"ceil":  luaMathFunc(math.Ceil),
+		"abs":   luaMathFunc(math.Abs),
+		"sqrt":  luaMathFunc(math.Sqrt),
+		"max":   luaMathMax,
+		"min":   luaMathMin,
+		"fmod":  luaMathFmod,
+		"pow":   luaMathPow,
+	})
+	m.Set("huge", math.Inf(1))
+	m.Set("pi", math.Pi)
+	L.globals.Set("math", m)
+}
+
+func luaSetFunctions(t *luaTable, funcs map[string]func(*luaState, []luaValue) ([]luaValue, error)) {
+	for name, fn := range funcs {
+		t.Set(name, &luaGoFunction{name, fn})
+	}
+}
+
+// 取第 n 个参数 不存在时为 nil
+func luaArg(args []luaValue, n int) luaValue {
+	if n < len(args) {
+		return args[n]
+	}
+	return nil
+}
+
+func (L *luaState) argError(n int, fname, msg string) error {
+	return L.errorf("bad argument #%d to '%s' (%s)", n+1, fname, msg)
+}
+
+func (L *luaState) checkNumber(args []luaValue, n int, fname string) (float64, error) {
+	v, ok := luaToNumber(luaArg(args, n))
+	if !ok {
+		return 0, L.argError(n, fname, "number expected, got "+luaTypeName(luaArg(args, n)))
+	}
+	return v, nil
+}
+
+// 可选的数字参数 没有传时使用默认值
+func (L *luaState) optNumber(args []luaValue, n int, fname string, def float64) (float64, error) {
+	if luaArg(args, n) == nil {
+		return def, nil
+	}
+	return L.checkNumber(args, n, fname)
+}
+
+// 数字也可以作为字符串参数
+func (L *luaState) checkString(args []luaValue, n int, fname string) (string, error) {
+	s, ok := luaConcatString(luaArg(args, n))
+	if !ok {
+		return "", L.argError(n, fname, "string expected, got "+luaTypeName(luaArg(args, n)))
+	}
+	return s, nil
+}
+
+func (L *luaState) checkTable(args []luaValue, n int, fname string) (*luaTable, error) {
+	t, ok := luaArg(args, n).(*luaTable)
+	if !ok {
+		return nil, L.argError(n, fname, "table expected, got "+luaTypeName(luaArg(args, n)))
+	}
+	return t, nil
+}
+
+func luaBaseType(L *luaState, args []luaValue) ([]luaValue, error) {
+	if len(args) == 0 {
+		return nil, L.argError(0, "type", "value expected")
+	}
+	return []luaValue{luaTypeName(args[0])}, nil
+}
+
+func luaBaseTostring(L *luaState, args []luaValue) ([]luaValue, error) {
+	if len(args) == 0 {
+		return nil, L.argError(0, "tostring", "value expected")
+	}
+	return []luaValue{luaToString(args[0])}, nil
+}
+
+func luaBaseTonumber(L *luaState, args []luaValue) ([]luaValue, error) {
+	base, err := L.optNumber(args, 1, "tonumber", 10)
+	if err != nil {
+		return nil, err
+	}
+	if base == 10 {
+		if n, ok := luaToNumber(luaArg(args, 0)); ok {
+			return []luaValue{n}, nil
+		}
+		return []luaValue{nil}, nil
+	}
+	if base < 2 || base > 36 {
+		return nil, L.argError(1, "tonumber", "base out of range")
+	}
+	s, err := L.checkString(args, 0, "tonumber")
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.ParseUint(strings.ToLower(strings.TrimSpace(s)), int(base), 64)
+	if err != nil {
+		return []luaValue{nil}, nil
+	}
+	return []luaValue{float64(n)}, nil
+}
+
+/*
+pcall 只捕获脚本中的错误
+hook 返回的错误（比如 SCRIPT KILL）不能被捕获 必须终止整个脚本
+*/
+func luaBasePcall(L *luaState, args []luaValue) ([]luaValue, error) {
+	if len(args) == 0 {
+		return nil, L.argError(0, "pcall", "value expected")
+	}
+	depth, line := L.depth, L.line
+	rets, err := L.call(args[0], args[1:])
+	if err != nil {
+		lerr, ok := err.(*luaError)
+		if !ok {
+			return nil, err
+		}
+		L.depth, L.line = depth, line
+		return []luaValue{false, lerr.value}, nil
+	}
+	return append([]luaValue{true}, rets...), nil
+}
+
+// error(message [, level]) level 为 0 时不添加位置信息
+func luaBaseError(L *luaState, args []luaValue) ([]luaValue, error) {
+	msg := luaArg(args, 0)
+	level, err := L.optNumber(args, 1, "error", 1)
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := msg.(string); ok && level > 0 {
+		msg = fmt.Sprintf("user_script:%d: %s", L.line, s)
+	}
+	return nil, &luaError{msg}
+}
+
+func luaBaseAssert(L *luaState, args []luaValue) ([]luaValue, error) {
+	if luaToBoolean(luaArg(args, 0)) {
+		return args, nil
+	}
+	if len(args) > 1 {
+		return nil, &luaError{args[1]}
+	}
+	return nil, L.errorf("assertion failed!")
+}
+
+func luaIpairsIter(L *luaState, args []luaValue) ([]luaValue, error) {
+	t, err := L.checkTable(args, 0, "ipairs")
+	if err != nil {
+		return nil, err
+	}
+	i, _ := luaToNumber(luaArg(args, 1))
+	v := t.Get(i + 1)
+	if v == nil {
+		return []luaValue{nil}, nil
+	}
+	return []luaValue{i + 1, v}, nil
+}
+
+func luaBaseIpairs(L *luaState, args []luaValue) ([]luaValue, error) {
+	t, err := L.checkTable(args, 0, "ipairs")
+	if err != nil {
+		return nil, err
+	}
+	return []luaValue{&luaGoFunction{"ipairs_iter", luaIpairsIter}, t, float64(0)}, nil
+}
+
+func luaBaseNext(L *luaState, args []luaValue) ([]luaValue, error) {
+	t, err := L.checkTable(args, 0, "next")
+	if err != nil {
+		return nil, err
+	}
+	k, v, ok := t.Next(luaArg(args, 1))
+	if !ok {
+		return nil, L.errorf("invalid key to 'next'")
+	}
+	if k == nil {
+		return []luaValue{nil}, nil
+	}
+	return []luaValue{k, v}, nil
+}
+
+func luaBasePairs(L *luaState, args []luaValue) ([]luaValue, error) {
+	t, err := L.checkTable(args, 0, "pairs")
+	if err != nil {
+		return nil, err
+	}
+	return []luaValue{L.globals.GetStr("next"), t, nil}, nil
+}
+
+// unpack(list [, i [, j]])
+func luaBaseUnpack(L *luaState, args []luaValue) ([]luaValue, error) {
+	t, err := L.checkTable(args, 0, "unpack")
+	if err != nil {
+		return nil, err
+	}
+	i, err := L.optNumber(args, 1, "unpack", 1)
+	if err != nil {
+		return nil, err
+	}
+	j, err := L.optNumber(args, 2, "unpack", float64(t.Len()))
+	if err != nil {
+		return nil, err
+	}
+	if j-i >= 8000 {
+		return nil, L.errorf("too many results to unpack")
+	}
+	var rets []luaValue
+	for k := i; k <= j; k++ {
+		rets = append(rets, t.Get(k))
+	}
+	return rets, nil
+}
+
+// select(n, ...) 或者 select('#', ...)
+func luaBaseSelect(L *luaState, args []luaValue) ([]luaValue, error) {
+	if s, ok := luaArg(args, 0).(string); ok && s == "#" {
+		return []luaValue{float64(len(args) - 1)}, nil
+	}
+	n, err := L.checkNumber(args, 0, "select")
+	if err != nil {
+		return nil, err
+	}
+	i := int(n)
+	if i < 0 {
+		i = len(args) + i
+	}
+	if i < 1 {
+		return nil, L.argError(0, "select", "index out of range")
+	}
+	if i >= len(args) {
+		return nil, nil
+	}
+	return args[i:], nil
+}
+
+func luaBaseRawget(L *luaState, args []luaValue) ([]luaValue, error) {
+	t, err := L.checkTable(args, 0, "rawget")
+	if err != nil {
+		return nil, err
+	}
+	return []luaValue{t.Get(luaArg(args, 1))}, nil
+}
+
+func luaBaseRawset(L *luaState, args []luaValue) ([]luaValue, error) {
+	t, err := L.checkTable(args, 0, "rawset")
+	if err != nil {
+		return nil, err
+	}
+	if luaArg(args, 1) == nil {
+		return nil, L.errorf("table index is nil")
+	}
+	if err := L.setTable(t, args[1], luaArg(args, 2)); err != nil {
+		return nil, err
+	}
+	return []luaValue{t}, nil
+}
+
+func luaBaseRawequal(L *luaState, args []luaValue) ([]luaValue, error) {
+	return []luaValue{luaArg(args, 0) == luaArg(args, 1)}, nil
+}
+
+func luaStringLen(L *luaState, args []luaValue) ([]luaValue, error) {
+	s, err := L.checkString(args, 0, "len")
+	if err != nil {
+		return nil, err
+	}
+	return []luaValue{float64(len(s))}, nil
+}
+
+// 把 Lua 的下标（从 1 开始 负数从末尾计算）转换成 [0, n] 的位置
+func luaStringPos(pos float64, n int) int {
+	i := int(pos)
+	if i < 0 {
+		i = n + i + 1
+	}
+	return i
+}
+
+// string.sub(s, i [, j])
+func luaStringSub(L *luaState, args []luaValue) ([]luaValue, error) {
+	s, err := L.checkString(args, 0, "sub")
+	if err != nil {
+		return nil, err
+	}
+	i, err := L.optNumber(args, 1, "sub", 1)
+	if err != nil {
+		return nil, err
+	}
+	j, err := L.optNumber(args, 2, "sub", -1)
+	if err != nil {
+		return nil, err
+	}
+	start, end := luaStringPos(i, len(s)), luaStringPos(j, len(s))
+	if start < 1 {
+		start = 1
+	}
+	if end > len(s) {
+		end = len(s)
+	}
+	if start > end {
+		return []luaValue{""}, nil
+	}
+	return []luaValue{s[start-1 : end]}, nil
+}
+
+func luaStringUpper(L *luaState, args []luaValue) ([]luaValue, error) {
+	s, err := L.checkString(args, 0, "upper")
+	if err != nil {
+		return nil, err
+	}
+	return []luaValue{strings.ToUpper(s)}, nil
+}
+
+func luaStringLower(L *luaState, args []luaValue) ([]luaValue, error) {
+	s, err := L.checkString(args, 0, "lower")
+	if err != nil {
+		return nil, err
+	}
+	return []luaValue{strings.ToLower(s)}, nil
+}
+
+func luaStringRep(L *luaState, args []luaValue) ([]luaValue, error) {
+	s, err := L.checkString(args, 0, "rep")
+	if err != nil {
+		return nil, err
+	}
+	n, err := L.checkNumber(args, 1, "rep")
+	if err != nil {
+		return nil, err
+	}
+	if n <= 0 {
+		return []luaValue{""}, nil
+	}
+	if float64(len(s))*n > float64(server.protoMaxBulkLen) {
+		return nil, L.errorf("resulting string too large")
+	}
+	return []luaValue{strings.Repeat(s, int(n))}, nil
+}
+
+func luaStringReverse(L *luaState, args []luaValue) ([]luaValue, error) {
+	s, err := L.checkString(args, 0, "reverse")
+	if err != nil {
+		return nil, err
+	}
+	b := []byte(s)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return []luaValue{string(b)}, nil
+}
+
+// string.byte(s [, i [, j]])
+func luaStringByte(L *luaState, args []luaValue) ([]luaValue, error) {
+	s, err := L.checkString(args, 0, "byte")
+	if err != nil {
+		return nil, err
+	}
+	i, err := L.optNumber(args, 1, "byte", 1)
+	if err != nil {
+		return nil, err
+	}
+	j, err := L.optNumber(args, 2, "byte", i)
+	if err != nil {
+		return nil, err
+	}
+	start, end := luaStringPos(i, len(s)), luaStringPos(j, len(s))
+	if start < 1 {
+		start = 1
+	}
+	if end > len(s) {
+		end = len(s)
+	}
+	var rets []luaValue
+	for k := start; k <= end; k++ {
+		rets = append(rets, float64(s[k-1]))
+	}
+	return rets, nil
+}
+
+func luaStringChar(L *luaState, args []luaValue) ([]luaValue, error) {
+	b := make([]byte, len(args))
+	for i := range args {
+		n, err := L.checkNumber(args, i, "char")
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 || n > 255 {
+			return nil, L.argError(i, "char", "invalid value")
+		}
+		b[i] = byte(n)
+	}
+	return []luaValue{string(b)}, nil
+}
+
+// string.format 支持 %d %i %u %c %x %X %o %e %E %f %g %G %q %s %%
+func luaStringFormat(L *luaState, args []luaValue) ([]luaValue, error) {
+	format, err := L.checkString(args, 0, "format")
+	if err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	argn := 1
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			b.WriteByte(format[i])
+			continue
+		}
+		i++
+		if i < len(format) && format[i] == '%' {
+			b.WriteByte('%')
+			continue
+		}
+		// 标志 宽度 精度
+		start := i
+		for i < len(format) && strings.IndexByte("-+ #0123456789.", format[i]) >= 0 {
+			i++
+		}
+		if i >= len(format) {
+			return nil, L.errorf("invalid option '%%' to 'format'")
+		}
+		spec := "%" + format[start:i]
+		conv := format[i]
+		if argn >= len(args) {
+			return nil, L.argError(argn, "format", "no value")
+		}
+		switch conv {
+		case 'd', 'i', 'c', 'x', 'X', 'o', 'u':
+			n, err := L.checkNumber(args, argn, "format")
+			if err != nil {
+				return nil, err
+			}
+			switch conv {
+			case 'c':
+				b.WriteByte(byte(n))
+			case 'i', 'u':
+				fmt.Fprintf(&b, spec+"d", int64(n))
+			default:
+				fmt.Fprintf(&b, spec+string(conv), int64(n))
+			}
+		case 'e', 'E', 'f', 'g', 'G':
+			n, err := L.checkNumber(args, argn, "format")
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(&b, spec+string(conv), n)
+		case 'q':
+			s, err := L.checkString(args, argn, "format")
+			if err != nil {
+				return nil, err
+			}
+			b.WriteString(strconv.Quote(s))
+		case 's':
+			fmt.Fprintf(&b, spec+"s", luaToString(args[argn]))
+		default:
+			return nil, L.errorf("invalid option '%%%c' to 'format'", conv)
+		}
+		argn++
+	}
+	return []luaValue{b.String()}, nil
+}
+
+// table.insert(t, [pos,] value)
+func luaTableInsert(L *luaState, args []luaValue) ([]luaValue, error) {
+	t, err := L.checkTable(args, 0, "insert")
+	if err != nil {
+		return nil, err
+	}
+	n := t.Len()
+	switch len(args) {
+	case 2:
+		return nil, L.setTable(t, float64(n+1), args[1])
+	case 3:
+		pos, err := L.checkNumber(args, 1, "insert")
+		if err != nil {
+			return nil, err
+		}
+		for i := float64(n); i >= pos; i-- {
+			if err := L.setTable(t, i+1, t.Get(i)); err != nil {
+				return nil, err
+			}
+		}
+		return nil, L.setTable(t, pos, args[2])
+	}
+	return nil, L.errorf("wrong number of arguments to 'insert'")
+}
+
+// table.remove(t [, pos]) 返回被删除的元素
+func luaTableRemove(L *luaState, args []luaValue) ([]luaValue, error) {
+	t, err := L.checkTable(args, 0, "remove")
+	if err != nil {
+		return nil, err
+	}
+	n := float64(t.Len())
+	if n == 0 {
+		return nil, nil
+	}
+	pos, err := L.optNumber(args, 1, "remove", n)
+	if err != nil {
+		return nil, err
+	}
+	v := t.Get(pos)
+	for i := pos; i < n; i++ {
+		if err := L.setTable(t, i, t.Get(i+1)); err != nil {
+			return nil, err
+		}
+	}
+	if err := L.setTable(t, n, nil); err != nil {
+		return nil, err
+	}
+	return []luaValue{v}, nil
+}
+
+// table.concat(t [, sep [, i [, j]]])
+func luaTableConcat(L *luaState, args []luaValue) ([]luaValue, error) {
+	t, err := L.checkTable(args, 0, "concat")
+	if err != nil {
+		return nil, err
+	}
+	sep := ""
+	if luaArg(args, 1) != nil {
+		if sep, err = L.checkString(args, 1, "concat"); err != nil {
+			return nil, err
+		}
+	}
+	i, err := L.optNumber(args, 2, "concat", 1)
+	if err != nil {
+		return nil, err
+	}
+	j, err := L.optNumber(args, 3, "concat", float64(t.Len()))
+	if err != nil {
+		return nil, err
+	}
+	var parts []string
+	for k := i; k <= j; k++ {
+		s, ok := luaConcatString(t.Get(k))
+		if !ok {
+			return nil, L.errorf("invalid value (at index %s) in table for 'concat'", luaNumberToString(k))
+		}
+		parts = append(parts, s)
+	}
+	return []luaValue{strings.Join(parts, sep)}, nil
+}
+
+func luaTableGetn(L *luaState, args []luaValue) ([]luaValue, error) {
+	t, err := L.checkTable(args, 0, "getn")
+	if err != nil {
+		return nil, err
+	}
+	return []luaValue{float64(t.Len())}, nil
+}
+
+func luaMathFunc(f func(float64) float64) func(*luaState, []luaValue) ([]luaValue, error) {
+	return func(L *luaState, args []luaValue) ([]luaValue, error) {
+		n, err := L.checkNumber(args, 0, "math")
+		if err != nil {
+			return nil, err
+		}
+		return []luaValue{f(n)}, nil
+	}
+}
+
+func luaMathMax(L *luaState, args []luaValue) ([]luaValue, error) {
+	m, err := L.checkNumber(args, 0, "max")
+	if err != nil {
+		return nil, err
+	}
+	for i := 1; i < len(args); i++ {
+		n, err := L.checkNumber(args, i, "max")
+		if err != nil {
+			return nil, err
+		}
+		m = math.Max(m, n)
+	}
+	return []luaValue{m}, nil
+}
+
+func luaMathMin(L *luaState, args []luaValue) ([]luaValue, error) {
+	m, err := L.checkNumber(args, 0, "min")
+	if err != nil {
+		return nil, err
+	}
+	for i := 1; i < len(args); i++ {
+		n, err := L.checkNumber(args, i, "min")
+		if err != nil {
+			return nil, err
+		}
+		m = math.Min(m, n)
+	}
+	return []luaValue{m}, nil
+}
+
+func luaMathFmod(L *luaState, args []luaValue) ([]luaValue, error) {
+	a, err := L.checkNumber(args, 0, "fmod")
+	if err != nil {
+		return nil, err
+	}
+	b, err := L.checkNumber(args, 1, "fmod")
+	if err != nil {
+		return nil, err
+	}
+	return []luaValue{math.Mod(a, b)}, nil
+}
+
+func luaMathPow(L *luaState, args []luaValue) ([]luaValue, error) {
+	a, err := L.checkNumber(args, 0, "pow")
+	if err != nil {
+		return nil, err
+	}
+	b, err := L.checkNumber(args, 1, "pow")
+	if err != nil {
+		return nil, err
+	}
+	return []luaValue{math.Pow(a, b)}, nil
+}
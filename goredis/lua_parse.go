@@ -0,0 +1,1158 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+/*
+EVAL 使用的 Lua 5.1 子集
+支持 local / 赋值 / if / while / repeat / 数值 for 和泛型 for / 函数定义和闭包 / 表
+不支持 metatable / 协程 / goto / 可变参数
+*/
+
+// 词法单元
+const (
+	TK_EOF = iota
+	TK_NAME
+	TK_NUMBER
+	TK_STRING
+	TK_OP // 运算符和标点 也包括关键字
+)
+
+var luaKeywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true, "end": true,
+	"false": true, "for": true, "function": true, "if": true, "in": true, "local": true,
+	"nil": true, "not": true, "or": true, "repeat": true, "return": true, "then": true,
+	"true": true, "until": true, "while": true,
+}
+
+type luaToken struct {
+	typ  int
+	str  string // 名字 字符串内容 运算符 关键字
+	num  float64
+	line int
+}
+
+type luaLexer struct {
+	src  string
+	pos  int
+	line int
+}
+
+// 语法错误 和运行时错误使用同样的位置格式
+type luaSyntaxError struct {
+	msg string
+}
+
+func (e *luaSyntaxError) Error() string {
+	return e.msg
+}
+
+func (lx *luaLexer) errorf(format string, v ...interface{}) error {
+	return &luaSyntaxError{fmt.Sprintf("user_script:%d: ", lx.line) + fmt.Sprintf(format, v...)}
+}
+
+func isLuaNameStart(ch byte) bool {
+	return ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+}
+
+func isLuaDigit(ch byte) bool {
+	return ch >= '0' && ch <= '9'
+}
+
+func (lx *luaLexer) peekByte(off int) byte {
+	if lx.pos+off < len(lx.src) {
+		return lx.src[lx.pos+off]
+	}
+	return 0
+}
+
+// 跳过空白和注释
+func (lx *luaLexer) skipSpace() error {
+	for lx.pos < len(lx.src) {
+		ch := lx.src[lx.pos]
+		switch {
+		case ch == '\n':
+			lx.line++
+			lx.pos++
+		case ch == ' ' || ch == '\t' || ch == '\r' || ch == '\f' || ch == '\v':
+			lx.pos++
+		case ch == '-' && lx.peekByte(1) == '-':
+			lx.pos += 2
+			if lx.peekByte(0) == '[' {
+				if level := lx.longBracketLevel(); level >= 0 {
+					if _, err := lx.readLongString(level); err != nil {
+						return err
+					}
+					continue
+				}
+			}
+			for lx.pos < len(lx.src) && lx.src[lx.pos] != '\n' {
+				lx.pos++
+			}
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// 当前位置是 [[ 或 [==[ 时返回等号个数 否则返回 -1
+func (lx *luaLexer) longBracketLevel() int {
+	i := lx.pos + 1
+	for i < len(lx.src) && lx.src[i] == '=' {
+		i++
+	}
+	if i < len(lx.src) && lx.src[i] == '[' {
+		return i - lx.pos - 1
+	}
+	return -1
+}
+
+func (lx *luaLexer) readLongString(level int) (string, error) {
+	lx.pos += level + 2
+	// 紧跟的第一个换行不属于内容
+	if lx.peekByte(0) == '\r' {
+		lx.pos++
+	}
+	if lx.peekByte(0) == '\n' {
+		lx.line++
+		lx.pos++
+	}
+	closing := "]" + strings.Repeat("=", level) + "]"
+	end := strings.Index(lx.src[lx.pos:], closing)
+	if end < 0 {
+		return "", lx.errorf("unfinished long string")
+	}
+	s := lx.src[lx.pos : lx.pos+end]
+	lx.line += strings.Count(s, "\n")
+	lx.pos += end + len(closing)
+	return s, nil
+}
+
+func (lx *luaLexer) readString(quote byte) (string, error) {
+	lx.pos++
+	var b strings.Builder
+	for {
+		if lx.pos >= len(lx.src) {
+			return "", lx.errorf("unfinished string")
+		}
+		ch := lx.src[lx.pos]
+		if ch == quote {
+			lx.pos++
+			return b.String(), nil
+		}
+		if ch == '\n' {
+			return "", lx.errorf("unfinished string")
+		}
+		if ch != '\\' {
+			b.WriteByte(ch)
+			lx.pos++
+			continue
+		}
+		lx.pos++
+		esc := lx.peekByte(0)
+		lx.pos++
+		switch esc {
+		case 'a':
+			b.WriteByte('\a')
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'v':
+			b.WriteByte('\v')
+		case '\\', '"', '\'':
+			b.WriteByte(esc)
+		case '\n':
+			lx.line++
+			b.WriteByte('\n')
+		default:
+			if !isLuaDigit(esc) {
+				return "", lx.errorf("invalid escape sequence")
+			}
+			// \ddd 最多三位十进制
+			n := int(esc - '0')
+			for i := 0; i < 2 && isLuaDigit(lx.peekByte(0)); i++ {
+				n = n*10 + int(lx.peekByte(0)-'0')
+				lx.pos++
+			}
+			if n > 255 {
+				return "", lx.errorf("escape sequence too large")
+			}
+			b.WriteByte(byte(n))
+		}
+	}
+}
+
+func (lx *luaLexer) readNumber() (float64, error) {
+	start := lx.pos
+	for lx.pos < len(lx.src) {
+		ch := lx.src[lx.pos]
+		if isLuaDigit(ch) || isLuaNameStart(ch) || ch == '.' {
+			lx.pos++
+		} else if (ch == '+' || ch == '-') && (lx.src[lx.pos-1] == 'e' || lx.src[lx.pos-1] == 'E') &&
+			!strings.HasPrefix(strings.ToLower(lx.src[start:]), "0x") {
+			lx.pos++
+		} else {
+			break
+		}
+	}
+	text := lx.src[start:lx.pos]
+	n, ok := luaStringToNumber(text)
+	if !ok {
+		return 0, lx.errorf("malformed number near '%s'", text)
+	}
+	return n, nil
+}
+
+// 三个字符和两个字符的运算符 按长度优先匹配
+var luaOperators = []string{"...", "..", "==", "~=", "<=", ">=",
+	"+", "-", "*", "/", "%", "^", "#", "<", ">", "=", "(", ")", "{", "}", "[", "]", ";", ":", ",", "."}
+
+func (lx *luaLexer) next() (luaToken, error) {
+	if err := lx.skipSpace(); err != nil {
+		return luaToken{}, err
+	}
+	tok := luaToken{line: lx.line}
+	if lx.pos >= len(lx.src) {
+		tok.typ = TK_EOF
+		return tok, nil
+	}
+	ch := lx.src[lx.pos]
+	switch {
+	case isLuaNameStart(ch):
+		start := lx.pos
+		for lx.pos < len(lx.src) && (isLuaNameStart(lx.src[lx.pos]) || isLuaDigit(lx.src[lx.pos])) {
+			lx.pos++
+		}
+		tok.str = lx.src[start:lx.pos]
+		if luaKeywords[tok.str] {
+			tok.typ = TK_OP
+		} else {
+			tok.typ = TK_NAME
+		}
+		return tok, nil
+	case isLuaDigit(ch) || (ch == '.' && isLuaDigit(lx.peekByte(1))):
+		n, err := lx.readNumber()
+		tok.typ, tok.num = TK_NUMBER, n
+		return tok, err
+	case ch == '"' || ch == '\'':
+		s, err := lx.readString(ch)
+		tok.typ, tok.str = TK_STRING, s
+		return tok, err
+	case ch == '[':
+		if level := lx.longBracketLevel(); level >= 0 {
+			s, err := lx.readLongString(level)
+			tok.typ, tok.str = TK_STRING, s
+			return tok, err
+		}
+	}
+	for _, op := range luaOperators {
+		if strings.HasPrefix(lx.src[lx.pos:], op) {
+			lx.pos += len(op)
+			tok.typ, tok.str = TK_OP, op
+			return tok, nil
+		}
+	}
+	return tok, lx.errorf("unexpected symbol near '%c'", ch)
+}
+
+// 语法树
+type luaExpr interface{}
+type luaStat interface{}
+
+type luaConstExpr struct {
+	value luaValue
+}
+
+type luaNameExpr struct {
+	name string
+	line int
+}
+
+type luaIndexExpr struct {
+	obj, key luaExpr
+	line     int
+}
+
+// obj:name(args) 时 method 不为空
+type luaCallExpr struct {
+	fn     luaExpr
+	method string
+	args   []luaExpr
+	line   int
+}
+
+type luaFunctionExpr struct {
+	params []string
+	body   []luaStat
+}
+
+type luaBinOpExpr struct {
+	op       string
+	lhs, rhs luaExpr
+	line     int
+}
+
+type luaUnOpExpr struct {
+	op   string
+	expr luaExpr
+	line int
+}
+
+// 括号会把多返回值截断为一个
+type luaParenExpr struct {
+	expr luaExpr
+}
+
+// key 为 nil 时是按顺序的数组元素
+type luaTableField struct {
+	key, value luaExpr
+}
+
+type luaTableExpr struct {
+	fields []luaTableField
+	line   int
+}
+
+type luaLocalStat struct {
+	names []string
+	exprs []luaExpr
+}
+
+type luaAssignStat struct {
+	targets []luaExpr
+	exprs   []luaExpr
+	line    int
+}
+
+type luaCallStat struct {
+	call *luaCallExpr
+}
+
+type luaDoStat struct {
+	body []luaStat
+}
+
+type luaWhileStat struct {
+	cond luaExpr
+	body []luaStat
+}
+
+type luaRepeatStat struct {
+	body []luaStat
+	cond luaExpr
+}
+
+type luaIfStat struct {
+	conds     []luaExpr
+	blocks    [][]luaStat
+	elseBlock []luaStat
+}
+
+type luaNumericForStat struct {
+	name               string
+	start, limit, step luaExpr
+	body               []luaStat
+	line               int
+}
+
+type luaGenericForStat struct {
+	names []string
+	exprs []luaExpr
+	body  []luaStat
+	line  int
+}
+
+type luaLocalFunctionStat struct {
+	name string
+	fn   *luaFunctionExpr
+}
+
+type luaReturnStat struct {
+	exprs []luaExpr
+}
+
+type luaBreakStat struct{}
+
+// 语句执行前记录行号 用于错误信息
+type luaLineStat struct {
+	line int
+}
+
+// 递归下降的语法分析 嵌套层数有限制 避免恶意脚本耗尽栈
+const LUA_MAX_PARSE_DEPTH = 200
+
+type luaParser struct {
+	lx    *luaLexer
+	tok   luaToken
+	ahead *luaToken
+	depth int
+}
+
+func luaParse(src string) (body []luaStat, err error) {
+	p := &luaParser{lx: &luaLexer{src: src, line: 1}}
+	// 以 # 开头的第一行忽略
+	if strings.HasPrefix(src, "#") {
+		for p.lx.pos < len(src) && src[p.lx.pos] != '\n' {
+			p.lx.pos++
+		}
+	}
+	if err = p.advance(); err != nil {
+		return nil, err
+	}
+	if body, err = p.block(); err != nil {
+		return nil, err
+	}
+	if p.tok.typ != TK_EOF {
+		return nil, p.errorf("'<eof>' expected near '%s'", p.tokText())
+	}
+	return body, nil
+}
+
+func (p *luaParser) errorf(format string, v ...interface{}) error {
+	return &luaSyntaxError{fmt.Sprintf("user_script:%d: ", p.tok.line) + fmt.Sprintf(format, v...)}
+}
+
+func (p *luaParser) tokText() string {
+	switch p.tok.typ {
+	case TK_EOF:
+		return "<eof>"
+	case TK_NUMBER:
+		return luaNumberToString(p.tok.num)
+	}
+	return p.tok.str
+}
+
+func (p *luaParser) advance() error {
+	if p.ahead != nil {
+		p.tok, p.ahead = *p.ahead, nil
+		return nil
+	}
+	tok, err := p.lx.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *luaParser) peek() (luaToken, error) {
+	if p.ahead == nil {
+		tok, err := p.lx.next()
+		if err != nil {
+			return tok, err
+		}
+		p.ahead = &tok
+	}
+	return *p.ahead, nil
+}
+
+func (p *luaParser) isOp(op string) bool {
+	return p.tok.typ == TK_OP && p.tok.str == op
+}
+
+func (p *luaParser) accept(op string) (bool, error) {
+	if !p.isOp(op) {
+		return false, nil
+	}
+	return true, p.advance()
+}
+
+func (p *luaParser) expect(op string) error {
+	if !p.isOp(op) {
+		return p.errorf("'%s' expected near '%s'", op, p.tokText())
+	}
+	return p.advance()
+}
+
+func (p *luaParser) name() (string, error) {
+	if p.tok.typ != TK_NAME {
+		return "", p.errorf("<name> expected near '%s'", p.tokText())
+	}
+	name := p.tok.str
+	return name, p.advance()
+}
+
+func (p *luaParser) enter() error {
+	p.depth++
+	if p.depth > LUA_MAX_PARSE_DEPTH {
+		return p.errorf("chunk has too many syntax levels")
+	}
+	return nil
+}
+
+func (p *luaParser) blockEnd() bool {
+	if p.tok.typ == TK_EOF {
+		return true
+	}
+	return p.tok.typ == TK_OP && (p.tok.str == "end" || p.tok.str == "else" ||
+		p.tok.str == "elseif" || p.tok.str == "until")
+}
+
+func (p *luaParser) block() ([]luaStat, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer func() { p.depth-- }()
+	var body []luaStat
+	for !p.blockEnd() {
+		line := p.tok.line
+		// return 和 break 必须是块中的最后一条语句
+		if p.isOp("return") {
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			var exprs []luaExpr
+			if !p.blockEnd() && !p.isOp(";") {
+				var err error
+				if exprs, err = p.exprList(); err != nil {
+					return nil, err
+				}
+			}
+			if _, err := p.accept(";"); err != nil {
+				return nil, err
+			}
+			body = append(body, &luaLineStat{line}, &luaReturnStat{exprs})
+			if !p.blockEnd() {
+				return nil, p.errorf("'end' expected near '%s'", p.tokText())
+			}
+			break
+		}
+		if p.isOp("break") {
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			if _, err := p.accept(";"); err != nil {
+				return nil, err
+			}
+			body = append(body, &luaBreakStat{})
+			if !p.blockEnd() {
+				return nil, p.errorf("'end' expected near '%s'", p.tokText())
+			}
+			break
+		}
+		stat, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, &luaLineStat{line}, stat)
+		if _, err := p.accept(";"); err != nil {
+			return nil, err
+		}
+	}
+	return body, nil
+}
+
+func (p *luaParser) statement() (luaStat, error) {
+	line := p.tok.line
+	if p.tok.typ == TK_OP {
+		switch p.tok.str {
+		case "do":
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			body, err := p.block()
+			if err != nil {
+				return nil, err
+			}
+			return &luaDoStat{body}, p.expect("end")
+		case "while":
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			cond, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("do"); err != nil {
+				return nil, err
+			}
+			body, err := p.block()
+			if err != nil {
+				return nil, err
+			}
+			return &luaWhileStat{cond, body}, p.expect("end")
+		case "repeat":
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			body, err := p.block()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("until"); err != nil {
+				return nil, err
+			}
+			cond, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			return &luaRepeatStat{body, cond}, nil
+		case "if":
+			return p.ifStatement()
+		case "for":
+			return p.forStatement(line)
+		case "function":
+			return p.functionStatement(line)
+		case "local":
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			if ok, err := p.accept("function"); err != nil {
+				return nil, err
+			} else if ok {
+				name, err := p.name()
+				if err != nil {
+					return nil, err
+				}
+				fn, err := p.functionBody(false)
+				if err != nil {
+					return nil, err
+				}
+				return &luaLocalFunctionStat{name, fn}, nil
+			}
+			return p.localStatement()
+		}
+	}
+	return p.exprStatement(line)
+}
+
+func (p *luaParser) ifStatement() (luaStat, error) {
+	stat := &luaIfStat{}
+	for {
+		// 当前是 if 或 elseif
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		cond, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("then"); err != nil {
+			return nil, err
+		}
+		block, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		stat.conds = append(stat.conds, cond)
+		stat.blocks = append(stat.blocks, block)
+		if !p.isOp("elseif") {
+			break
+		}
+	}
+	if ok, err := p.accept("else"); err != nil {
+		return nil, err
+	} else if ok {
+		block, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		stat.elseBlock = block
+	}
+	return stat, p.expect("end")
+}
+
+func (p *luaParser) forStatement(line int) (luaStat, error) {
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	first, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := p.accept("="); err != nil {
+		return nil, err
+	} else if ok {
+		stat := &luaNumericForStat{name: first, line: line}
+		if stat.start, err = p.expr(); err != nil {
+			return nil, err
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+		if stat.limit, err = p.expr(); err != nil {
+			return nil, err
+		}
+		if ok, err := p.accept(","); err != nil {
+			return nil, err
+		} else if ok {
+			if stat.step, err = p.expr(); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.expect("do"); err != nil {
+			return nil, err
+		}
+		if stat.body, err = p.block(); err != nil {
+			return nil, err
+		}
+		return stat, p.expect("end")
+	}
+	stat := &luaGenericForStat{names: []string{first}, line: line}
+	for p.isOp(",") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		stat.names = append(stat.names, name)
+	}
+	if err := p.expect("in"); err != nil {
+		return nil, err
+	}
+	if stat.exprs, err = p.exprList(); err != nil {
+		return nil, err
+	}
+	if err := p.expect("do"); err != nil {
+		return nil, err
+	}
+	if stat.body, err = p.block(); err != nil {
+		return nil, err
+	}
+	return stat, p.expect("end")
+}
+
+// function a.b.c:m() 转换成对 a.b.c.m 的赋值
+func (p *luaParser) functionStatement(line int) (luaStat, error) {
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	var target luaExpr = &luaNameExpr{name, line}
+	method := false
+	for p.isOp(".") || p.isOp(":") {
+		method = p.isOp(":")
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		field, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		target = &luaIndexExpr{target, &luaConstExpr{field}, line}
+		if method {
+			break
+		}
+	}
+	fn, err := p.functionBody(method)
+	if err != nil {
+		return nil, err
+	}
+	return &luaAssignStat{[]luaExpr{target}, []luaExpr{fn}, line}, nil
+}
+
+func (p *luaParser) functionBody(method bool) (*luaFunctionExpr, error) {
+	fn := &luaFunctionExpr{}
+	if method {
+		fn.params = append(fn.params, "self")
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	for !p.isOp(")") {
+		if p.isOp("...") {
+			return nil, p.errorf("vararg functions are not supported")
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		fn.params = append(fn.params, name)
+		if !p.isOp(")") {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	body, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+	fn.body = body
+	return fn, p.expect("end")
+}
+
+func (p *luaParser) localStatement() (luaStat, error) {
+	stat := &luaLocalStat{}
+	for {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		stat.names = append(stat.names, name)
+		if ok, err := p.accept(","); err != nil {
+			return nil, err
+		} else if !ok {
+			break
+		}
+	}
+	if ok, err := p.accept("="); err != nil {
+		return nil, err
+	} else if ok {
+		exprs, err := p.exprList()
+		if err != nil {
+			return nil, err
+		}
+		stat.exprs = exprs
+	}
+	return stat, nil
+}
+
+// 函数调用或者赋值
+func (p *luaParser) exprStatement(line int) (luaStat, error) {
+	e, err := p.suffixedExpr()
+	if err != nil {
+		return nil, err
+	}
+	if call, ok := e.(*luaCallExpr); ok && !p.isOp("=") && !p.isOp(",") {
+		return &luaCallStat{call}, nil
+	}
+	stat := &luaAssignStat{targets: []luaExpr{e}, line: line}
+	for p.isOp(",") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		target, err := p.suffixedExpr()
+		if err != nil {
+			return nil, err
+		}
+		stat.targets = append(stat.targets, target)
+	}
+	for _, target := range stat.targets {
+		switch target.(type) {
+		case *luaNameExpr, *luaIndexExpr:
+		default:
+			return nil, p.errorf("syntax error near '%s'", p.tokText())
+		}
+	}
+	if err := p.expect("="); err != nil {
+		return nil, err
+	}
+	if stat.exprs, err = p.exprList(); err != nil {
+		return nil, err
+	}
+	return stat, nil
+}
+
+func (p *luaParser) exprList() ([]luaExpr, error) {
+	var exprs []luaExpr
+	for {
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, e)
+		if ok, err := p.accept(","); err != nil {
+			return nil, err
+		} else if !ok {
+			return exprs, nil
+		}
+	}
+}
+
+// 二元运算符的左右优先级 和 Lua 5.1 的 lparser.c 一致 右结合的运算符右边优先级更低
+var luaBinaryPriority = map[string][2]int{
+	"+": {6, 6}, "-": {6, 6}, "*": {7, 7}, "/": {7, 7}, "%": {7, 7},
+	"^": {10, 9}, "..": {5, 4},
+	"==": {3, 3}, "~=": {3, 3}, "<": {3, 3}, "<=": {3, 3}, ">": {3, 3}, ">=": {3, 3},
+	"and": {2, 2}, "or": {1, 1},
+}
+
+const LUA_UNARY_PRIORITY = 8
+
+func (p *luaParser) expr() (luaExpr, error) {
+	return p.subExpr(0)
+}
+
+func (p *luaParser) subExpr(limit int) (luaExpr, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer func() { p.depth-- }()
+	var e luaExpr
+	if p.isOp("not") || p.isOp("-") || p.isOp("#") {
+		op, line := p.tok.str, p.tok.line
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		operand, err := p.subExpr(LUA_UNARY_PRIORITY)
+		if err != nil {
+			return nil, err
+		}
+		e = &luaUnOpExpr{op, operand, line}
+	} else {
+		var err error
+		if e, err = p.simpleExpr(); err != nil {
+			return nil, err
+		}
+	}
+	for p.tok.typ == TK_OP {
+		prio, ok := luaBinaryPriority[p.tok.str]
+		if !ok || prio[0] <= limit {
+			break
+		}
+		op, line := p.tok.str, p.tok.line
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		rhs, err := p.subExpr(prio[1])
+		if err != nil {
+			return nil, err
+		}
+		e = &luaBinOpExpr{op, e, rhs, line}
+	}
+	return e, nil
+}
+
+func (p *luaParser) simpleExpr() (luaExpr, error) {
+	tok := p.tok
+	switch tok.typ {
+	case TK_NUMBER:
+		return &luaConstExpr{tok.num}, p.advance()
+	case TK_STRING:
+		return &luaConstExpr{tok.str}, p.advance()
+	case TK_OP:
+		switch tok.str {
+		case "nil":
+			return &luaConstExpr{nil}, p.advance()
+		case "true":
+			return &luaConstExpr{true}, p.advance()
+		case "false":
+			return &luaConstExpr{false}, p.advance()
+		case "{":
+			return p.tableConstructor()
+		case "function":
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			return p.functionBody(false)
+		case "...":
+			return nil, p.errorf("cannot use '...' outside a vararg function")
+		}
+	}
+	return p.suffixedExpr()
+}
+
+func (p *luaParser) primaryExpr() (luaExpr, error) {
+	if p.tok.typ == TK_NAME {
+		e := &luaNameExpr{p.tok.str, p.tok.line}
+		return e, p.advance()
+	}
+	if p.isOp("(") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return &luaParenExpr{e}, p.expect(")")
+	}
+	return nil, p.errorf("unexpected symbol near '%s'", p.tokText())
+}
+
+func (p *luaParser) suffixedExpr() (luaExpr, error) {
+	e, err := p.primaryExpr()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		line := p.tok.line
+		switch {
+		case p.isOp("."):
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			e = &luaIndexExpr{e, &luaConstExpr{name}, line}
+		case p.isOp("["):
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			key, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			e = &luaIndexExpr{e, key, line}
+		case p.isOp(":"):
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			args, err := p.callArgs()
+			if err != nil {
+				return nil, err
+			}
+			e = &luaCallExpr{e, name, args, line}
+		case p.isOp("(") || p.isOp("{") || p.tok.typ == TK_STRING:
+			args, err := p.callArgs()
+			if err != nil {
+				return nil, err
+			}
+			e = &luaCallExpr{e, "", args, line}
+		default:
+			return e, nil
+		}
+	}
+}
+
+// f(args) f{table} f"string"
+func (p *luaParser) callArgs() ([]luaExpr, error) {
+	if p.tok.typ == TK_STRING {
+		s := p.tok.str
+		return []luaExpr{&luaConstExpr{s}}, p.advance()
+	}
+	if p.isOp("{") {
+		t, err := p.tableConstructor()
+		return []luaExpr{t}, err
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	if ok, err := p.accept(")"); err != nil || ok {
+		return nil, err
+	}
+	args, err := p.exprList()
+	if err != nil {
+		return nil, err
+	}
+	return args, p.expect(")")
+}
+
+func (p *luaParser) tableConstructor() (luaExpr, error) {
+	t := &luaTableExpr{line: p.tok.line}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	for !p.isOp("}") {
+		var field luaTableField
+		if p.isOp("[") {
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			key, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			if err := p.expect("="); err != nil {
+				return nil, err
+			}
+			field.key = key
+		} else if p.tok.typ == TK_NAME {
+			if next, err := p.peek(); err != nil {
+				return nil, err
+			} else if next.typ == TK_OP && next.str == "=" {
+				field.key = &luaConstExpr{p.tok.str}
+				if err := p.advance(); err != nil {
+					return nil, err
+				}
+				if err := p.advance(); err != nil {
+					return nil, err
+				}
+			}
+		}
+		value, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		field.value = value
+		t.fields = append(t.fields, field)
+		if !p.isOp(",") && !p.isOp(";") {
+			break
+		}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+	return t, p.expect("}")
+}
+
+// 数字的字符串形式 和 Lua 的 %.14g 一致
+func luaNumberToString(n float64) string {
+	switch {
+	case math.IsNaN(n):
+		return "nan"
+	case math.IsInf(n, 1):
+		return "inf"
+	case math.IsInf(n, -1):
+		return "-inf"
+	}
+	s := strconv.FormatFloat(n, 'g', 14, 64)
+	// Go 的指数至少两位 和 C 保持一致
+	if i := strings.IndexAny(s, "e"); i >= 0 && len(s)-i == 3 {
+		s = s[:i+2] + "0" + s[i+2:]
+	}
+	return s
+}
+
+// 字符串转换成数字 支持十六进制 前后可以有空白
+func luaStringToNumber(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, false
+	}
+	neg := false
+	body := s
+	if body[0] == '-' || body[0] == '+' {
+		neg = body[0] == '-'
+		body = body[1:]
+	}
+	if strings.HasPrefix(body, "0x") || strings.HasPrefix(body, "0X") {
+		v, err := strconv.ParseUint(body[2:], 16, 64)
+		if err != nil {
+			return 0, false
+		}
+		if neg {
+			return -float64(v), true
+		}
+		return float64(v), true
+	}
+	// ParseFloat 还接受 inf nan 下划线等 Lua 不认识的写法
+	for i := 0; i < len(body); i++ {
+		ch := body[i]
+		if !isLuaDigit(ch) && ch != '.' && ch != 'e' && ch != 'E' && ch != '+' && ch != '-' {
+			return 0, false
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		// 超出范围时 ParseFloat 返回 ±Inf 和 Lua 的行为一致
+		if ne, ok := err.(*strconv.NumError); ok && ne.Err == strconv.ErrRange {
+			return v, true
+		}
+		return 0, false
+	}
+	return v, true
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// 执行一段脚本 返回第一个返回值
+func runLua(t *testing.T, src string) (luaValue, error) {
+	t.Helper()
+	body, err := luaParse(src)
+	if err != nil {
+		return nil, err
+	}
+	rets, err := newLuaState().Exec(body)
+	if err != nil || len(rets) == 0 {
+		return nil, err
+	}
+	return rets[0], nil
+}
+
+func TestLuaEval(t *testing.T) {
+	tests := []struct {
+		src    string
+		expect luaValue
+	}{
+		{"return 1 + 2 * 3", float64(7)},
+		{"return 2 ^ 3 ^ 2", float64(512)},
+		{"return -2 ^ 2", float64(-4)},
+		{"return 7 % 3, 1", float64(1)},
+		{"return -7 % 3", float64(2)},
+		{"return 1 .. 2", "12"},
+		{"return 'a' .. 'b' .. 'c'", "abc"},
+		{"return '10' + 1", float64(11)},
+		{"return 0x10", float64(16)},
+		{"return 1e2", float64(100)},
+		{"return 1 < 2 and 'yes' or 'no'", "yes"},
+		{"return nil or false", false},
+		{"return not nil", true},
+		{"return 1 == '1'", false},
+		{"return 'a' < 'b'", true},
+		{"return #'hello'", float64(5)},
+		{"return #{1, 2, 3}", float64(3)},
+		{"return 'a\\tb\\65\\n'", "a\tbA\n"},
+		{"return [[\nline]]", "line"},
+		{"local a, b = 1 return b", nil},
+		{"local a, b = 1, 2 a, b = b, a return a - b", float64(1)},
+		{"local s = 0 for i = 1, 10 do s = s + i end return s", float64(55)},
+		{"local s = 0 for i = 10, 1, -2 do s = s + i end return s", float64(30)},
+		{"local s = '' for i, v in ipairs({'a', 'b', 'c'}) do s = s .. i .. v end return s", "1a2b3c"},
+		{"local n = 0 for k, v in pairs({a = 1, b = 2, 3}) do n = n + v end return n", float64(6)},
+		{"local i = 0 while true do i = i + 1 if i == 5 then break end end return i", float64(5)},
+		{"local i = 0 repeat local j = i i = i + 1 until j >= 3 return i", float64(4)},
+		{"local x = 5 if x > 10 then return 'a' elseif x > 3 then return 'b' else return 'c' end", "b"},
+		{"local function f(n) if n <= 1 then return 1 end return n * f(n - 1) end return f(5)", float64(120)},
+		{"local function c() local n = 0 return function() n = n + 1 return n end end local f = c() f() return f()", float64(2)},
+		{"local t = {} t.x = 1 t['y'] = 2 return t.x + t.y", float64(3)},
+		{"local t = {n = {m = 'deep'}} return t.n.m", "deep"},
+		{"local t = {1, 2, 3} table.insert(t, 4) table.insert(t, 1, 0) return table.concat(t, ',')", "0,1,2,3,4"},
+		{"local t = {1, 2, 3} return table.remove(t, 1) + #t", float64(3)},
+		{"return select('#', 1, nil, 3)", float64(3)},
+		{"return select(2, 'a', 'b', 'c')", "b"},
+		{"local a, b = unpack({1, 2}) return b", float64(2)},
+		{"return tostring(10) .. tostring(nil) .. tostring(1.5)", "10nil1.5"},
+		{"return tonumber('0x1f')", float64(31)},
+		{"return tonumber('z', 36)", float64(35)},
+		{"return tonumber('abc')", nil},
+		{"return type({})", "table"},
+		{"return string.format('%d-%s-%5.2f', 3, 'x', 1.5)", "3-x- 1.50"},
+		{"return ('abc'):upper()", "ABC"},
+		{"return string.sub('hello', 2, -2)", "ell"},
+		{"return string.rep('ab', 3)", "ababab"},
+		{"return string.byte('A')", float64(65)},
+		{"return math.max(1, 5, 3) + math.floor(2.7)", float64(7)},
+		{"local ok, err = pcall(error, 'boom', 0) return err", "boom"},
+		{"local ok = pcall(function() error('x') end) return ok", false},
+		{"local ok, v = pcall(function(a) return a * 2 end, 21) return v", float64(42)},
+		{"local ok, e = pcall(error, {code = 1}) return e.code", float64(1)},
+		{"-- comment\nreturn --[[ block\ncomment ]] 1", float64(1)},
+		{"do local x = 1 end return x", nil},
+	}
+	for _, tt := range tests {
+		got, err := runLua(t, tt.src)
+		if err != nil {
+			t.Errorf("%s: %v", tt.src, err)
+			continue
+		}
+		if got != tt.expect {
+			t.Errorf("%s: expect %v, got %v", tt.src, tt.expect, got)
+		}
+	}
+}
+
+func TestLuaErrors(t *testing.T) {
+	tests := []struct {
+		src    string
+		expect string
+	}{
+		{"return 1 +", "user_script:1: unexpected symbol near '<eof>'"},
+		{"local x = 'abc", "user_script:1: unfinished string"},
+		{"if true then\nreturn 1", "user_script:2: 'end' expected"},
+		{"x = = 1", "user_script:1: unexpected symbol near '='"},
+		{"return 1 + {}", "user_script:1: attempt to perform arithmetic on a table value"},
+		{"local t = nil\nreturn t.x", "user_script:2: attempt to index a nil value"},
+		{"return nosuch()", "user_script:1: attempt to call a nil value"},
+		{"return 1 < 'a'", "user_script:1: attempt to compare number with string"},
+		{"return {} .. 'a'", "user_script:1: attempt to concatenate a table value"},
+		{"\n\nerror('custom')", "user_script:3: custom"},
+		{"local function f() return f() + 1 end return f()", "stack overflow"},
+		{"return string.rep()", "bad argument #1 to 'rep'"},
+	}
+	for _, tt := range tests {
+		_, err := runLua(t, tt.src)
+		if err == nil || !strings.Contains(err.Error(), tt.expect) {
+			t.Errorf("%s: expect error %q, got %v", tt.src, tt.expect, err)
+		}
+	}
+}
+
+func TestLuaHook(t *testing.T) {
+	body, err := luaParse("local i = 0 while true do i = i + 1 end")
+	if err != nil {
+		t.Fatal(err)
+	}
+	L := newLuaState()
+	calls := 0
+	L.hook = func() error {
+		calls++
+		if calls == 3 {
+			return errLuaKilled
+		}
+		return nil
+	}
+	// pcall 不能捕获 hook 返回的错误
+	if _, err := L.Exec(body); err != errLuaKilled {
+		t.Errorf("expect killed, got %v", err)
+	}
+	body, _ = luaParse("return pcall(function() while true do end end)")
+	calls = 0
+	if _, err := L.Exec(body); err != errLuaKilled {
+		t.Errorf("pcall caught the hook error: %v", err)
+	}
+}
+
+func TestLuaTable(t *testing.T) {
+	tbl := newLuaTable()
+	tbl.Set(float64(2), "b")
+	tbl.Set(float64(1), "a")
+	tbl.Set("k", "v")
+	if tbl.Len() != 2 {
+		t.Errorf("expect len 2, got %d", tbl.Len())
+	}
+	var keys []luaValue
+	for k, _, _ := tbl.Next(nil); k != nil; k, _, _ = tbl.Next(k) {
+		keys = append(keys, k)
+	}
+	if len(keys) != 3 || keys[0] != float64(1) || keys[1] != float64(2) || keys[2] != "k" {
+		t.Errorf("unexpected keys %v", keys)
+	}
+	tbl.Set(float64(2), nil)
+	if tbl.Len() != 1 {
+		t.Errorf("expect len 1, got %d", tbl.Len())
+	}
+	tbl.readonly = true
+	L := newLuaState()
+	if err := L.setTable(tbl, "x", 1.0); err == nil || !strings.Contains(err.Error(), "readonly") {
+		t.Errorf("expect readonly error, got %v", err)
+	}
+}
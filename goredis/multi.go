@@ -0,0 +1,209 @@
+package main
+
+// 事务中排队的命令
+type multiCmd struct {
+	args []*Gobj
+	cmd  *GodisCommand
+}
+
+type multiState struct {
+	commands []multiCmd
+	cmdFlags int // 队列中所有命令 flags 的并集
+}
+
+// WATCH 的 key 以及 WATCH 时它是否已经过期
+type watchedKey struct {
+	key     *Gobj
+	db      *GodisDB
+	expired bool
+}
+
+// MULTI 之后收到的命令进入队列 参数的所有权转移到队列中
+func queueMultiCommand(c *GodisClient, cmd *GodisCommand) {
+	c.mstate.commands = append(c.mstate.commands, multiCmd{args: c.args, cmd: cmd})
+	c.mstate.cmdFlags |= cmd.flags
+	c.args = nil
+}
+
+func discardTransaction(c *GodisClient) {
+	for _, mc := range c.mstate.commands {
+		for _, arg := range mc.args {
+			arg.DecrRefCount()
+		}
+	}
+	c.mstate = multiState{}
+	c.flags &^= CLIENT_MULTI | CLIENT_DIRTY_CAS | CLIENT_DIRTY_EXEC | CLIENT_DENY_BLOCKING
+	unwatchAllKeys(c)
+}
+
+// 排队时出现错误 EXEC 时整个事务都不执行
+func flagTransaction(c *GodisClient) {
+	if c.flags&CLIENT_MULTI != 0 {
+		c.flags |= CLIENT_DIRTY_EXEC
+	}
+}
+
+func multiCommand(c *GodisClient) {
+	if c.flags&CLIENT_MULTI != 0 {
+		c.AddReplyError("MULTI calls can not be nested")
+		return
+	}
+	// 事务中的阻塞命令不会阻塞 直接按超时处理
+	c.flags |= CLIENT_MULTI | CLIENT_DENY_BLOCKING
+	c.AddReply(shared.ok)
+}
+
+func discardCommand(c *GodisClient) {
+	if c.flags&CLIENT_MULTI == 0 {
+		c.AddReplyError("DISCARD without MULTI")
+		return
+	}
+	discardTransaction(c)
+	c.AddReply(shared.ok)
+}
+
+/*
+依次执行队列中的命令 执行期间不会处理其他客户端的命令
+写命令以 MULTI ... EXEC 包裹传播到 AOF 保证重放时也是原子的
+*/
+func execCommand(c *GodisClient) {
+	if c.flags&CLIENT_MULTI == 0 {
+		c.AddReplyError("EXEC without MULTI")
+		return
+	}
+	// WATCH 之后过期的 key 也视为被修改
+	if isWatchedKeyExpired(c) {
+		c.flags |= CLIENT_DIRTY_CAS
+	}
+	if c.flags&(CLIENT_DIRTY_CAS|CLIENT_DIRTY_EXEC) != 0 {
+		if c.flags&CLIENT_DIRTY_EXEC != 0 {
+			c.AddReply(shared.execaborterr)
+		} else {
+			c.AddReplyNullArray()
+		}
+		discardTransaction(c)
+		return
+	}
+	// 执行期间修改 key 不需要再让自己的事务失败
+	unwatchAllKeys(c)
+
+	origArgs := c.args
+	server.inExec = true
+	c.AddReplyArrayLen(len(c.mstate.commands))
+	for i := range c.mstate.commands {
+		mc := &c.mstate.commands[i]
+		c.args = mc.args
+		// 排队之后用户的权限可能被修改了
+		if reason, pos := aclCheckAllPerm(c, mc.cmd, mc.args); reason != ACL_OK {
+			addACLLogEntry(c, reason, ACL_LOG_CTX_MULTI, aclDeniedObject(reason, mc.cmd, mc.args, pos), "")
+			c.AddReplyErrorFormat("-NOPERM ACLs rules changed between the moment the transaction was accumulated "+
+				"and the EXEC call. This command is no longer allowed for the following reason: %s",
+				getAclErrorMessage(reason, mc.cmd))
+			continue
+		}
+		call(c, mc.cmd)
+		// 命令可能改写了自己的参数
+		mc.args = c.args
+	}
+	c.args = origArgs
+	server.inExec = false
+	discardTransaction(c)
+
+	// 传播了 MULTI 时 让 EXEC 本身也被传播
+	if server.execMultiPropagated {
+		server.execMultiPropagated = false
+		server.dirty++
+	}
+}
+
+func watchForKey(c *GodisClient, key *Gobj) {
+	for _, wk := range c.watchedKeys {
+		if wk.db == c.db && GStrEqual(wk.key, key) {
+			return
+		}
+	}
+	name := key.StrVal()
+	c.db.watchedKeys[name] = append(c.db.watchedKeys[name], c)
+	key.IncrRefCount()
+	c.watchedKeys = append(c.watchedKeys, watchedKey{key: key, db: c.db, expired: c.db.keyIsExpired(key)})
+}
+
+func unwatchAllKeys(c *GodisClient) {
+	for _, wk := range c.watchedKeys {
+		name := wk.key.StrVal()
+		clients := wk.db.watchedKeys[name]
+		for i, wc := range clients {
+			if wc == c {
+				clients = append(clients[:i], clients[i+1:]...)
+				break
+			}
+		}
+		if len(clients) == 0 {
+			delete(wk.db.watchedKeys, name)
+		} else {
+			wk.db.watchedKeys[name] = clients
+		}
+		wk.key.DecrRefCount()
+	}
+	c.watchedKeys = nil
+}
+
+// WATCH 时还没有过期 之后逻辑上已经过期但还没有被删除的 key
+func isWatchedKeyExpired(c *GodisClient) bool {
+	for _, wk := range c.watchedKeys {
+		if !wk.expired && wk.db.keyIsExpired(wk.key) {
+			return true
+		}
+	}
+	return false
+}
+
+func touchWatchedKey(db *GodisDB, key *Gobj) {
+	if len(db.watchedKeys) == 0 {
+		return
+	}
+	for _, c := range db.watchedKeys[key.StrVal()] {
+		c.flags |= CLIENT_DIRTY_CAS
+	}
+}
+
+/*
+清空或者交换数据库时调用 replaced 为交换进来的数据库
+只有在 emptied 或 replaced 中存在的 key 才算被修改
+*/
+func touchAllWatchedKeysInDb(emptied, replaced *GodisDB) {
+	for name, clients := range emptied.watchedKeys {
+		key := CreateObject(GSTR, name)
+		exists := emptied.data.Find(key) != nil || (replaced != nil && replaced.data.Find(key) != nil)
+		key.DecrRefCount()
+		if !exists {
+			continue
+		}
+		for _, c := range clients {
+			c.flags |= CLIENT_DIRTY_CAS
+		}
+	}
+}
+
+// WATCH key [key ...]
+func watchCommand(c *GodisClient) {
+	if c.flags&CLIENT_MULTI != 0 {
+		c.AddReplyError("WATCH inside MULTI is not allowed")
+		return
+	}
+	// 已经被修改过 再监视也没有意义
+	if c.flags&CLIENT_DIRTY_CAS != 0 {
+		c.AddReply(shared.ok)
+		return
+	}
+	for _, key := range c.args[1:] {
+		watchForKey(c, key)
+	}
+	c.AddReply(shared.ok)
+}
+
+func unwatchCommand(c *GodisClient) {
+	unwatchAllKeys(c)
+	c.flags &^= CLIENT_DIRTY_CAS
+	c.AddReply(shared.ok)
+}
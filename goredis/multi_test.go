@@ -0,0 +1,150 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMultiExec(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	expectReply(t, c, "-ERR EXEC without MULTI\r\n", "exec")
+	expectReply(t, c, "-ERR DISCARD without MULTI\r\n", "discard")
+	expectReply(t, c, "+OK\r\n", "multi")
+	expectReply(t, c, "-ERR MULTI calls can not be nested\r\n", "multi")
+	expectReply(t, c, "+QUEUED\r\n", "set", "k", "v")
+	expectReply(t, c, "+QUEUED\r\n", "incr", "k")
+	expectReply(t, c, "+QUEUED\r\n", "get", "k")
+	expectReply(t, c, "*3\r\n+OK\r\n-ERR value is not an integer or out of range\r\n$1\r\nv\r\n", "exec")
+
+	c.run("multi")
+	c.run("set", "k", "v2")
+	expectReply(t, c, "+OK\r\n", "discard")
+	expectReply(t, c, "$1\r\nv\r\n", "get", "k")
+
+	// 排队时的错误让整个事务失败
+	c.run("multi")
+	c.run("set", "k", "v2")
+	expectReply(t, c, "-ERR wrong number of arguments for 'get' command\r\n", "get")
+	c.run("set", "k", "v3")
+	expectReply(t, c, "-EXECABORT Transaction discarded because of previous errors.\r\n", "exec")
+	c.run("multi")
+	c.run("nosuchcommand")
+	expectReply(t, c, "-EXECABORT Transaction discarded because of previous errors.\r\n", "exec")
+	expectReply(t, c, "$1\r\nv\r\n", "get", "k")
+
+	// 事务中的阻塞命令直接返回
+	c.run("multi")
+	c.run("blpop", "nolist", "0")
+	c.run("blmove", "nolist", "dst", "left", "left", "0")
+	expectReply(t, c, "*2\r\n*-1\r\n$-1\r\n", "exec")
+	if c.flags&CLIENT_BLOCKED != 0 {
+		t.Error("client blocked inside EXEC")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	initTestServer(t)
+	c1 := newTestClient(t)
+	c2 := newTestClient(t)
+	c1.run("set", "k", "1")
+	expectReply(t, c1, "+OK\r\n", "watch", "k")
+	c1.run("multi")
+	expectReply(t, c1, "-ERR WATCH inside MULTI is not allowed\r\n", "watch", "k")
+	c1.run("incr", "k")
+	c2.run("set", "k", "10")
+	expectReply(t, c1, "*-1\r\n", "exec")
+	expectReply(t, c1, "$2\r\n10\r\n", "get", "k")
+
+	// 没有被修改时正常执行 EXEC 之后不再监视
+	c1.run("watch", "k")
+	c2.run("get", "k")
+	c1.run("multi")
+	c1.run("incr", "k")
+	expectReply(t, c1, "*1\r\n:11\r\n", "exec")
+	if len(c1.db.watchedKeys) != 0 {
+		t.Errorf("watched keys left after EXEC: %v", c1.db.watchedKeys)
+	}
+
+	c1.run("watch", "k")
+	c2.run("set", "k", "v")
+	expectReply(t, c1, "+OK\r\n", "unwatch")
+	c1.run("multi")
+	c1.run("get", "k")
+	expectReply(t, c1, "*1\r\n$1\r\nv\r\n", "exec")
+
+	// 其他数据库中同名的 key 不影响
+	c1.run("watch", "k")
+	c2.run("select", "1")
+	c2.run("set", "k", "other")
+	c1.run("multi")
+	c1.run("get", "k")
+	expectReply(t, c1, "*1\r\n$1\r\nv\r\n", "exec")
+
+	// FLUSHALL 只影响存在的 key
+	c1.run("watch", "k", "nokey")
+	c2.run("flushall")
+	c1.run("multi")
+	c1.run("ping")
+	expectReply(t, c1, "*-1\r\n", "exec")
+	c1.run("watch", "nokey")
+	c2.run("flushall")
+	c1.run("multi")
+	c1.run("ping")
+	expectReply(t, c1, "*1\r\n+PONG\r\n", "exec")
+}
+
+func TestWatchExpiredKey(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	c.run("set", "k", "v")
+	c.run("watch", "k")
+	// 逻辑上已经过期但还没有被删除
+	c.db.setExpire(CreateObject(GSTR, "k"), GetMsTime()-1)
+	c.run("multi")
+	c.run("ping")
+	expectReply(t, c, "*-1\r\n", "exec")
+
+	// WATCH 时已经过期的 key 再被删除不算修改
+	c.run("set", "k2", "v")
+	c.db.setExpire(CreateObject(GSTR, "k2"), GetMsTime()-1)
+	c.run("watch", "k2")
+	c.run("multi")
+	c.run("ping")
+	expectReply(t, c, "*1\r\n+PONG\r\n", "exec")
+}
+
+func TestMultiAof(t *testing.T) {
+	initTestServer(t)
+	enableTestAof(t)
+	c := newTestClient(t)
+	c.run("multi")
+	c.run("get", "k")
+	expectReply(t, c, "*1\r\n$-1\r\n", "exec")
+	c.run("multi")
+	c.run("set", "k", "v")
+	c.run("incr", "counter")
+	c.run("exec")
+	flushAppendOnlyFile()
+	aof := readAof(t)
+	multi := strings.Index(aof, "MULTI")
+	exec := strings.Index(aof, "exec")
+	if multi < 0 || strings.Count(aof, "MULTI") != 1 || exec < strings.Index(aof, "incr") {
+		t.Errorf("unexpected AOF: %q", aof)
+	}
+
+	// 不完整的事务在加载时被丢弃
+	valid := aof
+	aof += string(catAppendOnlyGenericCommand(nil, "MULTI"))
+	aof += string(catAppendOnlyGenericCommand(nil, "SET", "k", "lost"))
+	if err := os.WriteFile(server.aofFilename, []byte(aof), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reloadAof(t, c)
+	expectReply(t, c, "$1\r\nv\r\n", "get", "k")
+	expectReply(t, c, "$1\r\n1\r\n", "get", "counter")
+	if got := readAof(t); got != valid {
+		t.Errorf("AOF is not truncated: %q", got)
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// CLIENT LIST TYPE / CLIENT KILL TYPE 使用的客户端类型
+const (
+	CLIENT_TYPE_NORMAL = iota
+	CLIENT_TYPE_SLAVE
+	CLIENT_TYPE_PUBSUB
+	CLIENT_TYPE_MASTER
+)
+
+// CLIENT PAUSE 的类型 ALL 比 WRITE 更严格
+const (
+	CLIENT_PAUSE_OFF = iota
+	CLIENT_PAUSE_WRITE
+	CLIENT_PAUSE_ALL
+)
+
+func getClientType(c *GodisClient) int {
+	if c.flags&CLIENT_MASTER != 0 {
+		return CLIENT_TYPE_MASTER
+	}
+	if c.flags&CLIENT_SLAVE != 0 {
+		return CLIENT_TYPE_SLAVE
+	}
+	if c.flags&CLIENT_PUBSUB != 0 {
+		return CLIENT_TYPE_PUBSUB
+	}
+	return CLIENT_TYPE_NORMAL
+}
+
+// 名字不合法时返回 -1
+func getClientTypeByName(name string) int {
+	switch strings.ToLower(name) {
+	case "normal":
+		return CLIENT_TYPE_NORMAL
+	case "slave", "replica":
+		return CLIENT_TYPE_SLAVE
+	case "pubsub":
+		return CLIENT_TYPE_PUBSUB
+	case "master":
+		return CLIENT_TYPE_MASTER
+	}
+	return -1
+}
+
+// ip:port 的形式 unix socket 为 path:0
+func formatSockaddr(sa unix.Sockaddr) string {
+	switch a := sa.(type) {
+	case *unix.SockaddrInet4:
+		return net.JoinHostPort(net.IP(a.Addr[:]).String(), strconv.Itoa(a.Port))
+	case *unix.SockaddrInet6:
+		return net.JoinHostPort(net.IP(a.Addr[:]).String(), strconv.Itoa(a.Port))
+	case *unix.SockaddrUnix:
+		return a.Name + ":0"
+	}
+	return "?:0"
+}
+
+// 连接建立时记录两端的地址 连接断开之后就取不到了
+func setClientAddrs(c *GodisClient) {
+	if sa, err := unix.Getpeername(c.fd); err == nil {
+		c.addr = formatSockaddr(sa)
+	}
+	if sa, err := unix.Getsockname(c.fd); err == nil {
+		c.laddr = formatSockaddr(sa)
+	}
+}
+
+// 没有用户的伪客户端不受 ACL 限制
+func clientUserName(c *GodisClient) string {
+	if c.user == nil {
+		return "(superuser)"
+	}
+	return c.user.name
+}
+
+func getClientFlagsString(c *GodisClient) string {
+	var b strings.Builder
+	for _, f := range []struct {
+		flag int
+		ch   byte
+	}{
+		{CLIENT_SLAVE, 'S'},
+		{CLIENT_MASTER, 'M'},
+		{CLIENT_PUBSUB, 'P'},
+		{CLIENT_MULTI, 'x'},
+		{CLIENT_BLOCKED, 'b'},
+		{CLIENT_DIRTY_CAS, 'd'},
+		{CLIENT_CLOSE_AFTER_REPLY, 'c'},
+		{CLIENT_ASKING, 'A'},
+		{CLIENT_NO_EVICT, 'e'},
+	} {
+		if c.flags&f.flag != 0 {
+			b.WriteByte(f.ch)
+		}
+	}
+	if b.Len() == 0 {
+		return "N"
+	}
+	return b.String()
+}
+
+// CLIENT LIST 中的一行
+func catClientInfoString(c *GodisClient) string {
+	now := GetMsTime()
+	multi := -1
+	if c.flags&CLIENT_MULTI != 0 {
+		multi = len(c.mstate.commands)
+	}
+	omem := 0
+	for n := c.reply.First(); n != nil; n = n.next {
+		omem += len(n.Val.StrVal())
+	}
+	events := "r"
+	if c.reply.Length() > 0 {
+		events = "rw"
+	}
+	cmd := "NULL"
+	if c.lastcmd != nil {
+		cmd = c.lastcmd.name
+	}
+	return fmt.Sprintf("id=%d addr=%s laddr=%s fd=%d name=%s age=%d idle=%d flags=%s db=%d sub=%d psub=%d multi=%d "+
+		"qbuf=%d qbuf-free=%d obl=0 oll=%d omem=%d events=%s cmd=%s user=%s resp=%d",
+		c.id, c.addr, c.laddr, c.fd, c.name, (now-c.ctime)/1000, now/1000-c.lastinteraction, getClientFlagsString(c),
+		c.db.id, len(c.pubsubChannels), len(c.pubsubPatterns), multi, c.queryLen, len(c.queryBuf)-c.queryLen,
+		c.reply.Length(), omem, events, cmd, clientUserName(c), c.resp)
+}
+
+// 按 id 排序 ctype 为 -1 时不过滤类型
+func getAllClientsInfoString(ctype int, ids map[int64]bool) string {
+	clients := make([]*GodisClient, 0, len(server.clients))
+	for _, c := range server.clients {
+		if ctype != -1 && getClientType(c) != ctype {
+			continue
+		}
+		if ids != nil && !ids[c.id] {
+			continue
+		}
+		clients = append(clients, c)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].id < clients[j].id })
+	var b strings.Builder
+	for _, c := range clients {
+		b.WriteString(catClientInfoString(c))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func clientCommand(c *GodisClient) {
+	sub := strings.ToLower(c.args[1].StrVal())
+	switch {
+	case sub == "id" && len(c.args) == 2:
+		c.AddReplyInt(c.id)
+	case sub == "info" && len(c.args) == 2:
+		c.AddReplyVerbatim(catClientInfoString(c)+"\n", "txt")
+	case sub == "list":
+		// CLIENT LIST [TYPE normal|master|replica|pubsub] [ID id [id ...]]
+		ctype := -1
+		var ids map[int64]bool
+		if len(c.args) == 4 && strings.EqualFold(c.args[2].StrVal(), "type") {
+			if ctype = getClientTypeByName(c.args[3].StrVal()); ctype == -1 {
+				c.AddReplyErrorFormat("Unknown client type '%s'", c.args[3].StrVal())
+				return
+			}
+		} else if len(c.args) > 3 && strings.EqualFold(c.args[2].StrVal(), "id") {
+			ids = make(map[int64]bool)
+			for _, arg := range c.args[3:] {
+				id, err := arg.ParseInt()
+				if err != nil || id <= 0 {
+					c.AddReplyError("Invalid client ID")
+					return
+				}
+				ids[id] = true
+			}
+		} else if len(c.args) != 2 {
+			c.AddReply(shared.syntaxerr)
+			return
+		}
+		c.AddReplyVerbatim(getAllClientsInfoString(ctype, ids), "txt")
+	case sub == "setname" && len(c.args) == 3:
+		name := c.args[2].StrVal()
+		if !validateClientName(name) {
+			c.AddReplyError("Client names cannot contain spaces, newlines or special characters.")
+			return
+		}
+		c.name = name
+		c.AddReply(shared.ok)
+	case sub == "getname" && len(c.args) == 2:
+		if c.name == "" {
+			c.AddReplyNull()
+		} else {
+			c.AddReplyBulkStr(c.name)
+		}
+	case sub == "kill":
+		clientKillCommand(c)
+	case sub == "pause" && (len(c.args) == 3 || len(c.args) == 4):
+		// CLIENT PAUSE timeout [WRITE|ALL]
+		timeout, ok := getPositiveLongFromObjectOrReply(c, c.args[2], "timeout is not an integer or out of range")
+		if !ok {
+			return
+		}
+		ptype := CLIENT_PAUSE_ALL
+		if len(c.args) == 4 {
+			switch strings.ToLower(c.args[3].StrVal()) {
+			case "write":
+				ptype = CLIENT_PAUSE_WRITE
+			case "all":
+			default:
+				c.AddReplyError("CLIENT PAUSE mode must be WRITE or ALL")
+				return
+			}
+		}
+		pauseClients(GetMsTime()+timeout, ptype)
+		c.AddReply(shared.ok)
+	case sub == "unpause" && len(c.args) == 2:
+		unpauseClients()
+		c.AddReply(shared.ok)
+	case sub == "no-evict" && len(c.args) == 3:
+		switch strings.ToLower(c.args[2].StrVal()) {
+		case "on":
+			c.flags |= CLIENT_NO_EVICT
+		case "off":
+			c.flags &^= CLIENT_NO_EVICT
+		default:
+			c.AddReply(shared.syntaxerr)
+			return
+		}
+		c.AddReply(shared.ok)
+	default:
+		c.AddReplyErrorFormat("unknown subcommand or wrong number of arguments for '%s'. Try CLIENT HELP.", c.args[1].StrVal())
+	}
+}
+
+/*
+CLIENT KILL addr:port 旧的形式 回复 OK 或者错误
+CLIENT KILL [ID id] [ADDR addr] [LADDR addr] [USER name] [TYPE type] [SKIPME yes|no] [MAXAGE seconds]
+新的形式回复关闭的客户端数量 SKIPME 默认为 yes
+*/
+func clientKillCommand(c *GodisClient) {
+	var id int64
+	var addr, laddr, user string
+	ctype, maxage := -1, int64(0)
+	skipme := true
+	if len(c.args) == 3 {
+		addr = c.args[2].StrVal()
+		skipme = false
+	} else if len(c.args) > 3 && len(c.args)%2 == 0 {
+		for i := 2; i < len(c.args); i += 2 {
+			val := c.args[i+1].StrVal()
+			switch strings.ToLower(c.args[i].StrVal()) {
+			case "id":
+				v, err := c.args[i+1].ParseInt()
+				if err != nil || v <= 0 {
+					c.AddReplyError("client-id should be greater than 0")
+					return
+				}
+				id = v
+			case "addr":
+				addr = val
+			case "laddr":
+				laddr = val
+			case "user":
+				if aclGetUserByName(val) == nil {
+					c.AddReplyErrorFormat("No such user '%s'", val)
+					return
+				}
+				user = val
+			case "type":
+				if ctype = getClientTypeByName(val); ctype == -1 {
+					c.AddReplyErrorFormat("Unknown client type '%s'", val)
+					return
+				}
+			case "skipme":
+				switch strings.ToLower(val) {
+				case "yes":
+					skipme = true
+				case "no":
+					skipme = false
+				default:
+					c.AddReply(shared.syntaxerr)
+					return
+				}
+			case "maxage":
+				v, err := c.args[i+1].ParseInt()
+				if err != nil || v <= 0 {
+					c.AddReplyError("maxage should be greater than 0")
+					return
+				}
+				maxage = v
+			default:
+				c.AddReply(shared.syntaxerr)
+				return
+			}
+		}
+	} else {
+		c.AddReply(shared.syntaxerr)
+		return
+	}
+
+	now := GetMsTime()
+	killed := 0
+	for _, other := range server.clients {
+		if addr != "" && other.addr != addr || laddr != "" && other.laddr != laddr ||
+			id != 0 && other.id != id || user != "" && clientUserName(other) != user ||
+			ctype != -1 && getClientType(other) != ctype || maxage != 0 && (now-other.ctime)/1000 < maxage {
+			continue
+		}
+		if other == c && skipme {
+			continue
+		}
+		// 关闭自己时先把回复发送出去
+		if other == c {
+			c.flags |= CLIENT_CLOSE_AFTER_REPLY
+		} else {
+			freeClient(other)
+		}
+		killed++
+	}
+	if len(c.args) == 3 {
+		if killed == 0 {
+			c.AddReplyError("No such client")
+			return
+		}
+		c.AddReply(shared.ok)
+		return
+	}
+	c.AddReplyInt(int64(killed))
+}
+
+/* ----------------------------- CLIENT PAUSE ----------------------------- */
+
+/*
+暂停期间普通客户端的命令（WRITE 时只有可能写数据的命令）被推迟到暂停结束之后执行
+主节点和副本的连接不暂停 主动过期和淘汰也暂停 数据集保持不变
+*/
+func pauseClients(end int64, ptype int) {
+	if ptype > server.clientPauseType {
+		server.clientPauseType = ptype
+	}
+	if end > server.clientPauseEndTime {
+		server.clientPauseEndTime = end
+	}
+}
+
+// 唤醒被推迟的客户端 它们的命令在 beforeSleep 中执行
+func unpauseClients() {
+	server.clientPauseType = CLIENT_PAUSE_OFF
+	server.clientPauseEndTime = 0
+	for len(server.postponedClients) > 0 {
+		unblockClient(server.postponedClients[0])
+	}
+}
+
+// 暂停时间到了就解除暂停 返回是否仍然处于暂停状态
+func checkClientPauseTimeoutAndReturnIfPaused() bool {
+	if server.clientPauseType == CLIENT_PAUSE_OFF {
+		return false
+	}
+	if server.clientPauseEndTime <= GetMsTime() {
+		unpauseClients()
+		return false
+	}
+	return true
+}
+
+// 可能产生写入的命令在 CLIENT PAUSE WRITE 期间推迟
+func isMayReplicateCommand(c *GodisClient, cmd *GodisCommand) bool {
+	if cmd.flags&CMD_WRITE != 0 {
+		return true
+	}
+	switch cmd.name {
+	case "eval", "evalsha", "publish":
+		return true
+	case "exec":
+		return c.mstate.cmdFlags&CMD_WRITE != 0
+	}
+	return false
+}
+
+func clientShouldBePaused(c *GodisClient, cmd *GodisCommand) bool {
+	if c.flags&(CLIENT_SLAVE|CLIENT_MASTER) != 0 || !checkClientPauseTimeoutAndReturnIfPaused() {
+		return false
+	}
+	return server.clientPauseType == CLIENT_PAUSE_ALL || isMayReplicateCommand(c, cmd)
+}
+
+// 保留当前命令的参数 唤醒之后重新执行
+func blockPostponeClient(c *GodisClient) {
+	c.flags |= CLIENT_BLOCKED
+	c.bstate.postponed = true
+	server.postponedClients = append(server.postponedClients, c)
+	server.blockedClients++
+}
+
+/* ----------------------------- 空闲超时 ----------------------------- */
+
+/*
+关闭超过 timeout 秒没有读写的客户端
+副本 主节点 订阅中以及阻塞中的客户端不受影响 阻塞命令有自己的超时
+*/
+func clientsCronHandleTimeout() {
+	if server.maxidletime == 0 {
+		return
+	}
+	now := GetMsTime() / 1000
+	for _, c := range server.clients {
+		if c.flags&(CLIENT_SLAVE|CLIENT_MASTER|CLIENT_BLOCKED|CLIENT_PUBSUB) != 0 {
+			continue
+		}
+		if now-c.lastinteraction > int64(server.maxidletime) {
+			serverLog(LL_VERBOSE, "Closing idle client, fd: %v", c.fd)
+			freeClient(c)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestClientCommand(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	other := newTestClient(t)
+	expectReply(t, c, ":"+strconv.FormatInt(c.id, 10)+"\r\n", "client", "id")
+	expectReply(t, c, "$-1\r\n", "client", "getname")
+	expectReply(t, c, "+OK\r\n", "client", "setname", "worker-1")
+	expectReply(t, c, "$8\r\nworker-1\r\n", "client", "getname")
+	expectReply(t, c, "-ERR Client names cannot contain spaces, newlines or special characters.\r\n", "client", "setname", "a b")
+	expectReply(t, c, "-ERR Unknown client type 'foo'\r\n", "client", "list", "type", "foo")
+	expectReply(t, c, "-ERR unknown subcommand or wrong number of arguments for 'foo'. Try CLIENT HELP.\r\n", "client", "foo")
+
+	c.run("select", "2")
+	c.run("client", "no-evict", "on")
+	info := c.run("client", "info")
+	for _, field := range []string{"id=" + strconv.FormatInt(c.id, 10) + " ", " name=worker-1 ", " flags=e ",
+		" db=2 ", " multi=-1 ", " cmd=client ", " user=default ", " resp=2\n"} {
+		if !strings.Contains(info, field) {
+			t.Errorf("expect %q in %q", field, info)
+		}
+	}
+
+	// 按 id 排序
+	list := c.run("client", "list")
+	lines := strings.Split(strings.TrimSuffix(list[strings.Index(list, "\r\n")+2:], "\n\r\n"), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], fmt.Sprintf("id=%d ", c.id)) ||
+		!strings.HasPrefix(lines[1], fmt.Sprintf("id=%d ", other.id)) || !strings.Contains(lines[1], " cmd=NULL ") {
+		t.Errorf("unexpected client list %q", list)
+	}
+	list = c.run("client", "list", "id", strconv.FormatInt(other.id, 10))
+	if strings.Count(list, "id=") != 1 || !strings.Contains(list, fmt.Sprintf("id=%d ", other.id)) {
+		t.Errorf("unexpected client list %q", list)
+	}
+	other.run("subscribe", "ch")
+	list = c.run("client", "list", "type", "pubsub")
+	if strings.Count(list, "id=") != 1 || !strings.Contains(list, " flags=P ") || !strings.Contains(list, " sub=1 ") {
+		t.Errorf("unexpected client list %q", list)
+	}
+}
+
+func TestClientKill(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	other, _ := newTestConnClient(t)
+	other2, _ := newTestConnClient(t)
+	expectReply(t, c, "-ERR No such client\r\n", "client", "kill", "1.2.3.4:5")
+	expectReply(t, c, "-ERR No such user 'nobody'\r\n", "client", "kill", "user", "nobody")
+	expectReply(t, c, "-ERR client-id should be greater than 0\r\n", "client", "kill", "id", "0")
+	expectReply(t, c, "-ERR syntax error\r\n", "client", "kill", "id", "1", "skipme")
+	expectReply(t, c, ":1\r\n", "client", "kill", "id", strconv.FormatInt(other.id, 10))
+	if server.clients[other.fd] == other {
+		t.Errorf("client not killed")
+	}
+	// 默认跳过自己
+	expectReply(t, c, ":1\r\n", "client", "kill", "user", "default")
+	if server.clients[other2.fd] == other2 || server.clients[c.fd] != c {
+		t.Errorf("unexpected clients after kill by user")
+	}
+	expectReply(t, c, ":1\r\n", "client", "kill", "type", "normal", "skipme", "no")
+	if c.flags&CLIENT_CLOSE_AFTER_REPLY == 0 {
+		t.Errorf("expect to close after reply")
+	}
+}
+
+func TestClientPause(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	other := newTestClient(t)
+	expectReply(t, c, "-ERR CLIENT PAUSE mode must be WRITE or ALL\r\n", "client", "pause", "100", "foo")
+	expectReply(t, c, "-ERR timeout is not an integer or out of range\r\n", "client", "pause", "-1")
+
+	// WRITE 只推迟可能写数据的命令
+	expectReply(t, c, "+OK\r\n", "client", "pause", "10000", "write")
+	expectReply(t, other, "$-1\r\n", "get", "k")
+	expectReply(t, other, "", "set", "k", "v")
+	if other.flags&CLIENT_BLOCKED == 0 || len(server.postponedClients) != 1 || server.blockedClients != 1 {
+		t.Fatalf("client not postponed")
+	}
+	expectReply(t, c, "$-1\r\n", "get", "k")
+	expectReply(t, c, "+OK\r\n", "client", "unpause")
+	processUnblockedClients()
+	if got := other.takeReply(); got != "+OK\r\n" || server.blockedClients != 0 {
+		t.Errorf("unexpected reply %q after unpause", got)
+	}
+
+	// ALL 推迟所有命令 超时之后自动恢复
+	expectReply(t, c, "+OK\r\n", "client", "pause", "50")
+	expectReply(t, other, "", "get", "k")
+	time.Sleep(60 * time.Millisecond)
+	beforeSleep(server.aeLoop)
+	if got := other.takeReply(); got != "$1\r\nv\r\n" || server.clientPauseType != CLIENT_PAUSE_OFF {
+		t.Errorf("unexpected reply %q after pause timeout", got)
+	}
+
+	// 暂停期间过期的 key 不删除
+	c.run("set", "e", "v", "px", "1")
+	time.Sleep(5 * time.Millisecond)
+	expectReply(t, c, "+OK\r\n", "client", "pause", "10000", "write")
+	expectReply(t, c, "$-1\r\n", "get", "e")
+	if c.db.data.Get(CreateObject(GSTR, "e")) == nil {
+		t.Errorf("expired key deleted during pause")
+	}
+}
+
+func TestClientsTimeout(t *testing.T) {
+	initTestServer(t)
+	server.maxidletime = 10
+	idle, _ := newTestConnClient(t)
+	active, _ := newTestConnClient(t)
+	sub, _ := newTestConnClient(t)
+	sub.run("subscribe", "ch")
+	for _, c := range []*GodisClient{idle, sub} {
+		c.lastinteraction = GetMsTime()/1000 - 11
+	}
+	clientsCronHandleTimeout()
+	if server.clients[idle.fd] == idle || server.clients[active.fd] != active || server.clients[sub.fd] != sub {
+		t.Errorf("unexpected clients after timeout")
+	}
+}
+
+func TestMaxClients(t *testing.T) {
+	initTestServer(t)
+	server.maxclients = 1
+	port := freeTestPort(t)
+	fd, err := TcpServer("127.0.0.1", port, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unix.Close(fd) })
+	for i, expect := range []string{"", "-ERR max number of clients reached\r\n"} {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		AcceptHandler(server.aeLoop, fd, nil)
+		if i == 0 {
+			if len(server.clients) != 1 {
+				t.Fatalf("client not accepted")
+			}
+			for _, c := range server.clients {
+				if c.addr != conn.LocalAddr().String() || c.laddr != conn.RemoteAddr().String() {
+					t.Errorf("unexpected client address %s %s", c.addr, c.laddr)
+				}
+				t.Cleanup(func() { freeClient(c) })
+			}
+			continue
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 64)
+		n, _ := conn.Read(buf)
+		if string(buf[:n]) != expect || server.statRejectedConn != 1 {
+			t.Errorf("expect %q, got %q", expect, buf[:n])
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import "strconv"
+
+// notify-keyspace-events 的各个标记
+const (
+	NOTIFY_KEYSPACE = 1 << 0  // K
+	NOTIFY_KEYEVENT = 1 << 1  // E
+	NOTIFY_GENERIC  = 1 << 2  // g
+	NOTIFY_STRING   = 1 << 3  // $
+	NOTIFY_LIST     = 1 << 4  // l
+	NOTIFY_SET      = 1 << 5  // s
+	NOTIFY_HASH     = 1 << 6  // h
+	NOTIFY_ZSET     = 1 << 7  // z
+	NOTIFY_EXPIRED  = 1 << 8  // x
+	NOTIFY_EVICTED  = 1 << 9  // e
+	NOTIFY_KEY_MISS = 1 << 10 // m 不包含在 A 中
+	NOTIFY_NEW      = 1 << 11 // n 不包含在 A 中
+	NOTIFY_ALL      = NOTIFY_GENERIC | NOTIFY_STRING | NOTIFY_LIST | NOTIFY_SET | NOTIFY_HASH |
+		NOTIFY_ZSET | NOTIFY_EXPIRED | NOTIFY_EVICTED // A
+)
+
+// 解析 notify-keyspace-events 的参数 有不认识的字符时返回 false
+func keyspaceEventsStringToFlags(classes string) (int, bool) {
+	flags := 0
+	for _, ch := range classes {
+		switch ch {
+		case 'A':
+			flags |= NOTIFY_ALL
+		case 'g':
+			flags |= NOTIFY_GENERIC
+		case '$':
+			flags |= NOTIFY_STRING
+		case 'l':
+			flags |= NOTIFY_LIST
+		case 's':
+			flags |= NOTIFY_SET
+		case 'h':
+			flags |= NOTIFY_HASH
+		case 'z':
+			flags |= NOTIFY_ZSET
+		case 'x':
+			flags |= NOTIFY_EXPIRED
+		case 'e':
+			flags |= NOTIFY_EVICTED
+		case 'K':
+			flags |= NOTIFY_KEYSPACE
+		case 'E':
+			flags |= NOTIFY_KEYEVENT
+		case 'm':
+			flags |= NOTIFY_KEY_MISS
+		case 'n':
+			flags |= NOTIFY_NEW
+		default:
+			return 0, false
+		}
+	}
+	return flags, true
+}
+
+/*
+发布 key 相关的事件 typ 为事件的类别
+K 开启时发布到 __keyspace@<db>__:<key> 消息为事件名
+E 开启时发布到 __keyevent@<db>__:<event> 消息为 key
+*/
+func notifyKeyspaceEvent(typ int, event string, key *Gobj, dbid int) {
+	flags := server.notifyKeyspaceEvents
+	if flags&typ == 0 {
+		return
+	}
+	db := strconv.Itoa(dbid)
+	if flags&NOTIFY_KEYSPACE != 0 {
+		channel := CreateObject(GSTR, "__keyspace@"+db+"__:"+key.StrVal())
+		message := CreateObject(GSTR, event)
+		pubsubPublishMessage(channel, message)
+		channel.DecrRefCount()
+		message.DecrRefCount()
+	}
+	if flags&NOTIFY_KEYEVENT != 0 {
+		channel := CreateObject(GSTR, "__keyevent@"+db+"__:"+event)
+		pubsubPublishMessage(channel, key)
+		channel.DecrRefCount()
+	}
+}
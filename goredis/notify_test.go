@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestKeyspaceEventsStringToFlags(t *testing.T) {
+	flags, ok := keyspaceEventsStringToFlags("KEA")
+	if !ok || flags != NOTIFY_KEYSPACE|NOTIFY_KEYEVENT|NOTIFY_ALL {
+		t.Errorf("KEA: got %b %v", flags, ok)
+	}
+	if flags&(NOTIFY_KEY_MISS|NOTIFY_NEW) != 0 {
+		t.Error("A should not include m and n")
+	}
+	if flags, ok = keyspaceEventsStringToFlags(""); !ok || flags != 0 {
+		t.Errorf("empty: got %b %v", flags, ok)
+	}
+	if _, ok = keyspaceEventsStringToFlags("KEw"); ok {
+		t.Error("invalid class accepted")
+	}
+}
+
+// 依次检查收到的 pmessage 参数为 channel message 交替排列
+func expectEvents(t *testing.T, sub *GodisClient, pattern string, events ...string) {
+	t.Helper()
+	bulk := func(s string) string { return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n" }
+	var want strings.Builder
+	for i := 0; i < len(events); i += 2 {
+		want.WriteString("*4\r\n$8\r\npmessage\r\n" + bulk(pattern) + bulk(events[i]) + bulk(events[i+1]))
+	}
+	if got := sub.takeReply(); got != want.String() {
+		t.Errorf("expect %q, got %q", want.String(), got)
+	}
+}
+
+func TestNotifyKeyspaceEvent(t *testing.T) {
+	initTestServer(t)
+	server.notifyKeyspaceEvents, _ = keyspaceEventsStringToFlags("KEA")
+	sub := newTestClient(t)
+	sub.run("psubscribe", "__key*__:*")
+	c := newTestClient(t)
+
+	c.run("set", "k", "v")
+	expectEvents(t, sub, "__key*__:*", "__keyspace@0__:k", "set", "__keyevent@0__:set", "k")
+	c.run("select", "1")
+	c.run("rpush", "l", "a")
+	c.run("lpop", "l")
+	expectEvents(t, sub, "__key*__:*",
+		"__keyspace@1__:l", "rpush", "__keyevent@1__:rpush", "l",
+		"__keyspace@1__:l", "lpop", "__keyevent@1__:lpop", "l",
+		"__keyspace@1__:l", "del", "__keyevent@1__:del", "l")
+	c.run("get", "nokey")
+	expectEvents(t, sub, "__key*__:*")
+
+	// 只订阅 keyevent 的过期事件
+	server.notifyKeyspaceEvents, _ = keyspaceEventsStringToFlags("Ex")
+	c.run("hset", "h", "f", "v")
+	c.run("pexpire", "h", "100000")
+	c.db.setExpire(CreateObject(GSTR, "h"), GetMsTime()-1)
+	c.run("exists", "h")
+	expectEvents(t, sub, "__key*__:*", "__keyevent@1__:expired", "h")
+
+	server.notifyKeyspaceEvents, _ = keyspaceEventsStringToFlags("Emn")
+	c.run("get", "nokey")
+	c.run("sadd", "s", "m")
+	c.run("sadd", "s", "m2")
+	expectEvents(t, sub, "__key*__:*", "__keyevent@1__:keymiss", "nokey", "__keyevent@1__:new", "s")
+
+	server.notifyKeyspaceEvents = 0
+	c.run("del", "s")
+	expectEvents(t, sub, "__key*__:*")
+}
+
+func TestNotifyGenericEvents(t *testing.T) {
+	initTestServer(t)
+	server.notifyKeyspaceEvents, _ = keyspaceEventsStringToFlags("Eg$z")
+	sub := newTestClient(t)
+	sub.run("psubscribe", "__keyevent@0__:*")
+	c := newTestClient(t)
+	c.run("set", "a", "1", "ex", "100")
+	c.run("incr", "a")
+	c.run("rename", "a", "b")
+	c.run("persist", "b")
+	c.run("zadd", "z", "1", "m")
+	c.run("zunionstore", "z2", "1", "z")
+	c.run("zpopmin", "z")
+	p := "__keyevent@0__:*"
+	expectEvents(t, sub, p,
+		"__keyevent@0__:set", "a", "__keyevent@0__:expire", "a",
+		"__keyevent@0__:incrby", "a",
+		"__keyevent@0__:rename_from", "a", "__keyevent@0__:rename_to", "b",
+		"__keyevent@0__:persist", "b",
+		"__keyevent@0__:zadd", "z",
+		"__keyevent@0__:zunionstore", "z2",
+		"__keyevent@0__:zpopmin", "z", "__keyevent@0__:del", "z")
+}
@@ -1,6 +1,10 @@
 package main
 
-import "strconv"
+import (
+	"math"
+	"strconv"
+	"unsafe"
+)
 
 // Gobj 是 Redis 中的对象结构体 Gtype 是对象的枚举类型
 type Gtype uint8
@@ -19,6 +23,10 @@ type Gobj struct {
 	Type_    Gtype
 	Val_     Gval
 	refCount int
+	// LRU 策略下是最后一次访问的时钟（秒 24 位）
+	// LFU 策略下高 16 位是最后一次递减的时间（分钟） 低 8 位是对数计数器
+	lru      uint32
+	memUsage int64 // 作为 key 的值时最近一次计入数据库的内存大小
 }
 
 // s := "-987" -> 输出：-987 <nil>
@@ -38,11 +46,7 @@ func (o *Gobj) StrVal() string {
 }
 
 func CreateFromInt(val int64) *Gobj {
-	return &Gobj{
-		Type_:    GSTR,
-		Val_:     strconv.FormatInt(val, 10),
-		refCount: 1,
-	}
+	return CreateObject(GSTR, strconv.FormatInt(val, 10))
 }
 
 func CreateObject(typ Gtype, ptr interface{}) *Gobj {
@@ -50,6 +54,7 @@ func CreateObject(typ Gtype, ptr interface{}) *Gobj {
 		Type_:    typ,
 		Val_:     ptr,
 		refCount: 1,
+		lru:      objectInitLRU(),
 	}
 }
 
@@ -64,3 +69,146 @@ func (o *Gobj) DecrRefCount() {
 		o.Val_ = nil
 	}
 }
+
+func CreateListObject() *Gobj {
+	return CreateObject(GLIST, ListCreate(ListType{EqualFunc: GStrEqual}))
+}
+
+// field 表同样使用支持渐进式 rehash 的 Dict
+func CreateHashObject() *Gobj {
+	return CreateObject(GDICT, DictCreate(DictType{HashFunc: GStrHash, EqualFunc: GStrEqual}))
+}
+
+// 严格解析整数 不能有多余的字符
+func (o *Gobj) ParseInt() (int64, error) {
+	return strconv.ParseInt(o.StrVal(), 10, 64)
+}
+
+// 解析失败时回复错误 msg 为空时使用默认的错误信息
+func getLongLongFromObjectOrReply(c *GodisClient, o *Gobj, msg string) (int64, bool) {
+	v, err := o.ParseInt()
+	if err != nil {
+		if msg != "" {
+			c.AddReplyError(msg)
+		} else {
+			c.AddReply(shared.notinterr)
+		}
+		return 0, false
+	}
+	return v, true
+}
+
+// 要求为非负整数
+func getPositiveLongFromObjectOrReply(c *GodisClient, o *Gobj, msg string) (int64, bool) {
+	v, ok := getLongLongFromObjectOrReply(c, o, msg)
+	if !ok {
+		return 0, false
+	}
+	if v < 0 {
+		if msg != "" {
+			c.AddReplyError(msg)
+		} else {
+			c.AddReplyError("value is out of range, must be positive")
+		}
+		return 0, false
+	}
+	return v, true
+}
+
+func (o *Gobj) ParseFloat() (float64, error) {
+	v, err := strconv.ParseFloat(o.StrVal(), 64)
+	if err == nil && math.IsNaN(v) {
+		return 0, strconv.ErrSyntax
+	}
+	return v, err
+}
+
+func getDoubleFromObjectOrReply(c *GodisClient, o *Gobj, msg string) (float64, bool) {
+	v, err := o.ParseFloat()
+	if err != nil {
+		if msg != "" {
+			c.AddReplyError(msg)
+		} else {
+			c.AddReply(shared.notfloaterr)
+		}
+		return 0, false
+	}
+	return v, true
+}
+
+// INCRBYFLOAT 等命令的结果 不使用科学计数法
+func formatHumanFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// 内存估算使用的结构体大小
+var (
+	objHeaderSize    = int64(unsafe.Sizeof(Gobj{}))
+	stringHeaderSize = int64(unsafe.Sizeof(""))
+	listSize         = int64(unsafe.Sizeof(List{}))
+	listNodeSize     = int64(unsafe.Sizeof(Node{}))
+	zsetSize         = int64(unsafe.Sizeof(zset{}) + unsafe.Sizeof(zskiplist{}))
+	zslNodeSize      = int64(unsafe.Sizeof(zskiplistNode{}))
+	zslLevelSize     = int64(unsafe.Sizeof(zskiplistLevel{}))
+	scoreObjectSize  = objHeaderSize + int64(unsafe.Sizeof(float64(0)))
+)
+
+const OBJ_COMPUTE_SIZE_DEF_SAMPLES = 5 // MEMORY USAGE 默认的采样个数
+
+func stringObjectSize(o *Gobj) int64 {
+	return objHeaderSize + stringHeaderSize + int64(len(o.StrVal()))
+}
+
+/*
+估算对象占用的内存
+集合类型只采样前 samples 个元素 按平均大小乘以元素个数 samples 为 0 时计算全部元素
+*/
+func objectComputeSize(o *Gobj, samples int64) int64 {
+	switch o.Type_ {
+	case GSTR:
+		return stringObjectSize(o)
+	case GLIST:
+		list := o.Val_.(*List)
+		length := int64(list.Length())
+		size := objHeaderSize + listSize + length*listNodeSize
+		var elesize, n int64
+		for node := list.First(); node != nil && (samples == 0 || n < samples); node = node.Next() {
+			elesize += stringObjectSize(node.Val)
+			n++
+		}
+		if n > 0 {
+			size += elesize / n * length
+		}
+		return size
+	case GSET, GDICT:
+		dict := o.Val_.(*Dict)
+		size := objHeaderSize + dict.MemUsage()
+		var elesize, n int64
+		it := dict.GetIterator()
+		for e := it.Next(); e != nil && (samples == 0 || n < samples); e = it.Next() {
+			elesize += stringObjectSize(e.Key)
+			if e.Val != nil {
+				elesize += stringObjectSize(e.Val)
+			}
+			n++
+		}
+		it.Release()
+		if n > 0 {
+			size += elesize / n * dict.Len()
+		}
+		return size
+	case GZSET:
+		zs := o.Val_.(*zset)
+		size := objHeaderSize + zsetSize + zs.dict.MemUsage()
+		var elesize, n int64
+		for x := zs.zsl.header.level[0].forward; x != nil && (samples == 0 || n < samples); x = x.level[0].forward {
+			elesize += stringObjectSize(x.member) + scoreObjectSize + zslNodeSize + int64(len(x.level))*zslLevelSize
+			n++
+		}
+		if n > 0 {
+			size += elesize / n * zs.zsl.length
+		}
+		return size
+	}
+	return objHeaderSize
+}
@@ -0,0 +1,231 @@
+package main
+
+import "strings"
+
+// 客户端订阅的频道和模式总数
+func clientSubscriptionsCount(c *GodisClient) int {
+	return len(c.pubsubChannels) + len(c.pubsubPatterns)
+}
+
+func indexOfString(list []string, s string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// 从订阅者列表中删除客户端 没有订阅者时删除整个频道
+func removeSubscriber(subscribers map[string][]*GodisClient, name string, c *GodisClient) {
+	clients := subscribers[name]
+	for i, sc := range clients {
+		if sc == c {
+			clients = append(clients[:i], clients[i+1:]...)
+			break
+		}
+	}
+	if len(clients) == 0 {
+		delete(subscribers, name)
+	} else {
+		subscribers[name] = clients
+	}
+}
+
+// subscribe / unsubscribe 等命令的回复 count 为订阅总数
+func addReplyPubsubSubscription(c *GodisClient, kind string, name *Gobj) {
+	c.AddReplyPushLen(3)
+	c.AddReplyBulkStr(kind)
+	if name == nil {
+		c.AddReplyNull()
+	} else {
+		c.AddReplyBulk(name)
+	}
+	c.AddReplyInt(int64(clientSubscriptionsCount(c)))
+}
+
+func pubsubSubscribeChannel(c *GodisClient, channel *Gobj) {
+	name := channel.StrVal()
+	if indexOfString(c.pubsubChannels, name) < 0 {
+		c.pubsubChannels = append(c.pubsubChannels, name)
+		server.pubsubChannels[name] = append(server.pubsubChannels[name], c)
+	}
+	addReplyPubsubSubscription(c, "subscribe", channel)
+}
+
+func pubsubUnsubscribeChannel(c *GodisClient, channel *Gobj, notify bool) {
+	name := channel.StrVal()
+	if i := indexOfString(c.pubsubChannels, name); i >= 0 {
+		c.pubsubChannels = append(c.pubsubChannels[:i], c.pubsubChannels[i+1:]...)
+		removeSubscriber(server.pubsubChannels, name, c)
+	}
+	if notify {
+		addReplyPubsubSubscription(c, "unsubscribe", channel)
+	}
+}
+
+func pubsubSubscribePattern(c *GodisClient, pattern *Gobj) {
+	name := pattern.StrVal()
+	if indexOfString(c.pubsubPatterns, name) < 0 {
+		c.pubsubPatterns = append(c.pubsubPatterns, name)
+		server.pubsubPatterns[name] = append(server.pubsubPatterns[name], c)
+	}
+	addReplyPubsubSubscription(c, "psubscribe", pattern)
+}
+
+func pubsubUnsubscribePattern(c *GodisClient, pattern *Gobj, notify bool) {
+	name := pattern.StrVal()
+	if i := indexOfString(c.pubsubPatterns, name); i >= 0 {
+		c.pubsubPatterns = append(c.pubsubPatterns[:i], c.pubsubPatterns[i+1:]...)
+		removeSubscriber(server.pubsubPatterns, name, c)
+	}
+	if notify {
+		addReplyPubsubSubscription(c, "punsubscribe", pattern)
+	}
+}
+
+// 退订全部频道 没有订阅任何频道时也要回复一次
+func pubsubUnsubscribeAllChannels(c *GodisClient, notify bool) {
+	if len(c.pubsubChannels) == 0 {
+		if notify {
+			addReplyPubsubSubscription(c, "unsubscribe", nil)
+		}
+		return
+	}
+	for len(c.pubsubChannels) > 0 {
+		channel := CreateObject(GSTR, c.pubsubChannels[0])
+		pubsubUnsubscribeChannel(c, channel, notify)
+		channel.DecrRefCount()
+	}
+}
+
+func pubsubUnsubscribeAllPatterns(c *GodisClient, notify bool) {
+	if len(c.pubsubPatterns) == 0 {
+		if notify {
+			addReplyPubsubSubscription(c, "punsubscribe", nil)
+		}
+		return
+	}
+	for len(c.pubsubPatterns) > 0 {
+		pattern := CreateObject(GSTR, c.pubsubPatterns[0])
+		pubsubUnsubscribePattern(c, pattern, notify)
+		pattern.DecrRefCount()
+	}
+}
+
+// 订阅数变为 0 时退出订阅模式
+func updatePubsubFlag(c *GodisClient) {
+	if clientSubscriptionsCount(c) > 0 {
+		c.flags |= CLIENT_PUBSUB
+	} else {
+		c.flags &^= CLIENT_PUBSUB
+	}
+}
+
+/*
+把消息发送给订阅了频道以及模式匹配频道的客户端
+消息和普通回复一样放入回复列表 由可写事件发送
+返回收到消息的客户端数
+*/
+func pubsubPublishMessage(channel, message *Gobj) int {
+	receivers := 0
+	name := channel.StrVal()
+	for _, c := range server.pubsubChannels[name] {
+		c.AddReplyPushLen(3)
+		c.AddReplyBulkStr("message")
+		c.AddReplyBulk(channel)
+		c.AddReplyBulk(message)
+		receivers++
+	}
+	for pattern, clients := range server.pubsubPatterns {
+		if !stringmatch(pattern, name, false) {
+			continue
+		}
+		for _, c := range clients {
+			c.AddReplyPushLen(4)
+			c.AddReplyBulkStr("pmessage")
+			c.AddReplyBulkStr(pattern)
+			c.AddReplyBulk(channel)
+			c.AddReplyBulk(message)
+			receivers++
+		}
+	}
+	return receivers
+}
+
+// SUBSCRIBE channel [channel ...]
+func subscribeCommand(c *GodisClient) {
+	for _, channel := range c.args[1:] {
+		pubsubSubscribeChannel(c, channel)
+	}
+	updatePubsubFlag(c)
+}
+
+// UNSUBSCRIBE [channel [channel ...]]
+func unsubscribeCommand(c *GodisClient) {
+	if len(c.args) == 1 {
+		pubsubUnsubscribeAllChannels(c, true)
+	} else {
+		for _, channel := range c.args[1:] {
+			pubsubUnsubscribeChannel(c, channel, true)
+		}
+	}
+	updatePubsubFlag(c)
+}
+
+// PSUBSCRIBE pattern [pattern ...]
+func psubscribeCommand(c *GodisClient) {
+	for _, pattern := range c.args[1:] {
+		pubsubSubscribePattern(c, pattern)
+	}
+	updatePubsubFlag(c)
+}
+
+// PUNSUBSCRIBE [pattern [pattern ...]]
+func punsubscribeCommand(c *GodisClient) {
+	if len(c.args) == 1 {
+		pubsubUnsubscribeAllPatterns(c, true)
+	} else {
+		for _, pattern := range c.args[1:] {
+			pubsubUnsubscribePattern(c, pattern, true)
+		}
+	}
+	updatePubsubFlag(c)
+}
+
+// PUBLISH channel message
+func publishCommand(c *GodisClient) {
+	receivers := pubsubPublishMessage(c.args[1], c.args[2])
+	c.AddReplyInt(int64(receivers))
+}
+
+// PUBSUB CHANNELS [pattern] | NUMSUB [channel ...] | NUMPAT
+func pubsubCommand(c *GodisClient) {
+	sub := strings.ToLower(c.args[1].StrVal())
+	switch {
+	case sub == "channels" && len(c.args) <= 3:
+		pattern := ""
+		if len(c.args) == 3 {
+			pattern = c.args[2].StrVal()
+		}
+		node := c.AddReplyDeferredLen()
+		n := 0
+		for name := range server.pubsubChannels {
+			if pattern == "" || stringmatch(pattern, name, false) {
+				c.AddReplyBulkStr(name)
+				n++
+			}
+		}
+		c.SetDeferredArrayLen(node, n)
+	case sub == "numsub":
+		c.AddReplyMapLen(len(c.args) - 2)
+		for _, channel := range c.args[2:] {
+			c.AddReplyBulk(channel)
+			c.AddReplyInt(int64(len(server.pubsubChannels[channel.StrVal()])))
+		}
+	case sub == "numpat" && len(c.args) == 2:
+		c.AddReplyInt(int64(len(server.pubsubPatterns)))
+	default:
+		c.AddReplyErrorFormat("unknown subcommand or wrong number of arguments for '%s'. Try PUBSUB HELP.", c.args[1].StrVal())
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func TestPubsub(t *testing.T) {
+	initTestServer(t)
+	sub := newTestClient(t)
+	psub := newTestClient(t)
+	pub := newTestClient(t)
+	expectReply(t, sub, "*3\r\n$9\r\nsubscribe\r\n$2\r\nc1\r\n:1\r\n*3\r\n$9\r\nsubscribe\r\n$2\r\nc2\r\n:2\r\n",
+		"subscribe", "c1", "c2")
+	expectReply(t, psub, "*3\r\n$10\r\npsubscribe\r\n$2\r\nc*\r\n:1\r\n", "psubscribe", "c*")
+
+	expectReply(t, pub, ":2\r\n", "publish", "c1", "hi")
+	if got := sub.takeReply(); got != "*3\r\n$7\r\nmessage\r\n$2\r\nc1\r\n$2\r\nhi\r\n" {
+		t.Errorf("unexpected message: %q", got)
+	}
+	if got := psub.takeReply(); got != "*4\r\n$8\r\npmessage\r\n$2\r\nc*\r\n$2\r\nc1\r\n$2\r\nhi\r\n" {
+		t.Errorf("unexpected pmessage: %q", got)
+	}
+	expectReply(t, pub, ":0\r\n", "publish", "other", "hi")
+
+	expectReply(t, pub, "*4\r\n$2\r\nc1\r\n:1\r\n$2\r\nc3\r\n:0\r\n", "pubsub", "numsub", "c1", "c3")
+	expectReply(t, pub, ":1\r\n", "pubsub", "numpat")
+	expectReply(t, pub, "*1\r\n$2\r\nc2\r\n", "pubsub", "channels", "*2")
+
+	// 订阅模式下只能执行订阅相关命令
+	expectReply(t, sub, "-ERR Can't execute 'get': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context\r\n",
+		"get", "k")
+	expectReply(t, sub, "*2\r\n$4\r\npong\r\n$0\r\n\r\n", "ping")
+	expectReply(t, sub, "*3\r\n$11\r\nunsubscribe\r\n$2\r\nc1\r\n:1\r\n*3\r\n$11\r\nunsubscribe\r\n$2\r\nc2\r\n:0\r\n",
+		"unsubscribe")
+	expectReply(t, sub, "$-1\r\n", "get", "k")
+	expectReply(t, sub, "*3\r\n$11\r\nunsubscribe\r\n$-1\r\n:0\r\n", "unsubscribe")
+
+	expectReply(t, psub, "*3\r\n$12\r\npunsubscribe\r\n$2\r\nc*\r\n:0\r\n", "punsubscribe", "c*")
+	if len(server.pubsubChannels) != 0 || len(server.pubsubPatterns) != 0 {
+		t.Errorf("subscriptions left: %v %v", server.pubsubChannels, server.pubsubPatterns)
+	}
+
+	// RESP3 下订阅后仍然可以执行普通命令
+	c3 := newTestClient(t)
+	c3.run("hello", "3")
+	expectReply(t, c3, ">3\r\n$9\r\nsubscribe\r\n$2\r\nc1\r\n:1\r\n", "subscribe", "c1")
+	expectReply(t, c3, "_\r\n", "get", "k")
+	pub.run("publish", "c1", "hi")
+	if got := c3.takeReply(); got != ">3\r\n$7\r\nmessage\r\n$2\r\nc1\r\n$2\r\nhi\r\n" {
+		t.Errorf("unexpected message: %q", got)
+	}
+}
+
+func TestPubsubFreeClient(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	c.run("subscribe", "c")
+	c.run("psubscribe", "p*")
+	freeClient(c)
+	if len(server.pubsubChannels) != 0 || len(server.pubsubPatterns) != 0 {
+		t.Errorf("subscriptions left: %v %v", server.pubsubChannels, server.pubsubPatterns)
+	}
+}
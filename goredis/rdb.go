@@ -0,0 +1,858 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+RDB 快照 格式与 Redis RDB version 9 兼容
+集合类型只写入最基础的编码（LIST / SET / ZSET_2 / HASH） Redis 可以直接加载
+*/
+const RDB_VERSION = 9
+
+// 对象类型
+const (
+	RDB_TYPE_STRING = 0
+	RDB_TYPE_LIST   = 1
+	RDB_TYPE_SET    = 2
+	RDB_TYPE_ZSET   = 3
+	RDB_TYPE_HASH   = 4
+	RDB_TYPE_ZSET_2 = 5 // 分数以二进制 double 保存
+)
+
+// 特殊的操作码
+const (
+	RDB_OPCODE_FUNCTION2     = 245
+	RDB_OPCODE_FUNCTION      = 246
+	RDB_OPCODE_MODULE_AUX    = 247
+	RDB_OPCODE_IDLE          = 248
+	RDB_OPCODE_FREQ          = 249
+	RDB_OPCODE_AUX           = 250
+	RDB_OPCODE_RESIZEDB      = 251
+	RDB_OPCODE_EXPIRETIME_MS = 252
+	RDB_OPCODE_EXPIRETIME    = 253
+	RDB_OPCODE_SELECTDB      = 254
+	RDB_OPCODE_EOF           = 255
+)
+
+// 长度编码 最高两位表示长度的类型
+const (
+	RDB_6BITLEN  = 0
+	RDB_14BITLEN = 1
+	RDB_32BITLEN = 0x80
+	RDB_64BITLEN = 0x81
+	RDB_ENCVAL   = 3 // 之后的 6 位表示特殊编码的类型
+
+	RDB_ENC_INT8  = 0
+	RDB_ENC_INT16 = 1
+	RDB_ENC_INT32 = 2
+	RDB_ENC_LZF   = 3
+)
+
+// 写入时同时计算 CRC64
+type rdbWriter struct {
+	w   io.Writer
+	crc uint64
+	err error
+}
+
+func (rdb *rdbWriter) write(p []byte) {
+	if rdb.err != nil {
+		return
+	}
+	rdb.crc = crc64(rdb.crc, p)
+	_, rdb.err = rdb.w.Write(p)
+}
+
+func (rdb *rdbWriter) saveType(t byte) {
+	rdb.write([]byte{t})
+}
+
+func (rdb *rdbWriter) saveLen(l uint64) {
+	switch {
+	case l < 1<<6:
+		rdb.write([]byte{byte(l) | RDB_6BITLEN<<6})
+	case l < 1<<14:
+		rdb.write([]byte{byte(l>>8) | RDB_14BITLEN<<6, byte(l)})
+	case l <= math.MaxUint32:
+		buf := []byte{RDB_32BITLEN, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(buf[1:], uint32(l))
+		rdb.write(buf)
+	default:
+		buf := []byte{RDB_64BITLEN, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint64(buf[1:], l)
+		rdb.write(buf)
+	}
+}
+
+// 可以表示成 32 位整数的字符串以整数编码保存
+func (rdb *rdbWriter) saveString(s string) {
+	if len(s) <= 11 {
+		if v, err := strconv.ParseInt(s, 10, 32); err == nil && strconv.FormatInt(v, 10) == s {
+			rdb.saveIntEncoded(v)
+			return
+		}
+	}
+	rdb.saveLen(uint64(len(s)))
+	rdb.write([]byte(s))
+}
+
+func (rdb *rdbWriter) saveIntEncoded(v int64) {
+	switch {
+	case v >= math.MinInt8 && v <= math.MaxInt8:
+		rdb.write([]byte{RDB_ENCVAL<<6 | RDB_ENC_INT8, byte(v)})
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		buf := []byte{RDB_ENCVAL<<6 | RDB_ENC_INT16, 0, 0}
+		binary.LittleEndian.PutUint16(buf[1:], uint16(v))
+		rdb.write(buf)
+	default:
+		buf := []byte{RDB_ENCVAL<<6 | RDB_ENC_INT32, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(buf[1:], uint32(v))
+		rdb.write(buf)
+	}
+}
+
+func (rdb *rdbWriter) saveMillisecondTime(ms int64) {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(ms))
+	rdb.write(buf)
+}
+
+func (rdb *rdbWriter) saveBinaryDouble(d float64) {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, math.Float64bits(d))
+	rdb.write(buf)
+}
+
+func (rdb *rdbWriter) saveAuxField(key, val string) {
+	rdb.saveType(RDB_OPCODE_AUX)
+	rdb.saveString(key)
+	rdb.saveString(val)
+}
+
+func rdbObjectType(o *Gobj) byte {
+	switch o.Type_ {
+	case GLIST:
+		return RDB_TYPE_LIST
+	case GSET:
+		return RDB_TYPE_SET
+	case GZSET:
+		return RDB_TYPE_ZSET_2
+	case GDICT:
+		return RDB_TYPE_HASH
+	}
+	return RDB_TYPE_STRING
+}
+
+func (rdb *rdbWriter) saveObject(o *Gobj) {
+	switch o.Type_ {
+	case GSTR:
+		rdb.saveString(o.StrVal())
+	case GLIST:
+		list := o.Val_.(*List)
+		rdb.saveLen(uint64(list.Length()))
+		for n := list.First(); n != nil; n = n.Next() {
+			rdb.saveString(n.Val.StrVal())
+		}
+	case GSET:
+		d := o.Val_.(*Dict)
+		rdb.saveLen(uint64(d.Len()))
+		it := d.GetIterator()
+		for e := it.Next(); e != nil; e = it.Next() {
+			rdb.saveString(e.Key.StrVal())
+		}
+		it.Release()
+	case GZSET:
+		// 从尾部开始写入 加载时每次都插入到跳表头部
+		zsl := o.Val_.(*zset).zsl
+		rdb.saveLen(uint64(zsl.length))
+		for x := zsl.tail; x != nil; x = x.backward {
+			rdb.saveString(x.member.StrVal())
+			rdb.saveBinaryDouble(x.score)
+		}
+	case GDICT:
+		d := o.Val_.(*Dict)
+		rdb.saveLen(uint64(d.Len()))
+		it := d.GetIterator()
+		for e := it.Next(); e != nil; e = it.Next() {
+			rdb.saveString(e.Key.StrVal())
+			rdb.saveString(e.Val.StrVal())
+		}
+		it.Release()
+	}
+}
+
+func (rdb *rdbWriter) saveKeyValuePair(key, val *Gobj, expire int64) {
+	if expire != -1 {
+		rdb.saveType(RDB_OPCODE_EXPIRETIME_MS)
+		rdb.saveMillisecondTime(expire)
+	}
+	rdb.saveType(rdbObjectType(val))
+	rdb.saveString(key.StrVal())
+	rdb.saveObject(val)
+}
+
+func (rdb *rdbWriter) saveHeader(rsi *rdbSaveInfo) {
+	rdb.write([]byte(fmt.Sprintf("REDIS%04d", RDB_VERSION)))
+	rdb.saveAuxField("redis-ver", GODIS_VERSION)
+	rdb.saveAuxField("redis-bits", "64")
+	rdb.saveAuxField("ctime", strconv.FormatInt(GetMsTime()/1000, 10))
+	if rsi != nil {
+		rdb.saveAuxField("repl-stream-db", strconv.Itoa(rsi.replStreamDb))
+	}
+}
+
+func (rdb *rdbWriter) saveEOF() {
+	rdb.saveType(RDB_OPCODE_EOF)
+	// 校验和本身不参与计算
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, rdb.crc)
+	if rdb.err == nil {
+		_, rdb.err = rdb.w.Write(buf)
+	}
+}
+
+// 把所有数据库写入 w 调用期间数据不能被修改
+func rdbSaveRio(w io.Writer) error {
+	rdb := &rdbWriter{w: w}
+	rdb.saveHeader(nil)
+	for _, db := range server.dbs {
+		if db.data.Len() == 0 {
+			continue
+		}
+		rdb.saveType(RDB_OPCODE_SELECTDB)
+		rdb.saveLen(uint64(db.id))
+		rdb.saveType(RDB_OPCODE_RESIZEDB)
+		rdb.saveLen(uint64(db.data.Len()))
+		rdb.saveLen(uint64(db.expire.Len()))
+		it := db.data.GetIterator()
+		for e := it.Next(); e != nil; e = it.Next() {
+			rdb.saveKeyValuePair(e.Key, e.Val, db.getExpire(e.Key))
+		}
+		it.Release()
+		if rdb.err != nil {
+			return rdb.err
+		}
+	}
+	rdb.saveEOF()
+	return rdb.err
+}
+
+// 先写入临时文件 fsync 之后再 rename 保证文件总是完整的
+func rdbWriteFile(filename string, write func(w io.Writer) error) error {
+	tmpfile := filepath.Join(filepath.Dir(filename), fmt.Sprintf("temp-%d-%d.rdb", os.Getpid(), GetUsTime()))
+	f, err := os.Create(tmpfile)
+	if err != nil {
+		return fmt.Errorf("failed opening the temp RDB file %s for saving: %v", tmpfile, err)
+	}
+	bw := bufio.NewWriterSize(f, 64*1024)
+	err = write(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpfile, filename)
+	}
+	if err != nil {
+		os.Remove(tmpfile)
+	}
+	return err
+}
+
+// SAVE 在主线程中完成写入
+func rdbSave(filename string) error {
+	err := rdbWriteFile(filename, rdbSaveRio)
+	if err != nil {
+		serverLog(LL_WARNING, "Write error saving DB on disk: %v", err)
+		server.lastbgsaveStatus = false
+		return err
+	}
+	serverLog(LL_NOTICE, "DB saved on disk")
+	server.dirty = 0
+	server.lastsave = GetMsTime() / 1000
+	server.lastbgsaveStatus = true
+	return nil
+}
+
+/*
+BGSAVE
+由 ServerCron 分批把开始时刻的数据编码成快照（见 snapshot.go） 写文件和 fsync 交给后台 goroutine
+完成之后在 ServerCron 中通过 checkChildrenDone 处理结果
+同一个数据库的 key 可能因为写屏障被分成几段 每段之前都写入 SELECTDB
+*/
+func rdbSaveBackground(filename string, rsi *rdbSaveInfo) error {
+	if server.rdbChildRunning {
+		return errors.New("background save already in progress")
+	}
+	server.dirtyBeforeBgsave = server.dirty
+	server.lastbgsaveTry = GetMsTime() / 1000
+	s := createSnapshot()
+	rdb := &rdbWriter{w: &s.buf}
+	rdb.saveHeader(rsi)
+	curdb := -1
+	s.saveKey = func(dbid int, key, val *Gobj, expire int64) {
+		if dbid != curdb {
+			rdb.saveType(RDB_OPCODE_SELECTDB)
+			rdb.saveLen(uint64(dbid))
+			curdb = dbid
+		}
+		rdb.saveKeyValuePair(key, val, expire)
+	}
+	s.saveEnd = rdb.saveEOF
+	server.rdbSnapshot = s
+	server.rdbChildRunning = true
+	server.rdbSaveTimeStart = GetMsTime()
+	done := make(chan error, 1)
+	server.rdbChildDone = done
+	go func() {
+		done <- rdbWriteFile(filename, s.writeTo)
+	}()
+	serverLog(LL_NOTICE, "Background saving started")
+	return nil
+}
+
+func backgroundSaveDoneHandler(err error) {
+	server.rdbChildRunning = false
+	server.rdbChildDone = nil
+	server.rdbSnapshot = nil
+	if err != nil {
+		serverLog(LL_WARNING, "Background saving error: %v", err)
+		server.lastbgsaveStatus = false
+	} else {
+		serverLog(LL_NOTICE, "Background saving terminated with success")
+		// 保存期间产生的修改仍然算作脏数据
+		server.dirty -= server.dirtyBeforeBgsave
+		server.lastsave = GetMsTime() / 1000
+		server.lastbgsaveStatus = true
+	}
+	updateSlavesWaitingBgsave(err)
+}
+
+// 等待正在进行的后台保存结束 SAVE 和测试中使用
+func waitForBgsave() {
+	if server.rdbChildRunning {
+		server.rdbSnapshot.run(0, true)
+		backgroundSaveDoneHandler(<-server.rdbChildDone)
+	}
+}
+
+// 上次 BGSAVE 失败时 至少间隔这么多秒才重试
+const CONFIG_BGSAVE_RETRY_DELAY = 5
+
+// 满足任意一个 save 条件时执行 BGSAVE
+func rdbCronSave() {
+	if server.rdbChildRunning {
+		return
+	}
+	now := GetMsTime() / 1000
+	if server.rdbBgsaveScheduled &&
+		(now-server.lastbgsaveTry > CONFIG_BGSAVE_RETRY_DELAY || server.lastbgsaveStatus) {
+		if rdbSaveBackground(server.rdbFilename, nil) == nil {
+			server.rdbBgsaveScheduled = false
+		}
+		return
+	}
+	for _, sp := range server.saveparams {
+		if server.dirty >= sp.Changes && now-server.lastsave > sp.Seconds &&
+			(now-server.lastbgsaveTry > CONFIG_BGSAVE_RETRY_DELAY || server.lastbgsaveStatus) {
+			serverLog(LL_NOTICE, "%d changes in %d seconds. Saving...", sp.Changes, sp.Seconds)
+			rdbSaveBackground(server.rdbFilename, nil)
+			break
+		}
+	}
+}
+
+func saveCommand(c *GodisClient) {
+	if server.rdbChildRunning {
+		c.AddReplyError("Background save already in progress")
+		return
+	}
+	if rdbSave(server.rdbFilename) != nil {
+		c.AddReply(shared.err)
+		return
+	}
+	c.AddReply(shared.ok)
+}
+
+// BGSAVE [SCHEDULE]
+// 正在保存时 SCHEDULE 在当前的保存结束之后再执行一次
+func bgsaveCommand(c *GodisClient) {
+	schedule := false
+	if len(c.args) > 1 {
+		if len(c.args) != 2 || !strings.EqualFold(c.args[1].StrVal(), "schedule") {
+			c.AddReply(shared.syntaxerr)
+			return
+		}
+		schedule = true
+	}
+	if server.rdbChildRunning {
+		if schedule {
+			server.rdbBgsaveScheduled = true
+			c.AddReplyStatus("Background saving scheduled")
+			return
+		}
+		c.AddReplyError("Background save already in progress")
+		return
+	}
+	if rdbSaveBackground(server.rdbFilename, nil) != nil {
+		c.AddReply(shared.err)
+		return
+	}
+	c.AddReplyStatus("Background saving started")
+}
+
+func lastsaveCommand(c *GodisClient) {
+	c.AddReplyInt(server.lastsave)
+}
+
+// 读取时同时计算 CRC64
+type rdbReader struct {
+	r    *bufio.Reader
+	crc  uint64
+	left int64 // 剩下的字节数 长度字段超过它时数据一定是错的
+}
+
+func (rdb *rdbReader) read(n int) ([]byte, error) {
+	if int64(n) > rdb.left {
+		return nil, io.ErrUnexpectedEOF
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(rdb.r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	rdb.left -= int64(n)
+	rdb.crc = crc64(rdb.crc, buf)
+	return buf, nil
+}
+
+// 长度来自文件或者客户端的 RESTORE 分配内存之前先确认剩下的数据足够
+func (rdb *rdbReader) checkLen(length uint64) error {
+	if length > uint64(rdb.left) {
+		return fmt.Errorf("length %d exceeds the remaining %d bytes", length, rdb.left)
+	}
+	return nil
+}
+
+func (rdb *rdbReader) loadType() (byte, error) {
+	buf, err := rdb.read(1)
+	if err != nil {
+		return 0, err
+	}
+	return buf[0], nil
+}
+
+// 返回长度 或者 isEncoded 为 true 时返回特殊编码的类型
+func (rdb *rdbReader) loadLenByRef() (length uint64, isEncoded bool, err error) {
+	buf, err := rdb.read(1)
+	if err != nil {
+		return 0, false, err
+	}
+	typ := (buf[0] & 0xC0) >> 6
+	switch {
+	case typ == RDB_ENCVAL:
+		return uint64(buf[0] & 0x3F), true, nil
+	case typ == RDB_6BITLEN:
+		return uint64(buf[0] & 0x3F), false, nil
+	case typ == RDB_14BITLEN:
+		next, err := rdb.read(1)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(buf[0]&0x3F)<<8 | uint64(next[0]), false, nil
+	case buf[0] == RDB_32BITLEN:
+		next, err := rdb.read(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(next)), false, nil
+	case buf[0] == RDB_64BITLEN:
+		next, err := rdb.read(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(next), false, nil
+	}
+	return 0, false, fmt.Errorf("unknown length encoding %d", buf[0])
+}
+
+func (rdb *rdbReader) loadLen() (uint64, error) {
+	length, isEncoded, err := rdb.loadLenByRef()
+	if err == nil && isEncoded {
+		err = errors.New("unexpected encoded length")
+	}
+	return length, err
+}
+
+func (rdb *rdbReader) loadString() (string, error) {
+	length, isEncoded, err := rdb.loadLenByRef()
+	if err != nil {
+		return "", err
+	}
+	if isEncoded {
+		switch length {
+		case RDB_ENC_INT8:
+			buf, err := rdb.read(1)
+			if err != nil {
+				return "", err
+			}
+			return strconv.FormatInt(int64(int8(buf[0])), 10), nil
+		case RDB_ENC_INT16:
+			buf, err := rdb.read(2)
+			if err != nil {
+				return "", err
+			}
+			return strconv.FormatInt(int64(int16(binary.LittleEndian.Uint16(buf))), 10), nil
+		case RDB_ENC_INT32:
+			buf, err := rdb.read(4)
+			if err != nil {
+				return "", err
+			}
+			return strconv.FormatInt(int64(int32(binary.LittleEndian.Uint32(buf))), 10), nil
+		case RDB_ENC_LZF:
+			return rdb.loadLzfString()
+		}
+		return "", fmt.Errorf("unknown string encoding %d", length)
+	}
+	if err := rdb.checkLen(length); err != nil {
+		return "", err
+	}
+	buf, err := rdb.read(int(length))
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func (rdb *rdbReader) loadLzfString() (string, error) {
+	clen, err := rdb.loadLen()
+	if err != nil {
+		return "", err
+	}
+	length, err := rdb.loadLen()
+	if err != nil {
+		return "", err
+	}
+	if err := rdb.checkLen(clen); err != nil {
+		return "", err
+	}
+	compressed, err := rdb.read(int(clen))
+	if err != nil {
+		return "", err
+	}
+	if length > uint64(len(compressed))*LZF_MAX_RATIO {
+		return "", errors.New("invalid LZF data")
+	}
+	out, err := lzfDecompress(compressed, int(length))
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+func (rdb *rdbReader) loadStringObject() (*Gobj, error) {
+	s, err := rdb.loadString()
+	if err != nil {
+		return nil, err
+	}
+	return CreateObject(GSTR, s), nil
+}
+
+func (rdb *rdbReader) loadMillisecondTime() (int64, error) {
+	buf, err := rdb.read(8)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(buf)), nil
+}
+
+func (rdb *rdbReader) loadBinaryDouble() (float64, error) {
+	buf, err := rdb.read(8)
+	if err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(buf)), nil
+}
+
+// 旧版本 ZSET 的分数以字符串保存 253 254 255 分别表示 nan +inf -inf
+func (rdb *rdbReader) loadDoubleValue() (float64, error) {
+	buf, err := rdb.read(1)
+	if err != nil {
+		return 0, err
+	}
+	switch buf[0] {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	str, err := rdb.read(int(buf[0]))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(str), 64)
+}
+
+// 容器中的元素引用计数由容器持有
+func (rdb *rdbReader) loadObject(rdbtype byte) (*Gobj, error) {
+	if rdbtype == RDB_TYPE_STRING {
+		return rdb.loadStringObject()
+	}
+	var o *Gobj
+	switch rdbtype {
+	case RDB_TYPE_LIST:
+		o = CreateListObject()
+	case RDB_TYPE_SET:
+		o = CreateSetObject()
+	case RDB_TYPE_ZSET, RDB_TYPE_ZSET_2:
+		o = CreateZsetObject()
+	case RDB_TYPE_HASH:
+		o = CreateHashObject()
+	default:
+		return nil, fmt.Errorf("unsupported RDB object type %d", rdbtype)
+	}
+	length, err := rdb.loadLen()
+	if err != nil {
+		return nil, err
+	}
+	// 每个元素至少占一个字节
+	if err := rdb.checkLen(length); err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < length; i++ {
+		ele, err := rdb.loadStringObject()
+		if err != nil {
+			return nil, err
+		}
+		switch rdbtype {
+		case RDB_TYPE_LIST:
+			listTypePush(o, ele, LIST_TAIL)
+		case RDB_TYPE_SET:
+			setTypeAdd(o, ele)
+		case RDB_TYPE_ZSET, RDB_TYPE_ZSET_2:
+			var score float64
+			if rdbtype == RDB_TYPE_ZSET_2 {
+				score, err = rdb.loadBinaryDouble()
+			} else {
+				score, err = rdb.loadDoubleValue()
+			}
+			if err != nil {
+				return nil, err
+			}
+			zsetAdd(o, score, ele, 0)
+		case RDB_TYPE_HASH:
+			val, err := rdb.loadStringObject()
+			if err != nil {
+				return nil, err
+			}
+			hashTypeSet(o, ele, val)
+			val.DecrRefCount()
+		}
+		ele.DecrRefCount()
+	}
+	return o, nil
+}
+
+// 启动时加载 已经过期的 key 直接丢弃
+func rdbLoad(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	rdb := &rdbReader{r: bufio.NewReaderSize(f, 64*1024), left: fi.Size()}
+	if err := rdbLoadRio(rdb); err != nil {
+		return fmt.Errorf("short read or OOM loading DB. Unrecoverable error, aborting now: %v", err)
+	}
+	return nil
+}
+
+func rdbLoadRio(rdb *rdbReader) error {
+	return rdbLoadRioWithInfo(rdb, nil)
+}
+
+func rdbLoadRioWithInfo(rdb *rdbReader, rsi *rdbSaveInfo) error {
+	header, err := rdb.read(9)
+	if err != nil {
+		return err
+	}
+	if string(header[:5]) != "REDIS" {
+		return errors.New("wrong signature trying to load DB from file")
+	}
+	version, err := strconv.Atoi(string(header[5:]))
+	if err != nil || version < 1 || version > RDB_VERSION {
+		return fmt.Errorf("can't handle RDB format version %s", header[5:])
+	}
+	db := server.dbs[0]
+	expire := int64(-1)
+	now := GetMsTime()
+	for {
+		typ, err := rdb.loadType()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case RDB_OPCODE_EXPIRETIME:
+			buf, err := rdb.read(4)
+			if err != nil {
+				return err
+			}
+			expire = int64(binary.LittleEndian.Uint32(buf)) * 1000
+			continue
+		case RDB_OPCODE_EXPIRETIME_MS:
+			if expire, err = rdb.loadMillisecondTime(); err != nil {
+				return err
+			}
+			continue
+		case RDB_OPCODE_FREQ:
+			if _, err := rdb.read(1); err != nil {
+				return err
+			}
+			continue
+		case RDB_OPCODE_IDLE:
+			if _, err := rdb.loadLen(); err != nil {
+				return err
+			}
+			continue
+		case RDB_OPCODE_EOF:
+			// 校验和为 0 表示没有开启校验
+			expected := rdb.crc
+			buf := make([]byte, 8)
+			if version >= 5 {
+				if _, err := io.ReadFull(rdb.r, buf); err != nil {
+					return err
+				}
+				if sum := binary.LittleEndian.Uint64(buf); sum != 0 && sum != expected {
+					return errors.New("wrong RDB checksum")
+				}
+			}
+			return nil
+		case RDB_OPCODE_SELECTDB:
+			id, err := rdb.loadLen()
+			if err != nil {
+				return err
+			}
+			if id >= uint64(len(server.dbs)) {
+				return fmt.Errorf("FATAL: Data file was created with a Redis server configured to handle more than %d databases", len(server.dbs))
+			}
+			db = server.dbs[id]
+			continue
+		case RDB_OPCODE_RESIZEDB:
+			if _, err := rdb.loadLen(); err != nil {
+				return err
+			}
+			if _, err := rdb.loadLen(); err != nil {
+				return err
+			}
+			continue
+		case RDB_OPCODE_AUX:
+			auxkey, err := rdb.loadString()
+			if err != nil {
+				return err
+			}
+			auxval, err := rdb.loadString()
+			if err != nil {
+				return err
+			}
+			if auxkey == "repl-stream-db" && rsi != nil {
+				if id, err := strconv.Atoi(auxval); err == nil && id >= 0 && id < len(server.dbs) {
+					rsi.replStreamDb = id
+				}
+			}
+			continue
+		case RDB_OPCODE_MODULE_AUX, RDB_OPCODE_FUNCTION, RDB_OPCODE_FUNCTION2:
+			return fmt.Errorf("unsupported RDB opcode %d", typ)
+		}
+
+		key, err := rdb.loadStringObject()
+		if err != nil {
+			return err
+		}
+		val, err := rdb.loadObject(typ)
+		if err != nil {
+			return err
+		}
+		if expire != -1 && expire < now {
+			// 过期的 key 不加载
+		} else if db.lookupKey(key) != nil {
+			return fmt.Errorf("duplicate key '%s' found in RDB file", key.StrVal())
+		} else {
+			db.dbAdd(key, val)
+			if expire != -1 {
+				db.setExpire(key, expire)
+			}
+		}
+		key.DecrRefCount()
+		val.DecrRefCount()
+		expire = -1
+	}
+}
+
+// 一个 3 字节的回溯引用最多展开成 264 字节
+const LZF_MAX_RATIO = 88
+
+// LZF 解压 用于读取 Redis 开启 rdbcompression 时写入的字符串
+func lzfDecompress(in []byte, outLen int) ([]byte, error) {
+	out := make([]byte, 0, outLen)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 1<<5 {
+			// 字面量
+			ctrl++
+			if i+ctrl > len(in) {
+				return nil, errors.New("invalid LZF data")
+			}
+			out = append(out, in[i:i+ctrl]...)
+			i += ctrl
+			continue
+		}
+		// 回溯引用
+		length := ctrl >> 5
+		if length == 7 {
+			if i >= len(in) {
+				return nil, errors.New("invalid LZF data")
+			}
+			length += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errors.New("invalid LZF data")
+		}
+		ref := len(out) - ((ctrl & 0x1f) << 8) - 1 - int(in[i])
+		i++
+		if ref < 0 {
+			return nil, errors.New("invalid LZF data")
+		}
+		for j := 0; j < length+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != outLen {
+		return nil, errors.New("invalid LZF data")
+	}
+	return out, nil
+}
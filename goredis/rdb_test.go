@@ -0,0 +1,200 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCrc64(t *testing.T) {
+	if got := crc64(0, []byte("123456789")); got != 0xe9c6d914c4b8d9ca {
+		t.Errorf("crc64 = %x", got)
+	}
+}
+
+func TestRdbSaveAndLoad(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	c.run("set", "str", "hello")
+	c.run("set", "int", "12345")
+	c.run("set", "neg", "-70000")
+	c.run("set", "big", strings.Repeat("x", 20000))
+	c.run("rpush", "list", "a", "b", "1")
+	c.run("sadd", "set", "x", "y", "z")
+	c.run("zadd", "zset", "1.5", "a", "-2", "b", "inf", "c")
+	c.run("hset", "hash", "f1", "v1", "f2", "2")
+	c.run("expire", "str", "1000")
+	c.run("select", "3")
+	c.run("set", "k3", "v3")
+	c.run("select", "0")
+	expectReply(t, c, "+OK\r\n", "save")
+	if server.dirty != 0 {
+		t.Errorf("dirty = %d after save", server.dirty)
+	}
+
+	// 重新创建数据库后加载
+	for i := range server.dbs {
+		server.dbs[i] = createDB(i)
+	}
+	c.db = server.dbs[0]
+	if err := rdbLoad(server.rdbFilename); err != nil {
+		t.Fatal(err)
+	}
+	expectReply(t, c, ":8\r\n", "dbsize")
+	expectReply(t, c, "$5\r\nhello\r\n", "get", "str")
+	expectReply(t, c, "$5\r\n12345\r\n", "get", "int")
+	expectReply(t, c, "$6\r\n-70000\r\n", "get", "neg")
+	expectReply(t, c, ":20000\r\n", "strlen", "big")
+	expectReply(t, c, "*3\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\n1\r\n", "lrange", "list", "0", "-1")
+	expectReply(t, c, ":3\r\n", "scard", "set")
+	expectReply(t, c, "*6\r\n$1\r\nb\r\n$2\r\n-2\r\n$1\r\na\r\n$3\r\n1.5\r\n$1\r\nc\r\n$3\r\ninf\r\n", "zrange", "zset", "0", "-1", "withscores")
+	expectReply(t, c, "$1\r\n2\r\n", "hget", "hash", "f2")
+	if ttl := c.db.getExpire(CreateObject(GSTR, "str")); ttl == -1 {
+		t.Errorf("expire of str is lost")
+	}
+	expectReply(t, c, ":-1\r\n", "ttl", "int")
+	c.run("select", "3")
+	expectReply(t, c, "$2\r\nv3\r\n", "get", "k3")
+}
+
+func TestRdbLoadSkipsExpiredAndChecksCrc(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	c.run("set", "k", "v")
+	c.run("set", "gone", "v")
+	// 已经过期但还没有被删除的 key 仍然会写入文件
+	c.db.setExpire(CreateObject(GSTR, "gone"), GetMsTime()-1000)
+	expectReply(t, c, "+OK\r\n", "save")
+
+	data, err := os.ReadFile(server.rdbFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data[:9]) != "REDIS0009" {
+		t.Fatalf("bad header %q", data[:9])
+	}
+
+	// 篡改数据之后校验失败
+	corrupt := append([]byte(nil), data...)
+	corrupt[len(corrupt)-12] ^= 0xff
+	if err := os.WriteFile(server.rdbFilename, corrupt, 0644); err != nil {
+		t.Fatal(err)
+	}
+	server.dbs[0] = createDB(0)
+	if err := rdbLoad(server.rdbFilename); err == nil {
+		t.Errorf("corrupted rdb loaded without error")
+	}
+
+	// 校验和为 0 时不校验
+	for i := len(data) - 8; i < len(data); i++ {
+		data[i] = 0
+	}
+	if err := os.WriteFile(server.rdbFilename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	server.dbs[0] = createDB(0)
+	if err := rdbLoad(server.rdbFilename); err != nil {
+		t.Fatal(err)
+	}
+	if server.dbs[0].data.Len() != 1 || server.dbs[0].expire.Len() != 0 {
+		t.Errorf("dbsize = %d", server.dbs[0].data.Len())
+	}
+}
+
+func TestBgsave(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	c.run("set", "k", "v")
+	expectReply(t, c, "+Background saving started\r\n", "bgsave")
+	expectReply(t, c, "-ERR Background save already in progress\r\n", "bgsave")
+	expectReply(t, c, "-ERR Background save already in progress\r\n", "save")
+	expectReply(t, c, "-ERR syntax error\r\n", "bgsave", "foo")
+	expectReply(t, c, "+Background saving scheduled\r\n", "bgsave", "schedule")
+	// 快照是 BGSAVE 时的数据 之后的修改不会写入
+	c.run("set", "k2", "v")
+	// 由 ServerCron 推进
+	for server.rdbChildRunning {
+		snapshotCron()
+		checkChildrenDone()
+	}
+	if server.dirty != 1 {
+		t.Errorf("dirty = %d after bgsave", server.dirty)
+	}
+	db := server.dbs[0]
+	server.dbs[0] = createDB(0)
+	if err := rdbLoad(server.rdbFilename); err != nil {
+		t.Fatal(err)
+	}
+	if server.dbs[0].data.Len() != 1 {
+		t.Errorf("dbsize = %d", server.dbs[0].data.Len())
+	}
+
+	// 之前的保存结束之后执行被推迟的 BGSAVE
+	server.dbs[0] = db
+	rdbCronSave()
+	if !server.rdbChildRunning || server.rdbBgsaveScheduled {
+		t.Errorf("scheduled bgsave not started")
+	}
+	waitForBgsave()
+	if server.dirty != 0 {
+		t.Errorf("dirty = %d after scheduled bgsave", server.dirty)
+	}
+}
+
+func TestBgsavePointInTime(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	for i := 0; i < 200; i++ {
+		c.run("set", "k"+strconv.Itoa(i), "v")
+	}
+	c.run("rpush", "l", "a")
+	c.run("set", "ttl", "v", "px", "100000")
+	c.run("select", "1")
+	c.run("set", "db1", "v")
+	c.run("select", "0")
+	c.run("bgsave")
+	if server.rdbSnapshot.buf.Len() > 100 {
+		t.Errorf("bgsave should not encode the dataset in the command")
+	}
+	// 遍历了一部分之后修改 还没有遍历到的 key 由写屏障写入原来的值
+	server.rdbSnapshot.scanStep()
+	c.run("rpush", "l", "b")
+	c.run("del", "k1")
+	c.run("set", "k2", "new")
+	c.run("persist", "ttl")
+	c.run("set", "added", "v")
+	c.run("swapdb", "0", "1")
+	c.run("set", "db1", "new")
+	c.run("flushall")
+	waitForBgsave()
+	if !server.lastbgsaveStatus {
+		t.Fatal("bgsave failed")
+	}
+
+	for i := range server.dbs {
+		server.dbs[i] = createDB(i)
+	}
+	if err := rdbLoad(server.rdbFilename); err != nil {
+		t.Fatal(err)
+	}
+	c.run("select", "0")
+	expectReply(t, c, ":202\r\n", "dbsize")
+	expectReply(t, c, "*1\r\n$1\r\na\r\n", "lrange", "l", "0", "-1")
+	expectReply(t, c, "$1\r\nv\r\n", "get", "k1")
+	expectReply(t, c, "$1\r\nv\r\n", "get", "k2")
+	expectReply(t, c, ":0\r\n", "exists", "added")
+	if ttl := c.run("pttl", "ttl"); ttl == ":-1\r\n" {
+		t.Errorf("expire lost in snapshot")
+	}
+	c.run("select", "1")
+	expectReply(t, c, "$1\r\nv\r\n", "get", "db1")
+}
+
+func TestLzfDecompress(t *testing.T) {
+	// "aaaaaaaaaa" 字面量 'a' 之后回溯 9 个字节
+	out, err := lzfDecompress([]byte{0x00, 'a', 0xe0, 0x00, 0x00}, 10)
+	if err != nil || string(out) != "aaaaaaaaaa" {
+		t.Errorf("lzf = %q, %v", out, err)
+	}
+}
@@ -0,0 +1,924 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+主从复制 与 Redis 的 PSYNC2 协议兼容
+副本握手：PING -> REPLCONF listening-port -> REPLCONF capa -> PSYNC <replid> <offset>
+主节点回复 +FULLRESYNC 之后发送 RDB 快照（$<len>\r\n<payload>）或者回复 +CONTINUE 从积压缓冲区补发
+之后的写命令通过副本客户端的回复缓冲区发送 复制偏移是复制流的字节数
+*/
+
+// 副本的连接状态
+const (
+	REPL_STATE_NONE                = iota // 不是副本
+	REPL_STATE_CONNECT                    // 需要连接主节点
+	REPL_STATE_CONNECTING                 // 正在连接
+	REPL_STATE_RECEIVE_PING_REPLY         // 等待 PING 的回复
+	REPL_STATE_RECEIVE_AUTH_REPLY         // 等待 AUTH 的回复
+	REPL_STATE_RECEIVE_PORT_REPLY         // 等待 REPLCONF listening-port 的回复
+	REPL_STATE_RECEIVE_CAPA_REPLY         // 等待 REPLCONF capa 的回复
+	REPL_STATE_RECEIVE_PSYNC_REPLY        // 等待 PSYNC 的回复
+	REPL_STATE_TRANSFER                   // 正在接收 RDB
+	REPL_STATE_CONNECTED                  // 已连接 正在接收命令流
+)
+
+const CONFIG_RUN_ID_SIZE = 40
+
+// 主节点上副本的同步状态
+const (
+	SLAVE_STATE_WAIT_BGSAVE_START = iota + 1 // 正在进行的 BGSAVE 不能共用 等待下一次
+	SLAVE_STATE_WAIT_BGSAVE_END              // 等待快照完成 期间的命令积累在回复缓冲区中
+	SLAVE_STATE_SEND_BULK                    // 正在发送快照文件
+	SLAVE_STATE_ONLINE                       // 正常接收命令流
+)
+
+// 全量同步的快照中附带的复制信息
+type rdbSaveInfo struct {
+	replStreamDb int // 复制流当前选择的数据库 副本加载之后从这个数据库开始执行命令
+}
+
+/* ----------------------------- 复制 ID 和积压缓冲区 ----------------------------- */
+
+func changeReplicationId() {
+	server.replid = getRandomHexChars(CONFIG_RUN_ID_SIZE)
+}
+
+func clearReplicationId2() {
+	server.replid2 = strings.Repeat("0", CONFIG_RUN_ID_SIZE)
+	server.secondReplidOffset = -1
+}
+
+/*
+副本提升为主节点时使用新的复制 ID 旧的 ID 保存为 replid2
+原来同一个主节点的其他副本仍然可以用旧的 ID 进行部分重同步
+*/
+func shiftReplicationId() {
+	server.replid2 = server.replid
+	server.secondReplidOffset = server.masterReplOffset + 1
+	changeReplicationId()
+	serverLog(LL_NOTICE, "Setting secondary replication ID to %s, valid up to offset: %d. New replication ID is %s",
+		server.replid2, server.secondReplidOffset, server.replid)
+}
+
+func createReplicationBacklog() {
+	server.replBacklog = make([]byte, server.replBacklogSize)
+	server.replBacklogHistlen = 0
+	server.replBacklogIdx = 0
+	// 还没有数据 下一个字节的偏移
+	server.replBacklogOff = server.masterReplOffset + 1
+}
+
+func freeReplicationBacklog() {
+	server.replBacklog = nil
+}
+
+// 写入环形缓冲区 同时推进全局复制偏移
+func feedReplicationBacklog(p []byte) {
+	server.masterReplOffset += int64(len(p))
+	if server.replBacklog == nil {
+		return
+	}
+	size := int64(len(server.replBacklog))
+	for len(p) > 0 {
+		n := copy(server.replBacklog[server.replBacklogIdx:], p)
+		server.replBacklogIdx += int64(n)
+		if server.replBacklogIdx == size {
+			server.replBacklogIdx = 0
+		}
+		server.replBacklogHistlen += int64(n)
+		p = p[n:]
+	}
+	if server.replBacklogHistlen > size {
+		server.replBacklogHistlen = size
+	}
+	server.replBacklogOff = server.masterReplOffset - server.replBacklogHistlen + 1
+}
+
+// 把积压缓冲区中从 offset 开始的数据发送给副本
+func addReplyReplicationBacklog(c *GodisClient, offset int64) int64 {
+	size := int64(len(server.replBacklog))
+	skip := offset - server.replBacklogOff
+	j := (server.replBacklogIdx + (size - server.replBacklogHistlen)) % size
+	j = (j + skip) % size
+	n := server.replBacklogHistlen - skip
+	buf := make([]byte, 0, n)
+	for left := n; left > 0; {
+		thislen := min(size-j, left)
+		buf = append(buf, server.replBacklog[j:j+thislen]...)
+		left -= thislen
+		j = 0
+	}
+	if len(buf) > 0 {
+		c.AddReplyStr(string(buf))
+	}
+	return n
+}
+
+/* ----------------------------- 主节点 ----------------------------- */
+
+/*
+把写命令发送给所有副本并写入积压缓冲区
+副本不调用这里 它把主节点的复制流原样转发给下级副本
+dbid 为 -1 时不需要 SELECT（比如 PING）
+*/
+func replicationFeedSlaves(dbid int, args ...string) {
+	if server.masterhost != "" {
+		return
+	}
+	if server.replBacklog == nil && len(server.slaves) == 0 {
+		return
+	}
+	var buf []byte
+	if dbid >= 0 && dbid != server.slaveseldb {
+		buf = catAppendOnlyGenericCommand(buf, "SELECT", strconv.Itoa(dbid))
+		server.slaveseldb = dbid
+	}
+	buf = catAppendOnlyGenericCommand(buf, args...)
+	feedReplicationBacklog(buf)
+	feedSlaves(buf)
+}
+
+// 副本收到的复制流写入自己的积压缓冲区 并原样转发给下级副本
+func replicationFeedStreamFromMasterStream(buf []byte) {
+	feedReplicationBacklog(buf)
+	feedSlaves(buf)
+}
+
+// 等待快照开始的副本不接收命令 这些命令已经包含在之后的快照中
+func feedSlaves(buf []byte) {
+	for _, slave := range server.slaves {
+		if slave.slaveReplState != SLAVE_STATE_WAIT_BGSAVE_START {
+			slave.AddReplyStr(string(buf))
+		}
+	}
+}
+
+// 副本的地址 ip 取自连接 端口是 REPLCONF listening-port 上报的端口
+func replicationGetSlaveName(c *GodisClient) string {
+	ip := "?"
+	if sa, err := unix.Getpeername(c.fd); err == nil {
+		if sa4, ok := sa.(*unix.SockaddrInet4); ok {
+			ip = net.IP(sa4.Addr[:]).String()
+		}
+	}
+	if c.slaveListeningPort != 0 {
+		return fmt.Sprintf("%s:%d", ip, c.slaveListeningPort)
+	}
+	return fmt.Sprintf("%s:<unknown-replica-port>", ip)
+}
+
+// 成功返回 true 否则需要全量同步
+func masterTryPartialResynchronization(c *GodisClient, replid string, offset int64) bool {
+	if !strings.EqualFold(replid, server.replid) &&
+		(!strings.EqualFold(replid, server.replid2) || offset > server.secondReplidOffset) {
+		if replid != "?" {
+			if !strings.EqualFold(replid, server.replid2) {
+				serverLog(LL_NOTICE, "Partial resynchronization not accepted: Replication ID mismatch "+
+					"(Replica asked for '%s', my replication IDs are '%s' and '%s')", replid, server.replid, server.replid2)
+			} else {
+				serverLog(LL_NOTICE, "Partial resynchronization not accepted: Requested offset for second ID was %d, "+
+					"but I can reply up to %d", offset, server.secondReplidOffset)
+			}
+		} else {
+			serverLog(LL_NOTICE, "Full resync requested by replica %s", replicationGetSlaveName(c))
+		}
+		return false
+	}
+	if server.replBacklog == nil || offset < server.replBacklogOff ||
+		offset > server.replBacklogOff+server.replBacklogHistlen {
+		serverLog(LL_NOTICE, "Unable to partial resync with replica %s for lack of backlog "+
+			"(Replica request was: %d).", replicationGetSlaveName(c), offset)
+		return false
+	}
+	c.AddReplyStr("+CONTINUE " + server.replid + "\r\n")
+	sent := addReplyReplicationBacklog(c, offset)
+	serverLog(LL_NOTICE, "Partial resynchronization request from %s accepted. Sending %d bytes of backlog "+
+		"starting from offset %d.", replicationGetSlaveName(c), sent, offset)
+	return true
+}
+
+func replicationAddSlave(c *GodisClient) {
+	c.flags |= CLIENT_SLAVE
+	c.replAckTime = GetMsTime() / 1000
+	unix.SetNonblock(c.fd, true)
+	server.slaves = append(server.slaves, c)
+}
+
+/*
+SYNC
+PSYNC <replid> <offset>
+全量同步和 BGSAVE 一样由 ServerCron 分批生成快照文件 完成之后再发送给副本
+快照开始之后的写命令积累在副本的回复缓冲区中 快照发送完之后再发送
+*/
+func syncCommand(c *GodisClient) {
+	if c.flags&CLIENT_SLAVE != 0 {
+		return
+	}
+	if server.masterhost != "" && server.replState != REPL_STATE_CONNECTED {
+		c.AddReplyError("-NOMASTERLINK Can't SYNC while not connected with my master")
+		return
+	}
+	if c.reply.Length() > 0 {
+		c.AddReplyError("SYNC and PSYNC are invalid with pending output")
+		return
+	}
+	serverLog(LL_NOTICE, "Replica %s asks for synchronization", replicationGetSlaveName(c))
+	if strings.EqualFold(c.args[0].StrVal(), "psync") {
+		offset, ok := getLongLongFromObjectOrReply(c, c.args[2], "")
+		if !ok {
+			return
+		}
+		if masterTryPartialResynchronization(c, c.args[1].StrVal(), offset) {
+			server.statSyncPartialOk++
+			c.slaveReplState = SLAVE_STATE_ONLINE
+			replicationAddSlave(c)
+			return
+		}
+		if c.args[1].StrVal() != "?" {
+			server.statSyncPartialErr++
+		}
+	} else {
+		c.flags |= CLIENT_PRE_PSYNC
+	}
+	server.statSyncFull++
+
+	// 第一个副本连接时创建积压缓冲区 使用新的复制 ID
+	if server.replBacklog == nil && len(server.slaves) == 0 && server.masterhost == "" {
+		changeReplicationId()
+		clearReplicationId2()
+		createReplicationBacklog()
+		serverLog(LL_NOTICE, "Replication backlog created, my new replication IDs are '%s' and '%s'",
+			server.replid, server.replid2)
+	}
+	c.slaveReplState = SLAVE_STATE_WAIT_BGSAVE_START
+	replicationAddSlave(c)
+	if !server.rdbChildRunning {
+		startBgsaveForReplication()
+		return
+	}
+	// 正在为其他副本保存时共用这次快照 复制那个副本积累的命令
+	for _, slave := range server.slaves {
+		if slave != c && slave.slaveReplState == SLAVE_STATE_WAIT_BGSAVE_END {
+			for n := slave.reply.First(); n != nil; n = n.next {
+				c.AddReply(n.Val)
+			}
+			replicationSetupSlaveForFullResync(c, slave.psyncInitialOffset)
+			serverLog(LL_NOTICE, "Waiting for end of BGSAVE for SYNC")
+			return
+		}
+	}
+	serverLog(LL_NOTICE, "Can't attach the replica to the current BGSAVE. Waiting for next BGSAVE for SYNC")
+}
+
+/*
+快照开始时告诉副本对应的复制偏移 +FULLRESYNC 直接写入连接
+回复缓冲区中是快照开始之后的命令 要等快照发送完才能发送
+写入失败时连接已经断开 由读事件释放客户端
+*/
+func replicationSetupSlaveForFullResync(c *GodisClient, offset int64) {
+	c.psyncInitialOffset = offset
+	c.slaveReplState = SLAVE_STATE_WAIT_BGSAVE_END
+	if c.flags&CLIENT_PRE_PSYNC != 0 {
+		return
+	}
+	if _, err := unix.Write(c.fd, []byte(fmt.Sprintf("+FULLRESYNC %s %d\r\n", server.replid, offset))); err != nil {
+		serverLog(LL_WARNING, "Error writing +FULLRESYNC to replica %s: %v", replicationGetSlaveName(c), err)
+	}
+}
+
+// 为等待快照开始的副本执行 BGSAVE
+func startBgsaveForReplication() {
+	rsi := &rdbSaveInfo{}
+	if server.master != nil {
+		rsi.replStreamDb = server.master.db.id
+	} else {
+		// 快照之后的第一条命令重新发送 SELECT
+		server.slaveseldb = -1
+	}
+	err := rdbSaveBackground(server.rdbFilename, rsi)
+	for _, slave := range append([]*GodisClient(nil), server.slaves...) {
+		if slave.slaveReplState != SLAVE_STATE_WAIT_BGSAVE_START {
+			continue
+		}
+		if err != nil {
+			serverLog(LL_WARNING, "BGSAVE for replication failed: %v", err)
+			freeClient(slave)
+			continue
+		}
+		replicationSetupSlaveForFullResync(slave, server.masterReplOffset)
+	}
+}
+
+// BGSAVE 结束之后 把快照文件发送给等待的副本 还有副本在等待下一次快照时重新开始
+func updateSlavesWaitingBgsave(bgsaveerr error) {
+	startBgsave := false
+	for _, slave := range append([]*GodisClient(nil), server.slaves...) {
+		switch slave.slaveReplState {
+		case SLAVE_STATE_WAIT_BGSAVE_START:
+			startBgsave = true
+		case SLAVE_STATE_WAIT_BGSAVE_END:
+			if bgsaveerr != nil {
+				serverLog(LL_WARNING, "SYNC failed. BGSAVE child returned an error")
+				freeClient(slave)
+				continue
+			}
+			f, err := os.Open(server.rdbFilename)
+			var fi os.FileInfo
+			if err == nil {
+				fi, err = f.Stat()
+			}
+			if err != nil {
+				serverLog(LL_WARNING, "SYNC failed. Can't open/stat DB after BGSAVE: %v", err)
+				if f != nil {
+					f.Close()
+				}
+				freeClient(slave)
+				continue
+			}
+			slave.replDbFile = f
+			slave.replDbOff = 0
+			slave.replDbSize = fi.Size()
+			slave.replPreamble = fmt.Sprintf("$%d\r\n", fi.Size())
+			slave.slaveReplState = SLAVE_STATE_SEND_BULK
+			server.aeLoop.AddFileEvent(slave.fd, AE_WRITABLE, sendBulkToSlave, slave)
+		}
+	}
+	if startBgsave {
+		startBgsaveForReplication()
+	}
+}
+
+// 每次可写时发送一块快照文件 发送完之后开始发送积累的命令
+func sendBulkToSlave(loop *AeLoop, fd int, extra interface{}) {
+	slave := extra.(*GodisClient)
+	if slave.replPreamble != "" {
+		n, err := unix.Write(fd, []byte(slave.replPreamble))
+		if err != nil {
+			if err != unix.EAGAIN {
+				serverLog(LL_VERBOSE, "Write error sending RDB preamble to replica: %v", err)
+				freeClient(slave)
+			}
+			return
+		}
+		slave.replPreamble = slave.replPreamble[n:]
+		if slave.replPreamble != "" {
+			return
+		}
+	}
+	if slave.replDbOff < slave.replDbSize {
+		buf := make([]byte, min(int64(GODIS_IO_BUF), slave.replDbSize-slave.replDbOff))
+		if _, err := slave.replDbFile.ReadAt(buf, slave.replDbOff); err != nil {
+			serverLog(LL_WARNING, "Read error sending DB to replica: %v", err)
+			freeClient(slave)
+			return
+		}
+		n, err := unix.Write(fd, buf)
+		if err != nil {
+			if err != unix.EAGAIN {
+				serverLog(LL_VERBOSE, "Write error sending DB to replica: %v", err)
+				freeClient(slave)
+			}
+			return
+		}
+		slave.replDbOff += int64(n)
+		if slave.replDbOff < slave.replDbSize {
+			return
+		}
+	}
+	slave.replDbFile.Close()
+	slave.replDbFile = nil
+	loop.RemoveFileEvent(fd, AE_WRITABLE)
+	slave.slaveReplState = SLAVE_STATE_ONLINE
+	slave.replAckTime = GetMsTime() / 1000
+	if slave.reply.Length() > 0 {
+		loop.AddFileEvent(fd, AE_WRITABLE, SendReplyToClient, slave)
+	}
+	serverLog(LL_NOTICE, "Synchronization with replica %s succeeded", replicationGetSlaveName(slave))
+}
+
+/*
+REPLCONF <option> <value> <option> <value> ...
+副本在握手时上报监听端口和支持的能力 之后每秒发送 ACK <offset>
+*/
+func replconfCommand(c *GodisClient) {
+	if len(c.args)%2 == 0 {
+		c.AddReply(shared.syntaxerr)
+		return
+	}
+	for i := 1; i < len(c.args); i += 2 {
+		opt := strings.ToLower(c.args[i].StrVal())
+		switch opt {
+		case "listening-port":
+			port, ok := getLongLongFromObjectOrReply(c, c.args[i+1], "")
+			if !ok {
+				return
+			}
+			c.slaveListeningPort = int(port)
+		case "capa":
+			// 快照总是以 $<len> 的格式发送 能力只作记录
+		case "ack":
+			// ACK 不回复
+			if c.flags&CLIENT_SLAVE == 0 {
+				return
+			}
+			if offset, err := c.args[i+1].ParseInt(); err == nil && offset > c.replAckOff {
+				c.replAckOff = offset
+			}
+			c.replAckTime = GetMsTime() / 1000
+			return
+		case "getack":
+			if server.masterhost != "" && server.master == c {
+				replicationSendAck()
+			}
+			return
+		default:
+			c.AddReplyErrorFormat("Unrecognized REPLCONF option: %s", c.args[i].StrVal())
+			return
+		}
+	}
+	c.AddReply(shared.ok)
+}
+
+/* ----------------------------- 副本 ----------------------------- */
+
+func sendCommandToMaster(fd int, args ...string) error {
+	_, err := unix.Write(fd, catAppendOnlyGenericCommand(nil, args...))
+	return err
+}
+
+// 非阻塞连接主节点 连接成功后由 syncWithMaster 继续握手
+func connectWithMaster() error {
+	addr, err := net.ResolveIPAddr("ip4", server.masterhost)
+	if err != nil {
+		return err
+	}
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM|unix.SOCK_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	sa := &unix.SockaddrInet4{Port: server.masterport}
+	copy(sa.Addr[:], addr.IP.To4())
+	if err := unix.Connect(fd, sa); err != nil && err != unix.EINPROGRESS {
+		unix.Close(fd)
+		return err
+	}
+	server.replTransferS = fd
+	server.replTransferBuf = nil
+	server.replTransferLastio = GetMsTime() / 1000
+	server.replState = REPL_STATE_CONNECTING
+	server.aeLoop.AddFileEvent(fd, AE_WRITABLE, syncWithMaster, nil)
+	serverLog(LL_NOTICE, "MASTER <-> REPLICA sync started")
+	return nil
+}
+
+// 握手或者传输过程中出错 下一次 replicationCron 重新连接
+func cancelReplicationHandshake() {
+	if server.replState < REPL_STATE_CONNECTING || server.replState > REPL_STATE_TRANSFER {
+		return
+	}
+	server.aeLoop.RemoveFileEvent(server.replTransferS, AE_READABLE)
+	server.aeLoop.RemoveFileEvent(server.replTransferS, AE_WRITABLE)
+	unix.Close(server.replTransferS)
+	server.replTransferS = -1
+	server.replTransferBuf = nil
+	server.replState = REPL_STATE_CONNECT
+}
+
+// 读取主节点发来的数据追加到 replTransferBuf
+func replReadFromMaster(fd int) error {
+	var buf [GODIS_IO_BUF]byte
+	n, err := unix.Read(fd, buf[:])
+	if err == unix.EAGAIN {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New("connection lost")
+	}
+	server.replTransferBuf = append(server.replTransferBuf, buf[:n]...)
+	server.replTransferLastio = GetMsTime() / 1000
+	return nil
+}
+
+// 取出一行 不包括行尾的 \r\n 没有完整的一行时返回 false
+func replNextLine() (string, bool) {
+	i := bytes.IndexByte(server.replTransferBuf, '\n')
+	if i < 0 {
+		return "", false
+	}
+	line := strings.TrimSuffix(string(server.replTransferBuf[:i]), "\r")
+	server.replTransferBuf = server.replTransferBuf[i+1:]
+	return line, true
+}
+
+func syncWithMaster(loop *AeLoop, fd int, extra interface{}) {
+	if server.replState == REPL_STATE_CONNECTING {
+		if errno, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ERROR); err != nil || errno != 0 {
+			serverLog(LL_WARNING, "Error condition on socket for SYNC: %v", unix.Errno(errno))
+			cancelReplicationHandshake()
+			return
+		}
+		loop.RemoveFileEvent(fd, AE_WRITABLE)
+		loop.AddFileEvent(fd, AE_READABLE, syncWithMaster, nil)
+		serverLog(LL_NOTICE, "Non blocking connect for SYNC fired the event.")
+		server.replState = REPL_STATE_RECEIVE_PING_REPLY
+		if err := sendCommandToMaster(fd, "PING"); err != nil {
+			serverLog(LL_WARNING, "Error writing to MASTER: %v", err)
+			cancelReplicationHandshake()
+		}
+		return
+	}
+	if err := replReadFromMaster(fd); err != nil {
+		serverLog(LL_WARNING, "Error reading from MASTER: %v", err)
+		cancelReplicationHandshake()
+		return
+	}
+	for {
+		var next []string
+		switch server.replState {
+		case REPL_STATE_RECEIVE_PING_REPLY:
+			line, ok := replNextLine()
+			if !ok {
+				return
+			}
+			// 主节点要求认证时也会回复错误 握手可以继续
+			if strings.HasPrefix(line, "-") && !strings.HasPrefix(line, "-NOAUTH") && !strings.HasPrefix(line, "-NOPERM") {
+				serverLog(LL_WARNING, "Error reply to PING from master: '%s'", line)
+				cancelReplicationHandshake()
+				return
+			}
+			serverLog(LL_NOTICE, "Master replied to PING, replication can continue...")
+			if server.masterauth != "" {
+				next = []string{"AUTH", server.masterauth}
+				if server.masteruser != "" {
+					next = []string{"AUTH", server.masteruser, server.masterauth}
+				}
+				server.replState = REPL_STATE_RECEIVE_AUTH_REPLY
+				break
+			}
+			next = []string{"REPLCONF", "listening-port", strconv.Itoa(server.port)}
+			server.replState = REPL_STATE_RECEIVE_PORT_REPLY
+		case REPL_STATE_RECEIVE_AUTH_REPLY:
+			line, ok := replNextLine()
+			if !ok {
+				return
+			}
+			if strings.HasPrefix(line, "-") {
+				serverLog(LL_WARNING, "Unable to AUTH to MASTER: %s", line)
+				cancelReplicationHandshake()
+				return
+			}
+			next = []string{"REPLCONF", "listening-port", strconv.Itoa(server.port)}
+			server.replState = REPL_STATE_RECEIVE_PORT_REPLY
+		case REPL_STATE_RECEIVE_PORT_REPLY:
+			line, ok := replNextLine()
+			if !ok {
+				return
+			}
+			if strings.HasPrefix(line, "-") {
+				serverLog(LL_NOTICE, "(Non critical) Master does not understand REPLCONF listening-port: %s", line)
+			}
+			next = []string{"REPLCONF", "capa", "psync2"}
+			server.replState = REPL_STATE_RECEIVE_CAPA_REPLY
+		case REPL_STATE_RECEIVE_CAPA_REPLY:
+			line, ok := replNextLine()
+			if !ok {
+				return
+			}
+			if strings.HasPrefix(line, "-") {
+				serverLog(LL_NOTICE, "(Non critical) Master does not understand REPLCONF capa: %s", line)
+			}
+			// 用自己的复制 ID 和偏移请求部分重同步
+			offset := server.masterReplOffset + 1
+			serverLog(LL_NOTICE, "Trying a partial resynchronization (request %s:%d).", server.replid, offset)
+			next = []string{"PSYNC", server.replid, strconv.FormatInt(offset, 10)}
+			server.replState = REPL_STATE_RECEIVE_PSYNC_REPLY
+		case REPL_STATE_RECEIVE_PSYNC_REPLY:
+			line, ok := replNextLine()
+			if !ok {
+				return
+			}
+			if line == "" {
+				continue
+			}
+			if strings.HasPrefix(line, "+FULLRESYNC") {
+				fields := strings.Fields(line)
+				if len(fields) != 3 || len(fields[1]) != CONFIG_RUN_ID_SIZE {
+					serverLog(LL_WARNING, "Master replied with wrong +FULLRESYNC syntax.")
+					cancelReplicationHandshake()
+					return
+				}
+				server.masterInitialReplid = fields[1]
+				server.masterInitialOffset, _ = strconv.ParseInt(fields[2], 10, 64)
+				serverLog(LL_NOTICE, "Full resync from master: %s:%d", server.masterInitialReplid, server.masterInitialOffset)
+				server.replTransferSize = -1
+				server.replState = REPL_STATE_TRANSFER
+				continue
+			}
+			if strings.HasPrefix(line, "+CONTINUE") {
+				serverLog(LL_NOTICE, "Successful partial resynchronization with master.")
+				if fields := strings.Fields(line); len(fields) == 2 && fields[1] != server.replid {
+					// 主节点换了复制 ID（比如原来的副本被提升） 旧的 ID 仍然可以给下级副本使用
+					server.replid2 = server.replid
+					server.secondReplidOffset = server.masterReplOffset + 1
+					server.replid = fields[1]
+					serverLog(LL_NOTICE, "Master replication ID changed to %s", server.replid)
+					disconnectSlaves()
+				}
+				if server.replBacklog == nil {
+					createReplicationBacklog()
+				}
+				replicationCreateMasterClient(fd, server.replStreamDb)
+				serverLog(LL_NOTICE, "MASTER <-> REPLICA sync: Master accepted a Partial Resynchronization.")
+				return
+			}
+			if strings.HasPrefix(line, "-NOMASTERLINK") || strings.HasPrefix(line, "-LOADING") {
+				serverLog(LL_NOTICE, "Master is currently unable to PSYNC but should be in the future: %s", line)
+			} else {
+				serverLog(LL_WARNING, "Unexpected reply to PSYNC from master: %s", line)
+			}
+			cancelReplicationHandshake()
+			return
+		case REPL_STATE_TRANSFER:
+			if server.replTransferSize == -1 {
+				line, ok := replNextLine()
+				if !ok {
+					return
+				}
+				if line == "" {
+					continue
+				}
+				if line[0] == '-' {
+					serverLog(LL_WARNING, "MASTER aborted replication with an error: %s", line[1:])
+					cancelReplicationHandshake()
+					return
+				}
+				size, err := strconv.ParseInt(line[1:], 10, 64)
+				if line[0] != '$' || err != nil || size < 0 {
+					serverLog(LL_WARNING, "Bad protocol from MASTER, the first byte is not '$' (we received '%s'), "+
+						"are you sure the host and port are right?", line)
+					cancelReplicationHandshake()
+					return
+				}
+				server.replTransferSize = size
+				serverLog(LL_NOTICE, "MASTER <-> REPLICA sync: receiving %d bytes from master", size)
+			}
+			if int64(len(server.replTransferBuf)) < server.replTransferSize {
+				return
+			}
+			readSyncBulkPayload(fd)
+			return
+		default:
+			return
+		}
+		if err := sendCommandToMaster(fd, next...); err != nil {
+			serverLog(LL_WARNING, "Error writing to MASTER: %v", err)
+			cancelReplicationHandshake()
+			return
+		}
+	}
+}
+
+// 快照接收完毕 清空数据后加载 剩下的数据是快照之后的命令流
+func readSyncBulkPayload(fd int) {
+	payload := server.replTransferBuf[:server.replTransferSize]
+	server.replTransferBuf = server.replTransferBuf[server.replTransferSize:]
+	// 下级副本需要重新同步 旧的积压缓冲区也不能再使用
+	disconnectSlaves()
+	freeReplicationBacklog()
+
+	serverLog(LL_NOTICE, "MASTER <-> REPLICA sync: Flushing old data")
+	emptyData(-1)
+	serverLog(LL_NOTICE, "MASTER <-> REPLICA sync: Loading DB in memory")
+	rsi := rdbSaveInfo{}
+	if err := rdbLoadRioWithInfo(&rdbReader{r: bufio.NewReader(bytes.NewReader(payload)), left: int64(len(payload))}, &rsi); err != nil {
+		serverLog(LL_WARNING, "Failed trying to load the MASTER synchronization DB from socket: %v", err)
+		cancelReplicationHandshake()
+		emptyData(-1)
+		return
+	}
+	server.replid = server.masterInitialReplid
+	server.masterReplOffset = server.masterInitialOffset
+	clearReplicationId2()
+	createReplicationBacklog()
+	replicationCreateMasterClient(fd, rsi.replStreamDb)
+	serverLog(LL_NOTICE, "MASTER <-> REPLICA sync: Finished with success")
+
+	// 数据整个换掉了 AOF 需要重写
+	if server.aofState == AOF_ON {
+		killAppendOnlyChild()
+		rewriteAppendOnlyFileBackground()
+	}
+}
+
+// 同步完成之后 主节点的连接作为一个特殊的客户端 命令不回复
+func replicationCreateMasterClient(fd int, dbid int) {
+	server.aeLoop.RemoveFileEvent(fd, AE_READABLE)
+	c := CreateClient(fd)
+	c.flags |= CLIENT_MASTER
+	// 主节点发来的命令不受 ACL 限制
+	c.user = nil
+	c.authenticated = true
+	c.db = server.dbs[dbid]
+	c.reploff = server.masterReplOffset
+	c.readReploff = server.masterReplOffset
+	server.clients[fd] = c
+	server.master = c
+	server.replState = REPL_STATE_CONNECTED
+	server.replTransferS = -1
+	server.aeLoop.AddFileEvent(fd, AE_READABLE, ReadQueryFromClient, c)
+
+	rest := server.replTransferBuf
+	server.replTransferBuf = nil
+	if len(rest) > 0 {
+		c.queryBuf = append(rest, make([]byte, GODIS_IO_BUF)...)
+		c.queryLen = len(rest)
+		c.readReploff += int64(len(rest))
+		c.pendingQuery = append([]byte(nil), rest...)
+		if err := ProcessQueryBuf(c); err != nil {
+			serverLog(LL_WARNING, "Error processing the master stream: %v", err)
+			freeClient(c)
+		}
+	}
+}
+
+/*
+主节点发来的一条命令执行完之后 推进复制偏移
+执行过的原始数据写入积压缓冲区并转发给下级副本
+*/
+func replicationCommandProcessed(c *GodisClient) {
+	applied := c.readReploff - int64(c.queryLen) - c.reploff
+	if applied <= 0 {
+		return
+	}
+	c.reploff += applied
+	replicationFeedStreamFromMasterStream(c.pendingQuery[:applied])
+	c.pendingQuery = c.pendingQuery[applied:]
+}
+
+// 主节点的连接断开 记住复制流选择的数据库 重连后部分重同步从这里继续
+func replicationHandleMasterDisconnection(c *GodisClient) {
+	server.master = nil
+	server.replStreamDb = c.db.id
+	server.replDownSince = GetMsTime() / 1000
+	if server.masterhost != "" {
+		server.replState = REPL_STATE_CONNECT
+		serverLog(LL_NOTICE, "Connection with master lost.")
+	}
+}
+
+func replicationSendAck() {
+	c := server.master
+	if c == nil {
+		return
+	}
+	c.flags |= CLIENT_MASTER_FORCE_REPLY
+	c.AddReplyArrayLen(3)
+	c.AddReplyBulkStr("REPLCONF")
+	c.AddReplyBulkStr("ACK")
+	c.AddReplyBulkStr(strconv.FormatInt(c.reploff, 10))
+	c.flags &^= CLIENT_MASTER_FORCE_REPLY
+}
+
+// 断开所有副本 让它们重新同步
+func disconnectSlaves() {
+	for _, slave := range append([]*GodisClient(nil), server.slaves...) {
+		freeClient(slave)
+	}
+}
+
+func replicationRemoveSlave(c *GodisClient) {
+	for i, slave := range server.slaves {
+		if slave == c {
+			server.slaves = append(server.slaves[:i], server.slaves[i+1:]...)
+			break
+		}
+	}
+	if c.replDbFile != nil {
+		c.replDbFile.Close()
+		c.replDbFile = nil
+	}
+	serverLog(LL_NOTICE, "Connection with replica %s lost.", replicationGetSlaveName(c))
+}
+
+func replicationSetMaster(host string, port int) {
+	server.masterhost = host
+	server.masterport = port
+	if server.master != nil {
+		freeClient(server.master)
+	}
+	disconnectSlaves()
+	cancelReplicationHandshake()
+	server.replState = REPL_STATE_CONNECT
+	if err := connectWithMaster(); err != nil {
+		serverLog(LL_WARNING, "Unable to connect to MASTER: %v", err)
+	}
+}
+
+func replicationUnsetMaster() {
+	if server.masterhost == "" {
+		return
+	}
+	server.masterhost = ""
+	if server.master != nil {
+		freeClient(server.master)
+	}
+	cancelReplicationHandshake()
+	// 原来的副本可以通过 replid2 和新主节点部分重同步
+	shiftReplicationId()
+	disconnectSlaves()
+	server.replState = REPL_STATE_NONE
+	server.slaveseldb = -1
+}
+
+// REPLICAOF host port | NO ONE
+func replicaofCommand(c *GodisClient) {
+	host, portArg := c.args[1].StrVal(), c.args[2]
+	if strings.EqualFold(host, "no") && strings.EqualFold(portArg.StrVal(), "one") {
+		if server.masterhost != "" {
+			replicationUnsetMaster()
+			serverLog(LL_NOTICE, "MASTER MODE enabled (user request from 'id=%d')", c.id)
+		}
+		c.AddReply(shared.ok)
+		return
+	}
+	if c.flags&CLIENT_SLAVE != 0 {
+		c.AddReplyError("Command is not valid when client is a replica.")
+		return
+	}
+	port, ok := getLongLongFromObjectOrReply(c, portArg, "")
+	if !ok {
+		return
+	}
+	if port < 0 || port > 65535 {
+		c.AddReplyError("Invalid master port")
+		return
+	}
+	if server.masterhost == host && server.masterport == int(port) {
+		serverLog(LL_NOTICE, "REPLICAOF would result into synchronization with the master we are already connected with. No operation performed.")
+		c.AddReplyStatus("OK Already connected to specified master")
+		return
+	}
+	replicationSetMaster(host, int(port))
+	serverLog(LL_NOTICE, "REPLICAOF %s:%d enabled (user request from 'id=%d')", host, port, c.id)
+	c.AddReply(shared.ok)
+}
+
+// 每秒执行一次
+func replicationCron() {
+	now := GetMsTime() / 1000
+	if server.masterhost != "" {
+		if server.replState >= REPL_STATE_CONNECTING && server.replState < REPL_STATE_TRANSFER &&
+			now-server.replTransferLastio > server.replTimeout {
+			serverLog(LL_WARNING, "Timeout connecting to the MASTER...")
+			cancelReplicationHandshake()
+		}
+		if server.replState == REPL_STATE_TRANSFER && now-server.replTransferLastio > server.replTimeout {
+			serverLog(LL_WARNING, "Timeout receiving bulk data from MASTER... If the problem persists try to set the 'repl-timeout' parameter in godis.conf to a larger value.")
+			cancelReplicationHandshake()
+		}
+		if server.master != nil && now-server.master.lastinteraction > server.replTimeout {
+			serverLog(LL_WARNING, "MASTER timeout: no data nor PING received...")
+			freeClient(server.master)
+		}
+		if server.replState == REPL_STATE_CONNECT {
+			serverLog(LL_NOTICE, "Connecting to MASTER %s:%d", server.masterhost, server.masterport)
+			if err := connectWithMaster(); err != nil {
+				serverLog(LL_WARNING, "Unable to connect to MASTER: %v", err)
+			}
+		}
+		replicationSendAck()
+	}
+
+	// 通过复制流定期发送 PING 副本以此判断主节点是否超时
+	if len(server.slaves) > 0 && server.replPingSlavePeriod > 0 &&
+		server.cronloops/int64(server.hz)%server.replPingSlavePeriod == 0 {
+		replicationFeedSlaves(-1, "PING")
+	}
+	// 等待快照的副本收不到命令 发送换行保持连接 副本会忽略空行
+	for _, slave := range server.slaves {
+		if slave.slaveReplState == SLAVE_STATE_WAIT_BGSAVE_START || slave.slaveReplState == SLAVE_STATE_WAIT_BGSAVE_END {
+			unix.Write(slave.fd, []byte("\n"))
+		}
+	}
+	for _, slave := range append([]*GodisClient(nil), server.slaves...) {
+		if slave.slaveReplState == SLAVE_STATE_ONLINE && now-slave.replAckTime > server.replTimeout {
+			serverLog(LL_WARNING, "Disconnecting timedout replica: %s", replicationGetSlaveName(slave))
+			freeClient(slave)
+		}
+	}
+}
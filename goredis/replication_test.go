@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestReplicationBacklog(t *testing.T) {
+	initTestServer(t)
+	server.replBacklogSize = 16
+	createReplicationBacklog()
+	feedReplicationBacklog([]byte("0123456789"))
+	feedReplicationBacklog([]byte("abcdefghij"))
+	if server.masterReplOffset != 20 || server.replBacklogHistlen != 16 || server.replBacklogOff != 5 {
+		t.Fatalf("unexpected backlog state: offset %d histlen %d off %d",
+			server.masterReplOffset, server.replBacklogHistlen, server.replBacklogOff)
+	}
+	c := newTestClient(t)
+	for _, tc := range []struct {
+		offset int64
+		expect string
+	}{
+		{5, "456789abcdefghij"},
+		{15, "efghij"},
+		{21, ""},
+	} {
+		addReplyReplicationBacklog(c, tc.offset)
+		if got := c.takeReply(); got != tc.expect {
+			t.Errorf("offset %d: expect %q, got %q", tc.offset, tc.expect, got)
+		}
+	}
+}
+
+func TestSyncCommand(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	c.run("set", "k", "v")
+	// 快照分多次发送
+	c.run("set", "big", strings.Repeat("x", 3*GODIS_IO_BUF))
+	oldReplid := server.replid
+
+	// 第一个副本连接时创建积压缓冲区并更换复制 ID +FULLRESYNC 直接写入连接
+	slave, peer := newTestConnClient(t)
+	expectReply(t, slave, "", "psync", "?", "-1")
+	if server.replid == oldReplid || server.replBacklog == nil {
+		t.Fatalf("backlog not created")
+	}
+	if got := readTestPeer(t, peer); got != "+FULLRESYNC "+server.replid+" 0\r\n" {
+		t.Fatalf("unexpected full resync reply %q", got)
+	}
+	if slave.flags&CLIENT_SLAVE == 0 || len(server.slaves) != 1 || server.statSyncFull != 1 ||
+		slave.slaveReplState != SLAVE_STATE_WAIT_BGSAVE_END || !server.rdbChildRunning {
+		t.Fatalf("slave not registered")
+	}
+
+	// 快照开始之后的写命令不在快照中 先发送 SELECT 排在快照后面
+	c.run("set", "k2", "v2")
+	waitForBgsave()
+	if slave.slaveReplState != SLAVE_STATE_SEND_BULK {
+		t.Fatalf("expect sending bulk, got state %d", slave.slaveReplState)
+	}
+	for slave.slaveReplState != SLAVE_STATE_ONLINE {
+		sendBulkToSlave(server.aeLoop, slave.fd, slave)
+	}
+	payload := readTestPeer(t, peer)
+	if !strings.HasPrefix(payload, "$") || !strings.Contains(payload, strings.Repeat("x", 3*GODIS_IO_BUF)) || !strings.Contains(payload, "REDIS0") ||
+		!strings.Contains(payload, "repl-stream-db") || strings.Contains(payload, "k2") {
+		t.Fatalf("unexpected payload %q", payload)
+	}
+	expect := "*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n*3\r\n$3\r\nset\r\n$2\r\nk2\r\n$2\r\nv2\r\n"
+	if got := slave.takeReply(); got != expect {
+		t.Errorf("expect %q, got %q", expect, got)
+	}
+	expectReply(t, slave, "", "replconf", "ack", "10")
+	if slave.replAckOff != 10 {
+		t.Errorf("expect ack offset 10, got %d", slave.replAckOff)
+	}
+
+	// 从积压缓冲区部分重同步
+	offset := server.masterReplOffset
+	c.run("set", "k3", "v3")
+	slave2 := newTestClient(t)
+	expect = "+CONTINUE " + server.replid + "\r\n*3\r\n$3\r\nset\r\n$2\r\nk3\r\n$2\r\nv3\r\n"
+	expectReply(t, slave2, expect, "psync", server.replid, strconv.FormatInt(offset+1, 10))
+	slave.takeReply()
+
+	// 复制 ID 不匹配或者偏移超出积压缓冲区时全量同步 第二个副本共用正在进行的快照
+	slave3, peer3 := newTestConnClient(t)
+	slave3.run("psync", "0123456789012345678901234567890123456789", "1")
+	expect = fmt.Sprintf("+FULLRESYNC %s %d\r\n", server.replid, server.masterReplOffset)
+	if got := readTestPeer(t, peer3); got != expect {
+		t.Errorf("expect %q, got %q", expect, got)
+	}
+	c.run("set", "k4", "v4")
+	slave4, peer4 := newTestConnClient(t)
+	buffered := slave4.run("psync", server.replid, strconv.FormatInt(server.masterReplOffset+2, 10))
+	if got := readTestPeer(t, peer4); got != expect || slave4.slaveReplState != SLAVE_STATE_WAIT_BGSAVE_END {
+		t.Errorf("expect %q, got %q", expect, got)
+	}
+	if buffered != slave3.takeReply() || !strings.Contains(buffered, "k4") {
+		t.Errorf("unexpected buffered commands %q", buffered)
+	}
+	if server.statSyncPartialOk != 1 || server.statSyncPartialErr != 2 {
+		t.Errorf("unexpected sync stats: ok %d err %d", server.statSyncPartialOk, server.statSyncPartialErr)
+	}
+	info := genGodisInfoString([]string{"replication"})
+	if !strings.Contains(info, "role:master\r\n") || !strings.Contains(info, "connected_slaves:4\r\n") ||
+		!strings.Contains(info, "repl_backlog_active:1\r\n") || !strings.Contains(info, "state=wait_bgsave") {
+		t.Errorf("unexpected info %q", info)
+	}
+	waitForBgsave()
+
+	expectReply(t, c, "-ERR Unrecognized REPLCONF option: foo\r\n", "replconf", "foo", "bar")
+	expectReply(t, c, "+OK\r\n", "replconf", "listening-port", "6380")
+	expectReply(t, c, "-ERR value is not an integer or out of range\r\n", "psync", "?", "x")
+}
+
+func TestReplicaReadOnly(t *testing.T) {
+	initTestServer(t)
+	server.masterhost = "127.0.0.1"
+	server.masterport = 6379
+	server.replState = REPL_STATE_CONNECTED
+	m, _ := newTestConnClient(t)
+	m.flags |= CLIENT_MASTER
+	server.master = m
+	c := newTestClient(t)
+
+	// 主节点发来的命令不回复
+	expectReply(t, m, "", "set", "k", "v")
+	expectReply(t, c, "$1\r\nv\r\n", "get", "k")
+	expectReply(t, c, "-READONLY You can't write against a read only replica.\r\n", "set", "k", "v2")
+	c.run("multi")
+	expectReply(t, c, "-READONLY You can't write against a read only replica.\r\n", "del", "k")
+	expectReply(t, c, "-EXECABORT Transaction discarded because of previous errors.\r\n", "exec")
+	script := "return redis.call('del', 'k')"
+	expectReply(t, c, "-READONLY You can't write against a read only replica. script: "+sha1hex(script)+
+		", on @user_script:1.\r\n", "eval", script, "0")
+	if reply := c.run("hello"); !strings.Contains(reply, "$4\r\nrole\r\n$7\r\nreplica\r\n") {
+		t.Errorf("unexpected hello reply %q", reply)
+	}
+
+	// 副本不删除过期的 key 只对普通客户端隐藏
+	m.run("set", "e", "v", "px", "1")
+	time.Sleep(2 * time.Millisecond)
+	expectReply(t, c, "$-1\r\n", "get", "e")
+	expectReply(t, c, ":0\r\n", "exists", "e")
+	if c.db.data.Len() != 2 {
+		t.Errorf("expired key deleted on replica")
+	}
+	expectReply(t, c, "$1\r\nk\r\n", "randomkey")
+	m.run("del", "e")
+
+	replicationSendAck()
+	if got := m.takeReply(); got != "*3\r\n$8\r\nREPLCONF\r\n$3\r\nACK\r\n$1\r\n0\r\n" {
+		t.Errorf("unexpected ack %q", got)
+	}
+	if info := genGodisInfoString([]string{"replication"}); !strings.Contains(info, "role:slave\r\n") ||
+		!strings.Contains(info, "master_link_status:up\r\n") {
+		t.Errorf("unexpected info %q", info)
+	}
+
+	// 提升为主节点之后保留旧的复制 ID
+	oldReplid := server.replid
+	expectReply(t, c, "+OK\r\n", "replicaof", "no", "one")
+	if server.masterhost != "" || server.master != nil || server.replid2 != oldReplid || server.secondReplidOffset != 1 {
+		t.Errorf("unexpected state after REPLICAOF NO ONE")
+	}
+	expectReply(t, c, "+OK\r\n", "set", "k", "v2")
+}
+
+// 读取 newTestConnClient 的对端已经收到的数据
+func readTestPeer(t *testing.T, fd int) string {
+	t.Helper()
+	buf := make([]byte, 64*1024)
+	n, err := unix.Read(fd, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+// 找一个空闲的端口
+func freeTestPort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// 在 dir 中启动一个 goredis 进程 返回监听的端口 extra 是额外的配置
+func startTestServer(t *testing.T, bin string, dir string, extra ...string) int {
+	port := freeTestPort(t)
+	conf := fmt.Sprintf("bind 127.0.0.1\nport %d\ndir %s\nsave \"\"\nlogfile %s\n", port, dir, filepath.Join(dir, "godis.log"))
+	for _, line := range extra {
+		conf += line + "\n"
+	}
+	confFile := filepath.Join(dir, "godis.conf")
+	if err := os.WriteFile(confFile, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(bin, confFile)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port)); err == nil {
+			conn.Close()
+			return port
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("server on port %d not started", port)
+	return 0
+}
+
+type testConn struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialTestServer(t *testing.T, port int) *testConn {
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{t, conn, bufio.NewReader(conn)}
+}
+
+// 发送一条命令 状态 错误和整数回复返回整行 bulk 回复返回内容
+func (tc *testConn) do(args ...string) string {
+	tc.t.Helper()
+	tc.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := tc.conn.Write(catAppendOnlyGenericCommand(nil, args...)); err != nil {
+		tc.t.Fatal(err)
+	}
+	line, err := tc.r.ReadString('\n')
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line[0] != '$' {
+		return line
+	}
+	n, _ := strconv.Atoi(line[1:])
+	if n < 0 {
+		return "(nil)"
+	}
+	buf := make([]byte, n+2)
+	if _, err := io.ReadFull(tc.r, buf); err != nil {
+		tc.t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+// 等待 cond 成立 最多 10 秒
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for %s", what)
+}
+
+func infoField(info, field string) string {
+	for _, line := range strings.Split(info, "\r\n") {
+		if v, ok := strings.CutPrefix(line, field+":"); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// 两个 goredis 进程之间的全量同步 命令传播 以及切换主从后的部分重同步
+func TestReplicationProcesses(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip starting goredis processes in short mode")
+	}
+	tmp := t.TempDir()
+	bin := filepath.Join(tmp, "goredis")
+	if out, err := exec.Command("go", "build", "-o", bin, ".").CombinedOutput(); err != nil {
+		t.Fatalf("build: %v\n%s", err, out)
+	}
+	for _, d := range []string{"master", "replica"} {
+		os.Mkdir(filepath.Join(tmp, d), 0755)
+	}
+	// 积压缓冲区放得下下面的大参数 连接断开时可以部分重同步
+	mport := startTestServer(t, bin, filepath.Join(tmp, "master"), "repl-backlog-size 16mb")
+	// 副本上的限制比主节点小 主节点发来的命令不受限制
+	rport := startTestServer(t, bin, filepath.Join(tmp, "replica"), "proto-max-bulk-len 1mb")
+	m, r := dialTestServer(t, mport), dialTestServer(t, rport)
+
+	m.do("set", "k", "v")
+	m.do("rpush", "l", "a", "b", "c")
+	m.do("select", "2")
+	m.do("set", "k2", "v2")
+	if got := r.do("replicaof", "127.0.0.1", strconv.Itoa(mport)); got != "+OK" {
+		t.Fatalf("replicaof: %s", got)
+	}
+	waitFor(t, "replica link up", func() bool {
+		return infoField(r.do("info", "replication"), "master_link_status") == "up"
+	})
+	if got := r.do("get", "k"); got != "v" {
+		t.Errorf("expect v, got %s", got)
+	}
+	if got := r.do("llen", "l"); got != ":3" {
+		t.Errorf("expect :3, got %s", got)
+	}
+
+	// 全量同步之后的写命令通过复制流传播 复制流中选择的数据库是 2
+	m.do("set", "k3", "v3")
+	r.do("select", "2")
+	waitFor(t, "k3 replicated", func() bool { return r.do("get", "k3") == "v3" })
+	if got := r.do("get", "k2"); got != "v2" {
+		t.Errorf("expect v2, got %s", got)
+	}
+	if got := r.do("set", "x", "y"); got != "-READONLY You can't write against a read only replica." {
+		t.Errorf("unexpected reply %s", got)
+	}
+	// 很长的参数不能断开复制连接
+	m.do("eval", "redis.call('set','big',string.rep('x',5000))", "0")
+	m.do("set", "huge", strings.Repeat("x", 2*1024*1024))
+	m.do("set", "k5", "v5")
+	waitFor(t, "big values replicated", func() bool { return r.do("get", "k5") == "v5" })
+	if got := r.do("strlen", "big"); got != ":5000" {
+		t.Errorf("expect :5000, got %s", got)
+	}
+	if got := r.do("strlen", "huge"); got != ":2097152" {
+		t.Errorf("expect :2097152, got %s", got)
+	}
+	if stats := m.do("info", "stats"); infoField(stats, "sync_full") != "1" || infoField(stats, "sync_partial_ok") != "0" {
+		t.Errorf("replication link dropped: %q", stats)
+	}
+	info := m.do("info", "replication")
+	if infoField(info, "connected_slaves") != "1" || !strings.Contains(infoField(info, "slave0"), "port="+strconv.Itoa(rport)) {
+		t.Errorf("unexpected master info %q", info)
+	}
+	waitFor(t, "replica offset acked", func() bool {
+		info := m.do("info", "replication")
+		moff := infoField(info, "master_repl_offset")
+		return infoField(r.do("info", "replication"), "slave_repl_offset") == moff &&
+			strings.Contains(infoField(info, "slave0"), "offset="+moff+",")
+	})
+
+	// 副本提升为主节点 原来的主节点作为它的副本可以部分重同步
+	if got := r.do("replicaof", "no", "one"); got != "+OK" {
+		t.Fatalf("replicaof no one: %s", got)
+	}
+	if got := m.do("replicaof", "127.0.0.1", strconv.Itoa(rport)); got != "+OK" {
+		t.Fatalf("replicaof: %s", got)
+	}
+	waitFor(t, "old master link up", func() bool {
+		return infoField(m.do("info", "replication"), "master_link_status") == "up"
+	})
+	stats := r.do("info", "stats")
+	if infoField(stats, "sync_partial_ok") != "1" || infoField(stats, "sync_full") != "0" {
+		t.Errorf("expect a partial resync: %q", stats)
+	}
+	r.do("select", "0")
+	r.do("set", "k4", "v4")
+	m.do("select", "0")
+	waitFor(t, "k4 replicated", func() bool { return m.do("get", "k4") == "v4" })
+	if got := infoField(m.do("info", "replication"), "role"); got != "slave" {
+		t.Errorf("expect role slave, got %s", got)
+	}
+}
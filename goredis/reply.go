@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// bulk / multi bulk 长度头的共享对象个数
+const OBJ_SHARED_BULKHDR_LEN = 32
+
+// 预先分配好的回复对象，AddReply 时只增加引用计数，不会被释放
+type sharedObjects struct {
+	crlf, ok, err, emptybulk, czero, cone, cnegone, pong, queued,
+	nullbulk, nullarray, emptyarray, emptymap, emptyset, null, ctrue, cfalse, wrongtypeerr, nokeyerr, syntaxerr, emptyscan,
+	outofrangeerr, notinterr, notfloaterr, execaborterr, oomerr, noautherr *Gobj
+	mbulkhdr [OBJ_SHARED_BULKHDR_LEN]*Gobj // "*<n>\r\n"
+	bulkhdr  [OBJ_SHARED_BULKHDR_LEN]*Gobj // "$<n>\r\n"
+}
+
+var shared sharedObjects
+
+func createSharedObjects() {
+	shared.crlf = CreateObject(GSTR, "\r\n")
+	shared.ok = CreateObject(GSTR, "+OK\r\n")
+	shared.err = CreateObject(GSTR, "-ERR\r\n")
+	shared.emptybulk = CreateObject(GSTR, "$0\r\n\r\n")
+	shared.czero = CreateObject(GSTR, ":0\r\n")
+	shared.cone = CreateObject(GSTR, ":1\r\n")
+	shared.cnegone = CreateObject(GSTR, ":-1\r\n")
+	shared.pong = CreateObject(GSTR, "+PONG\r\n")
+	shared.queued = CreateObject(GSTR, "+QUEUED\r\n")
+	shared.nullbulk = CreateObject(GSTR, "$-1\r\n")
+	shared.nullarray = CreateObject(GSTR, "*-1\r\n")
+	shared.emptyarray = CreateObject(GSTR, "*0\r\n")
+	shared.emptymap = CreateObject(GSTR, "%0\r\n")
+	shared.emptyset = CreateObject(GSTR, "~0\r\n")
+	shared.null = CreateObject(GSTR, "_\r\n")
+	shared.ctrue = CreateObject(GSTR, "#t\r\n")
+	shared.cfalse = CreateObject(GSTR, "#f\r\n")
+	shared.wrongtypeerr = CreateObject(GSTR, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
+	shared.nokeyerr = CreateObject(GSTR, "-ERR no such key\r\n")
+	shared.emptyscan = CreateObject(GSTR, "*2\r\n$1\r\n0\r\n*0\r\n")
+	shared.syntaxerr = CreateObject(GSTR, "-ERR syntax error\r\n")
+	shared.outofrangeerr = CreateObject(GSTR, "-ERR index out of range\r\n")
+	shared.notinterr = CreateObject(GSTR, "-ERR value is not an integer or out of range\r\n")
+	shared.notfloaterr = CreateObject(GSTR, "-ERR value is not a valid float\r\n")
+	shared.execaborterr = CreateObject(GSTR, "-EXECABORT Transaction discarded because of previous errors.\r\n")
+	shared.oomerr = CreateObject(GSTR, "-OOM command not allowed when used memory > 'maxmemory'.\r\n")
+	shared.noautherr = CreateObject(GSTR, "-NOAUTH Authentication required.\r\n")
+	for i := 0; i < OBJ_SHARED_BULKHDR_LEN; i++ {
+		shared.mbulkhdr[i] = CreateObject(GSTR, fmt.Sprintf("*%d\r\n", i))
+		shared.bulkhdr[i] = CreateObject(GSTR, fmt.Sprintf("$%d\r\n", i))
+	}
+}
+
+// 长度头 小的长度直接使用共享对象
+func (c *GodisClient) addReplyLongLongWithPrefix(n int64, prefix byte) {
+	if n >= 0 && n < OBJ_SHARED_BULKHDR_LEN {
+		if prefix == '*' {
+			c.AddReply(shared.mbulkhdr[n])
+			return
+		}
+		if prefix == '$' {
+			c.AddReply(shared.bulkhdr[n])
+			return
+		}
+	}
+	c.AddReplyStr(string(prefix) + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+// +OK
+func (c *GodisClient) AddReplyStatus(status string) {
+	c.AddReplyStr("+" + status + "\r\n")
+}
+
+/*
+msg 不以 '-' 开头时补上 "-ERR " 前缀
+需要自定义错误码时传入 "-WRONGTYPE ..." 这样的字符串
+*/
+func (c *GodisClient) AddReplyError(msg string) {
+	// 错误信息中不能包含换行 否则会破坏协议
+	msg = strings.NewReplacer("\r", " ", "\n", " ").Replace(msg)
+	if len(msg) == 0 || msg[0] != '-' {
+		msg = "-ERR " + msg
+	}
+	c.AddReplyStr(msg + "\r\n")
+}
+
+func (c *GodisClient) AddReplyErrorFormat(format string, v ...interface{}) {
+	c.AddReplyError(fmt.Sprintf(format, v...))
+}
+
+func (c *GodisClient) AddReplyInt(n int64) {
+	if n == 0 {
+		c.AddReply(shared.czero)
+	} else if n == 1 {
+		c.AddReply(shared.cone)
+	} else if n == -1 {
+		c.AddReply(shared.cnegone)
+	} else {
+		c.AddReplyStr(":" + strconv.FormatInt(n, 10) + "\r\n")
+	}
+}
+
+// 直接把数据库中的对象挂到回复链表上 不做拷贝
+func (c *GodisClient) AddReplyBulk(o *Gobj) {
+	str := o.StrVal()
+	c.addReplyLongLongWithPrefix(int64(len(str)), '$')
+	c.AddReply(o)
+	c.AddReply(shared.crlf)
+}
+
+func (c *GodisClient) AddReplyBulkStr(str string) {
+	c.AddReplyStr("$" + strconv.Itoa(len(str)) + "\r\n" + str + "\r\n")
+}
+
+func (c *GodisClient) AddReplyBulkInt(n int64) {
+	c.AddReplyBulkStr(strconv.FormatInt(n, 10))
+}
+
+// 不存在的 key RESP3 下统一为 '_'
+func (c *GodisClient) AddReplyNull() {
+	if c.resp >= 3 {
+		c.AddReply(shared.null)
+	} else {
+		c.AddReply(shared.nullbulk)
+	}
+}
+
+// BLPOP 超时等场景返回的空数组
+func (c *GodisClient) AddReplyNullArray() {
+	if c.resp >= 3 {
+		c.AddReply(shared.null)
+	} else {
+		c.AddReply(shared.nullarray)
+	}
+}
+
+func (c *GodisClient) AddReplyArrayLen(n int) {
+	c.addReplyLongLongWithPrefix(int64(n), '*')
+}
+
+// RESP2 下 map 展开为 key value 交替的数组
+func (c *GodisClient) AddReplyMapLen(n int) {
+	if c.resp >= 3 {
+		c.addReplyLongLongWithPrefix(int64(n), '%')
+	} else {
+		c.addReplyLongLongWithPrefix(int64(n*2), '*')
+	}
+}
+
+func (c *GodisClient) AddReplySetLen(n int) {
+	if c.resp >= 3 {
+		c.addReplyLongLongWithPrefix(int64(n), '~')
+	} else {
+		c.addReplyLongLongWithPrefix(int64(n), '*')
+	}
+}
+
+// pub/sub 消息等服务端主动推送的数据
+func (c *GodisClient) AddReplyPushLen(n int) {
+	if c.resp >= 3 {
+		c.addReplyLongLongWithPrefix(int64(n), '>')
+	} else {
+		c.addReplyLongLongWithPrefix(int64(n), '*')
+	}
+}
+
+func (c *GodisClient) AddReplyBool(b bool) {
+	if c.resp >= 3 {
+		if b {
+			c.AddReply(shared.ctrue)
+		} else {
+			c.AddReply(shared.cfalse)
+		}
+	} else {
+		c.AddReplyInt(boolToInt(b))
+	}
+}
+
+// 可以被 strconv.ParseFloat 精确还原 无穷大使用 Redis 的写法
+func formatDouble(d float64) string {
+	if math.IsInf(d, 1) {
+		return "inf"
+	} else if math.IsInf(d, -1) {
+		return "-inf"
+	} else if math.IsNaN(d) {
+		return "nan"
+	}
+	return strconv.FormatFloat(d, 'g', -1, 64)
+}
+
+// RESP2 下 double 以 bulk string 的形式返回
+func (c *GodisClient) AddReplyDouble(d float64) {
+	str := formatDouble(d)
+	if c.resp >= 3 {
+		c.AddReplyStr("," + str + "\r\n")
+	} else {
+		c.AddReplyBulkStr(str)
+	}
+}
+
+func (c *GodisClient) AddReplyBigNum(num string) {
+	if c.resp >= 3 {
+		c.AddReplyStr("(" + num + "\r\n")
+	} else {
+		c.AddReplyBulkStr(num)
+	}
+}
+
+// ext 为三个字符的格式说明 比如 "txt" "mkd"
+func (c *GodisClient) AddReplyVerbatim(str string, ext string) {
+	if c.resp >= 3 {
+		c.AddReplyStr("=" + strconv.Itoa(len(str)+4) + "\r\n" + ext + ":" + str + "\r\n")
+	} else {
+		c.AddReplyBulkStr(str)
+	}
+}
+
+// 不同协议版本下的空回复 用于 lookupKeyReadOrReply
+func nullReply(c *GodisClient) *Gobj {
+	if c.resp >= 3 {
+		return shared.null
+	}
+	return shared.nullbulk
+}
+
+func emptyMapReply(c *GodisClient) *Gobj {
+	if c.resp >= 3 {
+		return shared.emptymap
+	}
+	return shared.emptyarray
+}
+
+func emptySetReply(c *GodisClient) *Gobj {
+	if c.resp >= 3 {
+		return shared.emptyset
+	}
+	return shared.emptyarray
+}
+
+func boolToInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+/*
+元素个数事先未知时（比如遍历时过滤）先占位
+得到个数后再调用 SetDeferredArrayLen 填上
+占位节点在命令执行完之前不会被发送
+*/
+func (c *GodisClient) AddReplyDeferredLen() *Node {
+	// 不回复的客户端返回 nil
+	if !c.prepareClientToWrite() {
+		return nil
+	}
+	o := CreateObject(GSTR, "")
+	c.AddReply(o)
+	o.DecrRefCount()
+	return c.reply.Last()
+}
+
+func (c *GodisClient) SetDeferredArrayLen(node *Node, n int) {
+	c.setDeferredReply(node, "*"+strconv.Itoa(n)+"\r\n")
+}
+
+func (c *GodisClient) SetDeferredMapLen(node *Node, n int) {
+	if c.resp >= 3 {
+		c.setDeferredReply(node, "%"+strconv.Itoa(n)+"\r\n")
+	} else {
+		c.setDeferredReply(node, "*"+strconv.Itoa(n*2)+"\r\n")
+	}
+}
+
+func (c *GodisClient) SetDeferredSetLen(node *Node, n int) {
+	if c.resp >= 3 {
+		c.setDeferredReply(node, "~"+strconv.Itoa(n)+"\r\n")
+	} else {
+		c.setDeferredReply(node, "*"+strconv.Itoa(n)+"\r\n")
+	}
+}
+
+func (c *GodisClient) setDeferredReply(node *Node, str string) {
+	if node == nil {
+		return
+	}
+	node.Val.DecrRefCount()
+	node.Val = CreateObject(GSTR, str)
+}
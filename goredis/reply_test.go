@@ -0,0 +1,56 @@
+package main
+
+import "testing"
+
+func TestAddReply(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+
+	c.AddReplyInt(0)
+	c.AddReplyInt(-42)
+	c.AddReplyStatus("OK")
+	c.AddReplyError("bad thing\r\nhappened")
+	c.AddReplyError("-WRONGTYPE custom")
+	if got, expect := c.takeReply(), ":0\r\n:-42\r\n+OK\r\n-ERR bad thing  happened\r\n-WRONGTYPE custom\r\n"; got != expect {
+		t.Errorf("expect %q, got %q", expect, got)
+	}
+
+	node := c.AddReplyDeferredLen()
+	for i := 0; i < 40; i++ {
+		c.AddReplyBulkStr("x")
+	}
+	c.SetDeferredArrayLen(node, 40)
+	got := c.takeReply()
+	if got[:5] != "*40\r\n" || len(got) != 5+40*len("$1\r\nx\r\n") {
+		t.Errorf("unexpected deferred reply %q", got)
+	}
+
+	c.AddReplyArrayLen(2)
+	c.AddReplyBulk(CreateObject(GSTR, "hello"))
+	c.AddReplyNull()
+	if got, expect := c.takeReply(), "*2\r\n$5\r\nhello\r\n$-1\r\n"; got != expect {
+		t.Errorf("expect %q, got %q", expect, got)
+	}
+}
+
+func TestAddReplyResp3(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	for _, resp := range []int{2, 3} {
+		c.resp = resp
+		c.AddReplyMapLen(1)
+		c.AddReplyBulkStr("k")
+		c.AddReplyDouble(1.5)
+		c.AddReplySetLen(1)
+		c.AddReplyBool(true)
+		c.AddReplyNull()
+		c.AddReplyBigNum("123")
+		expect := "*2\r\n$1\r\nk\r\n$3\r\n1.5\r\n*1\r\n:1\r\n$-1\r\n$3\r\n123\r\n"
+		if resp == 3 {
+			expect = "%1\r\n$1\r\nk\r\n,1.5\r\n~1\r\n#t\r\n_\r\n(123\r\n"
+		}
+		if got := c.takeReply(); got != expect {
+			t.Errorf("resp%d: expect %q, got %q", resp, expect, got)
+		}
+	}
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+)
+
+const (
+	ZSKIPLIST_MAXLEVEL = 32
+	ZSKIPLIST_P        = 0.25 // 每升高一层的概率
+)
+
+type zskiplistLevel struct {
+	forward *zskiplistNode
+	span    int64 // 到 forward 节点之间跨越的节点数 用于计算排名
+}
+
+type zskiplistNode struct {
+	member   *Gobj
+	score    float64
+	backward *zskiplistNode
+	level    []zskiplistLevel
+}
+
+// 按 (score, member) 排序的跳表
+type zskiplist struct {
+	header *zskiplistNode
+	tail   *zskiplistNode
+	length int64
+	level  int
+}
+
+func zslCreateNode(level int, score float64, member *Gobj) *zskiplistNode {
+	return &zskiplistNode{
+		member: member,
+		score:  score,
+		level:  make([]zskiplistLevel, level),
+	}
+}
+
+func zslCreate() *zskiplist {
+	return &zskiplist{
+		header: zslCreateNode(ZSKIPLIST_MAXLEVEL, 0, nil),
+		level:  1,
+	}
+}
+
+func zslRandomLevel() int {
+	level := 1
+	for rand.Float64() < ZSKIPLIST_P && level < ZSKIPLIST_MAXLEVEL {
+		level++
+	}
+	return level
+}
+
+// (score, member) 是否排在 x 之后
+func zslLess(x *zskiplistNode, score float64, member string) bool {
+	return x.score < score || (x.score == score && x.member.StrVal() < member)
+}
+
+// 调用方需要保证 member 不存在
+func (zsl *zskiplist) Insert(score float64, member *Gobj) *zskiplistNode {
+	var update [ZSKIPLIST_MAXLEVEL]*zskiplistNode
+	var rank [ZSKIPLIST_MAXLEVEL]int64
+	ele := member.StrVal()
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		// rank[i] 为 update[i] 的排名
+		if i != zsl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && zslLess(x.level[i].forward, score, ele) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	level := zslRandomLevel()
+	if level > zsl.level {
+		for i := zsl.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = zsl.header
+			update[i].level[i].span = zsl.length
+		}
+		zsl.level = level
+	}
+	x = zslCreateNode(level, score, member)
+	member.IncrRefCount()
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = (rank[0] - rank[i]) + 1
+	}
+	// 更高的层只需要增加跨度
+	for i := level; i < zsl.level; i++ {
+		update[i].level[i].span++
+	}
+	if update[0] != zsl.header {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		zsl.tail = x
+	}
+	zsl.length++
+	return x
+}
+
+func (zsl *zskiplist) deleteNode(x *zskiplistNode, update []*zskiplistNode) {
+	for i := 0; i < zsl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span -= 1
+		}
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		zsl.tail = x.backward
+	}
+	for zsl.level > 1 && zsl.header.level[zsl.level-1].forward == nil {
+		zsl.level--
+	}
+	zsl.length--
+	x.member.DecrRefCount()
+}
+
+// 找到每一层中排在 (score, member) 之前的最后一个节点
+func (zsl *zskiplist) findUpdate(score float64, member string) ([]*zskiplistNode, *zskiplistNode) {
+	update := make([]*zskiplistNode, ZSKIPLIST_MAXLEVEL)
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && zslLess(x.level[i].forward, score, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	return update, x.level[0].forward
+}
+
+func (zsl *zskiplist) Delete(score float64, member *Gobj) bool {
+	update, x := zsl.findUpdate(score, member.StrVal())
+	if x != nil && x.score == score && x.member.StrVal() == member.StrVal() {
+		zsl.deleteNode(x, update)
+		return true
+	}
+	return false
+}
+
+// 分数变化后位置不变时直接原地修改 否则删除后重新插入
+func (zsl *zskiplist) UpdateScore(curscore float64, member *Gobj, newscore float64) *zskiplistNode {
+	update, x := zsl.findUpdate(curscore, member.StrVal())
+	if (x.backward == nil || x.backward.score < newscore) &&
+		(x.level[0].forward == nil || x.level[0].forward.score > newscore) {
+		x.score = newscore
+		return x
+	}
+	member.IncrRefCount()
+	zsl.deleteNode(x, update)
+	node := zsl.Insert(newscore, member)
+	member.DecrRefCount()
+	return node
+}
+
+// 排名从 1 开始 不存在时返回 0
+func (zsl *zskiplist) GetRank(score float64, member *Gobj) int64 {
+	var rank int64
+	ele := member.StrVal()
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil &&
+			(x.level[i].forward.score < score ||
+				(x.level[i].forward.score == score && x.level[i].forward.member.StrVal() <= ele)) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+		if x.member != nil && x.member.StrVal() == ele {
+			return rank
+		}
+	}
+	return 0
+}
+
+// 排名从 1 开始
+func (zsl *zskiplist) GetElementByRank(rank int64) *zskiplistNode {
+	var traversed int64
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank {
+			return x
+		}
+	}
+	return nil
+}
+
+// 分数区间 minex / maxex 表示开区间
+type zrangespec struct {
+	min, max     float64
+	minex, maxex bool
+}
+
+func zslValueGteMin(value float64, spec *zrangespec) bool {
+	if spec.minex {
+		return value > spec.min
+	}
+	return value >= spec.min
+}
+
+func zslValueLteMax(value float64, spec *zrangespec) bool {
+	if spec.maxex {
+		return value < spec.max
+	}
+	return value <= spec.max
+}
+
+func (zsl *zskiplist) isInRange(spec *zrangespec) bool {
+	if spec.min > spec.max || (spec.min == spec.max && (spec.minex || spec.maxex)) {
+		return false
+	}
+	x := zsl.tail
+	if x == nil || !zslValueGteMin(x.score, spec) {
+		return false
+	}
+	x = zsl.header.level[0].forward
+	if x == nil || !zslValueLteMax(x.score, spec) {
+		return false
+	}
+	return true
+}
+
+func (zsl *zskiplist) FirstInRange(spec *zrangespec) *zskiplistNode {
+	if !zsl.isInRange(spec) {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !zslValueGteMin(x.level[i].forward.score, spec) {
+			x = x.level[i].forward
+		}
+	}
+	x = x.level[0].forward
+	if !zslValueLteMax(x.score, spec) {
+		return nil
+	}
+	return x
+}
+
+func (zsl *zskiplist) LastInRange(spec *zrangespec) *zskiplistNode {
+	if !zsl.isInRange(spec) {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && zslValueLteMax(x.level[i].forward.score, spec) {
+			x = x.level[i].forward
+		}
+	}
+	if !zslValueGteMin(x.score, spec) {
+		return nil
+	}
+	return x
+}
+
+// 字典序区间 "-" 和 "+" 分别表示负无穷和正无穷
+type zlexrangespec struct {
+	min, max       string
+	minex, maxex   bool
+	minInf, maxInf int // -1 表示 "-" 1 表示 "+" 0 表示普通字符串
+}
+
+// 比较 value 和区间的一端
+func zslLexCmp(value string, inf int, bound string) int {
+	if inf != 0 {
+		return -inf
+	}
+	return strings.Compare(value, bound)
+}
+
+func zslLexValueGteMin(value string, spec *zlexrangespec) bool {
+	if spec.minex {
+		return zslLexCmp(value, spec.minInf, spec.min) > 0
+	}
+	return zslLexCmp(value, spec.minInf, spec.min) >= 0
+}
+
+func zslLexValueLteMax(value string, spec *zlexrangespec) bool {
+	if spec.maxex {
+		return zslLexCmp(value, spec.maxInf, spec.max) < 0
+	}
+	return zslLexCmp(value, spec.maxInf, spec.max) <= 0
+}
+
+func (zsl *zskiplist) isInLexRange(spec *zlexrangespec) bool {
+	if spec.minInf == 1 || spec.maxInf == -1 {
+		return false
+	}
+	if spec.minInf == 0 && spec.maxInf == 0 {
+		cmp := strings.Compare(spec.min, spec.max)
+		if cmp > 0 || (cmp == 0 && (spec.minex || spec.maxex)) {
+			return false
+		}
+	}
+	x := zsl.tail
+	if x == nil || !zslLexValueGteMin(x.member.StrVal(), spec) {
+		return false
+	}
+	x = zsl.header.level[0].forward
+	if x == nil || !zslLexValueLteMax(x.member.StrVal(), spec) {
+		return false
+	}
+	return true
+}
+
+func (zsl *zskiplist) FirstInLexRange(spec *zlexrangespec) *zskiplistNode {
+	if !zsl.isInLexRange(spec) {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !zslLexValueGteMin(x.level[i].forward.member.StrVal(), spec) {
+			x = x.level[i].forward
+		}
+	}
+	x = x.level[0].forward
+	if !zslLexValueLteMax(x.member.StrVal(), spec) {
+		return nil
+	}
+	return x
+}
+
+func (zsl *zskiplist) LastInLexRange(spec *zlexrangespec) *zskiplistNode {
+	if !zsl.isInLexRange(spec) {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && zslLexValueLteMax(x.level[i].forward.member.StrVal(), spec) {
+			x = x.level[i].forward
+		}
+	}
+	if !zslLexValueGteMin(x.member.StrVal(), spec) {
+		return nil
+	}
+	return x
+}
+
+/*
+删除从 first 开始 满足 inRange 的连续节点 同时从 dict 中删除
+返回删除的个数
+*/
+func (zsl *zskiplist) deleteRangeFrom(update []*zskiplistNode, x *zskiplistNode, dict *Dict, inRange func(x *zskiplistNode) bool) int64 {
+	var removed int64
+	for x != nil && inRange(x) {
+		next := x.level[0].forward
+		member := x.member
+		member.IncrRefCount()
+		zsl.deleteNode(x, update)
+		dict.Delete(member)
+		member.DecrRefCount()
+		removed++
+		x = next
+	}
+	return removed
+}
+
+func (zsl *zskiplist) DeleteRangeByScore(spec *zrangespec, dict *Dict) int64 {
+	update := make([]*zskiplistNode, ZSKIPLIST_MAXLEVEL)
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !zslValueGteMin(x.level[i].forward.score, spec) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	return zsl.deleteRangeFrom(update, x.level[0].forward, dict, func(x *zskiplistNode) bool {
+		return zslValueLteMax(x.score, spec)
+	})
+}
+
+func (zsl *zskiplist) DeleteRangeByLex(spec *zlexrangespec, dict *Dict) int64 {
+	update := make([]*zskiplistNode, ZSKIPLIST_MAXLEVEL)
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !zslLexValueGteMin(x.level[i].forward.member.StrVal(), spec) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	return zsl.deleteRangeFrom(update, x.level[0].forward, dict, func(x *zskiplistNode) bool {
+		return zslLexValueLteMax(x.member.StrVal(), spec)
+	})
+}
+
+// start end 为从 1 开始的排名 闭区间
+func (zsl *zskiplist) DeleteRangeByRank(start, end int64, dict *Dict) int64 {
+	update := make([]*zskiplistNode, ZSKIPLIST_MAXLEVEL)
+	var traversed int64
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span < start {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	rank := traversed + 1
+	return zsl.deleteRangeFrom(update, x.level[0].forward, dict, func(x *zskiplistNode) bool {
+		rank++
+		return rank-1 <= end
+	})
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+/*
+BGSAVE 和 BGREWRITEAOF 使用的后台快照
+Go 的运行时不能安全地 fork 所以由 ServerCron 分批遍历数据库 每次只占用一小段时间
+开始时记下每个数据库的 dict 之后总是遍历这些 dict FLUSHALL 和 SWAPDB 只替换指针 不影响遍历
+还没有遍历到的 key 被修改或者删除之前 先把它当前的值写入快照（写屏障）
+开始之后新增的 key 不写入 所以快照的内容就是开始时刻的数据
+编码后的数据分块交给后台 goroutine 写入文件
+*/
+const (
+	SNAPSHOT_CYCLE_TIME_PERC = 25        // 每次 cron 最多占用的时间百分比
+	SNAPSHOT_CHUNK_SIZE      = 64 * 1024 // 缓冲区超过这个大小就交给后台 goroutine
+	SNAPSHOT_PENDING_CHUNKS  = 16        // 写文件跟不上时最多积压的块数 满了之后暂停遍历
+)
+
+var errSnapshotAborted = errors.New("snapshot aborted")
+
+type snapshotDb struct {
+	id     int
+	data   *Dict
+	expire *Dict
+	saved  map[string]struct{} // 已经写入快照 或者开始之后才新增的 key
+	cursor uint64
+	done   bool // 开始时存在的 key 都已经写入
+}
+
+type snapshot struct {
+	dbs      []*snapshotDb
+	cur      int          // 正在遍历的数据库
+	buf      bytes.Buffer // 还没有交给后台 goroutine 的数据
+	pending  []byte       // 通道已满时暂存的块
+	finished bool         // 全部数据都已经交给后台 goroutine
+	chunks   chan []byte
+	aborted  chan struct{}
+	// 由 BGSAVE 和 BGREWRITEAOF 提供 把数据编码到 buf 中
+	saveKey func(dbid int, key, val *Gobj, expire int64)
+	saveEnd func()
+}
+
+func createSnapshot() *snapshot {
+	s := &snapshot{
+		chunks:  make(chan []byte, SNAPSHOT_PENDING_CHUNKS),
+		aborted: make(chan struct{}),
+	}
+	for _, db := range server.dbs {
+		s.dbs = append(s.dbs, &snapshotDb{
+			id:     db.id,
+			data:   db.data,
+			expire: db.expire,
+			saved:  make(map[string]struct{}),
+		})
+	}
+	return s
+}
+
+// SWAPDB 之后数据库的编号会变 所以按 dict 查找
+func (s *snapshot) lookupDb(db *GodisDB) *snapshotDb {
+	for _, sdb := range s.dbs {
+		if sdb.data == db.data {
+			if sdb.done {
+				return nil
+			}
+			return sdb
+		}
+	}
+	return nil
+}
+
+func (s *snapshot) saveEntry(sdb *snapshotDb, key, val *Gobj) {
+	k := key.StrVal()
+	if _, ok := sdb.saved[k]; ok {
+		return
+	}
+	expire := int64(-1)
+	if e := sdb.expire.Find(key); e != nil {
+		expire = e.Val.IntVal()
+	}
+	s.saveKey(sdb.id, key, val, expire)
+	sdb.saved[k] = struct{}{}
+}
+
+/*
+遍历一个槽位 最后一个数据库遍历完之后写入结尾
+回调中不能查找 sdb.data 查找会执行 rehash 移动正在遍历的链表
+*/
+func (s *snapshot) scanStep() {
+	if s.cur == len(s.dbs) {
+		return
+	}
+	sdb := s.dbs[s.cur]
+	sdb.cursor = sdb.data.Scan(sdb.cursor, func(e *Entry) {
+		s.saveEntry(sdb, e.Key, e.Val)
+	})
+	if sdb.cursor == 0 {
+		sdb.done = true
+		sdb.saved = nil
+		s.cur++
+		if s.cur == len(s.dbs) {
+			s.saveEnd()
+		}
+	}
+}
+
+func (s *snapshot) send(chunk []byte, block bool) bool {
+	if block {
+		s.chunks <- chunk
+		return true
+	}
+	select {
+	case s.chunks <- chunk:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *snapshot) takeBuf() []byte {
+	chunk := bytes.Clone(s.buf.Bytes())
+	s.buf.Reset()
+	return chunk
+}
+
+/*
+在 ms 毫秒内推进快照 写文件跟不上时提前返回
+block 为 true 时一直执行到全部交给后台 goroutine 为止
+*/
+func (s *snapshot) run(ms int64, block bool) {
+	start := GetMsTime()
+	for i := 1; !s.finished; i++ {
+		if s.pending != nil {
+			if !s.send(s.pending, block) {
+				return
+			}
+			s.pending = nil
+		}
+		if s.cur == len(s.dbs) {
+			if s.buf.Len() > 0 {
+				s.pending = s.takeBuf()
+				continue
+			}
+			close(s.chunks)
+			s.finished = true
+			return
+		}
+		s.scanStep()
+		if s.buf.Len() >= SNAPSHOT_CHUNK_SIZE {
+			s.pending = s.takeBuf()
+		}
+		if !block && i%16 == 0 && GetMsTime()-start >= ms {
+			return
+		}
+	}
+}
+
+// 放弃快照 后台 goroutine 返回 errSnapshotAborted
+func (s *snapshot) abort() {
+	close(s.aborted)
+}
+
+/*
+在后台 goroutine 中执行 把快照写入 w
+出错之后继续读取直到通道关闭 保证主线程阻塞发送时不会永远等待
+*/
+func (s *snapshot) writeTo(w io.Writer) error {
+	var err error
+	for {
+		select {
+		case chunk, ok := <-s.chunks:
+			if !ok {
+				return err
+			}
+			if err == nil {
+				_, err = w.Write(chunk)
+			}
+		case <-s.aborted:
+			return errSnapshotAborted
+		}
+	}
+}
+
+// 修改或者删除 key 之前调用 还没有写入快照时先写入当前的值
+func snapshotBeforeWrite(db *GodisDB, key *Gobj) {
+	for _, s := range [...]*snapshot{server.rdbSnapshot, server.aofSnapshot} {
+		if s == nil {
+			continue
+		}
+		if sdb := s.lookupDb(db); sdb != nil {
+			if e := sdb.data.Find(key); e != nil {
+				s.saveEntry(sdb, e.Key, e.Val)
+			}
+		}
+	}
+}
+
+// 新增 key 之后调用 开始之后新增的 key 不写入快照
+func snapshotKeyAdded(db *GodisDB, key *Gobj) {
+	for _, s := range [...]*snapshot{server.rdbSnapshot, server.aofSnapshot} {
+		if s == nil {
+			continue
+		}
+		if sdb := s.lookupDb(db); sdb != nil {
+			sdb.saved[key.StrVal()] = struct{}{}
+		}
+	}
+}
+
+// 由 ServerCron 调用 推进正在进行的快照
+func snapshotCron() {
+	ms := max(int64(1000/server.hz*SNAPSHOT_CYCLE_TIME_PERC/100), 1)
+	for _, s := range [...]*snapshot{server.rdbSnapshot, server.aofSnapshot} {
+		if s != nil {
+			s.run(ms, false)
+		}
+	}
+}
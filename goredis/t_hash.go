@@ -0,0 +1,359 @@
+package main
+
+import (
+	"math"
+	"strings"
+)
+
+// 查找用于写入的 hash 不存在时创建 类型错误时返回 nil
+func hashTypeLookupWriteOrCreate(c *GodisClient, key *Gobj) *Gobj {
+	o := c.db.lookupKeyWrite(key)
+	if o != nil {
+		if checkType(c, o, GDICT) {
+			return nil
+		}
+		return o
+	}
+	o = CreateHashObject()
+	c.db.dbAdd(key, o)
+	o.DecrRefCount()
+	return o
+}
+
+func hashTypeGet(o *Gobj, field *Gobj) *Gobj {
+	return o.Val_.(*Dict).Get(field)
+}
+
+// 返回 field 是否为新增
+func hashTypeSet(o *Gobj, field, val *Gobj) bool {
+	d := o.Val_.(*Dict)
+	if d.Add(field, val) == nil {
+		return true
+	}
+	d.Set(field, val)
+	return false
+}
+
+func hashTypeDelete(o *Gobj, field *Gobj) bool {
+	return o.Val_.(*Dict).Delete(field) == nil
+}
+
+func hashTypeLength(o *Gobj) int64 {
+	return o.Val_.(*Dict).Len()
+}
+
+func hashTypeDup(o *Gobj) *Gobj {
+	dst := CreateHashObject()
+	it := o.Val_.(*Dict).GetIterator()
+	for e := it.Next(); e != nil; e = it.Next() {
+		hashTypeSet(dst, e.Key, e.Val)
+	}
+	it.Release()
+	return dst
+}
+
+// HSET key field value [field value ...]
+func hsetCommand(c *GodisClient) {
+	if len(c.args)%2 == 1 {
+		c.AddReplyErrorFormat("wrong number of arguments for '%s' command", c.args[0].StrVal())
+		return
+	}
+	o := hashTypeLookupWriteOrCreate(c, c.args[1])
+	if o == nil {
+		return
+	}
+	var created int64
+	for i := 2; i < len(c.args); i += 2 {
+		if hashTypeSet(o, c.args[i], c.args[i+1]) {
+			created++
+		}
+	}
+	signalModifiedKey(c, c.db, c.args[1])
+	notifyKeyspaceEvent(NOTIFY_HASH, "hset", c.args[1], c.db.id)
+	server.dirty += int64(len(c.args)-2) / 2
+	// HMSET 是旧版本的命令 回复 OK
+	if strings.ToLower(c.args[0].StrVal()) == "hmset" {
+		c.AddReply(shared.ok)
+	} else {
+		c.AddReplyInt(created)
+	}
+}
+
+func hsetnxCommand(c *GodisClient) {
+	o := hashTypeLookupWriteOrCreate(c, c.args[1])
+	if o == nil {
+		return
+	}
+	if hashTypeGet(o, c.args[2]) != nil {
+		c.AddReply(shared.czero)
+		return
+	}
+	hashTypeSet(o, c.args[2], c.args[3])
+	signalModifiedKey(c, c.db, c.args[1])
+	notifyKeyspaceEvent(NOTIFY_HASH, "hset", c.args[1], c.db.id)
+	server.dirty++
+	c.AddReply(shared.cone)
+}
+
+func hgetCommand(c *GodisClient) {
+	o := c.db.lookupKeyReadOrReply(c, c.args[1], nullReply(c))
+	if o == nil || checkType(c, o, GDICT) {
+		return
+	}
+	val := hashTypeGet(o, c.args[2])
+	if val == nil {
+		c.AddReplyNull()
+	} else {
+		c.AddReplyBulk(val)
+	}
+}
+
+func hmgetCommand(c *GodisClient) {
+	o := c.db.lookupKeyRead(c.args[1])
+	if o != nil && checkType(c, o, GDICT) {
+		return
+	}
+	c.AddReplyArrayLen(len(c.args) - 2)
+	for _, field := range c.args[2:] {
+		var val *Gobj
+		if o != nil {
+			val = hashTypeGet(o, field)
+		}
+		if val == nil {
+			c.AddReplyNull()
+		} else {
+			c.AddReplyBulk(val)
+		}
+	}
+}
+
+func hdelCommand(c *GodisClient) {
+	key := c.args[1]
+	o := c.db.lookupKeyWriteOrReply(c, key, shared.czero)
+	if o == nil || checkType(c, o, GDICT) {
+		return
+	}
+	var deleted int64
+	for _, field := range c.args[2:] {
+		if hashTypeDelete(o, field) {
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		signalModifiedKey(c, c.db, key)
+		notifyKeyspaceEvent(NOTIFY_HASH, "hdel", key, c.db.id)
+	}
+	// 最后一个 field 删除后 key 也一并删除
+	if hashTypeLength(o) == 0 {
+		c.db.dbDelete(key)
+		notifyKeyspaceEvent(NOTIFY_GENERIC, "del", key, c.db.id)
+	}
+	server.dirty += deleted
+	c.AddReplyInt(deleted)
+}
+
+func hexistsCommand(c *GodisClient) {
+	o := c.db.lookupKeyReadOrReply(c, c.args[1], shared.czero)
+	if o == nil || checkType(c, o, GDICT) {
+		return
+	}
+	c.AddReplyInt(boolToInt(hashTypeGet(o, c.args[2]) != nil))
+}
+
+func hlenCommand(c *GodisClient) {
+	o := c.db.lookupKeyReadOrReply(c, c.args[1], shared.czero)
+	if o == nil || checkType(c, o, GDICT) {
+		return
+	}
+	c.AddReplyInt(hashTypeLength(o))
+}
+
+func hstrlenCommand(c *GodisClient) {
+	o := c.db.lookupKeyReadOrReply(c, c.args[1], shared.czero)
+	if o == nil || checkType(c, o, GDICT) {
+		return
+	}
+	val := hashTypeGet(o, c.args[2])
+	if val == nil {
+		c.AddReply(shared.czero)
+		return
+	}
+	c.AddReplyInt(int64(len(val.StrVal())))
+}
+
+const (
+	HASH_KEYS = 1 << 0
+	HASH_VALS = 1 << 1
+)
+
+// HKEYS / HVALS / HGETALL
+func genericHgetallCommand(c *GodisClient, flags int) {
+	var empty *Gobj
+	if flags&HASH_KEYS != 0 && flags&HASH_VALS != 0 {
+		empty = emptyMapReply(c)
+	} else {
+		empty = shared.emptyarray
+	}
+	o := c.db.lookupKeyReadOrReply(c, c.args[1], empty)
+	if o == nil || checkType(c, o, GDICT) {
+		return
+	}
+	length := int(hashTypeLength(o))
+	if flags&HASH_KEYS != 0 && flags&HASH_VALS != 0 {
+		c.AddReplyMapLen(length)
+	} else {
+		c.AddReplyArrayLen(length)
+	}
+	it := o.Val_.(*Dict).GetIterator()
+	for e := it.Next(); e != nil; e = it.Next() {
+		if flags&HASH_KEYS != 0 {
+			c.AddReplyBulk(e.Key)
+		}
+		if flags&HASH_VALS != 0 {
+			c.AddReplyBulk(e.Val)
+		}
+	}
+	it.Release()
+}
+
+func hkeysCommand(c *GodisClient) {
+	genericHgetallCommand(c, HASH_KEYS)
+}
+
+func hvalsCommand(c *GodisClient) {
+	genericHgetallCommand(c, HASH_VALS)
+}
+
+func hgetallCommand(c *GodisClient) {
+	genericHgetallCommand(c, HASH_KEYS|HASH_VALS)
+}
+
+func hincrbyCommand(c *GodisClient) {
+	incr, ok := getLongLongFromObjectOrReply(c, c.args[3], "")
+	if !ok {
+		return
+	}
+	o := hashTypeLookupWriteOrCreate(c, c.args[1])
+	if o == nil {
+		return
+	}
+	var value int64
+	if cur := hashTypeGet(o, c.args[2]); cur != nil {
+		v, err := cur.ParseInt()
+		if err != nil {
+			c.AddReplyError("hash value is not an integer")
+			return
+		}
+		value = v
+	}
+	if (incr < 0 && value < 0 && incr < math.MinInt64-value) ||
+		(incr > 0 && value > 0 && incr > math.MaxInt64-value) {
+		c.AddReplyError("increment or decrement would overflow")
+		return
+	}
+	value += incr
+	newObj := CreateFromInt(value)
+	hashTypeSet(o, c.args[2], newObj)
+	newObj.DecrRefCount()
+	signalModifiedKey(c, c.db, c.args[1])
+	notifyKeyspaceEvent(NOTIFY_HASH, "hincrby", c.args[1], c.db.id)
+	server.dirty++
+	c.AddReplyInt(value)
+}
+
+func hincrbyfloatCommand(c *GodisClient) {
+	incr, ok := getDoubleFromObjectOrReply(c, c.args[3], "")
+	if !ok {
+		return
+	}
+	if math.IsInf(incr, 0) {
+		c.AddReplyError("value is NaN or Infinity")
+		return
+	}
+	o := hashTypeLookupWriteOrCreate(c, c.args[1])
+	if o == nil {
+		return
+	}
+	var value float64
+	if cur := hashTypeGet(o, c.args[2]); cur != nil {
+		v, err := cur.ParseFloat()
+		if err != nil {
+			c.AddReplyError("hash value is not a float")
+			return
+		}
+		value = v
+	}
+	value += incr
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		c.AddReplyError("increment would produce NaN or Infinity")
+		return
+	}
+	newObj := CreateObject(GSTR, formatHumanFloat(value))
+	hashTypeSet(o, c.args[2], newObj)
+	c.AddReplyBulk(newObj)
+	newObj.DecrRefCount()
+	signalModifiedKey(c, c.db, c.args[1])
+	notifyKeyspaceEvent(NOTIFY_HASH, "hincrbyfloat", c.args[1], c.db.id)
+	server.dirty++
+}
+
+// HRANDFIELD key [count [WITHVALUES]]
+func hrandfieldCommand(c *GodisClient) {
+	if len(c.args) > 4 || (len(c.args) == 4 && strings.ToLower(c.args[3].StrVal()) != "withvalues") {
+		c.AddReply(shared.syntaxerr)
+		return
+	}
+	if len(c.args) == 2 {
+		o := c.db.lookupKeyReadOrReply(c, c.args[1], nullReply(c))
+		if o == nil || checkType(c, o, GDICT) {
+			return
+		}
+		c.AddReplyBulk(o.Val_.(*Dict).RandomGet().Key)
+		return
+	}
+	count, ok := getLongLongFromObjectOrReply(c, c.args[2], "")
+	if !ok {
+		return
+	}
+	// 负数取反可能溢出 也不可能回复这么多元素
+	if count <= -math.MaxInt64/2 || count >= math.MaxInt64/2 {
+		c.AddReplyError("value is out of range")
+		return
+	}
+	withvalues := len(c.args) == 4
+	o := c.db.lookupKeyReadOrReply(c, c.args[1], shared.emptyarray)
+	if o == nil || checkType(c, o, GDICT) {
+		return
+	}
+	d := o.Val_.(*Dict)
+	// RESP3 下 WITHVALUES 返回 [field, value] 组成的数组
+	addPair := func(e *Entry) {
+		if withvalues && c.resp >= 3 {
+			c.AddReplyArrayLen(2)
+		}
+		c.AddReplyBulk(e.Key)
+		if withvalues {
+			c.AddReplyBulk(e.Val)
+		}
+	}
+	replyLen := func(n int64) {
+		if withvalues && c.resp < 3 {
+			c.AddReplyArrayLen(int(n * 2))
+		} else {
+			c.AddReplyArrayLen(int(n))
+		}
+	}
+	// count 为负数时允许重复
+	if count < 0 {
+		replyLen(-count)
+		for i := int64(0); i < -count; i++ {
+			addPair(d.RandomGet())
+		}
+		return
+	}
+	entries := d.RandomEntries(count)
+	replyLen(int64(len(entries)))
+	for _, e := range entries {
+		addPair(e)
+	}
+}
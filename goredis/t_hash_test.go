@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestHashCommands(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	expectReply(t, c, ":2\r\n", "hset", "h", "a", "1", "b", "2")
+	expectReply(t, c, ":0\r\n", "hset", "h", "a", "10")
+	expectReply(t, c, "$2\r\n10\r\n", "hget", "h", "a")
+	expectReply(t, c, "$-1\r\n", "hget", "h", "nosuch")
+	expectReply(t, c, "*3\r\n$2\r\n10\r\n$-1\r\n$1\r\n2\r\n", "hmget", "h", "a", "c", "b")
+	expectReply(t, c, ":0\r\n", "hsetnx", "h", "a", "x")
+	expectReply(t, c, ":1\r\n", "hsetnx", "h", "c", "hello")
+	expectReply(t, c, ":5\r\n", "hstrlen", "h", "c")
+	expectReply(t, c, ":3\r\n", "hlen", "h")
+	expectReply(t, c, ":1\r\n", "hexists", "h", "b")
+	expectReply(t, c, ":15\r\n", "hincrby", "h", "a", "5")
+	expectReply(t, c, "-ERR hash value is not an integer\r\n", "hincrby", "h", "c", "1")
+	expectReply(t, c, "-ERR increment or decrement would overflow\r\n", "hincrby", "h", "a", "9223372036854775800")
+	expectReply(t, c, "$4\r\n15.5\r\n", "hincrbyfloat", "h", "a", "0.5")
+	expectReply(t, c, ":2\r\n", "hdel", "h", "a", "b", "nosuch")
+	expectReply(t, c, "*2\r\n$1\r\nc\r\n$5\r\nhello\r\n", "hgetall", "h")
+	expectReply(t, c, ":1\r\n", "hdel", "h", "c")
+	expectReply(t, c, ":0\r\n", "hlen", "h")
+	expectReply(t, c, "*0\r\n", "hkeys", "h")
+	expectReply(t, c, "-ERR wrong number of arguments for 'hset' command\r\n", "hset", "h", "a", "1", "b")
+}
+
+// field 足够多时会触发 rehash
+func TestHashRehashAndRandField(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	args := []string{"hset", "big"}
+	for i := 0; i < 200; i++ {
+		args = append(args, "f"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+	expectReply(t, c, ":200\r\n", args...)
+	for i := 0; i < 200; i += 37 {
+		expectReply(t, c, "$"+strconv.Itoa(len(strconv.Itoa(i)))+"\r\n"+strconv.Itoa(i)+"\r\n", "hget", "big", "f"+strconv.Itoa(i))
+	}
+	if reply := c.run("hkeys", "big"); !strings.HasPrefix(reply, "*200\r\n") || strings.Count(reply, "$") != 200 {
+		t.Errorf("unexpected hkeys reply %q", reply)
+	}
+	for _, count := range []string{"5", "150", "300"} {
+		reply := c.run("hrandfield", "big", count)
+		n, _ := strconv.Atoi(count)
+		if n > 200 {
+			n = 200
+		}
+		seen := map[string]bool{}
+		lines := strings.Split(reply, "\r\n")
+		for i := 2; i < len(lines); i += 2 {
+			seen[lines[i]] = true
+		}
+		if !strings.HasPrefix(reply, "*"+strconv.Itoa(n)+"\r\n") || len(seen) != n {
+			t.Errorf("hrandfield %s: expect %d distinct fields, got %d", count, n, len(seen))
+		}
+	}
+	if reply := c.run("hrandfield", "big", "-3", "withvalues"); !strings.HasPrefix(reply, "*6\r\n") {
+		t.Errorf("unexpected hrandfield reply %q", reply)
+	}
+	expectReply(t, c, "-ERR value is out of range\r\n", "hrandfield", "big", "-9223372036854775808")
+}
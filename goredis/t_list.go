@@ -0,0 +1,545 @@
+package main
+
+import (
+	"math"
+	"strings"
+)
+
+// push / pop 的方向
+const (
+	LIST_HEAD = 0
+	LIST_TAIL = 1
+)
+
+func listTypePush(o *Gobj, val *Gobj, where int) {
+	list := o.Val_.(*List)
+	if where == LIST_HEAD {
+		list.LPush(val)
+	} else {
+		list.Append(val)
+	}
+	val.IncrRefCount()
+}
+
+// 返回的对象由调用方负责 DecrRefCount
+func listTypePop(o *Gobj, where int) *Gobj {
+	list := o.Val_.(*List)
+	var n *Node
+	if where == LIST_HEAD {
+		n = list.First()
+	} else {
+		n = list.Last()
+	}
+	if n == nil {
+		return nil
+	}
+	list.DelNode(n)
+	return n.Val
+}
+
+func listTypeLength(o *Gobj) int {
+	return o.Val_.(*List).Length()
+}
+
+// COPY 使用 元素对象是只读的 可以直接共享
+func listTypeDup(o *Gobj) *Gobj {
+	dst := CreateListObject()
+	for n := o.Val_.(*List).First(); n != nil; n = n.Next() {
+		listTypePush(dst, n.Val, LIST_TAIL)
+	}
+	return dst
+}
+
+// 解析 LEFT / RIGHT
+func getListPosition(o *Gobj) (int, bool) {
+	switch strings.ToLower(o.StrVal()) {
+	case "left":
+		return LIST_HEAD, true
+	case "right":
+		return LIST_TAIL, true
+	}
+	return 0, false
+}
+
+func listPositionName(where int) string {
+	if where == LIST_HEAD {
+		return "LEFT"
+	}
+	return "RIGHT"
+}
+
+// 键空间通知的事件名 比如 lpush rpop
+func listEventName(op string, where int) string {
+	if where == LIST_HEAD {
+		return "l" + op
+	}
+	return "r" + op
+}
+
+// LPUSH / RPUSH / LPUSHX / RPUSHX
+func pushGenericCommand(c *GodisClient, where int, xx bool) {
+	key := c.args[1]
+	o := c.db.lookupKeyWrite(key)
+	if o != nil && checkType(c, o, GLIST) {
+		return
+	}
+	if o == nil {
+		// *X 系列只对已存在的 list 生效
+		if xx {
+			c.AddReply(shared.czero)
+			return
+		}
+		o = CreateListObject()
+		c.db.dbAdd(key, o)
+		o.DecrRefCount()
+	}
+	for _, val := range c.args[2:] {
+		listTypePush(o, val, where)
+	}
+	signalModifiedKey(c, c.db, key)
+	notifyKeyspaceEvent(NOTIFY_LIST, listEventName("push", where), key, c.db.id)
+	server.dirty += int64(len(c.args) - 2)
+	c.AddReplyInt(int64(listTypeLength(o)))
+}
+
+func lpushCommand(c *GodisClient) {
+	pushGenericCommand(c, LIST_HEAD, false)
+}
+
+func rpushCommand(c *GodisClient) {
+	pushGenericCommand(c, LIST_TAIL, false)
+}
+
+func lpushxCommand(c *GodisClient) {
+	pushGenericCommand(c, LIST_HEAD, true)
+}
+
+func rpushxCommand(c *GodisClient) {
+	pushGenericCommand(c, LIST_TAIL, true)
+}
+
+// LPOP / RPOP key [count]
+func popGenericCommand(c *GodisClient, where int) {
+	if len(c.args) > 3 {
+		c.AddReplyErrorFormat("wrong number of arguments for '%s' command", c.args[0].StrVal())
+		return
+	}
+	hasCount := len(c.args) == 3
+	var count int64
+	if hasCount {
+		var ok bool
+		if count, ok = getPositiveLongFromObjectOrReply(c, c.args[2], ""); !ok {
+			return
+		}
+	}
+	key := c.args[1]
+	o := c.db.lookupKeyWrite(key)
+	if o == nil {
+		if hasCount {
+			c.AddReplyNullArray()
+		} else {
+			c.AddReplyNull()
+		}
+		return
+	}
+	if checkType(c, o, GLIST) {
+		return
+	}
+	// count 为 0 时不修改列表 不触发事件也不传播
+	if hasCount && count == 0 {
+		c.AddReply(shared.emptyarray)
+		return
+	}
+	if !hasCount {
+		val := listTypePop(o, where)
+		c.AddReplyBulk(val)
+		val.DecrRefCount()
+	} else {
+		n := int(count)
+		if n > listTypeLength(o) {
+			n = listTypeLength(o)
+		}
+		c.AddReplyArrayLen(n)
+		for i := 0; i < n; i++ {
+			val := listTypePop(o, where)
+			c.AddReplyBulk(val)
+			val.DecrRefCount()
+		}
+	}
+	notifyKeyspaceEvent(NOTIFY_LIST, listEventName("pop", where), key, c.db.id)
+	if listTypeLength(o) == 0 {
+		c.db.dbDelete(key)
+		notifyKeyspaceEvent(NOTIFY_GENERIC, "del", key, c.db.id)
+	}
+	signalModifiedKey(c, c.db, key)
+	server.dirty++
+}
+
+func lpopCommand(c *GodisClient) {
+	popGenericCommand(c, LIST_HEAD)
+}
+
+func rpopCommand(c *GodisClient) {
+	popGenericCommand(c, LIST_TAIL)
+}
+
+func llenCommand(c *GodisClient) {
+	o := c.db.lookupKeyReadOrReply(c, c.args[1], shared.czero)
+	if o == nil || checkType(c, o, GLIST) {
+		return
+	}
+	c.AddReplyInt(int64(listTypeLength(o)))
+}
+
+func lindexCommand(c *GodisClient) {
+	o := c.db.lookupKeyRead(c.args[1])
+	if o == nil {
+		c.AddReplyNull()
+		return
+	}
+	if checkType(c, o, GLIST) {
+		return
+	}
+	index, ok := getLongLongFromObjectOrReply(c, c.args[2], "")
+	if !ok {
+		return
+	}
+	n := o.Val_.(*List).Index(int(index))
+	if n == nil {
+		c.AddReplyNull()
+	} else {
+		c.AddReplyBulk(n.Val)
+	}
+}
+
+func lsetCommand(c *GodisClient) {
+	o := c.db.lookupKeyWriteOrReply(c, c.args[1], shared.nokeyerr)
+	if o == nil || checkType(c, o, GLIST) {
+		return
+	}
+	index, ok := getLongLongFromObjectOrReply(c, c.args[2], "")
+	if !ok {
+		return
+	}
+	n := o.Val_.(*List).Index(int(index))
+	if n == nil {
+		c.AddReply(shared.outofrangeerr)
+		return
+	}
+	n.Val.DecrRefCount()
+	n.Val = c.args[3]
+	n.Val.IncrRefCount()
+	signalModifiedKey(c, c.db, c.args[1])
+	notifyKeyspaceEvent(NOTIFY_LIST, "lset", c.args[1], c.db.id)
+	server.dirty++
+	c.AddReply(shared.ok)
+}
+
+// 把 start end 转换成 [0, llen) 内的下标 区间为空时返回 false
+func normalizeRange(start, end, llen int64) (int64, int64, bool) {
+	if start < 0 {
+		start = llen + start
+	}
+	if end < 0 {
+		end = llen + end
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start > end || start >= llen {
+		return 0, 0, false
+	}
+	if end >= llen {
+		end = llen - 1
+	}
+	return start, end, true
+}
+
+func lrangeCommand(c *GodisClient) {
+	start, ok := getLongLongFromObjectOrReply(c, c.args[2], "")
+	if !ok {
+		return
+	}
+	end, ok := getLongLongFromObjectOrReply(c, c.args[3], "")
+	if !ok {
+		return
+	}
+	o := c.db.lookupKeyReadOrReply(c, c.args[1], shared.emptyarray)
+	if o == nil || checkType(c, o, GLIST) {
+		return
+	}
+	list := o.Val_.(*List)
+	start, end, ok = normalizeRange(start, end, int64(list.Length()))
+	if !ok {
+		c.AddReply(shared.emptyarray)
+		return
+	}
+	c.AddReplyArrayLen(int(end - start + 1))
+	n := list.Index(int(start))
+	for i := start; i <= end; i++ {
+		c.AddReplyBulk(n.Val)
+		n = n.next
+	}
+}
+
+func ltrimCommand(c *GodisClient) {
+	start, ok := getLongLongFromObjectOrReply(c, c.args[2], "")
+	if !ok {
+		return
+	}
+	end, ok := getLongLongFromObjectOrReply(c, c.args[3], "")
+	if !ok {
+		return
+	}
+	key := c.args[1]
+	o := c.db.lookupKeyWriteOrReply(c, key, shared.ok)
+	if o == nil || checkType(c, o, GLIST) {
+		return
+	}
+	list := o.Val_.(*List)
+	llen := int64(list.Length())
+	// 分别需要从头部和尾部删除的元素个数
+	var ltrim, rtrim int64
+	if start, end, ok = normalizeRange(start, end, llen); ok {
+		ltrim = start
+		rtrim = llen - end - 1
+	} else {
+		ltrim = llen
+		rtrim = 0
+	}
+	for i := int64(0); i < ltrim; i++ {
+		listTypePop(o, LIST_HEAD).DecrRefCount()
+	}
+	for i := int64(0); i < rtrim; i++ {
+		listTypePop(o, LIST_TAIL).DecrRefCount()
+	}
+	if ltrim+rtrim > 0 {
+		signalModifiedKey(c, c.db, key)
+		notifyKeyspaceEvent(NOTIFY_LIST, "ltrim", key, c.db.id)
+	}
+	if list.Length() == 0 {
+		c.db.dbDelete(key)
+		notifyKeyspaceEvent(NOTIFY_GENERIC, "del", key, c.db.id)
+	}
+	server.dirty += ltrim + rtrim
+	c.AddReply(shared.ok)
+}
+
+// LREM key count element
+func lremCommand(c *GodisClient) {
+	toremove, ok := getLongLongFromObjectOrReply(c, c.args[2], "")
+	if !ok {
+		return
+	}
+	key := c.args[1]
+	o := c.db.lookupKeyWriteOrReply(c, key, shared.czero)
+	if o == nil || checkType(c, o, GLIST) {
+		return
+	}
+	list := o.Val_.(*List)
+	elem := c.args[3]
+	var removed int64
+	// count 为负数时从尾部开始删除
+	n, fromTail := list.First(), toremove < 0
+	if fromTail {
+		toremove = -toremove
+		n = list.Last()
+	}
+	for n != nil {
+		next := n.next
+		if fromTail {
+			next = n.prev
+		}
+		if list.EqualFunc(n.Val, elem) {
+			list.DelNode(n)
+			n.Val.DecrRefCount()
+			removed++
+			if toremove != 0 && removed == toremove {
+				break
+			}
+		}
+		n = next
+	}
+	if removed > 0 {
+		signalModifiedKey(c, c.db, key)
+		notifyKeyspaceEvent(NOTIFY_LIST, "lrem", key, c.db.id)
+	}
+	if list.Length() == 0 {
+		c.db.dbDelete(key)
+		notifyKeyspaceEvent(NOTIFY_GENERIC, "del", key, c.db.id)
+	}
+	server.dirty += removed
+	c.AddReplyInt(removed)
+}
+
+// LINSERT key BEFORE|AFTER pivot element
+func linsertCommand(c *GodisClient) {
+	var after bool
+	switch strings.ToLower(c.args[2].StrVal()) {
+	case "after":
+		after = true
+	case "before":
+		after = false
+	default:
+		c.AddReply(shared.syntaxerr)
+		return
+	}
+	o := c.db.lookupKeyWriteOrReply(c, c.args[1], shared.czero)
+	if o == nil || checkType(c, o, GLIST) {
+		return
+	}
+	list := o.Val_.(*List)
+	pivot := list.Find(c.args[3])
+	if pivot == nil {
+		c.AddReply(shared.cnegone)
+		return
+	}
+	list.InsertNode(pivot, c.args[4], after)
+	c.args[4].IncrRefCount()
+	signalModifiedKey(c, c.db, c.args[1])
+	notifyKeyspaceEvent(NOTIFY_LIST, "linsert", c.args[1], c.db.id)
+	server.dirty++
+	c.AddReplyInt(int64(list.Length()))
+}
+
+// LPOS key element [RANK rank] [COUNT num-matches] [MAXLEN len]
+func lposCommand(c *GodisClient) {
+	var rank, count, maxlen int64 = 1, -1, 0
+	for i := 3; i < len(c.args); i++ {
+		opt := strings.ToLower(c.args[i].StrVal())
+		if i+1 >= len(c.args) {
+			c.AddReply(shared.syntaxerr)
+			return
+		}
+		var ok bool
+		switch opt {
+		case "rank":
+			if rank, ok = getLongLongFromObjectOrReply(c, c.args[i+1], ""); !ok {
+				return
+			}
+			// 取反会溢出
+			if rank == math.MinInt64 {
+				c.AddReplyError("value is out of range")
+				return
+			}
+			if rank == 0 {
+				c.AddReplyError("RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the end of the list")
+				return
+			}
+		case "count":
+			if count, ok = getPositiveLongFromObjectOrReply(c, c.args[i+1], "COUNT can't be negative"); !ok {
+				return
+			}
+		case "maxlen":
+			if maxlen, ok = getPositiveLongFromObjectOrReply(c, c.args[i+1], "MAXLEN can't be negative"); !ok {
+				return
+			}
+		default:
+			c.AddReply(shared.syntaxerr)
+			return
+		}
+		i++
+	}
+	o := c.db.lookupKeyRead(c.args[1])
+	if o != nil && checkType(c, o, GLIST) {
+		return
+	}
+	if o == nil {
+		if count != -1 {
+			c.AddReply(shared.emptyarray)
+		} else {
+			c.AddReplyNull()
+		}
+		return
+	}
+	list := o.Val_.(*List)
+	// rank 为负数时从尾部开始查找 下标仍然从头部开始计算
+	n, index, step := list.First(), int64(0), int64(1)
+	if rank < 0 {
+		rank = -rank
+		n, index, step = list.Last(), int64(list.Length()-1), -1
+	}
+	var matches []int64
+	for checked := int64(0); n != nil && (maxlen == 0 || checked < maxlen); checked++ {
+		if list.EqualFunc(n.Val, c.args[2]) {
+			rank--
+			if rank <= 0 {
+				matches = append(matches, index)
+				// 没有 COUNT 时只需要第一个 COUNT 0 表示返回全部
+				if count == -1 || (count > 0 && int64(len(matches)) >= count) {
+					break
+				}
+			}
+		}
+		index += step
+		if step > 0 {
+			n = n.next
+		} else {
+			n = n.prev
+		}
+	}
+	if count == -1 {
+		if len(matches) == 0 {
+			c.AddReplyNull()
+		} else {
+			c.AddReplyInt(matches[0])
+		}
+		return
+	}
+	c.AddReplyArrayLen(len(matches))
+	for _, m := range matches {
+		c.AddReplyInt(m)
+	}
+}
+
+func lmoveGenericCommand(c *GodisClient, wherefrom, whereto int) {
+	src := c.args[1]
+	sobj := c.db.lookupKeyWrite(src)
+	if sobj == nil {
+		c.AddReplyNull()
+		return
+	}
+	if checkType(c, sobj, GLIST) {
+		return
+	}
+	// 在弹出之前先检查目标 key 的类型
+	dst := c.args[2]
+	dobj := c.db.lookupKeyWrite(dst)
+	if dobj != nil && checkType(c, dobj, GLIST) {
+		return
+	}
+	val := listTypePop(sobj, wherefrom)
+	if dobj == nil {
+		dobj = CreateListObject()
+		c.db.dbAdd(dst, dobj)
+		dobj.DecrRefCount()
+	}
+	listTypePush(dobj, val, whereto)
+	c.AddReplyBulk(val)
+	val.DecrRefCount()
+	notifyKeyspaceEvent(NOTIFY_LIST, listEventName("pop", wherefrom), src, c.db.id)
+	notifyKeyspaceEvent(NOTIFY_LIST, listEventName("push", whereto), dst, c.db.id)
+	// src 和 dst 相同时 list 不会为空
+	if listTypeLength(sobj) == 0 {
+		c.db.dbDelete(src)
+		notifyKeyspaceEvent(NOTIFY_GENERIC, "del", src, c.db.id)
+	}
+	signalModifiedKey(c, c.db, src)
+	signalModifiedKey(c, c.db, dst)
+	server.dirty++
+}
+
+// LMOVE source destination LEFT|RIGHT LEFT|RIGHT
+func lmoveCommand(c *GodisClient) {
+	wherefrom, ok1 := getListPosition(c.args[3])
+	whereto, ok2 := getListPosition(c.args[4])
+	if !ok1 || !ok2 {
+		c.AddReply(shared.syntaxerr)
+		return
+	}
+	lmoveGenericCommand(c, wherefrom, whereto)
+}
+
+func rpoplpushCommand(c *GodisClient) {
+	lmoveGenericCommand(c, LIST_TAIL, LIST_HEAD)
+}
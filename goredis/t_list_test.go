@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+func TestListCommands(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	expectReply(t, c, ":0\r\n", "lpushx", "l", "a")
+	expectReply(t, c, ":3\r\n", "rpush", "l", "a", "b", "c")
+	expectReply(t, c, ":4\r\n", "lpush", "l", "z")
+	expectReply(t, c, "*4\r\n$1\r\nz\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n", "lrange", "l", "0", "-1")
+	expectReply(t, c, "$1\r\nc\r\n", "lindex", "l", "-1")
+	expectReply(t, c, "$-1\r\n", "lindex", "l", "10")
+	expectReply(t, c, "+OK\r\n", "lset", "l", "1", "x")
+	expectReply(t, c, "-ERR index out of range\r\n", "lset", "l", "9", "x")
+	expectReply(t, c, ":5\r\n", "linsert", "l", "before", "b", "y")
+	expectReply(t, c, ":-1\r\n", "linsert", "l", "after", "nosuch", "y")
+	expectReply(t, c, "*2\r\n$1\r\nz\r\n$1\r\nx\r\n", "lpop", "l", "2")
+	expectReply(t, c, "$1\r\nc\r\n", "rpop", "l")
+	expectReply(t, c, ":2\r\n", "llen", "l")
+	expectReply(t, c, "*2\r\n$1\r\ny\r\n$1\r\nb\r\n", "lrange", "l", "-100", "100")
+	expectReply(t, c, "*0\r\n", "lrange", "l", "5", "10")
+	expectReply(t, c, "*-1\r\n", "lpop", "nosuch", "2")
+	dirty := server.dirty
+	expectReply(t, c, "*0\r\n", "rpop", "l", "0")
+	if server.dirty != dirty {
+		t.Errorf("pop with zero count should not modify the dataset")
+	}
+	c.run("set", "str", "v")
+	expectReply(t, c, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n", "lpush", "str", "a")
+}
+
+func TestListRemTrimPos(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	c.run("set", "str", "v")
+	expectReply(t, c, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n", "llen", "str")
+	expectReply(t, c, ":7\r\n", "rpush", "l", "a", "b", "a", "c", "a", "b", "a")
+	expectReply(t, c, ":0\r\n", "lpos", "l", "a")
+	expectReply(t, c, ":4\r\n", "lpos", "l", "a", "rank", "3")
+	expectReply(t, c, ":4\r\n", "lpos", "l", "a", "rank", "-2")
+	expectReply(t, c, "*4\r\n:0\r\n:2\r\n:4\r\n:6\r\n", "lpos", "l", "a", "count", "0")
+	expectReply(t, c, "*1\r\n:0\r\n", "lpos", "l", "a", "count", "0", "maxlen", "2")
+	expectReply(t, c, "$-1\r\n", "lpos", "l", "x")
+	expectReply(t, c, "-ERR value is out of range\r\n", "lpos", "l", "a", "rank", "-9223372036854775808")
+	expectReply(t, c, ":2\r\n", "lrem", "l", "-2", "a")
+	expectReply(t, c, "*5\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\na\r\n$1\r\nc\r\n$1\r\nb\r\n", "lrange", "l", "0", "-1")
+	expectReply(t, c, ":2\r\n", "lrem", "l", "0", "a")
+	expectReply(t, c, "+OK\r\n", "ltrim", "l", "1", "-1")
+	expectReply(t, c, "*2\r\n$1\r\nc\r\n$1\r\nb\r\n", "lrange", "l", "0", "-1")
+	expectReply(t, c, "+OK\r\n", "ltrim", "l", "5", "1")
+	expectReply(t, c, ":0\r\n", "llen", "l")
+}
+
+func TestListMove(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	c.run("rpush", "src", "a", "b")
+	expectReply(t, c, "$1\r\nb\r\n", "rpoplpush", "src", "dst")
+	expectReply(t, c, "$1\r\na\r\n", "lmove", "src", "dst", "left", "right")
+	expectReply(t, c, ":0\r\n", "llen", "src")
+	expectReply(t, c, "*2\r\n$1\r\nb\r\n$1\r\na\r\n", "lrange", "dst", "0", "-1")
+	// 同一个 key 相当于旋转
+	expectReply(t, c, "$1\r\na\r\n", "lmove", "dst", "dst", "right", "left")
+	expectReply(t, c, "*2\r\n$1\r\na\r\n$1\r\nb\r\n", "lrange", "dst", "0", "-1")
+	expectReply(t, c, "$-1\r\n", "rpoplpush", "src", "dst")
+	expectReply(t, c, "-ERR syntax error\r\n", "lmove", "dst", "x", "up", "left")
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// set 使用 val 为 nil 的 Dict
+func CreateSetObject() *Gobj {
+	return CreateObject(GSET, DictCreate(DictType{HashFunc: GStrHash, EqualFunc: GStrEqual}))
+}
+
+func setTypeAdd(o *Gobj, member *Gobj) bool {
+	return o.Val_.(*Dict).Add(member, nil) == nil
+}
+
+func setTypeRemove(o *Gobj, member *Gobj) bool {
+	return o.Val_.(*Dict).Delete(member) == nil
+}
+
+func setTypeIsMember(o *Gobj, member *Gobj) bool {
+	return o.Val_.(*Dict).Find(member) != nil
+}
+
+func setTypeSize(o *Gobj) int64 {
+	return o.Val_.(*Dict).Len()
+}
+
+func setTypeDup(o *Gobj) *Gobj {
+	dst := CreateSetObject()
+	it := o.Val_.(*Dict).GetIterator()
+	for e := it.Next(); e != nil; e = it.Next() {
+		setTypeAdd(dst, e.Key)
+	}
+	it.Release()
+	return dst
+}
+
+func saddCommand(c *GodisClient) {
+	key := c.args[1]
+	o := c.db.lookupKeyWrite(key)
+	if o != nil && checkType(c, o, GSET) {
+		return
+	}
+	if o == nil {
+		o = CreateSetObject()
+		c.db.dbAdd(key, o)
+		o.DecrRefCount()
+	}
+	var added int64
+	for _, member := range c.args[2:] {
+		if setTypeAdd(o, member) {
+			added++
+		}
+	}
+	if added > 0 {
+		signalModifiedKey(c, c.db, key)
+		notifyKeyspaceEvent(NOTIFY_SET, "sadd", key, c.db.id)
+	}
+	server.dirty += added
+	c.AddReplyInt(added)
+}
+
+func sremCommand(c *GodisClient) {
+	key := c.args[1]
+	o := c.db.lookupKeyWriteOrReply(c, key, shared.czero)
+	if o == nil || checkType(c, o, GSET) {
+		return
+	}
+	var deleted int64
+	for _, member := range c.args[2:] {
+		if setTypeRemove(o, member) {
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		signalModifiedKey(c, c.db, key)
+		notifyKeyspaceEvent(NOTIFY_SET, "srem", key, c.db.id)
+	}
+	if setTypeSize(o) == 0 {
+		c.db.dbDelete(key)
+		notifyKeyspaceEvent(NOTIFY_GENERIC, "del", key, c.db.id)
+	}
+	server.dirty += deleted
+	c.AddReplyInt(deleted)
+}
+
+func sismemberCommand(c *GodisClient) {
+	o := c.db.lookupKeyReadOrReply(c, c.args[1], shared.czero)
+	if o == nil || checkType(c, o, GSET) {
+		return
+	}
+	c.AddReplyInt(boolToInt(setTypeIsMember(o, c.args[2])))
+}
+
+func smismemberCommand(c *GodisClient) {
+	o := c.db.lookupKeyRead(c.args[1])
+	if o != nil && checkType(c, o, GSET) {
+		return
+	}
+	c.AddReplyArrayLen(len(c.args) - 2)
+	for _, member := range c.args[2:] {
+		c.AddReplyInt(boolToInt(o != nil && setTypeIsMember(o, member)))
+	}
+}
+
+func scardCommand(c *GodisClient) {
+	o := c.db.lookupKeyReadOrReply(c, c.args[1], shared.czero)
+	if o == nil || checkType(c, o, GSET) {
+		return
+	}
+	c.AddReplyInt(setTypeSize(o))
+}
+
+func addReplySetMembers(c *GodisClient, o *Gobj) {
+	c.AddReplySetLen(int(setTypeSize(o)))
+	it := o.Val_.(*Dict).GetIterator()
+	for e := it.Next(); e != nil; e = it.Next() {
+		c.AddReplyBulk(e.Key)
+	}
+	it.Release()
+}
+
+func smembersCommand(c *GodisClient) {
+	o := c.db.lookupKeyReadOrReply(c, c.args[1], emptySetReply(c))
+	if o == nil || checkType(c, o, GSET) {
+		return
+	}
+	addReplySetMembers(c, o)
+}
+
+// SRANDMEMBER key [count] count 为负数时允许重复
+func srandmemberCommand(c *GodisClient) {
+	if len(c.args) > 3 {
+		c.AddReply(shared.syntaxerr)
+		return
+	}
+	if len(c.args) == 2 {
+		o := c.db.lookupKeyReadOrReply(c, c.args[1], nullReply(c))
+		if o == nil || checkType(c, o, GSET) {
+			return
+		}
+		c.AddReplyBulk(o.Val_.(*Dict).RandomGet().Key)
+		return
+	}
+	count, ok := getLongLongFromObjectOrReply(c, c.args[2], "")
+	if !ok {
+		return
+	}
+	// 负数取反可能溢出 也不可能回复这么多元素
+	if count <= -math.MaxInt64/2 || count >= math.MaxInt64/2 {
+		c.AddReplyError("value is out of range")
+		return
+	}
+	o := c.db.lookupKeyReadOrReply(c, c.args[1], shared.emptyarray)
+	if o == nil || checkType(c, o, GSET) {
+		return
+	}
+	d := o.Val_.(*Dict)
+	if count < 0 {
+		c.AddReplyArrayLen(int(-count))
+		for i := int64(0); i < -count; i++ {
+			c.AddReplyBulk(d.RandomGet().Key)
+		}
+		return
+	}
+	entries := d.RandomEntries(count)
+	c.AddReplyArrayLen(len(entries))
+	for _, e := range entries {
+		c.AddReplyBulk(e.Key)
+	}
+}
+
+// SPOP key [count]
+func spopCommand(c *GodisClient) {
+	if len(c.args) > 3 {
+		c.AddReply(shared.syntaxerr)
+		return
+	}
+	key := c.args[1]
+	if len(c.args) == 2 {
+		o := c.db.lookupKeyWriteOrReply(c, key, nullReply(c))
+		if o == nil || checkType(c, o, GSET) {
+			return
+		}
+		member := o.Val_.(*Dict).RandomGet().Key
+		member.IncrRefCount()
+		setTypeRemove(o, member)
+		c.AddReplyBulk(member)
+		notifyKeyspaceEvent(NOTIFY_SET, "spop", key, c.db.id)
+		if setTypeSize(o) == 0 {
+			c.db.dbDelete(key)
+			notifyKeyspaceEvent(NOTIFY_GENERIC, "del", key, c.db.id)
+		}
+		signalModifiedKey(c, c.db, key)
+		server.dirty++
+		// 随机的结果以 SREM 传播
+		rewriteClientCommandVector(c, "SREM", key.StrVal(), member.StrVal())
+		member.DecrRefCount()
+		return
+	}
+	count, ok := getPositiveLongFromObjectOrReply(c, c.args[2], "")
+	if !ok {
+		return
+	}
+	o := c.db.lookupKeyWriteOrReply(c, key, emptySetReply(c))
+	if o == nil || checkType(c, o, GSET) {
+		return
+	}
+	// 不弹出任何元素 不算修改
+	if count == 0 {
+		c.AddReply(emptySetReply(c))
+		return
+	}
+	// 全部弹出时直接删除 key
+	if count >= setTypeSize(o) {
+		addReplySetMembers(c, o)
+		signalModifiedKey(c, c.db, key)
+		server.dirty += setTypeSize(o)
+		c.db.dbDelete(key)
+		notifyKeyspaceEvent(NOTIFY_SET, "spop", key, c.db.id)
+		notifyKeyspaceEvent(NOTIFY_GENERIC, "del", key, c.db.id)
+		rewriteClientCommandVector(c, "DEL", key.StrVal())
+		return
+	}
+	entries := o.Val_.(*Dict).RandomEntries(count)
+	c.AddReplySetLen(len(entries))
+	args := []string{"SREM", key.StrVal()}
+	for _, e := range entries {
+		member := e.Key
+		member.IncrRefCount()
+		setTypeRemove(o, member)
+		c.AddReplyBulk(member)
+		args = append(args, member.StrVal())
+		member.DecrRefCount()
+	}
+	signalModifiedKey(c, c.db, key)
+	notifyKeyspaceEvent(NOTIFY_SET, "spop", key, c.db.id)
+	server.dirty += count
+	rewriteClientCommandVector(c, args...)
+}
+
+// SMOVE source destination member
+func smoveCommand(c *GodisClient) {
+	src, dst, member := c.args[1], c.args[2], c.args[3]
+	srcset := c.db.lookupKeyWrite(src)
+	dstset := c.db.lookupKeyWrite(dst)
+	if srcset == nil {
+		c.AddReply(shared.czero)
+		return
+	}
+	if checkType(c, srcset, GSET) || (dstset != nil && checkType(c, dstset, GSET)) {
+		return
+	}
+	// 源和目标相同时不做修改
+	if srcset == dstset {
+		c.AddReplyInt(boolToInt(setTypeIsMember(srcset, member)))
+		return
+	}
+	if !setTypeRemove(srcset, member) {
+		c.AddReply(shared.czero)
+		return
+	}
+	notifyKeyspaceEvent(NOTIFY_SET, "srem", src, c.db.id)
+	if setTypeSize(srcset) == 0 {
+		c.db.dbDelete(src)
+		notifyKeyspaceEvent(NOTIFY_GENERIC, "del", src, c.db.id)
+	}
+	if dstset == nil {
+		dstset = CreateSetObject()
+		c.db.dbAdd(dst, dstset)
+		dstset.DecrRefCount()
+	}
+	setTypeAdd(dstset, member)
+	notifyKeyspaceEvent(NOTIFY_SET, "sadd", dst, c.db.id)
+	signalModifiedKey(c, c.db, src)
+	signalModifiedKey(c, c.db, dst)
+	server.dirty++
+	c.AddReply(shared.cone)
+}
+
+const (
+	SET_OP_UNION = 0
+	SET_OP_DIFF  = 1
+	SET_OP_INTER = 2
+)
+
+// STORE 版本的键空间通知事件名 按 SET_OP_* 索引
+var setOpStoreEvents = [...]string{"sunionstore", "sdiffstore", "sinterstore"}
+
+/*
+SINTER / SUNION / SDIFF 以及对应的 STORE 版本
+dstkey 为 nil 时直接回复结果
+*/
+func setOperationGenericCommand(c *GodisClient, setkeys []*Gobj, dstkey *Gobj, op int) {
+	sets := make([]*Gobj, len(setkeys))
+	for i, key := range setkeys {
+		var o *Gobj
+		if dstkey != nil {
+			o = c.db.lookupKeyWrite(key)
+		} else {
+			o = c.db.lookupKeyRead(key)
+		}
+		if o != nil && checkType(c, o, GSET) {
+			return
+		}
+		sets[i] = o
+	}
+	result := CreateSetObject()
+	defer result.DecrRefCount()
+	switch op {
+	case SET_OP_INTER:
+		setInter(sets, result)
+	case SET_OP_UNION:
+		for _, o := range sets {
+			if o == nil {
+				continue
+			}
+			it := o.Val_.(*Dict).GetIterator()
+			for e := it.Next(); e != nil; e = it.Next() {
+				setTypeAdd(result, e.Key)
+			}
+			it.Release()
+		}
+	case SET_OP_DIFF:
+		if sets[0] != nil {
+			// 其他集合可能和 sets[0] 是同一个对象 查找时会触发 rehash
+			it := sets[0].Val_.(*Dict).GetSafeIterator()
+			for e := it.Next(); e != nil; e = it.Next() {
+				if !setIsMemberOfAny(sets[1:], e.Key) {
+					setTypeAdd(result, e.Key)
+				}
+			}
+			it.Release()
+		}
+	}
+
+	if dstkey == nil {
+		addReplySetMembers(c, result)
+		return
+	}
+	// 结果为空时删除目标 key
+	size := setTypeSize(result)
+	if size > 0 {
+		c.db.setKey(dstkey, result)
+		notifyKeyspaceEvent(NOTIFY_SET, setOpStoreEvents[op], dstkey, c.db.id)
+	} else if c.db.dbDelete(dstkey) {
+		notifyKeyspaceEvent(NOTIFY_GENERIC, "del", dstkey, c.db.id)
+	}
+	signalModifiedKey(c, c.db, dstkey)
+	server.dirty++
+	c.AddReplyInt(size)
+}
+
+// 从最小的集合开始遍历 任意一个集合不存在时结果为空
+func setInter(sets []*Gobj, result *Gobj) {
+	for _, o := range sets {
+		if o == nil {
+			return
+		}
+	}
+	sorted := make([]*Gobj, len(sets))
+	copy(sorted, sets)
+	sort.Slice(sorted, func(i, j int) bool {
+		return setTypeSize(sorted[i]) < setTypeSize(sorted[j])
+	})
+	it := sorted[0].Val_.(*Dict).GetSafeIterator()
+	for e := it.Next(); e != nil; e = it.Next() {
+		member := true
+		for _, o := range sorted[1:] {
+			if !setTypeIsMember(o, e.Key) {
+				member = false
+				break
+			}
+		}
+		if member {
+			setTypeAdd(result, e.Key)
+		}
+	}
+	it.Release()
+}
+
+func setIsMemberOfAny(sets []*Gobj, member *Gobj) bool {
+	for _, o := range sets {
+		if o != nil && setTypeIsMember(o, member) {
+			return true
+		}
+	}
+	return false
+}
+
+func sinterCommand(c *GodisClient) {
+	setOperationGenericCommand(c, c.args[1:], nil, SET_OP_INTER)
+}
+
+func sinterstoreCommand(c *GodisClient) {
+	setOperationGenericCommand(c, c.args[2:], c.args[1], SET_OP_INTER)
+}
+
+func sunionCommand(c *GodisClient) {
+	setOperationGenericCommand(c, c.args[1:], nil, SET_OP_UNION)
+}
+
+func sunionstoreCommand(c *GodisClient) {
+	setOperationGenericCommand(c, c.args[2:], c.args[1], SET_OP_UNION)
+}
+
+func sdiffCommand(c *GodisClient) {
+	setOperationGenericCommand(c, c.args[1:], nil, SET_OP_DIFF)
+}
+
+func sdiffstoreCommand(c *GodisClient) {
+	setOperationGenericCommand(c, c.args[2:], c.args[1], SET_OP_DIFF)
+}
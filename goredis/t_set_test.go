@@ -0,0 +1,99 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+// 集合的回复顺序不确定 排序之后再比较
+func sortedMembers(reply string) string {
+	lines := strings.Split(strings.TrimSuffix(reply, "\r\n"), "\r\n")
+	if len(lines) < 1 {
+		return reply
+	}
+	var members []string
+	for i := 2; i < len(lines); i += 2 {
+		members = append(members, lines[i])
+	}
+	sort.Strings(members)
+	return lines[0] + " " + strings.Join(members, ",")
+}
+
+func expectMembers(t *testing.T, c *GodisClient, expect string, args ...string) {
+	t.Helper()
+	if got := sortedMembers(c.run(args...)); got != expect {
+		t.Errorf("%v: expect %q, got %q", args, expect, got)
+	}
+}
+
+func TestSetCommands(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	expectReply(t, c, ":3\r\n", "sadd", "s", "a", "b", "c", "a")
+	expectReply(t, c, ":0\r\n", "sadd", "s", "a")
+	expectReply(t, c, ":3\r\n", "scard", "s")
+	expectReply(t, c, ":1\r\n", "sismember", "s", "b")
+	expectReply(t, c, "*3\r\n:1\r\n:0\r\n:1\r\n", "smismember", "s", "a", "x", "c")
+	expectMembers(t, c, "*3 a,b,c", "smembers", "s")
+	expectReply(t, c, ":1\r\n", "srem", "s", "b", "x")
+	expectReply(t, c, ":1\r\n", "smove", "s", "d", "a")
+	expectReply(t, c, ":0\r\n", "smove", "s", "d", "a")
+	expectMembers(t, c, "*1 a", "smembers", "d")
+	expectReply(t, c, "$1\r\nc\r\n", "spop", "s")
+	expectReply(t, c, ":0\r\n", "scard", "s")
+	expectReply(t, c, "$-1\r\n", "srandmember", "s")
+	c.run("set", "str", "v")
+	expectReply(t, c, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n", "sadd", "str", "a")
+}
+
+func TestSetRandom(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	c.run("sadd", "s", "1", "2", "3", "4", "5", "6", "7", "8", "9", "10")
+	if reply := c.run("srandmember", "s", "-20"); !strings.HasPrefix(reply, "*20\r\n") {
+		t.Errorf("unexpected srandmember reply %q", reply)
+	}
+	expectReply(t, c, "-ERR value is out of range\r\n", "srandmember", "s", "-9223372036854775808")
+	expectReply(t, c, "-ERR value is out of range\r\n", "srandmember", "s", "9223372036854775807")
+	for _, count := range []string{"2", "8", "20"} {
+		reply := sortedMembers(c.run("srandmember", "s", count))
+		members := strings.Split(strings.Fields(reply)[1], ",")
+		seen := map[string]bool{}
+		for _, m := range members {
+			seen[m] = true
+		}
+		if len(seen) != len(members) {
+			t.Errorf("srandmember %s returned duplicates: %q", count, reply)
+		}
+	}
+	if reply := c.run("spop", "s", "4"); !strings.HasPrefix(reply, "*4\r\n") {
+		t.Errorf("unexpected spop reply %q", reply)
+	}
+	expectReply(t, c, ":6\r\n", "scard", "s")
+	dirty := server.dirty
+	expectReply(t, c, "*0\r\n", "spop", "s", "0")
+	if server.dirty != dirty {
+		t.Errorf("spop with zero count should not modify the dataset")
+	}
+	c.run("spop", "s", "10")
+	expectReply(t, c, ":0\r\n", "scard", "s")
+}
+
+func TestSetAlgebra(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	c.run("sadd", "s1", "a", "b", "c", "d")
+	c.run("sadd", "s2", "c", "d", "e")
+	c.run("sadd", "s3", "d", "f")
+	expectMembers(t, c, "*1 d", "sinter", "s1", "s2", "s3")
+	expectMembers(t, c, "*0 ", "sinter", "s1", "nosuch")
+	expectMembers(t, c, "*6 a,b,c,d,e,f", "sunion", "s1", "s2", "s3", "nosuch")
+	expectMembers(t, c, "*2 a,b", "sdiff", "s1", "s2", "s3")
+	expectReply(t, c, ":2\r\n", "sinterstore", "dst", "s1", "s2")
+	expectMembers(t, c, "*2 c,d", "smembers", "dst")
+	expectReply(t, c, ":3\r\n", "sdiffstore", "dst", "s1", "s3")
+	expectMembers(t, c, "*3 a,b,c", "smembers", "dst")
+	expectReply(t, c, ":0\r\n", "sinterstore", "dst", "s1", "nosuch")
+	expectReply(t, c, ":0\r\n", "scard", "dst")
+}
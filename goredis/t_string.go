@@ -0,0 +1,674 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// 追加 extra 个字节之后字符串的最大长度 主节点发来的命令不检查
+// size 可能很大（SETRANGE 的 offset） 相加会溢出 所以用减法比较
+func checkStringLength(c *GodisClient, size, extra int64) bool {
+	if c.flags&CLIENT_MASTER == 0 && extra > server.protoMaxBulkLen-size {
+		c.AddReplyError("string exceeds maximum allowed size (proto-max-bulk-len)")
+		return false
+	}
+	return true
+}
+
+// SET / GETEX 的可选参数
+const (
+	OBJ_NO_FLAGS = 0
+	OBJ_SET_NX   = 1 << 0
+	OBJ_SET_XX   = 1 << 1
+	OBJ_EX       = 1 << 2
+	OBJ_PX       = 1 << 3
+	OBJ_KEEPTTL  = 1 << 4
+	OBJ_SET_GET  = 1 << 5
+	OBJ_EXAT     = 1 << 6
+	OBJ_PXAT     = 1 << 7
+	OBJ_PERSIST  = 1 << 8
+)
+
+const (
+	UNIT_SECONDS      = 0
+	UNIT_MILLISECONDS = 1
+)
+
+const (
+	COMMAND_GET = 0
+	COMMAND_SET = 1
+)
+
+const OBJ_EXPIRE_FLAGS = OBJ_EX | OBJ_PX | OBJ_EXAT | OBJ_PXAT
+
+/*
+解析 SET 和 GETEX 的可选参数
+SET 从第 3 个参数开始 GETEX 从第 2 个参数开始
+*/
+func parseExtendedStringArgumentsOrReply(c *GodisClient, commandType int) (flags int, expire *Gobj, unit int, ok bool) {
+	j := 2
+	if commandType == COMMAND_SET {
+		j = 3
+	}
+	for ; j < len(c.args); j++ {
+		opt := strings.ToLower(c.args[j].StrVal())
+		var next *Gobj
+		if j+1 < len(c.args) {
+			next = c.args[j+1]
+		}
+		switch {
+		case opt == "nx" && flags&OBJ_SET_XX == 0 && commandType == COMMAND_SET:
+			flags |= OBJ_SET_NX
+		case opt == "xx" && flags&OBJ_SET_NX == 0 && commandType == COMMAND_SET:
+			flags |= OBJ_SET_XX
+		case opt == "get" && commandType == COMMAND_SET:
+			flags |= OBJ_SET_GET
+		case opt == "keepttl" && flags&(OBJ_PERSIST|OBJ_EXPIRE_FLAGS) == 0 && commandType == COMMAND_SET:
+			flags |= OBJ_KEEPTTL
+		case opt == "persist" && flags&(OBJ_KEEPTTL|OBJ_EXPIRE_FLAGS) == 0 && commandType == COMMAND_GET:
+			flags |= OBJ_PERSIST
+		case (opt == "ex" || opt == "px" || opt == "exat" || opt == "pxat") &&
+			flags&(OBJ_KEEPTTL|OBJ_PERSIST|OBJ_EXPIRE_FLAGS) == 0 && next != nil:
+			switch opt {
+			case "ex":
+				flags |= OBJ_EX
+			case "px":
+				flags |= OBJ_PX
+			case "exat":
+				flags |= OBJ_EXAT
+			case "pxat":
+				flags |= OBJ_PXAT
+			}
+			if opt == "ex" || opt == "exat" {
+				unit = UNIT_SECONDS
+			} else {
+				unit = UNIT_MILLISECONDS
+			}
+			expire = next
+			j++
+		default:
+			c.AddReply(shared.syntaxerr)
+			return 0, nil, 0, false
+		}
+	}
+	return flags, expire, unit, true
+}
+
+// 将过期参数转换成毫秒级的 unix 时间戳
+func getExpireMillisecondsOrReply(c *GodisClient, expire *Gobj, flags int, unit int) (int64, bool) {
+	ms, ok := getLongLongFromObjectOrReply(c, expire, "")
+	if !ok {
+		return 0, false
+	}
+	if ms <= 0 || (unit == UNIT_SECONDS && ms > math.MaxInt64/1000) {
+		c.AddReplyErrorFormat("invalid expire time in '%s' command", strings.ToLower(c.args[0].StrVal()))
+		return 0, false
+	}
+	if unit == UNIT_SECONDS {
+		ms *= 1000
+	}
+	// EX / PX 是相对时间
+	if flags&(OBJ_EX|OBJ_PX) != 0 {
+		now := GetMsTime()
+		if ms > math.MaxInt64-now {
+			c.AddReplyErrorFormat("invalid expire time in '%s' command", strings.ToLower(c.args[0].StrVal()))
+			return 0, false
+		}
+		ms += now
+	}
+	return ms, true
+}
+
+// 回复 key 的值 类型错误时返回 false
+func getGenericCommand(c *GodisClient) bool {
+	o := c.db.lookupKeyReadOrReply(c, c.args[1], nullReply(c))
+	if o == nil {
+		return true
+	}
+	if checkType(c, o, GSTR) {
+		return false
+	}
+	c.AddReplyBulk(o)
+	return true
+}
+
+/*
+SET / SETNX / SETEX / PSETEX 的通用实现
+okReply 和 abortReply 为 nil 时分别回复 OK 和 null
+*/
+func setGenericCommand(c *GodisClient, flags int, key, val, expire *Gobj, unit int, okReply, abortReply *Gobj) {
+	var when int64
+	if expire != nil {
+		var ok bool
+		if when, ok = getExpireMillisecondsOrReply(c, expire, flags, unit); !ok {
+			return
+		}
+	}
+	// GET 在写入之前回复旧值 旧值不是字符串时不做修改
+	if flags&OBJ_SET_GET != 0 && !getGenericCommand(c) {
+		return
+	}
+	found := c.db.lookupKeyWrite(key) != nil
+	if (flags&OBJ_SET_NX != 0 && found) || (flags&OBJ_SET_XX != 0 && !found) {
+		if flags&OBJ_SET_GET == 0 {
+			if abortReply == nil {
+				abortReply = nullReply(c)
+			}
+			c.AddReply(abortReply)
+		}
+		return
+	}
+	c.db.genericSetKey(key, val, flags&OBJ_KEEPTTL != 0)
+	signalModifiedKey(c, c.db, key)
+	notifyKeyspaceEvent(NOTIFY_STRING, "set", key, c.db.id)
+	server.dirty++
+	if expire != nil {
+		c.db.setExpire(key, when)
+		notifyKeyspaceEvent(NOTIFY_GENERIC, "expire", key, c.db.id)
+		// 相对时间改写成 PXAT 重放 AOF 时过期时间不变
+		rewriteClientCommandVector(c, "SET", key.StrVal(), val.StrVal(), "PXAT", strconv.FormatInt(when, 10))
+	}
+	if flags&OBJ_SET_GET == 0 {
+		if okReply == nil {
+			okReply = shared.ok
+		}
+		c.AddReply(okReply)
+	}
+}
+
+// SET key value [NX|XX] [GET] [EX seconds|PX milliseconds|EXAT timestamp|PXAT timestamp|KEEPTTL]
+func setCommand(c *GodisClient) {
+	flags, expire, unit, ok := parseExtendedStringArgumentsOrReply(c, COMMAND_SET)
+	if !ok {
+		return
+	}
+	setGenericCommand(c, flags, c.args[1], c.args[2], expire, unit, nil, nil)
+}
+
+func setnxCommand(c *GodisClient) {
+	setGenericCommand(c, OBJ_SET_NX, c.args[1], c.args[2], nil, 0, shared.cone, shared.czero)
+}
+
+func setexCommand(c *GodisClient) {
+	setGenericCommand(c, OBJ_EX, c.args[1], c.args[3], c.args[2], UNIT_SECONDS, nil, nil)
+}
+
+func psetexCommand(c *GodisClient) {
+	setGenericCommand(c, OBJ_PX, c.args[1], c.args[3], c.args[2], UNIT_MILLISECONDS, nil, nil)
+}
+
+func getCommand(c *GodisClient) {
+	getGenericCommand(c)
+}
+
+func getsetCommand(c *GodisClient) {
+	if !getGenericCommand(c) {
+		return
+	}
+	c.db.setKey(c.args[1], c.args[2])
+	signalModifiedKey(c, c.db, c.args[1])
+	notifyKeyspaceEvent(NOTIFY_STRING, "set", c.args[1], c.db.id)
+	server.dirty++
+}
+
+func getdelCommand(c *GodisClient) {
+	if !getGenericCommand(c) {
+		return
+	}
+	if c.db.dbDelete(c.args[1]) {
+		signalModifiedKey(c, c.db, c.args[1])
+		notifyKeyspaceEvent(NOTIFY_GENERIC, "del", c.args[1], c.db.id)
+		server.dirty++
+	}
+}
+
+// GETEX key [EX seconds|PX milliseconds|EXAT timestamp|PXAT timestamp|PERSIST]
+func getexCommand(c *GodisClient) {
+	flags, expire, unit, ok := parseExtendedStringArgumentsOrReply(c, COMMAND_GET)
+	if !ok {
+		return
+	}
+	key := c.args[1]
+	o := c.db.lookupKeyReadOrReply(c, key, nullReply(c))
+	if o == nil || checkType(c, o, GSTR) {
+		return
+	}
+	var when int64
+	if expire != nil {
+		if when, ok = getExpireMillisecondsOrReply(c, expire, flags, unit); !ok {
+			return
+		}
+	}
+	c.AddReplyBulk(o)
+	if expire != nil {
+		// EXAT / PXAT 指定的时间已经过去时直接删除
+		signalModifiedKey(c, c.db, key)
+		server.dirty++
+		if when <= GetMsTime() {
+			c.db.dbDelete(key)
+			notifyKeyspaceEvent(NOTIFY_GENERIC, "del", key, c.db.id)
+			rewriteClientCommandVector(c, "DEL", key.StrVal())
+		} else {
+			c.db.setExpire(key, when)
+			notifyKeyspaceEvent(NOTIFY_GENERIC, "expire", key, c.db.id)
+			rewriteClientCommandVector(c, "PEXPIREAT", key.StrVal(), strconv.FormatInt(when, 10))
+		}
+	} else if flags&OBJ_PERSIST != 0 {
+		if c.db.removeExpire(key) {
+			signalModifiedKey(c, c.db, key)
+			notifyKeyspaceEvent(NOTIFY_GENERIC, "persist", key, c.db.id)
+			server.dirty++
+			rewriteClientCommandVector(c, "PERSIST", key.StrVal())
+		}
+	}
+}
+
+func mgetCommand(c *GodisClient) {
+	c.AddReplyArrayLen(len(c.args) - 1)
+	for _, key := range c.args[1:] {
+		o := c.db.lookupKeyRead(key)
+		if o == nil || o.Type_ != GSTR {
+			c.AddReplyNull()
+		} else {
+			c.AddReplyBulk(o)
+		}
+	}
+}
+
+// MSET / MSETNX nx 为 true 时任意一个 key 存在就不做修改
+func msetGenericCommand(c *GodisClient, nx bool) {
+	if len(c.args)%2 == 0 {
+		c.AddReplyErrorFormat("wrong number of arguments for '%s' command", strings.ToLower(c.args[0].StrVal()))
+		return
+	}
+	if nx {
+		for i := 1; i < len(c.args); i += 2 {
+			if c.db.lookupKeyWrite(c.args[i]) != nil {
+				c.AddReply(shared.czero)
+				return
+			}
+		}
+	}
+	for i := 1; i < len(c.args); i += 2 {
+		c.db.setKey(c.args[i], c.args[i+1])
+		signalModifiedKey(c, c.db, c.args[i])
+		notifyKeyspaceEvent(NOTIFY_STRING, "set", c.args[i], c.db.id)
+	}
+	server.dirty += int64(len(c.args)-1) / 2
+	if nx {
+		c.AddReply(shared.cone)
+	} else {
+		c.AddReply(shared.ok)
+	}
+}
+
+func msetCommand(c *GodisClient) {
+	msetGenericCommand(c, false)
+}
+
+func msetnxCommand(c *GodisClient) {
+	msetGenericCommand(c, true)
+}
+
+// 字符串对象可能被回复链表引用 修改时总是创建新的对象
+func appendCommand(c *GodisClient) {
+	key, app := c.args[1], c.args[2]
+	o := c.db.lookupKeyWrite(key)
+	var totlen int64
+	if o == nil {
+		c.db.dbAdd(key, app)
+		totlen = int64(len(app.StrVal()))
+	} else {
+		if checkType(c, o, GSTR) {
+			return
+		}
+		totlen = int64(len(o.StrVal()) + len(app.StrVal()))
+		if !checkStringLength(c, int64(len(o.StrVal())), int64(len(app.StrVal()))) {
+			return
+		}
+		newObj := CreateObject(GSTR, o.StrVal()+app.StrVal())
+		c.db.dbOverwrite(key, newObj)
+		newObj.DecrRefCount()
+	}
+	signalModifiedKey(c, c.db, key)
+	notifyKeyspaceEvent(NOTIFY_STRING, "append", key, c.db.id)
+	server.dirty++
+	c.AddReplyInt(totlen)
+}
+
+func strlenCommand(c *GodisClient) {
+	o := c.db.lookupKeyReadOrReply(c, c.args[1], shared.czero)
+	if o == nil || checkType(c, o, GSTR) {
+		return
+	}
+	c.AddReplyInt(int64(len(o.StrVal())))
+}
+
+// GETRANGE key start end 支持负数下标
+func getrangeCommand(c *GodisClient) {
+	start, ok := getLongLongFromObjectOrReply(c, c.args[2], "")
+	if !ok {
+		return
+	}
+	end, ok := getLongLongFromObjectOrReply(c, c.args[3], "")
+	if !ok {
+		return
+	}
+	o := c.db.lookupKeyReadOrReply(c, c.args[1], shared.emptybulk)
+	if o == nil || checkType(c, o, GSTR) {
+		return
+	}
+	str := o.StrVal()
+	strlen := int64(len(str))
+	if start < 0 && end < 0 && start > end {
+		c.AddReply(shared.emptybulk)
+		return
+	}
+	if start < 0 {
+		start += strlen
+	}
+	if end < 0 {
+		end += strlen
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= strlen {
+		end = strlen - 1
+	}
+	if start > end || strlen == 0 {
+		c.AddReply(shared.emptybulk)
+		return
+	}
+	c.AddReplyBulkStr(str[start : end+1])
+}
+
+// SETRANGE key offset value 超出原长度的部分用 0 填充
+func setrangeCommand(c *GodisClient) {
+	key, value := c.args[1], c.args[3].StrVal()
+	offset, ok := getLongLongFromObjectOrReply(c, c.args[2], "")
+	if !ok {
+		return
+	}
+	if offset < 0 {
+		c.AddReplyError("offset is out of range")
+		return
+	}
+	o := c.db.lookupKeyWrite(key)
+	var old string
+	if o != nil {
+		if checkType(c, o, GSTR) {
+			return
+		}
+		old = o.StrVal()
+	}
+	// value 为空时不做修改
+	if len(value) == 0 {
+		c.AddReplyInt(int64(len(old)))
+		return
+	}
+	if !checkStringLength(c, offset, int64(len(value))) {
+		return
+	}
+	buf := []byte(old)
+	if need := int(offset) + len(value); need > len(buf) {
+		buf = append(buf, make([]byte, need-len(buf))...)
+	}
+	copy(buf[offset:], value)
+	newObj := CreateObject(GSTR, string(buf))
+	if o == nil {
+		c.db.dbAdd(key, newObj)
+	} else {
+		c.db.dbOverwrite(key, newObj)
+	}
+	newObj.DecrRefCount()
+	signalModifiedKey(c, c.db, key)
+	notifyKeyspaceEvent(NOTIFY_STRING, "setrange", key, c.db.id)
+	server.dirty++
+	c.AddReplyInt(int64(len(buf)))
+}
+
+func incrDecrCommand(c *GodisClient, incr int64) {
+	key := c.args[1]
+	o := c.db.lookupKeyWrite(key)
+	if o != nil && checkType(c, o, GSTR) {
+		return
+	}
+	var value int64
+	if o != nil {
+		var ok bool
+		if value, ok = getLongLongFromObjectOrReply(c, o, ""); !ok {
+			return
+		}
+	}
+	if (incr < 0 && value < 0 && incr < math.MinInt64-value) ||
+		(incr > 0 && value > 0 && incr > math.MaxInt64-value) {
+		c.AddReplyError("increment or decrement would overflow")
+		return
+	}
+	value += incr
+	newObj := CreateFromInt(value)
+	if o == nil {
+		c.db.dbAdd(key, newObj)
+	} else {
+		c.db.dbOverwrite(key, newObj)
+	}
+	newObj.DecrRefCount()
+	signalModifiedKey(c, c.db, key)
+	notifyKeyspaceEvent(NOTIFY_STRING, "incrby", key, c.db.id)
+	server.dirty++
+	c.AddReplyInt(value)
+}
+
+func incrCommand(c *GodisClient) {
+	incrDecrCommand(c, 1)
+}
+
+func decrCommand(c *GodisClient) {
+	incrDecrCommand(c, -1)
+}
+
+func incrbyCommand(c *GodisClient) {
+	incr, ok := getLongLongFromObjectOrReply(c, c.args[2], "")
+	if !ok {
+		return
+	}
+	incrDecrCommand(c, incr)
+}
+
+func decrbyCommand(c *GodisClient) {
+	incr, ok := getLongLongFromObjectOrReply(c, c.args[2], "")
+	if !ok {
+		return
+	}
+	// -MinInt64 会溢出
+	if incr == math.MinInt64 {
+		c.AddReplyError("decrement would overflow")
+		return
+	}
+	incrDecrCommand(c, -incr)
+}
+
+func incrbyfloatCommand(c *GodisClient) {
+	key := c.args[1]
+	o := c.db.lookupKeyWrite(key)
+	if o != nil && checkType(c, o, GSTR) {
+		return
+	}
+	var value float64
+	if o != nil {
+		var ok bool
+		if value, ok = getDoubleFromObjectOrReply(c, o, ""); !ok {
+			return
+		}
+	}
+	incr, ok := getDoubleFromObjectOrReply(c, c.args[2], "")
+	if !ok {
+		return
+	}
+	value += incr
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		c.AddReplyError("increment would produce NaN or Infinity")
+		return
+	}
+	newObj := CreateObject(GSTR, formatHumanFloat(value))
+	if o == nil {
+		c.db.dbAdd(key, newObj)
+	} else {
+		c.db.dbOverwrite(key, newObj)
+	}
+	c.AddReplyBulk(newObj)
+	newObj.DecrRefCount()
+	signalModifiedKey(c, c.db, key)
+	notifyKeyspaceEvent(NOTIFY_STRING, "incrbyfloat", key, c.db.id)
+	server.dirty++
+}
+
+// LCS key1 key2 [LEN] [IDX] [MINMATCHLEN len] [WITHMATCHLEN]
+func lcsCommand(c *GodisClient) {
+	var a, b string
+	for i, key := range c.args[1:3] {
+		o := c.db.lookupKeyRead(key)
+		if o == nil {
+			continue
+		}
+		if o.Type_ != GSTR {
+			c.AddReplyError("The specified keys must contain string values")
+			return
+		}
+		if i == 0 {
+			a = o.StrVal()
+		} else {
+			b = o.StrVal()
+		}
+	}
+	var getlen, getidx, withmatchlen bool
+	var minmatchlen int64
+	for j := 3; j < len(c.args); j++ {
+		opt := strings.ToLower(c.args[j].StrVal())
+		switch {
+		case opt == "idx":
+			getidx = true
+		case opt == "len":
+			getlen = true
+		case opt == "withmatchlen":
+			withmatchlen = true
+		case opt == "minmatchlen" && j+1 < len(c.args):
+			v, ok := getLongLongFromObjectOrReply(c, c.args[j+1], "")
+			if !ok {
+				return
+			}
+			if v > 0 {
+				minmatchlen = v
+			}
+			j++
+		default:
+			c.AddReply(shared.syntaxerr)
+			return
+		}
+	}
+	if getlen && getidx {
+		c.AddReplyError("If you want both the length and indexes, please just use IDX.")
+		return
+	}
+
+	// dp[i][j] 为 a[:i] 和 b[:j] 的最长公共子序列长度
+	alen, blen := len(a), len(b)
+	dp := make([]uint32, (alen+1)*(blen+1))
+	lcs := func(i, j int) uint32 { return dp[i*(blen+1)+j] }
+	for i := 1; i <= alen; i++ {
+		for j := 1; j <= blen; j++ {
+			if a[i-1] == b[j-1] {
+				dp[i*(blen+1)+j] = lcs(i-1, j-1) + 1
+			} else {
+				dp[i*(blen+1)+j] = max(lcs(i-1, j), lcs(i, j-1))
+			}
+		}
+	}
+	idx := int(lcs(alen, blen))
+	if getlen {
+		c.AddReplyInt(int64(idx))
+		return
+	}
+
+	// 从末尾回溯 得到公共子序列以及匹配的区间
+	result := make([]byte, idx)
+	var matches *Node
+	var matchCount int
+	if getidx {
+		c.AddReplyMapLen(2)
+		c.AddReplyBulkStr("matches")
+		matches = c.AddReplyDeferredLen()
+	}
+	total := idx
+	arangeStart, arangeEnd, brangeStart, brangeEnd := alen, 0, 0, 0
+	i, j := alen, blen
+	for i > 0 && j > 0 {
+		emitRange := false
+		if a[i-1] == b[j-1] {
+			result[idx-1] = a[i-1]
+			if arangeStart == alen {
+				arangeStart, arangeEnd = i-1, i-1
+				brangeStart, brangeEnd = j-1, j-1
+			} else if arangeStart == i && brangeStart == j {
+				// 区间连续 向前扩展
+				arangeStart--
+				brangeStart--
+			} else {
+				emitRange = true
+			}
+			// 匹配到了某个字符串的第一个字节 之后会退出循环
+			if arangeStart == 0 || brangeStart == 0 {
+				emitRange = true
+			}
+			idx--
+			i--
+			j--
+		} else {
+			if lcs(i-1, j) > lcs(i, j-1) {
+				i--
+			} else {
+				j--
+			}
+			if arangeStart != alen {
+				emitRange = true
+			}
+		}
+		matchLen := arangeEnd - arangeStart + 1
+		if emitRange && minmatchlen > 0 && int64(matchLen) < minmatchlen {
+			arangeStart = alen
+			continue
+		}
+		if emitRange {
+			if getidx {
+				if withmatchlen {
+					c.AddReplyArrayLen(3)
+				} else {
+					c.AddReplyArrayLen(2)
+				}
+				c.AddReplyArrayLen(2)
+				c.AddReplyInt(int64(arangeStart))
+				c.AddReplyInt(int64(arangeEnd))
+				c.AddReplyArrayLen(2)
+				c.AddReplyInt(int64(brangeStart))
+				c.AddReplyInt(int64(brangeEnd))
+				if withmatchlen {
+					c.AddReplyInt(int64(matchLen))
+				}
+				matchCount++
+			}
+			arangeStart = alen
+		}
+	}
+	if getidx {
+		c.SetDeferredArrayLen(matches, matchCount)
+		c.AddReplyBulkStr("len")
+		c.AddReplyInt(int64(total))
+		return
+	}
+	c.AddReplyBulkStr(string(result))
+}
@@ -0,0 +1,104 @@
+package main
+
+import "testing"
+
+func TestSetOptions(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	expectReply(t, c, "$-1\r\n", "set", "k", "v1", "xx")
+	expectReply(t, c, "+OK\r\n", "set", "k", "v1", "nx")
+	expectReply(t, c, "$-1\r\n", "set", "k", "v2", "nx")
+	expectReply(t, c, "$2\r\nv1\r\n", "set", "k", "v2", "get")
+	expectReply(t, c, "-ERR syntax error\r\n", "set", "k", "v", "nx", "xx")
+	expectReply(t, c, "-ERR syntax error\r\n", "set", "k", "v", "ex", "10", "keepttl")
+	expectReply(t, c, "-ERR invalid expire time in 'set' command\r\n", "set", "k", "v", "ex", "0")
+	expectReply(t, c, "-ERR value is not an integer or out of range\r\n", "set", "k", "v", "px", "abc")
+	expectReply(t, c, "+OK\r\n", "set", "k", "v3", "ex", "100")
+	key := CreateObject(GSTR, "k")
+	if when := c.db.getExpire(key); when <= GetMsTime() {
+		t.Errorf("expire not set: %d", when)
+	}
+	expectReply(t, c, "+OK\r\n", "set", "k", "v4", "keepttl")
+	if c.db.getExpire(key) == -1 {
+		t.Error("KEEPTTL should keep the expire")
+	}
+	expectReply(t, c, "+OK\r\n", "set", "k", "v5")
+	if c.db.getExpire(key) != -1 {
+		t.Error("SET should clear the expire")
+	}
+	expectReply(t, c, "+OK\r\n", "set", "k", "v", "pxat", "1")
+	expectReply(t, c, "$-1\r\n", "get", "k")
+
+	// 类型错误时不能覆盖原来的值
+	c.run("rpush", "l", "a")
+	expectReply(t, c, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n", "set", "l", "v", "get")
+	expectReply(t, c, ":1\r\n", "llen", "l")
+}
+
+func TestStringCommands(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	expectReply(t, c, ":1\r\n", "setnx", "a", "1")
+	expectReply(t, c, ":0\r\n", "setnx", "a", "2")
+	expectReply(t, c, "$1\r\n1\r\n", "getset", "a", "3")
+	expectReply(t, c, "$1\r\n3\r\n", "getdel", "a")
+	expectReply(t, c, "$-1\r\n", "getdel", "a")
+	expectReply(t, c, "+OK\r\n", "mset", "a", "1", "b", "2")
+	expectReply(t, c, "-ERR wrong number of arguments for 'mset' command\r\n", "mset", "a", "1", "b")
+	expectReply(t, c, ":0\r\n", "msetnx", "a", "1", "c", "3")
+	expectReply(t, c, ":1\r\n", "msetnx", "c", "3", "d", "4")
+	c.run("rpush", "l", "x")
+	expectReply(t, c, "*4\r\n$1\r\n1\r\n$-1\r\n$1\r\n3\r\n$-1\r\n", "mget", "a", "nosuch", "c", "l")
+	expectReply(t, c, ":5\r\n", "append", "s", "hello")
+	expectReply(t, c, ":11\r\n", "append", "s", " world")
+	expectReply(t, c, ":11\r\n", "strlen", "s")
+	expectReply(t, c, "$5\r\nworld\r\n", "getrange", "s", "-5", "-1")
+	expectReply(t, c, "$11\r\nhello world\r\n", "getrange", "s", "0", "100")
+	expectReply(t, c, "$0\r\n\r\n", "getrange", "s", "5", "1")
+	expectReply(t, c, ":11\r\n", "setrange", "s", "6", "redis")
+	expectReply(t, c, "$11\r\nhello redis\r\n", "get", "s")
+	expectReply(t, c, ":5\r\n", "setrange", "pad", "2", "abc")
+	expectReply(t, c, "$5\r\n\x00\x00abc\r\n", "get", "pad")
+	expectReply(t, c, "-ERR offset is out of range\r\n", "setrange", "pad", "-1", "x")
+	expectReply(t, c, "-ERR string exceeds maximum allowed size (proto-max-bulk-len)\r\n", "setrange", "pad", "9223372036854775807", "x")
+	expectReply(t, c, "+OK\r\n", "setex", "e", "100", "v")
+	expectReply(t, c, "-ERR invalid expire time in 'setex' command\r\n", "setex", "e", "-1", "v")
+	expectReply(t, c, "$1\r\nv\r\n", "getex", "e", "persist")
+	if c.db.getExpire(CreateObject(GSTR, "e")) != -1 {
+		t.Error("GETEX PERSIST should remove the expire")
+	}
+	expectReply(t, c, "$1\r\nv\r\n", "getex", "e", "exat", "1")
+	expectReply(t, c, "$-1\r\n", "get", "e")
+}
+
+func TestIncrDecr(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	expectReply(t, c, ":1\r\n", "incr", "n")
+	expectReply(t, c, ":11\r\n", "incrby", "n", "10")
+	expectReply(t, c, ":9\r\n", "decrby", "n", "2")
+	expectReply(t, c, ":8\r\n", "decr", "n")
+	expectReply(t, c, "+OK\r\n", "set", "n", "9223372036854775807")
+	expectReply(t, c, "-ERR increment or decrement would overflow\r\n", "incr", "n")
+	expectReply(t, c, "-ERR decrement would overflow\r\n", "decrby", "n", "-9223372036854775808")
+	expectReply(t, c, "+OK\r\n", "set", "n", "abc")
+	expectReply(t, c, "-ERR value is not an integer or out of range\r\n", "incr", "n")
+	expectReply(t, c, "-ERR value is not a valid float\r\n", "incrbyfloat", "n", "1")
+	expectReply(t, c, "$4\r\n10.5\r\n", "incrbyfloat", "f", "10.5")
+	expectReply(t, c, "$3\r\n5.5\r\n", "incrbyfloat", "f", "-5")
+	expectReply(t, c, "-ERR increment would produce NaN or Infinity\r\n", "incrbyfloat", "f", "inf")
+}
+
+func TestLcs(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	c.run("mset", "key1", "ohmytext", "key2", "mynewtext")
+	expectReply(t, c, "$6\r\nmytext\r\n", "lcs", "key1", "key2")
+	expectReply(t, c, ":6\r\n", "lcs", "key1", "key2", "len")
+	expectReply(t, c, "*4\r\n$7\r\nmatches\r\n*2\r\n*2\r\n*2\r\n:4\r\n:7\r\n*2\r\n:5\r\n:8\r\n*2\r\n*2\r\n:2\r\n:3\r\n*2\r\n:0\r\n:1\r\n$3\r\nlen\r\n:6\r\n",
+		"lcs", "key1", "key2", "idx")
+	expectReply(t, c, "*4\r\n$7\r\nmatches\r\n*1\r\n*3\r\n*2\r\n:4\r\n:7\r\n*2\r\n:5\r\n:8\r\n:4\r\n$3\r\nlen\r\n:6\r\n",
+		"lcs", "key1", "key2", "idx", "minmatchlen", "4", "withmatchlen")
+	expectReply(t, c, "-ERR If you want both the length and indexes, please just use IDX.\r\n", "lcs", "key1", "key2", "len", "idx")
+	expectReply(t, c, "$0\r\n\r\n", "lcs", "key1", "nosuch")
+}
@@ -0,0 +1,978 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// dict 负责 member -> score 的查找 跳表负责按分数排序
+type zset struct {
+	dict *Dict
+	zsl  *zskiplist
+}
+
+func CreateZsetObject() *Gobj {
+	zs := &zset{
+		dict: DictCreate(DictType{HashFunc: GStrHash, EqualFunc: GStrEqual}),
+		zsl:  zslCreate(),
+	}
+	return CreateObject(GZSET, zs)
+}
+
+// dict 中的 val 只保存分数 仅在 zset 内部使用
+func createScoreObject(score float64) *Gobj {
+	return CreateObject(GZSET, score)
+}
+
+func zsetLength(o *Gobj) int64 {
+	return o.Val_.(*zset).zsl.length
+}
+
+func zsetDup(o *Gobj) *Gobj {
+	dst := CreateZsetObject()
+	for x := o.Val_.(*zset).zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+		zsetAdd(dst, x.score, x.member, 0)
+	}
+	return dst
+}
+
+func zsetScore(o *Gobj, member *Gobj) (float64, bool) {
+	e := o.Val_.(*zset).dict.Find(member)
+	if e == nil {
+		return 0, false
+	}
+	return e.Val.Val_.(float64), true
+}
+
+// ZADD 的输入输出标记
+const (
+	ZADD_IN_INCR = 1 << 0
+	ZADD_IN_NX   = 1 << 1
+	ZADD_IN_XX   = 1 << 2
+	ZADD_IN_GT   = 1 << 3
+	ZADD_IN_LT   = 1 << 4
+
+	ZADD_OUT_NOP     = 1 << 0 // 因为 NX/XX/GT/LT 没有执行
+	ZADD_OUT_NAN     = 1 << 1 // 结果为 NaN
+	ZADD_OUT_ADDED   = 1 << 2
+	ZADD_OUT_UPDATED = 1 << 3
+)
+
+// 返回输出标记以及新的分数
+func zsetAdd(o *Gobj, score float64, member *Gobj, inFlags int) (int, float64) {
+	incr := inFlags&ZADD_IN_INCR != 0
+	nx := inFlags&ZADD_IN_NX != 0
+	xx := inFlags&ZADD_IN_XX != 0
+	gt := inFlags&ZADD_IN_GT != 0
+	lt := inFlags&ZADD_IN_LT != 0
+	if math.IsNaN(score) {
+		return ZADD_OUT_NAN, 0
+	}
+	zs := o.Val_.(*zset)
+	e := zs.dict.Find(member)
+	if e != nil {
+		if nx {
+			return ZADD_OUT_NOP, 0
+		}
+		curscore := e.Val.Val_.(float64)
+		if incr {
+			score += curscore
+			if math.IsNaN(score) {
+				return ZADD_OUT_NAN, 0
+			}
+		}
+		if (lt && score >= curscore) || (gt && score <= curscore) {
+			return ZADD_OUT_NOP, curscore
+		}
+		if score == curscore {
+			return 0, score
+		}
+		zs.zsl.UpdateScore(curscore, member, score)
+		e.Val.Val_ = score
+		return ZADD_OUT_UPDATED, score
+	}
+	if xx {
+		return ZADD_OUT_NOP, 0
+	}
+	zs.zsl.Insert(score, member)
+	scoreObj := createScoreObject(score)
+	zs.dict.Add(member, scoreObj)
+	scoreObj.DecrRefCount()
+	return ZADD_OUT_ADDED, score
+}
+
+func zsetDel(o *Gobj, member *Gobj) bool {
+	zs := o.Val_.(*zset)
+	score, ok := zsetScore(o, member)
+	if !ok {
+		return false
+	}
+	zs.zsl.Delete(score, member)
+	zs.dict.Delete(member)
+	return true
+}
+
+// 排名从 0 开始
+func zsetRank(o *Gobj, member *Gobj, reverse bool) (int64, bool) {
+	score, ok := zsetScore(o, member)
+	if !ok {
+		return 0, false
+	}
+	zs := o.Val_.(*zset)
+	rank := zs.zsl.GetRank(score, member)
+	if reverse {
+		return zs.zsl.length - rank, true
+	}
+	return rank - 1, true
+}
+
+// "(1.5" 表示开区间 支持 -inf +inf
+func parseRangeItem(s string) (float64, bool, bool) {
+	ex := false
+	if len(s) > 0 && s[0] == '(' {
+		ex = true
+		s = s[1:]
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(v) {
+		return 0, false, false
+	}
+	return v, ex, true
+}
+
+func zslParseRange(min, max *Gobj) (*zrangespec, bool) {
+	var spec zrangespec
+	var ok1, ok2 bool
+	spec.min, spec.minex, ok1 = parseRangeItem(min.StrVal())
+	spec.max, spec.maxex, ok2 = parseRangeItem(max.StrVal())
+	return &spec, ok1 && ok2
+}
+
+// "[a" 闭区间 "(a" 开区间 "-" "+" 为无穷
+func parseLexRangeItem(s string) (string, bool, int, bool) {
+	if s == "-" {
+		return "", false, -1, true
+	}
+	if s == "+" {
+		return "", false, 1, true
+	}
+	if len(s) > 0 && s[0] == '(' {
+		return s[1:], true, 0, true
+	}
+	if len(s) > 0 && s[0] == '[' {
+		return s[1:], false, 0, true
+	}
+	return "", false, 0, false
+}
+
+func zslParseLexRange(min, max *Gobj) (*zlexrangespec, bool) {
+	var spec zlexrangespec
+	var ok1, ok2 bool
+	spec.min, spec.minex, spec.minInf, ok1 = parseLexRangeItem(min.StrVal())
+	spec.max, spec.maxex, spec.maxInf, ok2 = parseLexRangeItem(max.StrVal())
+	return &spec, ok1 && ok2
+}
+
+// ZADD key [NX|XX] [GT|LT] [CH] [INCR] score member [score member ...]
+func zaddGenericCommand(c *GodisClient, flags int) {
+	ch := false
+	idx := 2
+	for ; idx < len(c.args); idx++ {
+		opt := strings.ToLower(c.args[idx].StrVal())
+		if opt == "nx" {
+			flags |= ZADD_IN_NX
+		} else if opt == "xx" {
+			flags |= ZADD_IN_XX
+		} else if opt == "gt" {
+			flags |= ZADD_IN_GT
+		} else if opt == "lt" {
+			flags |= ZADD_IN_LT
+		} else if opt == "ch" {
+			ch = true
+		} else if opt == "incr" {
+			flags |= ZADD_IN_INCR
+		} else {
+			break
+		}
+	}
+	incr := flags&ZADD_IN_INCR != 0
+	elements := len(c.args) - idx
+	if elements%2 != 0 || elements == 0 {
+		c.AddReply(shared.syntaxerr)
+		return
+	}
+	elements /= 2
+	if flags&ZADD_IN_NX != 0 && flags&ZADD_IN_XX != 0 {
+		c.AddReplyError("XX and NX options at the same time are not compatible")
+		return
+	}
+	if (flags&ZADD_IN_GT != 0 && flags&ZADD_IN_NX != 0) ||
+		(flags&ZADD_IN_LT != 0 && flags&ZADD_IN_NX != 0) ||
+		(flags&ZADD_IN_GT != 0 && flags&ZADD_IN_LT != 0) {
+		c.AddReplyError("GT, LT, and/or NX options at the same time are not compatible")
+		return
+	}
+	if incr && elements > 1 {
+		c.AddReplyError("INCR option supports a single increment-element pair")
+		return
+	}
+	// 先检查全部分数 避免执行到一半出错
+	scores := make([]float64, elements)
+	for i := 0; i < elements; i++ {
+		var ok bool
+		if scores[i], ok = getDoubleFromObjectOrReply(c, c.args[idx+i*2], ""); !ok {
+			return
+		}
+	}
+
+	key := c.args[1]
+	o := c.db.lookupKeyWrite(key)
+	if o != nil && checkType(c, o, GZSET) {
+		return
+	}
+	if o == nil {
+		if flags&ZADD_IN_XX != 0 {
+			if incr {
+				c.AddReplyNull()
+			} else {
+				c.AddReply(shared.czero)
+			}
+			return
+		}
+		o = CreateZsetObject()
+		c.db.dbAdd(key, o)
+		o.DecrRefCount()
+	}
+	var added, updated, processed int64
+	var score float64
+	for i := 0; i < elements; i++ {
+		out, newscore := zsetAdd(o, scores[i], c.args[idx+i*2+1], flags)
+		if out&ZADD_OUT_NAN != 0 {
+			c.AddReplyError("resulting score is not a number (NaN)")
+			break
+		}
+		if out&ZADD_OUT_ADDED != 0 {
+			added++
+		}
+		if out&ZADD_OUT_UPDATED != 0 {
+			updated++
+		}
+		if out&ZADD_OUT_NOP == 0 {
+			processed++
+		}
+		score = newscore
+		if i == elements-1 {
+			if incr {
+				if processed == 0 {
+					c.AddReplyNull()
+				} else {
+					c.AddReplyDouble(score)
+				}
+			} else if ch {
+				c.AddReplyInt(added + updated)
+			} else {
+				c.AddReplyInt(added)
+			}
+		}
+	}
+	if added+updated > 0 {
+		signalModifiedKey(c, c.db, key)
+		if incr {
+			notifyKeyspaceEvent(NOTIFY_ZSET, "zincr", key, c.db.id)
+		} else {
+			notifyKeyspaceEvent(NOTIFY_ZSET, "zadd", key, c.db.id)
+		}
+	}
+	if zsetLength(o) == 0 {
+		c.db.dbDelete(key)
+	}
+	server.dirty += added + updated
+}
+
+func zaddCommand(c *GodisClient) {
+	zaddGenericCommand(c, 0)
+}
+
+func zincrbyCommand(c *GodisClient) {
+	zaddGenericCommand(c, ZADD_IN_INCR)
+}
+
+func zremCommand(c *GodisClient) {
+	key := c.args[1]
+	o := c.db.lookupKeyWriteOrReply(c, key, shared.czero)
+	if o == nil || checkType(c, o, GZSET) {
+		return
+	}
+	var deleted int64
+	for _, member := range c.args[2:] {
+		if zsetDel(o, member) {
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		signalModifiedKey(c, c.db, key)
+		notifyKeyspaceEvent(NOTIFY_ZSET, "zrem", key, c.db.id)
+	}
+	if zsetLength(o) == 0 {
+		c.db.dbDelete(key)
+		notifyKeyspaceEvent(NOTIFY_GENERIC, "del", key, c.db.id)
+	}
+	server.dirty += deleted
+	c.AddReplyInt(deleted)
+}
+
+func zscoreCommand(c *GodisClient) {
+	o := c.db.lookupKeyReadOrReply(c, c.args[1], nullReply(c))
+	if o == nil || checkType(c, o, GZSET) {
+		return
+	}
+	score, ok := zsetScore(o, c.args[2])
+	if !ok {
+		c.AddReplyNull()
+		return
+	}
+	c.AddReplyDouble(score)
+}
+
+func zmscoreCommand(c *GodisClient) {
+	o := c.db.lookupKeyRead(c.args[1])
+	if o != nil && checkType(c, o, GZSET) {
+		return
+	}
+	c.AddReplyArrayLen(len(c.args) - 2)
+	for _, member := range c.args[2:] {
+		if o == nil {
+			c.AddReplyNull()
+			continue
+		}
+		if score, ok := zsetScore(o, member); ok {
+			c.AddReplyDouble(score)
+		} else {
+			c.AddReplyNull()
+		}
+	}
+}
+
+func zcardCommand(c *GodisClient) {
+	o := c.db.lookupKeyReadOrReply(c, c.args[1], shared.czero)
+	if o == nil || checkType(c, o, GZSET) {
+		return
+	}
+	c.AddReplyInt(zsetLength(o))
+}
+
+func zcountCommand(c *GodisClient) {
+	spec, ok := zslParseRange(c.args[2], c.args[3])
+	if !ok {
+		c.AddReplyError("min or max is not a float")
+		return
+	}
+	o := c.db.lookupKeyReadOrReply(c, c.args[1], shared.czero)
+	if o == nil || checkType(c, o, GZSET) {
+		return
+	}
+	zsl := o.Val_.(*zset).zsl
+	first := zsl.FirstInRange(spec)
+	if first == nil {
+		c.AddReply(shared.czero)
+		return
+	}
+	last := zsl.LastInRange(spec)
+	c.AddReplyInt(zsl.GetRank(last.score, last.member) - zsl.GetRank(first.score, first.member) + 1)
+}
+
+// ZRANK / ZREVRANK key member [WITHSCORE]
+func zrankGenericCommand(c *GodisClient, reverse bool) {
+	if len(c.args) > 4 || (len(c.args) == 4 && strings.ToLower(c.args[3].StrVal()) != "withscore") {
+		c.AddReply(shared.syntaxerr)
+		return
+	}
+	withscore := len(c.args) == 4
+	var empty *Gobj = nullReply(c)
+	if withscore && c.resp < 3 {
+		empty = shared.nullarray
+	}
+	o := c.db.lookupKeyReadOrReply(c, c.args[1], empty)
+	if o == nil || checkType(c, o, GZSET) {
+		return
+	}
+	rank, ok := zsetRank(o, c.args[2], reverse)
+	if !ok {
+		c.AddReply(empty)
+		return
+	}
+	if withscore {
+		score, _ := zsetScore(o, c.args[2])
+		c.AddReplyArrayLen(2)
+		c.AddReplyInt(rank)
+		c.AddReplyDouble(score)
+	} else {
+		c.AddReplyInt(rank)
+	}
+}
+
+func zrankCommand(c *GodisClient) {
+	zrankGenericCommand(c, false)
+}
+
+func zrevrankCommand(c *GodisClient) {
+	zrankGenericCommand(c, true)
+}
+
+const (
+	ZRANGE_RANK  = 0
+	ZRANGE_SCORE = 1
+	ZRANGE_LEX   = 2
+)
+
+// 收集 ZRANGE 的结果 元素个数未知时使用延迟长度
+type zrangeResult struct {
+	c          *GodisClient
+	withscores bool
+	node       *Node
+	count      int
+}
+
+func (r *zrangeResult) begin() {
+	r.node = r.c.AddReplyDeferredLen()
+}
+
+func (r *zrangeResult) emit(member *Gobj, score float64) {
+	c := r.c
+	// RESP3 下每个元素为 [member, score]
+	if r.withscores && c.resp >= 3 {
+		c.AddReplyArrayLen(2)
+	}
+	c.AddReplyBulk(member)
+	if r.withscores {
+		c.AddReplyDouble(score)
+	}
+	r.count++
+}
+
+func (r *zrangeResult) end() {
+	n := r.count
+	if r.withscores && r.c.resp < 3 {
+		n *= 2
+	}
+	r.c.SetDeferredArrayLen(r.node, n)
+}
+
+/*
+ZRANGE key start stop [BYSCORE|BYLEX] [REV] [LIMIT offset count] [WITHSCORES]
+旧版本的 ZREVRANGE / ZRANGEBYSCORE 等命令通过 rangetype 和 reverse 指定
+*/
+func zrangeGenericCommand(c *GodisClient, rangetype int, reverse bool, allowFlags bool) {
+	withscores := false
+	var offset, limit int64 = 0, -1
+	hasLimit := false
+	for i := 4; i < len(c.args); i++ {
+		opt := strings.ToLower(c.args[i].StrVal())
+		left := len(c.args) - i - 1
+		if opt == "withscores" {
+			withscores = true
+		} else if opt == "limit" && left >= 2 {
+			var ok bool
+			if offset, ok = getLongLongFromObjectOrReply(c, c.args[i+1], ""); !ok {
+				return
+			}
+			if limit, ok = getLongLongFromObjectOrReply(c, c.args[i+2], ""); !ok {
+				return
+			}
+			hasLimit = true
+			i += 2
+		} else if allowFlags && opt == "byscore" && rangetype == ZRANGE_RANK {
+			rangetype = ZRANGE_SCORE
+		} else if allowFlags && opt == "bylex" && rangetype == ZRANGE_RANK {
+			rangetype = ZRANGE_LEX
+		} else if allowFlags && opt == "rev" {
+			reverse = true
+		} else {
+			c.AddReply(shared.syntaxerr)
+			return
+		}
+	}
+	if hasLimit && rangetype == ZRANGE_RANK {
+		c.AddReplyError("syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+		return
+	}
+	if withscores && rangetype == ZRANGE_LEX {
+		c.AddReplyError("syntax error, WITHSCORES not supported in combination with BYLEX")
+		return
+	}
+	// 逆序时参数顺序为 max min
+	minArg, maxArg := c.args[2], c.args[3]
+	if reverse && rangetype != ZRANGE_RANK {
+		minArg, maxArg = maxArg, minArg
+	}
+	var spec *zrangespec
+	var lexspec *zlexrangespec
+	var start, end int64
+	var ok bool
+	switch rangetype {
+	case ZRANGE_RANK:
+		if start, ok = getLongLongFromObjectOrReply(c, c.args[2], ""); !ok {
+			return
+		}
+		if end, ok = getLongLongFromObjectOrReply(c, c.args[3], ""); !ok {
+			return
+		}
+	case ZRANGE_SCORE:
+		if spec, ok = zslParseRange(minArg, maxArg); !ok {
+			c.AddReplyError("min or max is not a float")
+			return
+		}
+	case ZRANGE_LEX:
+		if lexspec, ok = zslParseLexRange(minArg, maxArg); !ok {
+			c.AddReplyError("min or max not valid string range item")
+			return
+		}
+	}
+
+	o := c.db.lookupKeyReadOrReply(c, c.args[1], shared.emptyarray)
+	if o == nil || checkType(c, o, GZSET) {
+		return
+	}
+	zsl := o.Val_.(*zset).zsl
+	result := &zrangeResult{c: c, withscores: withscores}
+	result.begin()
+	defer result.end()
+
+	if rangetype == ZRANGE_RANK {
+		start, end, ok = normalizeRange(start, end, zsl.length)
+		if !ok {
+			return
+		}
+		var x *zskiplistNode
+		if reverse {
+			x = zsl.GetElementByRank(zsl.length - start)
+		} else {
+			x = zsl.GetElementByRank(start + 1)
+		}
+		for i := start; i <= end; i++ {
+			result.emit(x.member, x.score)
+			if reverse {
+				x = x.backward
+			} else {
+				x = x.level[0].forward
+			}
+		}
+		return
+	}
+
+	var x *zskiplistNode
+	var inRange func(x *zskiplistNode) bool
+	if rangetype == ZRANGE_SCORE {
+		if reverse {
+			x = zsl.LastInRange(spec)
+			inRange = func(x *zskiplistNode) bool { return zslValueGteMin(x.score, spec) }
+		} else {
+			x = zsl.FirstInRange(spec)
+			inRange = func(x *zskiplistNode) bool { return zslValueLteMax(x.score, spec) }
+		}
+	} else {
+		if reverse {
+			x = zsl.LastInLexRange(lexspec)
+			inRange = func(x *zskiplistNode) bool { return zslLexValueGteMin(x.member.StrVal(), lexspec) }
+		} else {
+			x = zsl.FirstInLexRange(lexspec)
+			inRange = func(x *zskiplistNode) bool { return zslLexValueLteMax(x.member.StrVal(), lexspec) }
+		}
+	}
+	next := func(x *zskiplistNode) *zskiplistNode {
+		if reverse {
+			return x.backward
+		}
+		return x.level[0].forward
+	}
+	// offset 为负数时返回空
+	if offset < 0 {
+		return
+	}
+	for x != nil && offset > 0 {
+		x = next(x)
+		offset--
+	}
+	for x != nil && limit != 0 && inRange(x) {
+		result.emit(x.member, x.score)
+		if limit > 0 {
+			limit--
+		}
+		x = next(x)
+	}
+}
+
+func zrangeCommand(c *GodisClient) {
+	zrangeGenericCommand(c, ZRANGE_RANK, false, true)
+}
+
+func zrevrangeCommand(c *GodisClient) {
+	zrangeGenericCommand(c, ZRANGE_RANK, true, false)
+}
+
+func zrangebyscoreCommand(c *GodisClient) {
+	zrangeGenericCommand(c, ZRANGE_SCORE, false, false)
+}
+
+func zrevrangebyscoreCommand(c *GodisClient) {
+	zrangeGenericCommand(c, ZRANGE_SCORE, true, false)
+}
+
+func zrangebylexCommand(c *GodisClient) {
+	zrangeGenericCommand(c, ZRANGE_LEX, false, false)
+}
+
+func zrevrangebylexCommand(c *GodisClient) {
+	zrangeGenericCommand(c, ZRANGE_LEX, true, false)
+}
+
+// ZREMRANGEBYRANK / ZREMRANGEBYSCORE / ZREMRANGEBYLEX
+// 键空间通知的事件名 按 ZRANGE_* 索引
+var zremrangeEvents = [...]string{"zremrangebyrank", "zremrangebyscore", "zremrangebylex"}
+
+func zremrangeGenericCommand(c *GodisClient, rangetype int) {
+	var spec *zrangespec
+	var lexspec *zlexrangespec
+	var start, end int64
+	var ok bool
+	switch rangetype {
+	case ZRANGE_RANK:
+		if start, ok = getLongLongFromObjectOrReply(c, c.args[2], ""); !ok {
+			return
+		}
+		if end, ok = getLongLongFromObjectOrReply(c, c.args[3], ""); !ok {
+			return
+		}
+	case ZRANGE_SCORE:
+		if spec, ok = zslParseRange(c.args[2], c.args[3]); !ok {
+			c.AddReplyError("min or max is not a float")
+			return
+		}
+	case ZRANGE_LEX:
+		if lexspec, ok = zslParseLexRange(c.args[2], c.args[3]); !ok {
+			c.AddReplyError("min or max not valid string range item")
+			return
+		}
+	}
+	key := c.args[1]
+	o := c.db.lookupKeyWriteOrReply(c, key, shared.czero)
+	if o == nil || checkType(c, o, GZSET) {
+		return
+	}
+	zs := o.Val_.(*zset)
+	var deleted int64
+	switch rangetype {
+	case ZRANGE_RANK:
+		if start, end, ok = normalizeRange(start, end, zs.zsl.length); ok {
+			deleted = zs.zsl.DeleteRangeByRank(start+1, end+1, zs.dict)
+		}
+	case ZRANGE_SCORE:
+		deleted = zs.zsl.DeleteRangeByScore(spec, zs.dict)
+	case ZRANGE_LEX:
+		deleted = zs.zsl.DeleteRangeByLex(lexspec, zs.dict)
+	}
+	if deleted > 0 {
+		signalModifiedKey(c, c.db, key)
+		notifyKeyspaceEvent(NOTIFY_ZSET, zremrangeEvents[rangetype], key, c.db.id)
+	}
+	if zsetLength(o) == 0 {
+		c.db.dbDelete(key)
+		notifyKeyspaceEvent(NOTIFY_GENERIC, "del", key, c.db.id)
+	}
+	server.dirty += deleted
+	c.AddReplyInt(deleted)
+}
+
+func zremrangebyrankCommand(c *GodisClient) {
+	zremrangeGenericCommand(c, ZRANGE_RANK)
+}
+
+func zremrangebyscoreCommand(c *GodisClient) {
+	zremrangeGenericCommand(c, ZRANGE_SCORE)
+}
+
+func zremrangebylexCommand(c *GodisClient) {
+	zremrangeGenericCommand(c, ZRANGE_LEX)
+}
+
+/*
+ZPOPMIN / ZPOPMAX key [count]
+没有 count 时回复 [member, score] 有 count 时 RESP3 下回复 [[member, score] ...]
+*/
+func genericZpopCommand(c *GodisClient, key *Gobj, max bool, count int64, hasCount bool) {
+	o := c.db.lookupKeyWrite(key)
+	if o == nil {
+		c.AddReply(shared.emptyarray)
+		return
+	}
+	if checkType(c, o, GZSET) {
+		return
+	}
+	zs := o.Val_.(*zset)
+	if count > zs.zsl.length {
+		count = zs.zsl.length
+	}
+	nested := hasCount && c.resp >= 3
+	if nested {
+		c.AddReplyArrayLen(int(count))
+	} else {
+		c.AddReplyArrayLen(int(count * 2))
+	}
+	for i := int64(0); i < count; i++ {
+		var x *zskiplistNode
+		if max {
+			x = zs.zsl.tail
+		} else {
+			x = zs.zsl.header.level[0].forward
+		}
+		member, score := x.member, x.score
+		if nested {
+			c.AddReplyArrayLen(2)
+		}
+		c.AddReplyBulk(member)
+		c.AddReplyDouble(score)
+		member.IncrRefCount()
+		zsetDel(o, member)
+		member.DecrRefCount()
+	}
+	if count > 0 {
+		signalModifiedKey(c, c.db, key)
+		if max {
+			notifyKeyspaceEvent(NOTIFY_ZSET, "zpopmax", key, c.db.id)
+		} else {
+			notifyKeyspaceEvent(NOTIFY_ZSET, "zpopmin", key, c.db.id)
+		}
+	}
+	if zs.zsl.length == 0 {
+		c.db.dbDelete(key)
+		notifyKeyspaceEvent(NOTIFY_GENERIC, "del", key, c.db.id)
+	}
+	server.dirty += count
+}
+
+func zpopGenericCommand(c *GodisClient, max bool) {
+	if len(c.args) > 3 {
+		c.AddReply(shared.syntaxerr)
+		return
+	}
+	var count int64 = 1
+	hasCount := len(c.args) == 3
+	if hasCount {
+		var ok bool
+		if count, ok = getPositiveLongFromObjectOrReply(c, c.args[2], ""); !ok {
+			return
+		}
+	}
+	genericZpopCommand(c, c.args[1], max, count, hasCount)
+}
+
+func zpopminCommand(c *GodisClient) {
+	zpopGenericCommand(c, false)
+}
+
+func zpopmaxCommand(c *GodisClient) {
+	zpopGenericCommand(c, true)
+}
+
+const (
+	REDIS_AGGR_SUM = 0
+	REDIS_AGGR_MIN = 1
+	REDIS_AGGR_MAX = 2
+)
+
+// 遍历 set 或 zset set 中元素的分数视为 1
+func zuiForEach(o *Gobj, fn func(member *Gobj, score float64)) {
+	if o.Type_ == GSET {
+		// fn 中会查找其他集合 可能就是同一个 set
+		it := o.Val_.(*Dict).GetSafeIterator()
+		for e := it.Next(); e != nil; e = it.Next() {
+			fn(e.Key, 1)
+		}
+		it.Release()
+		return
+	}
+	for x := o.Val_.(*zset).zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+		fn(x.member, x.score)
+	}
+}
+
+func zuiFind(o *Gobj, member *Gobj) (float64, bool) {
+	if o.Type_ == GSET {
+		return 1, setTypeIsMember(o, member)
+	}
+	return zsetScore(o, member)
+}
+
+func zuiLength(o *Gobj) int64 {
+	if o.Type_ == GSET {
+		return setTypeSize(o)
+	}
+	return zsetLength(o)
+}
+
+func zunionInterAggregate(target *float64, val float64, aggregate int) {
+	switch aggregate {
+	case REDIS_AGGR_SUM:
+		*target = *target + val
+		// inf + -inf 的结果为 0
+		if math.IsNaN(*target) {
+			*target = 0
+		}
+	case REDIS_AGGR_MIN:
+		if val < *target {
+			*target = val
+		}
+	case REDIS_AGGR_MAX:
+		if val > *target {
+			*target = val
+		}
+	}
+}
+
+// ZUNIONSTORE / ZINTERSTORE destination numkeys key [key ...] [WEIGHTS weight ...] [AGGREGATE SUM|MIN|MAX]
+func zunionInterGenericCommand(c *GodisClient, op int) {
+	numkeys, ok := getLongLongFromObjectOrReply(c, c.args[2], "")
+	if !ok {
+		return
+	}
+	if numkeys < 1 {
+		c.AddReplyErrorFormat("at least 1 input key is needed for '%s' command", strings.ToLower(c.args[0].StrVal()))
+		return
+	}
+	if numkeys > int64(len(c.args)-3) {
+		c.AddReply(shared.syntaxerr)
+		return
+	}
+	keys := c.args[3 : 3+numkeys]
+	weights := make([]float64, numkeys)
+	for i := range weights {
+		weights[i] = 1
+	}
+	aggregate := REDIS_AGGR_SUM
+	for i := 3 + int(numkeys); i < len(c.args); i++ {
+		opt := strings.ToLower(c.args[i].StrVal())
+		left := len(c.args) - i - 1
+		if opt == "weights" && left >= int(numkeys) {
+			for j := range weights {
+				if weights[j], ok = getDoubleFromObjectOrReply(c, c.args[i+1+j], "weight value is not a float"); !ok {
+					return
+				}
+			}
+			i += int(numkeys)
+		} else if opt == "aggregate" && left >= 1 {
+			switch strings.ToLower(c.args[i+1].StrVal()) {
+			case "sum":
+				aggregate = REDIS_AGGR_SUM
+			case "min":
+				aggregate = REDIS_AGGR_MIN
+			case "max":
+				aggregate = REDIS_AGGR_MAX
+			default:
+				c.AddReply(shared.syntaxerr)
+				return
+			}
+			i++
+		} else {
+			c.AddReply(shared.syntaxerr)
+			return
+		}
+	}
+
+	srcs := make([]*Gobj, numkeys)
+	for i, key := range keys {
+		o := c.db.lookupKeyWrite(key)
+		if o != nil && o.Type_ != GSET && o.Type_ != GZSET {
+			c.AddReply(shared.wrongtypeerr)
+			return
+		}
+		srcs[i] = o
+	}
+
+	dstobj := CreateZsetObject()
+	defer dstobj.DecrRefCount()
+	scoreOf := func(score float64, weight float64) float64 {
+		v := score * weight
+		if math.IsNaN(v) {
+			return 0
+		}
+		return v
+	}
+	if op == SET_OP_INTER {
+		allExist := true
+		for _, o := range srcs {
+			if o == nil {
+				allExist = false
+			}
+		}
+		if allExist {
+			// 从最小的集合开始遍历
+			order := make([]int, numkeys)
+			for i := range order {
+				order[i] = i
+			}
+			sort.Slice(order, func(i, j int) bool {
+				return zuiLength(srcs[order[i]]) < zuiLength(srcs[order[j]])
+			})
+			first := order[0]
+			zuiForEach(srcs[first], func(member *Gobj, score float64) {
+				value := scoreOf(score, weights[first])
+				for _, j := range order[1:] {
+					s, found := zuiFind(srcs[j], member)
+					if !found {
+						return
+					}
+					zunionInterAggregate(&value, scoreOf(s, weights[j]), aggregate)
+				}
+				zsetAdd(dstobj, value, member, 0)
+			})
+		}
+	} else {
+		scores := make(map[string]float64)
+		members := make(map[string]*Gobj)
+		for i, o := range srcs {
+			if o == nil {
+				continue
+			}
+			zuiForEach(o, func(member *Gobj, score float64) {
+				value := scoreOf(score, weights[i])
+				name := member.StrVal()
+				if cur, ok := scores[name]; ok {
+					zunionInterAggregate(&cur, value, aggregate)
+					scores[name] = cur
+				} else {
+					scores[name] = value
+					members[name] = member
+				}
+			})
+		}
+		for name, score := range scores {
+			zsetAdd(dstobj, score, members[name], 0)
+		}
+	}
+
+	dstkey := c.args[1]
+	size := zsetLength(dstobj)
+	if size > 0 {
+		c.db.setKey(dstkey, dstobj)
+		if op == SET_OP_UNION {
+			notifyKeyspaceEvent(NOTIFY_ZSET, "zunionstore", dstkey, c.db.id)
+		} else {
+			notifyKeyspaceEvent(NOTIFY_ZSET, "zinterstore", dstkey, c.db.id)
+		}
+	} else if c.db.dbDelete(dstkey) {
+		notifyKeyspaceEvent(NOTIFY_GENERIC, "del", dstkey, c.db.id)
+	}
+	signalModifiedKey(c, c.db, dstkey)
+	server.dirty++
+	c.AddReplyInt(size)
+}
+
+func zunionstoreCommand(c *GodisClient) {
+	zunionInterGenericCommand(c, SET_OP_UNION)
+}
+
+func zinterstoreCommand(c *GodisClient) {
+	zunionInterGenericCommand(c, SET_OP_INTER)
+}
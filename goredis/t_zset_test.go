@@ -0,0 +1,124 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+// 随机插入删除之后检查跳表的顺序和排名
+func TestSkiplist(t *testing.T) {
+	zsl := zslCreate()
+	scores := map[string]float64{}
+	for i := 0; i < 1000; i++ {
+		member := "m" + strconv.Itoa(rand.Intn(300))
+		score := float64(rand.Intn(50))
+		if cur, ok := scores[member]; ok {
+			if i%3 == 0 {
+				zsl.Delete(cur, CreateObject(GSTR, member))
+				delete(scores, member)
+			} else {
+				zsl.UpdateScore(cur, CreateObject(GSTR, member), score)
+				scores[member] = score
+			}
+			continue
+		}
+		zsl.Insert(score, CreateObject(GSTR, member))
+		scores[member] = score
+	}
+	var expect []string
+	for m := range scores {
+		expect = append(expect, m)
+	}
+	sort.Slice(expect, func(i, j int) bool {
+		a, b := expect[i], expect[j]
+		return scores[a] < scores[b] || (scores[a] == scores[b] && a < b)
+	})
+	if zsl.length != int64(len(expect)) {
+		t.Fatalf("expect length %d, got %d", len(expect), zsl.length)
+	}
+	x := zsl.header.level[0].forward
+	for i, m := range expect {
+		if x.member.StrVal() != m {
+			t.Fatalf("rank %d: expect %s, got %s", i, m, x.member.StrVal())
+		}
+		if rank := zsl.GetRank(x.score, x.member); rank != int64(i+1) {
+			t.Fatalf("%s: expect rank %d, got %d", m, i+1, rank)
+		}
+		if zsl.GetElementByRank(int64(i+1)) != x {
+			t.Fatalf("GetElementByRank(%d) mismatch", i+1)
+		}
+		x = x.level[0].forward
+	}
+}
+
+func TestZsetCommands(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	expectReply(t, c, ":3\r\n", "zadd", "z", "1", "a", "2", "b", "3", "c")
+	expectReply(t, c, ":2\r\n", "zadd", "z", "ch", "5", "a", "4", "d")
+	expectReply(t, c, ":0\r\n", "zadd", "z", "nx", "0", "a")
+	expectReply(t, c, ":0\r\n", "zadd", "z", "gt", "ch", "1", "a")
+	expectReply(t, c, "$-1\r\n", "zadd", "z", "lt", "incr", "1", "a")
+	expectReply(t, c, "$3\r\n5.5\r\n", "zincrby", "z", "0.5", "a")
+	expectReply(t, c, "-ERR XX and NX options at the same time are not compatible\r\n", "zadd", "z", "nx", "xx", "1", "a")
+	expectReply(t, c, "-ERR value is not a valid float\r\n", "zadd", "z", "x", "a")
+	expectReply(t, c, ":4\r\n", "zcard", "z")
+	expectReply(t, c, "$1\r\n2\r\n", "zscore", "z", "b")
+	expectReply(t, c, ":3\r\n", "zrank", "z", "a")
+	expectReply(t, c, ":0\r\n", "zrevrank", "z", "a")
+	expectReply(t, c, ":2\r\n", "zcount", "z", "(2", "4")
+	expectReply(t, c, "*4\r\n$1\r\nb\r\n$1\r\nc\r\n$1\r\nd\r\n$1\r\na\r\n", "zrange", "z", "0", "-1")
+	expectReply(t, c, "*4\r\n$1\r\na\r\n$3\r\n5.5\r\n$1\r\nd\r\n$1\r\n4\r\n", "zrange", "z", "0", "1", "rev", "withscores")
+	expectReply(t, c, "*2\r\n$1\r\nc\r\n$1\r\nd\r\n", "zrange", "z", "(2", "+inf", "byscore", "limit", "0", "2")
+	expectReply(t, c, "*2\r\n$1\r\nd\r\n$1\r\nc\r\n", "zrange", "z", "4", "3", "byscore", "rev")
+	expectReply(t, c, "*2\r\n$1\r\nc\r\n$1\r\nd\r\n", "zrangebyscore", "z", "3", "4")
+	expectReply(t, c, "-ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX\r\n", "zrange", "z", "0", "1", "limit", "0", "1")
+	expectReply(t, c, ":2\r\n", "zrem", "z", "b", "c", "x")
+	expectReply(t, c, "*2\r\n$1\r\nd\r\n$1\r\n4\r\n", "zpopmin", "z")
+	expectReply(t, c, "*2\r\n$1\r\na\r\n$3\r\n5.5\r\n", "zpopmax", "z", "5")
+	expectReply(t, c, ":0\r\n", "zcard", "z")
+	expectReply(t, c, "*0\r\n", "zpopmin", "z")
+}
+
+func TestZsetLexAndRemRange(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	c.run("zadd", "z", "0", "a", "0", "b", "0", "c", "0", "d", "0", "e")
+	expectReply(t, c, "*3\r\n$1\r\nb\r\n$1\r\nc\r\n$1\r\nd\r\n", "zrange", "z", "(a", "[d", "bylex")
+	expectReply(t, c, "*2\r\n$1\r\ne\r\n$1\r\nd\r\n", "zrange", "z", "+", "[c", "bylex", "rev", "limit", "0", "2")
+	expectReply(t, c, "*2\r\n$1\r\na\r\n$1\r\nb\r\n", "zrangebylex", "z", "-", "(c")
+	expectReply(t, c, "-ERR min or max not valid string range item\r\n", "zrangebylex", "z", "a", "c")
+	expectReply(t, c, ":2\r\n", "zremrangebylex", "z", "[b", "[c")
+	expectReply(t, c, ":1\r\n", "zremrangebyrank", "z", "-1", "-1")
+	expectReply(t, c, "*2\r\n$1\r\na\r\n$1\r\nd\r\n", "zrange", "z", "0", "-1")
+	c.run("zadd", "s", "1", "a", "2", "b", "3", "c")
+	expectReply(t, c, ":2\r\n", "zremrangebyscore", "s", "-inf", "(3")
+	expectReply(t, c, "*1\r\n$1\r\nc\r\n", "zrange", "s", "0", "-1")
+}
+
+func TestZunionInterStore(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	c.run("zadd", "z1", "1", "a", "2", "b", "3", "c")
+	c.run("zadd", "z2", "10", "b", "20", "c", "30", "d")
+	c.run("sadd", "s", "c", "d")
+	expectReply(t, c, ":4\r\n", "zunionstore", "out", "2", "z1", "z2", "weights", "2", "1")
+	expectReply(t, c, "*8\r\n$1\r\na\r\n$1\r\n2\r\n$1\r\nb\r\n$2\r\n14\r\n$1\r\nc\r\n$2\r\n26\r\n$1\r\nd\r\n$2\r\n30\r\n", "zrange", "out", "0", "-1", "withscores")
+	expectReply(t, c, ":1\r\n", "zinterstore", "out", "3", "z1", "z2", "s", "aggregate", "max")
+	expectReply(t, c, "*2\r\n$1\r\nc\r\n$2\r\n20\r\n", "zrange", "out", "0", "-1", "withscores")
+	expectReply(t, c, ":0\r\n", "zinterstore", "out", "2", "z1", "nosuch")
+	expectReply(t, c, ":0\r\n", "zcard", "out")
+	expectReply(t, c, "-ERR at least 1 input key is needed for 'zunionstore' command\r\n", "zunionstore", "out", "0", "z1")
+}
+
+func TestZsetResp3(t *testing.T) {
+	initTestServer(t)
+	c := newTestClient(t)
+	c.resp = 3
+	c.run("zadd", "z", "1", "a", "2", "b")
+	expectReply(t, c, "*2\r\n*2\r\n$1\r\na\r\n,1\r\n*2\r\n$1\r\nb\r\n,2\r\n", "zrange", "z", "0", "-1", "withscores")
+	expectReply(t, c, "*2\r\n$1\r\na\r\n,1\r\n", "zpopmin", "z")
+	expectReply(t, c, "*1\r\n*2\r\n$1\r\nb\r\n,2\r\n", "zpopmin", "z", "1")
+}
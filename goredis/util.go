@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// 返回 n 个随机的十六进制字符 用于复制 ID 和集群节点 ID
+func getRandomHexChars(n int) string {
+	buf := make([]byte, (n+1)/2)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)[:n]
+}
+
+/*
+glob 风格的匹配 和 Redis 的 stringmatchlen 一致
+支持 * ? [abc] [^a] [a-z] 以及 \ 转义
+*/
+func stringmatch(pattern, str string, nocase bool) bool {
+	p, s := 0, 0
+	for p < len(pattern) && s <= len(str) {
+		switch pattern[p] {
+		case '*':
+			// 合并连续的 *
+			for p+1 < len(pattern) && pattern[p+1] == '*' {
+				p++
+			}
+			if p+1 == len(pattern) {
+				return true
+			}
+			for ; s < len(str); s++ {
+				if stringmatch(pattern[p+1:], str[s:], nocase) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == len(str) {
+				return false
+			}
+			s++
+		case '[':
+			if s == len(str) {
+				return false
+			}
+			p++
+			not := p < len(pattern) && pattern[p] == '^'
+			if not {
+				p++
+			}
+			match := false
+			for p < len(pattern) && pattern[p] != ']' {
+				if pattern[p] == '\\' && p+1 < len(pattern) {
+					p++
+					if equalByte(pattern[p], str[s], nocase) {
+						match = true
+					}
+				} else if p+2 < len(pattern) && pattern[p+1] == '-' {
+					start, end := pattern[p], pattern[p+2]
+					if start > end {
+						start, end = end, start
+					}
+					ch := str[s]
+					if nocase {
+						start, end, ch = lowerByte(start), lowerByte(end), lowerByte(ch)
+					}
+					if ch >= start && ch <= end {
+						match = true
+					}
+					p += 2
+				} else if equalByte(pattern[p], str[s], nocase) {
+					match = true
+				}
+				p++
+			}
+			// 缺少 ] 时视为在模式末尾结束
+			if p == len(pattern) {
+				p--
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false
+			}
+			s++
+		case '\\':
+			if p+1 < len(pattern) {
+				p++
+			}
+			fallthrough
+		default:
+			if s == len(str) || !equalByte(pattern[p], str[s], nocase) {
+				return false
+			}
+			s++
+		}
+		p++
+	}
+	return p == len(pattern) && s == len(str)
+}
+
+func lowerByte(b byte) byte {
+	if b >= 'A' && b <= 'Z' {
+		return b + 'a' - 'A'
+	}
+	return b
+}
+
+func equalByte(a, b byte, nocase bool) bool {
+	if nocase {
+		return lowerByte(a) == lowerByte(b)
+	}
+	return a == b
+}